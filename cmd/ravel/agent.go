@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/Comcast/Ravel/pkg/agent"
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+// Agent runs the privileged agent that executes the kernel operations of
+// directors and realservers running without NET_ADMIN
+func Agent(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
+
+	var cmd = &cobra.Command{
+		Use:           "agent",
+		Short:         "execute kernel operations for unprivileged directors and realservers",
+		SilenceUsage:  false,
+		SilenceErrors: true,
+		Long: `
+agent runs with NET_ADMIN on the host network and serves --agent-socket.
+directors and realservers started with the same --agent-socket send it the
+ipvsadm, ip, iptables, conntrack and sysctl operations they would otherwise
+execute themselves. the agent holds no configuration; it only executes the
+operations that its fixed policy allows: iptables only changes the chains of
+--iptables-chain and the jumps to them, restores only run with --noflush, ip
+only changes the addresses of the dummy and vrf devices ravel labeled, and
+routes and rules only go in tables other than the node's own.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			config := NewConfig(cmd.Flags())
+			if config.AgentSocket == "" {
+				return fmt.Errorf("agent-socket must be set")
+			}
+			if config.IPTablesChain == "" {
+				return fmt.Errorf("iptables-chain must be set")
+			}
+			return agent.Serve(ctx, config.AgentSocket, config.IPTablesChain, system.NewCommandRunner(), system.NewSysctl(), logger)
+		},
+	}
+
+	return cmd
+}
+
+// dialAgent connects to the privileged agent when config delegates kernel
+// operations to one. It returns nil when they are executed directly.
+func dialAgent(config *Config, logger logrus.FieldLogger) (*agent.Client, error) {
+	if config.AgentSocket == "" {
+		return nil, nil
+	}
+	client, err := agent.Dial(config.AgentSocket)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("executing kernel operations through the agent at %s", config.AgentSocket)
+	return client, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/Comcast/Ravel/pkg/announce"
+	"github.com/Comcast/Ravel/pkg/bgp"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+// newAnnouncer builds the announcement strategies enabled in config. arp and ndp
+// are always available, except for arp without IPv4; bgp and vrrp are added when
+// enabled. arp sends gratuitous arps from a raw socket unless arping is
+// selected. The vrrp election runs until ctx is done, and failing to join it
+// is an error.
+func newAnnouncer(ctx context.Context, config *Config, ip system.AddressManager, logger logrus.FieldLogger) (*announce.Set, error) {
+	arp, ndp := newNeighborAnnouncers(config, ip, stats.NewWorkerStateMetrics(stats.KindIpvsMaster, config.ConfigKey), logger)
+	if config.IPv6Only {
+		announcers := []announce.Announcer{ndp}
+		if config.Announce.BGP {
+			announcers = append(announcers, announce.NewBGP(bgp.NewBGPDController(config.BGP.Binary, logger), config.BGP.Communities))
+		}
+		return announce.NewSet("", announce.NDP, logger, announcers...)
+	}
+
+	announcers := []announce.Announcer{arp, ndp}
+	if config.Announce.BGP {
+		announcers = append(announcers, announce.NewBGP(bgp.NewBGPDController(config.BGP.Binary, logger), config.BGP.Communities))
+	}
+	if config.Announce.VRRP.Enabled {
+		c := config.Announce.VRRP
+		vrrp := announce.NewVRRP(config.Net.Interface, uint8(c.VRID), uint8(c.Priority), c.Interval, c.Preempt, arp, logger)
+		if err := vrrp.Open(); err != nil {
+			return nil, fmt.Errorf("unable to join vrrp election on %s. %v", config.Net.Interface, err)
+		}
+		go func() {
+			if err := vrrp.Run(ctx); err != nil {
+				logger.Errorf("vrrp election stopped. VIPs announced with vrrp will not fail over. %v", err)
+			}
+		}()
+		announcers = append(announcers, vrrp)
+	}
+	return announce.NewSet(config.Announce.Default, announce.NDP, logger, announcers...)
+}
+
+// newNeighborAnnouncers builds the arp and ndp announcers of config. arp is nil
+// without IPv4. metrics may be nil.
+func newNeighborAnnouncers(config *Config, ip system.AddressManager, metrics announce.Metrics, logger logrus.FieldLogger) (arp, ndp announce.Announcer) {
+	ndp = announce.NewNDP(ip)
+	if config.IPv6Only {
+		return nil, ndp
+	}
+	if config.Announce.Arping {
+		return announce.NewARP(ip), ndp
+	}
+	return announce.NewGARP(config.Net.Interface, metrics, logger), ndp
+}
+
+// Announce sends gratuitous arps and neighbor advertisements for VIPs on demand
+func Announce(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
+
+	var cmd = &cobra.Command{
+		Use:           "announce",
+		Short:         "send gratuitous arps and neighbor advertisements for VIPs",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Long: `
+announce sends a burst of gratuitous arps for the IPv4 VIPs given with --vip,
+and unsolicited neighbor advertisements for the IPv6 ones, out of the primary
+interface, with the announcers the directors use. It forces switches and
+gateways to relearn which node owns a VIP during an incident, without
+restarting the director.
+
+i.e. ravel announce --compute-iface eth0 --vip 10.54.213.165 --count 5`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			config := NewConfig(cmd.Flags())
+			vips, _ := cmd.Flags().GetStringSlice("vip")
+			count, _ := cmd.Flags().GetInt("count")
+			interval, _ := cmd.Flags().GetDuration("interval")
+
+			if len(vips) == 0 {
+				return fmt.Errorf("announce: at least one --vip is required")
+			}
+			if count < 1 {
+				return fmt.Errorf("announce: --count must be at least 1. saw %d", count)
+			}
+			var vips4, vips6 []string
+			for _, vip := range vips {
+				addr := net.ParseIP(vip)
+				switch {
+				case addr == nil:
+					return fmt.Errorf("announce: %q is not an IP address", vip)
+				case addr.To4() != nil:
+					if config.IPv6Only {
+						return fmt.Errorf("announce: %s is an IPv4 address, which can't be announced with --ipv6-only", vip)
+					}
+					vips4 = append(vips4, vip)
+				default:
+					vips6 = append(vips6, vip)
+				}
+			}
+
+			ip, err := system.NewIP(ctx, config.Net.Interface, config.Net.Gateway, config.Arp.PrimaryAnnounce, config.Arp.PrimaryIgnore, logger)
+			if err != nil {
+				return err
+			}
+			arp, ndp := newNeighborAnnouncers(config, ip, nil, logger)
+			announcers := []announce.Announcer{ndp}
+			default4 := ""
+			if arp != nil {
+				announcers = append(announcers, arp)
+				default4 = announce.ARP
+			}
+			set, err := announce.NewSet(default4, announce.NDP, logger, announcers...)
+			if err != nil {
+				return err
+			}
+			return set.Burst(ctx, vips4, vips6, count, interval)
+		},
+	}
+
+	cmd.Flags().StringSlice("vip", []string{}, "the VIPs to announce. may be repeated or comma separated")
+	cmd.Flags().Int("count", 3, "the number of announcements to send for each VIP")
+	cmd.Flags().Duration("interval", time.Second, "the time between announcements")
+
+	return cmd
+}
@@ -3,13 +3,19 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/Comcast/Ravel/pkg/bgp"
+	"github.com/Comcast/Ravel/pkg/chaos"
+	"github.com/Comcast/Ravel/pkg/iptables"
 	"github.com/Comcast/Ravel/pkg/stats"
 	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
 	"github.com/Comcast/Ravel/pkg/watcher"
 )
 
@@ -32,24 +38,51 @@ func BGP_DIRECTOR(ctx context.Context, logger logrus.FieldLogger) *cobra.Command
 			if err := config.Invalid(); err != nil {
 				return err
 			}
+			ifaceChanged, err := detectInterface(ctx, config, logger)
+			if err != nil {
+				return err
+			}
 			log.Debugln("BGP_DIRECTOR: Done validating config flags")
 
 			// write IPVS Sysctl flags to director node
-			if err := config.IPVS.WriteToNode(); err != nil {
+			if err := config.IPVS.WriteToNode(nil); err != nil {
 				return err
 			}
 			log.Debugln("BGP_DIRECTOR: Done writing IPVS proc settings to host")
 
 			// instantiate a watcher
 			log.Infoln("BGP_DIRECTOR: Starting configuration watcher")
-			watcher, err := watcher.NewWatcher(ctx, config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey, stats.KindBGPDirector, config.DefaultListener.Service, config.DefaultListener.Port, logger)
+			watcher, err := watcher.NewWatcher(ctx, config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey, stats.KindBGPDirector, config.DefaultListener.Service, config.DefaultListener.Port, config.WatcherAPI(), logger)
 			if err != nil {
 				return err
 			}
+			watcher.SetReconnect(config.WatchReconnect(), config.WatchRelistAfter)
+			if config.ShrinkGuardPercent > 0 {
+				watcher.SetShrinkGuard(config.ShrinkGuardPercent, stats.NewWorkerStateMetrics(stats.KindBGPDirector, config.ConfigKey))
+			}
+			if config.ConfigCache != "" {
+				key, err := config.CacheKey()
+				if err != nil {
+					return err
+				}
+				if err := watcher.SetCache(config.ConfigCache, key); err != nil {
+					logger.Warnf("BGP: starting without the config cache. %v", err)
+				}
+			}
+			if config.TerminatingEndpoints {
+				watcher.SetTerminatingEndpoints()
+			}
+			if config.ExternalDNSInterval > 0 {
+				go watcher.PublishVIPs(ctx, config.ExternalDNSInterval)
+			}
+
+			if config.Pprof {
+				util.RegisterDebugHandlers(http.DefaultServeMux)
+			}
 
 			// and Stats for the BGP_DIRECTOR VIPs.
 			log.Infoln("BGP_DIRECTOR: creating BGP_DIRECTOR stats")
-			s, err := stats.NewStats(ctx, stats.KindBGPDirector, config.Stats.Interface, config.Stats.ListenAddr, config.Stats.ListenPort, config.Stats.Interval, logger)
+			s, err := stats.NewStats(ctx, stats.KindBGPDirector, config.Stats.Interface, config.Stats.ListenAddr, config.Stats.ListenPort, config.Stats.Interval, config.Stats.Sinks, logger)
 			if err != nil {
 				return fmt.Errorf("failed to initialize metrics. %v", err)
 			}
@@ -82,6 +115,74 @@ func BGP_DIRECTOR(ctx context.Context, logger logrus.FieldLogger) *cobra.Command
 			if err != nil {
 				return err
 			}
+			if config.ConntrackFlush {
+				ipvs.SetConntrack(system.NewConntrack(ctx, logger))
+			}
+			if config.IPVS.RemovalBudget > 0 {
+				ipvs.SetRemovalBudget(config.IPVS.RemovalBudget, stats.NewWorkerStateMetrics(stats.KindBGPDirector, config.ConfigKey))
+			}
+			if config.IPVS.AdaptiveWeightInterval > 0 {
+				ipvs.SetAdaptiveWeights(config.IPVS.AdaptiveWeightInterval)
+			}
+			ipvs.SetWeightedLimits(config.IPVS.WeightedLimits)
+			if config.IPVS.MaxActiveConns > 0 {
+				ipvs.SetSaturationGuard(config.IPVS.MaxActiveConns, config.IPVS.SaturationInterval, stats.NewWorkerStateMetrics(stats.KindBGPDirector, config.ConfigKey))
+			}
+			if config.IPVS.DrainRamp > 0 {
+				ipvs.SetNodeDrain(config.IPVS.DrainRamp, stats.NewWorkerStateMetrics(stats.KindBGPDirector, config.ConfigKey))
+			}
+			if config.IPVS.Ejection.Interval > 0 {
+				ipvs.SetEjection(config.IPVS.Ejection, stats.NewWorkerStateMetrics(stats.KindBGPDirector, config.ConfigKey))
+			}
+			if config.IPVS.LastBackendPolicy != system.LastBackendAllow {
+				ipvs.SetLastBackendGuard(config.IPVS.LastBackendPolicy, stats.NewWorkerStateMetrics(stats.KindBGPDirector, config.ConfigKey))
+			}
+			if config.ShrinkGuardPercent > 0 {
+				ipvs.SetShrinkGuard(config.ShrinkGuardPercent, stats.NewWorkerStateMetrics(stats.KindBGPDirector, config.ConfigKey))
+			}
+			if config.ApplyVerify {
+				ipvs.SetVerify(config.ApplyVerifyRetries, stats.NewWorkerStateMetrics(stats.KindBGPDirector, config.ConfigKey))
+			}
+			if config.FlowCollector != "" {
+				flows := system.NewFlowExporter(ctx, config.FlowCollector, config.FlowInterval, config.FlowSampleRate, config.Net.PrimaryIP, func() *types.ClusterConfig {
+					c, _ := watcher.Current()
+					return c
+				}, stats.NewWorkerStateMetrics(stats.KindBGPDirector, config.ConfigKey), logger)
+				go flows.Run()
+			}
+
+			// the iptables manager writes the conntrack bypass rules in the raw table
+			// and, in ecmp mode, where every director in the set programs identical
+			// fwmark services, the mangle rules that mark VIP traffic
+			ipt, err := iptables.NewIPTables(ctx, stats.KindBGPDirector, config.ConfigKey, config.PodCIDRMasq, config.IPTablesChain, config.IPTablesMasq, logger)
+			if err != nil {
+				return err
+			}
+			ipt.SetLockWait(config.IPTablesLockWait, config.IPTablesLockRetries)
+			if config.ECMP.Enabled {
+				ipvs.EnableECMP(config.ECMP.FwmarkBase)
+			}
+			if config.SIITInstance != "" {
+				ipt.EnableTranslation(config.SIITInstance, config.SIITPool6)
+				if err := ipt.CheckTranslation(); err != nil {
+					return err
+				}
+			}
+			if config.TProxyMark != 0 {
+				ipt.EnableTProxy(config.TProxyMark, config.TProxyTable)
+			}
+			if config.MirrorMark != 0 {
+				ipt.EnableMirror(config.MirrorMark)
+			}
+			if config.RuleDiffLog != "" {
+				diffLog, err := util.NewDiffLog(config.RuleDiffLog, int64(config.RuleDiffLogMaxSize)<<20, config.RuleDiffLogMaxFiles, logger)
+				if err != nil {
+					return err
+				}
+				defer diffLog.Close()
+				ipt.SetDiffLog(diffLog)
+				ipvs.SetDiffLog(diffLog)
+			}
 
 			// instantiate an IP helper for loopback
 			log.Infoln("BGP_DIRECTOR: Initializing loopback IP helper")
@@ -89,9 +190,16 @@ func BGP_DIRECTOR(ctx context.Context, logger logrus.FieldLogger) *cobra.Command
 			if err != nil {
 				return err
 			}
-			if err := ipLoopback.SetARP(); err != nil {
-				return err
+			if !config.IPv6Only {
+				if err := ipLoopback.SetARP(); err != nil {
+					return err
+				}
 			}
+			mtuOverrides, _ := system.ParseMTUOverrides(config.Net.MTUOverrides)
+			ipLoopback.SetMTUParent(config.Net.Interface)
+			ipLoopback.SetMTUOverrides(mtuOverrides)
+			ipLoopback.SetAdoptUnlabeled(config.Net.AdoptUnlabeled)
+			ipLoopback.SetMTUMetrics(stats.NewWorkerStateMetrics(stats.KindBGPDirector, config.ConfigKey))
 
 			// instantiate an IP helper for primary interface
 			log.Infoln("BGP_DIRECTOR: initializing primary IP helper")
@@ -100,29 +208,62 @@ func BGP_DIRECTOR(ctx context.Context, logger logrus.FieldLogger) *cobra.Command
 				return err
 			}
 
-			log.Debugln("BGP_DIRECTOR: Setting ARP on primary IP")
-			if err := ipPrimary.SetARP(); err != nil {
-				return err
+			// without IPv4 there is no arp to set
+			if !config.IPv6Only {
+				log.Debugln("BGP_DIRECTOR: Setting ARP on primary IP")
+				if err := ipPrimary.SetARP(); err != nil {
+					return err
+				}
+			}
+
+			// optionally wrap the system helpers with failure injection
+			var rules iptables.RuleApplier = ipt
+			if config.Chaos.Enabled {
+				injector := chaos.NewInjector(config.Chaos.Config, stats.KindBGPDirector, config.ConfigKey, logger)
+				ipvs.SetCommandRunner(injector.CommandRunner(ipvs.CommandRunner()))
+				rules = injector.RuleApplier(rules)
+				go injector.DisconnectWatcher(ctx, watcher)
 			}
 
 			// instantiate BGP_DIRECTOR handler
 			log.Infoln("BGP_DIRECTOR: initializing BGP_DIRECTOR helper")
 			bgpController := bgp.NewBGPDController(config.BGP.Binary, logger)
-			worker, err := bgp.NewBGPWorker(ctx, config.ConfigKey, watcher, ipLoopback, ipPrimary, ipvs, bgpController, config.BGP.Communities, logger)
+			worker, err := bgp.NewBGPWorker(ctx, config.NodeName, config.ConfigKey, watcher, ipLoopback, ipPrimary, ipvs, rules, bgpController, config.BGP.Communities, config.ForcedReconfigureEvery(5*time.Second), config.IPv6Only, config.BGP.WithdrawOnPanic, config.BGP.WithdrawStaleAfter, config.Breaker(), config.BGP.WithdrawAfterApplyFailures, config.ConfigMapNamespace, config.DirectorPool(), logger)
 			if err != nil {
 				return err
 			}
 
+			// a standby starts with its routes withdrawn
+			if config.BGP.StandbyPrimary != "" {
+				worker.Demote()
+			}
+
 			log.Debugln("BGP_DIRECTOR: Starting BGP_DIRECTOR worker...")
 			err = worker.Start()
 			if err != nil {
 				return err
 			}
 
+			if config.NodeRoleInterval > 0 {
+				if err := labelNodeRole(ctx, config, worker.Active, logger); err != nil {
+					return err
+				}
+			}
+
+			if config.BGP.StandbyPrimary != "" {
+				standby := bgp.NewStandby(config.BGP.StandbyPrimary, config.BGP.StandbyProbeInterval, config.BGP.StandbyFailures, config.BGP.StandbyHoldDown, logger)
+				go standby.Run(ctx, worker)
+			}
+
 			log.Debugln("BGP_DIRECTOR: Waiting for shutdown")
 
-			// catching exit signals sent from the parent context
-			<-ctx.Done()
+			select {
+			case err := <-ifaceChanged:
+				worker.Stop()
+				return err
+			case <-ctx.Done():
+				// catching exit signals sent from the parent context
+			}
 			return worker.Stop()
 		},
 	}
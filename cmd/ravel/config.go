@@ -1,14 +1,29 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/Comcast/Ravel/pkg/chaos"
+	"github.com/Comcast/Ravel/pkg/director"
+	"github.com/Comcast/Ravel/pkg/mtls"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+	"github.com/Comcast/Ravel/pkg/watcher"
+	"github.com/Comcast/Ravel/pkg/xdp"
 )
 
 type Config struct {
@@ -23,8 +38,201 @@ type Config struct {
 	PodCIDRMasq  string
 	IPTablesMasq bool
 
-	// Periodic reconfigure
-	ForcedReconfigure bool
+	// IPTablesScopedRestore only writes the ravel chains that changed on each
+	// restore instead of the whole nat table
+	IPTablesScopedRestore bool
+
+	// IPTablesLockWait is how long iptables commands and restores wait for the
+	// xtables lock, and IPTablesLockRetries how often those that still fail on
+	// it are retried
+	IPTablesLockWait    time.Duration
+	IPTablesLockRetries int
+
+	// Periodic reconfigure. ForcedReconfigure enables it on realservers, where
+	// it is off by default. ForcedReconfigureInterval overrides the default
+	// interval of each mode, and ForcedReconfigureDisabled turns it off everywhere.
+	ForcedReconfigure         bool
+	ForcedReconfigureInterval time.Duration
+	ForcedReconfigureDisabled bool
+
+	// IPv6Only runs the director and bgp workers in a cluster with no IPv4 at
+	// all, programming only the v6 VIPs
+	IPv6Only bool
+
+	// SIITInstance is the jool_siit instance that translates VIP ports into
+	// the family of their paired VIP, with client addresses embedded in
+	// SIITPool6. Empty disables translation.
+	SIITInstance string
+	SIITPool6    string
+
+	// TProxyMark is the packet mark that sends VIP ports to a local transparent
+	// proxy through the routing table TProxyTable. Zero disables it.
+	TProxyMark  int
+	TProxyTable int
+
+	// MirrorMark is the connmark bit of the sampled connections of mirrored
+	// VIP ports. Zero disables mirroring.
+	MirrorMark int
+
+	// DataPlane forwards VIP traffic with ipvs, or experimentally from an XDP
+	// program configured by XDP
+	DataPlane string
+	XDP       xdp.Config
+
+	// ConntrackFlush deletes the conntrack entries of removed virtual services
+	// and backends. Gets set by --conntrack-flush, and should be turned off when
+	// VIP traffic is exempted with NOTRACK.
+	ConntrackFlush bool
+
+	// FlowCollector is the host:port IPFIX records of the VIP ports with
+	// flowExport set are sent to, every FlowInterval, for one in every
+	// FlowSampleRate connections. Empty disables flow export.
+	FlowCollector  string
+	FlowInterval   time.Duration
+	FlowSampleRate int
+
+	// PortConflictCheck reports VIP ports that collide with host listeners or
+	// the kube-proxy NodePortRange on realservers, and PortConflictWithhold stops
+	// forwarding them. Gets set by --port-conflict-check and --port-conflict-withhold
+	PortConflictCheck    bool
+	PortConflictWithhold bool
+	NodePortRange        string
+
+	// WeightEndpoint serves the VIP ports a realserver is ready to serve, and
+	// at what weight, for the health monitors of external load balancers
+	WeightEndpoint bool
+
+	// Probe is the realserver self-probe through its own VIP rules
+	Probe ProbeConfig
+
+	// FreezeWindows are the semicolon separated windows during which the director
+	// only applies removals, see util.ParseFreezeSchedule
+	FreezeWindows string
+
+	// ShrinkGuardPercent is the largest percentage of VIP ports or ipvs backends
+	// a single change may remove before it is refused. 0 disables the guard.
+	ShrinkGuardPercent int
+
+	// TerminatingEndpoints follows endpointslices, so that VIP ports whose pods
+	// are all terminating but still serving stay configured while they drain
+	TerminatingEndpoints bool
+
+	// KubeProxyMode is the mode kube-proxy runs in on the node, or auto to detect
+	// it by asking kube-proxy on KubeProxyMetricsAddr and then from the kernel
+	KubeProxyMode        string
+	KubeProxyMetricsAddr string
+
+	// ControlAddr is where the director serves the control api, see
+	// pkg/control. Empty disables it.
+	ControlAddr string
+
+	// ControlTokenFile is a static token file, in the format of the api
+	// server's, whose tokens log in to the control api. ControlTokenReview
+	// logs them in with TokenReviews of ControlTokenAudiences instead.
+	ControlTokenFile      string
+	ControlTokenReview    bool
+	ControlTokenAudiences []string
+
+	// ControlRoles are the verb=user:name,group:name rules of who may call the
+	// methods of each verb of the control api, see control.ParseRoles.
+	// ControlAccessReview asks the RBAC of the cluster instead.
+	ControlRoles        []string
+	ControlAccessReview bool
+
+	// ControlAuditLog is the file every call that changes the director is
+	// recorded in, besides the log. Empty records them in the log only.
+	ControlAuditLog string
+
+	// TLS secures the control api, the dashboard's polls of it, and the
+	// watch plane with mutual TLS, see pkg/mtls
+	TLS mtls.Config
+
+	// AgentSocket is the unix socket of the privileged agent that executes the
+	// kernel operations of this process, so that it can run without NET_ADMIN.
+	// Empty executes them directly.
+	AgentSocket string
+
+	// HandoffSocket is the unix socket through which a new process takes the
+	// node over from the running one without flushing its kernel state. Empty
+	// disables handoff.
+	HandoffSocket string
+
+	// ApplyVerify reads iptables and ipvs back after every apply and applies
+	// what didn't take effect again, up to ApplyVerifyRetries times
+	ApplyVerify        bool
+	ApplyVerifyRetries int
+
+	// Supervision of the director's goroutines. A failed goroutine is restarted
+	// after RestartBackoff, doubling up to RestartBackoffMax. The apply loop fails
+	// after RestartAfterApplyFailures consecutive failed applies, and the watches
+	// are reconnected after WatchStaleTimeout without an event. 0 disables either.
+	RestartBackoff            time.Duration
+	RestartBackoffMax         time.Duration
+	RestartAfterApplyFailures int
+	WatchStaleTimeout         time.Duration
+
+	// BreakAfterApplyFailures consecutive failed applies open the breaker of
+	// the director and bgp workers, which retries after BreakBackoff, doubling
+	// up to BreakBackoffMax, rather than every tick, and reports the node
+	// unhealthy until an apply succeeds. 0 retries every tick.
+	BreakAfterApplyFailures int
+	BreakBackoff            time.Duration
+	BreakBackoffMax         time.Duration
+
+	// WatchdogInterval is how often the director polls the iptables rules and
+	// ipvs entries it applied for changes made by something else. 0 disables it.
+	WatchdogInterval time.Duration
+
+	// ParityInterval is how often a realserver checks its iptables chains,
+	// sysctls and VIP devices, repairing the ones that drifted. 0 disables it.
+	ParityInterval time.Duration
+
+	// LinkRepair reconciles the director at once when VIP addresses vanish
+	// or the primary interface comes back up, and announces the VIPs again
+	// when it is a bond or team that fails over
+	LinkRepair bool
+
+	// NodeRoleInterval is how often the director checks whether it is active,
+	// labeling its node with types.RoleLabel while it is. 0 disables the label.
+	NodeRoleInterval time.Duration
+
+	// ExternalDNSInterval is how often the director writes the VIPs of each
+	// service into the annotations external-dns reads. 0 disables it.
+	ExternalDNSInterval time.Duration
+
+	// ParityBudget, AddressesBudget and ServicesBudget bound how long each
+	// stage of a director reconcile may run before its commands are killed.
+	// 0 leaves a stage bounded only by the timeouts of its commands.
+	ParityBudget    time.Duration
+	AddressesBudget time.Duration
+	ServicesBudget  time.Duration
+
+	// WatchReconnectBackoff is the wait before re-establishing the kubernetes
+	// watches of any worker after they fail, doubling up to
+	// WatchReconnectBackoffMax. Every WatchRelistAfter consecutive failures,
+	// every resource is listed again. 0 never relists.
+	WatchReconnectBackoff    time.Duration
+	WatchReconnectBackoffMax time.Duration
+	WatchRelistAfter         int
+
+	// RuleDiffLog is where the diff of the iptables and ipvs rules of every
+	// apply is written: empty for nowhere, debug for the log, or a file that is
+	// rotated at RuleDiffLogMaxSize megabytes, keeping RuleDiffLogMaxFiles old ones
+	RuleDiffLog         string
+	RuleDiffLogMaxSize  int
+	RuleDiffLogMaxFiles int
+
+	// ConfigCache is the file a worker keeps its last known config in, so
+	// that it can start while the api server is unreachable
+	ConfigCache string
+
+	// ConfigCacheKey is a file holding the key the config cache is signed
+	// with. Gets set by --config-cache-key
+	ConfigCacheKey string
+
+	// Pprof serves profiles and runtime stats under /debug on the metrics and
+	// health ports
+	Pprof bool
 
 	// This is the IP address of the node - the node as it is known to Kubernetes
 	NodeName string
@@ -32,6 +240,11 @@ type Config struct {
 	// This is the location on disk of a kubeconfig
 	KubeConfigFile string
 
+	// KubeNodeSelector limits the nodes watched to those it selects, and
+	// KubeProtobuf asks the api server for protobuf, see watcher.APIOptions
+	KubeNodeSelector string
+	KubeProtobuf     bool
+
 	// This is the IPTables prefix to use.
 	IPTablesChain string
 
@@ -50,6 +263,12 @@ type Config struct {
 	DefaultListener DefaultListenerConfig
 
 	BGP BGPConfig
+
+	ECMP ECMPConfig
+
+	Announce AnnounceConfig
+
+	Chaos ChaosConfig
 }
 
 func (c *Config) Invalid() error {
@@ -62,9 +281,338 @@ func (c *Config) Invalid() error {
 	if c.NodeName == "" {
 		return fmt.Errorf("nodename must be set. this is the ip address of the node, or its name in kubernetes")
 	}
+	if c.ForcedReconfigureInterval < 0 {
+		return fmt.Errorf("forced-reconfigure-interval must not be negative")
+	}
+	if _, err := system.ParsePortRange(c.NodePortRange); err != nil {
+		return fmt.Errorf("nodeport-range is invalid. %v", err)
+	}
+	if c.PortConflictWithhold && !c.PortConflictCheck {
+		return fmt.Errorf("port-conflict-withhold needs port-conflict-check")
+	}
+	if c.ConfigCacheKey != "" && c.ConfigCache == "" {
+		return fmt.Errorf("config-cache-key needs config-cache")
+	}
+	if !system.ValidKubeProxyMode(c.KubeProxyMode) {
+		return fmt.Errorf("kube-proxy-mode must be auto, iptables, ipvs, nftables or none")
+	}
+	if c.Net.VIPProbeTimeout < 0 {
+		return fmt.Errorf("vip-probe-timeout must not be negative")
+	}
+	if _, err := system.ParseMTUOverrides(c.Net.MTUOverrides); err != nil {
+		return fmt.Errorf("mtu-override is invalid. %v", err)
+	}
+	if err := system.ValidInterfaceStrategies(c.Net.InterfaceDetect); err != nil {
+		return fmt.Errorf("compute-iface-detect is invalid. %v", err)
+	}
+	if c.Net.InterfaceInterval < 0 {
+		return fmt.Errorf("compute-iface-interval must not be negative")
+	}
+	if c.IPVS.RemovalBudget < 0 {
+		return fmt.Errorf("ipvs-removal-budget must not be negative")
+	}
+	if c.IPVS.AdaptiveWeightInterval < 0 {
+		return fmt.Errorf("ipvs-adaptive-weight-interval must not be negative")
+	}
+	if c.IPVS.MaxActiveConns < 0 {
+		return fmt.Errorf("ipvs-max-active-conns must not be negative")
+	}
+	if c.IPVS.MaxActiveConns > 0 && c.IPVS.SaturationInterval <= 0 {
+		return fmt.Errorf("ipvs-saturation-interval must be positive when ipvs-max-active-conns is set")
+	}
+	if c.FlowCollector != "" {
+		if _, _, err := net.SplitHostPort(c.FlowCollector); err != nil {
+			return fmt.Errorf("flow-collector must be a host:port. %v", err)
+		}
+		if c.FlowInterval <= 0 {
+			return fmt.Errorf("flow-interval must be positive when flow-collector is set")
+		}
+		if c.FlowSampleRate < 1 {
+			return fmt.Errorf("flow-sample-rate must be at least 1")
+		}
+	}
+	if c.IPVS.DrainRamp < 0 {
+		return fmt.Errorf("ipvs-drain-ramp must not be negative")
+	}
+	if e := c.IPVS.Ejection; e.Interval < 0 {
+		return fmt.Errorf("ipvs-ejection-interval must not be negative")
+	} else if e.Interval > 0 {
+		if e.MinFailures < 1 {
+			return fmt.Errorf("ipvs-ejection-min-failures must be at least 1")
+		}
+		if e.FailurePercent < 1 || e.FailurePercent > 100 {
+			return fmt.Errorf("ipvs-ejection-failure-percent must be between 1 and 100")
+		}
+		if e.Duration <= 0 {
+			return fmt.Errorf("ipvs-ejection-duration must be positive")
+		}
+		if e.MaxPercent < 0 || e.MaxPercent > 100 {
+			return fmt.Errorf("ipvs-ejection-max-percent must be between 0 and 100")
+		}
+	}
+	if err := system.ValidLastBackendPolicy(c.IPVS.LastBackendPolicy); err != nil {
+		return fmt.Errorf("ipvs-last-backend-policy is invalid. %v", err)
+	}
+	if c.IPTablesLockWait < 0 {
+		return fmt.Errorf("iptables-lock-wait must not be negative")
+	}
+	if c.IPTablesLockRetries < 0 {
+		return fmt.Errorf("iptables-lock-retries must not be negative")
+	}
+	if err := c.Stats.Sinks.Validate(); err != nil {
+		return fmt.Errorf("stats-sinks is invalid. %v", err)
+	}
+	if c.ShrinkGuardPercent < 0 || c.ShrinkGuardPercent > 100 {
+		return fmt.Errorf("shrink-guard-percent must be between 0 and 100")
+	}
+	if c.ApplyVerifyRetries < 0 {
+		return fmt.Errorf("apply-verify-retries must not be negative")
+	}
+	if c.RestartBackoff <= 0 || c.RestartBackoffMax < c.RestartBackoff {
+		return fmt.Errorf("restart-backoff must be positive and no greater than restart-backoff-max")
+	}
+	if c.RestartAfterApplyFailures < 0 {
+		return fmt.Errorf("restart-after-apply-failures must not be negative")
+	}
+	if c.BreakAfterApplyFailures < 0 {
+		return fmt.Errorf("break-after-apply-failures must not be negative")
+	}
+	if c.BreakBackoff <= 0 || c.BreakBackoffMax < c.BreakBackoff {
+		return fmt.Errorf("break-backoff must be positive and no greater than break-backoff-max")
+	}
+	if c.WatchdogInterval < 0 {
+		return fmt.Errorf("watchdog-interval must not be negative")
+	}
+	if c.ParityInterval < 0 {
+		return fmt.Errorf("parity-interval must not be negative")
+	}
+	if c.NodeRoleInterval < 0 {
+		return fmt.Errorf("node-role-interval must not be negative")
+	}
+	if c.ExternalDNSInterval < 0 {
+		return fmt.Errorf("external-dns-interval must not be negative")
+	}
+	if c.ParityBudget < 0 || c.AddressesBudget < 0 || c.ServicesBudget < 0 {
+		return fmt.Errorf("parity-budget, addresses-budget and services-budget must not be negative")
+	}
+	if c.RuleDiffLogMaxSize < 1 {
+		return fmt.Errorf("rule-diff-log-max-size must be at least 1")
+	}
+	if c.RuleDiffLogMaxFiles < 0 {
+		return fmt.Errorf("rule-diff-log-max-files must not be negative")
+	}
+	if c.WatchStaleTimeout < 0 {
+		return fmt.Errorf("watch-stale-timeout must not be negative")
+	}
+	if c.WatchReconnectBackoff <= 0 || c.WatchReconnectBackoff > c.WatchReconnectBackoffMax {
+		return fmt.Errorf("watch-reconnect-backoff must be positive and no greater than watch-reconnect-backoff-max")
+	}
+	if _, err := labels.Parse(c.KubeNodeSelector); err != nil {
+		return fmt.Errorf("kube-node-selector is invalid. %v", err)
+	}
+	if c.WatchRelistAfter < 0 {
+		return fmt.Errorf("watch-relist-after must not be negative")
+	}
+	if c.BGP.WithdrawStaleAfter < 0 {
+		return fmt.Errorf("bgp-withdraw-stale-after must not be negative")
+	}
+	if c.BGP.WithdrawAfterApplyFailures < 0 {
+		return fmt.Errorf("bgp-withdraw-after-apply-failures must not be negative")
+	}
+	if _, err := labels.Parse(c.BGP.DirectorPoolSelector); err != nil {
+		return fmt.Errorf("bgp-director-pool-selector is invalid. %v", err)
+	}
+	if c.BGP.StandbyPrimary != "" {
+		if _, _, err := net.SplitHostPort(c.BGP.StandbyPrimary); err != nil {
+			return fmt.Errorf("bgp-standby-primary must be a host:port. %v", err)
+		}
+		if c.BGP.StandbyProbeInterval <= 0 || c.BGP.StandbyFailures <= 0 {
+			return fmt.Errorf("bgp-standby-probe-interval and bgp-standby-failures must be greater than 0")
+		}
+		if c.BGP.StandbyHoldDown < 0 {
+			return fmt.Errorf("bgp-standby-hold-down must not be negative")
+		}
+	}
+	if _, err := util.ParseFreezeSchedule(c.FreezeWindows); err != nil {
+		return fmt.Errorf("freeze-windows is invalid. %v", err)
+	}
+	if c.Probe.Interval < 0 {
+		return fmt.Errorf("probe-interval must not be negative")
+	}
+	if c.Probe.Interval > 0 && (c.Probe.Timeout <= 0 || c.Probe.Mark <= 0) {
+		return fmt.Errorf("probe-timeout and probe-mark must be greater than 0 when probe-interval is set")
+	}
+	if c.ECMP.Enabled {
+		if err := types.ValidateECMPFwmarkBase(c.ECMP.FwmarkBase); err != nil {
+			return fmt.Errorf("ecmp-fwmark-base is invalid. %v", err)
+		}
+	}
+	if c.Announce.VRRP.Enabled {
+		if c.Announce.VRRP.VRID < 1 || c.Announce.VRRP.VRID > 255 {
+			return fmt.Errorf("vrrp-vrid must be between 1 and 255")
+		}
+		if c.Announce.VRRP.Priority < 1 || c.Announce.VRRP.Priority > 254 {
+			return fmt.Errorf("vrrp-priority must be between 1 and 254")
+		}
+		if c.Announce.VRRP.Interval < time.Second || c.Announce.VRRP.Interval > 255*time.Second {
+			return fmt.Errorf("vrrp-interval must be between 1s and 255s")
+		}
+	}
+	if c.SIITInstance != "" {
+		// jool limits instance names to 15 characters
+		if len(c.SIITInstance) > 15 {
+			return fmt.Errorf("siit-instance must be at most 15 characters")
+		}
+		if ip, _, err := net.ParseCIDR(c.SIITPool6); err != nil || ip.To4() != nil {
+			return fmt.Errorf("siit-pool6 must be an IPv6 prefix")
+		}
+	}
+	if c.TProxyMark != 0 {
+		if c.TProxyMark < 0 || c.TProxyMark&(c.TProxyMark-1) != 0 {
+			return fmt.Errorf("tproxy-mark must be a single bit")
+		}
+		// 253 to 255 are the default, main and local tables
+		if c.TProxyTable < 1 || c.TProxyTable > 252 {
+			return fmt.Errorf("tproxy-table must be between 1 and 252")
+		}
+	}
+	if c.MirrorMark != 0 {
+		if c.MirrorMark < 0 || c.MirrorMark&(c.MirrorMark-1) != 0 {
+			return fmt.Errorf("mirror-mark must be a single bit")
+		}
+		if c.MirrorMark == c.TProxyMark {
+			return fmt.Errorf("mirror-mark must not be the tproxy-mark")
+		}
+	}
+	switch c.DataPlane {
+	case "ipvs":
+	case "xdp":
+		x := c.XDP
+		if err := x.Validate(); err != nil {
+			return fmt.Errorf("dataplane xdp is invalid. %v", err)
+		}
+		if c.ECMP.Enabled {
+			return fmt.Errorf("dataplane xdp does not support ecmp-mode fwmark services")
+		}
+		if c.TProxyMark != 0 {
+			return fmt.Errorf("dataplane xdp does not support tproxy-mark")
+		}
+		if c.MirrorMark != 0 {
+			return fmt.Errorf("dataplane xdp does not support mirror-mark")
+		}
+	default:
+		return fmt.Errorf("dataplane must be ipvs or xdp")
+	}
+	if c.IPv6Only {
+		if c.IPVS.ColocationMode == "iptables" {
+			return fmt.Errorf("ipvs-colocation-mode iptables is not available with ipv6-only")
+		}
+		if c.Announce.VRRP.Enabled {
+			return fmt.Errorf("announce-vrrp is not available with ipv6-only")
+		}
+	}
+	if c.Chaos.Enabled {
+		for name, p := range map[string]float64{
+			"chaos-iptables-restore-failure": c.Chaos.IPTablesRestoreFailure,
+			"chaos-api-disconnect":           c.Chaos.APIDisconnect,
+			"chaos-ipvs-delay":               c.Chaos.IPVSDelay,
+		} {
+			if p < 0 || p > 1 {
+				return fmt.Errorf("%s must be between 0 and 1", name)
+			}
+		}
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return err
+	}
+	if c.ControlTokenFile != "" && c.ControlTokenReview {
+		return fmt.Errorf("control-token-file and control-token-review are exclusive")
+	}
+	if len(c.ControlRoles) > 0 && c.ControlAccessReview {
+		return fmt.Errorf("control-roles and control-access-review are exclusive")
+	}
 	return nil
 }
 
+// Supervision returns how the director restarts its failed goroutines
+func (c *Config) Supervision() director.Supervision {
+	return director.Supervision{
+		Backoff:          util.Backoff{Initial: c.RestartBackoff, Max: c.RestartBackoffMax},
+		MaxApplyFailures: c.RestartAfterApplyFailures,
+		WatchStaleAfter:  c.WatchStaleTimeout,
+
+		BreakAfterApplyFailures: c.BreakAfterApplyFailures,
+		BreakerBackoff:          c.Breaker().Backoff,
+
+		Budget: director.Budget{
+			Parity:    c.ParityBudget,
+			Addresses: c.AddressesBudget,
+			Services:  c.ServicesBudget,
+		},
+	}
+}
+
+// Breaker returns the breaker that holds back the applies of a worker once
+// they keep failing
+func (c *Config) Breaker() util.Breaker {
+	return util.Breaker{
+		Threshold: c.BreakAfterApplyFailures,
+		Backoff:   util.Backoff{Initial: c.BreakBackoff, Max: c.BreakBackoffMax},
+	}
+}
+
+// DirectorPool returns the selector of the director pods of the pool, or nil
+// when no pool is selected
+func (c *Config) DirectorPool() labels.Selector {
+	if c.BGP.DirectorPoolSelector == "" {
+		return nil
+	}
+	selector, _ := labels.Parse(c.BGP.DirectorPoolSelector)
+	return selector
+}
+
+// WatcherAPI returns how the watchers limit their load on the api server
+func (c *Config) WatcherAPI() watcher.APIOptions {
+	return watcher.APIOptions{NodeSelector: c.KubeNodeSelector, Protobuf: c.KubeProtobuf}
+}
+
+// LoadTLS loads the files of mutual TLS and parses its policy. The files are
+// nil when it is disabled.
+func (c *Config) LoadTLS(logger logrus.FieldLogger) (*mtls.Files, mtls.Policy, error) {
+	if err := c.TLS.Validate(); err != nil {
+		return nil, mtls.Policy{}, err
+	}
+	if !c.TLS.Enabled() {
+		return nil, mtls.Policy{}, nil
+	}
+	policy, err := mtls.ParsePolicy(c.TLS.Policy)
+	if err != nil {
+		return nil, mtls.Policy{}, err
+	}
+	files, err := mtls.Load(c.TLS, logger)
+	if err != nil {
+		return nil, mtls.Policy{}, err
+	}
+	return files, policy, nil
+}
+
+// WatchReconnect returns the backoff between attempts to re-establish the watches
+func (c *Config) WatchReconnect() util.Backoff {
+	return util.Backoff{Initial: c.WatchReconnectBackoff, Max: c.WatchReconnectBackoffMax}
+}
+
+// ForcedReconfigureEvery returns the forced reconfigure interval for a worker whose
+// default interval is def, or 0 if forced reconfiguration is disabled
+func (c *Config) ForcedReconfigureEvery(def time.Duration) time.Duration {
+	if c.ForcedReconfigureDisabled {
+		return 0
+	}
+	if c.ForcedReconfigureInterval > 0 {
+		return c.ForcedReconfigureInterval
+	}
+	return def
+}
+
 type DefaultListenerConfig struct {
 	Service string
 	Port    int
@@ -107,6 +655,9 @@ type StatsConfig struct {
 	ListenAddr string
 	ListenPort string
 	Interval   time.Duration
+
+	// Sinks selects where metrics are sent
+	Sinks stats.SinkConfig
 }
 
 // IPVSConfig if you modify the tags or fields of this struct, or add new ones, run unit tests in config_test.go!!
@@ -125,6 +676,43 @@ type IPVSConfig struct {
 
 	// Sysctl settings for IPVS.
 	SysctlSettings map[string]string
+
+	// Gets set by --ipvs-removal-budget
+	// The most backends a director removes in a single reconcile. 0 is unlimited.
+	RemovalBudget int
+
+	// Gets set by --ipvs-adaptive-weight-interval
+	// How often the reals of services with an adaptiveWeight are measured. 0
+	// disables adaptive weighting.
+	AdaptiveWeightInterval time.Duration
+
+	// Gets set to true by --ipvs-weighted-limits
+	// When true, the connection limits of a service are divided among its
+	// nodes by their share of its ready pods, rather than equally.
+	WeightedLimits bool
+
+	// Gets set by --ipvs-max-active-conns and --ipvs-saturation-interval
+	// A backend node with more active connections than MaxActiveConns, across
+	// every virtual service, gets no new connections until it recovers. 0
+	// disables the guard.
+	MaxActiveConns     int
+	SaturationInterval time.Duration
+
+	// Gets set by --ipvs-drain-ramp
+	// How long the weight of a cordoned node, or one annotated with
+	// ravel.comcast.com/drain=true, takes to ramp down to 0. 0 disables the
+	// drain, leaving cordoned nodes to --ipvs-ignore-node-cordon.
+	DrainRamp time.Duration
+
+	// Gets set by the --ipvs-ejection flags
+	// Backends whose connections keep failing get no new connections until
+	// they answer a probe. An Interval of 0 disables ejection.
+	Ejection system.EjectionConfig
+
+	// Gets set by --ipvs-last-backend-policy
+	// What a director does with a change that leaves a virtual service without
+	// a healthy backend. allow|alert|block
+	LastBackendPolicy string
 }
 
 // NewIPVSConfig use reflect to pull out defaults we specify in tags
@@ -197,12 +785,18 @@ func (i *IPVSConfig) GetSysCtlSetting(name string) (string, error) {
 	return value, nil
 }
 
-// WriteToNode writes sysctl settings to the actual node
-func (i *IPVSConfig) WriteToNode() error {
+// WriteToNode writes sysctl settings to the actual node, through sysctl when it
+// is not nil
+func (i *IPVSConfig) WriteToNode(sysctl system.Sysctl) error {
 	log.Debugln("Writing sysctl settings to node!")
 	for name, value := range i.SysctlSettings {
 		log.Infoln("setting sysctl value", name, "to", value)
-		err := i.SetSysctl(name, value)
+		var err error
+		if sysctl != nil {
+			err = sysctl.Set("net/ipv4/vs/"+name, value)
+		} else {
+			err = i.SetSysctl(name, value)
+		}
 		if err != nil {
 			log.Debugln("Error when seting sysctl setting", name, value, err)
 			return err
@@ -241,6 +835,24 @@ type NetConfig struct {
 	Interface      string
 	PrimaryIP      string
 	Gateway        string
+
+	// AdoptUnlabeled removes VIP devices that ravel didn't label
+	AdoptUnlabeled bool
+
+	// VIPProbeTimeout is how long the director waits for another host to answer
+	// for the VIPs it adds. 0 disables probing.
+	VIPProbeTimeout time.Duration
+
+	// MTUOverrides are vip=mtu and device=mtu pairs, see system.ParseMTUOverrides
+	MTUOverrides []string
+
+	// InterfaceDetect are the strategies that pick Interface, tried in order
+	// before falling back to compute-iface, see system.InterfaceDetector
+	InterfaceDetect []string
+
+	// InterfaceInterval is how often the interface is detected again, restarting
+	// ravel when it changed. 0 disables re-evaluation.
+	InterfaceInterval time.Duration
 }
 
 type ArpConfig struct {
@@ -253,6 +865,70 @@ type ArpConfig struct {
 type BGPConfig struct {
 	Binary      string
 	Communities []string
+
+	// WithdrawOnPanic withdraws every route when a reconcile panics
+	WithdrawOnPanic bool
+
+	// WithdrawStaleAfter withdraws every route once the watcher has been out of
+	// sync with the api server for this long. 0 disables it.
+	WithdrawStaleAfter time.Duration
+
+	// WithdrawAfterApplyFailures withdraws every route once this many applies
+	// in a row have failed, until one succeeds. 0 disables it.
+	WithdrawAfterApplyFailures int
+
+	// DirectorPoolSelector selects the director pods whose nodes make up the
+	// pool the director policies of the cluster config divide the VIPs across
+	DirectorPoolSelector string
+
+	// StandbyPrimary runs the director as the warm standby of the primary at
+	// this host:port, see bgp.Standby. Empty runs it as a primary.
+	StandbyPrimary       string
+	StandbyProbeInterval time.Duration
+	StandbyFailures      int
+	StandbyHoldDown      time.Duration
+}
+
+// ECMPConfig enables several BGP directors to advertise the same VIPs at once.
+// All directors in the set must run with the same fwmark base.
+type ECMPConfig struct {
+	Enabled    bool
+	FwmarkBase int
+}
+
+// AnnounceConfig selects how the director announces its VIPs. Default is used for
+// VIPs without an entry in the announce section of the cluster config; bgp and
+// vrrp must be enabled before VIPs can select them.
+type AnnounceConfig struct {
+	Default string
+	BGP     bool
+	VRRP    VRRPConfig
+
+	// Arping sends arp announcements with the arping binary instead of a
+	// raw socket
+	Arping bool
+}
+
+// VRRPConfig is the virtual router used to announce VIPs with vrrp
+type VRRPConfig struct {
+	Enabled  bool
+	VRID     int
+	Priority int
+	Interval time.Duration
+	Preempt  bool
+}
+
+// ProbeConfig is how often, and with which packet mark, a realserver probes its VIP ports
+type ProbeConfig struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Mark     int
+}
+
+// ChaosConfig enables failure injection. For staging only.
+type ChaosConfig struct {
+	Enabled bool
+	chaos.Config
 }
 
 func NewConfig(flags *pflag.FlagSet) *Config {
@@ -263,12 +939,92 @@ func NewConfig(flags *pflag.FlagSet) *Config {
 	config.ConfigKey = viper.GetString("config-key")
 	config.NodeName = viper.GetString("nodename")
 	config.KubeConfigFile = viper.GetString("kubeconfig")
+	config.KubeNodeSelector = viper.GetString("kube-node-selector")
+	config.KubeProtobuf = viper.GetBool("kube-protobuf")
 	config.IPTablesChain = viper.GetString("iptables-chain")
 	config.FailoverTimeout = viper.GetInt("failover-timeout")
 	config.CleanupMaster = viper.GetBool("cleanup-master")
 	config.PodCIDRMasq = viper.GetString("pod-cidr-masq")
 	config.IPTablesMasq = viper.GetBool("iptables-masq")
+	config.IPTablesScopedRestore = viper.GetBool("iptables-scoped-restore")
+	config.IPTablesLockWait = viper.GetDuration("iptables-lock-wait")
+	config.IPTablesLockRetries = viper.GetInt("iptables-lock-retries")
 	config.ForcedReconfigure = viper.GetBool("forced-reconfigure")
+	config.ForcedReconfigureInterval = viper.GetDuration("forced-reconfigure-interval")
+	config.ForcedReconfigureDisabled = viper.GetBool("forced-reconfigure-disabled")
+	config.IPv6Only = viper.GetBool("ipv6-only")
+	config.SIITInstance = viper.GetString("siit-instance")
+	config.SIITPool6 = viper.GetString("siit-pool6")
+	config.TProxyMark = viper.GetInt("tproxy-mark")
+	config.TProxyTable = viper.GetInt("tproxy-table")
+	config.MirrorMark = viper.GetInt("mirror-mark")
+	config.DataPlane = viper.GetString("dataplane")
+	config.XDP = xdp.Config{
+		Object:   viper.GetString("xdp-object"),
+		Mode:     viper.GetString("xdp-mode"),
+		PinPath:  viper.GetString("xdp-pin-path"),
+		RingSize: viper.GetInt("xdp-ring-size"),
+		MaxVIPs:  viper.GetInt("xdp-max-vips"),
+		MaxReals: viper.GetInt("xdp-max-reals"),
+	}
+	config.ConntrackFlush = viper.GetBool("conntrack-flush")
+	config.FlowCollector = viper.GetString("flow-collector")
+	config.FlowInterval = viper.GetDuration("flow-interval")
+	config.FlowSampleRate = viper.GetInt("flow-sample-rate")
+	config.PortConflictCheck = viper.GetBool("port-conflict-check")
+	config.PortConflictWithhold = viper.GetBool("port-conflict-withhold")
+	config.WeightEndpoint = viper.GetBool("weight-endpoint")
+	config.NodePortRange = viper.GetString("nodeport-range")
+	config.FreezeWindows = viper.GetString("freeze-windows")
+	config.ShrinkGuardPercent = viper.GetInt("shrink-guard-percent")
+	config.TerminatingEndpoints = viper.GetBool("terminating-endpoints")
+	config.KubeProxyMode = viper.GetString("kube-proxy-mode")
+	config.KubeProxyMetricsAddr = viper.GetString("kube-proxy-metrics-addr")
+	config.ControlAddr = viper.GetString("control-addr")
+	config.AgentSocket = viper.GetString("agent-socket")
+	config.ControlTokenFile = viper.GetString("control-token-file")
+	config.ControlTokenReview = viper.GetBool("control-token-review")
+	config.ControlTokenAudiences = viper.GetStringSlice("control-token-audiences")
+	config.ControlRoles = viper.GetStringSlice("control-roles")
+	config.ControlAccessReview = viper.GetBool("control-access-review")
+	config.ControlAuditLog = viper.GetString("control-audit-log")
+	config.TLS = mtls.Config{
+		CertFile:   viper.GetString("tls-cert"),
+		KeyFile:    viper.GetString("tls-key"),
+		CAFile:     viper.GetString("tls-ca"),
+		ServerName: viper.GetString("tls-server-name"),
+		Policy:     viper.GetStringSlice("tls-policy"),
+	}
+	config.HandoffSocket = viper.GetString("handoff-socket")
+	config.ApplyVerify = viper.GetBool("apply-verify")
+	config.ApplyVerifyRetries = viper.GetInt("apply-verify-retries")
+	config.RestartBackoff = viper.GetDuration("restart-backoff")
+	config.RestartBackoffMax = viper.GetDuration("restart-backoff-max")
+	config.RestartAfterApplyFailures = viper.GetInt("restart-after-apply-failures")
+	config.BreakAfterApplyFailures = viper.GetInt("break-after-apply-failures")
+	config.BreakBackoff = viper.GetDuration("break-backoff")
+	config.BreakBackoffMax = viper.GetDuration("break-backoff-max")
+	config.WatchdogInterval = viper.GetDuration("watchdog-interval")
+	config.LinkRepair = viper.GetBool("link-repair")
+	config.ParityInterval = viper.GetDuration("parity-interval")
+	config.NodeRoleInterval = viper.GetDuration("node-role-interval")
+	config.ExternalDNSInterval = viper.GetDuration("external-dns-interval")
+	config.ParityBudget = viper.GetDuration("parity-budget")
+	config.AddressesBudget = viper.GetDuration("addresses-budget")
+	config.ServicesBudget = viper.GetDuration("services-budget")
+	config.WatchStaleTimeout = viper.GetDuration("watch-stale-timeout")
+	config.WatchReconnectBackoff = viper.GetDuration("watch-reconnect-backoff")
+	config.WatchReconnectBackoffMax = viper.GetDuration("watch-reconnect-backoff-max")
+	config.WatchRelistAfter = viper.GetInt("watch-relist-after")
+	config.RuleDiffLog = viper.GetString("rule-diff-log")
+	config.RuleDiffLogMaxSize = viper.GetInt("rule-diff-log-max-size")
+	config.RuleDiffLogMaxFiles = viper.GetInt("rule-diff-log-max-files")
+	config.ConfigCache = viper.GetString("config-cache")
+	config.ConfigCacheKey = viper.GetString("config-cache-key")
+	config.Pprof = viper.GetBool("pprof")
+	config.Probe.Interval = viper.GetDuration("probe-interval")
+	config.Probe.Timeout = viper.GetDuration("probe-timeout")
+	config.Probe.Mark = viper.GetInt("probe-mark")
 
 	if c, err := NewCoordinatorConfig(viper.GetStringSlice("coordinator-port")); err != nil {
 		config.Coordinator = DefaultCoordinatorConfig()
@@ -278,8 +1034,14 @@ func NewConfig(flags *pflag.FlagSet) *Config {
 
 	config.Net.LocalInterface = viper.GetString("compute-iface-local")
 	config.Net.Interface = viper.GetString("compute-iface")
+	config.XDP.Interface = config.Net.Interface
 	config.Net.Gateway = viper.GetString("gateway")
 	config.Net.PrimaryIP = viper.GetString("primary-ip")
+	config.Net.AdoptUnlabeled = viper.GetBool("adopt-unlabeled-vips")
+	config.Net.VIPProbeTimeout = viper.GetDuration("vip-probe-timeout")
+	config.Net.MTUOverrides = viper.GetStringSlice("mtu-override")
+	config.Net.InterfaceDetect = viper.GetStringSlice("compute-iface-detect")
+	config.Net.InterfaceInterval = viper.GetDuration("compute-iface-interval")
 
 	if i, err := NewIPVSConfig(viper.GetStringSlice("ipvs-sysctl")); err != nil {
 		panic(err)
@@ -290,6 +1052,20 @@ func NewConfig(flags *pflag.FlagSet) *Config {
 	config.IPVS.ColocationMode = viper.GetString("ipvs-colocation-mode")
 	config.IPVS.WeightOverride = viper.GetBool("ipvs-weight-override")
 	config.IPVS.IgnoreCordon = viper.GetBool("ipvs-ignore-node-cordon")
+	config.IPVS.RemovalBudget = viper.GetInt("ipvs-removal-budget")
+	config.IPVS.AdaptiveWeightInterval = viper.GetDuration("ipvs-adaptive-weight-interval")
+	config.IPVS.WeightedLimits = viper.GetBool("ipvs-weighted-limits")
+	config.IPVS.MaxActiveConns = viper.GetInt("ipvs-max-active-conns")
+	config.IPVS.SaturationInterval = viper.GetDuration("ipvs-saturation-interval")
+	config.IPVS.DrainRamp = viper.GetDuration("ipvs-drain-ramp")
+	config.IPVS.Ejection = system.EjectionConfig{
+		Interval:       viper.GetDuration("ipvs-ejection-interval"),
+		MinFailures:    viper.GetInt("ipvs-ejection-min-failures"),
+		FailurePercent: viper.GetInt("ipvs-ejection-failure-percent"),
+		Duration:       viper.GetDuration("ipvs-ejection-duration"),
+		MaxPercent:     viper.GetInt("ipvs-ejection-max-percent"),
+	}
+	config.IPVS.LastBackendPolicy = viper.GetString("ipvs-last-backend-policy")
 
 	config.Arp.LoAnnounce = viper.GetInt("lo-announce")
 	config.Arp.LoIgnore = viper.GetInt("lo-ignore")
@@ -301,12 +1077,44 @@ func NewConfig(flags *pflag.FlagSet) *Config {
 	config.Stats.ListenAddr = viper.GetString("stats-listen")
 	config.Stats.ListenPort = viper.GetString("stats-port")
 	config.Stats.Interval = viper.GetDuration("stats-interval")
+	config.Stats.Sinks.Sinks = viper.GetStringSlice("stats-sinks")
+	config.Stats.Sinks.StatsdAddr = viper.GetString("stats-statsd-addr")
+	config.Stats.Sinks.StatsdTagFormat = viper.GetString("stats-statsd-tag-format")
+	config.Stats.Sinks.StatsdTags = viper.GetStringSlice("stats-statsd-tags")
+	config.Stats.Sinks.OTLPEndpoint = viper.GetString("stats-otlp-endpoint")
 
 	config.DefaultListener.Service = viper.GetString("auto-configure-service")
 	config.DefaultListener.Port = viper.GetInt("auto-configure-port")
 
 	config.BGP.Binary = viper.GetString("bgp-bin")
 	config.BGP.Communities = viper.GetStringSlice("bgp-communities")
+	config.BGP.WithdrawOnPanic = viper.GetBool("bgp-withdraw-on-panic")
+	config.BGP.WithdrawStaleAfter = viper.GetDuration("bgp-withdraw-stale-after")
+	config.BGP.WithdrawAfterApplyFailures = viper.GetInt("bgp-withdraw-after-apply-failures")
+	config.BGP.DirectorPoolSelector = viper.GetString("bgp-director-pool-selector")
+	config.BGP.StandbyPrimary = viper.GetString("bgp-standby-primary")
+	config.BGP.StandbyProbeInterval = viper.GetDuration("bgp-standby-probe-interval")
+	config.BGP.StandbyFailures = viper.GetInt("bgp-standby-failures")
+	config.BGP.StandbyHoldDown = viper.GetDuration("bgp-standby-hold-down")
+
+	config.ECMP.Enabled = viper.GetBool("ecmp-mode")
+	config.ECMP.FwmarkBase = viper.GetInt("ecmp-fwmark-base")
+
+	config.Announce.Default = viper.GetString("announce-default")
+	config.Announce.BGP = viper.GetBool("announce-bgp")
+	config.Announce.VRRP.Enabled = viper.GetBool("announce-vrrp")
+	config.Announce.Arping = viper.GetBool("announce-arping")
+	config.Announce.VRRP.VRID = viper.GetInt("vrrp-vrid")
+	config.Announce.VRRP.Priority = viper.GetInt("vrrp-priority")
+	config.Announce.VRRP.Interval = viper.GetDuration("vrrp-interval")
+	config.Announce.VRRP.Preempt = viper.GetBool("vrrp-preempt")
+
+	config.Chaos.Enabled = viper.GetBool("chaos-enabled")
+	config.Chaos.IPTablesRestoreFailure = viper.GetFloat64("chaos-iptables-restore-failure")
+	config.Chaos.APIDisconnect = viper.GetFloat64("chaos-api-disconnect")
+	config.Chaos.APIDisconnectInterval = viper.GetDuration("chaos-api-disconnect-interval")
+	config.Chaos.IPVSDelay = viper.GetFloat64("chaos-ipvs-delay")
+	config.Chaos.IPVSDelayDuration = viper.GetDuration("chaos-ipvs-delay-duration")
 
 	// if the node name is not set, try to fetch it from the HOSTNAME env var
 	if config.NodeName == "" {
@@ -315,3 +1123,20 @@ func NewConfig(flags *pflag.FlagSet) *Config {
 
 	return config
 }
+
+// CacheKey reads the key the config cache is signed with, or returns nil when
+// the cache isn't signed
+func (c *Config) CacheKey() ([]byte, error) {
+	if c.ConfigCacheKey == "" {
+		return nil, nil
+	}
+	key, err := ioutil.ReadFile(c.ConfigCacheKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config-cache-key. %v", err)
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) < 16 {
+		return nil, fmt.Errorf("config-cache-key %s holds %d bytes. at least 16 are needed", c.ConfigCacheKey, len(key))
+	}
+	return key, nil
+}
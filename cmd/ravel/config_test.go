@@ -109,7 +109,7 @@ func TestWriteToDisk(t *testing.T) {
 	// verify that fields without tags don't break stuff
 	config.ColocationMode = "anything"
 
-	err = config.WriteToNode()
+	err = config.WriteToNode(nil)
 	if err != nil {
 		t.Fatal("saw error writing values:", err)
 	}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/Comcast/Ravel/pkg/control"
+	"github.com/Comcast/Ravel/pkg/director"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// controlInspector reads the ipvs state of a director's node for the control
+// api, comparing it with the rules generated from the watcher's current state
+// with the overrides made, as the director's next pass would
+type controlInspector struct {
+	ipvs      *system.IPVS
+	watcher   *watcher.Watcher
+	overrides *types.Overrides
+}
+
+func (c *controlInspector) Backends(ctx context.Context) (map[string]map[string]system.IPVSRealStats, error) {
+	return c.ipvs.Backends(ctx)
+}
+
+func (c *controlInspector) Diff() ([]string, error) {
+	snapshot := c.watcher.Snapshot()
+	director.ApplyOverrides(snapshot, c.overrides)
+	return c.ipvs.Diff(snapshot, snapshot.ClusterConfig)
+}
+
+// setControlAuth sets up the authentication, authorization and audit of the
+// control api the config asks for. The auditor is returned to be closed.
+func setControlAuth(api *control.Control, config *Config, logger logrus.FieldLogger) (*control.Auditor, error) {
+	var clientset kubernetes.Interface
+	if config.ControlTokenReview || config.ControlAccessReview {
+		kubeConfig, err := clientcmd.BuildConfigFromFlags("", config.KubeConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("error getting configuration from kubeconfig at %s. %v", config.KubeConfigFile, err)
+		}
+		if clientset, err = kubernetes.NewForConfig(kubeConfig); err != nil {
+			return nil, fmt.Errorf("error initializing config. %v", err)
+		}
+	}
+
+	var authenticator control.Authenticator
+	switch {
+	case config.ControlTokenReview:
+		authenticator = control.NewTokenReviewer(clientset, config.ControlTokenAudiences)
+	case config.ControlTokenFile != "":
+		tokens, err := control.LoadStaticTokens(config.ControlTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticator = tokens
+	}
+
+	var authorizer control.Authorizer
+	switch {
+	case config.ControlAccessReview:
+		authorizer = control.NewAccessReviewer(clientset, config.NodeName)
+	case len(config.ControlRoles) > 0:
+		roles, err := control.ParseRoles(config.ControlRoles)
+		if err != nil {
+			return nil, err
+		}
+		authorizer = roles
+	}
+	api.SetAuth(authenticator, authorizer)
+
+	auditor, err := control.NewAuditor(config.ControlAuditLog, logger)
+	if err != nil {
+		return nil, err
+	}
+	api.SetAuditor(auditor)
+	return auditor, nil
+}
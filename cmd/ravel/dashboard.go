@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/Comcast/Ravel/pkg/dashboard"
+	"github.com/Comcast/Ravel/pkg/mtls"
+)
+
+// Dashboard runs the aggregator of the control apis of a fleet of directors
+func Dashboard(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
+
+	var cmd = &cobra.Command{
+		Use:           "dashboard",
+		Short:         "serve the VIP state of every director in the fleet",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Long: `
+dashboard polls the control api of every director, found with
+--dashboard-selector in --config-namespace or listed in --dashboard-targets,
+and serves a page showing the directors advertising each VIP, the healthy
+backends behind it, and whether each director's rules are in parity.
+The same state is served as JSON on /api/state.
+
+The directors must serve their control api on an address the dashboard can
+reach, i.e. --control-addr=:10203, which should then be firewalled to it, or
+served with --tls-cert, with which the dashboard presents its own --tls-cert.
+With --tls-cert the dashboard is itself served with mutual tls, and
+--tls-policy authorizes its clients by the method Dashboard.GetState.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			config := NewConfig(cmd.Flags())
+
+			var discover dashboard.Discover
+			if targets := viper.GetStringSlice("dashboard-targets"); len(targets) > 0 {
+				discover = dashboard.StaticTargets(targets)
+			} else {
+				selector := viper.GetString("dashboard-selector")
+				if selector == "" {
+					return fmt.Errorf("dashboard-selector or dashboard-targets must be set")
+				}
+				kubeConfig, err := clientcmd.BuildConfigFromFlags("", config.KubeConfigFile)
+				if err != nil {
+					return fmt.Errorf("error getting configuration from kubeconfig at %s. %v", config.KubeConfigFile, err)
+				}
+				clientset, err := kubernetes.NewForConfig(kubeConfig)
+				if err != nil {
+					return fmt.Errorf("error initializing config. %v", err)
+				}
+				discover = dashboard.PodTargets(clientset, config.ConfigMapNamespace, selector, viper.GetInt("dashboard-control-port"))
+			}
+
+			interval := viper.GetDuration("dashboard-interval")
+			if interval <= 0 {
+				return fmt.Errorf("dashboard-interval must be positive")
+			}
+			aggregator := dashboard.NewAggregator(discover, interval, viper.GetDuration("dashboard-timeout"), logger)
+			files, policy, err := config.LoadTLS(logger)
+			if err != nil {
+				return err
+			}
+			if files != nil {
+				aggregator.SetTLS(files)
+			}
+			go aggregator.Run(ctx)
+
+			addr := viper.GetString("dashboard-addr")
+			listener, err := mtls.Listen(addr, files)
+			if err != nil {
+				return fmt.Errorf("dashboard: unable to listen on %s. %v", addr, err)
+			}
+			server := &http.Server{Handler: mtls.Handler(aggregator, policy, "Dashboard.GetState", logger)}
+			go func() {
+				<-ctx.Done()
+				server.Close()
+			}()
+			logger.Infof("dashboard: serving the fleet on %s", addr)
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				return fmt.Errorf("dashboard: unable to serve on %s. %v", addr, err)
+			}
+			return nil
+		},
+	}
+
+	cmd.PersistentFlags().String("dashboard-addr", ":10211", "address the dashboard is served on, with mutual tls when tls-cert is set")
+	cmd.PersistentFlags().String("dashboard-selector", "", "label selector of the director pods in --config-namespace, i.e. app=ravel-director")
+	cmd.PersistentFlags().Int("dashboard-control-port", 10203, "port of the directors' control api, their --control-addr")
+	cmd.PersistentFlags().StringSlice("dashboard-targets", []string{}, "addresses of control apis to poll instead of discovering the director pods")
+	cmd.PersistentFlags().Duration("dashboard-interval", 15*time.Second, "how often the directors are polled")
+	cmd.PersistentFlags().Duration("dashboard-timeout", 5*time.Second, "how long each director has to answer a poll")
+	viper.BindPFlag("dashboard-addr", cmd.PersistentFlags().Lookup("dashboard-addr"))
+	viper.BindPFlag("dashboard-selector", cmd.PersistentFlags().Lookup("dashboard-selector"))
+	viper.BindPFlag("dashboard-control-port", cmd.PersistentFlags().Lookup("dashboard-control-port"))
+	viper.BindPFlag("dashboard-targets", cmd.PersistentFlags().Lookup("dashboard-targets"))
+	viper.BindPFlag("dashboard-interval", cmd.PersistentFlags().Lookup("dashboard-interval"))
+	viper.BindPFlag("dashboard-timeout", cmd.PersistentFlags().Lookup("dashboard-timeout"))
+
+	return cmd
+}
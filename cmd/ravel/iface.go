@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+// interfaceAnnotation names the primary interface of a node for the annotation
+// strategy of compute-iface-detect
+const interfaceAnnotation = "ravel.comcast.com/compute-iface"
+
+// detectInterface sets the primary interface of config from the strategies of
+// compute-iface-detect, falling back to compute-iface. Every
+// compute-iface-interval it detects the interface again, and sends an error to
+// the channel it returns when the interface changed, so that ravel restarts on
+// the new one. The channel is nil, and never delivers, when there is nothing
+// to detect or re-evaluation is disabled.
+func detectInterface(ctx context.Context, config *Config, logger logrus.FieldLogger) (<-chan error, error) {
+	if len(config.Net.InterfaceDetect) == 0 {
+		return nil, nil
+	}
+
+	var annotation func(ctx context.Context) (string, error)
+	if config.NodeName != "" {
+		kubeConfig, err := clientcmd.BuildConfigFromFlags("", config.KubeConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("error getting configuration from kubeconfig at %s. %v", config.KubeConfigFile, err)
+		}
+		clientset, err := kubernetes.NewForConfig(kubeConfig)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing config. %v", err)
+		}
+		annotation = func(ctx context.Context) (string, error) {
+			node, err := clientset.CoreV1().Nodes().Get(ctx, config.NodeName, metav1.GetOptions{})
+			if err != nil {
+				return "", err
+			}
+			return node.Annotations[interfaceAnnotation], nil
+		}
+	}
+
+	detector, err := system.NewInterfaceDetector(config.Net.InterfaceDetect, config.Net.Interface, annotation)
+	if err != nil {
+		return nil, err
+	}
+	iface, strategy, err := detector.Detect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("using %s as the primary interface, found by %s", iface, strategy)
+	config.Net.Interface = iface
+	config.XDP.Interface = iface
+
+	if config.Net.InterfaceInterval == 0 {
+		return nil, nil
+	}
+	changed := make(chan error, 1)
+	go func() {
+		t := time.NewTicker(config.Net.InterfaceInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			next, strategy, err := detector.Detect(ctx)
+			if err != nil {
+				logger.Warnf("unable to detect the primary interface again. keeping %s. %v", iface, err)
+				continue
+			}
+			if next != iface {
+				changed <- fmt.Errorf("the primary interface changed from %s to %s, found by %s. restarting", iface, next, strategy)
+				return
+			}
+		}
+	}()
+	return changed, nil
+}
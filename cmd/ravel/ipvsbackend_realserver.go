@@ -4,13 +4,16 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"time"
 
+	"github.com/Comcast/Ravel/pkg/handoff"
 	"github.com/Comcast/Ravel/pkg/haproxy"
 	"github.com/Comcast/Ravel/pkg/watcher"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"github.com/Comcast/Ravel/pkg/chaos"
 	"github.com/Comcast/Ravel/pkg/iptables"
 	"github.com/Comcast/Ravel/pkg/realserver"
 	"github.com/Comcast/Ravel/pkg/stats"
@@ -42,15 +45,48 @@ are missing from the configuration.`,
 			if err := config.Invalid(); err != nil {
 				return err
 			}
+			ifaceChanged, err := detectInterface(ctx, config, logger)
+			if err != nil {
+				return err
+			}
+
+			// optionally execute kernel operations through a privileged agent
+			privileged, err := dialAgent(config, logger)
+			if err != nil {
+				return err
+			}
+			if privileged != nil {
+				defer privileged.Close()
+			}
 
 			// instantiate a watcher
-			watcher, err := watcher.NewWatcher(ctx, config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey, stats.KindIpvsBackend, config.DefaultListener.Service, config.DefaultListener.Port, logger)
+			watcher, err := watcher.NewWatcher(ctx, config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey, stats.KindIpvsBackend, config.DefaultListener.Service, config.DefaultListener.Port, config.WatcherAPI(), logger)
 			if err != nil {
 				return err
 			}
+			watcher.SetReconnect(config.WatchReconnect(), config.WatchRelistAfter)
+			if config.ShrinkGuardPercent > 0 {
+				watcher.SetShrinkGuard(config.ShrinkGuardPercent, stats.NewWorkerStateMetrics(stats.KindIpvsBackend, config.ConfigKey))
+			}
+			if config.ConfigCache != "" {
+				key, err := config.CacheKey()
+				if err != nil {
+					return err
+				}
+				if err := watcher.SetCache(config.ConfigCache, key); err != nil {
+					logger.Warnf("IPVSBACKEND: starting without the config cache. %v", err)
+				}
+			}
+			if config.TerminatingEndpoints {
+				watcher.SetTerminatingEndpoints()
+			}
+
+			if config.Pprof {
+				util.RegisterDebugHandlers(http.DefaultServeMux)
+			}
 
 			// initialize statistics
-			s, err := stats.NewStats(ctx, stats.KindIpvsBackend, config.Stats.Interface, config.Stats.ListenAddr, config.Stats.ListenPort, config.Stats.Interval, logger)
+			s, err := stats.NewStats(ctx, stats.KindIpvsBackend, config.Stats.Interface, config.Stats.ListenAddr, config.Stats.ListenPort, config.Stats.Interval, config.Stats.Sinks, logger)
 			if err != nil {
 				return fmt.Errorf("failed to initialize metrics. %v", err)
 			}
@@ -78,6 +114,16 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
+			if privileged != nil {
+				ipLoopback.SetCommandRunner(privileged)
+				ipPrimary.SetCommandRunner(privileged)
+			}
+			// the VIP devices are managed by the loopback helper
+			mtuOverrides, _ := system.ParseMTUOverrides(config.Net.MTUOverrides)
+			ipLoopback.SetMTUParent(config.Net.Interface)
+			ipLoopback.SetMTUOverrides(mtuOverrides)
+			ipLoopback.SetAdoptUnlabeled(config.Net.AdoptUnlabeled)
+			ipLoopback.SetMTUMetrics(stats.NewWorkerStateMetrics(stats.KindIpvsBackend, config.ConfigKey))
 
 			// instantiate an iptables interface
 			logger.Info("IPVSBACKEND: initializing iptables helper")
@@ -85,6 +131,29 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
+			if privileged != nil {
+				ipt.SetExec(privileged.Exec())
+			}
+			ipt.SetLockWait(config.IPTablesLockWait, config.IPTablesLockRetries)
+			coordinateKubeProxy(ctx, config, ipt, stats.KindIpvsBackend, logger)
+			// the agent only runs --noflush restores
+			if config.IPTablesScopedRestore || privileged != nil {
+				ipt.SetScopedRestore()
+			}
+			if config.RuleDiffLog != "" {
+				diffLog, err := util.NewDiffLog(config.RuleDiffLog, int64(config.RuleDiffLogMaxSize)<<20, config.RuleDiffLogMaxFiles, logger)
+				if err != nil {
+					return err
+				}
+				defer diffLog.Close()
+				ipt.SetDiffLog(diffLog)
+			}
+			if config.ApplyVerify {
+				ipt.SetVerify(config.ApplyVerifyRetries, stats.NewWorkerStateMetrics(stats.KindIpvsBackend, config.ConfigKey))
+			}
+			if config.Probe.Interval > 0 {
+				ipt.EnableProbeMark(config.Probe.Mark)
+			}
 
 			// instantiate a new IPVS manager
 			logger.Info("IPVSBACKEND: initializing ipvs helper")
@@ -92,6 +161,18 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
+			if privileged != nil {
+				ipvs.SetCommandRunner(privileged)
+			}
+
+			// optionally wrap the system helpers with failure injection
+			var rules iptables.RuleApplier = ipt
+			if config.Chaos.Enabled {
+				injector := chaos.NewInjector(config.Chaos.Config, stats.KindIpvsBackend, config.ConfigKey, logger)
+				ipvs.SetCommandRunner(injector.CommandRunner(ipvs.CommandRunner()))
+				rules = injector.RuleApplier(rules)
+				go injector.DisconnectWatcher(ctx, watcher)
+			}
 
 			// instantiate the realserver worker.
 			logger.Info("IPVSBACKEND: initializing realserver")
@@ -99,21 +180,55 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
-			worker, err := realserver.NewRealServer(ctx, config.NodeName, config.ConfigKey, watcher, ipPrimary, ipLoopback, ipvs, ipt, config.ForcedReconfigure, haproxy, logger)
+			// forced reconfigure is opt-in for realservers
+			var forcedReconfigureInterval time.Duration
+			if config.ForcedReconfigure {
+				forcedReconfigureInterval = config.ForcedReconfigureEvery(10 * time.Minute)
+			}
+			// report, or withhold, VIP ports that would take traffic away from the node's own daemons
+			var portConflicts *system.PortConflictChecker
+			if config.PortConflictCheck {
+				portConflicts, err = system.NewPortConflictChecker(config.NodePortRange, config.PortConflictWithhold, logger)
+				if err != nil {
+					return err
+				}
+				http.Handle("/portConflicts", portConflicts)
+			}
+			worker, err := realserver.NewRealServer(ctx, config.NodeName, config.ConfigKey, watcher, ipPrimary, ipLoopback, ipvs, rules, forcedReconfigureInterval, config.ParityInterval, portConflicts, realserver.ProbeConfig(config.Probe), haproxy, logger)
 			if err != nil {
 				return err
 			}
+			// report readiness and weights to external load balancers
+			if config.WeightEndpoint {
+				http.Handle(realserver.WeightsPath, worker)
+				http.Handle(realserver.WeightsPath+"/", worker)
+			}
+
+			// take the node over from a running realserver without flushing it
+			var released <-chan struct{}
+			if config.HandoffSocket != "" {
+				adopt, err := handoff.Request(ctx, config.HandoffSocket, handoff.DefaultTimeout, logger)
+				if err != nil {
+					logger.Warnf("IPVSBACKEND: handoff failed. starting from scratch. %v", err)
+				} else if adopt {
+					worker.Adopt()
+				}
+				released, err = handoff.Serve(ctx, config.HandoffSocket, worker.Release, logger)
+				if err != nil {
+					return err
+				}
+			}
 
 			logger.Infof("IPVSBACKEND: starting continuous poll to find director, using 127.0.0.1:%d", config.Coordinator.Ports[0])
 			cm := NewCoordinationMetrics(stats.KindIpvsBackend)
-			return blockForever(ctx, worker, config.Coordinator.Ports[0], config.FailoverTimeout, cm, logger)
+			return blockForever(ctx, worker, config.Coordinator.Ports[0], config.FailoverTimeout, released, ifaceChanged, cm, logger)
 
 		},
 	}
 	return cmd
 }
 
-func blockForever(ctx context.Context, worker realserver.RealServer, port, maxTries int, cm *coordinationMetrics, logger logrus.FieldLogger) error {
+func blockForever(ctx context.Context, worker realserver.RealServer, port, maxTries int, released <-chan struct{}, ifaceChanged <-chan error, cm *coordinationMetrics, logger logrus.FieldLogger) error {
 	controlChan := make(chan bool)
 	go watchForMaster(ctx, port, controlChan)
 
@@ -144,6 +259,14 @@ func blockForever(ctx context.Context, worker realserver.RealServer, port, maxTr
 			}
 			lastMasterStatus = masterRunning
 			tries = 1
+		case <-released:
+			// the worker was released without cleanup for the new process
+			logger.Info("handed the node off to a new process. exiting")
+			return nil
+		case err := <-ifaceChanged:
+			// the rules of the old interface are cleaned up before restarting
+			worker.Stop()
+			return err
 		case <-ctx.Done():
 			// catching exit signals sent from the parent context
 			return worker.Stop()
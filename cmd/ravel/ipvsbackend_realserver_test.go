@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -24,7 +25,12 @@ func (m *mockWorker) Start() error {
 	}
 	return nil
 }
-func (m *mockWorker) Stop() error { return nil }
+func (m *mockWorker) Stop() error    { return nil }
+func (m *mockWorker) Adopt()         {}
+func (m *mockWorker) Release() error { return nil }
+
+func (m *mockWorker) ServeHTTP(http.ResponseWriter, *http.Request) {}
+
 func (m *mockWorker) drain() {
 	for len(m.started) > 0 {
 		<-m.started
@@ -47,7 +53,7 @@ func TestBlockForever(t *testing.T) {
 
 	// base case
 	worker.drain()
-	go blockForever(ctx, worker, port, maxTries, cm, logger)
+	go blockForever(ctx, worker, port, maxTries, nil, nil, cm, logger)
 	select {
 	case <-ctx.Done():
 		// pass
@@ -60,7 +66,7 @@ func TestBlockForever(t *testing.T) {
 	ctx, cxl = context.WithTimeout(context.Background(), 3000*time.Millisecond)
 	defer cxl()
 	worker.drain()
-	go blockForever(ctx, worker, 0, maxTries, cm, logger)
+	go blockForever(ctx, worker, 0, maxTries, nil, nil, cm, logger)
 	select {
 	case <-ctx.Done():
 		t.Fatal("worker didn't start before context expired")
@@ -73,7 +79,7 @@ func TestBlockForever(t *testing.T) {
 	ctx, cxl = context.WithTimeout(context.Background(), 6000*time.Millisecond)
 	defer cxl()
 	worker.drain()
-	go blockForever(ctx, worker, port, maxTries, cm, logger)
+	go blockForever(ctx, worker, port, maxTries, nil, nil, cm, logger)
 	select {
 	case <-time.After(500 * time.Millisecond):
 		fmt.Println("closed listener")
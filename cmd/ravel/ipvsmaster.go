@@ -4,17 +4,26 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/Comcast/Ravel/pkg/announce"
+	"github.com/Comcast/Ravel/pkg/chaos"
+	"github.com/Comcast/Ravel/pkg/control"
+	"github.com/Comcast/Ravel/pkg/dataplane"
 	"github.com/Comcast/Ravel/pkg/director"
+	"github.com/Comcast/Ravel/pkg/handoff"
 	"github.com/Comcast/Ravel/pkg/iptables"
 	"github.com/Comcast/Ravel/pkg/stats"
 	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
 	"github.com/Comcast/Ravel/pkg/util"
 	"github.com/Comcast/Ravel/pkg/watcher"
+	"github.com/Comcast/Ravel/pkg/xdp"
 )
 
 // IPVSMASTER runs the ipvs IPVSMASTER - also called ipvs-master
@@ -47,22 +56,60 @@ are missing from the configuration.`,
 			if err := config.Invalid(); err != nil {
 				return err
 			}
+			ifaceChanged, err := detectInterface(ctx, config, logger)
+			if err != nil {
+				return err
+			}
+
+			// optionally execute kernel operations through a privileged agent
+			privileged, err := dialAgent(config, logger)
+			if err != nil {
+				return err
+			}
+			var sysctl system.Sysctl
+			if privileged != nil {
+				defer privileged.Close()
+				sysctl = privileged.Sysctl()
+			}
 
 			// write IPVS Sysctl flags to director node
 			log.Debugln("IPVSMASTER: Writing sysctl due to from director startup.")
-			if err := config.IPVS.WriteToNode(); err != nil {
+			if err := config.IPVS.WriteToNode(sysctl); err != nil {
 				return err
 			}
 
 			// instantiate a watcher
 			logger.Info("IPVSMASTER: starting watcher")
-			watcher, err := watcher.NewWatcher(ctx, config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey, stats.KindIpvsMaster, config.DefaultListener.Service, config.DefaultListener.Port, logger)
+			watcher, err := watcher.NewWatcher(ctx, config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey, stats.KindIpvsMaster, config.DefaultListener.Service, config.DefaultListener.Port, config.WatcherAPI(), logger)
 			if err != nil {
 				return err
 			}
+			watcher.SetReconnect(config.WatchReconnect(), config.WatchRelistAfter)
+			if config.ShrinkGuardPercent > 0 {
+				watcher.SetShrinkGuard(config.ShrinkGuardPercent, stats.NewWorkerStateMetrics(stats.KindIpvsMaster, config.ConfigKey))
+			}
+			if config.TerminatingEndpoints {
+				watcher.SetTerminatingEndpoints()
+			}
+			if config.ExternalDNSInterval > 0 {
+				go watcher.PublishVIPs(ctx, config.ExternalDNSInterval)
+			}
+			if config.ConfigCache != "" {
+				key, err := config.CacheKey()
+				if err != nil {
+					return err
+				}
+				if err := watcher.SetCache(config.ConfigCache, key); err != nil {
+					logger.Warnf("IPVSMASTER: starting without the config cache. %v", err)
+				}
+			}
+
+			if config.Pprof {
+				util.RegisterDebugHandlers(http.DefaultServeMux)
+			}
 
 			// initialize statistics
-			s, err := stats.NewStats(ctx, stats.KindIpvsMaster, config.Stats.Interface, config.Stats.ListenAddr, config.Stats.ListenPort, config.Stats.Interval, logger)
+			s, err := stats.NewStats(ctx, stats.KindIpvsMaster, config.Stats.Interface, config.Stats.ListenAddr, config.Stats.ListenPort, config.Stats.Interval, config.Stats.Sinks, logger)
 			if err != nil {
 				return fmt.Errorf("failed to initialize metrics. %v", err)
 			}
@@ -91,6 +138,51 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
+			if privileged != nil {
+				ipvs.SetCommandRunner(privileged)
+			}
+			if config.ConntrackFlush {
+				conntrack := system.NewConntrack(ctx, logger)
+				if privileged != nil {
+					conntrack.SetCommandRunner(privileged)
+				}
+				ipvs.SetConntrack(conntrack)
+			}
+			if config.IPVS.RemovalBudget > 0 {
+				ipvs.SetRemovalBudget(config.IPVS.RemovalBudget, stats.NewWorkerStateMetrics(stats.KindIpvsMaster, config.ConfigKey))
+			}
+			if config.IPVS.AdaptiveWeightInterval > 0 {
+				ipvs.SetAdaptiveWeights(config.IPVS.AdaptiveWeightInterval)
+			}
+			ipvs.SetWeightedLimits(config.IPVS.WeightedLimits)
+			if config.IPVS.MaxActiveConns > 0 {
+				ipvs.SetSaturationGuard(config.IPVS.MaxActiveConns, config.IPVS.SaturationInterval, stats.NewWorkerStateMetrics(stats.KindIpvsMaster, config.ConfigKey))
+			}
+			if config.IPVS.DrainRamp > 0 {
+				ipvs.SetNodeDrain(config.IPVS.DrainRamp, stats.NewWorkerStateMetrics(stats.KindIpvsMaster, config.ConfigKey))
+			}
+			if config.IPVS.Ejection.Interval > 0 {
+				ipvs.SetEjection(config.IPVS.Ejection, stats.NewWorkerStateMetrics(stats.KindIpvsMaster, config.ConfigKey))
+			}
+			if config.IPVS.LastBackendPolicy != system.LastBackendAllow {
+				ipvs.SetLastBackendGuard(config.IPVS.LastBackendPolicy, stats.NewWorkerStateMetrics(stats.KindIpvsMaster, config.ConfigKey))
+			}
+			if config.ShrinkGuardPercent > 0 {
+				ipvs.SetShrinkGuard(config.ShrinkGuardPercent, stats.NewWorkerStateMetrics(stats.KindIpvsMaster, config.ConfigKey))
+			}
+			if config.ApplyVerify {
+				ipvs.SetVerify(config.ApplyVerifyRetries, stats.NewWorkerStateMetrics(stats.KindIpvsMaster, config.ConfigKey))
+			}
+			if config.FlowCollector != "" {
+				flows := system.NewFlowExporter(ctx, config.FlowCollector, config.FlowInterval, config.FlowSampleRate, config.Net.PrimaryIP, func() *types.ClusterConfig {
+					c, _ := watcher.Current()
+					return c
+				}, stats.NewWorkerStateMetrics(stats.KindIpvsMaster, config.ConfigKey), logger)
+				if privileged != nil {
+					flows.SetCommandRunner(privileged)
+				}
+				go flows.Run()
+			}
 
 			// instantiate an IP helper for loopback and set the arp rules
 			// the loopback helper only runs once, at startup
@@ -99,8 +191,14 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
-			if err := ipLoopback.SetARP(); err != nil {
-				return err
+			if privileged != nil {
+				ipLoopback.SetCommandRunner(privileged)
+				ipLoopback.SetSysctl(sysctl)
+			}
+			if !config.IPv6Only {
+				if err := ipLoopback.SetARP(); err != nil {
+					return err
+				}
 			}
 
 			// instantiate a new IP helper
@@ -109,6 +207,14 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
+			if privileged != nil {
+				ip.SetCommandRunner(privileged)
+				ip.SetSysctl(sysctl)
+			}
+			mtuOverrides, _ := system.ParseMTUOverrides(config.Net.MTUOverrides)
+			ip.SetMTUOverrides(mtuOverrides)
+			ip.SetAdoptUnlabeled(config.Net.AdoptUnlabeled)
+			ip.SetMTUMetrics(stats.NewWorkerStateMetrics(stats.KindIpvsMaster, config.ConfigKey))
 
 			// instantiate an iptables interface
 			logger.Info("IPVSMASTER: initializing iptables")
@@ -116,13 +222,143 @@ are missing from the configuration.`,
 			if err != nil {
 				return err
 			}
+			if privileged != nil {
+				ipt.SetExec(privileged.Exec())
+			}
+			ipt.SetLockWait(config.IPTablesLockWait, config.IPTablesLockRetries)
+			coordinateKubeProxy(ctx, config, ipt, stats.KindIpvsMaster, logger)
+			// the agent only runs --noflush restores
+			if config.IPTablesScopedRestore || privileged != nil {
+				ipt.SetScopedRestore()
+			}
+			if config.SIITInstance != "" {
+				ipt.EnableTranslation(config.SIITInstance, config.SIITPool6)
+				if err := ipt.CheckTranslation(); err != nil {
+					return err
+				}
+			}
+			if config.TProxyMark != 0 {
+				ipt.EnableTProxy(config.TProxyMark, config.TProxyTable)
+			}
+			if config.MirrorMark != 0 {
+				ipt.EnableMirror(config.MirrorMark)
+			}
+			if config.RuleDiffLog != "" {
+				diffLog, err := util.NewDiffLog(config.RuleDiffLog, int64(config.RuleDiffLogMaxSize)<<20, config.RuleDiffLogMaxFiles, logger)
+				if err != nil {
+					return err
+				}
+				defer diffLog.Close()
+				ipt.SetDiffLog(diffLog)
+				ipvs.SetDiffLog(diffLog)
+			}
+			if config.ApplyVerify {
+				ipt.SetVerify(config.ApplyVerifyRetries, stats.NewWorkerStateMetrics(stats.KindIpvsMaster, config.ConfigKey))
+			}
+
+			// optionally serve the virtual services from xdp instead of ipvs
+			var ipvsExec system.IPVSExecutor = ipvs
+			// a process that hands the node off leaves its programs to the successor
+			handedOff := false
+			if config.DataPlane == "xdp" {
+				logger.Info("IPVSMASTER: attaching xdp data plane")
+				plane, err := xdp.New(config.XDP, logger)
+				if err != nil {
+					return err
+				}
+				if err := plane.Check(ctx); err != nil {
+					return err
+				}
+				if err := plane.Attach(ctx); err != nil {
+					return err
+				}
+				defer func() {
+					if !handedOff {
+						plane.Detach(context.Background())
+					}
+				}()
+				ipvsExec = xdp.NewExecutor(ipvs, plane)
+			}
+
+			// optionally wrap the system helpers with failure injection
+			var rules iptables.RuleApplier = ipt
+			if config.Chaos.Enabled {
+				injector := chaos.NewInjector(config.Chaos.Config, stats.KindIpvsMaster, config.ConfigKey, logger)
+				ipvs.SetCommandRunner(injector.CommandRunner(ipvs.CommandRunner()))
+				rules = injector.RuleApplier(rules)
+				go injector.DisconnectWatcher(ctx, watcher)
+			}
+
+			// select how VIPs are announced
+			announcer, err := newAnnouncer(ctx, config, ip, logger)
+			if err != nil {
+				return err
+			}
+
+			freeze, err := util.ParseFreezeSchedule(config.FreezeWindows)
+			if err != nil {
+				return err
+			}
 
 			// instantiate the director worker.
 			logger.Info("IPVSMASTER: initializing director")
-			worker, err := director.NewDirector(ctx, config.NodeName, config.ConfigKey, config.CleanupMaster, watcher, ipvs, ip, ipt, config.IPVS.ColocationMode, config.ForcedReconfigure)
+			plane := dataplane.NewIPVS(ipvsExec, ip, rules, sysctl, config.IPVS.ColocationMode, config.IPv6Only, config.ConfigKey, logger)
+			if config.Net.VIPProbeTimeout > 0 {
+				plane.SetAddressProber(announce.NewARPProber(config.Net.Interface, config.Net.VIPProbeTimeout, logger))
+			}
+			// the commands of a reconcile stage are killed when it runs past
+			// its budget or the director stops
+			scope := util.NewScope(ctx)
+			ipvs.SetScope(scope)
+			ip.SetScope(scope)
+			ipt.SetScope(scope)
+			plane.SetScope(scope)
+			worker, err := director.NewDirector(ctx, config.NodeName, config.ConfigKey, config.CleanupMaster, watcher, plane, ip, config.IPv6Only, config.ForcedReconfigureEvery(60*time.Second), freeze, announcer, config.Supervision())
 			if err != nil {
 				return err
 			}
+			if config.WatchdogInterval > 0 {
+				worker.SetWatchdog(config.WatchdogInterval)
+			}
+			if config.LinkRepair {
+				worker.SetLinkRepair(system.NewLinkMonitor(logger), config.Net.Interface)
+			}
+
+			// serve the control api, whose changes are overrides of the cluster config
+			if config.ControlAddr != "" {
+				overrides := types.NewOverrides()
+				worker.SetOverrides(overrides)
+				api := control.NewControl(worker, overrides, logger)
+				api.SetInspector(&controlInspector{ipvs: ipvs, watcher: watcher, overrides: overrides})
+				api.SetMTUReporter(ip)
+				files, policy, err := config.LoadTLS(logger)
+				if err != nil {
+					return err
+				}
+				if files != nil {
+					api.SetTLS(files, policy)
+				}
+				auditor, err := setControlAuth(api, config, logger)
+				if err != nil {
+					return err
+				}
+				defer auditor.Close()
+				go func() {
+					if err := control.Serve(ctx, config.ControlAddr, api); err != nil {
+						logger.Errorf("IPVSMASTER: running without the control api. %v", err)
+					}
+				}()
+			}
+
+			// take the node over from a running director without flushing it
+			if config.HandoffSocket != "" {
+				adopt, err := handoff.Request(ctx, config.HandoffSocket, handoff.DefaultTimeout, logger)
+				if err != nil {
+					logger.Warnf("IPVSMASTER: handoff failed. starting from scratch. %v", err)
+				} else if adopt {
+					worker.Adopt()
+				}
+			}
 
 			// start the director
 			logger.Info("IPVSMASTER: starting worker")
@@ -131,8 +367,28 @@ are missing from the configuration.`,
 				return err
 			}
 			logger.Info("IPVSMASTER: started")
+			if config.NodeRoleInterval > 0 {
+				if err := labelNodeRole(ctx, config, announcer.Elected, logger); err != nil {
+					return err
+				}
+			}
+
+			// a nil channel never delivers when handoff is disabled
+			var released <-chan struct{}
+			if config.HandoffSocket != "" {
+				released, err = handoff.Serve(ctx, config.HandoffSocket, worker.Release, logger)
+				if err != nil {
+					return err
+				}
+			}
 			for { // ever
 				select {
+				case <-released:
+					logger.Info("IPVSMASTER: handed the node off to a new process. exiting")
+					handedOff = true
+					return nil
+				case err := <-ifaceChanged:
+					return err
 				case <-ctx.Done():
 					// catching exit signals sent from the parent context
 					// Removed in VPES-1410. When director exits, we shouldn't clean nup!
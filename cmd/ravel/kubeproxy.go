@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+// coordinateKubeProxy finds the mode of kube-proxy on the node, unless it is
+// given in config, places the ravel jumps ahead of kube-proxy's when that
+// avoids a conflict, and warns about the rest. The report is served on
+// /kubeProxy.
+func coordinateKubeProxy(ctx context.Context, config *Config, ipt *iptables.IPTables, lbKind string, logger logrus.FieldLogger) {
+	mode, source := config.KubeProxyMode, "the kube-proxy-mode flag"
+	if mode == "auto" {
+		mode, source = system.DetectKubeProxyMode(ctx, system.NewCommandRunner(), config.KubeProxyMetricsAddr)
+	}
+	report := system.NewKubeProxyReport(mode, source, lbKind)
+	logger.Infof("kube-proxy is in %s mode, from %s", report.Mode, report.Source)
+	if report.JumpFirst {
+		ipt.SetJumpFirst()
+	}
+	for _, conflict := range report.Conflicts {
+		logger.Warnf("kube-proxy conflict: %s. %s", conflict.Reason, conflict.Detail)
+	}
+	http.Handle("/kubeProxy", report)
+}
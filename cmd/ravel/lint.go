@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// lintCommand is `ravel config lint`
+func lintCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "lint <file>",
+		Short: "flag suspicious patterns in a cluster config",
+		Long: `
+lint reads a cluster config, the JSON or YAML value of a config key of the
+configmap, and reports patterns that are valid but likely mistakes, along with
+any validation error: ports shadowed by other entries, MTUs that are invalid,
+set for unknown VIPs or differ between the families of a dual-stack VIP, VIPs
+outside the announced bgp prefixes given with --bgp-prefix, and, with the
+EndpointsList given with --endpoints, VIP ports served by a single node or none.
+
+every finding has a severity of error, warning or info. lint exits non-zero
+when any finding is at least as severe as --fail-on, so it can gate a CI
+pipeline, and --output json prints the findings for machines.`,
+		Args:          cobra.ExactArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output, _ := cmd.Flags().GetString("output")
+			failOn, _ := cmd.Flags().GetString("fail-on")
+			prefixes, _ := cmd.Flags().GetStringSlice("bgp-prefix")
+			endpointsPath, _ := cmd.Flags().GetString("endpoints")
+
+			if output != "text" && output != "json" {
+				return fmt.Errorf("lint: --output must be text or json. saw %q", output)
+			}
+			if _, ok := types.LintSeverities[failOn]; !ok && failOn != "none" {
+				return fmt.Errorf("lint: --fail-on must be %s, %s, %s or none. saw %q", types.LintError, types.LintWarning, types.LintInfo, failOn)
+			}
+
+			data, err := readYAMLOrJSON(args[0])
+			if err != nil {
+				return err
+			}
+			config, err := types.ParseClusterConfig(data)
+			if err != nil {
+				return fmt.Errorf("unable to parse %s. %v", args[0], err)
+			}
+
+			opts := types.LintOptions{}
+			for _, prefix := range prefixes {
+				_, n, err := net.ParseCIDR(prefix)
+				if err != nil {
+					return fmt.Errorf("lint: bgp prefix %q is not a CIDR. %v", prefix, err)
+				}
+				opts.BGPPrefixes = append(opts.BGPPrefixes, n)
+			}
+			if endpointsPath != "" {
+				data, err := readYAMLOrJSON(endpointsPath)
+				if err != nil {
+					return err
+				}
+				list := &v1.EndpointsList{}
+				if err := json.Unmarshal(data, list); err != nil {
+					return fmt.Errorf("unable to decode %s. %v", endpointsPath, err)
+				}
+				opts.Endpoints = map[string]*v1.Endpoints{}
+				for n := range list.Items {
+					opts.Endpoints[list.Items[n].Namespace+"/"+list.Items[n].Name] = &list.Items[n]
+				}
+			}
+
+			findings := types.Lint(config, opts)
+			if err := writeFindings(cmd.OutOrStdout(), output, findings); err != nil {
+				return err
+			}
+
+			failed := 0
+			for _, f := range findings {
+				if failOn != "none" && types.LintSeverities[f.Severity] >= types.LintSeverities[failOn] {
+					failed++
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("lint: %d of %d findings are %s or worse", failed, len(findings), failOn)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().String("output", "text", "text|json")
+	cmd.Flags().String("fail-on", types.LintError, "exit non-zero for findings of this severity or worse. error|warning|info|none")
+	cmd.Flags().StringSlice("bgp-prefix", []string{}, "a prefix the directors announce with bgp, that VIPs must fall in. may be repeated or comma separated")
+	cmd.Flags().String("endpoints", "", "path to an EndpointsList, i.e. the output of kubectl get endpoints -A -o yaml, to check the backends of VIP ports with")
+
+	return cmd
+}
+
+// readYAMLOrJSON reads a JSON or YAML file as JSON
+func readYAMLOrJSON(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s. %v", path, err)
+	}
+	data, err = yaml.ToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s. %v", path, err)
+	}
+	return data, nil
+}
+
+// writeFindings prints findings as a table, or as a JSON array
+func writeFindings(out io.Writer, output string, findings []types.LintFinding) error {
+	if output == "json" {
+		b, err := json.MarshalIndent(findings, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(append(b, '\n'))
+		return err
+	}
+
+	if len(findings) == 0 {
+		_, err := fmt.Fprintln(out, "no findings")
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEVERITY\tCHECK\tVIP\tPORT\tMESSAGE")
+	for _, f := range findings {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", f.Severity, f.Check, f.VIP, f.Port, f.Message)
+	}
+	return w.Flush()
+}
@@ -5,13 +5,13 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
-	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	// _ "net/http/pprof" // only needed in performance debugging
+
+	"github.com/Comcast/Ravel/pkg/types"
 )
 
 var (
@@ -26,18 +26,6 @@ var (
 
 var ErrSignalCaught error = fmt.Errorf("caught signal. exiting.")
 
-var allOfTheSignals = []os.Signal{
-	os.Signal(syscall.SIGABRT),
-	os.Signal(syscall.SIGHUP),
-	os.Signal(syscall.SIGINT),
-	os.Signal(syscall.SIGKILL),
-	os.Signal(syscall.SIGQUIT),
-	os.Signal(syscall.SIGSTOP),
-	os.Signal(syscall.SIGTERM),
-	os.Signal(syscall.SIGUSR1),
-	os.Signal(syscall.SIGCONT),
-}
-
 func initConfig() error {
 	if flagCfgFile != "" {
 		viper.SetConfigType("yaml")
@@ -79,17 +67,107 @@ func init() {
 	rootCmd.PersistentFlags().String("config-namespace", "", "The namespace containing the configmap")
 	rootCmd.PersistentFlags().String("config-name", "", "The name of the configmap")
 	rootCmd.PersistentFlags().String("compute-iface", "", "The name of the desired inbound configKey interface for the director.")
+	rootCmd.PersistentFlags().StringSlice("compute-iface-detect", []string{}, "strategies that detect compute-iface, tried in order before falling back to compute-iface. default-route for the interface of the default route, cidr:<cidr> for the interface with an address in the cidr, or annotation for the interface named by the ravel.comcast.com/compute-iface annotation of the node. '--compute-iface-detect=annotation --compute-iface-detect=cidr:10.131.0.0/16'")
+	rootCmd.PersistentFlags().Duration("compute-iface-interval", 0, "how often compute-iface-detect is detected again, exiting so that ravel restarts when the interface changed. 0 disables re-evaluation")
 	rootCmd.PersistentFlags().String("compute-iface-local", "lo", "The name of the local interface to use. Defaults to lo. Can also be dummy0")
 	rootCmd.PersistentFlags().String("gateway", "", "primary inteface gateway")
 	rootCmd.PersistentFlags().String("nodename", "", "required field. the ip address of the node; its identity from kubernetes' standpoint.")
 	rootCmd.PersistentFlags().String("kubeconfig", "", "the path to the kubeconfig file containing a crt and key.")
+	rootCmd.PersistentFlags().String("kube-node-selector", "", "label selector limiting the nodes that are watched, i.e. to the nodes running realservers. it must select every node that runs ravel or backs a VIP. empty watches every node")
+	rootCmd.PersistentFlags().Bool("kube-protobuf", false, "ask the api server for protobuf rather than JSON on the watches, which is cheaper for both to encode and decode")
 	rootCmd.PersistentFlags().String("primary-ip", "", "The primary IP of the server this is running on.")
+	rootCmd.PersistentFlags().Bool("adopt-unlabeled-vips", false, "remove stale VIP devices that ravel didn't label as its own, labeling the rest. set once when upgrading from a version that didn't label them")
+	rootCmd.PersistentFlags().Duration("vip-probe-timeout", 0, "director only. before adding VIPs, arp probe for them on compute-iface and wait this long for another host to answer. VIPs that are answered for are not added. 0 disables probing")
+	rootCmd.PersistentFlags().StringSlice("mtu-override", []string{}, "the mtu of a VIP device on this node, in place of the mtuConfig of the configmap. can be passed multiple times. '--mtu-override=10.54.213.147=1400 --mtu-override=10_54_213_148=1400'")
 
 	rootCmd.PersistentFlags().Bool("cleanup-master", false, "Cleanup IPVS master on shutdown")
 	rootCmd.PersistentFlags().String("pod-cidr-masq", "", "Pod CIDR used to exclude pod network from RDEI-MASQ rules")
-	rootCmd.PersistentFlags().Bool("forced-reconfigure", false, "Reconfigure happens every 10 minutes")
+	rootCmd.PersistentFlags().Bool("forced-reconfigure", false, "realserver only. reapply the configuration without a parity check every forced-reconfigure-interval, 10 minutes by default")
+	rootCmd.PersistentFlags().Duration("forced-reconfigure-interval", 0, "how often to reapply the configuration without a parity check. 0 uses the default for the mode: 60s director, 5s bgp, 10m realserver. the phase is staggered across nodes by node name")
+	rootCmd.PersistentFlags().Bool("forced-reconfigure-disabled", false, "never reapply the configuration without a parity check")
+	rootCmd.PersistentFlags().Bool("port-conflict-check", true, "realserver only. report VIP ports that a host process listens on or that are in nodeport-range. conflicts are logged and served on /portConflicts")
+	rootCmd.PersistentFlags().Bool("port-conflict-withhold", false, "realserver only. don't forward the VIP ports that port-conflict-check finds")
+	rootCmd.PersistentFlags().Bool("weight-endpoint", false, "realserver only. serve the VIP ports the node is ready to serve, and at what weight, on /weights of the health port, and each on /weights/<vip>/<port> for the health monitors of external load balancers")
+	rootCmd.PersistentFlags().String("freeze-windows", "", "director only. semicolon separated windows during which only removals are applied, each a five field cron expression in UTC followed by a duration, i.e. '0 18 * * 5 4h'")
+	rootCmd.PersistentFlags().Int("shrink-guard-percent", 0, "refuse configs that remove more than this percentage of VIP ports, and, on directors, ipvs changes that remove more than this percentage of backends, unless the configmap is annotated with ravel.comcast.com/allow-shrink=true. 0 disables the guard")
+	rootCmd.PersistentFlags().Bool("terminating-endpoints", false, "watch endpointslices and keep the VIP ports of services whose pods are all terminating but still serving, with no weight, so that established connections drain. needs list and watch on discovery.k8s.io endpointslices")
+	rootCmd.PersistentFlags().String("kube-proxy-mode", "auto", "the mode kube-proxy runs in on the node: iptables, ipvs, nftables or none. auto detects it. in iptables and ipvs mode the ravel jumps are placed ahead of kube-proxy's. conflicts are served on /kubeProxy")
+	rootCmd.PersistentFlags().String("kube-proxy-metrics-addr", "127.0.0.1:10249", "the address of kube-proxy's metrics server, asked for its mode on /proxyMode when kube-proxy-mode is auto")
+	rootCmd.PersistentFlags().String("control-addr", "", "director only. address of the control api through which automation advertises and withdraws VIPs, sets maintenance, drains nodes, reads state, backends and rule diffs and forces a reconcile, i.e. 127.0.0.1:10203. without tls-cert or a control-token option it has no authentication, so keep it on loopback. ravelctl calls it. empty disables it")
+	rootCmd.PersistentFlags().String("control-token-file", "", "director only. static token file, in the format of the api server's: token,user,uid,\"group1,group2\". callers of the control api must log in with one of its tokens")
+	rootCmd.PersistentFlags().Bool("control-token-review", false, "director only. callers of the control api log in with a service account or other kubernetes token, checked with a TokenReview")
+	rootCmd.PersistentFlags().StringSlice("control-token-audiences", []string{}, "director only. audiences the tokens of control-token-review must be issued for. empty for the api server's")
+	rootCmd.PersistentFlags().StringSlice("control-roles", []string{}, "director only. verb=user:name,group:name rules of who may call the control api. the verbs are get, advertise, withdraw, maintain, drain and reconcile, or * for all. users logged in with a token or named by the first SAN of their tls-cert")
+	rootCmd.PersistentFlags().Bool("control-access-review", false, "director only. authorize calls of the control api with a SubjectAccessReview of their verb on the directors resource of ravel.comcast.com, named for the node")
+	rootCmd.PersistentFlags().String("control-audit-log", "", "director only. file every call of the control api that changes the director is appended to as a JSON line. they are logged either way")
+	rootCmd.PersistentFlags().String("tls-cert", "", "PEM certificate the control api, dashboard, watchplane and node-agent present for mutual tls, i.e. from a mounted secret. it, tls-key and tls-ca are reloaded when they change. empty disables tls")
+	rootCmd.PersistentFlags().String("tls-key", "", "PEM key of tls-cert")
+	rootCmd.PersistentFlags().String("tls-ca", "", "PEM CA the certificates of peers must be signed by")
+	rootCmd.PersistentFlags().String("tls-server-name", "", "name clients require in the certificate of the server. empty requires only that tls-ca signed it")
+	rootCmd.PersistentFlags().StringSlice("tls-policy", []string{}, "method=identity,identity rules naming the DNS or URI SANs that may call each rpc method, i.e. Control.GetState=dashboard.ravel or WatchPlane.*=spiffe://cluster/ns/ravel/sa/node-agent. Service.* and * match every method of a service or any. empty allows any caller tls-ca signed")
+	rootCmd.PersistentFlags().String("agent-socket", "", "unix socket of a privileged 'ravel agent' on the node. directors and realservers send their ipvs, address, iptables, conntrack and sysctl operations to it, and can then run without NET_ADMIN. the agent serves the same flag, and iptables restores are then always scoped, see iptables-scoped-restore. empty executes them directly")
+	rootCmd.PersistentFlags().String("handoff-socket", "", "unix socket, on a host path shared with the next pod on the node, through which a new ravel process takes the node over without flushing ipvs, iptables or addresses. directors and realservers only. empty disables handoff")
+	rootCmd.PersistentFlags().Bool("apply-verify", false, "read iptables and ipvs back after every apply and apply the rules that did not take effect again")
+	rootCmd.PersistentFlags().Int("apply-verify-retries", 2, "the number of times rules that did not take effect are applied again before the apply fails")
+	rootCmd.PersistentFlags().Bool("pprof", false, "serve net/http/pprof profiles under /debug/pprof/ and go runtime stats under /debug/runtime on the metrics and health ports")
+	rootCmd.PersistentFlags().Duration("restart-backoff", time.Second, "director only. how long to wait before restarting a director goroutine that failed. the wait doubles with each consecutive failure")
+	rootCmd.PersistentFlags().Duration("restart-backoff-max", time.Minute, "director only. the longest wait before restarting a failed director goroutine")
+	rootCmd.PersistentFlags().Int("restart-after-apply-failures", 0, "director only. restart the apply loop, after backoff, once this many consecutive applies have failed. 0 retries every tick forever")
+	rootCmd.PersistentFlags().Int("break-after-apply-failures", 0, "director and bgp only. once this many consecutive applies have failed, retry them with backoff rather than every tick, and report unhealthy until one succeeds. 0 retries every tick")
+	rootCmd.PersistentFlags().Duration("break-backoff", 10*time.Second, "director and bgp only. how long to wait before retrying an apply once break-after-apply-failures have failed. the wait doubles with each failed retry")
+	rootCmd.PersistentFlags().Duration("break-backoff-max", 5*time.Minute, "director and bgp only. the longest wait before retrying an apply that keeps failing")
+	rootCmd.PersistentFlags().Duration("node-role-interval", 0, "director only. how often to check whether this director is active, labeling its node ravel.comcast.com/role=director-active while it is and clearing the label when it isn't. active is the vrrp master, or the primary with bgp standby, and otherwise any running director. needs permission to patch nodes. 0 disables the label")
+	rootCmd.PersistentFlags().Duration("external-dns-interval", 0, "director only. how often to write the VIPs the cluster config assigns to each service into its external-dns.alpha.kubernetes.io/target annotation, and the load balancer status of LoadBalancer services, removing them once the service has no VIPs. needs permission to patch services and their status. 0 disables publishing")
+	rootCmd.PersistentFlags().Bool("link-repair", false, "director only. reconcile at once when the kernel reports that a VIP address was removed, and reconcile and announce every VIP again when compute-iface comes back up, rather than waiting for the next parity check. when compute-iface is a bond or team, announce every VIP again as it fails over to another slave")
+	rootCmd.PersistentFlags().Duration("watchdog-interval", 0, "director only. how often to poll the iptables rules and ipvs entries ravel applied for changes made by something else, recording a metric and a node event and reconciling when a poll finds one. changes are not watched for as they happen, so they are repaired within this interval rather than at once. 0 disables the watchdog")
+	rootCmd.PersistentFlags().Duration("parity-budget", 0, "director only. how long the parity check of a reconcile may run before its commands are killed and the reconcile fails. 0 is unbounded but for the timeouts of the commands")
+	rootCmd.PersistentFlags().Duration("addresses-budget", 0, "director only. how long a reconcile may spend putting VIP addresses on the node before its commands are killed and the reconcile fails. 0 is unbounded but for the timeouts of the commands")
+	rootCmd.PersistentFlags().Duration("services-budget", 0, "director only. how long a reconcile may spend programming iptables and ipvs before its commands are killed and the reconcile fails. 0 is unbounded but for the timeouts of the commands")
+	rootCmd.PersistentFlags().Duration("watch-stale-timeout", 0, "director only. reconnect the kubernetes watches, with backoff, when no event has arrived for this long. 0 disables the check")
+	rootCmd.PersistentFlags().Duration("watch-reconnect-backoff", time.Second, "how long to wait before re-establishing the kubernetes watches after they fail. the wait doubles with each consecutive failure")
+	rootCmd.PersistentFlags().Duration("watch-reconnect-backoff-max", 30*time.Second, "the longest wait before re-establishing the kubernetes watches")
+	rootCmd.PersistentFlags().Int("watch-relist-after", 5, "list every watched resource again, dropping objects deleted while the watches were down, after this many consecutive watch failures. 0 never relists")
+	rootCmd.PersistentFlags().String("rule-diff-log", "", "write the diff between the existing and the applied iptables and ipvs rules of every apply. 'debug' logs it at debug level, any other value is the path of a file. empty disables it")
+	rootCmd.PersistentFlags().Int("rule-diff-log-max-size", 10, "the size in megabytes at which the rule-diff-log file is rotated")
+	rootCmd.PersistentFlags().Int("rule-diff-log-max-files", 5, "the number of rotated rule-diff-log files to keep")
+	rootCmd.PersistentFlags().String("config-cache", "", "a file to keep the last successfully applied config in. it is used at startup until the watcher has synced with the api server. empty disables the cache")
+	rootCmd.PersistentFlags().String("config-cache-key", "", "a file holding the key, at least 16 bytes, the config-cache is signed with using HMAC-SHA256, i.e. from a mounted secret. a cache not signed with it is ignored. empty leaves the cache unsigned")
+	rootCmd.PersistentFlags().String("nodeport-range", "30000-32767", "the kube-proxy nodePort range checked by port-conflict-check. empty to only check host listeners")
+	rootCmd.PersistentFlags().Duration("parity-interval", 0, "realserver only. how often to check the iptables chains, the arp and rp_filter sysctls and the VIP devices against the config, repairing only the ones that drifted. 0 disables the check")
+	rootCmd.PersistentFlags().Duration("probe-interval", 0, "realserver only. how often to connect to each tcp VIP port with local pods through the node's own rules. 0 disables the probe")
+	rootCmd.PersistentFlags().Duration("probe-timeout", 2*time.Second, "how long a probe may take to connect")
+	rootCmd.PersistentFlags().Int("probe-mark", 0x200000, "the packet mark that sends probes through the ravel chain. must not overlap marks used by kube-proxy or the cni")
+	rootCmd.PersistentFlags().Bool("ipv6-only", false, "director and bgp only. run in a cluster with no IPv4 at all. only the v6 VIPs are programmed, announced with ndp or advertised as v6 prefixes")
+	rootCmd.PersistentFlags().String("siit-instance", "", "director and bgp only. the jool_siit instance that translates VIP ports with translate set in the cluster config into the family of their paired VIP. needs the jool_siit kernel module loaded on the node. empty disables translation")
+	rootCmd.PersistentFlags().String("siit-pool6", "64:ff9b::/96", "the prefix the siit instance embeds v4 client addresses in, and extracts them from")
+	rootCmd.PersistentFlags().Int("tproxy-mark", 0, "director and bgp only. the packet mark, a single bit, that sends VIP ports with tproxyPort set in the cluster config to the local transparent proxy. must not overlap marks used by kube-proxy or the cni. 0 disables transparent proxying")
+	rootCmd.PersistentFlags().Int("tproxy-table", 100, "the routing table that delivers packets carrying the tproxy mark locally")
+	rootCmd.PersistentFlags().Int("mirror-mark", 0, "director and bgp only. the connmark bit that picks the sampled connections of VIP ports with a mirror in the cluster config, whose packets are copied to the mirror gateway. must not overlap marks used by kube-proxy or the cni. 0 disables mirroring")
+	rootCmd.PersistentFlags().String("dataplane", "ipvs", "director only. ipvs, or xdp to forward VIP traffic from an XDP program on compute-iface instead. xdp is experimental and bypasses netfilter, so acls, syn proxies, transparent proxies and fwmark services don't apply to it")
+	rootCmd.PersistentFlags().String("xdp-object", "", "the compiled XDP program loaded by dataplane xdp")
+	rootCmd.PersistentFlags().String("xdp-mode", "drv", "drv to run the XDP program in the driver, or generic where the driver has no XDP support")
+	rootCmd.PersistentFlags().String("xdp-pin-path", "/sys/fs/bpf/ravel", "the bpffs directory the XDP program and its maps are pinned in")
+	rootCmd.PersistentFlags().Int("xdp-ring-size", 65537, "the prime number of consistent hashing slots of each VIP. must match the XDP program")
+	rootCmd.PersistentFlags().Int("xdp-max-vips", 512, "the number of virtual services the XDP program's maps hold")
+	rootCmd.PersistentFlags().Int("xdp-max-reals", 4096, "the number of realservers the XDP program's maps hold")
+	rootCmd.PersistentFlags().String("flow-collector", "", "director and bgp only. the host:port of an IPFIX collector that the traffic of VIP ports with flowExport set in the cluster config is exported to, sampled from conntrack. needs net.netfilter.nf_conntrack_acct=1 for byte counts. empty disables flow export")
+	rootCmd.PersistentFlags().Duration("flow-interval", 10*time.Second, "how often connections are sampled and exported to the flow collector")
+	rootCmd.PersistentFlags().Int("flow-sample-rate", 1, "export one in every flow-sample-rate connections")
+	rootCmd.PersistentFlags().Bool("conntrack-flush", true, "director only. delete the conntrack entries of removed VIPs and backends over netlink, or with the conntrack binary on the agent of agent-socket. disable when VIP traffic is NOTRACK")
 	rootCmd.PersistentFlags().Bool("ipvs-weight-override", false, "set all IPVS wrr weights to 1 regardless")
 	rootCmd.PersistentFlags().Bool("ipvs-ignore-node-cordon", true, "ignore cordoned flag when determining whether a node is an eligible backend")
+	rootCmd.PersistentFlags().Int("ipvs-removal-budget", 0, "directors only. the most ipvs backends removed in a single reconcile. removals over the budget are applied by later reconciles. 0 is unlimited")
+	rootCmd.PersistentFlags().Duration("ipvs-adaptive-weight-interval", 10*time.Second, "directors only. how often to measure the reals of services with an adaptiveWeight, and scale their weights by how they perform. 0 disables adaptive weighting")
+	rootCmd.PersistentFlags().Bool("ipvs-weighted-limits", false, "directors only. divide the uThreshold and lThreshold of a service among its nodes by their share of its ready pods, as the weights are, instead of equally")
+	rootCmd.PersistentFlags().Int("ipvs-max-active-conns", 0, "directors only. send no new connections to a backend node with more active ipvs connections than this, across every VIP port, until it is down to 80% of it. 0 disables the guard")
+	rootCmd.PersistentFlags().Duration("ipvs-saturation-interval", 5*time.Second, "directors only. how often the active connections of backend nodes are checked against ipvs-max-active-conns")
+	rootCmd.PersistentFlags().Duration("ipvs-drain-ramp", 0, "directors only. ramp the weight of a node that is cordoned, or annotated with ravel.comcast.com/drain=true, down to 0 over this long in every pool, keeping it an eligible backend so its established connections drain. 0 disables the drain")
+	rootCmd.PersistentFlags().Duration("ipvs-ejection-interval", 0, "directors only. how often the ipvs connection table is sampled for backends whose connections are reset or never complete, which are sent no new connections until they answer a probe. 0 disables ejection")
+	rootCmd.PersistentFlags().Int("ipvs-ejection-min-failures", 5, "directors only. the fewest failed connections in a sample that eject a backend")
+	rootCmd.PersistentFlags().Int("ipvs-ejection-failure-percent", 50, "directors only. the share of its sampled connections that must have failed to eject a backend")
+	rootCmd.PersistentFlags().Duration("ipvs-ejection-duration", 30*time.Second, "directors only. how long a backend is ejected before it is probed. doubles, up to 8 times, while the probes fail")
+	rootCmd.PersistentFlags().Int("ipvs-ejection-max-percent", 50, "directors only. the largest share of the backends that are ejected at once")
+	rootCmd.PersistentFlags().String("ipvs-last-backend-policy", "allow", "directors only. what to do with a change that leaves a virtual service without a healthy backend, a real with weight. allow applies it, alert applies it with an error log and metric, and block keeps the service's configured reals until it has a healthy backend again or the configmap is annotated with ravel.comcast.com/allow-shrink=true. allow|alert|block")
 
 	rootCmd.PersistentFlags().String("iptables-chain", "RAVEL", "The name of the iptables chain to use.")
 	rootCmd.PersistentFlags().Int("failover-timeout", 1, "number of seconds for the realserver to wait before reconfiguring itself")
@@ -108,9 +186,39 @@ func init() {
 	rootCmd.PersistentFlags().String("stats-listen", "0.0.0.0", "listen address for prometheus endpoint")
 	rootCmd.PersistentFlags().String("stats-port", "10234", "listen port for prometheus endpoint")
 	rootCmd.PersistentFlags().Duration("stats-interval", 1*time.Second, "sampling interval")
+	rootCmd.PersistentFlags().StringSlice("stats-sinks", []string{"prometheus"}, "where metrics are sent. any of prometheus, statsd and otlp, or none. the prometheus endpoint is only served with the prometheus sink")
+	rootCmd.PersistentFlags().String("stats-statsd-addr", "", "host:port of the statsd server for the statsd sink")
+	rootCmd.PersistentFlags().String("stats-statsd-tag-format", "dogstatsd", "how labels are sent to statsd. any of dogstatsd, influxdb and none")
+	rootCmd.PersistentFlags().StringSlice("stats-statsd-tags", []string{}, "tags added to every statsd metric, as key=value. i.e. cluster=ho-1,datacenter=ho,role=director")
+	rootCmd.PersistentFlags().String("stats-otlp-endpoint", "", "url of the OTLP/HTTP metrics receiver for the otlp sink, i.e. http://otel-collector:4318/v1/metrics")
 
 	rootCmd.PersistentFlags().StringSlice("coordinator-port", []string{"44444"}, "port for the director and realserver to coordinate traffic on. multiple ports supported. if the realserver sees multiple ports, only the first will be used.")
+	rootCmd.PersistentFlags().Bool("ecmp-mode", false, "bgp mode only. configure ipvs so that several directors can advertise the same vips for router ECMP. forces a consistent-hash scheduler (mh or sh) and fwmark services.")
+	rootCmd.PersistentFlags().Int("ecmp-fwmark-base", types.DefaultECMPFwmarkBase, "first fwmark used for ecmp services. must be identical on every director in the ECMP set, above 0xffff and a multiple of 0x1000.")
+	rootCmd.PersistentFlags().String("announce-default", "arp", "director only. how VIPs are announced unless the cluster config selects otherwise. arp|bgp|vrrp")
+	rootCmd.PersistentFlags().Bool("announce-bgp", false, "director only. allow VIPs to be announced by injecting routes into gobgp at bgp-bin")
+	rootCmd.PersistentFlags().Bool("announce-vrrp", false, "director only. allow VIPs to be announced with vrrp advertisements on compute-iface")
+	rootCmd.PersistentFlags().Bool("announce-arping", false, "director only. announce arp VIPs by executing arping against the gateway rather than sending gratuitous arps from a raw socket on compute-iface")
+	rootCmd.PersistentFlags().Int("vrrp-vrid", 51, "the vrrp virtual router id, 1-255. must be unique on the segment")
+	rootCmd.PersistentFlags().Int("vrrp-priority", 100, "the vrrp priority of this director, 1-254. the highest priority owns the VIPs")
+	rootCmd.PersistentFlags().Duration("vrrp-interval", time.Second, "how often vrrp advertisements are sent")
+	rootCmd.PersistentFlags().Bool("vrrp-preempt", true, "take the VIPs back from a lower priority master. disable to avoid a second failover when a director recovers")
+
+	rootCmd.PersistentFlags().Bool("chaos-enabled", false, "STAGING ONLY. enable failure injection to exercise retry and rollback behavior.")
+	rootCmd.PersistentFlags().Float64("chaos-iptables-restore-failure", 0, "probability, 0-1, that an iptables-restore fails when chaos-enabled is set")
+	rootCmd.PersistentFlags().Float64("chaos-api-disconnect", 0, "probability, 0-1, that the api server watches are dropped each chaos-api-disconnect-interval when chaos-enabled is set")
+	rootCmd.PersistentFlags().Duration("chaos-api-disconnect-interval", time.Minute, "how often to roll for an api server disconnect")
+	rootCmd.PersistentFlags().Float64("chaos-ipvs-delay", 0, "probability, 0-1, that an ipvsadm call is delayed by chaos-ipvs-delay-duration when chaos-enabled is set")
+	rootCmd.PersistentFlags().Duration("chaos-ipvs-delay-duration", 5*time.Second, "how long to delay a slowed ipvsadm call")
 	rootCmd.PersistentFlags().StringSlice("bgp-communities", []string{""}, "The community strings to advertise with BGP_DIRECTOR announcements.  Comma separated.")
+	rootCmd.PersistentFlags().Bool("bgp-withdraw-on-panic", false, "bgp only. withdraw every route when a reconcile panics, until a reconcile succeeds")
+	rootCmd.PersistentFlags().Int("bgp-withdraw-after-apply-failures", 0, "bgp only. withdraw every route once this many consecutive applies have failed, until one succeeds. 0 keeps advertising")
+	rootCmd.PersistentFlags().Duration("bgp-withdraw-stale-after", 0, "bgp only. withdraw every route once the kubernetes watches have been out of sync for this long, rather than advertising VIPs from a stale view of the cluster, until they sync again. 0 keeps advertising")
+	rootCmd.PersistentFlags().String("bgp-director-pool-selector", "", "bgp only. label selector of the director pods in --config-namespace, i.e. app=ravel-director. the nodes of the ready ones make up the pool of directors that the directors policies and sharding of the cluster config divide the VIPs across. empty advertises every VIP from every director")
+	rootCmd.PersistentFlags().String("bgp-standby-primary", "", "bgp only. run as the warm standby of the director accepting tcp connections at this host:port, e.g. its bgp port. a standby applies its rules and keeps its bgp sessions up with its routes withdrawn, and advertises them once the primary fails. empty runs as a primary")
+	rootCmd.PersistentFlags().Duration("bgp-standby-probe-interval", 200*time.Millisecond, "bgp only. how often a standby probes its primary, and the timeout of each probe")
+	rootCmd.PersistentFlags().Int("bgp-standby-failures", 3, "bgp only. the number of consecutive failed probes of the primary after which a standby is promoted")
+	rootCmd.PersistentFlags().Duration("bgp-standby-hold-down", 30*time.Second, "bgp only. how long the primary must answer probes before a promoted standby withdraws its routes again")
 
 	rootCmd.PersistentFlags().String("auto-configure-service", "", "configure the load balancer to send traffic to this service for all vips. must be used in conjunction with auto-configure-port")
 	rootCmd.PersistentFlags().Int("auto-configure-port", 0, "vip port to use for autoconfigured monitoring service. ensure that this port does not conflict with configured service ports to prevent conflicts.")
@@ -120,6 +228,12 @@ Mode "iptables" will result in the worker writing iptables rules to capture inbo
 Mode "ipvs" will result in pod ip addresses being added to the ipvs configuraton. iptables and ipvs modes require the conntrack flag be set.`)
 	rootCmd.PersistentFlags().Bool("iptables-masq", true, "determines whether masquerade chain is used in generated iptables rules.")
 	viper.BindPFlag("iptables-masq", rootCmd.PersistentFlags().Lookup("iptables-masq"))
+	rootCmd.PersistentFlags().Bool("iptables-scoped-restore", false, "only write the ravel chains that changed since the table was last read, with iptables-restore --noflush, instead of rewriting the whole nat table on every restore")
+	viper.BindPFlag("iptables-scoped-restore", rootCmd.PersistentFlags().Lookup("iptables-scoped-restore"))
+	rootCmd.PersistentFlags().Duration("iptables-lock-wait", 5*time.Second, "how long iptables commands, and restores where iptables-restore supports it, wait for the xtables lock held by other programs such as kube-proxy. 0 keeps the iptables default")
+	viper.BindPFlag("iptables-lock-wait", rootCmd.PersistentFlags().Lookup("iptables-lock-wait"))
+	rootCmd.PersistentFlags().Int("iptables-lock-retries", 3, "how often an iptables command or restore that fails on the xtables lock is retried, with a backoff")
+	viper.BindPFlag("iptables-lock-retries", rootCmd.PersistentFlags().Lookup("iptables-lock-retries"))
 	viper.BindPFlag("ipvs-colocation-mode", rootCmd.PersistentFlags().Lookup("ipvs-colocation-mode"))
 	viper.BindPFlag("failover-timeout", rootCmd.PersistentFlags().Lookup("failover-timeout"))
 	viper.BindPFlag("auto-configure-service", rootCmd.PersistentFlags().Lookup("auto-configure-service"))
@@ -130,6 +244,11 @@ Mode "ipvs" will result in pod ip addresses being added to the ipvs configuraton
 	viper.BindPFlag("stats-listen", rootCmd.PersistentFlags().Lookup("stats-listen"))
 	viper.BindPFlag("stats-port", rootCmd.PersistentFlags().Lookup("stats-port"))
 	viper.BindPFlag("stats-interval", rootCmd.PersistentFlags().Lookup("stats-interval"))
+	viper.BindPFlag("stats-sinks", rootCmd.PersistentFlags().Lookup("stats-sinks"))
+	viper.BindPFlag("stats-statsd-addr", rootCmd.PersistentFlags().Lookup("stats-statsd-addr"))
+	viper.BindPFlag("stats-statsd-tag-format", rootCmd.PersistentFlags().Lookup("stats-statsd-tag-format"))
+	viper.BindPFlag("stats-statsd-tags", rootCmd.PersistentFlags().Lookup("stats-statsd-tags"))
+	viper.BindPFlag("stats-otlp-endpoint", rootCmd.PersistentFlags().Lookup("stats-otlp-endpoint"))
 	viper.BindPFlag("calico-version", rootCmd.PersistentFlags().Lookup("calico-version"))
 	viper.BindPFlag("calico-dir", rootCmd.PersistentFlags().Lookup("calico-dir"))
 	viper.BindPFlag("calico-bin", rootCmd.PersistentFlags().Lookup("calico-bin"))
@@ -139,10 +258,17 @@ Mode "ipvs" will result in pod ip addresses being added to the ipvs configuraton
 	viper.BindPFlag("config-name", rootCmd.PersistentFlags().Lookup("config-name"))
 	viper.BindPFlag("compute-iface", rootCmd.PersistentFlags().Lookup("compute-iface"))
 	viper.BindPFlag("compute-iface-local", rootCmd.PersistentFlags().Lookup("compute-iface-local"))
+	viper.BindPFlag("compute-iface-detect", rootCmd.PersistentFlags().Lookup("compute-iface-detect"))
+	viper.BindPFlag("compute-iface-interval", rootCmd.PersistentFlags().Lookup("compute-iface-interval"))
 	viper.BindPFlag("gateway", rootCmd.PersistentFlags().Lookup("gateway"))
 	viper.BindPFlag("nodename", rootCmd.PersistentFlags().Lookup("nodename"))
 	viper.BindPFlag("kubeconfig", rootCmd.PersistentFlags().Lookup("kubeconfig"))
+	viper.BindPFlag("kube-node-selector", rootCmd.PersistentFlags().Lookup("kube-node-selector"))
+	viper.BindPFlag("kube-protobuf", rootCmd.PersistentFlags().Lookup("kube-protobuf"))
 	viper.BindPFlag("primary-ip", rootCmd.PersistentFlags().Lookup("primary-ip"))
+	viper.BindPFlag("adopt-unlabeled-vips", rootCmd.PersistentFlags().Lookup("adopt-unlabeled-vips"))
+	viper.BindPFlag("vip-probe-timeout", rootCmd.PersistentFlags().Lookup("vip-probe-timeout"))
+	viper.BindPFlag("mtu-override", rootCmd.PersistentFlags().Lookup("mtu-override"))
 	viper.BindPFlag("iptables-chain", rootCmd.PersistentFlags().Lookup("iptables-chain"))
 	viper.BindPFlag("lo-announce", rootCmd.PersistentFlags().Lookup("lo-announce"))
 	viper.BindPFlag("lo-ignore", rootCmd.PersistentFlags().Lookup("lo-ignore"))
@@ -151,9 +277,117 @@ Mode "ipvs" will result in pod ip addresses being added to the ipvs configuraton
 	viper.BindPFlag("cleanup-master", rootCmd.PersistentFlags().Lookup("cleanup-master"))
 	viper.BindPFlag("pod-cidr-masq", rootCmd.PersistentFlags().Lookup("pod-cidr-masq"))
 	viper.BindPFlag("forced-reconfigure", rootCmd.PersistentFlags().Lookup("forced-reconfigure"))
+	viper.BindPFlag("forced-reconfigure-interval", rootCmd.PersistentFlags().Lookup("forced-reconfigure-interval"))
+	viper.BindPFlag("forced-reconfigure-disabled", rootCmd.PersistentFlags().Lookup("forced-reconfigure-disabled"))
+	viper.BindPFlag("port-conflict-check", rootCmd.PersistentFlags().Lookup("port-conflict-check"))
+	viper.BindPFlag("port-conflict-withhold", rootCmd.PersistentFlags().Lookup("port-conflict-withhold"))
+	viper.BindPFlag("weight-endpoint", rootCmd.PersistentFlags().Lookup("weight-endpoint"))
+	viper.BindPFlag("freeze-windows", rootCmd.PersistentFlags().Lookup("freeze-windows"))
+	viper.BindPFlag("shrink-guard-percent", rootCmd.PersistentFlags().Lookup("shrink-guard-percent"))
+	viper.BindPFlag("terminating-endpoints", rootCmd.PersistentFlags().Lookup("terminating-endpoints"))
+	viper.BindPFlag("kube-proxy-mode", rootCmd.PersistentFlags().Lookup("kube-proxy-mode"))
+	viper.BindPFlag("kube-proxy-metrics-addr", rootCmd.PersistentFlags().Lookup("kube-proxy-metrics-addr"))
+	viper.BindPFlag("control-addr", rootCmd.PersistentFlags().Lookup("control-addr"))
+	viper.BindPFlag("agent-socket", rootCmd.PersistentFlags().Lookup("agent-socket"))
+	viper.BindPFlag("control-token-file", rootCmd.PersistentFlags().Lookup("control-token-file"))
+	viper.BindPFlag("control-token-review", rootCmd.PersistentFlags().Lookup("control-token-review"))
+	viper.BindPFlag("control-token-audiences", rootCmd.PersistentFlags().Lookup("control-token-audiences"))
+	viper.BindPFlag("control-roles", rootCmd.PersistentFlags().Lookup("control-roles"))
+	viper.BindPFlag("control-access-review", rootCmd.PersistentFlags().Lookup("control-access-review"))
+	viper.BindPFlag("control-audit-log", rootCmd.PersistentFlags().Lookup("control-audit-log"))
+	viper.BindPFlag("tls-cert", rootCmd.PersistentFlags().Lookup("tls-cert"))
+	viper.BindPFlag("tls-key", rootCmd.PersistentFlags().Lookup("tls-key"))
+	viper.BindPFlag("tls-ca", rootCmd.PersistentFlags().Lookup("tls-ca"))
+	viper.BindPFlag("tls-server-name", rootCmd.PersistentFlags().Lookup("tls-server-name"))
+	viper.BindPFlag("tls-policy", rootCmd.PersistentFlags().Lookup("tls-policy"))
+	viper.BindPFlag("handoff-socket", rootCmd.PersistentFlags().Lookup("handoff-socket"))
+	viper.BindPFlag("apply-verify", rootCmd.PersistentFlags().Lookup("apply-verify"))
+	viper.BindPFlag("apply-verify-retries", rootCmd.PersistentFlags().Lookup("apply-verify-retries"))
+	viper.BindPFlag("restart-backoff", rootCmd.PersistentFlags().Lookup("restart-backoff"))
+	viper.BindPFlag("restart-backoff-max", rootCmd.PersistentFlags().Lookup("restart-backoff-max"))
+	viper.BindPFlag("restart-after-apply-failures", rootCmd.PersistentFlags().Lookup("restart-after-apply-failures"))
+	viper.BindPFlag("break-after-apply-failures", rootCmd.PersistentFlags().Lookup("break-after-apply-failures"))
+	viper.BindPFlag("break-backoff", rootCmd.PersistentFlags().Lookup("break-backoff"))
+	viper.BindPFlag("break-backoff-max", rootCmd.PersistentFlags().Lookup("break-backoff-max"))
+	viper.BindPFlag("watchdog-interval", rootCmd.PersistentFlags().Lookup("watchdog-interval"))
+	viper.BindPFlag("link-repair", rootCmd.PersistentFlags().Lookup("link-repair"))
+	viper.BindPFlag("parity-interval", rootCmd.PersistentFlags().Lookup("parity-interval"))
+	viper.BindPFlag("node-role-interval", rootCmd.PersistentFlags().Lookup("node-role-interval"))
+	viper.BindPFlag("external-dns-interval", rootCmd.PersistentFlags().Lookup("external-dns-interval"))
+	viper.BindPFlag("parity-budget", rootCmd.PersistentFlags().Lookup("parity-budget"))
+	viper.BindPFlag("addresses-budget", rootCmd.PersistentFlags().Lookup("addresses-budget"))
+	viper.BindPFlag("services-budget", rootCmd.PersistentFlags().Lookup("services-budget"))
+	viper.BindPFlag("watch-stale-timeout", rootCmd.PersistentFlags().Lookup("watch-stale-timeout"))
+	viper.BindPFlag("watch-reconnect-backoff", rootCmd.PersistentFlags().Lookup("watch-reconnect-backoff"))
+	viper.BindPFlag("watch-reconnect-backoff-max", rootCmd.PersistentFlags().Lookup("watch-reconnect-backoff-max"))
+	viper.BindPFlag("watch-relist-after", rootCmd.PersistentFlags().Lookup("watch-relist-after"))
+	viper.BindPFlag("rule-diff-log", rootCmd.PersistentFlags().Lookup("rule-diff-log"))
+	viper.BindPFlag("rule-diff-log-max-size", rootCmd.PersistentFlags().Lookup("rule-diff-log-max-size"))
+	viper.BindPFlag("rule-diff-log-max-files", rootCmd.PersistentFlags().Lookup("rule-diff-log-max-files"))
+	viper.BindPFlag("config-cache", rootCmd.PersistentFlags().Lookup("config-cache"))
+	viper.BindPFlag("config-cache-key", rootCmd.PersistentFlags().Lookup("config-cache-key"))
+	viper.BindPFlag("pprof", rootCmd.PersistentFlags().Lookup("pprof"))
+	viper.BindPFlag("nodeport-range", rootCmd.PersistentFlags().Lookup("nodeport-range"))
+	viper.BindPFlag("probe-interval", rootCmd.PersistentFlags().Lookup("probe-interval"))
+	viper.BindPFlag("probe-timeout", rootCmd.PersistentFlags().Lookup("probe-timeout"))
+	viper.BindPFlag("probe-mark", rootCmd.PersistentFlags().Lookup("probe-mark"))
+	viper.BindPFlag("ipv6-only", rootCmd.PersistentFlags().Lookup("ipv6-only"))
+	viper.BindPFlag("siit-instance", rootCmd.PersistentFlags().Lookup("siit-instance"))
+	viper.BindPFlag("siit-pool6", rootCmd.PersistentFlags().Lookup("siit-pool6"))
+	viper.BindPFlag("tproxy-mark", rootCmd.PersistentFlags().Lookup("tproxy-mark"))
+	viper.BindPFlag("tproxy-table", rootCmd.PersistentFlags().Lookup("tproxy-table"))
+	viper.BindPFlag("mirror-mark", rootCmd.PersistentFlags().Lookup("mirror-mark"))
+	viper.BindPFlag("dataplane", rootCmd.PersistentFlags().Lookup("dataplane"))
+	viper.BindPFlag("xdp-object", rootCmd.PersistentFlags().Lookup("xdp-object"))
+	viper.BindPFlag("xdp-mode", rootCmd.PersistentFlags().Lookup("xdp-mode"))
+	viper.BindPFlag("xdp-pin-path", rootCmd.PersistentFlags().Lookup("xdp-pin-path"))
+	viper.BindPFlag("xdp-ring-size", rootCmd.PersistentFlags().Lookup("xdp-ring-size"))
+	viper.BindPFlag("xdp-max-vips", rootCmd.PersistentFlags().Lookup("xdp-max-vips"))
+	viper.BindPFlag("xdp-max-reals", rootCmd.PersistentFlags().Lookup("xdp-max-reals"))
+	viper.BindPFlag("flow-collector", rootCmd.PersistentFlags().Lookup("flow-collector"))
+	viper.BindPFlag("flow-interval", rootCmd.PersistentFlags().Lookup("flow-interval"))
+	viper.BindPFlag("flow-sample-rate", rootCmd.PersistentFlags().Lookup("flow-sample-rate"))
+	viper.BindPFlag("conntrack-flush", rootCmd.PersistentFlags().Lookup("conntrack-flush"))
 	viper.BindPFlag("ipvs-weight-override", rootCmd.PersistentFlags().Lookup("ipvs-weight-override"))
 	viper.BindPFlag("ipvs-ignore-node-cordon", rootCmd.PersistentFlags().Lookup("ipvs-ignore-node-cordon"))
+	viper.BindPFlag("ipvs-removal-budget", rootCmd.PersistentFlags().Lookup("ipvs-removal-budget"))
+	viper.BindPFlag("ipvs-adaptive-weight-interval", rootCmd.PersistentFlags().Lookup("ipvs-adaptive-weight-interval"))
+	viper.BindPFlag("ipvs-weighted-limits", rootCmd.PersistentFlags().Lookup("ipvs-weighted-limits"))
+	viper.BindPFlag("ipvs-max-active-conns", rootCmd.PersistentFlags().Lookup("ipvs-max-active-conns"))
+	viper.BindPFlag("ipvs-saturation-interval", rootCmd.PersistentFlags().Lookup("ipvs-saturation-interval"))
+	viper.BindPFlag("ipvs-drain-ramp", rootCmd.PersistentFlags().Lookup("ipvs-drain-ramp"))
+	viper.BindPFlag("ipvs-ejection-interval", rootCmd.PersistentFlags().Lookup("ipvs-ejection-interval"))
+	viper.BindPFlag("ipvs-ejection-min-failures", rootCmd.PersistentFlags().Lookup("ipvs-ejection-min-failures"))
+	viper.BindPFlag("ipvs-ejection-failure-percent", rootCmd.PersistentFlags().Lookup("ipvs-ejection-failure-percent"))
+	viper.BindPFlag("ipvs-ejection-duration", rootCmd.PersistentFlags().Lookup("ipvs-ejection-duration"))
+	viper.BindPFlag("ipvs-ejection-max-percent", rootCmd.PersistentFlags().Lookup("ipvs-ejection-max-percent"))
+	viper.BindPFlag("ipvs-last-backend-policy", rootCmd.PersistentFlags().Lookup("ipvs-last-backend-policy"))
 	viper.BindPFlag("bgp-communities", rootCmd.PersistentFlags().Lookup("bgp-communities"))
+	viper.BindPFlag("bgp-withdraw-on-panic", rootCmd.PersistentFlags().Lookup("bgp-withdraw-on-panic"))
+	viper.BindPFlag("bgp-withdraw-after-apply-failures", rootCmd.PersistentFlags().Lookup("bgp-withdraw-after-apply-failures"))
+	viper.BindPFlag("bgp-withdraw-stale-after", rootCmd.PersistentFlags().Lookup("bgp-withdraw-stale-after"))
+	viper.BindPFlag("bgp-director-pool-selector", rootCmd.PersistentFlags().Lookup("bgp-director-pool-selector"))
+	viper.BindPFlag("bgp-standby-primary", rootCmd.PersistentFlags().Lookup("bgp-standby-primary"))
+	viper.BindPFlag("bgp-standby-probe-interval", rootCmd.PersistentFlags().Lookup("bgp-standby-probe-interval"))
+	viper.BindPFlag("bgp-standby-failures", rootCmd.PersistentFlags().Lookup("bgp-standby-failures"))
+	viper.BindPFlag("bgp-standby-hold-down", rootCmd.PersistentFlags().Lookup("bgp-standby-hold-down"))
+	viper.BindPFlag("ecmp-mode", rootCmd.PersistentFlags().Lookup("ecmp-mode"))
+	viper.BindPFlag("ecmp-fwmark-base", rootCmd.PersistentFlags().Lookup("ecmp-fwmark-base"))
+	viper.BindPFlag("announce-default", rootCmd.PersistentFlags().Lookup("announce-default"))
+	viper.BindPFlag("announce-bgp", rootCmd.PersistentFlags().Lookup("announce-bgp"))
+	viper.BindPFlag("announce-vrrp", rootCmd.PersistentFlags().Lookup("announce-vrrp"))
+	viper.BindPFlag("announce-arping", rootCmd.PersistentFlags().Lookup("announce-arping"))
+	viper.BindPFlag("vrrp-vrid", rootCmd.PersistentFlags().Lookup("vrrp-vrid"))
+	viper.BindPFlag("vrrp-priority", rootCmd.PersistentFlags().Lookup("vrrp-priority"))
+	viper.BindPFlag("vrrp-interval", rootCmd.PersistentFlags().Lookup("vrrp-interval"))
+	viper.BindPFlag("vrrp-preempt", rootCmd.PersistentFlags().Lookup("vrrp-preempt"))
+
+	viper.BindPFlag("chaos-enabled", rootCmd.PersistentFlags().Lookup("chaos-enabled"))
+	viper.BindPFlag("chaos-iptables-restore-failure", rootCmd.PersistentFlags().Lookup("chaos-iptables-restore-failure"))
+	viper.BindPFlag("chaos-api-disconnect", rootCmd.PersistentFlags().Lookup("chaos-api-disconnect"))
+	viper.BindPFlag("chaos-api-disconnect-interval", rootCmd.PersistentFlags().Lookup("chaos-api-disconnect-interval"))
+	viper.BindPFlag("chaos-ipvs-delay", rootCmd.PersistentFlags().Lookup("chaos-ipvs-delay"))
+	viper.BindPFlag("chaos-ipvs-delay-duration", rootCmd.PersistentFlags().Lookup("chaos-ipvs-delay-duration"))
 }
 
 func main() {
@@ -167,7 +401,15 @@ func main() {
 	rootCmd.AddCommand(BGP_DIRECTOR(ctx, log))           // ravel-director
 	rootCmd.AddCommand(IPVSMASTER(ctx, log))             // ipvs-master
 	rootCmd.AddCommand(IPVSBACKEND_REALSERVER(ctx, log)) // ipvs-backend
-
+	rootCmd.AddCommand(Agent(ctx, log))                  // privileged agent
+	rootCmd.AddCommand(WatchPlane(ctx, log))             // watch plane of node-agents
+	rootCmd.AddCommand(NodeAgent(ctx, log))              // realserver of a watch plane
+
+	rootCmd.AddCommand(ClusterConfigTools(log))
+	rootCmd.AddCommand(Dashboard(ctx, log))
+	rootCmd.AddCommand(Render(ctx, log))
+	rootCmd.AddCommand(State(ctx, log))
+	rootCmd.AddCommand(Announce(ctx, log))
 	rootCmd.AddCommand(Version())
 
 	log.Infoln("Command arguments:", rootCmd.Flags().Args())
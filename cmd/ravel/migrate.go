@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// ClusterConfigTools works with cluster config documents offline
+func ClusterConfigTools(logger logrus.FieldLogger) *cobra.Command {
+
+	var cmd = &cobra.Command{
+		Use:   "config",
+		Short: "work with cluster config documents",
+	}
+
+	cmd.PersistentFlags().String("migrate-output", "", "migrate only. file the migrated config is written to. empty writes to stdout")
+	viper.BindPFlag("migrate-output", cmd.PersistentFlags().Lookup("migrate-output"))
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "migrate <file>",
+		Short: "convert a cluster config to the v2 schema",
+		Long: `
+migrate reads a cluster config, the JSON or YAML value of a config key of the
+configmap, and writes it in the v2 schema. values that v1 replaces by defaults,
+such as an unknown scheduler, are migrated as their defaults with a warning.
+
+the result is validated, and checked to configure every service as the input
+does, before it is written.`,
+		Args:          cobra.ExactArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := ioutil.ReadFile(args[0])
+			if err != nil {
+				return fmt.Errorf("unable to read %s. %v", args[0], err)
+			}
+			data, err = yaml.ToJSON(data)
+			if err != nil {
+				return fmt.Errorf("unable to decode %s. %v", args[0], err)
+			}
+			config, err := types.ParseClusterConfig(data)
+			if err != nil {
+				return fmt.Errorf("unable to parse %s. %v", args[0], err)
+			}
+			if err := config.Validate(); err != nil {
+				return fmt.Errorf("%s is invalid. %v", args[0], err)
+			}
+
+			migrated, warnings, err := types.Migrate(config)
+			for _, warning := range warnings {
+				logger.Warnf("migrate: %s", warning)
+			}
+			if err != nil {
+				return err
+			}
+
+			out, err := json.MarshalIndent(migrated, "", "  ")
+			if err != nil {
+				return err
+			}
+			out = append(out, '\n')
+			if path := viper.GetString("migrate-output"); path != "" {
+				if err := ioutil.WriteFile(path, out, 0644); err != nil {
+					return fmt.Errorf("unable to write %s. %v", path, err)
+				}
+				logger.Infof("migrate: wrote %d services to %s", len(migrated.Services), path)
+				return nil
+			}
+			_, err = cmd.OutOrStdout().Write(out)
+			return err
+		},
+	})
+	cmd.AddCommand(lintCommand())
+
+	return cmd
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/Comcast/Ravel/pkg/bgp"
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/sim"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+const (
+	renderModeDirector   = "director"
+	renderModeRealServer = "realserver"
+	renderModeBGP        = "bgp"
+)
+
+// Render prints the configuration ravel would program for a set of snapshots
+func Render(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
+
+	var cmd = &cobra.Command{
+		Use:           "render",
+		Short:         "print the rules ravel would program, without changing the host",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Long: `
+render reads a cluster config, and optionally a NodeList and an EndpointsList,
+from JSON or YAML files and prints the VIP addresses, ipvsadm rules, iptables
+rules and BGP advertisements that ravel would program in the given mode.
+
+Nothing on the host is modified. The output is stable, so it can be diffed
+and attached to a change request.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			config := NewConfig(cmd.Flags())
+			mode := viper.GetString("render-mode")
+
+			events, err := sim.LoadEvents(viper.GetString("render-cluster-config"), viper.GetString("render-nodes"), viper.GetString("render-endpoints"))
+			if err != nil {
+				return err
+			}
+
+			// keep the rendered output free of log lines
+			quiet := logrus.New()
+			quiet.Out = ioutil.Discard
+
+			out := cmd.OutOrStdout()
+			switch mode {
+			case renderModeDirector, renderModeBGP:
+				return renderDirector(ctx, out, config, mode, events, quiet)
+			case renderModeRealServer:
+				return renderRealServer(ctx, out, config, events[0].Config, quiet)
+			}
+			return fmt.Errorf("render-mode must be one of %s|%s|%s", renderModeDirector, renderModeRealServer, renderModeBGP)
+		},
+	}
+
+	cmd.Flags().String("render-cluster-config", "", "path to a cluster config, as found under the config key of the ravel configmap")
+	cmd.Flags().String("render-nodes", "", "path to a NodeList, i.e. the output of kubectl get nodes -o yaml")
+	cmd.Flags().String("render-endpoints", "", "path to an EndpointsList, i.e. the output of kubectl get endpoints -A -o yaml")
+	cmd.Flags().String("render-mode", renderModeDirector, "director|realserver|bgp")
+	viper.BindPFlag("render-cluster-config", cmd.Flags().Lookup("render-cluster-config"))
+	viper.BindPFlag("render-nodes", cmd.Flags().Lookup("render-nodes"))
+	viper.BindPFlag("render-endpoints", cmd.Flags().Lookup("render-endpoints"))
+	viper.BindPFlag("render-mode", cmd.Flags().Lookup("render-mode"))
+
+	return cmd
+}
+
+// renderDirector converges a simulated director and prints the resulting kernel state
+func renderDirector(ctx context.Context, out io.Writer, config *Config, mode string, events []sim.Event, logger logrus.FieldLogger) error {
+	s, err := sim.NewScenario(ctx, config.NodeName, config.Net.PrimaryIP, logger)
+	if err != nil {
+		return err
+	}
+	ecmp := mode == renderModeBGP && config.ECMP.Enabled
+	if ecmp {
+		s.EnableECMP(config.ECMP.FwmarkBase)
+	}
+	if config.TProxyMark != 0 {
+		s.Kernel.IPTables.EnableTProxy(config.TProxyMark, config.TProxyTable)
+	}
+	if config.MirrorMark != 0 {
+		s.Kernel.IPTables.EnableMirror(config.MirrorMark)
+	}
+
+	s.Apply(events...)
+	if err := s.Converge(); err != nil {
+		return err
+	}
+	clusterConfig := s.Watcher.ClusterConfig
+
+	fmt.Fprintln(out, "# addresses")
+	for _, vip := range s.Kernel.VIPs() {
+		fmt.Fprintln(out, vip)
+	}
+
+	fmt.Fprintln(out, "\n# ipvs")
+	s.Kernel.IPVS.Lock()
+	for _, rule := range s.Kernel.IPVS.Rules {
+		fmt.Fprintln(out, "ipvsadm", rule)
+	}
+	s.Kernel.IPVS.Unlock()
+
+	// only VIP ports with noTrack set produce raw table rules
+	if raw := s.Kernel.IPTables.NotrackRulesBytes(clusterConfig); bytes.Contains(raw, []byte("--notrack")) {
+		fmt.Fprintln(out, "\n# iptables raw")
+		fmt.Fprint(out, string(raw))
+	}
+
+	// only VIPs in maintenance produce filter table rules
+	if len(clusterConfig.Maintenance) > 0 {
+		fmt.Fprintln(out, "\n# iptables filter")
+		fmt.Fprint(out, string(s.Kernel.IPTables.MaintenanceRulesBytes(clusterConfig)))
+	}
+
+	// only VIPs with the syn proxy enabled produce syn proxy rules
+	if clusterConfig.HasSYNProxy() {
+		fmt.Fprintln(out, "\n# iptables synproxy")
+		fmt.Fprint(out, string(s.Kernel.IPTables.SYNProxyRulesBytes(clusterConfig)))
+	}
+
+	// only transparently proxied VIP ports produce tproxy rules
+	if config.TProxyMark != 0 && clusterConfig.HasTProxy(false) {
+		fmt.Fprintln(out, "\n# iptables mangle tproxy")
+		fmt.Fprint(out, string(s.Kernel.IPTables.TProxyRulesBytes(clusterConfig)))
+	}
+
+	// only mirrored VIP ports produce mirror rules
+	if config.MirrorMark != 0 && clusterConfig.HasMirror(false) {
+		fmt.Fprintln(out, "\n# iptables mangle mirror")
+		fmt.Fprint(out, string(s.Kernel.IPTables.MirrorRulesBytes(clusterConfig)))
+	}
+
+	// only VIP ports with an acl produce acl rules
+	if clusterConfig.HasACL(false) {
+		fmt.Fprintln(out, "\n# iptables mangle acl")
+		fmt.Fprint(out, string(s.Kernel.IPTables.ACLRulesBytes(clusterConfig)))
+	}
+
+	// ecmp services and steered clients are marked in the mangle table
+	var marks []types.ECMPFwmark
+	if ecmp {
+		if marks, err = types.ECMPFwmarks(clusterConfig, config.ECMP.FwmarkBase); err != nil {
+			return err
+		}
+	}
+	steering, err := types.SteeringFwmarks(clusterConfig)
+	if err != nil {
+		return err
+	}
+	if len(marks) > 0 || len(steering) > 0 {
+		fmt.Fprintln(out, "\n# iptables mangle")
+		fmt.Fprint(out, string(s.Kernel.IPTables.FwmarkRulesBytes(marks, steering)))
+	}
+
+	if mode != renderModeBGP {
+		return nil
+	}
+
+	fmt.Fprintln(out, "\n# bgp")
+	communities := []string{}
+	for _, c := range config.BGP.Communities {
+		if c != "" {
+			communities = append(communities, c)
+		}
+	}
+	vips := []string{}
+	for vip := range clusterConfig.Config {
+		vips = append(vips, string(vip))
+	}
+	sort.Strings(vips)
+	for _, vip := range vips {
+		fmt.Fprintln(out, config.BGP.Binary, strings.Join(bgp.AdvertiseArgs("ipv4", vip+"/32", communities), " "))
+	}
+	return nil
+}
+
+// renderRealServer prints the iptables rules a realserver would restore
+func renderRealServer(ctx context.Context, out io.Writer, config *Config, clusterConfig *types.ClusterConfig, logger logrus.FieldLogger) error {
+	ipt, err := iptables.NewIPTables(ctx, stats.KindIpvsBackend, config.ConfigKey, config.PodCIDRMasq, config.IPTablesChain, config.IPTablesMasq, logger)
+	if err != nil {
+		return err
+	}
+	rules, err := ipt.GenerateRules(clusterConfig)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "# iptables")
+	fmt.Fprint(out, string(iptables.BytesFromRules(rules)))
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/Comcast/Ravel/pkg/director"
+)
+
+// labelNodeRole labels the director's node while active reports it is the
+// active director, until ctx is done, see director.NodeRole
+func labelNodeRole(ctx context.Context, config *Config, active func() bool, logger logrus.FieldLogger) error {
+	kubeConfig, err := clientcmd.BuildConfigFromFlags("", config.KubeConfigFile)
+	if err != nil {
+		return fmt.Errorf("error getting configuration from kubeconfig at %s. %v", config.KubeConfigFile, err)
+	}
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return fmt.Errorf("error initializing config. %v", err)
+	}
+	go director.NewNodeRole(clientset, config.NodeName, config.NodeRoleInterval, logger).Run(ctx, active)
+	return nil
+}
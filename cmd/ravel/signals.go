@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var allOfTheSignals = []os.Signal{
+	os.Signal(syscall.SIGABRT),
+	os.Signal(syscall.SIGHUP),
+	os.Signal(syscall.SIGINT),
+	os.Signal(syscall.SIGKILL),
+	os.Signal(syscall.SIGQUIT),
+	os.Signal(syscall.SIGSTOP),
+	os.Signal(syscall.SIGTERM),
+	os.Signal(syscall.SIGUSR1),
+	os.Signal(syscall.SIGCONT),
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// windows only delivers the signals of ctrl-c and ctrl-break
+var allOfTheSignals = []os.Signal{
+	os.Signal(syscall.SIGINT),
+	os.Signal(syscall.SIGTERM),
+}
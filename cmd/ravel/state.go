@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/Comcast/Ravel/pkg/bgp"
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/state"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+const (
+	stateModeDirector = "director"
+	stateModeBGP      = "bgp"
+)
+
+// State exports and imports the load balancer state of this node
+func State(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
+
+	var cmd = &cobra.Command{
+		Use:   "state",
+		Short: "export or import the load balancer state of this node",
+		Long: `
+state export writes the desired cluster config and the applied VIP addresses,
+ipvs table, ravel iptables chains and BGP routes of this node to a file.
+
+state import applies a file written by state export, so that a replacement
+director can serve traffic before its own watcher has synced.`,
+	}
+
+	cmd.PersistentFlags().String("state-file", "ravel-state.json", "path of the state file")
+	cmd.PersistentFlags().String("state-mode", stateModeDirector, "director|bgp. the kind of director whose state is exported or imported")
+	cmd.PersistentFlags().Duration("state-watch-timeout", 30*time.Second, "export only. how long to wait for the cluster config from kubernetes. 0 skips the desired config")
+	viper.BindPFlag("state-file", cmd.PersistentFlags().Lookup("state-file"))
+	viper.BindPFlag("state-mode", cmd.PersistentFlags().Lookup("state-mode"))
+	viper.BindPFlag("state-watch-timeout", cmd.PersistentFlags().Lookup("state-watch-timeout"))
+
+	cmd.AddCommand(&cobra.Command{
+		Use:           "export",
+		Short:         "write the state of this node to --state-file",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			config := NewConfig(cmd.Flags())
+			host, err := newStateHost(ctx, config, logger)
+			if err != nil {
+				return err
+			}
+
+			var desired *types.ClusterConfig
+			if timeout := viper.GetDuration("state-watch-timeout"); timeout > 0 {
+				desired, err = waitForClusterConfig(ctx, config, timeout, logger)
+				if err != nil {
+					return err
+				}
+			}
+
+			snapshot, err := host.Export(ctx, config.NodeName, desired)
+			if err != nil {
+				return err
+			}
+			if err := state.WriteFile(viper.GetString("state-file"), snapshot); err != nil {
+				return err
+			}
+			logger.Infof("state: exported %d addresses, %d ipvs rules and %d bgp routes to %s", len(snapshot.Addresses)+len(snapshot.Addresses6), len(snapshot.IPVS), len(snapshot.BGPRoutes), viper.GetString("state-file"))
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:           "import",
+		Short:         "apply the state in --state-file to this node",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			config := NewConfig(cmd.Flags())
+			host, err := newStateHost(ctx, config, logger)
+			if err != nil {
+				return err
+			}
+
+			snapshot, err := state.ReadFile(viper.GetString("state-file"))
+			if err != nil {
+				return err
+			}
+			logger.Infof("state: importing snapshot of %s taken at %v", snapshot.NodeName, snapshot.Created)
+			return host.Import(ctx, snapshot)
+		},
+	})
+
+	return cmd
+}
+
+// newStateHost builds the system helpers for the configured director mode
+func newStateHost(ctx context.Context, config *Config, logger logrus.FieldLogger) (*state.Host, error) {
+	mode := viper.GetString("state-mode")
+	kind := stats.KindIpvsMaster
+	device := config.Net.Interface
+	switch mode {
+	case stateModeDirector:
+	case stateModeBGP:
+		kind = stats.KindBGPDirector
+		device = config.Net.LocalInterface
+	default:
+		return nil, fmt.Errorf("state-mode must be one of %s|%s", stateModeDirector, stateModeBGP)
+	}
+
+	ipvs, err := system.NewIPVS(ctx, config.Net.PrimaryIP, config.IPVS.WeightOverride, config.IPVS.IgnoreCordon, logger, kind)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := system.NewIP(ctx, device, config.Net.Gateway, config.Arp.PrimaryAnnounce, config.Arp.PrimaryIgnore, logger)
+	if err != nil {
+		return nil, err
+	}
+	ipt, err := iptables.NewIPTables(ctx, kind, config.ConfigKey, config.PodCIDRMasq, config.IPTablesChain, config.IPTablesMasq, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var bgpController bgp.Controller
+	if mode == stateModeBGP {
+		bgpController = bgp.NewBGPDController(config.BGP.Binary, logger)
+	}
+
+	return state.NewHost(ipvs, ip, ipt, bgpController, config.BGP.Communities, logger), nil
+}
+
+// waitForClusterConfig starts a watcher and returns the first cluster config it publishes
+func waitForClusterConfig(ctx context.Context, config *Config, timeout time.Duration, logger logrus.FieldLogger) (*types.ClusterConfig, error) {
+	ctxWatch, cxl := context.WithTimeout(ctx, timeout)
+	defer cxl()
+
+	w, err := watcher.NewWatcher(ctxWatch, config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey, stats.KindIpvsMaster, config.DefaultListener.Service, config.DefaultListener.Port, config.WatcherAPI(), logger)
+	if err != nil {
+		return nil, err
+	}
+
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			w.RLock()
+			cc := w.ClusterConfig
+			w.RUnlock()
+			if cc != nil {
+				return cc, nil
+			}
+		case <-ctxWatch.Done():
+			return nil, fmt.Errorf("state: no cluster config received within %v", timeout)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/watcher"
+	"github.com/Comcast/Ravel/pkg/watchplane"
+)
+
+// WatchPlane runs the kubernetes watches of the realservers once, and serves
+// the bundle of each node to its node-agent
+func WatchPlane(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
+
+	var cmd = &cobra.Command{
+		Use:           "watchplane",
+		Short:         "compile and serve the rules of every node to their node-agents",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Long: `
+watchplane runs the kubernetes watches a realserver would, once for the whole
+cluster, and compiles the bundle of every node: the cluster config and the
+iptables rules of the pods on the node. Each node runs a node-agent instead of
+a realserver, which long-polls the watchplane for its own bundle and applies
+it. This keeps the load of the watches on the api server constant as the
+cluster grows.
+
+Bundles are recompiled every --watchplane-interval and served with net/rpc on
+--watchplane-addr, which should be firewalled to the nodes or served with
+--tls-cert, so that only node-agents presenting a certificate get them. With
+--watchplane-signing-key, an ed25519 private key in PKCS #8 PEM, every bundle
+is signed, and node-agents given the public key apply no bundle that isn't.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			config := NewConfig(cmd.Flags())
+			if config.IPTablesChain == "" {
+				return fmt.Errorf("iptables-chain must be set")
+			}
+			interval := viper.GetDuration("watchplane-interval")
+			if interval <= 0 {
+				return fmt.Errorf("watchplane-interval must be positive")
+			}
+
+			w, err := watcher.NewWatcher(ctx, config.KubeConfigFile, config.ConfigMapNamespace, config.ConfigMapName, config.ConfigKey, stats.KindIpvsBackend, config.DefaultListener.Service, config.DefaultListener.Port, config.WatcherAPI(), logger)
+			if err != nil {
+				return err
+			}
+			w.SetReconnect(config.WatchReconnect(), config.WatchRelistAfter)
+			if config.TerminatingEndpoints {
+				w.SetTerminatingEndpoints()
+			}
+
+			// the rules are only generated here, never applied
+			ipt, err := iptables.NewIPTables(ctx, stats.KindIpvsBackend, config.ConfigKey, config.PodCIDRMasq, config.IPTablesChain, config.IPTablesMasq, logger)
+			if err != nil {
+				return err
+			}
+
+			server := watchplane.NewServer(watchplane.WatcherSource(w, ipt), logger)
+			if key := viper.GetString("watchplane-signing-key"); key != "" {
+				signer, err := watchplane.LoadSigner(key)
+				if err != nil {
+					return err
+				}
+				server.SetSigner(signer)
+			} else {
+				logger.Warn("watchplane: no watchplane-signing-key. bundles are served unsigned")
+			}
+			files, policy, err := config.LoadTLS(logger)
+			if err != nil {
+				return err
+			}
+			if files != nil {
+				server.SetTLS(files, policy)
+			}
+			go server.Run(ctx, interval)
+			return watchplane.Serve(ctx, viper.GetString("watchplane-addr"), server)
+		},
+	}
+
+	cmd.PersistentFlags().String("watchplane-addr", ":10212", "address the bundles are served on")
+	cmd.PersistentFlags().Duration("watchplane-interval", 5*time.Second, "how often the bundles are compiled")
+	cmd.PersistentFlags().String("watchplane-signing-key", "", "PEM file of the ed25519 private key bundles are signed with, i.e. from openssl genpkey -algorithm ed25519")
+	viper.BindPFlag("watchplane-addr", cmd.PersistentFlags().Lookup("watchplane-addr"))
+	viper.BindPFlag("watchplane-interval", cmd.PersistentFlags().Lookup("watchplane-interval"))
+	viper.BindPFlag("watchplane-signing-key", cmd.PersistentFlags().Lookup("watchplane-signing-key"))
+
+	return cmd
+}
+
+// NodeAgent applies the bundles a watchplane compiles for the node, in place
+// of a realserver
+func NodeAgent(ctx context.Context, logger logrus.FieldLogger) *cobra.Command {
+
+	var cmd = &cobra.Command{
+		Use:           "node-agent",
+		Short:         "apply the rules the watchplane compiles for this node",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Long: `
+node-agent takes the place of a realserver on clusters run with a watchplane.
+Rather than watching kubernetes itself, it long-polls --watchplane-server for
+the bundle of --nodename, and puts its VIPs on the loopback and its rules in
+iptables as a realserver would.
+
+The last bundle applied is kept in --watchplane-cache, so that a restarted
+agent applies it at once and only asks the watchplane for newer bundles.
+
+With --watchplane-verify-keys, the PEM files of the public keys the watchplane
+signs with, a bundle from the watchplane or the cache is only applied when it
+is signed with one of them for this node, and isn't older than the last.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			config := NewConfig(cmd.Flags())
+			if err := config.Invalid(); err != nil {
+				return err
+			}
+			server := viper.GetString("watchplane-server")
+			if server == "" {
+				return fmt.Errorf("watchplane-server must be set")
+			}
+
+			privileged, err := dialAgent(config, logger)
+			if err != nil {
+				return err
+			}
+			if privileged != nil {
+				defer privileged.Close()
+			}
+
+			ipLoopback, err := system.NewIP(ctx, config.Net.LocalInterface, config.Net.Gateway, config.Arp.LoAnnounce, config.Arp.LoIgnore, logger)
+			if err != nil {
+				return err
+			}
+			if privileged != nil {
+				ipLoopback.SetCommandRunner(privileged)
+			}
+			mtuOverrides, _ := system.ParseMTUOverrides(config.Net.MTUOverrides)
+			ipLoopback.SetMTUParent(config.Net.Interface)
+			ipLoopback.SetMTUOverrides(mtuOverrides)
+			ipLoopback.SetAdoptUnlabeled(config.Net.AdoptUnlabeled)
+
+			ipt, err := iptables.NewIPTables(ctx, stats.KindIpvsBackend, config.ConfigKey, config.PodCIDRMasq, config.IPTablesChain, config.IPTablesMasq, logger)
+			if err != nil {
+				return err
+			}
+			if privileged != nil {
+				ipt.SetExec(privileged.Exec())
+			}
+			ipt.SetLockWait(config.IPTablesLockWait, config.IPTablesLockRetries)
+			// the agent only runs --noflush restores
+			if config.IPTablesScopedRestore || privileged != nil {
+				ipt.SetScopedRestore()
+			}
+
+			client := watchplane.NewClient(server)
+			files, _, err := config.LoadTLS(logger)
+			if err != nil {
+				return err
+			}
+			if files != nil {
+				client.SetTLS(files)
+			}
+			agent := watchplane.NewAgent(config.NodeName, client, ipLoopback, ipt, logger)
+			agent.SetCache(viper.GetString("watchplane-cache"))
+			if keys := viper.GetStringSlice("watchplane-verify-keys"); len(keys) > 0 {
+				verifier, err := watchplane.LoadVerifier(keys...)
+				if err != nil {
+					return err
+				}
+				agent.SetVerifier(verifier)
+			} else {
+				logger.Warn("node-agent: no watchplane-verify-keys. bundles are applied unverified")
+			}
+			return agent.Run(ctx)
+		},
+	}
+
+	cmd.PersistentFlags().String("watchplane-server", "", "address of the watchplane, i.e. ravel-watchplane:10212")
+	cmd.PersistentFlags().String("watchplane-cache", "/var/lib/ravel/bundle.json", "file the last bundle applied is kept in. empty to keep none")
+	cmd.PersistentFlags().StringSlice("watchplane-verify-keys", []string{}, "PEM files of the ed25519 public keys bundles must be signed with. more than one for a key rotation")
+	viper.BindPFlag("watchplane-server", cmd.PersistentFlags().Lookup("watchplane-server"))
+	viper.BindPFlag("watchplane-cache", cmd.PersistentFlags().Lookup("watchplane-cache"))
+	viper.BindPFlag("watchplane-verify-keys", cmd.PersistentFlags().Lookup("watchplane-verify-keys"))
+
+	return cmd
+}
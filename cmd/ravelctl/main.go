@@ -0,0 +1,391 @@
+// ravelctl inspects and drives a running director through its control api,
+// served on the director's --control-addr. Run it on the director's node, as
+// the api listens on loopback, or with --tls-cert for a director serving the
+// api with mutual TLS.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/Comcast/Ravel/pkg/control"
+	"github.com/Comcast/Ravel/pkg/mtls"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+var (
+	flagAddr   string
+	flagOutput string
+	flagTLS    mtls.Config
+
+	flagToken     string
+	flagTokenFile string
+)
+
+// callTimeout bounds the calls made over mutual tls, where a director that
+// stopped answering would otherwise hang ravelctl
+const callTimeout = time.Minute
+
+var rootCmd = &cobra.Command{
+	Use:   "ravelctl",
+	Short: "inspect and drive a ravel director",
+	Long: `
+ravelctl calls the control api a director serves on --control-addr. changes
+made through it override the cluster config on that director only, and are
+lost when the director restarts.`,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&flagAddr, "addr", "127.0.0.1:10203", "address of the director's control api, its --control-addr")
+	rootCmd.PersistentFlags().StringVarP(&flagOutput, "output", "o", "table", "table|json")
+	rootCmd.PersistentFlags().StringVar(&flagToken, "token", "", "token to log in to a director that requires one")
+	rootCmd.PersistentFlags().StringVar(&flagTokenFile, "token-file", "", "file of the token to log in with, i.e. /var/run/secrets/kubernetes.io/serviceaccount/token")
+	rootCmd.PersistentFlags().StringVar(&flagTLS.CertFile, "tls-cert", "", "PEM certificate presented to a director serving the api with mutual tls")
+	rootCmd.PersistentFlags().StringVar(&flagTLS.KeyFile, "tls-key", "", "PEM key of tls-cert")
+	rootCmd.PersistentFlags().StringVar(&flagTLS.CAFile, "tls-ca", "", "PEM CA the director's certificate must be signed by")
+	rootCmd.PersistentFlags().StringVar(&flagTLS.ServerName, "tls-server-name", "", "name required in the director's certificate. empty requires only that tls-ca signed it")
+}
+
+// call runs fn against the director's api
+func call(fn func(c *control.Client, args []string) error) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		if flagOutput != "table" && flagOutput != "json" {
+			return fmt.Errorf("output must be table or json. saw %q", flagOutput)
+		}
+		c, err := dial()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if err := login(c); err != nil {
+			return err
+		}
+		return fn(c, args)
+	}
+}
+
+// dial connects to the director's api, with mutual tls when --tls-cert is set
+func dial() (*control.Client, error) {
+	if err := flagTLS.Validate(); err != nil {
+		return nil, err
+	}
+	if !flagTLS.Enabled() {
+		return control.Dial(flagAddr)
+	}
+	files, err := mtls.Load(flagTLS, log.New())
+	if err != nil {
+		return nil, err
+	}
+	return control.DialTLS(flagAddr, callTimeout, files)
+}
+
+// login logs in with --token or the token of --token-file, if any
+func login(c *control.Client) error {
+	token := flagToken
+	if flagTokenFile != "" {
+		b, err := ioutil.ReadFile(flagTokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token == "" {
+		return nil
+	}
+	_, err := c.Login(token)
+	return err
+}
+
+// printJSON prints v indented, returning true when the output is json
+func printJSON(v interface{}) bool {
+	if flagOutput != "json" {
+		return false
+	}
+	b, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(b))
+	return true
+}
+
+func table() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func status() *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "print what the director is doing and the overrides in effect",
+		Args:  cobra.NoArgs,
+		RunE: call(func(c *control.Client, _ []string) error {
+			state, err := c.GetState()
+			if err != nil {
+				return err
+			}
+			if printJSON(state) {
+				return nil
+			}
+			d, o := state.Director, state.Overrides
+			w := table()
+			fmt.Fprintf(w, "started:\t%v\n", d.Started)
+			fmt.Fprintf(w, "applied generation:\t%d\n", d.AppliedGeneration)
+			fmt.Fprintf(w, "vips:\t%d v4, %d v6\n", len(d.VIPs), len(d.VIPs6))
+			if d.Frozen != "" {
+				fmt.Fprintf(w, "frozen:\t%s\n", d.Frozen)
+			}
+			if d.Error != "" {
+				fmt.Fprintf(w, "error:\t%s\n", d.Error)
+			}
+			fmt.Fprintf(w, "withdrawn:\t%s\n", list(o.Withdrawn))
+			fmt.Fprintf(w, "in maintenance:\t%d\n", len(o.Maintenance))
+			fmt.Fprintf(w, "drained nodes:\t%s\n", list(o.Drained))
+			return w.Flush()
+		}),
+	}
+}
+
+func list(s []string) string {
+	if len(s) == 0 {
+		return "none"
+	}
+	return strings.Join(s, ", ")
+}
+
+// vip is a row of the vips table
+type vip struct {
+	VIP         string `json:"vip"`
+	Family      string `json:"family"`
+	State       string `json:"state"`
+	Maintenance string `json:"maintenance,omitempty"`
+}
+
+func vips() *cobra.Command {
+	return &cobra.Command{
+		Use:   "vips",
+		Short: "list the VIPs of the director, and those withdrawn from it",
+		Args:  cobra.NoArgs,
+		RunE: call(func(c *control.Client, _ []string) error {
+			state, err := c.GetState()
+			if err != nil {
+				return err
+			}
+			rows := []vip{}
+			add := func(addrs []string, family, s string) {
+				for _, addr := range addrs {
+					row := vip{VIP: addr, Family: family, State: s}
+					if m, ok := state.Overrides.Maintenance[types.ServiceIP(addr)]; ok {
+						row.Maintenance = m.Action
+						if m.Withdraw {
+							row.Maintenance += ", withdrawn from bgp"
+						}
+					}
+					rows = append(rows, row)
+				}
+			}
+			add(state.Director.VIPs, "ipv4", "advertised")
+			add(state.Director.VIPs6, "ipv6", "advertised")
+			for _, addr := range state.Overrides.Withdrawn {
+				family := "ipv4"
+				if strings.Contains(addr, ":") {
+					family = "ipv6"
+				}
+				add([]string{addr}, family, "withdrawn")
+			}
+			if printJSON(rows) {
+				return nil
+			}
+			w := table()
+			fmt.Fprintln(w, "VIP\tFAMILY\tSTATE\tMAINTENANCE")
+			for _, row := range rows {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", row.VIP, row.Family, row.State, row.Maintenance)
+			}
+			return w.Flush()
+		}),
+	}
+}
+
+func backends() *cobra.Command {
+	return &cobra.Command{
+		Use:   "backends [vip]",
+		Short: "list the reals behind every virtual service, or those of one VIP, with their weights and connections",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: call(func(c *control.Client, args []string) error {
+			backends, err := c.GetBackends()
+			if err != nil {
+				return err
+			}
+			if len(args) == 1 {
+				for service := range backends {
+					if !strings.Contains(service, " "+args[0]+":") && !strings.Contains(service, " ["+args[0]+"]:") {
+						delete(backends, service)
+					}
+				}
+			}
+			if printJSON(backends) {
+				return nil
+			}
+			services := []string{}
+			for service := range backends {
+				services = append(services, service)
+			}
+			sort.Strings(services)
+			w := table()
+			fmt.Fprintln(w, "SERVICE\tREAL\tWEIGHT\tACTIVE\tINACTIVE")
+			for _, service := range services {
+				reals := []string{}
+				for real := range backends[service] {
+					reals = append(reals, real)
+				}
+				sort.Strings(reals)
+				for _, real := range reals {
+					s := backends[service][real]
+					fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", service, real, s.Weight, s.ActiveConns, s.InactiveConns)
+				}
+			}
+			return w.Flush()
+		}),
+	}
+}
+
+func drainNode() *cobra.Command {
+	var undo bool
+	cmd := &cobra.Command{
+		Use:   "drain-node <node>",
+		Short: "ramp the weights of the backends on a node down, as the drain annotation does",
+		Long: `
+drain-node treats the node as if it carried the ravel.comcast.com/drain
+annotation, on this director only. like the annotation, it has no effect
+unless the director ramps draining nodes down, see --ipvs-drain-ramp.`,
+		Args: cobra.ExactArgs(1),
+		RunE: call(func(c *control.Client, args []string) error {
+			return c.DrainNode(args[0], undo)
+		}),
+	}
+	cmd.Flags().BoolVar(&undo, "undo", false, "undrain the node")
+	return cmd
+}
+
+func forceReconcile() *cobra.Command {
+	return &cobra.Command{
+		Use:   "force-reconcile",
+		Short: "reconcile without a parity check",
+		Args:  cobra.NoArgs,
+		RunE: call(func(c *control.Client, _ []string) error {
+			return c.ForceReconcile()
+		}),
+	}
+}
+
+func diff() *cobra.Command {
+	return &cobra.Command{
+		Use:   "diff",
+		Short: "show how the ipvs rules in the kernel differ from those the director would apply now",
+		Long: `
+diff prints the rules only in the kernel prefixed with -, and those the
+director would add prefixed with +. it exits with 1 when there is a
+difference.`,
+		Args: cobra.NoArgs,
+		RunE: call(func(c *control.Client, _ []string) error {
+			diff, err := c.GetDiff()
+			if err != nil {
+				return err
+			}
+			if !printJSON(diff) {
+				if len(diff) == 0 {
+					fmt.Println("in parity")
+				}
+				for _, line := range diff {
+					fmt.Println(line)
+				}
+			}
+			if len(diff) > 0 {
+				os.Exit(1)
+			}
+			return nil
+		}),
+	}
+}
+
+func mtu() *cobra.Command {
+	return &cobra.Command{
+		Use:   "mtu",
+		Short: "list the mtu of every VIP device with one configured, and why those without it were left so",
+		Args:  cobra.NoArgs,
+		RunE: call(func(c *control.Client, _ []string) error {
+			statuses, err := c.GetMTU()
+			if err != nil {
+				return err
+			}
+			if printJSON(statuses) {
+				return nil
+			}
+			w := table()
+			fmt.Fprintln(w, "DEVICE\tVIP\tDESIRED\tCURRENT\tREASON")
+			for _, s := range statuses {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", s.Device, s.VIP, s.Desired, s.Current, s.Reason)
+			}
+			return w.Flush()
+		}),
+	}
+}
+
+func withdraw() *cobra.Command {
+	return &cobra.Command{
+		Use:   "withdraw <vip>",
+		Short: "take a VIP off the director",
+		Args:  cobra.ExactArgs(1),
+		RunE: call(func(c *control.Client, args []string) error {
+			return c.WithdrawVIP(args[0])
+		}),
+	}
+}
+
+func advertise() *cobra.Command {
+	return &cobra.Command{
+		Use:   "advertise <vip>",
+		Short: "put a withdrawn VIP back on the director",
+		Args:  cobra.ExactArgs(1),
+		RunE: call(func(c *control.Client, args []string) error {
+			return c.AdvertiseVIP(args[0])
+		}),
+	}
+}
+
+func maintenance() *cobra.Command {
+	m := types.Maintenance{}
+	var clearOverride bool
+	cmd := &cobra.Command{
+		Use:   "maintenance <vip>",
+		Short: "put a VIP in maintenance, or clear the override with --clear",
+		Args:  cobra.ExactArgs(1),
+		RunE: call(func(c *control.Client, args []string) error {
+			if clearOverride {
+				return c.SetMaintenance(args[0], nil)
+			}
+			return c.SetMaintenance(args[0], &m)
+		}),
+	}
+	cmd.Flags().StringVar(&m.Action, "action", types.MaintenanceReject, "reject|drop")
+	cmd.Flags().BoolVar(&m.Withdraw, "withdraw", false, "also stop advertising the VIP over BGP")
+	cmd.Flags().BoolVar(&clearOverride, "clear", false, "remove the override, so that the configmap decides again")
+	return cmd
+}
+
+func main() {
+	rootCmd.AddCommand(status(), vips(), backends(), drainNode(), forceReconcile(), diff(), mtu())
+	rootCmd.AddCommand(withdraw(), advertise(), maintenance())
+
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, "ravelctl:", err)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/system"
+	utilexec "github.com/Comcast/Ravel/pkg/util/exec"
+)
+
+func TestAgent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runner := system.NewRecordingCommandRunner()
+	runner.Respond("ipvsadm -Sn", "-A -t 10.54.213.165:80 -s wrr\n", nil)
+	runner.Respond("ip link add 10_54_213_165 type dummy", "RTNETLINK answers: File exists\n", errors.New("exit status 2"))
+	runner.Respond("ip -d -o link show dev 10_54_213_165", `5: 10_54_213_165: <BROADCAST,NOARP> mtu 1500 qdisc noop state DOWN \    link/ether 9e:64:3a:2c:0e:1f brd ff:ff:ff:ff:ff:ff promiscuity 0 \    dummy addrgenmode eui64 \    alias ravel`, nil)
+	runner.Respond("ip -d -o link show dev eth0", `2: eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc mq state UP \    link/ether 0a:1b:2c:3d:4e:5f brd ff:ff:ff:ff:ff:ff promiscuity 0`, nil)
+	sysctl := system.NewFakeSysctl(map[string]string{"net/ipv4/vs/conntrack": "1"})
+	go Serve(ctx, path, "RAVEL", runner, sysctl, logrus.New())
+
+	var client *Client
+	var err error
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if client, err = Dial(path); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	out, err := client.Run(ctx, nil, "ipvsadm", "-Sn")
+	if err != nil || string(out) != "-A -t 10.54.213.165:80 -s wrr\n" {
+		t.Fatalf("expected the output of ipvsadm. have %q %v", out, err)
+	}
+
+	// failed commands keep their output, which callers inspect
+	out, err = client.Run(ctx, nil, "ip", "link", "add", "10_54_213_165", "type", "dummy")
+	if err == nil || !strings.Contains(string(out), "File exists") {
+		t.Fatalf("expected the failure and its output. have %q %v", out, err)
+	}
+
+	// operations outside the policy never reach the runner
+	if _, err := client.Run(ctx, nil, "ip", "link", "del", "eth0"); err == nil {
+		t.Fatal("expected the agent to refuse to delete the node's own device")
+	}
+	if _, err := client.Run(ctx, nil, "sh", "-c", "id"); err == nil {
+		t.Fatal("expected the agent to refuse a shell")
+	}
+
+	// addresses only go on the devices ravel labeled, which the agent reads
+	if _, err := client.Run(ctx, nil, "ip", "address", "add", "10.54.213.165", "dev", "10_54_213_165"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run(ctx, nil, "ip", "address", "add", "10.54.213.165", "dev", "eth0"); err == nil {
+		t.Fatal("expected the agent to refuse an address on the node's own device")
+	}
+	for _, line := range runner.CommandLines() {
+		if line == "ip link del eth0" || line == "ip address add 10.54.213.165 dev eth0" || strings.HasPrefix(line, "sh") {
+			t.Fatalf("expected refused operations not to be run. have %v", runner.CommandLines())
+		}
+	}
+
+	// iptables restores are fed through stdin
+	if _, err := client.Exec().CommandContext(ctx, "iptables-restore", "--noflush").CombinedOutput(); err != nil {
+		t.Fatal(err)
+	}
+	cmd := client.Exec().CommandContext(ctx, "iptables-restore", "--noflush")
+	cmd.SetStdin(strings.NewReader("*nat\nCOMMIT\n"))
+	if _, err := cmd.CombinedOutput(); err != nil {
+		t.Fatal(err)
+	}
+	if c := runner.Commands[len(runner.Commands)-1]; c.Stdin != "*nat\nCOMMIT\n" {
+		t.Fatalf("expected the restore input to reach the agent. have %q", c.Stdin)
+	}
+	var _ utilexec.ExitError = &exitError{}
+
+	s := client.Sysctl()
+	if err := s.Set("net/ipv4/vs/conntrack", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Get("net/ipv4/vs/conntrack"); err != nil || v != "0" {
+		t.Fatalf("expected the sysctl to be set through the agent. have %q %v", v, err)
+	}
+	if err := s.Set("kernel/core_pattern", "|/tmp/x"); err == nil {
+		t.Fatal("expected the agent to refuse a sysctl ravel doesn't set")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		args  []string
+		valid bool
+	}{
+		{"ipvsadm", []string{"-R"}, true},
+		{"ip", []string{"-6", "address", "add", "2001:db8::1", "dev", "2001db81"}, true},
+		{"ip", []string{"link", "del", "10_54_213_165", "type", "dummy"}, true},
+		{"ip", []string{"link", "set", "eth0", "down"}, false},
+		{"ip", []string{"link", "set", "dev", "10_54_213_165", "alias", "ravel"}, true},
+		{"ip", []string{"-d", "-o", "link", "show", "type", "vrf"}, true},
+		{"ip", []string{"link", "add", "tenant-a", "type", "vrf", "table", "100"}, true},
+		{"ip", []string{"link", "set", "dev", "10_54_213_165", "master", "tenant-a"}, true},
+		{"ip", []string{"link", "set", "dev", "eth0", "master", "bond0", "x"}, false},
+		{"ip", []string{"-4", "rule", "add", "fwmark", "1", "lookup", "100"}, true},
+		{"ip", []string{"netns", "exec", "x", "sh"}, false},
+		{"conntrack", []string{"-D", "-f", "ipv4"}, true},
+		{"conntrack", []string{"-F"}, false},
+		{"ifconfig", []string{"10_54_213_165", "mtu", "9000"}, true},
+		{"ifconfig", []string{"eth0", "down"}, false},
+		{"ifconfig", []string{"10_54_213_165", "mtu", "9000;"}, false},
+		{"ip", []string{"link", "set", "dev", "eth0", "alias", "mine"}, false},
+		{"ip", []string{"-4", "rule", "add", "fwmark", "1", "lookup", "main"}, false},
+		{"ip", []string{"-4", "rule", "add", "from", "10.54.213.165", "lookup", "200", "priority", "10100"}, true},
+		{"ip", []string{"-4", "route", "replace", "default", "via", "10.0.0.1", "dev", "eth1", "table", "200"}, true},
+		{"ip", []string{"-4", "route", "replace", "default", "via", "10.0.0.1", "dev", "eth1"}, false},
+		{"ip", []string{"-6", "route", "del", "default", "table", "254"}, false},
+		{"ip", []string{"address", "flush", "dev", "eth0"}, false},
+		{"iptables", []string{"-w", "5", "-N", "RAVEL-FWMARK", "-t", "mangle"}, true},
+		{"iptables", []string{"-w2", "-F", "KUBE-SERVICES", "-t", "nat"}, false},
+		{"iptables", []string{"-C", "PREROUTING", "-t", "nat", "-j", "RAVEL"}, true},
+		{"iptables", []string{"-I", "PREROUTING", "-t", "nat", "-j", "ACCEPT"}, false},
+		{"iptables", []string{"-D", "PREROUTING", "-t", "nat", "-j", "RAVEL", "-j", "DROP"}, false},
+		{"iptables", []string{"-P", "INPUT", "DROP"}, false},
+		{"ip6tables", []string{"--version"}, true},
+		{"iptables-restore", []string{"-T", "nat"}, false},
+		{"/usr/sbin/arping", []string{"-c", "1", "-s", "10.54.213.165", "10.54.213.1", "-I", "eth0"}, true},
+		{"/usr/sbin/arping", []string{"-c", "100000", "-s", "10.54.213.165", "10.54.213.1", "-I", "eth0"}, false},
+		{"/bin/sh", nil, false},
+	} {
+		if err := Validate("RAVEL", c.name, c.args, nil); (err == nil) != c.valid {
+			t.Errorf("%s %v: expected valid=%v. have %v", c.name, c.args, c.valid, err)
+		}
+	}
+}
+
+func TestValidateRestore(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		input string
+		valid bool
+	}{
+		{"ravel chains", "*nat\n:RAVEL - [0:0]\n:RAVEL-SVC-1 - [0:0]\n-A RAVEL -d 10.54.213.165/32 -j RAVEL-SVC-1\n-A RAVEL-SVC-1 -m comment --comment \"default/web:http\" -j KUBE-MARK-MASQ\n-X RAVEL-SVC-2\nCOMMIT\n", true},
+		{"jumps", "*nat\n-A PREROUTING -j RAVEL\n-D OUTPUT -m mark --mark 0x1 -j RAVEL\n-I PREROUTING 1 -j RAVEL\nCOMMIT\n", true},
+		{"declared builtin", "*nat\n:PREROUTING ACCEPT [0:0]\nCOMMIT\n", false},
+		{"other chain", "*nat\n:KUBE-SERVICES - [0:0]\nCOMMIT\n", false},
+		{"other rule", "*filter\n-A INPUT -j DROP\nCOMMIT\n", false},
+		{"quoted jump", "*filter\n-A INPUT -m comment --comment \"-j RAVEL\" \"-j\" DROP\nCOMMIT\n", false},
+		{"policy", "*filter\n-P INPUT DROP\nCOMMIT\n", false},
+	} {
+		if err := Validate("RAVEL", "iptables-restore", []string{"-T", "nat", "--noflush", "--counters"}, []byte(c.input)); (err == nil) != c.valid {
+			t.Errorf("%s: expected valid=%v. have %v", c.name, c.valid, err)
+		}
+	}
+}
+
+func TestCheckDevice(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		link    string
+		labeled bool
+		valid   bool
+	}{
+		{"labeled dummy", `5: 10_54_213_165: <BROADCAST,NOARP> mtu 1500 \    link/ether 9e:64:3a:2c:0e:1f promiscuity 0 \    dummy addrgenmode eui64 \    alias ravel`, true, true},
+		{"unlabeled dummy", `5: 10_54_213_165: <BROADCAST,NOARP> mtu 1500 \    link/ether 9e:64:3a:2c:0e:1f promiscuity 0 \    dummy addrgenmode eui64`, true, false},
+		{"labeling a dummy", `5: 10_54_213_165: <BROADCAST,NOARP> mtu 1500 \    link/ether 9e:64:3a:2c:0e:1f promiscuity 0 \    dummy addrgenmode eui64`, false, true},
+		{"vrf", `7: tenant-a: <NOARP,MASTER,UP,LOWER_UP> mtu 65575 \    link/ether 5e:10:8a:2b:1c:0d promiscuity 0 \    vrf table 100 addrgenmode eui64 \    alias ravel`, true, true},
+		{"node device", `2: eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 \    link/ether 0a:1b:2c:3d:4e:5f promiscuity 0`, false, false},
+		{"aliased as a dummy", `2: eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 \    link/ether 0a:1b:2c:3d:4e:5f promiscuity 0 \    alias dummy`, false, false},
+	} {
+		if err := checkDevice("dev", c.link, c.labeled); (err == nil) != c.valid {
+			t.Errorf("%s: expected valid=%v. have %v", c.name, c.valid, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sync"
+
+	"github.com/Comcast/Ravel/pkg/system"
+	utilexec "github.com/Comcast/Ravel/pkg/util/exec"
+)
+
+// Client sends kernel operations to the agent serving a unix socket. A
+// connection that breaks, as when the agent restarts, is made again on the
+// next operation.
+type Client struct {
+	sync.Mutex
+
+	path   string
+	client *rpc.Client
+}
+
+// Dial connects to the agent at path
+func Dial(path string) (*Client, error) {
+	c := &Client{path: path}
+	if _, err := c.connection(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// connection returns the connection to the agent, making it when there's none
+func (c *Client) connection() (*rpc.Client, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.client != nil {
+		return c.client, nil
+	}
+	conn, err := net.Dial("unix", c.path)
+	if err != nil {
+		return nil, fmt.Errorf("agent: unable to connect to %s. %v", c.path, err)
+	}
+	c.client = jsonrpc.NewClient(conn)
+	return c.client, nil
+}
+
+// call calls method on the agent, giving up on the reply when ctx is done
+func (c *Client) call(ctx context.Context, method string, args, reply interface{}) error {
+	client, err := c.connection()
+	if err != nil {
+		return err
+	}
+	call := client.Go(serviceName+"."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-call.Done:
+	}
+	if errors.Is(call.Error, rpc.ErrShutdown) || errors.Is(call.Error, io.ErrUnexpectedEOF) {
+		c.Lock()
+		if c.client == client {
+			c.client = nil
+		}
+		c.Unlock()
+		client.Close()
+	}
+	return call.Error
+}
+
+// Close closes the connection to the agent
+func (c *Client) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
+
+// Run has the agent execute name with args, and returns its combined output.
+// It makes the Client a system.CommandRunner.
+func (c *Client) Run(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	reply := &RunReply{}
+	if err := c.call(ctx, "Run", RunArgs{Name: name, Args: args, Stdin: stdin}, reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return reply.Output, &exitError{message: reply.Error, status: reply.ExitStatus}
+	}
+	return reply.Output, nil
+}
+
+// Sysctl returns a system.Sysctl that reads and writes kernel parameters
+// through the agent
+func (c *Client) Sysctl() system.Sysctl {
+	return clientSysctl{c}
+}
+
+// Exec returns a utilexec.Interface whose commands are executed by the agent,
+// for the iptables runners
+func (c *Client) Exec() utilexec.Interface {
+	return clientExec{c}
+}
+
+// exitError is a command that failed in the agent. It satisfies
+// utilexec.ExitError, so that callers can tell exit statuses apart.
+type exitError struct {
+	message string
+	status  int
+}
+
+func (e *exitError) Error() string  { return e.message }
+func (e *exitError) String() string { return e.message }
+func (e *exitError) Exited() bool   { return e.status > 0 }
+func (e *exitError) ExitStatus() int {
+	return e.status
+}
+
+type clientSysctl struct {
+	c *Client
+}
+
+func (s clientSysctl) Get(name string) (string, error) {
+	reply := &SysctlReply{}
+	if err := s.c.call(context.Background(), "GetSysctl", SysctlArgs{Name: name}, reply); err != nil {
+		return "", fmt.Errorf("sysctl: unable to read %s. %v", name, err)
+	}
+	return reply.Value, nil
+}
+
+func (s clientSysctl) Set(name, value string) error {
+	if err := s.c.call(context.Background(), "SetSysctl", SysctlArgs{Name: name, Value: value}, &SysctlReply{}); err != nil {
+		return fmt.Errorf("sysctl: unable to set %s to %s. %v", name, value, err)
+	}
+	return nil
+}
+
+type clientExec struct {
+	c *Client
+}
+
+func (e clientExec) Command(cmd string, args ...string) utilexec.Cmd {
+	return e.CommandContext(context.Background(), cmd, args...)
+}
+
+func (e clientExec) CommandContext(ctx context.Context, cmd string, args ...string) utilexec.Cmd {
+	return &clientCmd{c: e.c, ctx: ctx, name: cmd, args: args}
+}
+
+// LookPath returns file as it is; the agent finds binaries on its own path
+func (e clientExec) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+// clientCmd is a command the agent executes. The agent only returns the
+// combined output, so Output returns that too.
+type clientCmd struct {
+	c      *Client
+	ctx    context.Context
+	name   string
+	args   []string
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+func (cmd *clientCmd) CombinedOutput() ([]byte, error) {
+	var stdin []byte
+	if cmd.stdin != nil {
+		b, err := ioutil.ReadAll(cmd.stdin)
+		if err != nil {
+			return nil, err
+		}
+		stdin = b
+	}
+	out, err := cmd.c.Run(cmd.ctx, stdin, cmd.name, cmd.args...)
+	if cmd.stdout != nil {
+		io.Copy(cmd.stdout, bytes.NewReader(out))
+	}
+	return out, err
+}
+
+func (cmd *clientCmd) Output() ([]byte, error) {
+	return cmd.CombinedOutput()
+}
+
+func (cmd *clientCmd) SetDir(dir string) {}
+
+func (cmd *clientCmd) SetStdin(in io.Reader) {
+	cmd.stdin = in
+}
+
+func (cmd *clientCmd) SetStdout(out io.Writer) {
+	cmd.stdout = out
+}
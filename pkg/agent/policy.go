@@ -0,0 +1,320 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// sysctlPrefixes are the kernel parameters, as paths below /proc/sys, that the
+// agent reads and writes: ipvs, arp, conntrack and syn cookies
+var sysctlPrefixes = []string{
+	"net/ipv4/vs/",
+	"net/ipv4/conf/",
+	"net/ipv6/conf/",
+	"net/netfilter/",
+	"net/ipv4/tcp_syncookies",
+}
+
+// reservedTables are the routing tables of the node itself: unspec, default,
+// main and local. Every other table ravel routes and looks up is one the
+// config names, for return routes, vrfs and tproxy.
+var reservedTables = map[string]bool{"0": true, "253": true, "254": true, "255": true, "default": true, "main": true, "local": true, "unspec": true}
+
+// the mtu range ifconfig may set, as system checks overrides against
+const (
+	minMTU = 68
+	maxMTU = 65535
+)
+
+// ownerAlias is the alias ravel sets on the dummy and vrf devices it creates,
+// see system.IP
+const ownerAlias = "ravel"
+
+// Validate returns an error unless running name with args, and stdin for the
+// iptables restores, is an operation ravel needs. Commands are executed
+// directly, never through a shell, so only the binary and the shape of its
+// arguments are checked. chain is the prefix of the iptables chains ravel
+// owns, its --iptables-chain: iptables only changes those chains and the jumps
+// to them. The devices operations change are checked against the kernel by the
+// agent, see targetDevice.
+func Validate(chain, name string, args []string, stdin []byte) error {
+	switch name {
+	case "ipvsadm", "jool_siit", "iptables-save", "ip6tables-save":
+		// these only ever act on ipvs and the siit translator, or read
+		return nil
+	case "iptables", "ip6tables":
+		return validateIPTables(chain, args)
+	case "iptables-restore", "ip6tables-restore":
+		return validateRestore(chain, args, stdin)
+	case "/usr/sbin/arping":
+		// arping -c 1 -s <vip> <gateway> -I <device>, see system.IP
+		if len(args) == 7 && args[0] == "-c" && args[1] == "1" && args[2] == "-s" && net.ParseIP(args[3]) != nil && net.ParseIP(args[4]) != nil && args[5] == "-I" {
+			return nil
+		}
+		return fmt.Errorf("agent: arping may only send one request from a VIP to the gateway")
+	case "conntrack":
+		if len(args) > 0 && (args[0] == "-D" || args[0] == "-L") {
+			return nil
+		}
+		return fmt.Errorf("agent: conntrack may only list or delete entries")
+	case "ifconfig":
+		if len(args) == 3 && args[1] == "mtu" {
+			if mtu, err := strconv.Atoi(args[2]); err == nil && mtu >= minMTU && mtu <= maxMTU {
+				return nil
+			}
+		}
+		return fmt.Errorf("agent: ifconfig may only set the mtu of a device, between %d and %d", minMTU, maxMTU)
+	case "ip":
+		return validateIP(args)
+	}
+	return fmt.Errorf("agent: %s is not an operation ravel runs", name)
+}
+
+// validateIPTables allows the iptables commands of the runner: reading the
+// version, and creating, flushing and deleting the chains of ravel and the
+// rules in them, or the rules of other chains that jump to them
+func validateIPTables(chain string, args []string) error {
+	// the lock wait, -w, -w2 or -w <seconds>
+	for len(args) > 0 && strings.HasPrefix(args[0], "-w") {
+		if args[0] == "-w" && len(args) > 1 {
+			if _, err := strconv.Atoi(args[1]); err == nil {
+				args = args[1:]
+			}
+		}
+		args = args[1:]
+	}
+	if len(args) == 1 && args[0] == "--version" {
+		return nil
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("agent: iptables needs an operation and a chain")
+	}
+	if err := validateChainOp(chain, args); err != nil {
+		return fmt.Errorf("agent: iptables %s. %v", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// validateRestore allows iptables-restore --noflush, with input that only
+// declares and changes the chains of ravel, and adds or removes the jumps to
+// them, so that the chains of other programs are never flushed or rewritten
+func validateRestore(chain string, args []string, stdin []byte) error {
+	if len(args) == 1 && args[0] == "--version" {
+		return nil
+	}
+	noflush := false
+	for _, arg := range args {
+		if arg == "--noflush" || arg == "-n" {
+			noflush = true
+		}
+	}
+	if !noflush {
+		return fmt.Errorf("agent: iptables-restore may only run with --noflush")
+	}
+
+	for n, line := range strings.Split(string(stdin), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || line == "COMMIT" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "*"):
+			continue
+		case strings.HasPrefix(line, ":"):
+			// declaring a chain with --noflush flushes it
+			if name := strings.Fields(line[1:]); len(name) == 0 || !ownedChain(chain, name[0]) {
+				return fmt.Errorf("agent: iptables-restore may only declare the chains of ravel. line %d: %s", n+1, line)
+			}
+			continue
+		}
+		if err := validateChainOp(chain, restoreFields(line)); err != nil {
+			return fmt.Errorf("agent: iptables-restore line %d: %s. %v", n+1, line, err)
+		}
+	}
+	return nil
+}
+
+// restoreFields splits a line of iptables-restore input into its arguments,
+// with the quotes iptables-restore strips removed, so that a quoted option
+// isn't taken for a value
+func restoreFields(line string) []string {
+	fields := strings.Fields(line)
+	for n, field := range fields {
+		fields[n] = strings.Trim(field, `"'`)
+	}
+	return fields
+}
+
+// validateChainOp checks an iptables operation, its chain and the rest of its
+// arguments. The chains of ravel may be changed in any way, other chains may
+// only have rules that jump to them added and removed.
+func validateChainOp(chain string, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("an operation needs a chain")
+	}
+	op, target := args[0], args[1]
+	switch op {
+	case "-N", "--new-chain", "-F", "--flush", "-X", "--delete-chain", "-Z", "--zero", "-R", "--replace":
+		if ownedChain(chain, target) {
+			return nil
+		}
+		return fmt.Errorf("only the chains of ravel, starting with %s, may be created, flushed, replaced or deleted", chain)
+	case "-A", "--append", "-I", "--insert", "-D", "--delete", "-C", "--check":
+		if ownedChain(chain, target) || jumpsTo(chain, args[2:]) {
+			return nil
+		}
+		return fmt.Errorf("rules of %s may only jump to the chains of ravel, starting with %s", target, chain)
+	}
+	return fmt.Errorf("%s is not an operation ravel runs", op)
+}
+
+// ownedChain returns true for the chains of ravel, which start with chain
+func ownedChain(chain, name string) bool {
+	return chain != "" && strings.HasPrefix(name, chain)
+}
+
+// jumpsTo returns true when the rule in args jumps to the chains of ravel, and
+// to nothing else
+func jumpsTo(chain string, args []string) bool {
+	found := false
+	for n, arg := range args {
+		switch arg {
+		case "-j", "--jump", "-g", "--goto":
+			if n+1 >= len(args) || !ownedChain(chain, args[n+1]) {
+				return false
+			}
+			found = true
+		}
+	}
+	return found
+}
+
+// validateIP allows the ip commands of the address manager and the policy
+// routing: dummy and vrf devices and their addresses, and the rules and routes
+// of the tables other than the node's own
+func validateIP(args []string) error {
+	// the family, and the one line and detailed output options
+	for len(args) > 0 && (args[0] == "-4" || args[0] == "-6" || args[0] == "-o" || args[0] == "-d") {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("agent: ip needs an object and a command")
+	}
+	switch object, command := args[0], args[1]; object {
+	case "link":
+		switch command {
+		case "show":
+			return nil
+		case "add", "del":
+			// only the dummy devices that hold VIPs and the vrfs they are
+			// placed in, never the node's own
+			if len(args) == 5 && args[3] == "type" && (args[4] == "dummy" || args[4] == "vrf") {
+				return nil
+			}
+			if command == "add" && len(args) == 7 && args[3] == "type" && args[4] == "vrf" && args[5] == "table" && !reservedTables[args[6]] {
+				return nil
+			}
+		case "set":
+			// the alias that marks the devices ravel owns, the vrf a device
+			// is placed in, and bringing up a vrf
+			if len(args) == 6 && args[2] == "dev" && (args[4] == "alias" && args[5] == ownerAlias || args[4] == "master") {
+				return nil
+			}
+			if len(args) == 5 && args[2] == "dev" && (args[4] == "nomaster" || args[4] == "up") {
+				return nil
+			}
+		}
+		return fmt.Errorf("agent: ip link may only show, add and delete dummy and vrf devices, or set their alias, vrf and state")
+	case "address", "addr":
+		switch command {
+		case "show":
+			return nil
+		case "add", "del":
+			if len(args) == 5 && args[3] == "dev" {
+				return nil
+			}
+		}
+		return fmt.Errorf("agent: ip address may only show addresses, or add and delete an address of a device")
+	case "rule", "route":
+		if command == "show" {
+			return nil
+		}
+		// rules look up, and routes go in, a table of ravel
+		key := "table"
+		if object == "rule" {
+			key = "lookup"
+		}
+		for n := 2; n < len(args)-1; n++ {
+			if args[n] == key {
+				if reservedTables[args[n+1]] {
+					break
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("agent: ip %s may only change the tables ravel routes, never the node's own", object)
+	}
+	return fmt.Errorf("agent: ip %s is not an operation ravel runs", strings.Join(args, " "))
+}
+
+// targetDevice returns the device an operation that passes Validate changes,
+// and whether the device must already carry the alias of ravel. It returns no
+// device for operations that create devices or change none. Devices may only
+// ever be dummy and vrf devices, see checkDevice.
+func targetDevice(name string, args []string) (string, bool) {
+	switch name {
+	case "ifconfig":
+		return args[0], true
+	case "ip":
+		for len(args) > 0 && (args[0] == "-4" || args[0] == "-6" || args[0] == "-o" || args[0] == "-d") {
+			args = args[1:]
+		}
+		switch object, command := args[0], args[1]; {
+		case (object == "address" || object == "addr") && (command == "add" || command == "del"):
+			return args[4], true
+		case object == "link" && command == "del":
+			return args[2], true
+		case object == "link" && command == "set":
+			// labeling is how a device becomes ravel's
+			return args[3], args[4] != "alias"
+		}
+	}
+	return "", false
+}
+
+// checkDevice returns an error unless link, the device's line of
+// `ip -d -o link show dev <device>`, is a dummy or vrf device that carries the
+// alias of ravel, or needn't when labeled is false
+func checkDevice(device, link string, labeled bool) error {
+	fields := strings.Fields(strings.ReplaceAll(link, `\`, " "))
+	kind, alias := false, ""
+	for n := 2; n < len(fields); n++ {
+		if fields[n] == "alias" {
+			// the alias is the rest of the line
+			alias = strings.Join(fields[n+1:], " ")
+			break
+		}
+		if fields[n] == "dummy" || fields[n] == "vrf" && n+1 < len(fields) && fields[n+1] == "table" {
+			kind = true
+		}
+	}
+	if !kind {
+		return fmt.Errorf("agent: %s is not a dummy or vrf device", device)
+	}
+	if labeled && alias != ownerAlias {
+		return fmt.Errorf("agent: %s doesn't carry the alias %s of the devices ravel owns", device, ownerAlias)
+	}
+	return nil
+}
+
+// ValidateSysctl returns an error unless name is a kernel parameter ravel sets
+func ValidateSysctl(name string) error {
+	if strings.Contains(name, "..") {
+		return fmt.Errorf("agent: invalid sysctl %s", name)
+	}
+	for _, prefix := range sysctlPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("agent: sysctl %s is not one ravel sets", name)
+}
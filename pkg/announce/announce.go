@@ -0,0 +1,210 @@
+// Package announce tells the network which node owns a VIP. Each Announcer
+// implements one strategy - gratuitous ARP, IPv6 neighbor advertisement, BGP
+// route injection or VRRP - and a Set dispatches every VIP to the strategy
+// selected for it in the cluster config, so L2 and L3 announcement can be
+// mixed in one deployment.
+package announce
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// the announcement strategies that can be selected for a VIP
+const (
+	ARP  = "arp"
+	NDP  = "ndp"
+	BGP  = "bgp"
+	VRRP = "vrrp"
+)
+
+// Announcer announces ownership of a set of VIPs using a single strategy.
+// Announce is called periodically and must be safe to repeat.
+type Announcer interface {
+	// Name returns the strategy implemented, as used in the cluster config
+	Name() string
+
+	// Announce claims or refreshes ownership of vips. It returns Errors when
+	// only some of the VIPs could be announced.
+	Announce(ctx context.Context, vips []string) error
+
+	// Withdraw gives up ownership of vips, which the node no longer serves.
+	// Strategies that only refresh the neighbor caches of the segment have
+	// nothing to withdraw, as the entries age out.
+	Withdraw(ctx context.Context, vips []string) error
+}
+
+// Errors maps each VIP that could not be announced to the reason
+type Errors map[string]error
+
+func (e Errors) Error() string {
+	vips := []string{}
+	for vip := range e {
+		vips = append(vips, vip)
+	}
+	sort.Strings(vips)
+
+	msgs := []string{}
+	for _, vip := range vips {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", vip, e[vip]))
+	}
+	return "announce: " + strings.Join(msgs, "; ")
+}
+
+// add records err against every VIP in vips, expanding Errors returned by an Announcer
+func (e Errors) add(vips []string, err error) {
+	if errs, ok := err.(Errors); ok {
+		for vip, err := range errs {
+			e[vip] = err
+		}
+		return
+	}
+	for _, vip := range vips {
+		e[vip] = err
+	}
+}
+
+// Set dispatches VIPs to the Announcer selected for them
+type Set struct {
+	// Default4 and Default6 are the strategies used for VIPs without an entry
+	// in the cluster config
+	Default4 string
+	Default6 string
+
+	announcers map[string]Announcer
+	logger     log.FieldLogger
+}
+
+// NewSet creates a Set from announcers, keyed by their Name
+func NewSet(default4, default6 string, logger log.FieldLogger, announcers ...Announcer) (*Set, error) {
+	s := &Set{
+		Default4:   default4,
+		Default6:   default6,
+		announcers: map[string]Announcer{},
+		logger:     logger.WithFields(log.Fields{"module": "announce"}),
+	}
+	for _, a := range announcers {
+		s.announcers[a.Name()] = a
+	}
+	for _, d := range []string{default4, default6} {
+		if _, ok := s.announcers[d]; d != "" && !ok {
+			return nil, fmt.Errorf("announce: default strategy %s has no announcer", d)
+		}
+	}
+	return s, nil
+}
+
+// Elected reports whether this node owns the VIPs it announces: false while
+// its vrrp announcer is a backup, and true without vrrp
+func (s *Set) Elected() bool {
+	if vrrp, ok := s.announcers[VRRP].(*VRRPAnnouncer); ok {
+		return vrrp.IsMaster()
+	}
+	return true
+}
+
+// Backup reports whether the v4 vip is announced with vrrp while this node is
+// a vrrp backup, so that it must not be configured: a backup holding the VIP
+// would answer ARP for it alongside the master.
+func (s *Set) Backup(vip string, selected map[types.ServiceIP]string) bool {
+	if s.strategy(vip, s.Default4, selected) != VRRP {
+		return false
+	}
+	vrrp, ok := s.announcers[VRRP].(*VRRPAnnouncer)
+	return ok && !vrrp.IsMaster()
+}
+
+// Strategies returns the names of the registered announcers
+func (s *Set) Strategies() []string {
+	out := []string{}
+	for name := range s.announcers {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Announce announces vips4 and vips6, choosing the strategy for each from
+// selected and falling back to the defaults. All strategies are attempted
+// even if one fails.
+func (s *Set) Announce(ctx context.Context, vips4, vips6 []string, selected map[types.ServiceIP]string) error {
+	return s.dispatch(vips4, vips6, selected, func(a Announcer, vips []string) error {
+		return a.Announce(ctx, vips)
+	})
+}
+
+// Withdraw withdraws vips4 and vips6, which were announced with the strategies
+// selected for them, when the node stops serving them. All strategies are
+// attempted even if one fails.
+func (s *Set) Withdraw(ctx context.Context, vips4, vips6 []string, selected map[types.ServiceIP]string) error {
+	return s.dispatch(vips4, vips6, selected, func(a Announcer, vips []string) error {
+		return a.Withdraw(ctx, vips)
+	})
+}
+
+// dispatch calls do with the announcer of each strategy and its VIPs
+func (s *Set) dispatch(vips4, vips6 []string, selected map[types.ServiceIP]string, do func(a Announcer, vips []string) error) error {
+	byStrategy := map[string][]string{}
+	for _, vip := range vips4 {
+		strategy := s.strategy(vip, s.Default4, selected)
+		byStrategy[strategy] = append(byStrategy[strategy], vip)
+	}
+	for _, vip := range vips6 {
+		strategy := s.strategy(vip, s.Default6, selected)
+		byStrategy[strategy] = append(byStrategy[strategy], vip)
+	}
+
+	errs := Errors{}
+	for strategy, vips := range byStrategy {
+		a, ok := s.announcers[strategy]
+		if !ok {
+			errs.add(vips, fmt.Errorf("announce strategy %q is not enabled. have %v", strategy, s.Strategies()))
+			continue
+		}
+		if err := do(a, vips); err != nil {
+			errs.add(vips, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Burst announces vips4 and vips6 with the default strategies count times,
+// interval apart, for operators forcing announcements during an incident, i.e.
+// when a switch kept a stale neighbor entry after a failover. Every round is
+// attempted, and the error of the last one that failed is returned.
+func (s *Set) Burst(ctx context.Context, vips4, vips6 []string, count int, interval time.Duration) error {
+	var failed error
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+		if err := s.Announce(ctx, vips4, vips6, nil); err != nil {
+			s.logger.Errorf("announcement %d of %d failed. %v", i+1, count, err)
+			failed = err
+			continue
+		}
+		s.logger.Infof("announcement %d of %d sent for %d VIPs", i+1, count, len(vips4)+len(vips6))
+	}
+	return failed
+}
+
+func (s *Set) strategy(vip, def string, selected map[types.ServiceIP]string) string {
+	if strategy, ok := selected[types.ServiceIP(vip)]; ok && strategy != "" {
+		return strategy
+	}
+	return def
+}
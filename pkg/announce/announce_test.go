@@ -0,0 +1,380 @@
+package announce
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+type recordingAnnouncer struct {
+	name      string
+	vips      []string
+	withdrawn []string
+}
+
+func (r *recordingAnnouncer) Name() string { return r.name }
+
+func (r *recordingAnnouncer) Announce(_ context.Context, vips []string) error {
+	r.vips = append(r.vips, vips...)
+	return nil
+}
+
+func (r *recordingAnnouncer) Withdraw(_ context.Context, vips []string) error {
+	r.withdrawn = append(r.withdrawn, vips...)
+	return nil
+}
+
+func TestSetDispatchesBySelection(t *testing.T) {
+	ip := system.NewFakeIP()
+	bgp := &recordingAnnouncer{name: BGP}
+	s, err := NewSet(ARP, NDP, logrus.New(), NewARP(ip), NewNDP(ip), bgp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selected := map[types.ServiceIP]string{"10.54.213.166": BGP}
+	err = s.Announce(context.Background(), []string{"10.54.213.165", "10.54.213.166"}, []string{"2001:558:1044:1ae::7"}, selected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ip.Advertised) != 2 {
+		t.Fatalf("expected the arp and ndp VIPs to be advertised on the interface. saw %v", ip.Advertised)
+	}
+	if len(bgp.vips) != 1 || bgp.vips[0] != "10.54.213.166" {
+		t.Fatalf("expected only the selected VIP to be announced with bgp. saw %v", bgp.vips)
+	}
+}
+
+func TestSetWithdraw(t *testing.T) {
+	ip := system.NewFakeIP()
+	bgp := &recordingAnnouncer{name: BGP}
+	s, err := NewSet(ARP, NDP, logrus.New(), NewARP(ip), NewNDP(ip), bgp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selected := map[types.ServiceIP]string{"10.54.213.166": BGP}
+	if err := s.Withdraw(context.Background(), []string{"10.54.213.165", "10.54.213.166"}, nil, selected); err != nil {
+		t.Fatal(err)
+	}
+	if len(bgp.withdrawn) != 1 || bgp.withdrawn[0] != "10.54.213.166" || len(ip.Advertised) != 0 {
+		t.Fatalf("expected only the bgp VIP to be withdrawn. saw %v and %v advertised", bgp.withdrawn, ip.Advertised)
+	}
+}
+
+func TestSetUnknownStrategy(t *testing.T) {
+	ip := system.NewFakeIP()
+	s, err := NewSet(ARP, NDP, logrus.New(), NewARP(ip), NewNDP(ip))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Announce(context.Background(), []string{"10.54.213.165", "10.54.213.166"}, nil, map[types.ServiceIP]string{"10.54.213.166": VRRP})
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 1 || errs["10.54.213.166"] == nil {
+		t.Fatalf("expected an error for the VIP with a disabled strategy only. saw %v", err)
+	}
+	if len(ip.Advertised) != 1 {
+		t.Fatalf("expected the other VIP to be announced. saw %v", ip.Advertised)
+	}
+
+	if _, err := NewSet(BGP, NDP, logrus.New(), NewARP(ip)); err == nil {
+		t.Fatal("expected an error for a default strategy without an announcer")
+	}
+}
+
+func TestBurst(t *testing.T) {
+	ip := system.NewFakeIP()
+	s, err := NewSet(ARP, NDP, logrus.New(), NewARP(ip), NewNDP(ip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Burst(context.Background(), []string{"10.54.213.165"}, []string{"2001:558:1044:1ae::7"}, 3, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if len(ip.Advertised) != 6 {
+		t.Fatalf("expected both VIPs to be announced three times. saw %v", ip.Advertised)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Burst(ctx, []string{"10.54.213.165"}, nil, 3, time.Hour); err != context.Canceled {
+		t.Fatalf("expected the burst to stop with its context. saw %v", err)
+	}
+}
+
+type capturedPacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+type fakeConn struct {
+	packets []capturedPacket
+}
+
+func (f *fakeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	f.packets = append(f.packets, capturedPacket{b: b, addr: addr})
+	return len(b), nil
+}
+
+func (f *fakeConn) ReadFrom(b []byte) (int, net.Addr, error) { return 0, nil, io.EOF }
+func (f *fakeConn) Close() error                             { return nil }
+
+func TestAdvertisementRoundTrip(t *testing.T) {
+	ad := &Advertisement{VRID: 51, Priority: 150, Interval: time.Second, VIPs: []net.IP{net.ParseIP("10.54.213.165"), net.ParseIP("10.54.213.166")}}
+	b, err := ad.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != vrrpHeaderLen+8+vrrpAuthDataLen {
+		t.Fatalf("unexpected advertisement length %d", len(b))
+	}
+	if b[0] != 0x21 || b[1] != 51 || b[2] != 150 || b[3] != 2 || b[5] != 1 {
+		t.Fatalf("unexpected advertisement header % x", b[:vrrpHeaderLen])
+	}
+
+	parsed, err := ParseAdvertisement(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.VRID != 51 || parsed.Priority != 150 || parsed.Interval != time.Second || len(parsed.VIPs) != 2 || !parsed.VIPs[1].Equal(ad.VIPs[1]) {
+		t.Fatalf("unexpected parsed advertisement %+v", parsed)
+	}
+
+	b[2] = 200
+	if _, err := ParseAdvertisement(b); err == nil {
+		t.Fatal("expected a checksum error for a modified packet")
+	}
+}
+
+func newTestVRRP(priority uint8, preempt bool) (*VRRPAnnouncer, *system.FakeIP, *fakeConn) {
+	ip := system.NewFakeIP()
+	conn := &fakeConn{}
+	v := NewVRRP("eth0", 51, priority, time.Second, preempt, NewARP(ip), logrus.New())
+	v.conn = conn
+	v.localIP = net.ParseIP("10.0.0.2")
+	return v, ip, conn
+}
+
+func TestVRRPBackupAnnouncesNothing(t *testing.T) {
+	v, ip, conn := newTestVRRP(100, true)
+	if err := v.Announce(context.Background(), []string{"10.54.213.165"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ip.Advertised) != 0 || len(conn.packets) != 0 {
+		t.Fatal("expected a backup to leave the VIPs to the master")
+	}
+
+	if err := v.Announce(context.Background(), []string{"2001:558:1044:1ae::7"}); err == nil {
+		t.Fatal("expected an error announcing an IPv6 VIP with vrrp")
+	}
+}
+
+func TestVRRPFailover(t *testing.T) {
+	v, ip, conn := newTestVRRP(100, true)
+	v.Announce(context.Background(), []string{"10.54.213.165"})
+
+	// the master down timer expired. take over and claim the VIPs
+	v.becomeMaster(context.Background())
+	if !v.IsMaster() {
+		t.Fatal("expected to be master")
+	}
+	if len(conn.packets) != 1 || len(ip.Advertised) != 1 {
+		t.Fatalf("expected an advertisement and a gratuitous arp. saw %d and %v", len(conn.packets), ip.Advertised)
+	}
+	if err := v.Announce(context.Background(), []string{"10.54.213.165"}); err != nil || len(ip.Advertised) != 2 {
+		t.Fatal("expected the master to refresh the VIPs with gratuitous arp")
+	}
+
+	// a lower priority router is told to back down
+	if _, send := v.handle(&Advertisement{VRID: 51, Priority: 50}, net.ParseIP("10.0.0.3")); !send || !v.IsMaster() {
+		t.Fatal("expected to stay master and advertise")
+	}
+
+	// advertisements for other virtual routers are ignored
+	v.handle(&Advertisement{VRID: 52, Priority: 200}, net.ParseIP("10.0.0.3"))
+	if !v.IsMaster() {
+		t.Fatal("expected an advertisement for another vrid to be ignored")
+	}
+
+	// an equal priority router with a higher address wins
+	reset, _ := v.handle(&Advertisement{VRID: 51, Priority: 100}, net.ParseIP("10.0.0.3"))
+	if v.IsMaster() || reset != v.masterDownInterval() {
+		t.Fatal("expected to become backup")
+	}
+}
+
+func TestVRRPPreemption(t *testing.T) {
+	v, _, _ := newTestVRRP(150, true)
+	if reset, _ := v.handle(&Advertisement{VRID: 51, Priority: 100}, net.ParseIP("10.0.0.3")); reset != 0 {
+		t.Fatal("expected a preempting backup to let its timer expire")
+	}
+
+	v, _, _ = newTestVRRP(150, false)
+	if reset, _ := v.handle(&Advertisement{VRID: 51, Priority: 100}, net.ParseIP("10.0.0.3")); reset != v.masterDownInterval() {
+		t.Fatal("expected a non-preempting backup to defer to the running master")
+	}
+
+	if reset, _ := v.handle(&Advertisement{VRID: 51, Priority: vrrpPriorityResign}, net.ParseIP("10.0.0.3")); reset != v.skew() {
+		t.Fatal("expected a resigning master to shorten the master down timer")
+	}
+}
+
+type fakeFrameConn struct {
+	frames [][]byte
+	err    error
+	closed bool
+}
+
+func (f *fakeFrameConn) Send(frame []byte) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.frames = append(f.frames, frame)
+	return nil
+}
+
+func (f *fakeFrameConn) Close() error {
+	f.closed = true
+	return nil
+}
+
+type recordingMetrics map[string]error
+
+func (r recordingMetrics) Announced(strategy, vip string, err error) { r[vip] = err }
+
+func TestGARP(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02}
+	conn := &fakeFrameConn{}
+	opened := 0
+	metrics := recordingMetrics{}
+	g := NewGARP("eth0", metrics, logrus.New())
+	g.open = func(device string) (frameConn, net.HardwareAddr, error) {
+		opened++
+		return conn, mac, nil
+	}
+
+	err := g.Announce(context.Background(), []string{"10.54.213.165", "10.54.213.166", "2001:db8::7"})
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 1 || errs["2001:db8::7"] == nil {
+		t.Fatalf("expected an error for the v6 VIP only. saw %v", err)
+	}
+	if len(conn.frames) != 2 || metrics["10.54.213.165"] != nil || metrics["2001:db8::7"] == nil {
+		t.Fatalf("expected a frame and a metric per VIP. saw %d frames and %v", len(conn.frames), metrics)
+	}
+	frame := conn.frames[0]
+	if len(frame) != 42 || !bytes.Equal(frame[0:6], ethernetBroadcast) || !bytes.Equal(frame[6:12], mac) {
+		t.Fatalf("unexpected ethernet header % x", frame[:14])
+	}
+	// the VIP is both the sender and the target of the request
+	if frame[21] != arpOpRequest || !net.IP(frame[28:32]).Equal(net.ParseIP("10.54.213.165")) || !net.IP(frame[38:42]).Equal(net.ParseIP("10.54.213.165")) {
+		t.Fatalf("unexpected arp packet % x", frame[14:])
+	}
+
+	// a socket that fails every VIP is reopened on the next announcement
+	conn.err = io.ErrClosedPipe
+	if err := g.Announce(context.Background(), []string{"10.54.213.165"}); err == nil || !conn.closed {
+		t.Fatalf("expected the failed socket to be closed. saw %v", err)
+	}
+	conn.err = nil
+	if err := g.Announce(context.Background(), []string{"10.54.213.165"}); err != nil || opened != 2 {
+		t.Fatalf("expected the socket to be reopened. opened %d times. saw %v", opened, err)
+	}
+}
+
+func TestGARPFollowsActiveSlave(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02}
+	conns := map[string]*fakeFrameConn{}
+	g := NewGARP("bond0", nil, logrus.New())
+	g.open = func(device string) (frameConn, net.HardwareAddr, error) {
+		conns[device] = &fakeFrameConn{}
+		return conns[device], mac, nil
+	}
+	active := "ens1"
+	g.bond = func(device string) (*system.Bond, error) {
+		return &system.Bond{Mode: "active-backup", ActiveSlave: active, Slaves: []string{"ens1", "ens2"}}, nil
+	}
+
+	if err := g.Announce(context.Background(), []string{"10.54.213.165"}); err != nil {
+		t.Fatal(err)
+	}
+	if conns["ens1"] == nil || len(conns["ens1"].frames) != 1 {
+		t.Fatalf("expected the arp to be sent out of the active slave. saw %v", conns)
+	}
+
+	// a failover moves the socket to the new active slave
+	active = "ens2"
+	if err := g.Announce(context.Background(), []string{"10.54.213.165"}); err != nil {
+		t.Fatal(err)
+	}
+	if !conns["ens1"].closed || conns["ens2"] == nil || len(conns["ens2"].frames) != 1 {
+		t.Fatalf("expected the arp to be sent out of the new active slave. saw %v", conns)
+	}
+
+	// a bond balancing over every slave sends out of the bond
+	active = ""
+	if err := g.Announce(context.Background(), []string{"10.54.213.165"}); err != nil {
+		t.Fatal(err)
+	}
+	if conns["bond0"] == nil || len(conns["bond0"].frames) != 1 {
+		t.Fatalf("expected the arp to be sent out of the bond. saw %v", conns)
+	}
+}
+
+type fakeProbeConn struct {
+	fakeFrameConn
+	replies [][]byte
+}
+
+func (f *fakeProbeConn) Receive(b []byte, timeout time.Duration) (int, error) {
+	if len(f.replies) == 0 {
+		time.Sleep(timeout)
+		return 0, syscall.EAGAIN
+	}
+	n := copy(b, f.replies[0])
+	f.replies = f.replies[1:]
+	return n, nil
+}
+
+func TestARPProbe(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02}
+	other := net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x09}
+
+	// another director answers for .165, and probes for .167 itself
+	reply, _ := arpRequest(other, net.ParseIP("10.54.213.165"), net.IPv4zero)
+	binary.BigEndian.PutUint16(reply[ethernetHeaderLen+6:], arpOpReply)
+	probe, _ := ARPProbe(other, net.ParseIP("10.54.213.167"))
+	own, _ := GratuitousARP(mac, net.ParseIP("10.54.213.166"))
+	conn := &fakeProbeConn{replies: [][]byte{reply, probe, own, {0x01}}}
+
+	p := NewARPProber("eth0", 50*time.Millisecond, logrus.New())
+	p.open = func(device string) (probeConn, net.HardwareAddr, error) {
+		return conn, mac, nil
+	}
+	conflicts, err := p.Probe(context.Background(), []string{"10.54.213.165", "10.54.213.166", "10.54.213.167", "2001:db8::7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"10.54.213.165": other.String()}; !reflect.DeepEqual(conflicts, want) {
+		t.Fatalf("expected %v. saw %v", want, conflicts)
+	}
+	if len(conn.frames) != 3 || !conn.closed {
+		t.Fatalf("expected a probe per v4 address on a socket that is closed after. saw %d frames", len(conn.frames))
+	}
+	// probes are sent from the unspecified address
+	if frame := conn.frames[0]; !net.IP(frame[28:32]).Equal(net.IPv4zero) {
+		t.Fatalf("unexpected arp packet % x", frame[14:])
+	}
+}
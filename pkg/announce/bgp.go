@@ -0,0 +1,79 @@
+package announce
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/Comcast/Ravel/pkg/bgp"
+)
+
+type bgpAnnouncer struct {
+	controller  bgp.Controller
+	communities []string
+}
+
+// NewBGP creates an Announcer that injects a host route for each VIP through
+// the bgp controller. Routes that are already in the RIB are not re-added.
+func NewBGP(controller bgp.Controller, communities []string) Announcer {
+	return &bgpAnnouncer{controller: controller, communities: communities}
+}
+
+func (b *bgpAnnouncer) Name() string { return BGP }
+
+func (b *bgpAnnouncer) Announce(ctx context.Context, vips []string) error {
+	return b.routes(ctx, vips, func(v4, configured []string) error {
+		return b.controller.Set(ctx, v4, configured, b.communities)
+	}, func(v6 []string) error {
+		return b.controller.SetV6(ctx, v6, b.communities)
+	})
+}
+
+// Withdraw removes the host routes of vips from the RIB
+func (b *bgpAnnouncer) Withdraw(ctx context.Context, vips []string) error {
+	return b.routes(ctx, vips, func(v4, configured []string) error {
+		return b.controller.Withdraw(ctx, v4, configured)
+	}, func(v6 []string) error {
+		configured, err := b.controller.GetV6(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to get bgp routes. %v", err)
+		}
+		return b.controller.WithdrawV6(ctx, v6, configured)
+	})
+}
+
+// routes splits vips by family and calls set4 with the ipv4 VIPs and the routes
+// in the RIB, and set6 with the ipv6 VIPs
+func (b *bgpAnnouncer) routes(ctx context.Context, vips []string, set4 func(v4, configured []string) error, set6 func(v6 []string) error) error {
+	v4, v6 := []string{}, []string{}
+	for _, vip := range vips {
+		ip := net.ParseIP(vip)
+		switch {
+		case ip == nil:
+			return fmt.Errorf("invalid VIP %s", vip)
+		case ip.To4() != nil:
+			v4 = append(v4, vip)
+		default:
+			v6 = append(v6, vip)
+		}
+	}
+
+	errs := Errors{}
+	if len(v4) > 0 {
+		configured, err := b.controller.Get(ctx)
+		if err != nil {
+			errs.add(v4, fmt.Errorf("unable to get bgp routes. %v", err))
+		} else if err := set4(v4, configured); err != nil {
+			errs.add(v4, err)
+		}
+	}
+	if len(v6) > 0 {
+		if err := set6(v6); err != nil {
+			errs.add(v6, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,201 @@
+package announce
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+const (
+	// ethernet type of ARP, and the ARP fields of an IPv4 over ethernet request
+	etherTypeARP     = 0x0806
+	arpHardwareEther = 1
+	arpProtocolIPv4  = 0x0800
+	arpOpRequest     = 1
+	arpOpReply       = 2
+
+	ethernetHeaderLen = 14
+	arpPacketLen      = 28
+)
+
+var ethernetBroadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// Metrics records the outcome of announcing each VIP
+type Metrics interface {
+	Announced(strategy, vip string, err error)
+}
+
+// GratuitousARP encodes the ethernet frame of a gratuitous ARP for ip from
+// mac: a broadcast request in which ip is both the sender and the target
+// address, which neighbors and the gateway take as the new owner of ip
+func GratuitousARP(mac net.HardwareAddr, ip net.IP) ([]byte, error) {
+	v4 := ip.To4()
+	if v4 == nil {
+		return nil, fmt.Errorf("garp: %s is not an IPv4 address", ip)
+	}
+	return arpRequest(mac, v4, v4)
+}
+
+// arpRequest encodes the ethernet frame of a broadcast ARP request from mac
+// and sender for target
+func arpRequest(mac net.HardwareAddr, sender, target net.IP) ([]byte, error) {
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("garp: %s is not an ethernet address", mac)
+	}
+
+	b := make([]byte, ethernetHeaderLen+arpPacketLen)
+	copy(b[0:6], ethernetBroadcast)
+	copy(b[6:12], mac)
+	binary.BigEndian.PutUint16(b[12:14], etherTypeARP)
+
+	arp := b[ethernetHeaderLen:]
+	binary.BigEndian.PutUint16(arp[0:2], arpHardwareEther)
+	binary.BigEndian.PutUint16(arp[2:4], arpProtocolIPv4)
+	arp[4] = 6 // hardware address length
+	arp[5] = 4 // protocol address length
+	binary.BigEndian.PutUint16(arp[6:8], arpOpRequest)
+	copy(arp[8:14], mac)
+	copy(arp[14:18], sender.To4())
+	// the target hardware address is left zero
+	copy(arp[24:28], target.To4())
+	return b, nil
+}
+
+// frameConn sends ethernet frames out of an interface
+type frameConn interface {
+	Send(frame []byte) error
+	Close() error
+}
+
+// GARPAnnouncer announces IPv4 VIPs with gratuitous ARPs that it sends from a
+// raw socket on the interface, without an external binary. The socket is kept
+// open between announcements, and all the VIPs of an announcement are sent in
+// one pass over it. When the interface is a bond with an active slave, the
+// ARPs are sent out of the active slave, so that switches learn the VIPs on
+// the port the bond receives on, and the socket follows the bond as it fails
+// over.
+type GARPAnnouncer struct {
+	sync.Mutex
+
+	device  string
+	metrics Metrics
+
+	// open returns the socket to send frames with and the address to send
+	// them from, and bond the state of a bond. They are replaced by tests.
+	open func(device string) (frameConn, net.HardwareAddr, error)
+	bond func(device string) (*system.Bond, error)
+	conn frameConn
+	mac  net.HardwareAddr
+
+	// egress is the device conn is open on
+	egress string
+
+	logger log.FieldLogger
+}
+
+// NewGARP creates an Announcer that sends gratuitous ARPs for the VIPs out of
+// device. metrics may be nil.
+func NewGARP(device string, metrics Metrics, logger log.FieldLogger) *GARPAnnouncer {
+	return &GARPAnnouncer{
+		device:  device,
+		metrics: metrics,
+		open:    openFrameConn,
+		bond:    system.ReadBond,
+		logger:  logger.WithFields(log.Fields{"module": "garp", "device": device}),
+	}
+}
+
+func (g *GARPAnnouncer) Name() string { return ARP }
+
+// Withdraw does nothing, as the arp entries of the VIPs age out
+func (g *GARPAnnouncer) Withdraw(ctx context.Context, vips []string) error { return nil }
+
+// Announce sends a gratuitous ARP for each of vips. When the socket fails, it
+// is closed and reopened on the next announcement, i.e. after the interface
+// was recreated, as it is when the active slave of the bond changed.
+func (g *GARPAnnouncer) Announce(ctx context.Context, vips []string) error {
+	g.Lock()
+	defer g.Unlock()
+
+	egress := g.egressDevice()
+	if g.conn != nil && egress != g.egress {
+		g.logger.Infof("garp: the active slave changed from %s to %s", g.egress, egress)
+		g.conn.Close()
+		g.conn = nil
+	}
+
+	errs := Errors{}
+	if g.conn == nil {
+		// the active slave of a bond carries the bond's address, which is the
+		// one ARPs are sent from
+		conn, mac, err := g.open(egress)
+		if err != nil {
+			for _, vip := range vips {
+				errs[vip] = err
+				g.record(vip, err)
+			}
+			return errs
+		}
+		g.conn, g.mac, g.egress = conn, mac, egress
+	}
+
+	for _, vip := range vips {
+		if ctx.Err() != nil {
+			errs[vip] = ctx.Err()
+			continue
+		}
+		frame, err := GratuitousARP(g.mac, net.ParseIP(vip))
+		if err == nil {
+			if err = g.conn.Send(frame); err != nil {
+				err = fmt.Errorf("garp: unable to send on %s. %v", g.egress, err)
+			}
+		}
+		g.record(vip, err)
+		if err != nil {
+			errs[vip] = err
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	if len(errs) == len(vips) {
+		g.conn.Close()
+		g.conn = nil
+	}
+	return errs
+}
+
+// egressDevice returns the device to send ARPs out of: the active slave when
+// the device is a bond that has one, and the device otherwise
+func (g *GARPAnnouncer) egressDevice() string {
+	bond, err := g.bond(g.device)
+	if err != nil {
+		g.logger.Debugf("garp: unable to read the bond state of %s. %v", g.device, err)
+		return g.device
+	}
+	if bond == nil || bond.ActiveSlave == "" {
+		return g.device
+	}
+	return bond.ActiveSlave
+}
+
+func (g *GARPAnnouncer) record(vip string, err error) {
+	if g.metrics != nil {
+		g.metrics.Announced(ARP, vip, err)
+	}
+}
+
+func openFrameConn(device string) (frameConn, net.HardwareAddr, error) {
+	s, mac, err := openPacketSocket(device)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, mac, nil
+}
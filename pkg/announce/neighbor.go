@@ -0,0 +1,45 @@
+package announce
+
+import (
+	"context"
+
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+// neighbor announces VIPs on the local segment through an AddressManager
+type neighbor struct {
+	name      string
+	advertise func(addr string) error
+}
+
+// NewARP creates an Announcer that sends a gratuitous ARP for each IPv4 VIP
+func NewARP(ip system.AddressManager) Announcer {
+	return &neighbor{name: ARP, advertise: ip.AdvertiseMacAddress}
+}
+
+// NewNDP creates an Announcer that sends an unsolicited neighbor advertisement for each IPv6 VIP
+func NewNDP(ip system.AddressManager) Announcer {
+	return &neighbor{name: NDP, advertise: ip.AdvertiseNeighbor}
+}
+
+func (n *neighbor) Name() string { return n.name }
+
+func (n *neighbor) Announce(ctx context.Context, vips []string) error {
+	errs := Errors{}
+	for _, vip := range vips {
+		if ctx.Err() != nil {
+			errs[vip] = ctx.Err()
+			continue
+		}
+		if err := n.advertise(vip); err != nil {
+			errs[vip] = err
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Withdraw does nothing, as the neighbor entries of the VIPs age out
+func (n *neighbor) Withdraw(ctx context.Context, vips []string) error { return nil }
@@ -0,0 +1,62 @@
+package announce
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// packetSocket is a raw AF_PACKET socket bound to the ARP frames of an interface
+type packetSocket struct {
+	fd   int
+	addr *syscall.SockaddrLinklayer
+}
+
+// openPacketSocket opens a packet socket on device, returning the ethernet
+// address of the device. It needs CAP_NET_RAW, as the VRRP socket does.
+func openPacketSocket(device string) (*packetSocket, net.HardwareAddr, error) {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return nil, nil, fmt.Errorf("garp: unable to find interface %s. %v", device, err)
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return nil, nil, fmt.Errorf("garp: %s has no ethernet address", device)
+	}
+
+	protocol := htons(etherTypeARP)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(protocol))
+	if err != nil {
+		return nil, nil, fmt.Errorf("garp: unable to open raw socket. %v", err)
+	}
+	addr := &syscall.SockaddrLinklayer{Protocol: protocol, Ifindex: iface.Index, Halen: 6}
+	copy(addr.Addr[:], ethernetBroadcast)
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, nil, fmt.Errorf("garp: unable to bind raw socket to %s. %v", device, err)
+	}
+	return &packetSocket{fd: fd, addr: addr}, iface.HardwareAddr, nil
+}
+
+func (p *packetSocket) Send(frame []byte) error {
+	return syscall.Sendto(p.fd, frame, 0, p.addr)
+}
+
+// Receive reads a frame into b, waiting at most timeout for one
+func (p *packetSocket) Receive(b []byte, timeout time.Duration) (int, error) {
+	tv := syscall.NsecToTimeval(timeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(p.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return 0, err
+	}
+	n, _, err := syscall.Recvfrom(p.fd, b, 0)
+	return n, err
+}
+
+func (p *packetSocket) Close() error {
+	return syscall.Close(p.fd)
+}
+
+// htons converts a short to network byte order, as socket addresses take it
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package announce
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// errNoPacketSockets is returned where ARPs would be sent or received, as
+// raw packet sockets are only available on linux
+var errNoPacketSockets = fmt.Errorf("garp: raw packet sockets are only available on linux")
+
+// packetSocket stands in for the raw AF_PACKET socket of linux, and is never
+// opened
+type packetSocket struct{}
+
+func openPacketSocket(device string) (*packetSocket, net.HardwareAddr, error) {
+	return nil, nil, errNoPacketSockets
+}
+
+func (p *packetSocket) Send(frame []byte) error {
+	return errNoPacketSockets
+}
+
+func (p *packetSocket) Receive(b []byte, timeout time.Duration) (int, error) {
+	return 0, errNoPacketSockets
+}
+
+func (p *packetSocket) Close() error {
+	return nil
+}
@@ -0,0 +1,139 @@
+package announce
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ARPProbe encodes the ethernet frame of an ARP probe for ip from mac, as
+// RFC 5227 defines it: a request for ip from the unspecified address, which
+// the host that holds ip answers without taking mac as the owner of anything
+func ARPProbe(mac net.HardwareAddr, ip net.IP) ([]byte, error) {
+	v4 := ip.To4()
+	if v4 == nil {
+		return nil, fmt.Errorf("probe: %s is not an IPv4 address", ip)
+	}
+	return arpRequest(mac, net.IPv4zero, v4)
+}
+
+// probeConn sends ethernet frames out of an interface and receives them
+type probeConn interface {
+	frameConn
+	Receive(b []byte, timeout time.Duration) (int, error)
+}
+
+// ARPProber detects the VIPs that another host on the segment already
+// answers for, before the director adds them. Two directors that both hold a
+// VIP take turns in the ARP caches of their neighbors, and each breaks the
+// connections of the other.
+type ARPProber struct {
+	device  string
+	timeout time.Duration
+
+	// open returns the socket to probe with and the address to probe from.
+	// It is replaced by tests.
+	open func(device string) (probeConn, net.HardwareAddr, error)
+
+	logger log.FieldLogger
+}
+
+// NewARPProber creates a prober that sends its probes out of device and waits
+// timeout for the answers
+func NewARPProber(device string, timeout time.Duration, logger log.FieldLogger) *ARPProber {
+	return &ARPProber{
+		device:  device,
+		timeout: timeout,
+		open:    openProbeConn,
+		logger:  logger.WithFields(log.Fields{"module": "probe", "device": device}),
+	}
+}
+
+// Probe sends a probe for each of the IPv4 addresses of addrs at once, and
+// returns the addresses another host answered for within the timeout, with
+// the ethernet address of that host. IPv6 addresses are skipped.
+func (a *ARPProber) Probe(ctx context.Context, addrs []string) (map[string]string, error) {
+	probed := map[string]bool{}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+			probed[ip.To4().String()] = true
+		}
+	}
+	if len(probed) == 0 {
+		return map[string]string{}, nil
+	}
+
+	conn, mac, err := a.open(a.device)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	for addr := range probed {
+		frame, err := ARPProbe(mac, net.ParseIP(addr))
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.Send(frame); err != nil {
+			return nil, fmt.Errorf("probe: unable to send on %s. %v", a.device, err)
+		}
+	}
+
+	conflicts := map[string]string{}
+	b := make([]byte, 1500)
+	for deadline := time.Now().Add(a.timeout); ; {
+		remaining := time.Until(deadline)
+		if remaining <= 0 || ctx.Err() != nil {
+			break
+		}
+		n, err := conn.Receive(b, remaining)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("probe: unable to receive on %s. %v", a.device, err)
+		}
+		sender, senderIP, ok := parseARP(b[:n])
+		if !ok || bytes.Equal(sender, mac) {
+			continue
+		}
+		if probed[senderIP.String()] {
+			conflicts[senderIP.String()] = sender.String()
+		}
+	}
+	return conflicts, nil
+}
+
+// parseARP returns the sender of an ARP request or reply over ethernet
+func parseARP(frame []byte) (net.HardwareAddr, net.IP, bool) {
+	if len(frame) < ethernetHeaderLen+arpPacketLen || binary.BigEndian.Uint16(frame[12:14]) != etherTypeARP {
+		return nil, nil, false
+	}
+	arp := frame[ethernetHeaderLen:]
+	if binary.BigEndian.Uint16(arp[2:4]) != arpProtocolIPv4 || arp[4] != 6 || arp[5] != 4 {
+		return nil, nil, false
+	}
+	if op := binary.BigEndian.Uint16(arp[6:8]); op != arpOpRequest && op != arpOpReply {
+		return nil, nil, false
+	}
+	sender := net.IP(append([]byte{}, arp[14:18]...))
+	// probes of other hosts don't hold the address yet
+	if sender.Equal(net.IPv4zero) {
+		return nil, nil, false
+	}
+	return net.HardwareAddr(append([]byte{}, arp[8:14]...)), sender, true
+}
+
+func openProbeConn(device string) (probeConn, net.HardwareAddr, error) {
+	s, mac, err := openPacketSocket(device)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, mac, nil
+}
@@ -0,0 +1,460 @@
+package announce
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// vrrpProtocol is the IP protocol number of VRRP
+	vrrpProtocol = 112
+
+	// vrrpVersion is the VRRP version spoken, RFC 3768
+	vrrpVersion = 2
+
+	vrrpTypeAdvertisement = 1
+	vrrpHeaderLen         = 8
+	vrrpAuthDataLen       = 8
+)
+
+// vrrpGroup is the multicast address VRRP advertisements are sent to
+var vrrpGroup = &net.IPAddr{IP: net.IPv4(224, 0, 0, 18)}
+
+// Advertisement is a VRRPv2 advertisement for one virtual router
+type Advertisement struct {
+	VRID     uint8
+	Priority uint8
+
+	// Interval is sent in whole seconds
+	Interval time.Duration
+	VIPs     []net.IP
+}
+
+// Marshal encodes the advertisement, including its checksum
+func (a *Advertisement) Marshal() ([]byte, error) {
+	if len(a.VIPs) > 255 {
+		return nil, fmt.Errorf("vrrp: %d addresses is more than an advertisement can carry", len(a.VIPs))
+	}
+	interval := a.Interval / time.Second
+	if interval < 1 || interval > 255 {
+		return nil, fmt.Errorf("vrrp: advertisement interval %v must be between 1s and 255s", a.Interval)
+	}
+
+	b := make([]byte, vrrpHeaderLen+4*len(a.VIPs)+vrrpAuthDataLen)
+	b[0] = vrrpVersion<<4 | vrrpTypeAdvertisement
+	b[1] = a.VRID
+	b[2] = a.Priority
+	b[3] = uint8(len(a.VIPs))
+	b[4] = 0 // no authentication
+	b[5] = uint8(interval)
+	for i, vip := range a.VIPs {
+		v4 := vip.To4()
+		if v4 == nil {
+			return nil, fmt.Errorf("vrrp: %s is not an IPv4 address", vip)
+		}
+		copy(b[vrrpHeaderLen+4*i:], v4)
+	}
+	binary.BigEndian.PutUint16(b[6:8], checksum(b))
+	return b, nil
+}
+
+// ParseAdvertisement decodes a VRRPv2 advertisement, verifying its checksum
+func ParseAdvertisement(b []byte) (*Advertisement, error) {
+	if len(b) < vrrpHeaderLen {
+		return nil, fmt.Errorf("vrrp: packet of %d bytes is too short", len(b))
+	}
+	if b[0]>>4 != vrrpVersion || b[0]&0x0f != vrrpTypeAdvertisement {
+		return nil, fmt.Errorf("vrrp: unsupported version %d or type %d", b[0]>>4, b[0]&0x0f)
+	}
+	count := int(b[3])
+	if len(b) < vrrpHeaderLen+4*count {
+		return nil, fmt.Errorf("vrrp: packet of %d bytes is too short for %d addresses", len(b), count)
+	}
+	if checksum(b) != 0 {
+		return nil, fmt.Errorf("vrrp: bad checksum")
+	}
+
+	ad := &Advertisement{
+		VRID:     b[1],
+		Priority: b[2],
+		Interval: time.Duration(b[5]) * time.Second,
+	}
+	for i := 0; i < count; i++ {
+		off := vrrpHeaderLen + 4*i
+		ad.VIPs = append(ad.VIPs, net.IPv4(b[off], b[off+1], b[off+2], b[off+3]))
+	}
+	return ad, nil
+}
+
+// checksum is the internet checksum of b, RFC 1071
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// vrrp states. Initialize is folded into startup.
+const (
+	vrrpStateBackup = "backup"
+	vrrpStateMaster = "master"
+)
+
+// vrrpPriorityResign is advertised by a master that is shutting down, so a
+// backup takes over without waiting for the master down interval
+const vrrpPriorityResign = 0
+
+// packetConn is the part of a net.PacketConn used by VRRP
+type packetConn interface {
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	ReadFrom(b []byte) (int, net.Addr, error)
+	Close() error
+}
+
+// VRRPAnnouncer shares VIP ownership with other directors on the same segment
+// using VRRP. The director with the highest priority is master: it sends
+// advertisements and gratuitous ARPs for the VIPs, while backups stay silent
+// until the master stops advertising. A higher priority director takes over
+// from a running master only when preemption is enabled.
+//
+// Run must be started for the announcer to take part in the election. Until it
+// wins, Announce does nothing, so the VIPs are left to the master.
+type VRRPAnnouncer struct {
+	sync.Mutex
+
+	device   string
+	vrid     uint8
+	priority uint8
+	interval time.Duration
+	preempt  bool
+
+	// arp claims the VIPs when this node is master
+	arp Announcer
+
+	state   string
+	vips    []string
+	localIP net.IP
+	conn    packetConn
+
+	logger log.FieldLogger
+}
+
+// NewVRRP creates an Announcer for virtual router vrid on device. arp is used to
+// send gratuitous ARPs for the VIPs while this node is master.
+func NewVRRP(device string, vrid, priority uint8, interval time.Duration, preempt bool, arp Announcer, logger log.FieldLogger) *VRRPAnnouncer {
+	return &VRRPAnnouncer{
+		device:   device,
+		vrid:     vrid,
+		priority: priority,
+		interval: interval,
+		preempt:  preempt,
+		arp:      arp,
+		state:    vrrpStateBackup,
+		logger:   logger.WithFields(log.Fields{"module": "vrrp", "vrid": vrid}),
+	}
+}
+
+func (v *VRRPAnnouncer) Name() string { return VRRP }
+
+// IsMaster reports whether this node currently owns the VIPs
+func (v *VRRPAnnouncer) IsMaster() bool {
+	v.Lock()
+	defer v.Unlock()
+	return v.state == vrrpStateMaster
+}
+
+// Announce adds vips to the addresses of the virtual router and, when this
+// node is master, refreshes them with gratuitous ARPs
+func (v *VRRPAnnouncer) Announce(ctx context.Context, vips []string) error {
+	for _, vip := range vips {
+		if ip := net.ParseIP(vip); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("vrrp: %s is not an IPv4 address", vip)
+		}
+	}
+
+	v.Lock()
+	set := map[string]bool{}
+	for _, vip := range append(v.vips, vips...) {
+		set[vip] = true
+	}
+	v.vips = sortedKeys(set)
+	master := v.state == vrrpStateMaster
+	v.Unlock()
+
+	if !master {
+		return nil
+	}
+	return v.arp.Announce(ctx, vips)
+}
+
+// Withdraw removes vips from the addresses of the virtual router, so that they
+// are no longer advertised
+func (v *VRRPAnnouncer) Withdraw(ctx context.Context, vips []string) error {
+	v.Lock()
+	defer v.Unlock()
+	set := map[string]bool{}
+	for _, vip := range v.vips {
+		set[vip] = true
+	}
+	for _, vip := range vips {
+		delete(set, vip)
+	}
+	v.vips = sortedKeys(set)
+	return nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	out := []string{}
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Open finds the address of the device and opens the VRRP socket on it, so
+// that a director that can't take part in the election fails at startup
+// rather than leaving its VIPs without failover. Run opens it when it wasn't.
+func (v *VRRPAnnouncer) Open() error {
+	local, err := interfaceIPv4(v.device)
+	if err != nil {
+		return err
+	}
+	conn, err := listenVRRP(v.device)
+	if err != nil {
+		return err
+	}
+	v.Lock()
+	v.localIP = local
+	v.conn = conn
+	v.Unlock()
+	return nil
+}
+
+// Run takes part in the VRRP election until ctx is done. A master resigns on
+// the way out so that a backup takes over immediately.
+func (v *VRRPAnnouncer) Run(ctx context.Context) error {
+	v.Lock()
+	conn := v.conn
+	v.Unlock()
+	if conn == nil {
+		if err := v.Open(); err != nil {
+			return err
+		}
+		v.Lock()
+		conn = v.conn
+		v.Unlock()
+	}
+	defer conn.Close()
+
+	received := make(chan receivedAdvertisement, 16)
+	go v.read(ctx, conn, received)
+
+	v.logger.Infof("vrrp: starting as %s with priority %d on %s. preempt=%v", vrrpStateBackup, v.priority, v.device, v.preempt)
+	masterDown := time.NewTimer(v.masterDownInterval())
+	defer masterDown.Stop()
+	advertise := time.NewTicker(v.interval)
+	defer advertise.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if v.IsMaster() {
+				v.logger.Info("vrrp: resigning mastership")
+				if err := v.advertise(vrrpPriorityResign); err != nil {
+					v.logger.Error(err)
+				}
+			}
+			return nil
+
+		case r := <-received:
+			reset, send := v.handle(r.ad, r.src)
+			if reset > 0 {
+				resetTimer(masterDown, reset)
+			}
+			if send {
+				if err := v.advertise(v.priority); err != nil {
+					v.logger.Error(err)
+				}
+			}
+
+		case <-masterDown.C:
+			if v.IsMaster() {
+				continue
+			}
+			v.becomeMaster(ctx)
+
+		case <-advertise.C:
+			if !v.IsMaster() {
+				continue
+			}
+			if err := v.advertise(v.priority); err != nil {
+				v.logger.Error(err)
+			}
+		}
+	}
+}
+
+// handle applies an advertisement from another router to the state machine. It
+// returns the duration to reset the master down timer to, if any, and whether
+// an advertisement should be sent right away.
+func (v *VRRPAnnouncer) handle(ad *Advertisement, src net.IP) (time.Duration, bool) {
+	v.Lock()
+	defer v.Unlock()
+
+	if ad.VRID != v.vrid {
+		return 0, false
+	}
+
+	switch v.state {
+	case vrrpStateMaster:
+		if ad.Priority == vrrpPriorityResign {
+			// another master is leaving. assert ownership
+			return 0, true
+		}
+		if ad.Priority > v.priority || (ad.Priority == v.priority && bytes.Compare(src.To4(), v.localIP.To4()) > 0) {
+			v.logger.Infof("vrrp: %s advertised priority %d. becoming %s", src, ad.Priority, vrrpStateBackup)
+			v.state = vrrpStateBackup
+			return v.masterDownInterval(), false
+		}
+		// a lower priority router is the one that has to back down
+		return 0, true
+
+	default:
+		if ad.Priority == vrrpPriorityResign {
+			return v.skew(), false
+		}
+		if !v.preempt || ad.Priority >= v.priority {
+			return v.masterDownInterval(), false
+		}
+		// with preemption a lower priority master is ignored, so the master
+		// down timer expires and this node takes over
+		return 0, false
+	}
+}
+
+func (v *VRRPAnnouncer) becomeMaster(ctx context.Context) {
+	v.Lock()
+	v.state = vrrpStateMaster
+	vips := append([]string{}, v.vips...)
+	v.Unlock()
+
+	v.logger.Infof("vrrp: no advertisement within %v. becoming %s for %v", v.masterDownInterval(), vrrpStateMaster, vips)
+	if err := v.advertise(v.priority); err != nil {
+		v.logger.Error(err)
+	}
+	if len(vips) == 0 {
+		return
+	}
+	if err := v.arp.Announce(ctx, vips); err != nil {
+		v.logger.Errorf("vrrp: unable to announce VIPs on becoming %s. %v", vrrpStateMaster, err)
+	}
+}
+
+// advertise sends an advertisement for the current VIPs with the given priority
+func (v *VRRPAnnouncer) advertise(priority uint8) error {
+	v.Lock()
+	defer v.Unlock()
+
+	ad := &Advertisement{VRID: v.vrid, Priority: priority, Interval: v.interval}
+	for _, vip := range v.vips {
+		ad.VIPs = append(ad.VIPs, net.ParseIP(vip))
+	}
+	b, err := ad.Marshal()
+	if err != nil {
+		return err
+	}
+	if _, err := v.conn.WriteTo(b, vrrpGroup); err != nil {
+		return fmt.Errorf("vrrp: unable to send advertisement on %s. %v", v.device, err)
+	}
+	return nil
+}
+
+// skew is the priority-weighted delay that lets the highest priority backup
+// take over first
+func (v *VRRPAnnouncer) skew() time.Duration {
+	return time.Duration(256-int(v.priority)) * time.Second / 256
+}
+
+// masterDownInterval is how long a backup waits for an advertisement before
+// taking over
+func (v *VRRPAnnouncer) masterDownInterval() time.Duration {
+	return 3*v.interval + v.skew()
+}
+
+type receivedAdvertisement struct {
+	ad  *Advertisement
+	src net.IP
+}
+
+// read parses advertisements from conn until it is closed
+func (v *VRRPAnnouncer) read(ctx context.Context, conn packetConn, out chan<- receivedAdvertisement) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				v.logger.Errorf("vrrp: unable to read advertisements. %v", err)
+			}
+			return
+		}
+		ad, err := ParseAdvertisement(buf[:n])
+		if err != nil {
+			v.logger.Debugf("vrrp: skipped packet from %v. %v", addr, err)
+			continue
+		}
+		src := net.IPv4zero
+		if ipAddr, ok := addr.(*net.IPAddr); ok {
+			src = ipAddr.IP
+		}
+		select {
+		case out <- receivedAdvertisement{ad: ad, src: src}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// interfaceIPv4 returns the first IPv4 address of device, which VRRP uses to
+// break ties between routers of equal priority
+func interfaceIPv4(device string) (net.IP, error) {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return nil, fmt.Errorf("vrrp: unable to find interface %s. %v", device, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("vrrp: unable to list addresses of %s. %v", device, err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("vrrp: %s has no IPv4 address", device)
+}
@@ -0,0 +1,56 @@
+package announce
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// listenVRRP opens a raw VRRP socket on device that has joined the VRRP group
+// and sends multicast with the TTL of 255 that receivers require
+func listenVRRP(device string) (*net.IPConn, error) {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return nil, fmt.Errorf("vrrp: unable to find interface %s. %v", device, err)
+	}
+	conn, err := net.ListenIP(fmt.Sprintf("ip4:%d", vrrpProtocol), &net.IPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, fmt.Errorf("vrrp: unable to open raw socket. %v", err)
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("vrrp: unable to access raw socket. %v", err)
+	}
+	mreq := &syscall.IPMreqn{Ifindex: int32(iface.Index)}
+	copy(mreq.Multiaddr[:], vrrpGroup.IP.To4())
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		for _, opt := range []struct {
+			name  int
+			value int
+		}{
+			{syscall.IP_MULTICAST_TTL, 255},
+			// don't receive our own advertisements
+			{syscall.IP_MULTICAST_LOOP, 0},
+		} {
+			if sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, opt.name, opt.value); sockErr != nil {
+				return
+			}
+		}
+		if sockErr = syscall.SetsockoptIPMreqn(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, mreq); sockErr != nil {
+			return
+		}
+		sockErr = syscall.SetsockoptIPMreqn(int(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("vrrp: unable to configure multicast on %s. %v", device, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package announce
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenVRRP returns an error, as the VRRP socket joins its group with
+// options only linux has
+func listenVRRP(device string) (*net.IPConn, error) {
+	return nil, fmt.Errorf("vrrp: advertisements can only be sent and received on linux")
+}
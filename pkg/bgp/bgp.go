@@ -25,11 +25,31 @@ type Controller interface {
 	// SetV6 set, for v6.  Very similar to above function
 	SetV6(ctx context.Context, addresses []string, communities []string) error
 
+	// Withdraw removes the ipv4 addresses that are in configuredAddresses from BGP
+	Withdraw(ctx context.Context, addresses, configuredAddresses []string) error
+
+	// GetV6 and WithdrawV6 are Get and Withdraw, for v6
+	GetV6(ctx context.Context) ([]string, error)
+	WithdrawV6(ctx context.Context, addresses, configuredAddresses []string) error
+
 	// Teardown removes all addresses from BGP.
 	// Perhaps this will never be applied.
 	Teardown(context.Context) error
 }
 
+// VRFController advertises routes in the ribs of the VRFs of gobgpd, whose
+// sessions advertise them to the peers of each VRF alone. family is ipv4 or
+// ipv6.
+type VRFController interface {
+	// GetVRF returns the addresses in the rib of vrf
+	GetVRF(ctx context.Context, vrf, family string) ([]string, error)
+
+	// SetVRF adds the addresses that aren't in configuredAddresses to the rib
+	// of vrf, and WithdrawVRF removes those that are
+	SetVRF(ctx context.Context, vrf, family string, addresses, configuredAddresses, communities []string) error
+	WithdrawVRF(ctx context.Context, vrf, family string, addresses, configuredAddresses []string) error
+}
+
 type GoBGPDController struct {
 	commandPath string
 	logger      logrus.FieldLogger
@@ -37,12 +57,34 @@ type GoBGPDController struct {
 
 // Get fetches a list of configured addresses in gobgp
 func (g *GoBGPDController) Get(ctx context.Context) ([]string, error) {
+	return g.get(ctx, ribArgs("", addrKindIPV4))
+}
+
+// GetV6 fetches a list of configured v6 addresses in gobgp
+func (g *GoBGPDController) GetV6(ctx context.Context) ([]string, error) {
+	return g.get(ctx, ribArgs("", addrKindIPV6))
+}
+
+// GetVRF fetches a list of the addresses in the rib of vrf
+func (g *GoBGPDController) GetVRF(ctx context.Context, vrf, family string) ([]string, error) {
+	return g.get(ctx, ribArgs(vrf, family))
+}
+
+// ribArgs returns the gobgp arguments of the global rib of family, or of the
+// rib of vrf when it is set
+func ribArgs(vrf, family string) []string {
+	if vrf == "" {
+		return []string{"global", "rib", "-a", family}
+	}
+	return []string{"vrf", vrf, "rib", "-a", family}
+}
+
+func (g *GoBGPDController) get(ctx context.Context, args []string) ([]string, error) {
 	configuredAddrs := []string{}
 
 	// set a timeout context for this command
 	cmdCtx, cmdCtxCancel := context.WithTimeout(ctx, time.Second*20)
 	defer cmdCtxCancel()
-	args := []string{"global", "rib", "-a", "ipv4"}
 	cmd := exec.CommandContext(cmdCtx, g.commandPath, args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
@@ -60,7 +102,7 @@ func parseRIBOutput(output []byte) []string {
 		out := outputAsList[i]
 		fields := strings.Fields(out)
 		if len(fields) > 2 {
-			trimCidr := strings.Replace(fields[1], "/32", "", 1)
+			trimCidr := strings.TrimSuffix(strings.TrimSuffix(fields[1], "/32"), "/128")
 			addresses = append(addresses, trimCidr)
 		}
 	}
@@ -89,20 +131,7 @@ func (g *GoBGPDController) Set(ctx context.Context, addresses, configuredAddress
 	for _, address := range toAdd {
 		cidr := address + "/32"
 		// g.logger.Debugf("Advertising route to %s", cidr)
-		args := []string{"global", "rib", "-a", "ipv4", "add", cidr}
-		// if communities are supplied, add it here as a community
-		if len(communities) > 0 {
-			// add community cli option
-			args = append(args, "community")
-			// add each community with a comma after it like so: 100:100:100,200:200:200
-			for _, c := range communities {
-				args = append(args, c, ",")
-			}
-			// remove any trailing commas on the communities arguments
-			if args[len(args)-1] == "," {
-				args = args[:len(args)-1]
-			}
-		}
+		args := AdvertiseArgs(addrKindIPV4, cidr, communities)
 		// set a timeout context for this command
 		cmdCtx, cmdCtxCancel := context.WithTimeout(ctx, time.Second*20)
 		defer cmdCtxCancel()
@@ -113,26 +142,61 @@ func (g *GoBGPDController) Set(ctx context.Context, addresses, configuredAddress
 	return nil
 }
 
+// Withdraw removes routes for the given ipv4 addresses. Addresses that aren't
+// configured are skipped.
+func (g *GoBGPDController) Withdraw(ctx context.Context, addresses, configuredAddresses []string) error {
+	return g.withdraw(ctx, "", addrKindIPV4, addresses, configuredAddresses)
+}
+
+// WithdrawV6 removes routes for the given ipv6 addresses. Addresses that aren't
+// configured are skipped.
+func (g *GoBGPDController) WithdrawV6(ctx context.Context, addresses, configuredAddresses []string) error {
+	return g.withdraw(ctx, "", addrKindIPV6, addresses, configuredAddresses)
+}
+
+// WithdrawVRF removes routes for the given addresses from the rib of vrf.
+// Addresses that aren't configured are skipped.
+func (g *GoBGPDController) WithdrawVRF(ctx context.Context, vrf, family string, addresses, configuredAddresses []string) error {
+	return g.withdraw(ctx, vrf, family, addresses, configuredAddresses)
+}
+
+func (g *GoBGPDController) withdraw(ctx context.Context, vrf, family string, addresses, configuredAddresses []string) error {
+	prefixLen := "/32"
+	if family == addrKindIPV6 {
+		prefixLen = "/128"
+	}
+	for _, addr := range addresses {
+		var found bool
+		for _, configured := range configuredAddresses {
+			if addr == configured {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		// $PATH/gobgp global rib -a ipv4 del 10.54.213.148/32
+		cidr := addr + prefixLen
+		args := append(ribArgs(vrf, family), "del", cidr)
+		g.logger.Infof("withdrawing route to %s", cidr)
+		cmdCtx, cmdCtxCancel := context.WithTimeout(ctx, time.Second*20)
+		err := exec.CommandContext(cmdCtx, g.commandPath, args...).Run()
+		cmdCtxCancel()
+		if err != nil {
+			return fmt.Errorf("removing route %s with %s: %s", cidr, strings.Join(append([]string{g.commandPath}, args...), " "), err)
+		}
+	}
+	return nil
+}
+
 // SetV6 set ipvsadm rule with ipv6 syntax.  If a blank community slice is supplied, no community is advertised.
 func (g *GoBGPDController) SetV6(ctx context.Context, addresses []string, communities []string) error {
 	// $PATH/gobgp global rib -a ipv6 add [2001:558:1044:1ae:10ad:ba1a:0000:0007]/128
 	for _, address := range addresses {
 		cidr := address + "/128"
 		// g.logger.Debugf("Advertising route to %s", cidr)
-		args := []string{"global", "rib", "-a", "ipv6", "add", cidr}
-		// if communities are supplied, add it here as a community
-		if len(communities) > 0 {
-			// add community cli option
-			args = append(args, "community")
-			// add each community with a comma after it like so: 100:100:100,200:200:200
-			for _, c := range communities {
-				args = append(args, c, ",")
-			}
-			// remove any trailing commas on the communities arguments
-			if args[len(args)-1] == "," {
-				args = args[:len(args)-1]
-			}
-		}
+		args := AdvertiseArgs(addrKindIPV6, cidr, communities)
 		// set a timeout context for this command
 		cmdCtx, cmdCtxCancel := context.WithTimeout(ctx, time.Second*20)
 		defer cmdCtxCancel()
@@ -143,6 +207,63 @@ func (g *GoBGPDController) SetV6(ctx context.Context, addresses []string, commun
 	return nil
 }
 
+// SetVRF adds routes for the given addresses to the rib of vrf, skipping those
+// in configuredAddresses. If a blank community slice is supplied, no community
+// is advertised.
+func (g *GoBGPDController) SetVRF(ctx context.Context, vrf, family string, addresses, configuredAddresses, communities []string) error {
+	prefixLen := "/32"
+	if family == addrKindIPV6 {
+		prefixLen = "/128"
+	}
+	configured := map[string]bool{}
+	for _, addr := range configuredAddresses {
+		configured[addr] = true
+	}
+	// $PATH/gobgp vrf tenant-a rib -a ipv4 add 10.54.213.148/32
+	for _, address := range addresses {
+		if configured[address] {
+			continue
+		}
+		cidr := address + prefixLen
+		args := VRFAdvertiseArgs(vrf, family, cidr, communities)
+		cmdCtx, cmdCtxCancel := context.WithTimeout(ctx, time.Second*20)
+		err := exec.CommandContext(cmdCtx, g.commandPath, args...).Run()
+		cmdCtxCancel()
+		if err != nil {
+			return fmt.Errorf("adding route %s with %s: %s", cidr, strings.Join(append([]string{g.commandPath}, args...), " "), err)
+		}
+	}
+	return nil
+}
+
+// VRFAdvertiseArgs returns the gobgp arguments that advertise cidr in the rib
+// of vrf, as AdvertiseArgs does in the global rib.
+// $PATH/gobgp vrf tenant-a rib -a ipv4 add 10.54.213.148/32 community 100:100
+func VRFAdvertiseArgs(vrf, family, cidr string, communities []string) []string {
+	return append(ribArgs(vrf, family), AdvertiseArgs(family, cidr, communities)[4:]...)
+}
+
+// AdvertiseArgs returns the gobgp arguments that advertise cidr in the given
+// address family with an optional set of community strings.
+// $PATH/gobgp global rib -a ipv4 add 10.54.213.148/32 community 100:100
+func AdvertiseArgs(family, cidr string, communities []string) []string {
+	args := []string{"global", "rib", "-a", family, "add", cidr}
+	// if communities are supplied, add it here as a community
+	if len(communities) > 0 {
+		// add community cli option
+		args = append(args, "community")
+		// add each community with a comma after it like so: 100:100:100,200:200:200
+		for _, c := range communities {
+			args = append(args, c, ",")
+		}
+		// remove any trailing commas on the communities arguments
+		if args[len(args)-1] == "," {
+			args = args[:len(args)-1]
+		}
+	}
+	return args
+}
+
 func (g *GoBGPDController) Teardown(context.Context) error {
 	// I suspect that we don't want to remove all addresses' routes,
 	// but rather one at a time, if any at all.
@@ -32,3 +32,34 @@ func TestParseBGPOutput(t *testing.T) {
 		t.Fatalf("outputs were not equal. expected %v, saw %v:", shouldEqual, outParsed)
 	}
 }
+
+func TestAdvertiseArgs(t *testing.T) {
+	shouldEqual := []string{"global", "rib", "-a", "ipv4", "add", "10.131.153.120/32", "community", "100:100", ",", "200:200"}
+	args := AdvertiseArgs(addrKindIPV4, "10.131.153.120/32", []string{"100:100", "200:200"})
+	if !reflect.DeepEqual(shouldEqual, args) {
+		t.Fatalf("args were not equal. expected %v, saw %v", shouldEqual, args)
+	}
+
+	shouldEqual = []string{"global", "rib", "-a", "ipv6", "add", "2001:558:1044:1ae:10ad:ba1a:0:7/128"}
+	args = AdvertiseArgs(addrKindIPV6, "2001:558:1044:1ae:10ad:ba1a:0:7/128", nil)
+	if !reflect.DeepEqual(shouldEqual, args) {
+		t.Fatalf("args were not equal. expected %v, saw %v", shouldEqual, args)
+	}
+
+	shouldEqual = []string{"vrf", "tenant-a", "rib", "-a", "ipv4", "add", "10.131.153.120/32", "community", "100:100"}
+	args = VRFAdvertiseArgs("tenant-a", addrKindIPV4, "10.131.153.120/32", []string{"100:100"})
+	if !reflect.DeepEqual(shouldEqual, args) {
+		t.Fatalf("args were not equal. expected %v, saw %v", shouldEqual, args)
+	}
+}
+
+func TestParseBGPOutputV6(t *testing.T) {
+	output := []byte(`Network              Next Hop             AS_PATH              Age        Attrs
+*> 2001:558:1044:1ae::7/128    ::                                   00:00:21   [{Origin: ?}]
+*> 2001:558:1044:1ae::8/128    ::                                   00:00:21   [{Origin: ?}]
+`)
+	shouldEqual := []string{"2001:558:1044:1ae::7", "2001:558:1044:1ae::8"}
+	if outParsed := parseRIBOutput(output); !reflect.DeepEqual(shouldEqual, outParsed) {
+		t.Fatalf("outputs were not equal. expected %v, saw %v:", shouldEqual, outParsed)
+	}
+}
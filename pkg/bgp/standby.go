@@ -0,0 +1,93 @@
+package bgp
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Standby runs a worker as the warm standby of a primary director. The worker
+// keeps its IPVS rules applied and its BGP sessions established, with its
+// routes withdrawn, and is promoted once the primary stops answering probes.
+// Once the primary has answered for holdDown the worker is demoted again, so
+// that a flapping primary doesn't move the VIPs back and forth.
+type Standby struct {
+	primary  string
+	interval time.Duration
+	failures int
+	holdDown time.Duration
+	logger   logrus.FieldLogger
+
+	// probe checks the primary, replaced in tests
+	probe func(ctx context.Context) error
+}
+
+// NewStandby creates a Standby that probes the primary, a host:port that
+// accepts TCP connections while it is up, every interval. The worker is
+// promoted after failures consecutive failed probes.
+func NewStandby(primary string, interval time.Duration, failures int, holdDown time.Duration, logger logrus.FieldLogger) *Standby {
+	s := &Standby{
+		primary:  primary,
+		interval: interval,
+		failures: failures,
+		holdDown: holdDown,
+		logger:   logger,
+	}
+	s.probe = s.dial
+	return s
+}
+
+// dial connects to the primary, timing out after a probe interval
+func (s *Standby) dial(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.interval)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.primary)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Run demotes worker and probes the primary until ctx is done, promoting and
+// demoting worker as the primary fails and recovers
+func (s *Standby) Run(ctx context.Context, worker BGPWorker) {
+	worker.Demote()
+	s.logger.Infof("bgp: running as the standby of %s", s.primary)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	promoted := false
+	failed := 0
+	var upSince time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.probe(ctx); err != nil {
+			upSince = time.Time{}
+			failed++
+			if !promoted && failed >= s.failures {
+				s.logger.Warnf("bgp: primary %s failed %d probes. promoting. %v", s.primary, failed, err)
+				worker.Promote()
+				promoted = true
+			}
+			continue
+		}
+
+		failed = 0
+		if upSince.IsZero() {
+			upSince = time.Now()
+		}
+		if promoted && time.Since(upSince) >= s.holdDown {
+			s.logger.Infof("bgp: primary %s up for %v. demoting to standby", s.primary, time.Since(upSince))
+			worker.Demote()
+			promoted = false
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package bgp
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type standbyWorker struct {
+	calls chan string
+}
+
+func (w *standbyWorker) Start() error { return nil }
+func (w *standbyWorker) Stop() error  { return nil }
+func (w *standbyWorker) Promote()     { w.calls <- "promote" }
+func (w *standbyWorker) Demote()      { w.calls <- "demote" }
+func (w *standbyWorker) Active() bool { return true }
+
+func TestStandby(t *testing.T) {
+	// the primary fails a probe, recovers, fails three in a row and recovers
+	results := []bool{true, false, true, false, false, false, true, true, true}
+	probes := 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewStandby("primary:179", time.Millisecond, 3, 0, logrus.New())
+	s.probe = func(context.Context) error {
+		if probes >= len(results) {
+			cancel()
+			return nil
+		}
+		up := results[probes]
+		probes++
+		if !up {
+			return fmt.Errorf("connection refused")
+		}
+		return nil
+	}
+
+	worker := &standbyWorker{calls: make(chan string, 10)}
+	s.Run(ctx, worker)
+	close(worker.calls)
+
+	calls := []string{}
+	for call := range worker.calls {
+		calls = append(calls, call)
+	}
+	expected := []string{"demote", "promote", "demote"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected %v. saw %v", expected, calls)
+	}
+}
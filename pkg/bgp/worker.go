@@ -3,23 +3,29 @@ package bgp
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/Comcast/Ravel/pkg/iptables"
 	"github.com/Comcast/Ravel/pkg/stats"
 	"github.com/Comcast/Ravel/pkg/system"
 	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
 	"github.com/Comcast/Ravel/pkg/watcher"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 const (
 	addrKindIPV4 = "ipv4"
 	AddrKindIPV4 = "ipv4"
 	addrKindIPV6 = "ipv6"
+	AddrKindIPV6 = "ipv6"
 )
 
 func init() {
@@ -31,6 +37,16 @@ func init() {
 type BGPWorker interface {
 	Start() error
 	Stop() error
+
+	// Promote makes a warm standby add and advertise its VIPs at once, and
+	// Demote makes the worker a warm standby, see Standby. A worker demoted
+	// before it is started starts as a standby.
+	Promote()
+	Demote()
+
+	// Active reports whether the worker advertises its VIPs, i.e. isn't a
+	// standby
+	Active() bool
 }
 
 type bgpserver struct {
@@ -42,6 +58,7 @@ type bgpserver struct {
 	ipDevices *system.IP
 	ipPrimary *system.IP
 	ipvs      *system.IPVS
+	ipt       iptables.RuleApplier
 	bgp       Controller
 	devices   map[string]string
 
@@ -60,10 +77,69 @@ type bgpserver struct {
 	metrics *stats.WorkerStateMetrics
 
 	communities []string
+
+	// forced reconfigures are staggered across the fleet by node name. a zero
+	// interval disables them
+	nodeName                  string
+	forcedReconfigureInterval time.Duration
+
+	// ipv6Only skips the ipv4 configuration entirely, for clusters with no
+	// IPv4 at all
+	ipv6Only bool
+
+	// steered is set while the fwmark chain holds steering rules
+	steered bool
+
+	// defense sets the kernel parameters the defenses of the cluster config need
+	defense *system.SysctlOverrides
+
+	// withdrawOnPanic withdraws every route when a reconcile panics, so that
+	// traffic moves to the other directors while this one's state is suspect.
+	// withdrawn is set until the routes are advertised again.
+	withdrawOnPanic bool
+	withdrawn       bool
+
+	// withdrawStaleAfter, when above zero, withdraws every route once the
+	// watcher's view of the cluster has been stale for that long, rather than
+	// advertising VIPs from it. stale is set until the watcher has synced again.
+	withdrawStaleAfter time.Duration
+	stale              bool
+
+	// breaker holds back the applies once they keep failing, so that they are
+	// retried with backoff rather than every tick. withdrawAfterFailures, when
+	// above zero, withdraws every route once that many applies in a row have
+	// failed, until one succeeds.
+	breaker               util.Breaker
+	withdrawAfterFailures int
+
+	// cachedGeneration is the generation last written to the config cache
+	cachedGeneration uint64
+	// convergedAt is the EventTime of the cluster config last applied or found
+	// in parity, see converged
+	convergedAt time.Time
+
+	// standby keeps the worker a warm standby, which applies its IPVS rules
+	// but neither adds nor advertises its VIPs, so that a promotion only has
+	// to do that. standbyChanged wakes periodic to apply a change at once.
+	standby        bool
+	standbyChanged chan struct{}
+
+	// poolSelector, when set, selects the director pods in poolNamespace
+	// whose nodes make up the pool of directors, which the director policies
+	// and sharding of the cluster config divide the VIPs across. pool is the pool at the
+	// last reconcile, and poolChanged is set until a reconcile applies it.
+	poolNamespace string
+	poolSelector  labels.Selector
+	pool          []string
+	poolChanged   bool
+
+	// vrfRoutes are the VIPs the worker advertised in the rib of each VRF,
+	// by family, so that they are withdrawn once they leave the VRF
+	vrfRoutes map[string]map[string][]string
 }
 
 // NewBGPWorker creates a new BGPWorker, which configures BGP for all VIPs
-func NewBGPWorker(ctx context.Context, configKey string, watcher *watcher.Watcher, ipDevices *system.IP, ipPrimary *system.IP, ipvs *system.IPVS, bgpController Controller, communities []string, logger logrus.FieldLogger) (BGPWorker, error) {
+func NewBGPWorker(ctx context.Context, nodeName, configKey string, watcher *watcher.Watcher, ipDevices *system.IP, ipPrimary *system.IP, ipvs *system.IPVS, ipt iptables.RuleApplier, bgpController Controller, communities []string, forcedReconfigureInterval time.Duration, ipv6Only bool, withdrawOnPanic bool, withdrawStaleAfter time.Duration, breaker util.Breaker, withdrawAfterFailures int, poolNamespace string, poolSelector labels.Selector, logger logrus.FieldLogger) (BGPWorker, error) {
 
 	log.Debugln("bgp: Creating new BGP worker")
 
@@ -72,18 +148,32 @@ func NewBGPWorker(ctx context.Context, configKey string, watcher *watcher.Watche
 		ipDevices: ipDevices,
 		ipPrimary: ipPrimary,
 		ipvs:      ipvs,
+		ipt:       ipt,
 		bgp:       bgpController,
 		devices:   map[string]string{},
+		defense:   system.NewSysctlOverrides(system.NewSysctl()),
 
 		services: map[string]string{},
 
-		doneChan: make(chan struct{}),
+		doneChan:       make(chan struct{}),
+		standbyChanged: make(chan struct{}, 1),
 
 		ctx:     ctx,
 		logger:  logger,
 		metrics: stats.NewWorkerStateMetrics(stats.KindBGPDirector, configKey),
 
 		communities: communities,
+
+		nodeName:                  nodeName,
+		forcedReconfigureInterval: forcedReconfigureInterval,
+		ipv6Only:                  ipv6Only,
+		withdrawOnPanic:           withdrawOnPanic,
+		withdrawStaleAfter:        withdrawStaleAfter,
+		breaker:                   breaker,
+		withdrawAfterFailures:     withdrawAfterFailures,
+		poolNamespace:             poolNamespace,
+		poolSelector:              poolSelector,
+		vrfRoutes:                 map[string]map[string][]string{},
 	}
 
 	return r, nil
@@ -113,8 +203,10 @@ func (b *bgpserver) cleanup(ctx context.Context) error {
 	errs := []string{}
 
 	// delete all k2i addresses from loopback
-	if err := b.ipDevices.Teardown(ctx, b.watcher.ClusterConfig.Config, b.watcher.ClusterConfig.Config6); err != nil {
-		errs = append(errs, fmt.Sprintf("cleanup - failed to remove ip addresses - %v", err))
+	if config := b.watcher.Snapshot().ClusterConfig; config != nil {
+		if err := b.ipDevices.Teardown(ctx, config.Config, config.Config6); err != nil {
+			errs = append(errs, fmt.Sprintf("cleanup - failed to remove ip addresses - %v", err))
+		}
 	}
 
 	if len(errs) == 0 {
@@ -146,10 +238,212 @@ func (b *bgpserver) Start() error {
 
 	log.Debugln("bgp: starting watches and periodic checks")
 	go b.watches()
-	go b.periodic()
+	go b.runPeriodic()
 	return nil
 }
 
+// runPeriodic runs periodic until the watch context is done. A reconcile that
+// panics is recovered, leaving the kernel state as it found it, and periodic
+// is started again after a second. The node reports unhealthy until a later
+// reconcile succeeds.
+func (b *bgpserver) runPeriodic() {
+	for {
+		err := util.Recover("bgp: periodic", func() error {
+			b.periodic()
+			return nil
+		})
+		p, ok := err.(*util.PanicError)
+		if !ok {
+			return
+		}
+		b.logger.Errorf("bgp: %v", p)
+		b.metrics.ReconcilePanic()
+		util.MarkUnhealthy(stats.KindBGPDirector, fmt.Sprintf("reconcile panicked: %v", p.Value))
+		if b.withdrawOnPanic {
+			if err := b.withdrawAll(); err != nil {
+				b.logger.Errorf("bgp: unable to withdraw routes after panic. %v", err)
+			}
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-b.ctxWatch.Done():
+			return
+		}
+	}
+}
+
+// withdrawAll withdraws every route this director advertises. They are
+// advertised again by the next reconcile that succeeds.
+func (b *bgpserver) withdrawAll() error {
+	configuredAddrs, err := b.bgp.Get(b.ctx)
+	if err != nil {
+		return err
+	}
+	if err := b.bgp.Withdraw(b.ctx, configuredAddrs, configuredAddrs); err != nil {
+		return err
+	}
+	configuredAddrs6, err := b.bgp.GetV6(b.ctx)
+	if err != nil {
+		return err
+	}
+	if err := b.bgp.WithdrawV6(b.ctx, configuredAddrs6, configuredAddrs6); err != nil {
+		return err
+	}
+	for _, family := range []string{addrKindIPV4, addrKindIPV6} {
+		if _, err := b.advertiseVRFs(family, nil, true); err != nil {
+			return err
+		}
+	}
+	b.withdrawn = true
+	return nil
+}
+
+// Promote makes a standby worker add and advertise its VIPs
+func (b *bgpserver) Promote() {
+	b.setStandby(false)
+}
+
+// Demote makes the worker a warm standby, withdrawing its routes and removing
+// its VIPs while keeping its IPVS rules applied
+func (b *bgpserver) Demote() {
+	b.setStandby(true)
+}
+
+func (b *bgpserver) setStandby(standby bool) {
+	b.Lock()
+	changed := b.standby != standby
+	b.standby = standby
+	b.Unlock()
+	if !changed {
+		return
+	}
+	select {
+	case b.standbyChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (b *bgpserver) Active() bool {
+	return !b.isStandby()
+}
+
+func (b *bgpserver) isStandby() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.standby
+}
+
+// vips returns the VIPs of config that are added to the loopback, which are
+// none on a standby
+func (b *bgpserver) vips(config map[types.ServiceIP]types.PortMap) map[types.ServiceIP]types.PortMap {
+	if b.isStandby() {
+		return nil
+	}
+	return config
+}
+
+// applyStandby reconfigures after a promotion or demotion at once, rather than
+// at the next tick. As the IPVS rules of a standby are kept applied, a
+// promotion only adds and advertises the VIPs.
+func (b *bgpserver) applyStandby() {
+	start := time.Now()
+	standby := b.isStandby()
+	b.metrics.Standby(standby)
+	snapshot := b.watcher.Snapshot()
+	if snapshot.ClusterConfig == nil || b.withdrawIfStale() {
+		return
+	}
+
+	if !b.ipv6Only {
+		if err := b.configure(snapshot); err != nil {
+			b.logger.Errorf("bgp: unable to apply ipv4 configuration after a standby change. %v", err)
+			return
+		}
+	}
+	if err := b.configure6(snapshot); err != nil {
+		b.logger.Errorf("bgp: unable to apply ipv6 configuration after a standby change. %v", err)
+		return
+	}
+	if standby {
+		b.logger.Infof("bgp: demoted to standby in %v", time.Since(start))
+		return
+	}
+	b.logger.Infof("bgp: promoted in %v", time.Since(start))
+}
+
+// withdrawIfStale withdraws every route once the watcher has been stale for
+// longer than withdrawStaleAfter, and returns true while it is, so that nothing
+// is reconciled from its view. The routes are advertised again by the first
+// reconcile after the watcher has synced.
+func (b *bgpserver) withdrawIfStale() bool {
+	if b.withdrawStaleAfter <= 0 {
+		return false
+	}
+	age := b.watcher.StaleFor()
+	if age <= b.withdrawStaleAfter {
+		if b.stale {
+			b.logger.Infof("bgp: watcher synced again. advertising routes")
+			b.stale = false
+		}
+		return false
+	}
+
+	if !b.stale {
+		b.logger.Errorf("bgp: watcher has been stale for %v. withdrawing every route until it syncs", age.Round(time.Second))
+		util.MarkUnhealthy(stats.KindBGPDirector, fmt.Sprintf("watcher stale for more than %v", b.withdrawStaleAfter))
+		b.stale = true
+	}
+	if !b.withdrawn {
+		if err := b.withdrawAll(); err != nil {
+			b.logger.Errorf("bgp: unable to withdraw routes from a stale watcher. %v", err)
+		}
+	}
+	return true
+}
+
+// applyFailed records a failed apply with the breaker. Once it opens, the node
+// reports unhealthy until an apply succeeds, and once withdrawAfterFailures
+// applies have failed every route is withdrawn, so that traffic moves to the
+// directors that can still program their VIPs.
+func (b *bgpserver) applyFailed(err error) {
+	opened := b.breaker.Failure(time.Now(), err)
+	if b.breaker.Open() {
+		if opened {
+			b.logger.Errorf("bgp: %d consecutive applies failed. retrying with backoff until one succeeds", b.breaker.Failures())
+			b.metrics.ApplyBreakerOpen(true)
+		}
+		util.MarkUnhealthy(stats.KindBGPDirector, fmt.Sprintf("apply failing persistently: %d consecutive failures, next retry at %s. last error: %v", b.breaker.Failures(), b.breaker.RetryAt().Format(time.RFC3339), err))
+	}
+	if b.withdrawAfterFailures <= 0 || b.breaker.Failures() < b.withdrawAfterFailures {
+		return
+	}
+	if b.breaker.Failures() == b.withdrawAfterFailures {
+		b.logger.Errorf("bgp: %d consecutive applies failed. withdrawing every route until one succeeds", b.breaker.Failures())
+	}
+	if err := b.withdrawAll(); err != nil {
+		b.logger.Errorf("bgp: unable to withdraw routes after failed applies. %v", err)
+	}
+}
+
+// applySucceeded closes the breaker after an apply that succeeded
+func (b *bgpserver) applySucceeded() {
+	if b.breaker.Success() {
+		b.logger.Infof("bgp: apply succeeded. retrying on every tick again")
+		b.metrics.ApplyBreakerOpen(false)
+	}
+}
+
+// breakerAllows is whether an apply may be tried now, which it may not while
+// the breaker waits out its backoff
+func (b *bgpserver) breakerAllows() bool {
+	if b.breaker.Allow(time.Now()) {
+		return true
+	}
+	b.logger.Debugf("bgp: applies are failing persistently. skipping apply until %v", b.breaker.RetryAt())
+	return false
+}
+
 // watchServiceUpdates calls the watcher every 100ms to retrieve an updated
 // list of service definitions. It then iterates over the map of services and
 // builds a new map of namespace/service:port identity to clusterIP:port
@@ -193,7 +487,8 @@ func (b *bgpserver) getClusterAddr(identity string) (string, error) {
 	return ip, nil
 }
 
-func (b *bgpserver) configure() error {
+// configure applies the ipv4 VIPs, IPVS rules and routes of snapshot
+func (b *bgpserver) configure(snapshot *watcher.Watcher) error {
 	// log.Debugln("bgp: configuring BGPServer")
 	startTime := time.Now()
 	defer func() {
@@ -205,7 +500,9 @@ func (b *bgpserver) configure() error {
 
 	// add/remove vip addresses on the interface specified for this vip
 	// log.Debugln("bgp: Setting addresses")
-	err := b.setAddresses()
+	stageStart := time.Now()
+	err := b.setAddresses(snapshot)
+	b.metrics.Stage(stats.StageAddresses, time.Since(stageStart))
 	if err != nil {
 		return err
 	}
@@ -222,61 +519,301 @@ func (b *bgpserver) configure() error {
 	// This only adds, and never removes, VIPs
 	// log.Debug("bgp: applying bgp settings")
 	addrs := []string{}
-	for ip := range b.watcher.ClusterConfig.Config {
+	for ip := range snapshot.ClusterConfig.Config {
+		if !b.advertises(snapshot.ClusterConfig, ip) || b.inVRF(snapshot.ClusterConfig, ip) {
+			continue
+		}
 		addrs = append(addrs, string(ip))
 	}
+	standby := b.isStandby()
 	// log.Debugln("bgp: done applying bgp settings")
 
+	// in ecmp mode, or when clients are steered, mark VIP traffic so that IPVS
+	// fwmark services pick it up
+	if b.ipvs.ECMPEnabled() || b.steered || snapshot.ClusterConfig.HasSteering() {
+		if err := b.setFwmarks(snapshot.ClusterConfig); err != nil {
+			log.Errorf("bgp: unable to configure fwmarks with error %v", err)
+			return err
+		}
+	}
+
 	// Set IPVS rules based on VIPs, pods associated with each VIP
 	// and some other settings bgpserver receives from RDEI.
 	// log.Debugln("bgp: Setting IPVS settings")
-	err = b.ipvs.SetIPVS(b.watcher, b.watcher.ClusterConfig, b.logger, addrKindIPV4)
+	stageStart = time.Now()
+	err = b.ipvs.SetIPVS(snapshot, snapshot.ClusterConfig, b.logger, addrKindIPV4)
+	b.metrics.Stage(stats.StageIPVS, time.Since(stageStart))
 	if err != nil {
 		log.Errorf("bgp: unable to configure ipvs with error %v", err)
 		// return fmt.Errorf("bgp: unable to configure ipvs with error %v", err)
 	}
 
-	err = b.bgp.Set(b.ctx, addrs, configuredAddrs, b.communities)
+	if standby {
+		// a standby keeps its sessions up but advertises nothing
+		err = b.bgp.Withdraw(b.ctx, configuredAddrs, configuredAddrs)
+		addrs = nil
+	} else {
+		err = b.bgp.Set(b.ctx, addrs, configuredAddrs, b.communities)
+	}
 	if err != nil {
 		log.Errorf("bgp: b.bgp.Set failed - %v", err)
 		return err
 	}
+	vrfAddrs, err := b.advertiseVRFs(addrKindIPV4, snapshot.ClusterConfig, standby)
+	if err != nil {
+		log.Errorf("bgp: unable to advertise vips in their vrfs - %v", err)
+		return err
+	}
+	b.metrics.AdvertisedVIPs(addrKindIPV4, len(addrs)+vrfAddrs)
 
 	// log.Debugln("bgp: IPVS configured")
 	b.lastReconfigure = time.Now()
+	b.withdrawn = false
+
+	return nil
+}
+
+// advertises reports whether the director advertises vip: it isn't in
+// maintenance with its routes withdrawn, and its director policy, or the
+// sharding of config, picks this director from the pool
+func (b *bgpserver) advertises(config *types.ClusterConfig, vip types.ServiceIP) bool {
+	if m, ok := config.InMaintenance(vip); ok && m.Withdraw {
+		return false
+	}
+	return config.Advertises(vip, b.nodeName, b.pool)
+}
+
+// updatePool refreshes the pool of directors from the watcher, and marks it
+// changed when its members are different, as that moves VIPs between
+// directors without any change to the cluster config
+func (b *bgpserver) updatePool() {
+	if b.poolSelector == nil {
+		return
+	}
+	pool := b.watcher.PodNodes(b.poolNamespace, b.poolSelector)
+	if reflect.DeepEqual(pool, b.pool) {
+		return
+	}
+	b.logger.Infof("bgp: director pool changed from %v to %v", b.pool, pool)
+	b.pool = pool
+	b.poolChanged = true
+}
+
+// withdrawUnadvertised removes the routes of the VIPs the director doesn't
+// advertise, those in maintenance that are set to be withdrawn and those the
+// director policies give to other directors, and the global routes of the
+// VIPs placed in VRFs. Their addresses and IPVS services are kept, so
+// advertising a VIP again only has to add its route.
+func (b *bgpserver) withdrawUnadvertised(config *types.ClusterConfig) error {
+	if config == nil {
+		return nil
+	}
+	withdraw, withdraw6 := []string{}, []string{}
+	for vip := range config.Config {
+		if !b.advertises(config, vip) || b.inVRF(config, vip) {
+			withdraw = append(withdraw, string(vip))
+		}
+	}
+	for vip := range config.Config6 {
+		if !b.advertises(config, vip) || b.inVRF(config, vip) {
+			withdraw6 = append(withdraw6, string(vip))
+		}
+	}
 
+	if len(withdraw) > 0 {
+		configuredAddrs, err := b.bgp.Get(b.ctx)
+		if err != nil {
+			return err
+		}
+		if err := b.bgp.Withdraw(b.ctx, withdraw, configuredAddrs); err != nil {
+			return err
+		}
+	}
+	if len(withdraw6) > 0 {
+		configuredAddrs6, err := b.bgp.GetV6(b.ctx)
+		if err != nil {
+			return err
+		}
+		if err := b.bgp.WithdrawV6(b.ctx, withdraw6, configuredAddrs6); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (b *bgpserver) configure6() error {
+// inVRF reports whether vip is placed in a VRF, whose rib it is advertised in
+// rather than the global rib
+func (b *bgpserver) inVRF(config *types.ClusterConfig, vip types.ServiceIP) bool {
+	_, ok := config.VRFOf(vip)
+	return ok
+}
+
+// advertiseVRFs advertises the VIPs of the family in config that are placed in
+// VRFs in the ribs of their VRFs, and withdraws from each rib the VIPs of the
+// family and those the worker advertised that aren't advertised there anymore,
+// returning how many are advertised. A standby advertises none.
+func (b *bgpserver) advertiseVRFs(family string, config *types.ClusterConfig, standby bool) (int, error) {
+	var familyVIPs map[types.ServiceIP]types.PortMap
+	if config != nil {
+		familyVIPs = config.Config
+		if family == addrKindIPV6 {
+			familyVIPs = config.Config6
+		}
+	}
+	desired := map[string][]string{}
+	if !standby {
+		for vip := range familyVIPs {
+			if name, ok := config.VRFOf(vip); ok && b.advertises(config, vip) {
+				desired[name] = append(desired[name], string(vip))
+			}
+		}
+	}
+	previous := b.vrfRoutes[family]
+	if len(desired) == 0 && len(previous) == 0 {
+		return 0, nil
+	}
+	controller, ok := b.bgp.(VRFController)
+	if !ok {
+		return 0, fmt.Errorf("bgp: the bgp controller can't advertise in vrfs")
+	}
+
+	names := []string{}
+	for name := range desired {
+		names = append(names, name)
+	}
+	for name := range previous {
+		if _, ok := desired[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	advertised := map[string][]string{}
+	var count int
+	for _, name := range names {
+		vips := desired[name]
+		configured, err := controller.GetVRF(b.ctx, name, family)
+		if err != nil {
+			if len(vips) == 0 {
+				// the vrf may be gone from gobgpd along with the config
+				b.logger.Warnf("bgp: unable to read the rib of vrf %s to withdraw its vips. %v", name, err)
+				continue
+			}
+			return count, err
+		}
+
+		// the vips advertised in the vrf, and those withdrawn already
+		skip := map[string]bool{}
+		for _, vip := range vips {
+			skip[vip] = true
+		}
+		withdraw := []string{}
+		for vip := range familyVIPs {
+			if !skip[string(vip)] {
+				skip[string(vip)] = true
+				withdraw = append(withdraw, string(vip))
+			}
+		}
+		for _, vip := range previous[name] {
+			if !skip[vip] {
+				skip[vip] = true
+				withdraw = append(withdraw, vip)
+			}
+		}
+		if err := controller.WithdrawVRF(b.ctx, name, family, withdraw, configured); err != nil {
+			return count, err
+		}
+		if err := controller.SetVRF(b.ctx, name, family, vips, configured, b.communities); err != nil {
+			return count, err
+		}
+		if len(vips) > 0 {
+			advertised[name] = vips
+		}
+		count += len(vips)
+	}
+	b.vrfRoutes[family] = advertised
+	return count, nil
+}
+
+// setFwmarks writes the mangle rules that tag inbound VIP traffic of config with the
+// fwmarks shared by every director in the ECMP set, and those of steered clients
+func (b *bgpserver) setFwmarks(config *types.ClusterConfig) error {
+	if b.ipt == nil {
+		return fmt.Errorf("bgp: fwmarks require an iptables manager")
+	}
+	var marks []types.ECMPFwmark
+	if b.ipvs.ECMPEnabled() {
+		var err error
+		if marks, err = b.ipvs.ECMPFwmarks(config); err != nil {
+			return err
+		}
+	}
+	steering, err := types.SteeringFwmarks(config)
+	if err != nil {
+		return err
+	}
+	if err := b.ipt.SetFwmarks(marks, steering); err != nil {
+		return err
+	}
+	// keep writing the chain after the last rule goes, so that it is emptied
+	b.steered = len(steering) > 0
+	return nil
+}
+
+// configure6 applies the ipv6 VIPs, routes and IPVS rules of snapshot
+func (b *bgpserver) configure6(snapshot *watcher.Watcher) error {
 	// logger := b.logger.WithFields(logrus.Fields{"protocol": "ipv6"})
 
 	log.Debugln("bgp: starting ipv6 configuration")
 	// add vip addresses to loopback
-	err := b.setAddresses6()
+	stageStart := time.Now()
+	err := b.setAddresses6(snapshot)
+	b.metrics.Stage(stats.StageAddresses, time.Since(stageStart))
 	if err != nil {
 		return err
 	}
 
 	addrs := []string{}
-	for ip := range b.watcher.ClusterConfig.Config6 {
+	for ip := range snapshot.ClusterConfig.Config6 {
+		if !b.advertises(snapshot.ClusterConfig, ip) || b.inVRF(snapshot.ClusterConfig, ip) {
+			continue
+		}
 		addrs = append(addrs, string(ip))
 	}
 
-	// set BGP announcements
-	err = b.bgp.SetV6(b.ctx, addrs, b.communities)
+	// set BGP announcements, or withdraw them from a standby
+	standby := b.isStandby()
+	if standby {
+		configuredAddrs6, err := b.bgp.GetV6(b.ctx)
+		if err != nil {
+			return err
+		}
+		if err := b.bgp.WithdrawV6(b.ctx, configuredAddrs6, configuredAddrs6); err != nil {
+			return err
+		}
+		addrs = nil
+	} else if err := b.bgp.SetV6(b.ctx, addrs, b.communities); err != nil {
+		return err
+	}
+	vrfAddrs, err := b.advertiseVRFs(addrKindIPV6, snapshot.ClusterConfig, standby)
 	if err != nil {
 		return err
 	}
+	b.metrics.AdvertisedVIPs(addrKindIPV6, len(addrs)+vrfAddrs)
 
 	// Set IPVS rules based on VIPs, pods associated with each VIP
 	// and some other settings bgpserver receives from RDEI.
-	err = b.ipvs.SetIPVS(b.watcher, b.watcher.ClusterConfig, b.logger, addrKindIPV6)
+	stageStart = time.Now()
+	err = b.ipvs.SetIPVS(snapshot, snapshot.ClusterConfig, b.logger, addrKindIPV6)
+	b.metrics.Stage(stats.StageIPVS, time.Since(stageStart))
 	if err != nil {
 		return fmt.Errorf("bgp: unable to configure ipvs with error %v", err)
 	}
 	// log.Debugln("bgp: IPVS6 configured successfully")
 
+	b.lastReconfigure = time.Now()
+	b.withdrawn = false
+
 	return nil
 }
 
@@ -295,8 +832,8 @@ func (b *bgpserver) periodic() {
 	log.Infof("bgp: starting BGP periodic ticker, interval %v\n", bgpInterval)
 
 	// every so many seconds, reapply configuration without checking parity
-	reconfigureDuration := 5 * time.Second
-	reconfigureTicker := time.NewTicker(reconfigureDuration)
+	reconfigureDuration := b.forcedReconfigureInterval
+	reconfigureTicker := util.NewStaggeredTicker(reconfigureDuration, b.nodeName)
 	defer reconfigureTicker.Stop()
 
 	var runStartTime time.Time
@@ -307,23 +844,50 @@ func (b *bgpserver) periodic() {
 
 		select {
 		case <-reconfigureTicker.C:
+			if b.withdrawIfStale() || !b.breakerAllows() {
+				continue
+			}
 			log.Debugf("bgp: mandatory periodic reconfigure executing after %v", reconfigureDuration)
 			start := time.Now()
-			if err := b.configure(); err != nil {
-				b.metrics.Reconfigure("critical", time.Since(start))
-				log.Errorf("bgp: unable to apply mandatory ipv4 reconfiguration. %v", err)
+			snapshot := b.watcher.Snapshot()
+			config := snapshot.ClusterConfig
+			if config == nil {
+				continue
+			}
+			b.updatePool()
+			var failed error
+			if !b.ipv6Only {
+				if err := b.configure(snapshot); err != nil {
+					b.metrics.Reconfigure("critical", time.Since(start))
+					log.Errorf("bgp: unable to apply mandatory ipv4 reconfiguration. %v", err)
+					failed = err
+				}
 			}
 
 			log.Debugln("bgp: time to run v4 configure:", time.Since(start))
 
-			if err := b.configure6(); err != nil {
+			if err := b.configure6(snapshot); err != nil {
 				b.metrics.Reconfigure("critical", time.Since(start))
 				log.Errorf("bgp: unable to apply mandatory ipv6 reconfiguration. %v", err)
+				failed = err
 			}
 			log.Debugln("bgp: time to run v4 and v6 configure:", time.Since(start))
+			if failed != nil {
+				b.applyFailed(failed)
+				continue
+			}
+			b.applySucceeded()
 
 			b.metrics.Reconfigure("complete", time.Since(start))
+			b.converged(config, true)
+			b.saveCache(snapshot, true)
+		case <-b.standbyChanged:
+			b.applyStandby()
+
 		case <-bgpTicker.C:
+			if b.withdrawIfStale() {
+				continue
+			}
 			// log.Debugln("bgp: BGP ticker checking parity...")
 			b.performReconfigure()
 			// log.Debugln("bgp: time to run bgp ticker reconfigure:", time.Since(start))
@@ -343,7 +907,8 @@ func (b *bgpserver) noUpdatesReady() bool {
 	return b.lastReconfigure.Sub(b.lastInboundUpdate) > 0
 }
 
-func (b *bgpserver) setAddresses6() error {
+// setAddresses6 adds and removes the ipv6 VIP devices of snapshot
+func (b *bgpserver) setAddresses6(snapshot *watcher.Watcher) error {
 
 	// pull existing
 	startTime := time.Now()
@@ -356,17 +921,17 @@ func (b *bgpserver) setAddresses6() error {
 		return err
 	}
 
-	if b.watcher == nil {
+	if snapshot == nil {
 		return fmt.Errorf("can not call setAddresses6 because watcher is nil")
 	}
-	if b.watcher.ClusterConfig == nil {
+	if snapshot.ClusterConfig == nil {
 		return fmt.Errorf("can not call setAddresses6 because ClusterConfig is nil")
 	}
 
 	// get desired set VIP addresses
 	desired := []string{}
 	devToAddr := map[string]string{}
-	for ip := range b.watcher.ClusterConfig.Config6 {
+	for ip := range b.vips(snapshot.ClusterConfig.Config6) {
 		devName := b.ipDevices.Device(string(ip), true)
 		if len(strings.TrimSpace(devName)) > 0 {
 			desired = append(desired, devName)
@@ -406,18 +971,24 @@ func (b *bgpserver) setAddresses6() error {
 
 	// now iterate across configured and see if we have a non-standard MTU
 	// setting it where applicable
-	err = b.ipDevices.SetMTU(b.watcher.ClusterConfig.MTUConfig6, true)
+	err = b.ipDevices.SetMTU(snapshot.ClusterConfig.MTUConfig6, true)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// place the VIPs of tenants in their VRFs
+	if err := b.ipDevices.SetVRFs(snapshot.ClusterConfig.VRFs, true); err != nil {
+		return err
+	}
+
+	// and send the replies of the VIPs out of the interfaces they are routed through
+	return b.ipDevices.SetReturnRoutes(snapshot.ClusterConfig.ReturnRoutes(true), true)
 }
 
 // setAddresses adds or removes IP address from the loopback device (lo).
 // The IP addresses should be VIPs, from the configmap that a kubernetes
-// watcher gives to a bgpserver in func (b *bgpserver) watches()
-func (b *bgpserver) setAddresses() error {
+// watcher gives to a bgpserver in func (b *bgpserver) watches(), as of snapshot
+func (b *bgpserver) setAddresses(snapshot *watcher.Watcher) error {
 
 	startTime := time.Now()
 	defer func() {
@@ -434,13 +1005,13 @@ func (b *bgpserver) setAddresses() error {
 	// get desired set VIP addresses
 	desired := []string{}
 	devToAddr := map[string]string{}
-	if b.watcher == nil {
+	if snapshot == nil {
 		return fmt.Errorf("can not call setAddresses because watcher is nil")
 	}
-	if b.watcher.ClusterConfig == nil {
+	if snapshot.ClusterConfig == nil {
 		return fmt.Errorf("can not call setAddresses because ClusterConfig is nil")
 	}
-	for ip := range b.watcher.ClusterConfig.Config {
+	for ip := range b.vips(snapshot.ClusterConfig.Config) {
 		devName := b.ipDevices.Device(string(ip), false)
 		if len(strings.TrimSpace(devName)) > 0 {
 			desired = append(desired, devName)
@@ -483,12 +1054,18 @@ func (b *bgpserver) setAddresses() error {
 	// setting it where applicable
 	// pull existing
 	// log.Debugln("bgp: setting BTP on devices")
-	err = b.ipDevices.SetMTU(b.watcher.ClusterConfig.MTUConfig, false)
+	err = b.ipDevices.SetMTU(snapshot.ClusterConfig.MTUConfig, false)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// place the VIPs of tenants in their VRFs
+	if err := b.ipDevices.SetVRFs(snapshot.ClusterConfig.VRFs, false); err != nil {
+		return err
+	}
+
+	// and send the replies of the VIPs out of the interfaces they are routed through
+	return b.ipDevices.SetReturnRoutes(snapshot.ClusterConfig.ReturnRoutes(false), false)
 }
 
 // watches just selects from node updates and config updates channels,
@@ -540,11 +1117,65 @@ func (b *bgpserver) performReconfigure() {
 	}()
 	// log.Debugln("bgp: running performReconfigure")
 
-	if b.noUpdatesReady() {
+	b.updatePool()
+	if b.noUpdatesReady() && !b.withdrawn && !b.poolChanged {
 		// log.Debugln("bgp: no updates ready")
 		// last update happened before the last reconfigure
 		return
 	}
+	if !b.breakerAllows() {
+		return
+	}
+
+	// capture the generation before taking the snapshot, so a config published
+	// mid-apply is never reported as applied. the rest of the pass reads the
+	// snapshot, so updates arriving from the watcher mid-apply can't produce torn reads
+	generation := b.watcher.ConfigGeneration()
+	snapshot := b.watcher.Snapshot()
+	config := snapshot.ClusterConfig
+	if config == nil {
+		return
+	}
+
+	// the conntrack bypass rules live in the raw table, which the parity check
+	// doesn't cover, so they are reconciled on every pass
+	if b.ipt != nil {
+		if err := b.ipt.SetNotrack(config); err != nil {
+			b.logger.Errorf("bgp: unable to configure conntrack bypass rules. %v", err)
+		}
+		if err := b.ipt.SetMaintenance(config); err != nil {
+			b.logger.Errorf("bgp: unable to configure maintenance rules. %v", err)
+		}
+		if err := b.ipt.SetTranslation(config); err != nil {
+			b.logger.Errorf("bgp: unable to configure translation rules. %v", err)
+		}
+		if err := b.ipt.SetACL(config); err != nil {
+			b.logger.Errorf("bgp: unable to configure acl rules. %v", err)
+		}
+		if err := b.ipt.SetTProxy(config); err != nil {
+			b.logger.Errorf("bgp: unable to configure tproxy rules. %v", err)
+		}
+		if err := b.ipt.SetMirror(config); err != nil {
+			b.logger.Errorf("bgp: unable to configure mirror rules. %v", err)
+		}
+	}
+
+	// the syn flood defenses, kernel parameters first as the syn proxy relies on them
+	if b.defense != nil {
+		if err := b.defense.Apply(config.DefenseSysctls()); err != nil {
+			b.logger.Errorf("bgp: unable to configure defense sysctls. %v", err)
+		}
+	}
+	if b.ipt != nil {
+		if err := b.ipt.SetSYNProxy(config); err != nil {
+			b.logger.Errorf("bgp: unable to configure syn proxy rules. %v", err)
+		}
+	}
+
+	// withdrawing a VIP doesn't change IPVS, so it's reconciled on every pass too
+	if err := b.withdrawUnadvertised(config); err != nil {
+		b.logger.Errorf("bgp: unable to withdraw unadvertised VIPs. %v", err)
+	}
 
 	// these are the VIP addresses
 	// get both the v4 and v6 to use in CheckConfigParity below
@@ -562,29 +1193,72 @@ func (b *bgpserver) performReconfigure() {
 
 	// log.Debugln("CheckConfigParity: bgpserver passing in these addresses:", addresses)
 	// compare configurations and apply new IPVS rules if they're different
-	same, err := b.ipvs.CheckConfigParity(b.watcher, b.watcher.ClusterConfig, addresses)
+	parityStart := time.Now()
+	same, err := b.ipvs.CheckConfigParity(snapshot, config, addresses)
+	b.metrics.Stage(stats.StageParity, time.Since(parityStart))
 	if err != nil {
 		b.metrics.Reconfigure("error", time.Since(start))
 		log.Errorln("bgp: unable to compare configurations with error %v\n", err)
 		return
 	}
-	if same {
+	if same && !b.withdrawn && !b.poolChanged {
 		b.logger.Debug("bgp: parity same")
+		b.applySucceeded()
+		util.MarkHealthy(stats.KindBGPDirector)
 		b.metrics.Reconfigure("noop", time.Since(start))
+		b.metrics.AppliedGeneration(generation)
+		b.converged(config, false)
+		b.saveCache(snapshot, false)
 		return
 	}
 
 	log.Debugln("bgp: parity different, reconfiguring")
-	if err := b.configure(); err != nil {
-		b.metrics.Reconfigure("critical", time.Since(start))
-		b.logger.Errorf("bgp: unable to apply ipv4 configuration. %v", err)
-		return
+	if !b.ipv6Only {
+		if err := b.configure(snapshot); err != nil {
+			b.metrics.Reconfigure("critical", time.Since(start))
+			b.logger.Errorf("bgp: unable to apply ipv4 configuration. %v", err)
+			b.applyFailed(err)
+			return
+		}
 	}
 
-	if err := b.configure6(); err != nil {
+	if err := b.configure6(snapshot); err != nil {
 		b.metrics.Reconfigure("critical", time.Since(start))
 		b.logger.Errorf("bgp: unable to apply ipv6 configuration. %v", err)
+		b.applyFailed(err)
 		return
 	}
+	b.poolChanged = false
+	b.applySucceeded()
+	util.MarkHealthy(stats.KindBGPDirector)
 	b.metrics.Reconfigure("complete", time.Since(start))
+	b.metrics.AppliedGeneration(generation)
+	b.converged(config, true)
+	b.saveCache(snapshot, true)
+}
+
+// saveCache writes the state behind a successful reconcile to the config cache.
+// Reconciles that found parity only write it when the generation has changed.
+func (b *bgpserver) saveCache(snapshot *watcher.Watcher, applied bool) {
+	generation := snapshot.ClusterConfig.Generation
+	if !applied && b.cachedGeneration == generation {
+		return
+	}
+	b.cachedGeneration = generation
+
+	if err := b.watcher.WriteCache(snapshot); err != nil {
+		b.logger.Errorf("bgp: %v", err)
+	}
+}
+
+// converged records the time the changes to endpoints in config took to land in
+// the kernel, once per change, when the reconcile that applied it changed the kernel
+func (b *bgpserver) converged(config *types.ClusterConfig, changed bool) {
+	if config == nil || !config.EventTime.After(b.convergedAt) {
+		return
+	}
+	b.convergedAt = config.EventTime
+	if changed {
+		b.metrics.Converged(time.Since(config.EventTime))
+	}
 }
@@ -0,0 +1,228 @@
+// Package chaos injects failures into the system interfaces used by the director,
+// the bgp director and the realserver. It exists to validate retry and rollback behavior in staging and
+// must never be enabled in production.
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+const (
+	faultIPTablesRestore = "iptables_restore"
+	faultAPIDisconnect   = "api_disconnect"
+	faultIPVSDelay       = "ipvs_delay"
+)
+
+// Config holds the probabilities, between 0 and 1, of each injected fault
+type Config struct {
+	// IPTablesRestoreFailure is the chance that an iptables-restore fails
+	IPTablesRestoreFailure float64
+
+	// APIDisconnect is the chance, checked every APIDisconnectInterval, that the
+	// watcher loses its connection to the API server
+	APIDisconnect         float64
+	APIDisconnectInterval time.Duration
+
+	// IPVSDelay is the chance that an ipvsadm call is slowed by IPVSDelayDuration
+	IPVSDelay         float64
+	IPVSDelayDuration time.Duration
+}
+
+// Disconnector is implemented by the watcher
+type Disconnector interface {
+	Disconnect()
+}
+
+// Injector decides when to inject faults
+type Injector struct {
+	sync.Mutex
+
+	config Config
+	rand   *rand.Rand
+
+	logger   log.FieldLogger
+	injected *prometheus.CounterVec
+	kind     string
+	secZone  string
+}
+
+var (
+	injectedOnce sync.Once
+	injected     *prometheus.CounterVec
+)
+
+// NewInjector creates a new failure injector
+func NewInjector(config Config, kind, secZone string, logger log.FieldLogger) *Injector {
+	injectedOnce.Do(func() {
+		injected = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: stats.Prefix + "chaos_injected_count",
+			Help: "is a count of faults injected by the chaos layer. labels for fault iptables_restore|api_disconnect|ipvs_delay",
+		}, []string{"lb", "seczone", "fault"})
+		prometheus.MustRegister(injected)
+	})
+
+	logger.Warnf("chaos: failure injection enabled. %+v", config)
+
+	return &Injector{
+		config:   config,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		logger:   logger.WithFields(log.Fields{"module": "chaos"}),
+		injected: injected,
+		kind:     kind,
+		secZone:  secZone,
+	}
+}
+
+// roll returns true with probability p, and counts the fault when it does
+func (i *Injector) roll(p float64, fault string) bool {
+	if p <= 0 {
+		return false
+	}
+	i.Lock()
+	hit := i.rand.Float64() < p
+	i.Unlock()
+	if hit {
+		i.logger.Warnf("chaos: injecting %s", fault)
+		i.injected.With(prometheus.Labels{"lb": i.kind, "seczone": i.secZone, "fault": fault}).Inc()
+	}
+	return hit
+}
+
+// DisconnectWatcher periodically disconnects the watcher from the API server
+// until ctx is canceled
+func (i *Injector) DisconnectWatcher(ctx context.Context, d Disconnector) {
+	if i.config.APIDisconnect <= 0 || i.config.APIDisconnectInterval <= 0 {
+		return
+	}
+	t := time.NewTicker(i.config.APIDisconnectInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if i.roll(i.config.APIDisconnect, faultAPIDisconnect) {
+				d.Disconnect()
+			}
+		}
+	}
+}
+
+// RuleApplier wraps a RuleApplier, failing the calls that run iptables-restore
+func (i *Injector) RuleApplier(r iptables.RuleApplier) iptables.RuleApplier {
+	return &ruleApplier{RuleApplier: r, injector: i}
+}
+
+type ruleApplier struct {
+	iptables.RuleApplier
+	injector *Injector
+}
+
+func (r *ruleApplier) fail() error {
+	if r.injector.roll(r.injector.config.IPTablesRestoreFailure, faultIPTablesRestore) {
+		return fmt.Errorf("chaos: injected iptables-restore failure")
+	}
+	return nil
+}
+
+func (r *ruleApplier) Restore(rules map[string]*iptables.RuleSet) error {
+	if err := r.fail(); err != nil {
+		return err
+	}
+	return r.RuleApplier.Restore(rules)
+}
+
+func (r *ruleApplier) SetNotrack(config *types.ClusterConfig) error {
+	if err := r.fail(); err != nil {
+		return err
+	}
+	return r.RuleApplier.SetNotrack(config)
+}
+
+func (r *ruleApplier) SetMaintenance(config *types.ClusterConfig) error {
+	if err := r.fail(); err != nil {
+		return err
+	}
+	return r.RuleApplier.SetMaintenance(config)
+}
+
+func (r *ruleApplier) SetTranslation(config *types.ClusterConfig) error {
+	if err := r.fail(); err != nil {
+		return err
+	}
+	return r.RuleApplier.SetTranslation(config)
+}
+
+func (r *ruleApplier) SetACL(config *types.ClusterConfig) error {
+	if err := r.fail(); err != nil {
+		return err
+	}
+	return r.RuleApplier.SetACL(config)
+}
+
+func (r *ruleApplier) SetSYNProxy(config *types.ClusterConfig) error {
+	if err := r.fail(); err != nil {
+		return err
+	}
+	return r.RuleApplier.SetSYNProxy(config)
+}
+
+func (r *ruleApplier) SetTProxy(config *types.ClusterConfig) error {
+	if err := r.fail(); err != nil {
+		return err
+	}
+	return r.RuleApplier.SetTProxy(config)
+}
+
+func (r *ruleApplier) SetMirror(config *types.ClusterConfig) error {
+	if err := r.fail(); err != nil {
+		return err
+	}
+	return r.RuleApplier.SetMirror(config)
+}
+
+func (r *ruleApplier) SetFwmarks(marks []types.ECMPFwmark, steering []types.SteeringFwmark) error {
+	if err := r.fail(); err != nil {
+		return err
+	}
+	return r.RuleApplier.SetFwmarks(marks, steering)
+}
+
+// CommandRunner wraps the CommandRunner of an IPVS manager, delaying every
+// ipvsadm it runs, so that reads of both families and every apply are slowed
+// alike. The delay ends early when the command's context is done, which then
+// fails the command.
+func (i *Injector) CommandRunner(r system.CommandRunner) system.CommandRunner {
+	return &commandRunner{CommandRunner: r, injector: i}
+}
+
+type commandRunner struct {
+	system.CommandRunner
+	injector *Injector
+}
+
+func (c *commandRunner) Run(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	if name == "ipvsadm" && c.injector.roll(c.injector.config.IPVSDelay, faultIPVSDelay) {
+		t := time.NewTimer(c.injector.config.IPVSDelayDuration)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, fmt.Errorf("chaos: %s %s: %v", name, strings.Join(args, " "), ctx.Err())
+		case <-t.C:
+		}
+	}
+	return c.CommandRunner.Run(ctx, stdin, name, args...)
+}
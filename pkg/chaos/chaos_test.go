@@ -0,0 +1,72 @@
+package chaos
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+func TestRuleApplierRestore(t *testing.T) {
+	fake := iptables.NewFakeRuleApplier("RAVEL", true, logrus.New())
+	rules := NewInjector(Config{IPTablesRestoreFailure: 1}, "test", "test", logrus.New()).RuleApplier(fake)
+	if err := rules.Restore(map[string]*iptables.RuleSet{}); err == nil {
+		t.Error("expected injected restore failure")
+	}
+	if err := rules.SetNotrack(&types.ClusterConfig{}); err == nil {
+		t.Error("expected injected restore failure of the raw table rules")
+	}
+	if fake.Restores != 0 {
+		t.Errorf("expected restore to be skipped, got %d", fake.Restores)
+	}
+
+	rules = NewInjector(Config{}, "test", "test", logrus.New()).RuleApplier(fake)
+	if err := rules.Restore(map[string]*iptables.RuleSet{}); err != nil {
+		t.Errorf("expected passthrough, got %v", err)
+	}
+	if fake.Restores != 1 {
+		t.Errorf("expected one restore, got %d", fake.Restores)
+	}
+}
+
+func TestCommandRunnerDelay(t *testing.T) {
+	recorder := system.NewRecordingCommandRunner()
+	recorder.Respond("ipvsadm -Sn", "-A -t [2001:db8::7]:80 -s wrr\n", nil)
+	runner := NewInjector(Config{IPVSDelay: 1, IPVSDelayDuration: 20 * time.Millisecond}, "test", "test", logrus.New()).CommandRunner(recorder)
+
+	// the v6 rules are read through the delayed ipvsadm too
+	ipvs, err := system.NewIPVS(context.Background(), "10.131.153.120", false, true, logrus.New(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipvs.SetCommandRunner(runner)
+	start := time.Now()
+	rules, err := ipvs.GetV6()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("expected the rules to be read after the delay. have %v after %v", rules, time.Since(start))
+	}
+
+	// the delay ends with the command's context
+	runner = NewInjector(Config{IPVSDelay: 1, IPVSDelayDuration: time.Hour}, "test", "test", logrus.New()).CommandRunner(recorder)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := runner.Run(ctx, nil, "ipvsadm", "-Sn"); err == nil {
+		t.Fatal("expected the delayed command to fail with its context")
+	}
+	if len(recorder.Commands) != 1 {
+		t.Fatalf("expected the canceled command not to run. have %v", recorder.CommandLines())
+	}
+
+	// other commands aren't delayed
+	if _, err := runner.Run(context.Background(), nil, "ip", "link", "show"); err != nil {
+		t.Fatal(err)
+	}
+}
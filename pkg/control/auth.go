@@ -0,0 +1,478 @@
+package control
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Comcast/Ravel/pkg/mtls"
+)
+
+// the verb of each method, as authorizers see it. get is the only verb that
+// changes nothing, and every call of the others is audited.
+var verbs = map[string]string{
+	"AdvertiseVIP":   "advertise",
+	"WithdrawVIP":    "withdraw",
+	"SetMaintenance": "maintain",
+	"DrainNode":      "drain",
+	"ForceReconcile": "reconcile",
+	"GetState":       "get",
+	"GetBackends":    "get",
+	"GetDiff":        "get",
+	"GetMTU":         "get",
+}
+
+// how long an authenticator or authorizer has to answer
+const reviewTimeout = 10 * time.Second
+
+// LoginArgs authenticates the connection it is sent over with Token
+type LoginArgs struct {
+	Token string
+}
+
+// User is a caller of the API
+type User struct {
+	Name   string   `json:"name"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// Authenticator returns the user a token belongs to
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (*User, error)
+}
+
+// Authorizer decides whether a user may call the methods of a verb
+type Authorizer interface {
+	Authorize(ctx context.Context, user *User, verb string) (bool, error)
+}
+
+// StaticTokens authenticates the tokens of a file in the format of the static
+// token file of the api server: token,user,uid,"group1,group2"
+type StaticTokens map[string]User
+
+// LoadStaticTokens reads the token file at path
+func LoadStaticTokens(path string) (StaticTokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("control: %v", err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	tokens := StaticTokens{}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("control: token file %s is invalid. %v", path, err)
+		}
+		if len(record) < 2 || record[0] == "" || record[1] == "" {
+			return nil, fmt.Errorf("control: token file %s has a line without a token and user", path)
+		}
+		user := User{Name: record[1]}
+		if len(record) > 3 && record[3] != "" {
+			user.Groups = strings.Split(record[3], ",")
+		}
+		tokens[record[0]] = user
+	}
+	return tokens, nil
+}
+
+// Authenticate returns the user of the token, comparing it with every token
+// in constant time
+func (s StaticTokens) Authenticate(ctx context.Context, token string) (*User, error) {
+	var found *User
+	for t, user := range s {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			u := user
+			found = &u
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("control: the token is not valid")
+	}
+	return found, nil
+}
+
+// TokenReviewer authenticates service account and other kubernetes tokens
+// with a TokenReview
+type TokenReviewer struct {
+	clientset kubernetes.Interface
+	audiences []string
+}
+
+// NewTokenReviewer creates a TokenReviewer accepting tokens of audiences, or
+// of the api server when there are none
+func NewTokenReviewer(clientset kubernetes.Interface, audiences []string) *TokenReviewer {
+	return &TokenReviewer{clientset: clientset, audiences: audiences}
+}
+
+// Authenticate returns the user the api server finds the token belongs to
+func (t *TokenReviewer) Authenticate(ctx context.Context, token string) (*User, error) {
+	review, err := t.clientset.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: t.audiences},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("control: unable to review the token. %v", err)
+	}
+	if !review.Status.Authenticated {
+		return nil, fmt.Errorf("control: the token is not valid. %s", review.Status.Error)
+	}
+	return &User{Name: review.Status.User.Username, Groups: review.Status.User.Groups}, nil
+}
+
+// Roles authorizes verbs by the rules of a local policy
+type Roles map[string]map[string]bool
+
+// ParseRoles parses rules of the form verb=user:name,group:name. The verb *
+// is any verb. A verb is authorized to the users and groups of its own rules
+// and of those of *.
+func ParseRoles(rules []string) (Roles, error) {
+	roles := Roles{}
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		verb := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || verb == "" {
+			return nil, fmt.Errorf("control role %q must be verb=user:name,group:name", rule)
+		}
+		if _, ok := roles[verb]; !ok {
+			roles[verb] = map[string]bool{}
+		}
+		for _, subject := range strings.Split(parts[1], ",") {
+			subject = strings.TrimSpace(subject)
+			if !strings.HasPrefix(subject, "user:") && !strings.HasPrefix(subject, "group:") {
+				return nil, fmt.Errorf("control role %q: %q must be a user:name or group:name", rule, subject)
+			}
+			roles[verb][subject] = true
+		}
+	}
+	return roles, nil
+}
+
+// Authorize is whether the user or one of its groups is given the verb
+func (r Roles) Authorize(ctx context.Context, user *User, verb string) (bool, error) {
+	subjects := []string{"user:" + user.Name}
+	for _, g := range user.Groups {
+		subjects = append(subjects, "group:"+g)
+	}
+	for _, v := range []string{verb, "*"} {
+		for _, s := range subjects {
+			if r[v][s] {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// AccessReviewer authorizes verbs with the RBAC of the cluster, through a
+// SubjectAccessReview of the verb on the directors resource of the
+// ravel.comcast.com group, named for the node. A role granting it is
+//
+//	rules:
+//	- apiGroups: ["ravel.comcast.com"]
+//	  resources: ["directors"]
+//	  verbs: ["get", "drain", "maintain"]
+type AccessReviewer struct {
+	clientset kubernetes.Interface
+	node      string
+}
+
+// NewAccessReviewer creates an AccessReviewer of the director of node
+func NewAccessReviewer(clientset kubernetes.Interface, node string) *AccessReviewer {
+	return &AccessReviewer{clientset: clientset, node: node}
+}
+
+// Authorize is whether RBAC gives the user the verb on the director
+func (a *AccessReviewer) Authorize(ctx context.Context, user *User, verb string) (bool, error) {
+	review, err := a.clientset.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Name,
+			Groups: user.Groups,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Group:    "ravel.comcast.com",
+				Resource: "directors",
+				Verb:     verb,
+				Name:     a.node,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("control: unable to review access. %v", err)
+	}
+	return review.Status.Allowed, nil
+}
+
+// AuditEvent records one call that changes the director, or the refusal of
+// one
+type AuditEvent struct {
+	Time   time.Time       `json:"time"`
+	User   string          `json:"user"`
+	Groups []string        `json:"groups,omitempty"`
+	Remote string          `json:"remote"`
+	Method string          `json:"method"`
+	Verb   string          `json:"verb"`
+	Args   json.RawMessage `json:"args,omitempty"`
+	Result string          `json:"result"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// the results of audited calls
+const (
+	AuditAllowed = "allowed"
+	AuditRefused = "refused"
+	AuditFailed  = "failed"
+)
+
+// Auditor writes every audit event to the log, and as a JSON line to a file
+type Auditor struct {
+	sync.Mutex
+	w      io.WriteCloser
+	logger log.FieldLogger
+}
+
+// NewAuditor creates an Auditor appending to the file at path, or only
+// logging when path is empty
+func NewAuditor(path string, logger log.FieldLogger) (*Auditor, error) {
+	a := &Auditor{logger: logger}
+	if path == "" {
+		return a, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("control: unable to open the audit log. %v", err)
+	}
+	a.w = f
+	return a, nil
+}
+
+// Record records the event
+func (a *Auditor) Record(e AuditEvent) {
+	a.logger.WithFields(log.Fields{"audit": true, "user": e.User, "remote": e.Remote, "result": e.Result}).Infof("control: %s %s %s", e.Method, string(e.Args), e.Error)
+	if a.w == nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		a.logger.Errorf("control: unable to encode the audit event. %v", err)
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	if _, err := a.w.Write(append(b, '\n')); err != nil {
+		a.logger.Errorf("control: unable to write the audit log. %v", err)
+	}
+}
+
+// Close closes the file of the audit log
+func (a *Auditor) Close() error {
+	if a.w == nil {
+		return nil
+	}
+	return a.w.Close()
+}
+
+// SetAuth requires callers to log in with a token authenticator accepts, and
+// to be authorized the verb of every method they call. Either may be nil: a
+// nil authenticator leaves callers anonymous unless mutual TLS names them,
+// and a nil authorizer allows every verb.
+func (c *Control) SetAuth(authenticator Authenticator, authorizer Authorizer) {
+	c.authenticator = authenticator
+	c.authorizer = authorizer
+}
+
+// SetAuditor records every call that changes the director with auditor
+func (c *Control) SetAuditor(auditor *Auditor) {
+	c.auditor = auditor
+}
+
+// session is the codec of a connection, which tracks the user logged in over
+// it, authorizes its calls and audits those that change the director
+type session struct {
+	rpc.ServerCodec
+	c      *Control
+	remote string
+	user   *User
+
+	// the call whose body is read next, if it is audited, and its sequence
+	// number
+	next    *AuditEvent
+	nextSeq uint64
+
+	// writes is held by every response, as the replies to logins and
+	// refusals are written from the reading goroutine while the server
+	// writes the replies to calls. audits are the audited calls awaiting a
+	// reply, by sequence number.
+	writes sync.Mutex
+	audits map[uint64]*AuditEvent
+}
+
+// newSession wraps the codec of conn. A caller that presented a certificate
+// is the user of its first SAN, in the groups of all of them.
+func (c *Control) newSession(codec rpc.ServerCodec, conn net.Conn) *session {
+	s := &session{ServerCodec: codec, c: c, remote: conn.RemoteAddr().String(), audits: map[uint64]*AuditEvent{}}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if ids := mtls.Identities(tlsConn.ConnectionState()); len(ids) > 0 {
+			s.user = &User{Name: ids[0], Groups: ids}
+		}
+	}
+	return s
+}
+
+func (s *session) ReadRequestHeader(r *rpc.Request) error {
+	for {
+		if err := s.ServerCodec.ReadRequestHeader(r); err != nil {
+			return err
+		}
+		method := strings.TrimPrefix(r.ServiceMethod, serviceName+".")
+		if method == "Login" {
+			if err := s.login(r); err != nil {
+				return err
+			}
+			continue
+		}
+		verb, ok := verbs[method]
+		if !ok {
+			// the server answers methods it doesn't have
+			s.next = nil
+			return nil
+		}
+
+		var event *AuditEvent
+		if verb != "get" {
+			event = &AuditEvent{Time: time.Now(), Remote: s.remote, Method: method, Verb: verb, Result: AuditAllowed}
+			if s.user != nil {
+				event.User, event.Groups = s.user.Name, s.user.Groups
+			}
+		}
+		refusal := s.authorize(verb)
+		if refusal == "" {
+			s.next, s.nextSeq = event, r.Seq
+			return nil
+		}
+
+		// the body of a refused call is read for the audit, and dropped
+		var args json.RawMessage
+		if err := s.ServerCodec.ReadRequestBody(&args); err != nil {
+			return err
+		}
+		if event != nil {
+			event.Args, event.Result, event.Error = args, AuditRefused, refusal
+			s.c.audit(*event)
+		}
+		if err := s.write(&rpc.Response{ServiceMethod: r.ServiceMethod, Seq: r.Seq, Error: refusal}, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// authorize returns why the user of the session may not call the methods of
+// verb, or nothing
+func (s *session) authorize(verb string) string {
+	if s.c.authenticator != nil && s.user == nil {
+		return "control: log in first"
+	}
+	if s.c.authorizer == nil {
+		return ""
+	}
+	user := s.user
+	if user == nil {
+		user = &User{Name: "system:anonymous"}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reviewTimeout)
+	defer cancel()
+	allowed, err := s.c.authorizer.Authorize(ctx, user, verb)
+	if err != nil {
+		s.c.logger.Errorf("control: %v", err)
+		return "control: unable to authorize " + user.Name
+	}
+	if !allowed {
+		return fmt.Sprintf("control: %s may not %s", user.Name, verb)
+	}
+	return ""
+}
+
+// login authenticates the session with the token of the request
+func (s *session) login(r *rpc.Request) error {
+	args := LoginArgs{}
+	if err := s.ServerCodec.ReadRequestBody(&args); err != nil {
+		return err
+	}
+	response := &rpc.Response{ServiceMethod: r.ServiceMethod, Seq: r.Seq}
+	if s.c.authenticator == nil {
+		response.Error = "control: authentication is not enabled"
+		return s.write(response, nil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reviewTimeout)
+	defer cancel()
+	user, err := s.c.authenticator.Authenticate(ctx, args.Token)
+	if err != nil {
+		s.c.logger.Warnf("control: login from %s failed. %v", s.remote, err)
+		response.Error = "control: login failed"
+		return s.write(response, nil)
+	}
+	s.user = user
+	s.c.logger.Infof("control: %s logged in from %s", user.Name, s.remote)
+	return s.write(response, user)
+}
+
+func (s *session) ReadRequestBody(x interface{}) error {
+	event := s.next
+	s.next = nil
+	if event == nil || x == nil {
+		return s.ServerCodec.ReadRequestBody(x)
+	}
+	if err := s.ServerCodec.ReadRequestBody(x); err != nil {
+		return err
+	}
+	event.Args, _ = json.Marshal(x)
+	s.writes.Lock()
+	s.audits[s.nextSeq] = event
+	s.writes.Unlock()
+	return nil
+}
+
+func (s *session) WriteResponse(r *rpc.Response, body interface{}) error {
+	s.writes.Lock()
+	event, ok := s.audits[r.Seq]
+	delete(s.audits, r.Seq)
+	s.writes.Unlock()
+	if ok {
+		if r.Error != "" {
+			event.Result, event.Error = AuditFailed, r.Error
+		}
+		s.c.audit(*event)
+	}
+	return s.write(r, body)
+}
+
+func (s *session) write(r *rpc.Response, body interface{}) error {
+	s.writes.Lock()
+	defer s.writes.Unlock()
+	return s.ServerCodec.WriteResponse(r, body)
+}
+
+func (c *Control) audit(e AuditEvent) {
+	if c.auditor != nil {
+		c.auditor.Record(e)
+	}
+}
@@ -0,0 +1,235 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/director"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// fakeDirector counts the reconciles requested of it
+type fakeDirector struct {
+	director.Director
+	requests int
+}
+
+func (f *fakeDirector) RequestReconcile() { f.requests++ }
+func (f *fakeDirector) State() director.State {
+	return director.State{Started: true, AppliedGeneration: 7, VIPs: []string{"10.54.213.165"}}
+}
+
+// fakeInspector reports a single real, and a node out of parity
+type fakeInspector struct{}
+
+func (fakeInspector) Backends(ctx context.Context) (map[string]map[string]system.IPVSRealStats, error) {
+	return map[string]map[string]system.IPVSRealStats{
+		"-t 10.54.213.165:80": {"10.131.153.76:80": {Weight: 1, ActiveConns: 3}},
+	}, nil
+}
+
+func (fakeInspector) Diff() ([]string, error) {
+	return []string{"+ -a -t 10.54.213.165:80 -r 10.131.153.76:80 -i -w 1"}, nil
+}
+
+func TestControl(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// take a free port, then serve on it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	d := &fakeDirector{}
+	overrides := types.NewOverrides()
+	c := NewControl(d, overrides, logrus.New())
+	c.SetInspector(fakeInspector{})
+	go Serve(ctx, addr, c)
+
+	var client *Client
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if client, err = Dial(addr); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.WithdrawVIP("10.54.213.165"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WithdrawVIP("not-a-vip"); err == nil {
+		t.Fatal("expected an invalid VIP to be refused")
+	}
+	if err := client.SetMaintenance("10.54.213.166", &types.Maintenance{Action: "teapot"}); err == nil {
+		t.Fatal("expected an invalid maintenance action to be refused")
+	}
+	if err := client.SetMaintenance("10.54.213.166", &types.Maintenance{Action: types.MaintenanceDrop}); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := client.GetState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Director.AppliedGeneration != 7 || len(state.Overrides.Withdrawn) != 1 || state.Overrides.Maintenance["10.54.213.166"].Action != types.MaintenanceDrop {
+		t.Fatalf("expected the director state and both overrides. have %+v", state)
+	}
+
+	if err := client.AdvertiseVIP("10.54.213.165"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AdvertiseVIP("10.54.213.165"); err == nil {
+		t.Fatal("expected advertising a VIP that isn't withdrawn to fail")
+	}
+	if err := client.DrainNode("node-a", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DrainNode("node-b", true); err == nil {
+		t.Fatal("expected undraining a node that isn't drained to fail")
+	}
+	if state, err := client.GetState(); err != nil || len(state.Overrides.Drained) != 1 {
+		t.Fatalf("expected the drained node in the state. have %+v %v", state, err)
+	}
+
+	backends, err := client.GetBackends()
+	if err != nil || backends["-t 10.54.213.165:80"]["10.131.153.76:80"].ActiveConns != 3 {
+		t.Fatalf("expected the counters of the real. have %+v %v", backends, err)
+	}
+	diff, err := client.GetDiff()
+	if err != nil || len(diff) != 1 {
+		t.Fatalf("expected the diff. have %v %v", diff, err)
+	}
+
+	if err := client.ForceReconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if d.requests != 5 {
+		t.Fatalf("expected every change and the forced reconcile to request a reconcile. have %d", d.requests)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "tokens.csv")
+	tokens := "# token,user,uid,groups\nviewtoken,vera,1001,\"viewers\"\nadmintoken,ada,1002,\"admins,viewers\"\n"
+	if err := ioutil.WriteFile(tokenFile, []byte(tokens), 0600); err != nil {
+		t.Fatal(err)
+	}
+	authenticator, err := LoadStaticTokens(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles, err := ParseRoles([]string{"get=group:viewers", "*=group:admins"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog := filepath.Join(dir, "audit.log")
+	auditor, err := NewAuditor(auditLog, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditor.Close()
+
+	d := &fakeDirector{}
+	c := NewControl(d, types.NewOverrides(), logrus.New())
+	c.SetAuth(authenticator, roles)
+	c.SetAuditor(auditor)
+	go Serve(ctx, addr, c)
+
+	dial := func() *Client {
+		var client *Client
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			if client, err = Dial(addr); err == nil {
+				return client
+			}
+		}
+		t.Fatal(err)
+		return nil
+	}
+
+	anonymous := dial()
+	defer anonymous.Close()
+	if _, err := anonymous.GetState(); err == nil || !strings.Contains(err.Error(), "log in") {
+		t.Fatalf("expected a caller that didn't log in to be refused. have %v", err)
+	}
+	if _, err := anonymous.Login("guessed"); err == nil {
+		t.Fatal("expected an unknown token to be refused")
+	}
+
+	viewer := dial()
+	defer viewer.Close()
+	if user, err := viewer.Login("viewtoken"); err != nil || user.Name != "vera" {
+		t.Fatalf("expected to log in as vera. have %+v %v", user, err)
+	}
+	if _, err := viewer.GetState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := viewer.WithdrawVIP("10.54.213.165"); err == nil || !strings.Contains(err.Error(), "may not withdraw") {
+		t.Fatalf("expected a viewer to be refused a withdrawal. have %v", err)
+	}
+
+	admin := dial()
+	defer admin.Close()
+	if _, err := admin.Login("admintoken"); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.WithdrawVIP("10.54.213.165"); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.AdvertiseVIP("10.54.213.166"); err == nil {
+		t.Fatal("expected advertising a VIP that isn't withdrawn to fail")
+	}
+	if d.requests != 1 {
+		t.Fatalf("expected only the permitted withdrawal to request a reconcile. have %d", d.requests)
+	}
+
+	// every call that changes the director is audited, reads are not
+	b, err := ioutil.ReadFile(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected three audit events. have %s", b)
+	}
+	expected := []struct{ user, method, result string }{
+		{"vera", "WithdrawVIP", AuditRefused},
+		{"ada", "WithdrawVIP", AuditAllowed},
+		{"ada", "AdvertiseVIP", AuditFailed},
+	}
+	for n, line := range lines {
+		e := AuditEvent{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.User != expected[n].user || e.Method != expected[n].method || e.Result != expected[n].result || !strings.Contains(string(e.Args), "10.54.213.16") {
+			t.Errorf("expected %+v. have %+v", expected[n], e)
+		}
+	}
+}
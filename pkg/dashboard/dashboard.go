@@ -0,0 +1,352 @@
+// Package dashboard aggregates the control api state of every ravel director
+// in a fleet, and serves it as a page and as JSON. For every VIP it shows the
+// directors advertising it and the healthy backends each of them forwards to,
+// and for every director whether its ipvs rules are in parity with its config.
+//
+// The aggregator only reads. Changes are made per director with ravelctl.
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Comcast/Ravel/pkg/control"
+	"github.com/Comcast/Ravel/pkg/mtls"
+)
+
+// the parity of a director's ipvs rules with its config
+const (
+	ParityInSync  = "in parity"
+	ParityDrifted = "out of parity"
+	ParityUnknown = "unknown"
+)
+
+// Target is a director whose control api is polled
+type Target struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+// Discover returns the directors to poll
+type Discover func(ctx context.Context) ([]Target, error)
+
+// StaticTargets polls the control apis at addrs
+func StaticTargets(addrs []string) Discover {
+	return func(ctx context.Context) ([]Target, error) {
+		targets := []Target{}
+		for _, addr := range addrs {
+			targets = append(targets, Target{Name: addr, Addr: addr})
+		}
+		return targets, nil
+	}
+}
+
+// PodTargets polls the control api on port of every running pod in namespace
+// that matches selector. Directors run on the host network, so the pod's
+// address is its node's.
+func PodTargets(clientset kubernetes.Interface, namespace, selector string, port int) Discover {
+	return func(ctx context.Context) ([]Target, error) {
+		pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, fmt.Errorf("dashboard: unable to list the pods in %s matching %q. %v", namespace, selector, err)
+		}
+		targets := []Target{}
+		for _, pod := range pods.Items {
+			if pod.Status.PodIP == "" || pod.DeletionTimestamp != nil {
+				continue
+			}
+			targets = append(targets, Target{
+				Name: pod.Spec.NodeName,
+				Addr: net.JoinHostPort(pod.Status.PodIP, fmt.Sprint(port)),
+			})
+		}
+		return targets, nil
+	}
+}
+
+// NodeState is what one director reported at the last poll
+type NodeState struct {
+	Target            Target `json:"target"`
+	Node              string `json:"node"`
+	Reachable         bool   `json:"reachable"`
+	Error             string `json:"error,omitempty"`
+	Started           bool   `json:"started"`
+	AppliedGeneration uint64 `json:"appliedGeneration"`
+	Parity            string `json:"parity"`
+	// Drift is the number of ipvs rules that differ from the config
+	Drift int `json:"drift"`
+	// Withdrawn are the VIPs an operator withdrew from the director
+	Withdrawn []string `json:"withdrawn"`
+}
+
+// VIPState is a VIP across the fleet
+type VIPState struct {
+	VIP string `json:"vip"`
+	// Directors are the nodes advertising the VIP
+	Directors []string `json:"directors"`
+	// Withdrawn are the nodes an operator withdrew the VIP from
+	Withdrawn []string `json:"withdrawn"`
+	// HealthyBackends counts, for each director, the distinct reals with some
+	// weight behind the VIP's virtual services
+	HealthyBackends map[string]int `json:"healthyBackends"`
+}
+
+// FleetState is the fleet at the last poll
+type FleetState struct {
+	Polled time.Time   `json:"polled"`
+	Nodes  []NodeState `json:"nodes"`
+	VIPs   []VIPState  `json:"vips"`
+}
+
+// Aggregator polls the directors every interval
+type Aggregator struct {
+	sync.Mutex
+
+	discover Discover
+	interval time.Duration
+	timeout  time.Duration
+	tls      *mtls.Files
+	state    FleetState
+	logger   log.FieldLogger
+}
+
+// NewAggregator creates an aggregator of the directors discover returns.
+// Each director gets timeout to answer a poll.
+func NewAggregator(discover Discover, interval, timeout time.Duration, logger log.FieldLogger) *Aggregator {
+	return &Aggregator{
+		discover: discover,
+		interval: interval,
+		timeout:  timeout,
+		state:    FleetState{Nodes: []NodeState{}, VIPs: []VIPState{}},
+		logger:   logger,
+	}
+}
+
+// SetTLS polls control apis served with mutual TLS, presenting the
+// certificate of files
+func (a *Aggregator) SetTLS(files *mtls.Files) {
+	a.tls = files
+}
+
+// Run polls the fleet every interval until ctx is done
+func (a *Aggregator) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		a.Poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll collects the state of every director once
+func (a *Aggregator) Poll(ctx context.Context) {
+	targets, err := a.discover(ctx)
+	if err != nil {
+		a.logger.Errorf("dashboard: %v", err)
+		return
+	}
+
+	nodes := make([]NodeState, len(targets))
+	backends := make([]control.Backends, len(targets))
+	vips := make([][]string, len(targets))
+	wg := sync.WaitGroup{}
+	for n, target := range targets {
+		wg.Add(1)
+		go func(n int, target Target) {
+			defer wg.Done()
+			nodes[n], vips[n], backends[n] = a.poll(target)
+		}(n, target)
+	}
+	wg.Wait()
+
+	state := FleetState{Polled: time.Now(), Nodes: nodes, VIPs: aggregate(nodes, vips, backends)}
+	sort.Slice(state.Nodes, func(i, j int) bool { return state.Nodes[i].Node < state.Nodes[j].Node })
+
+	a.Lock()
+	a.state = state
+	a.Unlock()
+}
+
+// poll collects the state of a single director, and the VIPs it advertises
+// and the backends behind them
+func (a *Aggregator) poll(target Target) (NodeState, []string, control.Backends) {
+	node := NodeState{Target: target, Node: target.Name, Parity: ParityUnknown, Withdrawn: []string{}}
+
+	c, err := control.DialTLS(target.Addr, a.timeout, a.tls)
+	if err != nil {
+		node.Error = err.Error()
+		return node, nil, nil
+	}
+	defer c.Close()
+
+	state, err := c.GetState()
+	if err != nil {
+		node.Error = err.Error()
+		return node, nil, nil
+	}
+	node.Reachable = true
+	if state.Director.Node != "" {
+		node.Node = state.Director.Node
+	}
+	node.Started = state.Director.Started
+	node.AppliedGeneration = state.Director.AppliedGeneration
+	node.Error = state.Director.Error
+	node.Withdrawn = state.Overrides.Withdrawn
+
+	// directors without an inspector can't tell their backends or parity
+	if diff, err := c.GetDiff(); err == nil {
+		node.Drift = len(diff)
+		node.Parity = ParityInSync
+		if len(diff) > 0 {
+			node.Parity = ParityDrifted
+		}
+	}
+	backends, err := c.GetBackends()
+	if err != nil {
+		backends = nil
+	}
+	return node, append(state.Director.VIPs, state.Director.VIPs6...), backends
+}
+
+// aggregate turns what each director reported into the state of each VIP
+func aggregate(nodes []NodeState, vips [][]string, backends []control.Backends) []VIPState {
+	byVIP := map[string]*VIPState{}
+	get := func(vip string) *VIPState {
+		if _, ok := byVIP[vip]; !ok {
+			byVIP[vip] = &VIPState{VIP: vip, Directors: []string{}, Withdrawn: []string{}, HealthyBackends: map[string]int{}}
+		}
+		return byVIP[vip]
+	}
+
+	for n, node := range nodes {
+		for _, vip := range vips[n] {
+			s := get(vip)
+			s.Directors = append(s.Directors, node.Node)
+			if backends[n] != nil {
+				s.HealthyBackends[node.Node] = healthyBackends(backends[n], vip)
+			}
+		}
+		for _, vip := range node.Withdrawn {
+			s := get(vip)
+			s.Withdrawn = append(s.Withdrawn, node.Node)
+		}
+	}
+
+	out := []VIPState{}
+	for _, s := range byVIP {
+		sort.Strings(s.Directors)
+		sort.Strings(s.Withdrawn)
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].VIP < out[j].VIP })
+	return out
+}
+
+// healthyBackends counts the distinct reals with some weight behind the
+// virtual services of vip. Services are keyed as `-t 10.1.2.3:80`, or
+// `-t [2001:db8::1]:80`.
+func healthyBackends(backends control.Backends, vip string) int {
+	reals := map[string]bool{}
+	for service, services := range backends {
+		fields := strings.Fields(service)
+		if len(fields) < 2 {
+			continue
+		}
+		host, _, err := net.SplitHostPort(fields[1])
+		if err != nil || host != vip {
+			continue
+		}
+		for real, s := range services {
+			if s.Weight <= 0 {
+				continue
+			}
+			if host, _, err := net.SplitHostPort(real); err == nil {
+				real = host
+			}
+			reals[real] = true
+		}
+	}
+	return len(reals)
+}
+
+// State returns the fleet at the last poll
+func (a *Aggregator) State() FleetState {
+	a.Lock()
+	defer a.Unlock()
+	return a.state
+}
+
+// ServeHTTP serves the dashboard on / and its state as JSON on /api/state
+func (a *Aggregator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	state := a.State()
+	switch r.URL.Path {
+	case "/api/state":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := page.Execute(w, state); err != nil {
+			a.logger.Errorf("dashboard: unable to render the page. %v", err)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var page = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="15">
+<title>ravel fleet</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.bad { color: #b00; }
+</style>
+</head>
+<body>
+<h1>ravel fleet</h1>
+<p>polled {{.Polled.Format "2006-01-02 15:04:05 MST"}}. <a href="api/state">json</a></p>
+<h2>VIPs</h2>
+<table>
+<tr><th>VIP</th><th>advertised by</th><th>healthy backends</th><th>withdrawn from</th></tr>
+{{range .VIPs}}<tr>
+<td>{{.VIP}}</td>
+<td{{if not .Directors}} class="bad"{{end}}>{{range .Directors}}{{.}} {{else}}none{{end}}</td>
+<td>{{range $node, $count := .HealthyBackends}}{{$node}}: {{if eq $count 0}}<span class="bad">0</span>{{else}}{{$count}}{{end}} {{end}}</td>
+<td>{{range .Withdrawn}}{{.}} {{end}}</td>
+</tr>
+{{end}}</table>
+<h2>directors</h2>
+<table>
+<tr><th>node</th><th>address</th><th>started</th><th>generation</th><th>parity</th><th>error</th></tr>
+{{range .Nodes}}<tr>
+<td>{{.Node}}</td>
+<td>{{.Target.Addr}}</td>
+<td>{{if .Reachable}}{{.Started}}{{else}}<span class="bad">unreachable</span>{{end}}</td>
+<td>{{.AppliedGeneration}}</td>
+<td{{if eq .Parity "out of parity"}} class="bad"{{end}}>{{.Parity}}{{if .Drift}} ({{.Drift}} rules){{end}}</td>
+<td class="bad">{{.Error}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,110 @@
+package dashboard
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/control"
+	"github.com/Comcast/Ravel/pkg/director"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// fakeDirector advertises a single VIP
+type fakeDirector struct {
+	director.Director
+	node string
+}
+
+func (f *fakeDirector) RequestReconcile() {}
+func (f *fakeDirector) State() director.State {
+	return director.State{Node: f.node, Started: true, AppliedGeneration: 7, VIPs: []string{"10.54.213.165"}}
+}
+
+// fakeInspector reports two reals behind the VIP, one of them quiesced, and
+// drift when drifted is set
+type fakeInspector struct {
+	drifted bool
+}
+
+func (f fakeInspector) Backends(ctx context.Context) (map[string]map[string]system.IPVSRealStats, error) {
+	return map[string]map[string]system.IPVSRealStats{
+		"-t 10.54.213.165:80":  {"10.131.153.76:80": {Weight: 1}, "10.131.153.77:80": {Weight: 0}},
+		"-t 10.54.213.165:443": {"10.131.153.76:443": {Weight: 1}},
+	}, nil
+}
+
+func (f fakeInspector) Diff() ([]string, error) {
+	if f.drifted {
+		return []string{"- -a -t 10.54.213.165:80 -r 10.131.153.78:80 -i -w 1"}, nil
+	}
+	return []string{}, nil
+}
+
+// serve serves a control api for a director on node, returning its address
+func serve(t *testing.T, ctx context.Context, node string, drifted bool) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	c := control.NewControl(&fakeDirector{node: node}, types.NewOverrides(), logrus.New())
+	c.SetInspector(fakeInspector{drifted: drifted})
+	go control.Serve(ctx, addr, c)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if client, err := control.Dial(addr); err == nil {
+			client.Close()
+			return addr
+		}
+	}
+	t.Fatalf("the control api on %s never came up", addr)
+	return ""
+}
+
+func TestAggregator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addrs := []string{serve(t, ctx, "node-a", false), serve(t, ctx, "node-b", true), "127.0.0.1:1"}
+	a := NewAggregator(StaticTargets(addrs), time.Minute, time.Second, logrus.New())
+	a.Poll(ctx)
+
+	state := a.State()
+	if len(state.Nodes) != 3 {
+		t.Fatalf("expected every target. have %+v", state.Nodes)
+	}
+	parity := map[string]string{}
+	for _, n := range state.Nodes {
+		parity[n.Node] = n.Parity
+	}
+	if parity["node-a"] != ParityInSync || parity["node-b"] != ParityDrifted || parity["127.0.0.1:1"] != ParityUnknown {
+		t.Fatalf("expected the parity of each director. have %v", parity)
+	}
+
+	if len(state.VIPs) != 1 {
+		t.Fatalf("expected one vip. have %+v", state.VIPs)
+	}
+	vip := state.VIPs[0]
+	if strings.Join(vip.Directors, ",") != "node-a,node-b" || vip.HealthyBackends["node-a"] != 1 {
+		t.Fatalf("expected both directors and the one healthy backend. have %+v", vip)
+	}
+
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(rec.Body.String(), "10.54.213.165") || !strings.Contains(rec.Body.String(), ParityDrifted) {
+		t.Fatalf("expected the page to show the vip and the drifted director. have %s", rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest("GET", "/api/state", nil))
+	if !strings.Contains(rec.Body.String(), `"healthyBackends":{"node-a":1,"node-b":1}`) {
+		t.Fatalf("expected the state as json. have %s", rec.Body.String())
+	}
+}
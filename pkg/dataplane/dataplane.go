@@ -0,0 +1,85 @@
+// Package dataplane abstracts how a director programs its VIPs into the node.
+// The director decides what to apply and when; a DataPlane decides how. IPVS,
+// with iptables for everything around the virtual services, is the first
+// provider.
+package dataplane
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// DataPlane programs the virtual services and VIP addresses of a cluster config
+// into the node. A reconcile calls ApplyPolicies, then InParity unless it is
+// forced, and when that finds a difference ApplyAddresses and ApplyServices.
+// The commands of those stages stop once their ctx is done.
+type DataPlane interface {
+	// Name identifies the provider in logs and metrics
+	Name() string
+
+	// Init clears what an earlier run, or a realserver on the same node, left
+	// behind. It is called every time the director starts.
+	Init() error
+
+	// ApplyPolicies reconciles the state that the parity check doesn't cover,
+	// such as connection tracking bypass, maintenance, acls and syn flood
+	// defenses. It runs on every reconcile. Failures are logged rather than
+	// returned, so that one policy can't hold back the others or the services.
+	ApplyPolicies(config *types.ClusterConfig)
+
+	// InParity reports whether the services and addresses of the node already
+	// match w
+	InParity(ctx context.Context, w *watcher.Watcher) (bool, error)
+
+	// ApplyAddresses puts the VIPs of config on the node and removes those it
+	// no longer holds. It returns the addresses that were added, so that the
+	// director can announce them.
+	ApplyAddresses(ctx context.Context, config *types.ClusterConfig) ([]string, error)
+
+	// ApplyServices programs the virtual services of w, and their backends.
+	// node is the director's own node, which is nil until it has been seen.
+	ApplyServices(ctx context.Context, w *watcher.Watcher, node *corev1.Node) error
+
+	// Stats counts what the plane is serving
+	Stats() (Stats, error)
+
+	// Teardown removes everything the plane programmed for config
+	Teardown(ctx context.Context, config *types.ClusterConfig) error
+}
+
+// ParityDiffer is a DataPlane that can tell what differed when InParity last
+// found a difference, so that the director can log why it reconfigures
+type ParityDiffer interface {
+	ParityDiff() system.ParityDiff
+}
+
+// Stats is what a DataPlane is serving
+type Stats struct {
+	Services  int
+	Backends  int
+	Addresses int
+}
+
+// VIPs returns the VIPs of config that a director programs: those in Config,
+// along with those in Config6 when the config is dual-stack, or only those in
+// Config6 when the cluster has no IPv4
+func VIPs(config *types.ClusterConfig, ipv6Only bool) ([]string, []string) {
+	vips4, vips6 := []string{}, []string{}
+	if ipv6Only || config.DualStack {
+		for ip := range config.Config6 {
+			vips6 = append(vips6, string(ip))
+		}
+	}
+	if ipv6Only {
+		return vips4, vips6
+	}
+	for ip := range config.Config {
+		vips4 = append(vips4, string(ip))
+	}
+	return vips4, vips6
+}
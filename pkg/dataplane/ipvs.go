@@ -0,0 +1,524 @@
+package dataplane
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/Comcast/Ravel/pkg/bgp"
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// colocation modes of a director that shares its node with a realserver
+const (
+	ColocationDisabled = "disabled"
+	ColocationIPTables = "iptables"
+	ColocationIPVS     = "ipvs"
+)
+
+// IPVS is the DataPlane that forwards VIP traffic with IPVS, and handles
+// everything around the virtual services with iptables and kernel parameters
+type IPVS struct {
+	ipvs     system.IPVSExecutor
+	ip       system.AddressManager
+	iptables iptables.RuleApplier
+
+	// colocationMode is iptables when the director shares its node with a
+	// realserver and NATs VIP traffic to the node's own pods
+	colocationMode string
+
+	// ipv6Only programs only the v6 VIPs in Config6
+	ipv6Only bool
+
+	// steered is set while the fwmark chain holds steering rules
+	steered bool
+
+	// defense sets the kernel parameters the defenses of the cluster config need
+	defense *system.SysctlOverrides
+
+	// prober, when set, withholds the VIPs another host already answers for
+	prober AddressProber
+
+	// scope, when set, is bound to the context of each stage, see SetScope
+	scope *util.Scope
+
+	logger  logrus.FieldLogger
+	metrics *stats.WorkerStateMetrics
+}
+
+var _ DataPlane = &IPVS{}
+var _ Fingerprinter = &IPVS{}
+var _ ParityDiffer = &IPVS{}
+
+// AddressProber finds the addresses of addrs that another host on the segment
+// answers for, keyed to that host, see announce.ARPProber
+type AddressProber interface {
+	Probe(ctx context.Context, addrs []string) (map[string]string, error)
+}
+
+// NewIPVS creates an IPVS data plane. A nil sysctl acts on /proc/sys.
+func NewIPVS(ipvs system.IPVSExecutor, ip system.AddressManager, ipt iptables.RuleApplier, sysctl system.Sysctl, colocationMode string, ipv6Only bool, configKey string, logger logrus.FieldLogger) *IPVS {
+	if sysctl == nil {
+		sysctl = system.NewSysctl()
+	}
+	return &IPVS{
+		ipvs:           ipvs,
+		ip:             ip,
+		iptables:       ipt,
+		colocationMode: colocationMode,
+		ipv6Only:       ipv6Only,
+		defense:        system.NewSysctlOverrides(sysctl),
+		logger:         logger,
+		metrics:        stats.NewWorkerStateMetrics(stats.KindIpvsMaster, configKey),
+	}
+}
+
+// SetAddressProber probes the v4 VIPs before they are added, and withholds
+// those another host answers for until it no longer does
+func (p *IPVS) SetAddressProber(prober AddressProber) {
+	p.prober = prober
+}
+
+// SetScope binds scope, which the executors of the plane run their commands
+// under, to the context of every stage while it runs, so that the deadline
+// and cancellation of the stage reach those commands
+func (p *IPVS) SetScope(scope *util.Scope) {
+	p.scope = scope
+}
+
+// bind binds the scope of the plane to ctx, and returns its release
+func (p *IPVS) bind(ctx context.Context) func() {
+	if p.scope == nil {
+		return func() {}
+	}
+	return p.scope.Bind(ctx)
+}
+
+func (p *IPVS) Name() string {
+	return "ipvs"
+}
+
+func (p *IPVS) Init() error {
+	// set arp rules. without IPv4 there is no arp to set
+	if !p.ipv6Only {
+		if err := p.ip.SetARP(); err != nil {
+			return fmt.Errorf("dataplane: failed to clear arp rules - %v", err)
+		}
+	}
+
+	// If director is co-located with a realserver, the realserver
+	// will deal with setting up new iptables rules
+	if p.colocationMode != ColocationIPTables {
+		// cleanup any lingering iptables rules
+		if err := p.iptables.Flush(); err != nil {
+			return fmt.Errorf("dataplane: failed to flush iptables - %v", err)
+		}
+	}
+	return nil
+}
+
+func (p *IPVS) ApplyPolicies(config *types.ClusterConfig) {
+	// the conntrack bypass rules live in the raw table, which the parity check
+	// doesn't cover, so they are reconciled on every pass. colocated directors NAT
+	// VIP traffic and can't bypass conntrack.
+	if p.colocationMode != ColocationIPTables {
+		if err := p.iptables.SetNotrack(config); err != nil {
+			p.logger.Errorf("dataplane: unable to configure conntrack bypass rules. %v", err)
+		}
+	}
+
+	// the maintenance rules live in the filter table and are reconciled on every
+	// pass for the same reason
+	if err := p.iptables.SetMaintenance(config); err != nil {
+		p.logger.Errorf("dataplane: unable to configure maintenance rules. %v", err)
+	}
+
+	// as are the mangle rules and address mappings that translate VIP ports
+	// into the family of their paired VIP
+	if err := p.iptables.SetTranslation(config); err != nil {
+		p.logger.Errorf("dataplane: unable to configure translation rules. %v", err)
+	}
+
+	// and the mangle rules that drop the clients the ACLs of VIP ports shut out
+	if err := p.iptables.SetACL(config); err != nil {
+		p.logger.Errorf("dataplane: unable to configure acl rules. %v", err)
+	}
+
+	// and the mangle rules and routing that deliver VIP ports to a local
+	// transparent proxy
+	if err := p.iptables.SetTProxy(config); err != nil {
+		p.logger.Errorf("dataplane: unable to configure tproxy rules. %v", err)
+	}
+
+	// and the mangle rules that copy mirrored VIP ports to their shadow backend
+	if err := p.iptables.SetMirror(config); err != nil {
+		p.logger.Errorf("dataplane: unable to configure mirror rules. %v", err)
+	}
+
+	// and the syn flood defenses. the kernel parameters go first, as the syn
+	// proxy relies on them
+	if err := p.defense.Apply(config.DefenseSysctls()); err != nil {
+		p.logger.Errorf("dataplane: unable to configure defense sysctls. %v", err)
+	}
+	if err := p.iptables.SetSYNProxy(config); err != nil {
+		p.logger.Errorf("dataplane: unable to configure syn proxy rules. %v", err)
+	}
+
+	// and the mangle rules that mark the traffic of steered clients for their
+	// fwmark services. once the last steering rule goes the chain is emptied
+	if p.steered || config.HasSteering() {
+		if err := p.setSteering(config); err != nil {
+			p.logger.Errorf("dataplane: unable to configure steering rules. %v", err)
+		}
+	}
+}
+
+func (p *IPVS) InParity(ctx context.Context, w *watcher.Watcher) (bool, error) {
+	defer p.bind(ctx)()
+
+	addressesV4, addressesV6, err := p.ip.Get()
+	if err != nil {
+		p.logger.Errorf("dataplane: error creating interface: %v", err)
+	}
+
+	// splice together to compare against the internal state of configs
+	// addresses is sorted within the CheckConfigParity function
+	addresses := append(addressesV4, addressesV6...)
+
+	start := time.Now()
+	same, err := p.ipvs.CheckConfigParity(w, w.ClusterConfig, addresses)
+	p.metrics.Stage(stats.StageParity, time.Since(start))
+	return same, err
+}
+
+// ParityDiff returns what differed in the last InParity. It is empty when the
+// executor doesn't count it.
+func (p *IPVS) ParityDiff() system.ParityDiff {
+	if differ, ok := p.ipvs.(ParityDiffer); ok {
+		return differ.ParityDiff()
+	}
+	return system.ParityDiff{}
+}
+
+// ApplyAddresses puts the VIPs of config on the node and removes those no
+// longer configured, returning the VIPs added. Those are the v4 VIPs, the v6
+// VIPs with them when the config is dual-stack, or only the v6 VIPs when the
+// cluster has no IPv4, see VIPs. A director that isn't dual-stack has no v6
+// VIPs, and removes the v6 devices left from when it was.
+func (p *IPVS) ApplyAddresses(ctx context.Context, config *types.ClusterConfig) ([]string, error) {
+	defer p.bind(ctx)()
+	start := time.Now()
+	defer func() {
+		p.metrics.Stage(stats.StageAddresses, time.Since(start))
+	}()
+
+	// pull existing
+	configuredV4, configuredV6, err := p.ip.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	vips4, vips6 := VIPs(config, p.ipv6Only)
+	added := []string{}
+	if !p.ipv6Only {
+		a, err := p.applyAddresses(ctx, config, configuredV4, vips4, false)
+		if err != nil {
+			return nil, err
+		}
+		added = append(added, a...)
+	}
+	if p.ipv6Only || config.DualStack {
+		a, err := p.applyAddresses(ctx, config, configuredV6, vips6, true)
+		if err != nil {
+			return nil, err
+		}
+		added = append(added, a...)
+	} else {
+		removals, _ := p.ip.Compare6(configuredV6, []string{})
+		if err := p.removeAddresses(removals); err != nil {
+			return nil, err
+		}
+	}
+	return added, nil
+}
+
+// removeAddresses deletes the devices of removals
+func (p *IPVS) removeAddresses(removals []string) error {
+	for _, addr := range removals {
+		p.logger.WithFields(logrus.Fields{"device": "primary", "addr": addr, "action": "deleting"}).Info()
+		if err := p.ip.Del(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyAddresses brings the devices of one family in line with vips
+func (p *IPVS) applyAddresses(ctx context.Context, config *types.ClusterConfig, configured, vips []string, isIP6 bool) ([]string, error) {
+	// get desired VIP addresses. v6 addresses are compared by device name,
+	// since that is all that is known of the configured ones
+	desired, compare := vips, p.ip.Compare4
+	devToAddr := map[string]string{}
+	if isIP6 {
+		desired, compare = []string{}, p.ip.Compare6
+		for _, vip := range vips {
+			device := p.ip.Device(vip, true)
+			desired = append(desired, device)
+			devToAddr[device] = vip
+		}
+	}
+
+	// XXX statsd
+	removals, additions := compare(configured, desired)
+	if err := p.removeAddresses(removals); err != nil {
+		return nil, err
+	}
+	// a VIP held by another director stays off the node, rather than both
+	// answering for it. a probe that fails holds nothing back.
+	var conflicts map[string]string
+	if p.prober != nil && !isIP6 && len(additions) > 0 {
+		var probeErr error
+		if conflicts, probeErr = p.prober.Probe(ctx, additions); probeErr != nil {
+			p.logger.Errorf("dataplane: unable to probe the addresses to add: %v", probeErr)
+		}
+	}
+
+	added := []string{}
+	for _, addr := range additions {
+		if owner, ok := conflicts[addr]; ok {
+			p.logger.WithFields(logrus.Fields{"device": "primary", "addr": addr, "owner": owner, "action": "refused"}).Warn("dataplane: another host answers for the address")
+			p.metrics.AddressConflict(addr)
+			continue
+		}
+		p.logger.WithFields(logrus.Fields{"device": "primary", "addr": addr, "action": "adding"}).Info()
+		add := p.ip.Add
+		if isIP6 {
+			addr, add = devToAddr[addr], p.ip.Add6
+		}
+		if err := add(addr); err != nil {
+			p.logger.Errorf("dataplane: error adding adapter: %s %v", addr, err)
+		}
+		added = append(added, addr)
+	}
+
+	// now iterate across configured and see if we have a non-standard MTU
+	// setting it where applicable
+	var err error
+	if isIP6 {
+		err = p.ip.SetMTU(config.MTUConfig6, true)
+	} else {
+		err = p.ip.SetMTU(config.MTUConfig, false)
+	}
+	if err != nil {
+		p.logger.Errorf("dataplane: error setting MTU on adapters: %v", err)
+	}
+	if err := p.ip.SetReturnRoutes(config.ReturnRoutes(isIP6), isIP6); err != nil {
+		p.logger.Errorf("dataplane: error setting the return routes of VIPs: %v", err)
+	}
+
+	return added, nil
+}
+
+func (p *IPVS) ApplyServices(ctx context.Context, w *watcher.Watcher, node *corev1.Node) error {
+	defer p.bind(ctx)()
+
+	// Manage iptables configuration
+	// only execute with cli flag ipvs-colocation-mode=true
+	// this indicates the director is in a non-isolated load balancer tier
+	if p.colocationMode == ColocationIPTables {
+		if err := p.setIPTables(w, node); err != nil {
+			return fmt.Errorf("unable to configure iptables with error %w", err)
+		}
+		p.logger.Debugf("dataplane: iptables configured")
+	}
+
+	// Manage ipvsadm configuration
+	start := time.Now()
+	err := p.ipvs.SetIPVS(w, w.ClusterConfig, p.logger, p.addrKind())
+	p.metrics.Stage(stats.StageIPVS, time.Since(start))
+	if err != nil {
+		return fmt.Errorf("unable to configure ipvs with error %w", err)
+	}
+	return nil
+}
+
+func (p *IPVS) Stats() (Stats, error) {
+	s := Stats{}
+
+	get := p.ipvs.Get
+	if p.ipv6Only {
+		get = p.ipvs.GetV6
+	}
+	rules, err := get()
+	if err != nil {
+		return s, err
+	}
+	for _, rule := range rules {
+		switch {
+		case strings.HasPrefix(rule, "-A "):
+			s.Services++
+		case strings.HasPrefix(rule, "-a "):
+			s.Backends++
+		}
+	}
+
+	addressesV4, addressesV6, err := p.ip.Get()
+	if err != nil {
+		return s, err
+	}
+	s.Addresses = len(addressesV4)
+	if p.ipv6Only {
+		s.Addresses = len(addressesV6)
+	}
+	return s, nil
+}
+
+// Fingerprint checksums the ravel chains of the nat table and the ipvs rules
+// of the family the plane programs
+func (p *IPVS) Fingerprint() (map[string]string, error) {
+	rules, err := p.iptables.Save()
+	if err != nil {
+		return nil, err
+	}
+
+	get := p.ipvs.Get
+	if p.ipv6Only {
+		get = p.ipvs.GetV6
+	}
+	services, err := get()
+	if err != nil {
+		return nil, err
+	}
+	services = append([]string{}, services...)
+	sort.Strings(services)
+	sum := sha256.Sum256([]byte(strings.Join(services, "\n")))
+
+	return map[string]string{
+		"iptables": iptables.Fingerprint(p.iptables.BaseChain(), rules),
+		"ipvs":     hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+func (p *IPVS) Teardown(ctx context.Context, config *types.ClusterConfig) error {
+	errs := []string{}
+	if err := p.iptables.Flush(); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to flush iptables - %v", err))
+	}
+
+	if err := p.ip.Teardown(ctx, config.Config, config.Config6); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to remove ip addresses - %v", err))
+	}
+
+	if err := p.ipvs.Teardown(ctx); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to remove existing ipvs config - %v", err))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("dataplane: %v", errs)
+}
+
+func (p *IPVS) setIPTables(w *watcher.Watcher, node *corev1.Node) error {
+	if node == nil {
+		return fmt.Errorf("node has not been seen yet")
+	}
+
+	p.logger.Debugf("dataplane: capturing iptables rules")
+	// fetch existing iptables rules
+	start := time.Now()
+	existing, err := p.iptables.Save()
+	p.metrics.Stage(stats.StageIPTablesSave, time.Since(start))
+	if err != nil {
+		return err
+	}
+	p.logger.Debugf("dataplane: got %d existing rules", len(existing))
+
+	p.logger.Debugf("dataplane: generating iptables rules")
+	// i need to determine what percentage of traffic should be sent to the master
+	// for each namespace/service:port that is in the config, i need to know the proportion
+	// of the whole that namespace/service:port represents
+	start = time.Now()
+	generated, err := p.iptables.GenerateRulesForNodeClassic(w, node.Name, w.ClusterConfig, true)
+	p.metrics.Stage(stats.StageIPTablesGenerate, time.Since(start))
+	if err != nil {
+		return err
+	}
+	p.logger.Debugf("dataplane: got %d generated rules", len(generated))
+
+	p.logger.Debugf("dataplane: merging iptables rules")
+
+	start = time.Now()
+	merged, _, err := p.iptables.Merge(generated, existing) // subset, all rules
+	p.metrics.Stage(stats.StageIPTablesMerge, time.Since(start))
+	if err != nil {
+		return err
+	}
+
+	p.logger.Debugf("dataplane: got %d merged rules", len(merged))
+
+	p.logger.Debugf("dataplane: applying updated rules")
+	start = time.Now()
+	err = p.iptables.Restore(merged)
+	p.metrics.Stage(stats.StageIPTablesRestore, time.Since(start))
+	if err != nil {
+		// set our failure gauge for iptables alertmanagers. the change that
+		// failed is also in the rule diff log, when it is enabled
+		p.metrics.IptablesWriteFailure(1)
+		// write erroneous rule set to file to capture later
+		p.logger.Errorf("error applying rules. writing erroneous rule change to /tmp/director-ruleset-err for debugging")
+		writeErr := ioutil.WriteFile("/tmp/director-ruleset-err", createErrorLog(err, iptables.BytesFromRules(merged)), 0644)
+		if writeErr != nil {
+			p.logger.Errorf("error writing to file; logging rules: %s", string(iptables.BytesFromRules(merged)))
+		}
+
+		return err
+	}
+
+	// set gauge to success
+	p.metrics.IptablesWriteFailure(0)
+	return nil
+}
+
+// setSteering writes the mangle rules that mark the traffic of steered clients
+func (p *IPVS) setSteering(config *types.ClusterConfig) error {
+	steering, err := types.SteeringFwmarks(config)
+	if err != nil {
+		return err
+	}
+	if err := p.iptables.SetFwmarks(nil, steering); err != nil {
+		return err
+	}
+	p.steered = len(steering) > 0
+	return nil
+}
+
+// addrKind is the address family of the ipvs rules the director programs
+func (p *IPVS) addrKind() string {
+	if p.ipv6Only {
+		return bgp.AddrKindIPV6
+	}
+	return bgp.AddrKindIPV4
+}
+
+func createErrorLog(err error, rules []byte) []byte {
+	if err == nil {
+		return rules
+	}
+
+	errBytes := []byte(fmt.Sprintf("ipvs restore error: %v\n", err.Error()))
+	return append(errBytes, rules...)
+}
@@ -0,0 +1,154 @@
+package dataplane
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+func TestIPVSPlane(t *testing.T) {
+	ipvs := system.NewFakeIPVS()
+	ip := system.NewFakeIP()
+	ipt := iptables.NewFakeRuleApplier("RAVEL", true, logrus.New())
+	plane := NewIPVS(ipvs, ip, ipt, system.NewFakeSysctl(nil), ColocationDisabled, false, "test", logrus.New())
+
+	if err := plane.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if ipt.Flushes != 1 {
+		t.Fatalf("expected init to flush iptables, saw %d flushes", ipt.Flushes)
+	}
+
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {
+				"80": &types.ServiceDef{Namespace: "syseng", Service: "mod-super8", PortName: "http", TCPEnabled: true},
+			},
+		},
+	}
+	added, err := plane.ApplyAddresses(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0] != "10.54.213.165" {
+		t.Fatalf("expected the VIP to be added, got %v", added)
+	}
+	if added, _ := plane.ApplyAddresses(context.Background(), config); len(added) != 0 {
+		t.Fatalf("expected nothing to be added again, got %v", added)
+	}
+
+	ipvs.Set([]string{
+		"-A -t 10.54.213.165:80 -s wrr",
+		"-a -t 10.54.213.165:80 -r 10.131.153.76:80 -g -w 1",
+		"-a -t 10.54.213.165:80 -r 10.131.153.77:80 -g -w 1",
+	})
+	stats, err := plane.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (Stats{Services: 1, Backends: 2, Addresses: 1}) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	if err := plane.Teardown(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if ipvs.Teardowns != 1 || ipt.Flushes != 2 {
+		t.Fatalf("expected teardown to clear ipvs and iptables")
+	}
+}
+
+type fakeProber map[string]string
+
+func (f fakeProber) Probe(ctx context.Context, addrs []string) (map[string]string, error) {
+	return f, nil
+}
+
+func TestIPVSPlaneAddressConflict(t *testing.T) {
+	ip := system.NewFakeIP()
+	plane := NewIPVS(system.NewFakeIPVS(), ip, iptables.NewFakeRuleApplier("RAVEL", true, logrus.New()), system.NewFakeSysctl(nil), ColocationDisabled, false, "test", logrus.New())
+	prober := fakeProber{"10.54.213.166": "02:42:ac:11:00:09"}
+	plane.SetAddressProber(prober)
+
+	def := &types.ServiceDef{Namespace: "syseng", Service: "mod-super8", PortName: "http", TCPEnabled: true}
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {"80": def},
+			"10.54.213.166": {"80": def},
+		},
+	}
+	added, err := plane.ApplyAddresses(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0] != "10.54.213.165" {
+		t.Fatalf("expected only the VIP no other host answers for to be added, got %v", added)
+	}
+
+	// the VIP is added once the other host lets go of it
+	delete(prober, "10.54.213.166")
+	if added, _ := plane.ApplyAddresses(context.Background(), config); len(added) != 1 || added[0] != "10.54.213.166" {
+		t.Fatalf("expected the VIP to be added, got %v", added)
+	}
+	if len(ip.Devices) != 2 {
+		t.Fatalf("expected both VIPs on the node, got %v", ip.Devices)
+	}
+}
+
+func TestIPVSPlaneDualStackAddresses(t *testing.T) {
+	ip := system.NewFakeIP()
+	plane := NewIPVS(system.NewFakeIPVS(), ip, iptables.NewFakeRuleApplier("RAVEL", true, logrus.New()), system.NewFakeSysctl(nil), ColocationDisabled, false, "test", logrus.New())
+
+	def := &types.ServiceDef{Namespace: "syseng", Service: "mod-super8", PortName: "http", TCPEnabled: true}
+	config := &types.ClusterConfig{
+		Config:  map[types.ServiceIP]types.PortMap{"10.54.213.165": {"80": def}},
+		Config6: map[types.ServiceIP]types.PortMap{"2001:db8::165": {"80": def}},
+	}
+
+	// without dual-stack only the v4 VIPs are programmed
+	if vips4, vips6 := VIPs(config, false); len(vips4) != 1 || len(vips6) != 0 {
+		t.Fatalf("expected only the v4 VIP. have %v %v", vips4, vips6)
+	}
+	if added, err := plane.ApplyAddresses(context.Background(), config); err != nil || len(added) != 1 || added[0] != "10.54.213.165" {
+		t.Fatalf("expected only the v4 VIP to be added. have %v %v", added, err)
+	}
+
+	// with it, both families are
+	config.DualStack = true
+	if vips4, vips6 := VIPs(config, false); len(vips4) != 1 || len(vips6) != 1 || vips6[0] != "2001:db8::165" {
+		t.Fatalf("expected both VIPs. have %v %v", vips4, vips6)
+	}
+	if added, err := plane.ApplyAddresses(context.Background(), config); err != nil || len(added) != 1 || added[0] != "2001:db8::165" {
+		t.Fatalf("expected the v6 VIP to be added. have %v %v", added, err)
+	}
+	if len(ip.Devices) != 2 {
+		t.Fatalf("expected both VIPs on the node. have %v", ip.Devices)
+	}
+
+	// and a v6 VIP removed from Config6 is torn down
+	config.Config6 = map[types.ServiceIP]types.PortMap{}
+	if _, err := plane.ApplyAddresses(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if len(ip.Devices) != 1 || ip.Devices["10_54_213_165"] == "" {
+		t.Fatalf("expected only the v4 VIP on the node. have %v", ip.Devices)
+	}
+
+	// as are the v6 VIPs of a config that is no longer dual-stack
+	config.Config6 = map[types.ServiceIP]types.PortMap{"2001:db8::165": {"80": def}}
+	if added, err := plane.ApplyAddresses(context.Background(), config); err != nil || len(added) != 1 {
+		t.Fatalf("expected the v6 VIP to be added again. have %v %v", added, err)
+	}
+	config.DualStack = false
+	if _, err := plane.ApplyAddresses(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if len(ip.Devices) != 1 || ip.Devices["10_54_213_165"] == "" {
+		t.Fatalf("expected the v6 VIP to be removed with dual-stack. have %v", ip.Devices)
+	}
+}
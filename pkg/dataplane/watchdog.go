@@ -0,0 +1,175 @@
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fingerprinter is a DataPlane that checksums the kernel state it owns, by
+// kind such as iptables or ipvs, so that a Watchdog notices when something
+// else changes it
+type Fingerprinter interface {
+	Fingerprint() (map[string]string, error)
+}
+
+// EventRecorder records a kubernetes event on a node
+type EventRecorder interface {
+	NodeEvent(node, eventType, reason, message string) error
+}
+
+// tamperMetrics records the changes a Watchdog found
+type tamperMetrics interface {
+	KernelTampered(what string)
+}
+
+// Watchdog notices changes made between reconciles to the kernel state a plane
+// owns, such as an operator running iptables -F. The director takes a
+// baseline fingerprint after every apply, and the watchdog compares the kernel
+// against it every interval. A change is recorded as a metric and an event on
+// the node, and repaired by a reconcile. The kernel is polled, not watched for
+// netlink or netfilter events, so a change stands until the next check finds
+// it, an interval at most.
+type Watchdog struct {
+	sync.Mutex
+
+	plane Fingerprinter
+	node  string
+
+	// baseline is the fingerprint after the last apply, nil while there is
+	// none to compare against. epoch changes with every apply, so that a
+	// check that read the kernel mid-apply is discarded.
+	baseline map[string]string
+	epoch    uint64
+
+	events  EventRecorder
+	metrics tamperMetrics
+	logger  logrus.FieldLogger
+}
+
+// NewWatchdog creates a Watchdog of the kernel state of plane on node. events
+// may be nil.
+func NewWatchdog(plane Fingerprinter, node string, events EventRecorder, metrics tamperMetrics, logger logrus.FieldLogger) *Watchdog {
+	return &Watchdog{plane: plane, node: node, events: events, metrics: metrics, logger: logger}
+}
+
+// Applying drops the baseline before the plane is changed. A nil Watchdog
+// does nothing, as do its other methods.
+func (w *Watchdog) Applying() {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.baseline = nil
+	w.epoch++
+}
+
+// Applied takes the baseline after the plane was changed. With keep, a
+// baseline already taken is kept, as after a reconcile that found parity and
+// changed nothing.
+func (w *Watchdog) Applied(keep bool) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	epoch := w.epoch
+	if keep && w.baseline != nil {
+		w.Unlock()
+		return
+	}
+	w.Unlock()
+
+	fingerprint, err := w.plane.Fingerprint()
+	if err != nil {
+		w.logger.Warnf("watchdog: unable to fingerprint the kernel state. %v", err)
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	if w.epoch == epoch {
+		w.baseline = fingerprint
+	}
+}
+
+// Check compares the kernel state against the baseline, and returns what of
+// it changed. A change drops the baseline, so that it is reported once and
+// not again until the next apply.
+func (w *Watchdog) Check() ([]string, error) {
+	w.Lock()
+	baseline, epoch := w.baseline, w.epoch
+	w.Unlock()
+	if baseline == nil {
+		return nil, nil
+	}
+
+	fingerprint, err := w.plane.Fingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if w.epoch != epoch {
+		// an apply began while the kernel was read
+		return nil, nil
+	}
+	changed := []string{}
+	for what, sum := range baseline {
+		if fingerprint[what] != sum {
+			changed = append(changed, what)
+		}
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	sort.Strings(changed)
+	w.baseline = nil
+	w.epoch++
+	return changed, nil
+}
+
+// Run checks the kernel state every interval until ctx is done, and calls
+// repair after recording every change it finds
+func (w *Watchdog) Run(ctx context.Context, interval time.Duration, repair func()) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+
+		changed, err := w.Check()
+		if err != nil {
+			w.logger.Warnf("watchdog: unable to fingerprint the kernel state. %v", err)
+			continue
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		w.tampered(changed)
+		repair()
+	}
+}
+
+// tampered records a change to the kernel state made outside of ravel
+func (w *Watchdog) tampered(changed []string) {
+	message := fmt.Sprintf("the %s state ravel owns was changed outside of ravel. repairing it", strings.Join(changed, " and "))
+	w.logger.Errorf("watchdog: %s", message)
+	for _, what := range changed {
+		w.metrics.KernelTampered(what)
+	}
+	if w.events == nil {
+		return
+	}
+	if err := w.events.NodeEvent(w.node, "Warning", "KernelStateTampered", message); err != nil {
+		w.logger.Warnf("watchdog: unable to record an event on node %s. %v", w.node, err)
+	}
+}
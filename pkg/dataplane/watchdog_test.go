@@ -0,0 +1,96 @@
+package dataplane
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+type tamperCounts map[string]int
+
+func (c tamperCounts) KernelTampered(what string) {
+	c[what]++
+}
+
+type nodeEvents []string
+
+func (e *nodeEvents) NodeEvent(node, eventType, reason, message string) error {
+	*e = append(*e, strings.Join([]string{node, eventType, reason}, " "))
+	return nil
+}
+
+func TestWatchdog(t *testing.T) {
+	ipvs := system.NewFakeIPVS()
+	ipt := iptables.NewFakeRuleApplier("RAVEL", true, logrus.New())
+	plane := NewIPVS(ipvs, system.NewFakeIP(), ipt, system.NewFakeSysctl(nil), ColocationIPTables, false, "test", logrus.New())
+	ipvs.Set([]string{
+		"-A -t 10.54.213.165:80 -s wrr",
+		"-a -t 10.54.213.165:80 -r 10.131.153.76:80 -g -w 1",
+	})
+	ipt.Table["PREROUTING"].Rules = []string{"-A PREROUTING -j RAVEL"}
+	ipt.Table["RAVEL"] = &iptables.RuleSet{ChainRule: ":RAVEL - [0:0]", Rules: []string{"-A RAVEL -d 10.54.213.165/32 -j RAVEL-SVC-A"}}
+
+	counts, events := tamperCounts{}, &nodeEvents{}
+	w := NewWatchdog(plane, "director-0", events, counts, logrus.New())
+
+	// nothing is compared before the first apply
+	if changed, err := w.Check(); err != nil || changed != nil {
+		t.Fatalf("expected no check without a baseline. saw %v %v", changed, err)
+	}
+	w.Applying()
+	w.Applied(false)
+	if changed, err := w.Check(); err != nil || changed != nil {
+		t.Fatalf("expected no change. saw %v %v", changed, err)
+	}
+
+	// someone runs iptables -F and removes a backend
+	ipt.Table["RAVEL"].Rules = nil
+	ipvs.Set([]string{"-d -t 10.54.213.165:80 -r 10.131.153.76:80"})
+	changed, err := w.Check()
+	if err != nil || !reflect.DeepEqual(changed, []string{"iptables", "ipvs"}) {
+		t.Fatalf("expected iptables and ipvs to have changed. saw %v %v", changed, err)
+	}
+	// reported once, until the repair takes a new baseline
+	if changed, _ := w.Check(); changed != nil {
+		t.Fatalf("expected the change to be reported once. saw %v", changed)
+	}
+
+	// a reconcile that found parity keeps the baseline it has
+	w.Applied(false)
+	ipvs.Set([]string{"-A -t 10.54.213.165:80 -s rr"})
+	w.Applied(true)
+	if changed, _ := w.Check(); !reflect.DeepEqual(changed, []string{"ipvs"}) {
+		t.Fatalf("expected ipvs to have changed. saw %v", changed)
+	}
+
+	// Run records the change and repairs it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.Applied(false)
+	ipt.Table["PREROUTING"].Rules = nil
+	repaired := make(chan struct{}, 1)
+	go w.Run(ctx, time.Millisecond, func() { repaired <- struct{}{} })
+	select {
+	case <-repaired:
+	case <-time.After(time.Second):
+		t.Fatal("expected the change to be repaired")
+	}
+	if counts["iptables"] != 1 || counts["ipvs"] != 0 {
+		t.Fatalf("expected a tamper of iptables to be recorded. saw %v", counts)
+	}
+	if !reflect.DeepEqual([]string(*events), []string{"director-0 Warning KernelStateTampered"}) {
+		t.Fatalf("expected a warning event on the node. saw %v", *events)
+	}
+
+	// a nil watchdog, as a director without one has, does nothing
+	var none *Watchdog
+	none.Applying()
+	none.Applied(false)
+}
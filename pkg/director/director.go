@@ -3,41 +3,134 @@ package director
 import (
 	"context"
 	"fmt"
-	"github.com/Comcast/Ravel/pkg/bgp"
-	"io/ioutil"
+	"github.com/Comcast/Ravel/pkg/announce"
+	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/dataplane"
 	"github.com/Comcast/Ravel/pkg/stats"
 	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
 	"github.com/Comcast/Ravel/pkg/watcher"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 )
 
-const (
-	colocationModeDisabled = "disabled"
-	colocationModeIPTables = "iptables"
-	colocationModeIPVS     = "ipvs"
-)
-
 // TODO: instant startup
 
-// A director is the control flow for kube2ipvs. It can only be started once, and it can only be stopped once.
+// A director is the control flow for kube2ipvs. It can be stopped and started
+// again any number of times, but not started twice without a stop in between.
 type Director interface {
 	Start() error
 	Stop() error
+
+	// Adopt makes the next Start keep the kernel state as it is, rather than
+	// clearing what an earlier run left behind, because a predecessor handed
+	// the node off
+	Adopt()
+
+	// Release stops the director like Stop, but never cleans up, so that a
+	// successor that adopts the node serves from the kernel state as it is
+	Release() error
+
+	// Reconcile applies the current configuration once, outside of the periodic loop
+	Reconcile(force bool) error
+
+	// Err returns the first error, or panic, of the director's goroutines. A
+	// goroutine that fails is restarted, so an error here need not mean the
+	// director has stopped working.
+	Err() error
+
+	// SetOverrides makes every apply, and the announcements, use the cluster
+	// config and nodes with the operator's overrides made. Call it before Start.
+	SetOverrides(o *types.Overrides)
+
+	// RequestReconcile queues a reconcile without a parity check on the
+	// director's periodic loop, so that it doesn't race the loop's own
+	RequestReconcile()
+
+	// State returns what the director is doing, for the control API
+	State() State
+
+	// SetWatchdog checks every interval that nothing else changed the iptables
+	// rules and ipvs entries the director applied, and reconciles at once when
+	// something did. Call it before Start.
+	SetWatchdog(interval time.Duration)
+
+	// SetLinkRepair reconciles at once when links reports that an address of a
+	// VIP was removed, and reconciles and announces the VIPs again when device
+	// comes back up, rather than waiting for the next parity check. When device
+	// is a bond or a team, the VIPs are announced again as it fails over too.
+	// Call it before Start.
+	SetLinkRepair(links LinkEvents, device string)
+}
+
+// State is what a director is doing
+type State struct {
+	Node              string   `json:"node"`
+	Started           bool     `json:"started"`
+	AppliedGeneration uint64   `json:"appliedGeneration"`
+	VIPs              []string `json:"vips"`
+	VIPs6             []string `json:"vips6"`
+	// Frozen is the freeze window in effect at the last apply
+	Frozen string `json:"frozen,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// releaseWait is how long Release waits for a reconcile in progress to finish
+const releaseWait = 10 * time.Second
+
+// DefaultRestartBackoff is the wait before a failed director goroutine is
+// restarted when Supervision doesn't set one
+var DefaultRestartBackoff = util.Backoff{Initial: time.Second, Max: time.Minute}
+
+// DefaultBreakerBackoff is the wait between the retries of an apply that keeps
+// failing when Supervision doesn't set one
+var DefaultBreakerBackoff = util.Backoff{Initial: 10 * time.Second, Max: 5 * time.Minute}
+
+// Supervision is how the director detects and recovers from failures of its
+// goroutines. Any goroutine that panics is restarted after Backoff. The
+// periodic apply loop also fails after MaxApplyFailures consecutive failed
+// applies, and the watch sync when the watcher has gone WatchStaleAfter
+// without an event, which reconnects the watches. Zero disables either check.
+//
+// After BreakAfterApplyFailures consecutive failed applies, the periodic loop
+// only retries after BreakerBackoff rather than on every tick, and the node
+// reports unhealthy until an apply succeeds. Zero retries every tick.
+//
+// Budget bounds how long each stage of a reconcile may run.
+type Supervision struct {
+	Backoff          util.Backoff
+	MaxApplyFailures int
+	WatchStaleAfter  time.Duration
+
+	BreakAfterApplyFailures int
+	BreakerBackoff          util.Backoff
+
+	Budget Budget
+}
+
+// Budget is how long each stage of a reconcile may run before the commands it
+// started are killed and the reconcile fails. A stage with no budget is only
+// bounded by the timeouts of its commands.
+type Budget struct {
+	Parity    time.Duration
+	Addresses time.Duration
+	Services  time.Duration
 }
 
 type director struct {
 	sync.Mutex
 
-	// start/stop and backpropagation of internal errors
+	// start/stop and backpropagation of internal errors. group holds the
+	// goroutines started by the last Start
 	isStarted bool
-	doneChan  chan struct{}
-	err       error
+	group     *util.RunGroup
 
 	// declarative state - this is what ought to be configured
 	nodeName string
@@ -46,118 +139,238 @@ type director struct {
 	// config   *types.ClusterConfig
 
 	// inbound data sources
-	nodeChan chan []*corev1.Node
+	nodes *nodeMailbox
 	// configChan chan *types.ClusterConfig
 	ctxWatch context.Context
 	cxlWatch context.CancelFunc
 
 	reconfiguring bool
+
+	// appliedGeneration is the generation of the cluster config last applied or found in parity
+	appliedGeneration uint64
+	// appliedConfig is the cluster config last applied or found in parity
+	appliedConfig *types.ClusterConfig
+	// cachedGeneration is the generation last written to the config cache
+	cachedGeneration uint64
+	// convergedAt is the EventTime of the cluster config last applied or found
+	// in parity, see converged
+	convergedAt time.Time
 	// lastInboundUpdate time.Time
 	// lastReconfigure time.Time
 
-	watcher  *watcher.Watcher
-	ipvs     *system.IPVS
-	ip       *system.IP
-	iptables *iptables.IPTables
+	watcher *watcher.Watcher
+
+	// plane programs the VIPs into the node
+	plane dataplane.DataPlane
+
+	// announcer tells the network this director owns its VIPs
+	announcer *announce.Set
 
 	// cli flag default false
-	doCleanup         bool
-	colocationMode    string
-	forcedReconfigure bool
+	doCleanup bool
+
+	// adopt skips clearing the kernel state on the next Start, see Adopt
+	adopt bool
+
+	// ipv6Only programs only the v6 VIPs in Config6 and announces them with
+	// ndp, for clusters with no IPv4 at all
+	ipv6Only bool
+
+	// forcedReconfigureInterval is how often configuration is reapplied without
+	// a parity check. zero disables forced reconfiguration
+	forcedReconfigureInterval time.Duration
 	// ipvsWeightOverride bool
 
+	// freeze holds back configuration changes other than removals during its
+	// windows. frozen is the window in effect at the last apply, if any
+	freeze util.FreezeSchedule
+	frozen *util.FreezeWindow
+
+	supervision Supervision
+
+	// watchdog, when set, checks every watchdogInterval that the kernel state
+	// applied wasn't changed by anything else
+	watchdog         *dataplane.Watchdog
+	watchdogInterval time.Duration
+
+	// links, when set, reports the changes to the links and addresses of the
+	// node, see SetLinkRepair. reannounce holds a pending announcement of
+	// every VIP, which the arps loop makes.
+	links      LinkEvents
+	linkDevice string
+	reannounce chan struct{}
+
+	// breaker holds back the periodic applies once they keep failing. It
+	// outlives restarts of the loop, so that a restart doesn't retry hot.
+	breaker util.Breaker
+
+	// applying is set, atomically, while a reconcile runs, so that one that
+	// would overlap it, such as one the control api runs, is skipped
+	applying int32
+
+	// overrides are the operator's changes to the cluster config, see
+	// SetOverrides. reconcileRequests holds a pending RequestReconcile
+	overrides         *types.Overrides
+	reconcileRequests chan struct{}
+
 	// boilerplate.  when this context is canceled, the director must cease all activties
 	ctx     context.Context
 	logger  logrus.FieldLogger
 	metrics *stats.WorkerStateMetrics
 }
 
-func NewDirector(ctx context.Context, nodeName, configKey string, cleanup bool, watcher *watcher.Watcher, ipvs *system.IPVS, ip *system.IP, ipt *iptables.IPTables, colocationMode string, forcedReconfigure bool) (Director, error) {
+// NewDirector creates a director that programs its VIPs with plane. ip is only
+// used to announce them when announcer is nil.
+func NewDirector(ctx context.Context, nodeName, configKey string, cleanup bool, watcher *watcher.Watcher, plane dataplane.DataPlane, ip system.AddressManager, ipv6Only bool, forcedReconfigureInterval time.Duration, freeze util.FreezeSchedule, announcer *announce.Set, supervision Supervision) (Director, error) {
+	// VIPs are announced with gratuitous arp, or neighbor advertisements when
+	// there is no IPv4, unless the caller selects otherwise
+	if announcer == nil {
+		var err error
+		if ipv6Only {
+			announcer, err = announce.NewSet("", announce.NDP, logrus.StandardLogger(), announce.NewNDP(ip))
+		} else {
+			announcer, err = announce.NewSet(announce.ARP, announce.NDP, logrus.StandardLogger(), announce.NewARP(ip), announce.NewNDP(ip))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if supervision.Backoff.Max == 0 {
+		supervision.Backoff = DefaultRestartBackoff
+	}
+	if supervision.BreakerBackoff.Max == 0 {
+		supervision.BreakerBackoff = DefaultBreakerBackoff
+	}
 	d := &director{
 		watcher:  watcher,
-		ipvs:     ipvs,
-		ip:       ip,
+		plane:    plane,
 		nodeName: nodeName,
 
-		iptables: ipt,
+		announcer: announcer,
 
-		doneChan: make(chan struct{}),
-		nodeChan: make(chan []*corev1.Node, 1),
+		group: util.NewRunGroup(),
+		nodes: newNodeMailbox(),
 		// configChan: make(chan *types.ClusterConfig, 1),
 
-		doCleanup:         cleanup,
-		ctx:               ctx,
-		logger:            logrus.StandardLogger(),
-		metrics:           stats.NewWorkerStateMetrics(stats.KindIpvsMaster, configKey),
-		colocationMode:    colocationMode,
-		forcedReconfigure: forcedReconfigure,
+		doCleanup:                 cleanup,
+		ctx:                       ctx,
+		logger:                    logrus.StandardLogger(),
+		metrics:                   stats.NewWorkerStateMetrics(stats.KindIpvsMaster, configKey),
+		ipv6Only:                  ipv6Only,
+		forcedReconfigureInterval: forcedReconfigureInterval,
+		freeze:                    freeze,
+		supervision:               supervision,
+		breaker:                   util.Breaker{Threshold: supervision.BreakAfterApplyFailures, Backoff: supervision.BreakerBackoff},
+		reconcileRequests:         make(chan struct{}, 1),
+		reannounce:                make(chan struct{}, 1),
 	}
 
 	return d, nil
 }
 
 func (d *director) Start() error {
+	if err := d.beginTransition("Start"); err != nil {
+		return err
+	}
+	defer d.setReconfiguring(false)
 	if d.isStarted {
-		return fmt.Errorf("director: director has already been started. a director instance can only be started once")
+		return fmt.Errorf("director: director has already been started. stop it before starting it again")
 	}
-	if d.reconfiguring {
-		return fmt.Errorf("director: unable to Start. reconfiguration already in progress")
+	if d.group != nil {
+		if running := d.group.Running(); len(running) > 0 {
+			return fmt.Errorf("director: unable to Start. %v from the previous run have not exited", running)
+		}
 	}
-	d.setReconfiguring(true)
-	defer func() { d.setReconfiguring(false) }()
 	d.logger.Debugf("director: start called")
 
-	// init
-	d.isStarted = true
-	d.doneChan = make(chan struct{})
-
-	// set arp rules
-	err := d.ip.SetARP()
-	if err != nil {
-		return fmt.Errorf("director: cleanup - failed to clear arp rules - %v", err)
-	}
+	// init. a restarted director begins from scratch: the goroutines, contexts
+	// and node mailbox of the previous run are replaced, and what it applied is
+	// forgotten, since a stop with cleanup tears it down
+	d.group = util.NewRunGroup()
+	d.nodes = newNodeMailbox()
+	d.Lock()
+	d.node = nil
+	d.appliedGeneration = 0
+	d.appliedConfig = nil
+	d.frozen = nil
+	adopt := d.adopt
+	d.adopt = false
+	d.Unlock()
 
-	if d.colocationMode != colocationModeIPTables {
-		// cleanup any lingering iptables rules
-		if err := d.iptables.Flush(); err != nil {
-			return fmt.Errorf("director: cleanup - failed to flush iptables - %v", err)
-		}
+	// clear the arp rules and iptables left behind by an earlier run, unless
+	// they were handed off to this one
+	if adopt {
+		d.logger.Info("director: adopting the kernel state handed off by the previous process")
+	} else if err := d.plane.Init(); err != nil {
+		return fmt.Errorf("director: cleanup - %v", err)
 	}
-	// If director is co-located with a realserver, the realserver
-	// will deal with setting up new iptables rules
 
 	// instantitate a watcher and load this watcher instance into self
 	ctxWatch, cxlWatch := context.WithCancel(d.ctx)
 	d.ctxWatch = ctxWatch
 	d.cxlWatch = cxlWatch
+	d.isStarted = true
 
 	// register the watcher for both nodes and the configmap
 	// d.watcher.Nodes(ctxWatch, "director-nodes", d.nodeChan)
 	// d.watcher.ConfigMap(ctxWatch, "director-configmap", d.configChan)
 
-	// perform periodic configuration activities
-	go d.periodic()
-	go d.watches()
-	go d.arps()
+	// perform periodic configuration activities. each goroutine is handed the
+	// context of this run, so that none outlives the Stop that ends it, and is
+	// restarted with backoff if it fails
+	d.supervise(ctxWatch, "periodic", d.periodic)
+	d.supervise(ctxWatch, "watches", d.watches)
+	d.supervise(ctxWatch, "arps", d.arps)
+	if d.watchdog != nil {
+		d.supervise(ctxWatch, "watchdog", func(ctx context.Context) error {
+			return d.watchdog.Run(ctx, d.watchdogInterval, d.RequestReconcile)
+		})
+	}
+	if d.links != nil {
+		d.supervise(ctxWatch, "links", d.watchLinks)
+	}
 
-	// notify d.nodeChan and d.configChan like registering watchers
+	// notify d.nodes and d.configChan like registering watchers
 	// with the watcher.Watcher used to do
-	go d.causePeriodicWatcherSync()
+	d.supervise(ctxWatch, "causePeriodicWatcherSync", d.causePeriodicWatcherSync)
 
 	d.logger.Debugf("director: setup complete. director is running")
 	return nil
 }
 
+// supervise runs fn in the director's run group, restarting it after the
+// supervision backoff whenever it returns an error or panics
+func (d *director) supervise(ctxWatch context.Context, name string, fn func(context.Context) error) {
+	d.group.GoSupervised(ctxWatch, name, d.supervision.Backoff, func() error {
+		return fn(ctxWatch)
+	}, func(err error, failures int) {
+		d.logger.Errorf("director: %v. restarting it in %v after %d consecutive failures", err, d.supervision.Backoff.Next(failures), failures)
+		d.metrics.SubsystemFailed(name, failures)
+	})
+}
+
 // causePeriodicWatcherSync patches the existing director logic into the watcher by
 // periodically sending the latest information from the watcher to the old notification
 // channels for changes the director was built with.
-func (d *director) causePeriodicWatcherSync() {
+func (d *director) causePeriodicWatcherSync(ctxWatch context.Context) error {
 	t := time.NewTicker(time.Second * 3)
 	defer t.Stop()
 	for {
-		log.Debugln("director: causePeriodicWatcherSync: sending", len(d.watcher.Nodes), "to d.nodeChan")
-		d.nodeChan <- d.watcher.Nodes
-		<-t.C
+		if d.supervision.WatchStaleAfter > 0 {
+			if age := time.Since(d.watcher.LastEvent()); age > d.supervision.WatchStaleAfter {
+				d.watcher.Disconnect()
+				return fmt.Errorf("no watch events for %v. reconnecting watches", age.Round(time.Second))
+			}
+		}
+
+		_, nodes := d.watcher.Current()
+		log.Debugln("director: causePeriodicWatcherSync: sending", len(nodes), "to d.nodes")
+		d.nodes.Put(nodes)
+		select {
+		case <-t.C:
+		case <-ctxWatch.Done():
+			return nil
+		}
 		// log.Debugln("director: causePeriodicWatcherSync: sending", len(d.watcher.ClusterConfig.Config), "to d.configChan")
 		// // d.configChan <- d.watcher.ClusterConfig
 		// <-t.C
@@ -170,45 +383,59 @@ func (d *director) causePeriodicWatcherSync() {
 // This function cannot clean up interface configurations, as the interface configurations
 // rely on the presence of a config.
 func (d *director) cleanup(ctx context.Context) error {
-	errs := []string{}
-	if err := d.iptables.Flush(); err != nil {
-		errs = append(errs, fmt.Sprintf("cleanup - failed to flush iptables - %v", err))
+	if err := d.plane.Teardown(ctx, d.watcher.ClusterConfig); err != nil {
+		return fmt.Errorf("director: cleanup - %v", err)
 	}
+	return nil
+}
 
-	if err := d.ip.Teardown(ctx, d.watcher.ClusterConfig.Config, d.watcher.ClusterConfig.Config6); err != nil {
-		errs = append(errs, fmt.Sprintf("cleanup - failed to remove ip addresses - %v", err))
-	}
+func (d *director) Stop() error {
+	return d.stop("Stop", d.doCleanup, 0)
+}
 
-	if err := d.ipvs.Teardown(ctx); err != nil {
-		errs = append(errs, fmt.Sprintf("cleanup - failed to remove existing ipvs config - %v", err))
-	}
+// Release waits out a reconcile in progress for up to releaseWait, as the
+// successor asking for the node can't start until it returns
+func (d *director) Release() error {
+	return d.stop("Release", false, releaseWait)
+}
 
-	if len(errs) == 0 {
-		return nil
-	}
-	return fmt.Errorf("director: %v", errs)
+func (d *director) Adopt() {
+	d.Lock()
+	defer d.Unlock()
+	d.adopt = true
 }
 
-func (d *director) Stop() error {
-	if d.reconfiguring {
-		return fmt.Errorf("director: unable to Stop. reconfiguration already in progress")
+// stop ends the director's goroutines, and tears down what it programmed when
+// cleanup is set. A reconcile in progress is waited out for up to wait.
+func (d *director) stop(op string, cleanup bool, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		err := d.beginTransition(op)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	defer d.setReconfiguring(false)
+	if !d.isStarted {
+		return fmt.Errorf("director: unable to %s. director is not running", op)
 	}
-	d.setReconfiguring(true)
-	defer func() { d.setReconfiguring(false) }()
 
 	// kill the watcher
 	d.cxlWatch()
 	d.logger.Info("director: blocking until periodic tasks complete")
-	select {
-	case <-d.doneChan:
-	case <-time.After(5000 * time.Millisecond):
+	if running := d.group.Wait(5000 * time.Millisecond); len(running) > 0 {
+		d.logger.Warnf("director: gave up waiting for %v to exit", running)
 	}
 
 	// remove config VIP addresses from the compute interface
 	ctxDestroy, cxl := context.WithTimeout(context.Background(), 5000*time.Millisecond)
 	defer cxl()
 
-	if d.doCleanup {
+	if cleanup {
 		err := d.cleanup(ctxDestroy)
 		d.isStarted = false
 		return err
@@ -219,10 +446,10 @@ func (d *director) Stop() error {
 }
 
 func (d *director) Err() error {
-	return d.err
+	return d.group.Err()
 }
 
-func (d *director) watches() {
+func (d *director) watches(ctxWatch context.Context) error {
 	// XXX This things needs to actually get the list of nodes when a node update occurs
 	// XXX It also needs to get all of the endpoints
 	// XXX this thing needs a nonblocking, continuous read on the nodes channel and a
@@ -230,15 +457,19 @@ func (d *director) watches() {
 	for {
 		select {
 
-		case nodes := <-d.nodeChan:
-			// d.logger.Debugf("director: watches: ", len(nodes), "nodes received from d.nodeChan")
+		case <-d.nodes.Ready():
+			nodes, ok := d.nodes.Take()
+			if !ok {
+				continue
+			}
+			// d.logger.Debugf("director: watches: ", len(nodes), "nodes received from d.nodes")
 			// if types.NodesEqual(d.watcher.Nodes, nodes) {
 			// 	d.logger.Debug("NODES ARE EQUAL")
 			// 	d.metrics.NodeUpdate("noop")
 			// 	continue
 			// }
 			// d.metrics.NodeUpdate("updated")
-			// d.logger.Debugf("director: watches: ", len(nodes), "nodes set from d.nodeChan")
+			// d.logger.Debugf("director: watches: ", len(nodes), "nodes set from d.nodes")
 			// d.nodes = nodes
 
 			for _, node := range nodes {
@@ -261,16 +492,16 @@ func (d *director) watches() {
 		// 	// Administrative
 		case <-d.ctx.Done():
 			d.logger.Debugf("director: parent context closed. exiting run loop")
-			return
-		case <-d.ctxWatch.Done():
+			return nil
+		case <-ctxWatch.Done():
 			d.logger.Debugf("director: watch context closed. exiting run loop")
-			return
+			return nil
 		}
 
 	}
 }
 
-func (d *director) arps() {
+func (d *director) arps(ctxWatch context.Context) error {
 	arpInterval := 2000 * time.Millisecond
 	gratuitousArp := time.NewTicker(arpInterval)
 	defer gratuitousArp.Stop()
@@ -281,60 +512,135 @@ func (d *director) arps() {
 		case <-gratuitousArp.C:
 			// every five minutes or so, walk the whole set of VIPs and make the call to
 			// gratuitous arp.
-			if d.watcher.ClusterConfig == nil || d.watcher.Nodes == nil {
-				d.logger.Debugf("director: configs are nil. skipping arp clear")
-				continue
-			}
-			ips := []string{}
-			d.Lock()
-			for ip := range d.watcher.ClusterConfig.Config {
-				ips = append(ips, string(ip))
-			}
-			d.Unlock()
-			for _, ip := range ips {
-				if err := d.ip.AdvertiseMacAddress(ip); err != nil {
-					d.metrics.ArpingFailure(err)
-					d.logger.Error(err)
-				}
-			}
+			d.announceAll()
+
+		case <-d.reannounce:
+			d.logger.Info("director: announcing every VIP again after a link change")
+			d.announceAll()
 
 		case <-d.ctx.Done():
 			d.logger.Debugf("director: parent context closed. exiting run loop")
-			return
-		case <-d.ctxWatch.Done():
+			return nil
+		case <-ctxWatch.Done():
 			d.logger.Debugf("director: watch context closed. exiting run loop")
-			return
+			return nil
 		}
 	}
 }
 
-func (d *director) periodic() {
+// announceAll refreshes the announcement of every VIP of the current config
+func (d *director) announceAll() {
+	if config, nodes := d.watcher.Current(); config == nil || nodes == nil {
+		d.logger.Debugf("director: configs are nil. skipping arp clear")
+		return
+	}
+	config := d.overrides.Apply(d.watcher.Snapshot().ClusterConfig)
+	vips4, vips6 := d.vips(config)
+	d.announce(vips4, vips6, config.Announce)
+}
+
+func (d *director) periodic(ctxWatch context.Context) error {
 	// reconfig ipvs
 	checkInterval := time.Second * 2
 	t := time.NewTicker(checkInterval)
 	d.logger.Infof("director: starting periodic ticker. config check %v", checkInterval)
 
-	forcedReconfigureInterval := time.Second * 60
-	forceReconfigure := time.NewTicker(forcedReconfigureInterval)
+	// forced reconfigures are staggered by node name so that directors started
+	// together don't all rewrite their rules at the same moment
+	forceReconfigure := util.NewStaggeredTicker(d.forcedReconfigureInterval, d.nodeName)
+	if d.forcedReconfigureInterval > 0 {
+		d.logger.Infof("director: forced reconfigure every %v at offset %v", d.forcedReconfigureInterval, util.StaggerOffset(d.forcedReconfigureInterval, d.nodeName))
+	} else {
+		d.logger.Info("director: forced reconfigure disabled")
+	}
 
 	defer t.Stop()
 	defer forceReconfigure.Stop()
 
+	// consecutive failed applies. the loop fails once there are too many, so
+	// that it is restarted after backoff rather than retried every tick.
+	// transient failures don't count, and a config refused as invalid is
+	// alerted on at once and not retried by the ticker until it changes
+	failures := 0
+	var rejected uint64
+	applied := func(generation uint64, err error) error {
+		if err == nil {
+			failures = 0
+			rejected = 0
+			d.metrics.SubsystemHealthy("periodic")
+			if d.breaker.Success() {
+				d.logger.Infof("director: apply succeeded. retrying on every tick again")
+				d.metrics.ApplyBreakerOpen(false)
+			}
+			return nil
+		}
+		class := util.ErrorClass(err)
+		d.metrics.ReconcileError(class)
+		switch class {
+		case util.ClassTransient:
+			return nil
+		case util.ClassConfigInvalid:
+			rejected = generation
+			util.MarkUnhealthy(stats.KindIpvsMaster, err.Error())
+			return nil
+		}
+		failures++
+		d.breakerFailed(err)
+		if d.supervision.MaxApplyFailures > 0 && failures >= d.supervision.MaxApplyFailures {
+			return fmt.Errorf("%d consecutive applies failed. last error: %v", failures, err)
+		}
+		return nil
+	}
+
+	// finished is when the last reconcile of the loop returned. a tick from
+	// before then waited in the ticker while that reconcile ran long, and is
+	// dropped rather than starting another right behind it
+	var finished time.Time
+	reconfigure := func(force bool) error {
+		err := d.reconfigure(ctxWatch, force)
+		finished = time.Now()
+		return err
+	}
+
 	for {
 		select {
 		case <-forceReconfigure.C:
-			if d.watcher.ClusterConfig.Config == nil {
+			config, nodes := d.watcher.Current()
+			if config == nil || config.Config == nil {
 				log.Warningln("director: Force reconfiguration skipped because d.config is nil")
 				continue
 			}
-			if d.watcher.Nodes == nil {
+			if nodes == nil {
 				log.Warningln("director: Force reconfiguration skipped because d.nodes is nil")
 				continue
 			}
+			if !d.breakerAllows() {
+				continue
+			}
 			d.logger.Info("director: Force reconfiguration w/o parity check timer went off")
-			d.reconfigure(true)
+			if err := applied(config.Generation, reconfigure(true)); err != nil {
+				return err
+			}
 
-		case <-t.C: // periodically apply declared state
+		case <-d.reconcileRequests:
+			config, nodes := d.watcher.Current()
+			if config == nil || config.Config == nil || nodes == nil {
+				d.logger.Warn("director: requested reconfiguration skipped because there is no config or nodes yet")
+				continue
+			}
+			// a reconcile the operator requested is tried even while the
+			// breaker holds back the ticks, to see whether a fix took
+			d.logger.Info("director: reconfiguration w/o parity check requested")
+			if err := applied(config.Generation, reconfigure(true)); err != nil {
+				return err
+			}
+
+		case tick := <-t.C: // periodically apply declared state
+			if tick.Before(finished) {
+				d.logger.Debugf("director: the tick of %v came while the last reconcile ran. skipping it", tick.Format(time.RFC3339))
+				d.metrics.ReconcileSkipped("overlap")
+				continue
+			}
 
 			// if d.lastReconfigure.Sub(d.lastInboundUpdate) > 0 {
 			// 	// Last reconfigure happened after the last update from watcher
@@ -344,207 +650,449 @@ func (d *director) periodic() {
 
 			// d.metrics.QueueDepth(len(d.configChan))
 
-			if d.watcher.ClusterConfig.Config == nil {
+			config, nodes := d.watcher.Current()
+			if config == nil || config.Config == nil {
 				d.logger.Debugf("director: configs are nil. skipping apply")
 				continue
 			}
-			if d.watcher.Nodes == nil {
+			if nodes == nil {
 				d.logger.Debugf("director: nodes are nil. skipping apply")
 				continue
 			}
+			if rejected != 0 && config.Generation == rejected {
+				d.logger.Debugf("director: generation %d was refused as invalid. skipping apply", rejected)
+				continue
+			}
+			if !d.breakerAllows() {
+				continue
+			}
 
-			d.reconfigure(false)
+			if err := applied(config.Generation, reconfigure(false)); err != nil {
+				return err
+			}
 
 		case <-d.ctx.Done():
 			d.logger.Debugf("director: parent context closed. exiting run loop")
-			return
-		case <-d.ctxWatch.Done():
+			return nil
+		case <-ctxWatch.Done():
 			d.logger.Debugf("director: watch context closed. exiting run loop")
-			d.doneChan <- struct{}{}
-			return
+			return nil
 		}
 	}
 }
 
-func (d *director) reconfigure(force bool) {
+// breakerFailed records a failed apply with the breaker. Once it opens, the
+// node reports unhealthy with the failure until an apply succeeds.
+func (d *director) breakerFailed(err error) {
+	opened := d.breaker.Failure(time.Now(), err)
+	if !d.breaker.Open() {
+		return
+	}
+	if opened {
+		d.logger.Errorf("director: %d consecutive applies failed. retrying with backoff until one succeeds", d.breaker.Failures())
+		d.metrics.ApplyBreakerOpen(true)
+	}
+	util.MarkUnhealthy(stats.KindIpvsMaster, fmt.Sprintf("apply failing persistently: %d consecutive failures, next retry at %s. last error: %v", d.breaker.Failures(), d.breaker.RetryAt().Format(time.RFC3339), err))
+}
+
+// breakerAllows is whether the periodic loop may apply now, which it may not
+// while the breaker waits out its backoff
+func (d *director) breakerAllows() bool {
+	if d.breaker.Allow(time.Now()) {
+		return true
+	}
+	d.logger.Debugf("director: applies are failing persistently. skipping apply until %v", d.breaker.RetryAt())
+	return false
+}
+
+func (d *director) reconfigure(ctx context.Context, force bool) error {
 	start := time.Now()
 	d.logger.Infof("director: reconfiguring")
-	if err := d.applyConf(force); err != nil {
+	if err := util.Recover("director: reconcile", func() error { return d.applyConf(ctx, force) }); err != nil {
+		if p, ok := err.(*util.PanicError); ok {
+			d.panicked(p)
+		}
 		d.logger.Errorf("error applying configuration in director. %v", err)
-		return
+		return err
 	}
+	util.MarkHealthy(stats.KindIpvsMaster)
 	d.logger.Infof("director: reconfiguration completed successfully in %v", time.Since(start))
 	// d.lastReconfigure = start
+	return nil
+}
+
+// panicked handles a reconcile that panicked. Whatever the reconcile had written
+// to the kernel is left in place, since tearing it down could drop more traffic
+// than the partial apply, and the node reports unhealthy until a later
+// reconcile succeeds.
+func (d *director) panicked(p *util.PanicError) {
+	d.metrics.ReconcilePanic()
+	util.MarkUnhealthy(stats.KindIpvsMaster, fmt.Sprintf("reconcile panicked: %v", p.Value))
+}
+
+func (d *director) Reconcile(force bool) error {
+	return d.applyConf(d.ctx, force)
 }
 
-func (d *director) applyConf(force bool) error {
-	// TODO: this thing could have gotten a new copy of nodes by the
-	// time it did its thing. need to lock in the caller, capture
-	// the current time, deepcopy the nodes/config, and pass them into this.
+// applyConf reconciles the node with the configuration. The commands of every
+// stage are killed once ctx is done, or the stage runs past its budget. A
+// reconcile started while another runs is skipped with a transient error.
+func (d *director) applyConf(ctx context.Context, force bool) error {
+	if !atomic.CompareAndSwapInt32(&d.applying, 0, 1) {
+		d.metrics.ReconcileSkipped("running")
+		return util.Errorf(util.ErrTransient, "director: a reconcile is still running. skipping this one")
+	}
+	defer atomic.StoreInt32(&d.applying, 0)
+
 	d.logger.Debugf("director: applying configuration")
 	start := time.Now()
 
+	// work from a copy of the config and nodes taken at a single point in time,
+	// so that updates arriving from the watcher mid-apply can't produce torn reads
+	snapshot := d.watcher.Snapshot()
+	if snapshot.ClusterConfig == nil {
+		return util.Errorf(util.ErrTransient, "director: no cluster config to apply")
+	}
+	d.Lock()
+	node := d.node.DeepCopy()
+	d.Unlock()
+
+	// during a freeze window only removals are applied. the rest of the change
+	// waits for the window to end
+	d.applyFreeze(snapshot)
+	ApplyOverrides(snapshot, d.overrides)
+	held := d.holdBackup(snapshot)
+
+	// the state the parity check doesn't cover is reconciled on every pass
+	d.plane.ApplyPolicies(snapshot.ClusterConfig)
+
 	// compare configurations and apply them
 	if force {
 		d.logger.Info("director: configuration parity ignored")
 	} else {
-		addressesV4, addressesV6, err := d.ip.Get()
-		if err != nil {
-			log.Errorln("director: error creating interface:", err)
-		}
-
-		// splice together to compare against the internal state of configs
-		// addresses is sorted within the CheckConfigParity function
-		addresses := append(addressesV4, addressesV6...)
-
-		same, err := d.ipvs.CheckConfigParity(d.watcher, d.watcher.ClusterConfig, addresses)
+		var same bool
+		err := d.stage(ctx, "parity", d.supervision.Budget.Parity, func(ctx context.Context) (err error) {
+			same, err = d.plane.InParity(ctx, snapshot)
+			return err
+		})
 		if err != nil {
 			d.metrics.Reconfigure("error", time.Since(start))
-			return fmt.Errorf("director: unable to compare configurations with error %v", err)
+			return fmt.Errorf("director: unable to compare configurations with error %w", err)
 		}
 		if same {
 			d.metrics.Reconfigure("noop", time.Since(start))
+			d.setApplied(snapshot.ClusterConfig)
+			d.converged(snapshot.ClusterConfig, false)
+			d.saveCache(snapshot, false)
+			// nothing the watchdog fingerprints was changed, so its baseline
+			// is kept, and a change the parity check doesn't cover is still noticed
+			d.watchdog.Applied(true)
 			d.logger.Info("director: configuration has parity")
 			return nil
 		}
 
-		d.logger.Info("director: configuration parity mismatch")
+		logger := d.logger
+		if differ, ok := d.plane.(dataplane.ParityDiffer); ok {
+			logger = logger.WithFields(differ.ParityDiff().Fields())
+		}
+		logger.Infof("director: configuration parity mismatch. applied generation %d, current generation %d", d.appliedGeneration, snapshot.ClusterConfig.Generation)
 	}
+	d.watchdog.Applying()
 
 	// Manage VIP addresses
-	err := d.setAddresses()
+	var added []string
+	err := d.stage(ctx, "addresses", d.supervision.Budget.Addresses, func(ctx context.Context) (err error) {
+		added, err = d.plane.ApplyAddresses(ctx, snapshot.ClusterConfig)
+		return err
+	})
 	if err != nil {
 		d.metrics.Reconfigure("error", time.Since(start))
-		return fmt.Errorf("director: unable to configure VIP addresses with error %v", err)
+		return fmt.Errorf("director: unable to configure VIP addresses with error %w", err)
 	}
+	d.announceAdded(added, snapshot.ClusterConfig.Announce)
+	d.withdrawRemoved(snapshot.ClusterConfig, held)
 	d.logger.Debugf("director: addresses set")
 
-	// Manage iptables configuration
-	// only execute with cli flag ipvs-colocation-mode=true
-	// this indicates the director is in a non-isolated load balancer tier
-	if d.colocationMode == colocationModeIPTables {
-		err = d.setIPTables()
-		if err != nil {
-			d.metrics.Reconfigure("error", time.Since(start))
-			return fmt.Errorf("director: unable to configure iptables with error %v", err)
-		}
-		d.logger.Debugf("director: iptables configured")
-	}
-
-	// Manage ipvsadm configuration
-	err = d.ipvs.SetIPVS(d.watcher, d.watcher.ClusterConfig, d.logger, bgp.AddrKindIPV4)
-
+	// Manage the virtual services
+	err = d.stage(ctx, "services", d.supervision.Budget.Services, func(ctx context.Context) error {
+		return d.plane.ApplyServices(ctx, snapshot, node)
+	})
 	if err != nil {
 		d.metrics.Reconfigure("error", time.Since(start))
-		return fmt.Errorf("director: unable to configure ipvs with error %v", err)
+		return fmt.Errorf("director: %w", err)
 	}
-	d.logger.Debugf("director: ipvs configured")
+	d.logger.Debugf("director: %s services configured", d.plane.Name())
+	d.recordStats()
 
 	d.metrics.Reconfigure("complete", time.Since(start))
+	d.setApplied(snapshot.ClusterConfig)
+	d.converged(snapshot.ClusterConfig, true)
+	d.saveCache(snapshot, true)
+	d.watchdog.Applied(false)
 	return nil
 }
 
-func (d *director) setIPTables() error {
+// stage runs a stage of a reconcile with ctx bounded by budget, when it is
+// set. A stage that runs past its budget fails as a kernel apply, since its
+// commands were killed partway through.
+func (d *director) stage(ctx context.Context, name string, budget time.Duration, fn func(context.Context) error) error {
+	if budget <= 0 {
+		return fn(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+	err := fn(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		d.metrics.ReconcileOverBudget(name)
+		return util.Errorf(util.ErrKernelApply, "the %s stage ran past its budget of %v: %w", name, budget, err)
+	}
+	return err
+}
 
-	d.logger.Debugf("director: capturing iptables rules")
-	// fetch existing iptables rules
-	existing, err := d.iptables.Save()
-	if err != nil {
-		return err
+// ApplyOverrides makes the overrides o in a snapshot of the watcher, both to
+// its cluster config and to its nodes
+func ApplyOverrides(snapshot *watcher.Watcher, o *types.Overrides) {
+	snapshot.ClusterConfig = o.Apply(snapshot.ClusterConfig)
+	snapshot.Nodes = o.ApplyNodes(snapshot.Nodes)
+}
+
+func (d *director) SetOverrides(o *types.Overrides) {
+	d.overrides = o
+}
+
+func (d *director) SetWatchdog(interval time.Duration) {
+	fingerprinter, ok := d.plane.(dataplane.Fingerprinter)
+	if !ok {
+		d.logger.Warnf("director: the %s data plane can't be fingerprinted. running without a watchdog", d.plane.Name())
+		return
 	}
-	d.logger.Debugf("director: got %d existing rules", len(existing))
+	d.watchdog = dataplane.NewWatchdog(fingerprinter, d.nodeName, d.watcher, d.metrics, d.logger)
+	d.watchdogInterval = interval
+}
 
-	d.logger.Debugf("director: generating iptables rules")
-	// i need to determine what percentage of traffic should be sent to the master
-	// for each namespace/service:port that is in the config, i need to know the proportion
-	// of the whole that namespace/service:port represents
-	generated, err := d.iptables.GenerateRulesForNodeClassic(d.watcher, d.node.Name, d.watcher.ClusterConfig, true)
-	if err != nil {
-		return err
+func (d *director) RequestReconcile() {
+	select {
+	case d.reconcileRequests <- struct{}{}:
+	default:
+		// one is already pending
 	}
-	d.logger.Debugf("director: got %d generated rules", len(generated))
+}
 
-	d.logger.Debugf("director: merging iptables rules")
+func (d *director) State() State {
+	d.Lock()
+	s := State{Node: d.nodeName, Started: d.isStarted, AppliedGeneration: d.appliedGeneration, VIPs: []string{}, VIPs6: []string{}}
+	if d.appliedConfig != nil {
+		s.VIPs, s.VIPs6 = d.vips(d.appliedConfig)
+	}
+	if d.frozen != nil {
+		s.Frozen = d.frozen.Spec
+	}
+	d.Unlock()
 
-	merged, _, err := d.iptables.Merge(generated, existing) // subset, all rules
+	sort.Strings(s.VIPs)
+	sort.Strings(s.VIPs6)
+	if err := d.Err(); err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
 
-	if err != nil {
-		return err
+// saveCache writes the state behind a successful reconcile to the config cache.
+// Reconciles that found parity only write it when the generation has changed.
+func (d *director) saveCache(snapshot *watcher.Watcher, applied bool) {
+	generation := snapshot.ClusterConfig.Generation
+	d.Lock()
+	if !applied && d.cachedGeneration == generation {
+		d.Unlock()
+		return
 	}
+	d.cachedGeneration = generation
+	d.Unlock()
 
-	d.logger.Debugf("director: got %d merged rules", len(merged))
+	if err := d.watcher.WriteCache(snapshot); err != nil {
+		d.logger.Errorf("director: %v", err)
+	}
+}
 
-	d.logger.Debugf("director: applying updated rules")
-	err = d.iptables.Restore(merged)
-	if err != nil {
-		// set our failure gauge for iptables alertmanagers
-		d.metrics.IptablesWriteFailure(1)
-		// write erroneous rule set to file to capture later
-		d.logger.Errorf("error applying rules. writing erroneous rule change to /tmp/director-ruleset-err for debugging")
-		writeErr := ioutil.WriteFile("/tmp/director-ruleset-err", createErrorLog(err, iptables.BytesFromRules(merged)), 0644)
-		if writeErr != nil {
-			d.logger.Errorf("error writing to file; logging rules: %s", string(iptables.BytesFromRules(merged)))
-		}
+func (d *director) setApplied(config *types.ClusterConfig) {
+	d.Lock()
+	d.appliedGeneration = config.Generation
+	d.appliedConfig = config
+	d.Unlock()
+	d.metrics.AppliedGeneration(config.Generation)
+}
 
-		return err
+// converged records the time the changes to endpoints in config took to land in
+// the kernel, when the reconcile that applied it changed the kernel. Each change
+// is measured once: configs are reconciled repeatedly, and a change that a
+// reconcile found already in parity didn't change this node.
+func (d *director) converged(config *types.ClusterConfig, changed bool) {
+	d.Lock()
+	fresh := config.EventTime.After(d.convergedAt)
+	if fresh {
+		d.convergedAt = config.EventTime
 	}
+	d.Unlock()
 
-	// set gauge to success
-	d.metrics.IptablesWriteFailure(0)
-	return nil
+	if fresh && changed {
+		d.metrics.Converged(time.Since(config.EventTime))
+	}
 }
 
-// func (d *director) configReady() bool {
-// 	newConfig := false
-// 	d.Lock()
-// 	if d.newConfig {
-// 		newConfig = true
-// 		d.newConfig = false
-// 	}
-// 	d.Unlock()
-// 	return newConfig
-// }
-
-func (d *director) setAddresses() error {
-	// pull existing
-	configuredV4, _, err := d.ip.Get()
-	if err != nil {
-		return err
-	}
+// applyFreeze replaces the config in snapshot with only the removals it makes to
+// the applied config while a freeze window is active. Backends still follow node
+// and endpoint changes, so unhealthy backends are removed during a freeze.
+func (d *director) applyFreeze(snapshot *watcher.Watcher) {
+	w := d.freeze.Active(time.Now())
+
+	d.Lock()
+	applied := d.appliedConfig
+	changed := w != d.frozen
+	d.frozen = w
+	d.Unlock()
 
-	// get desired VIP addresses
-	desired := []string{}
-	for ip := range d.watcher.ClusterConfig.Config {
-		desired = append(desired, string(ip))
+	d.metrics.ConfigFrozen(w != nil)
+	if changed {
+		if w != nil {
+			d.logger.Infof("director: freeze window '%s' started. only removals will be applied", w.Spec)
+		} else {
+			d.logger.Info("director: freeze window ended. applying held back changes")
+		}
+	}
+	if w == nil {
+		return
 	}
 
-	// XXX statsd
-	removals, additions := d.ip.Compare4(configuredV4, desired)
+	frozen := types.RemovalsOnly(applied, snapshot.ClusterConfig)
+	if frozen != snapshot.ClusterConfig && frozen.Generation != snapshot.ClusterConfig.Generation {
+		d.logger.Infof("director: holding back cluster config generation %d during freeze window '%s'", snapshot.ClusterConfig.Generation, w.Spec)
+	}
+	snapshot.ClusterConfig = frozen
+}
 
-	for _, addr := range removals {
-		d.logger.WithFields(logrus.Fields{"device": "primary", "addr": addr, "action": "deleting"}).Info()
-		err := d.ip.Del(addr)
-		if err != nil {
-			return err
+// holdBackup removes the v4 VIPs announced with vrrp from the config in
+// snapshot while this director is a vrrp backup, so that their addresses are
+// kept off the device and the backup doesn't answer ARP for them. The parity
+// check puts them back once the director is elected. It returns the VIPs held.
+func (d *director) holdBackup(snapshot *watcher.Watcher) map[string]bool {
+	held := map[string]bool{}
+	for vip := range snapshot.ClusterConfig.Config {
+		if d.announcer.Backup(string(vip), snapshot.ClusterConfig.Announce) {
+			held[string(vip)] = true
 		}
 	}
-	for _, addr := range additions {
-		d.logger.WithFields(logrus.Fields{"device": "primary", "addr": addr, "action": "adding"}).Info()
-		if err := d.ip.Add(addr); err != nil {
-			log.Errorln("director: error adding adapter:", addr, err)
+	if len(held) == 0 {
+		return held
+	}
+
+	config := snapshot.ClusterConfig.DeepCopy()
+	for vip := range held {
+		delete(config.Config, types.ServiceIP(vip))
+	}
+	d.logger.Debugf("director: vrrp backup. holding back %d VIPs", len(held))
+	snapshot.ClusterConfig = config
+	return held
+}
+
+// announceAdded announces the VIPs that were just added to the node
+func (d *director) announceAdded(added []string, selected map[types.ServiceIP]string) {
+	if len(added) == 0 {
+		return
+	}
+	added4, added6 := splitFamilies(added)
+	if err := d.announcer.Announce(d.ctx, added4, added6, selected); err != nil {
+		d.logger.Warnf("director: error announcing new VIPs. this is most likely due to the VIP not being present on the interface. %s", err)
+	}
+}
+
+// withdrawRemoved withdraws the announcements of the VIPs of the last applied
+// config that config no longer has, with the strategies they were announced
+// with. VIPs only held back while the director is a vrrp backup are kept, so
+// that they are announced as soon as it is elected.
+func (d *director) withdrawRemoved(config *types.ClusterConfig, held map[string]bool) {
+	d.Lock()
+	applied := d.appliedConfig
+	d.Unlock()
+	if applied == nil {
+		return
+	}
+
+	current := map[string]bool{}
+	vips4, vips6 := d.vips(config)
+	for _, vip := range append(vips4, vips6...) {
+		current[vip] = true
+	}
+	removed := []string{}
+	vips4, vips6 = d.vips(applied)
+	for _, vip := range append(vips4, vips6...) {
+		if !current[vip] && !held[vip] {
+			removed = append(removed, vip)
 		}
-		if err := d.ip.AdvertiseMacAddress(addr); err != nil {
-			d.logger.Warnf("director: error setting gratuitous arp. this is most likely due to the VIP not being present on the interface. %s", err)
+	}
+	if len(removed) == 0 {
+		return
+	}
+	removed4, removed6 := splitFamilies(removed)
+	if err := d.announcer.Withdraw(d.ctx, removed4, removed6, applied.Announce); err != nil {
+		d.logger.Warnf("director: error withdrawing removed VIPs. %s", err)
+	}
+}
+
+// splitFamilies splits vips into the ipv4 and the ipv6 ones
+func splitFamilies(vips []string) ([]string, []string) {
+	vips4, vips6 := []string{}, []string{}
+	for _, vip := range vips {
+		if ip := net.ParseIP(vip); ip != nil && ip.To4() == nil {
+			vips6 = append(vips6, vip)
+			continue
 		}
+		vips4 = append(vips4, vip)
 	}
+	return vips4, vips6
+}
 
-	// now iterate across configured and see if we have a non-standard MTU
-	// setting it where applicable
-	err = d.ip.SetMTU(d.watcher.ClusterConfig.MTUConfig, false)
+// recordStats records what the data plane serves after an apply
+func (d *director) recordStats() {
+	s, err := d.plane.Stats()
 	if err != nil {
-		log.Errorln("director: error setting MTU on adapters:", err)
+		d.logger.Warnf("director: unable to read %s data plane stats. %v", d.plane.Name(), err)
+		return
+	}
+	d.metrics.DataPlaneObjects(d.plane.Name(), "services", s.Services)
+	d.metrics.DataPlaneObjects(d.plane.Name(), "backends", s.Backends)
+	d.metrics.DataPlaneObjects(d.plane.Name(), "addresses", s.Addresses)
+}
+
+// vips returns the VIPs of config that the director programs
+func (d *director) vips(config *types.ClusterConfig) ([]string, []string) {
+	return dataplane.VIPs(config, d.ipv6Only)
+}
+
+// announce refreshes the announcement of vips4 and vips6, recording a failure
+// metric for each VIP that couldn't be announced
+func (d *director) announce(vips4, vips6 []string, selected map[types.ServiceIP]string) {
+	err := d.announcer.Announce(d.ctx, vips4, vips6, selected)
+	if err == nil {
+		return
 	}
+	errs, ok := err.(announce.Errors)
+	if !ok {
+		errs = announce.Errors{"": err}
+	}
+	for _, err := range errs {
+		d.metrics.ArpingFailure(err)
+		d.logger.Error(err)
+	}
+}
 
+// beginTransition marks a Start or Stop as in progress, failing when one already is
+func (d *director) beginTransition(op string) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.reconfiguring {
+		return util.Errorf(util.ErrTransient, "director: unable to %s. reconfiguration already in progress", op)
+	}
+	d.reconfiguring = true
 	return nil
 }
 
@@ -553,12 +1101,3 @@ func (d *director) setReconfiguring(v bool) {
 	d.reconfiguring = v
 	d.Unlock()
 }
-
-func createErrorLog(err error, rules []byte) []byte {
-	if err == nil {
-		return rules
-	}
-
-	errBytes := []byte(fmt.Sprintf("ipvs restore error: %v\n", err.Error()))
-	return append(errBytes, rules...)
-}
@@ -1 +1,549 @@
 package director
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/Comcast/Ravel/pkg/announce"
+	"github.com/Comcast/Ravel/pkg/dataplane"
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// metrics register with prometheus, so they can only be created once per test binary
+var testMetrics = stats.NewWorkerStateMetrics(stats.KindIpvsMaster, "test")
+
+func newTestDirector(config *types.ClusterConfig) (*director, *system.FakeIPVS, *system.FakeIP, *iptables.FakeRuleApplier) {
+	ipvs := system.NewFakeIPVS()
+	ip := system.NewFakeIP()
+	ipt := iptables.NewFakeRuleApplier("RAVEL", true, logrus.New())
+	announcer, _ := announce.NewSet(announce.ARP, announce.NDP, logrus.New(), announce.NewARP(ip), announce.NewNDP(ip))
+
+	d := &director{
+		nodeName: "director-0",
+		watcher: &watcher.Watcher{
+			ClusterConfig: config,
+			Nodes:         []*corev1.Node{},
+		},
+		plane:       newTestPlane(ipvs, ip, ipt, dataplane.ColocationDisabled, false),
+		announcer:   announcer,
+		nodes:       newNodeMailbox(),
+		ctx:         context.Background(),
+		logger:      logrus.New(),
+		metrics:     testMetrics,
+		supervision: Supervision{Backoff: DefaultRestartBackoff},
+	}
+	return d, ipvs, ip, ipt
+}
+
+func newTestPlane(ipvs *system.FakeIPVS, ip *system.FakeIP, ipt *iptables.FakeRuleApplier, colocationMode string, ipv6Only bool) dataplane.DataPlane {
+	return dataplane.NewIPVS(ipvs, ip, ipt, system.NewFakeSysctl(nil), colocationMode, ipv6Only, "test", logrus.New())
+}
+
+func testClusterConfig() *types.ClusterConfig {
+	return &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {
+				"80": &types.ServiceDef{Namespace: "syseng", Service: "mod-super8", PortName: "http", TCPEnabled: true},
+			},
+		},
+	}
+}
+
+func TestApplyConfParityMismatch(t *testing.T) {
+	d, ipvs, ip, _ := newTestDirector(testClusterConfig())
+	ip.Devices["10_1_1_1"] = "10.1.1.1"
+
+	if err := d.applyConf(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ip.Devices["10_54_213_165"]; !ok {
+		t.Errorf("expected VIP device to be added. have %v", ip.Devices)
+	}
+	if _, ok := ip.Devices["10_1_1_1"]; ok {
+		t.Errorf("expected stale device to be removed. have %v", ip.Devices)
+	}
+	if len(ip.Advertised) != 1 || ip.Advertised[0] != "10.54.213.165" {
+		t.Errorf("expected VIP to be advertised. have %v", ip.Advertised)
+	}
+	if len(ipvs.SetIPVSCalls) != 1 {
+		t.Errorf("expected one ipvs apply, got %d", len(ipvs.SetIPVSCalls))
+	}
+}
+
+func TestApplyConfParityNoop(t *testing.T) {
+	d, ipvs, ip, _ := newTestDirector(testClusterConfig())
+	ipvs.Parity = true
+
+	if err := d.applyConf(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if len(ip.Devices) != 0 {
+		t.Errorf("expected no address changes, have %v", ip.Devices)
+	}
+	if len(ipvs.SetIPVSCalls) != 0 {
+		t.Errorf("expected no ipvs apply, got %d", len(ipvs.SetIPVSCalls))
+	}
+}
+
+func TestApplyConfForced(t *testing.T) {
+	d, ipvs, _, _ := newTestDirector(testClusterConfig())
+	ipvs.Parity = true
+
+	if err := d.applyConf(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	if len(ipvs.SetIPVSCalls) != 1 {
+		t.Errorf("expected forced ipvs apply, got %d", len(ipvs.SetIPVSCalls))
+	}
+}
+
+func TestStartStopCycles(t *testing.T) {
+	d, _, _, _ := newTestDirector(testClusterConfig())
+
+	if err := d.Stop(); err == nil {
+		t.Fatal("expected a director that was never started to refuse to stop")
+	}
+
+	for cycle := 0; cycle < 3; cycle++ {
+		if err := d.Start(); err != nil {
+			t.Fatalf("cycle %d: %v", cycle, err)
+		}
+		if err := d.Start(); err == nil {
+			t.Fatalf("cycle %d: expected a running director to refuse to start", cycle)
+		}
+		if running := d.group.Running(); len(running) != 4 {
+			t.Fatalf("cycle %d: expected four goroutines to be running. saw %v", cycle, running)
+		}
+
+		if err := d.Stop(); err != nil {
+			t.Fatalf("cycle %d: %v", cycle, err)
+		}
+		if running := d.group.Running(); len(running) != 0 {
+			t.Fatalf("cycle %d: expected every goroutine to exit on stop. %v leaked", cycle, running)
+		}
+		if err := d.Err(); err != nil {
+			t.Fatalf("cycle %d: %v", cycle, err)
+		}
+	}
+}
+
+func TestAdoptRelease(t *testing.T) {
+	d, ipvs, _, ipt := newTestDirector(testClusterConfig())
+	d.doCleanup = true
+
+	// an adopted node keeps the iptables rules the previous process left
+	d.Adopt()
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if ipt.Flushes != 0 {
+		t.Fatalf("expected an adopting start not to flush iptables. saw %d flushes", ipt.Flushes)
+	}
+
+	// a release leaves everything in place for the successor, even when the
+	// director cleans up on stop
+	if err := d.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if ipt.Flushes != 0 || ipvs.Teardowns != 0 {
+		t.Fatalf("expected a release not to clean up. saw %d flushes and %d teardowns", ipt.Flushes, ipvs.Teardowns)
+	}
+
+	// adoption only lasts for one start
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if ipt.Flushes != 1 {
+		t.Fatalf("expected a later start to flush iptables. saw %d flushes", ipt.Flushes)
+	}
+	if err := d.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if ipvs.Teardowns != 1 {
+		t.Fatalf("expected stop to clean up. saw %d teardowns", ipvs.Teardowns)
+	}
+}
+
+func TestSuperviseStaleWatch(t *testing.T) {
+	d, _, _, _ := newTestDirector(testClusterConfig())
+	d.group = util.NewRunGroup()
+	d.supervision = Supervision{Backoff: util.Backoff{Initial: time.Millisecond, Max: time.Second}, WatchStaleAfter: time.Minute}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// the test watcher has never seen an event, so the sync fails, and is
+	// restarted, until it is stopped
+	d.supervise(ctx, "causePeriodicWatcherSync", d.causePeriodicWatcherSync)
+	deadline := time.Now().Add(time.Second)
+	for d.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := d.Err(); err == nil || !strings.HasPrefix(err.Error(), "causePeriodicWatcherSync: no watch events for") {
+		t.Fatalf("expected the stale watch to fail the sync. saw %v", err)
+	}
+	if running := d.group.Running(); len(running) != 1 {
+		t.Fatalf("expected the sync to be restarted. saw %v", running)
+	}
+
+	cancel()
+	if running := d.group.Wait(time.Second); len(running) != 0 {
+		t.Fatalf("expected the sync to exit with its context. saw %v", running)
+	}
+}
+
+func TestReconfigurePanic(t *testing.T) {
+	d, _, _, _ := newTestDirector(testClusterConfig())
+	w := d.watcher
+	d.watcher = nil
+
+	if _, ok := d.reconfigure(context.Background(), false).(*util.PanicError); !ok {
+		t.Fatal("expected the panic to be recovered and returned")
+	}
+	if reason := util.UnhealthyReasons()[stats.KindIpvsMaster]; !strings.HasPrefix(reason, "reconcile panicked") {
+		t.Fatalf("expected the director to be marked unhealthy. saw %q", reason)
+	}
+
+	d.watcher = w
+	if err := d.reconfigure(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if reasons := util.UnhealthyReasons(); reasons != nil {
+		t.Fatalf("expected a successful reconcile to clear the panic. saw %v", reasons)
+	}
+}
+
+func TestBreakerHoldsBackApplies(t *testing.T) {
+	d, _, _, _ := newTestDirector(testClusterConfig())
+	d.breaker = util.Breaker{Threshold: 2, Backoff: util.Backoff{Initial: time.Hour, Max: time.Hour}}
+	err := fmt.Errorf("iptables-restore: line 3 failed")
+
+	d.breakerFailed(err)
+	if !d.breakerAllows() {
+		t.Fatal("expected an apply to be retried at once below the threshold")
+	}
+	if _, ok := util.UnhealthyReasons()[stats.KindIpvsMaster]; ok {
+		t.Fatal("expected the director to stay healthy below the threshold")
+	}
+
+	d.breakerFailed(err)
+	if d.breakerAllows() {
+		t.Fatal("expected the breaker to hold back the next apply")
+	}
+	if reason := util.UnhealthyReasons()[stats.KindIpvsMaster]; !strings.HasPrefix(reason, "apply failing persistently: 2 consecutive failures") || !strings.HasSuffix(reason, err.Error()) {
+		t.Fatalf("expected the director to be marked unhealthy. saw %q", reason)
+	}
+
+	// an apply that succeeds clears the condition
+	if err := d.reconfigure(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	d.breaker.Success()
+	if reasons := util.UnhealthyReasons(); reasons != nil {
+		t.Fatalf("expected a successful apply to clear the condition. saw %v", reasons)
+	}
+	if !d.breakerAllows() {
+		t.Fatal("expected applies every tick once the breaker closed")
+	}
+}
+
+// slowPlane is a plane whose services stage runs until its context is done
+type slowPlane struct {
+	dataplane.DataPlane
+}
+
+func (p slowPlane) ApplyServices(ctx context.Context, w *watcher.Watcher, node *corev1.Node) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestReconcileBudget(t *testing.T) {
+	d, _, _, _ := newTestDirector(testClusterConfig())
+	d.plane = slowPlane{d.plane}
+	d.supervision.Budget.Services = 10 * time.Millisecond
+
+	err := d.applyConf(context.Background(), true)
+	if util.ErrorClass(err) != util.ClassKernelApply || !strings.Contains(err.Error(), "services stage ran past its budget of 10ms") {
+		t.Fatalf("expected the services stage to run out of budget. saw %v", err)
+	}
+
+	// a director that stops cancels the stage in progress
+	d.supervision.Budget.Services = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := d.applyConf(ctx, true); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the reconcile to be canceled. saw %v", err)
+	}
+
+	// a reconcile started while another runs is skipped
+	d.applying = 1
+	if err := d.applyConf(context.Background(), true); util.ErrorClass(err) != util.ClassTransient {
+		t.Fatalf("expected the overlapping reconcile to be skipped. saw %v", err)
+	}
+}
+
+func TestNodeMailboxCoalesces(t *testing.T) {
+	m := newNodeMailbox()
+	if _, ok := m.Take(); ok {
+		t.Fatal("expected an empty mailbox")
+	}
+
+	// neither put may block, even though nothing is reading
+	m.Put([]*corev1.Node{{}})
+	m.Put([]*corev1.Node{{}, {}})
+
+	<-m.Ready()
+	nodes, ok := m.Take()
+	if !ok || len(nodes) != 2 {
+		t.Fatalf("expected the latest node list of 2 nodes. saw %d", len(nodes))
+	}
+	if _, ok := m.Take(); ok {
+		t.Fatal("expected the mailbox to be empty after take")
+	}
+}
+
+func TestApplyConfNotrack(t *testing.T) {
+	config := testClusterConfig()
+	config.Config["10.54.213.165"]["80"].NoTrack = true
+	d, ipvs, _, ipt := newTestDirector(config)
+	ipvs.Parity = true
+
+	if err := d.applyConf(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	rules := ipt.Raw["RAVEL-NOTRACK"].Rules
+	if len(rules) != 1 || rules[0] != "-A RAVEL-NOTRACK -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j CT --notrack" {
+		t.Fatalf("expected a notrack rule for the VIP port even with ipvs parity. have %v", rules)
+	}
+
+	d.plane = newTestPlane(ipvs, system.NewFakeIP(), ipt, dataplane.ColocationIPTables, false)
+	config.Config["10.54.213.165"]["80"].NoTrack = false
+	if err := d.applyConf(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if len(ipt.Raw["RAVEL-NOTRACK"].Rules) != 1 {
+		t.Fatal("expected colocated directors to leave the raw table alone")
+	}
+}
+
+func TestApplyConfTranslation(t *testing.T) {
+	config := testClusterConfig()
+	config.IPV6 = map[types.ServiceIP]string{"10.54.213.165": "2001:db8::7"}
+	config.Config6 = map[types.ServiceIP]types.PortMap{
+		"2001:db8::7": {
+			"80": &types.ServiceDef{Namespace: "syseng", Service: "mod-super8", PortName: "http", TCPEnabled: true, Translate: types.TranslateSIIT},
+		},
+	}
+	d, ipvs, _, ipt := newTestDirector(config)
+	ipvs.Parity = true
+
+	if err := d.applyConf(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if rules := ipt.Mangle6["RAVEL-XLAT"].Rules; len(rules) != 1 || !strings.Contains(rules[0], "-d 2001:db8::7/128") {
+		t.Fatalf("expected the v6 VIP port to be handed to the translator. have %v", rules)
+	}
+	if len(ipt.Mangle["RAVEL-XLAT"].Rules) != 0 {
+		t.Fatalf("expected no v4 translation rules. have %v", ipt.Mangle["RAVEL-XLAT"].Rules)
+	}
+	if len(ipt.Mappings) != 1 || ipt.Mappings[0] != "2001:db8::7/128 10.54.213.165/32" {
+		t.Fatalf("expected the v6 VIP to be mapped to its v4 pair. have %v", ipt.Mappings)
+	}
+}
+
+func TestApplyConfSteering(t *testing.T) {
+	config := testClusterConfig()
+	config.Config["10.54.213.165"]["80"].Steering = []types.Steering{{Sources: []string{"10.0.0.0/8"}, Service: "mod-super8-canary"}}
+	d, ipvs, _, ipt := newTestDirector(config)
+	ipvs.Parity = true
+
+	if err := d.applyConf(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	rules := ipt.Mangle["RAVEL-FWMARK"].Rules
+	if len(rules) != 2 || !strings.Contains(rules[0], "-s 10.0.0.0/8 -d 10.54.213.165/32") || !strings.Contains(rules[1], "-j RETURN") {
+		t.Fatalf("expected the steered clients to be marked. have %v", rules)
+	}
+
+	// removing the rules clears the chain
+	config.Config["10.54.213.165"]["80"].Steering = nil
+	if err := d.applyConf(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	if rules := ipt.Mangle["RAVEL-FWMARK"].Rules; len(rules) != 0 {
+		t.Fatalf("expected no steering rules. have %v", rules)
+	}
+}
+
+func TestApplyConfFreeze(t *testing.T) {
+	d, _, ip, _ := newTestDirector(testClusterConfig())
+	if err := d.applyConf(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	freeze, err := util.ParseFreezeSchedule("* * * * * 1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.freeze = freeze
+
+	// the frozen change removes the applied VIP and adds another
+	d.watcher.ClusterConfig = &types.ClusterConfig{
+		Generation: 2,
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.166": {
+				"80": &types.ServiceDef{Namespace: "syseng", Service: "mod-super8", PortName: "http", TCPEnabled: true},
+			},
+		},
+	}
+	if err := d.applyConf(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	if len(ip.Devices) != 0 {
+		t.Fatalf("expected only the removal to be applied during the freeze. have %v", ip.Devices)
+	}
+
+	d.freeze = nil
+	if err := d.applyConf(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ip.Devices["10_54_213_166"]; !ok || len(ip.Devices) != 1 {
+		t.Fatalf("expected the held back addition after the freeze. have %v", ip.Devices)
+	}
+	if d.appliedGeneration != 2 {
+		t.Fatalf("expected generation 2 to be applied. have %d", d.appliedGeneration)
+	}
+}
+
+type recordingAnnouncer struct {
+	announced, withdrawn []string
+}
+
+func (r *recordingAnnouncer) Name() string { return announce.BGP }
+
+func (r *recordingAnnouncer) Announce(_ context.Context, vips []string) error {
+	r.announced = append(r.announced, vips...)
+	return nil
+}
+
+func (r *recordingAnnouncer) Withdraw(_ context.Context, vips []string) error {
+	r.withdrawn = append(r.withdrawn, vips...)
+	return nil
+}
+
+func TestApplyConfWithdrawsRemovedVIPs(t *testing.T) {
+	config := testClusterConfig()
+	config.Config["10.54.213.166"] = types.PortMap{
+		"80": &types.ServiceDef{Namespace: "syseng", Service: "mod-super8", PortName: "http", TCPEnabled: true},
+	}
+	config.Announce = map[types.ServiceIP]string{"10.54.213.166": announce.BGP}
+	d, _, ip, _ := newTestDirector(config)
+	bgp := &recordingAnnouncer{}
+	d.announcer, _ = announce.NewSet(announce.ARP, announce.NDP, logrus.New(), announce.NewARP(ip), announce.NewNDP(ip), bgp)
+
+	if err := d.applyConf(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bgp.announced, []string{"10.54.213.166"}) || len(bgp.withdrawn) != 0 {
+		t.Fatalf("expected the bgp VIP to be announced. have %v, withdrawn %v", bgp.announced, bgp.withdrawn)
+	}
+
+	// the VIP leaves the config, and its route is withdrawn with the strategy
+	// it was announced with
+	d.watcher.ClusterConfig = testClusterConfig()
+	d.watcher.ClusterConfig.Generation = 1
+	if err := d.applyConf(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bgp.withdrawn, []string{"10.54.213.166"}) {
+		t.Fatalf("expected the removed VIP to be withdrawn. have %v", bgp.withdrawn)
+	}
+}
+
+func TestApplyConfHoldsVRRPVIPsOnBackup(t *testing.T) {
+	config := testClusterConfig()
+	config.Config["10.54.213.166"] = types.PortMap{
+		"80": &types.ServiceDef{Namespace: "syseng", Service: "mod-super8", PortName: "http", TCPEnabled: true},
+	}
+	config.Announce = map[types.ServiceIP]string{"10.54.213.166": announce.VRRP}
+	d, _, ip, _ := newTestDirector(config)
+	arp := announce.NewARP(ip)
+	// the election isn't running, so the director stays a backup
+	vrrp := announce.NewVRRP("eth0", 51, 100, time.Second, true, arp, logrus.New())
+	d.announcer, _ = announce.NewSet(announce.ARP, announce.NDP, logrus.New(), arp, announce.NewNDP(ip), vrrp)
+
+	if err := d.applyConf(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ip.Devices["10_54_213_166"]; ok {
+		t.Fatalf("expected the vrrp VIP to be kept off a backup. have %v", ip.Devices)
+	}
+	if _, ok := ip.Devices["10_54_213_165"]; !ok {
+		t.Fatalf("expected the arp VIP to be configured. have %v", ip.Devices)
+	}
+	if d.appliedConfig.Config["10.54.213.166"] != nil {
+		t.Fatal("expected the held VIP to be missing from the applied config")
+	}
+	if d.watcher.ClusterConfig.Config["10.54.213.166"] == nil {
+		t.Fatal("expected the watcher config to be left alone")
+	}
+}
+
+func TestApplyConfIPv6Only(t *testing.T) {
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{},
+		Config6: map[types.ServiceIP]types.PortMap{
+			"2001:558:1044:1ae:10ad:ba1a:0:7": {
+				"80": &types.ServiceDef{Namespace: "syseng", Service: "mod-super8", PortName: "http", TCPEnabled: true},
+			},
+		},
+	}
+	d, ipvs, ip, ipt := newTestDirector(config)
+	d.ipv6Only = true
+	d.plane = newTestPlane(ipvs, ip, ipt, dataplane.ColocationDisabled, true)
+	// arp is not available at all without IPv4
+	d.announcer, _ = announce.NewSet("", announce.NDP, logrus.New(), announce.NewNDP(ip))
+	ip.Devices["10_1_1_1"] = "10.1.1.1"
+	ip.Devices["a83dead"] = "2001:558:1044:1ae::a83:dead"
+
+	if err := d.applyConf(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	device := ip.Device("2001:558:1044:1ae:10ad:ba1a:0:7", true)
+	if ip.Devices[device] != "2001:558:1044:1ae:10ad:ba1a:0:7" {
+		t.Errorf("expected v6 VIP device %s to be added. have %v", device, ip.Devices)
+	}
+	if _, ok := ip.Devices["a83dead"]; ok {
+		t.Errorf("expected stale v6 device to be removed. have %v", ip.Devices)
+	}
+	if _, ok := ip.Devices["10_1_1_1"]; !ok {
+		t.Errorf("expected v4 devices to be left alone. have %v", ip.Devices)
+	}
+	if len(ip.Advertised) != 1 || ip.Advertised[0] != "2001:558:1044:1ae:10ad:ba1a:0:7" {
+		t.Errorf("expected the v6 VIP to be announced. have %v", ip.Advertised)
+	}
+	if len(ipvs.SetIPVSCalls) != 1 || ipvs.SetIPVSCalls[0] != "ipv6" {
+		t.Errorf("expected one ipv6 ipvs apply, got %v", ipvs.SetIPVSCalls)
+	}
+
+	// the periodic announcement covers only the v6 VIPs too
+	ip.Advertised = nil
+	vips4, vips6 := d.vips(config)
+	d.announce(vips4, vips6, config.Announce)
+	if len(ip.Advertised) != 1 || ip.Advertised[0] != "2001:558:1044:1ae:10ad:ba1a:0:7" {
+		t.Errorf("expected only the v6 VIP to be announced. have %v", ip.Advertised)
+	}
+}
@@ -0,0 +1,115 @@
+package director
+
+import (
+	"context"
+	"net"
+
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+// LinkEvents reports the changes the kernel makes to the links and addresses
+// of the node until ctx is done, see system.LinkMonitor
+type LinkEvents interface {
+	Run(ctx context.Context, events chan<- system.LinkEvent) error
+}
+
+func (d *director) SetLinkRepair(links LinkEvents, device string) {
+	d.links = links
+	d.linkDevice = device
+}
+
+// watchLinks reconciles, and announces the VIPs again, as the changes to links
+// and addresses call for, see linkRepair
+func (d *director) watchLinks(ctx context.Context) error {
+	events := make(chan system.LinkEvent, 64)
+	done := make(chan error, 1)
+	go func() {
+		done <- d.links.Run(ctx, events)
+	}()
+
+	// up is whether each link was last seen up, so that only a link coming
+	// back up is acted on. index is the index of the device, which its slaves
+	// name as their master when it is a bond or a team.
+	up := map[string]bool{}
+	index := 0
+	if iface, err := net.InterfaceByName(d.linkDevice); err == nil {
+		index = iface.Index
+	}
+	for {
+		select {
+		case ev := <-events:
+			if ev.Device == d.linkDevice && ev.Index != 0 {
+				index = ev.Index
+			}
+			if ev.Type == system.LinkDown && ev.Device == d.linkDevice && up[ev.Device] {
+				d.logger.Warnf("director: %s went down", ev.Device)
+			}
+			repair, reannounce := linkRepair(ev, d.linkDevice, index, up, d.vipSet())
+			if ev.Type == system.LinkUp || ev.Type == system.LinkDown {
+				up[ev.Device] = ev.Type == system.LinkUp
+			}
+			if repair {
+				d.logger.Infof("director: reconciling at once after %s of %s %s", ev.Type, ev.Device, ev.Address)
+				d.metrics.LinkRepair(ev.Type)
+				d.RequestReconcile()
+			}
+			if reannounce && !repair {
+				d.logger.Infof("director: announcing every VIP again after %s of %s", ev.Type, ev.Device)
+			}
+			if reannounce {
+				select {
+				case d.reannounce <- struct{}{}:
+				default:
+					// one is already pending
+				}
+			}
+		case err := <-done:
+			return err
+		}
+	}
+}
+
+// linkRepair returns whether ev calls for a reconcile, to put back what was
+// removed, and for every VIP to be announced again. That is when an address of
+// vips is removed, when device comes back up, as neighbors may have forgotten
+// the VIPs while it was down, and when changes were dropped, as any of those
+// may have been. When device is a bond or a team, of the given index, the VIPs
+// are also announced again as it fails over, or one of its slaves comes up or
+// goes down, so that switches learn them on the port that now carries them. up
+// is whether each link was last seen up; a link not seen yet is taken to have
+// been down.
+func linkRepair(ev system.LinkEvent, device string, index int, up map[string]bool, vips map[string]bool) (bool, bool) {
+	switch ev.Type {
+	case system.AddressRemoved:
+		return vips[ev.Address], false
+	case system.BondFailover:
+		return false, device != "" && ev.Device == device
+	case system.LinkUp, system.LinkDown:
+		if index != 0 && ev.Master == index && up[ev.Device] != (ev.Type == system.LinkUp) {
+			return false, true
+		}
+		changed := ev.Type == system.LinkUp && device != "" && ev.Device == device && !up[ev.Device]
+		return changed, changed
+	case system.LinksOverrun:
+		return true, true
+	}
+	return false, false
+}
+
+// vipSet returns the VIPs the director programs for the current config, in
+// the form the kernel reports addresses in
+func (d *director) vipSet() map[string]bool {
+	config, _ := d.watcher.Current()
+	if config == nil {
+		return map[string]bool{}
+	}
+	vips4, vips6 := d.vips(d.overrides.Apply(config))
+	set := map[string]bool{}
+	for _, vip := range append(vips4, vips6...) {
+		if ip := net.ParseIP(vip); ip != nil {
+			vip = ip.String()
+		}
+		set[vip] = true
+	}
+	return set
+}
@@ -0,0 +1,85 @@
+package director
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+// fakeLinkEvents sends its events, then waits for ctx to be done
+type fakeLinkEvents []system.LinkEvent
+
+func (f fakeLinkEvents) Run(ctx context.Context, events chan<- system.LinkEvent) error {
+	for _, ev := range f {
+		events <- ev
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func TestLinkRepair(t *testing.T) {
+	vips := map[string]bool{"10.54.213.165": true}
+	for _, c := range []struct {
+		name       string
+		ev         system.LinkEvent
+		up         map[string]bool
+		repair     bool
+		reannounce bool
+	}{
+		{"vip removed", system.LinkEvent{Type: system.AddressRemoved, Device: "10_54_213_165", Address: "10.54.213.165"}, nil, true, false},
+		{"other address removed", system.LinkEvent{Type: system.AddressRemoved, Device: "eth0", Address: "10.131.153.76"}, nil, false, false},
+		{"vip added", system.LinkEvent{Type: system.AddressAdded, Device: "10_54_213_165", Address: "10.54.213.165"}, nil, false, false},
+		{"device back up", system.LinkEvent{Type: system.LinkUp, Device: "eth0"}, map[string]bool{"eth0": false}, true, true},
+		{"device first seen", system.LinkEvent{Type: system.LinkUp, Device: "eth0"}, nil, true, true},
+		{"device still up", system.LinkEvent{Type: system.LinkUp, Device: "eth0"}, map[string]bool{"eth0": true}, false, false},
+		{"other device up", system.LinkEvent{Type: system.LinkUp, Device: "eth1"}, nil, false, false},
+		{"device down", system.LinkEvent{Type: system.LinkDown, Device: "eth0"}, map[string]bool{"eth0": true}, false, false},
+		{"overrun", system.LinkEvent{Type: system.LinksOverrun}, nil, true, true},
+		{"bond failover", system.LinkEvent{Type: system.BondFailover, Device: "eth0"}, map[string]bool{"eth0": true}, false, true},
+		{"other bond failover", system.LinkEvent{Type: system.BondFailover, Device: "bond1"}, nil, false, false},
+		{"slave down", system.LinkEvent{Type: system.LinkDown, Device: "ens1", Master: 4}, map[string]bool{"ens1": true}, false, true},
+		{"slave up", system.LinkEvent{Type: system.LinkUp, Device: "ens1", Master: 4}, map[string]bool{"ens1": false}, false, true},
+		{"slave still up", system.LinkEvent{Type: system.LinkUp, Device: "ens1", Master: 4}, map[string]bool{"ens1": true}, false, false},
+		{"slave of another bond", system.LinkEvent{Type: system.LinkDown, Device: "ens3", Master: 7}, map[string]bool{"ens3": true}, false, false},
+	} {
+		repair, reannounce := linkRepair(c.ev, "eth0", 4, c.up, vips)
+		if repair != c.repair || reannounce != c.reannounce {
+			t.Errorf("%s: expected repair %v and reannounce %v. have %v and %v", c.name, c.repair, c.reannounce, repair, reannounce)
+		}
+	}
+}
+
+func TestWatchLinks(t *testing.T) {
+	d, _, _, _ := newTestDirector(testClusterConfig())
+	d.reconcileRequests = make(chan struct{}, 1)
+	d.reannounce = make(chan struct{}, 1)
+	d.SetLinkRepair(fakeLinkEvents{
+		{Type: system.LinkUp, Device: "eth0"},
+		{Type: system.LinkDown, Device: "eth0"},
+		{Type: system.AddressRemoved, Device: "10_54_213_165", Address: "10.54.213.165"},
+	}, "eth0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- d.watchLinks(ctx)
+	}()
+
+	select {
+	case <-d.reannounce:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the VIPs to be announced again when eth0 came up")
+	}
+	select {
+	case <-d.reconcileRequests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a reconcile to be requested")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,54 @@
+package director
+
+import (
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// nodeMailbox holds only the most recent node list. Put never blocks - a newer
+// list replaces one that hasn't been read yet - so a stalled consumer can neither
+// build a backlog of stale node sets nor hold up the producer.
+type nodeMailbox struct {
+	sync.Mutex
+	nodes []*corev1.Node
+	full  bool
+
+	// ready has a buffer of one and is signalled whenever the slot is filled
+	ready chan struct{}
+}
+
+func newNodeMailbox() *nodeMailbox {
+	return &nodeMailbox{
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// Put replaces the contents of the mailbox with nodes
+func (m *nodeMailbox) Put(nodes []*corev1.Node) {
+	m.Lock()
+	m.nodes = nodes
+	m.full = true
+	m.Unlock()
+
+	select {
+	case m.ready <- struct{}{}:
+	default:
+		// a signal is already pending and will pick up the new value
+	}
+}
+
+// Ready returns a channel that receives when the mailbox has been filled
+func (m *nodeMailbox) Ready() <-chan struct{} {
+	return m.ready
+}
+
+// Take empties the mailbox, returning the latest node list and whether there was one
+func (m *nodeMailbox) Take() ([]*corev1.Node, bool) {
+	m.Lock()
+	defer m.Unlock()
+	nodes, ok := m.nodes, m.full
+	m.nodes = nil
+	m.full = false
+	return nodes, ok
+}
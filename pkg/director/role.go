@@ -0,0 +1,99 @@
+package director
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// NodeRole labels the node of a director with types.RoleLabel while the
+// director is active, and clears the label when it no longer is. Whether the
+// director is active is polled, as it changes with elections that know
+// nothing of the kubernetes api, and a failed patch is retried on the next
+// poll.
+type NodeRole struct {
+	node     string
+	interval time.Duration
+	patch    func(ctx context.Context, patch []byte) error
+	logger   log.FieldLogger
+
+	// labeled is what the node was last successfully patched to, nil before
+	// the first patch, so that a label left behind by an earlier run is
+	// cleared
+	labeled *bool
+}
+
+// NewNodeRole creates a NodeRole for node that polls every interval
+func NewNodeRole(clientset kubernetes.Interface, node string, interval time.Duration, logger log.FieldLogger) *NodeRole {
+	return &NodeRole{
+		node:     node,
+		interval: interval,
+		patch: func(ctx context.Context, patch []byte) error {
+			_, err := clientset.CoreV1().Nodes().Patch(ctx, node, k8stypes.MergePatchType, patch, metav1.PatchOptions{})
+			return err
+		},
+		logger: logger.WithFields(log.Fields{"module": "director"}),
+	}
+}
+
+// Run labels the node by active until ctx is done, and then clears the label,
+// as a director that stops is no longer active
+func (r *NodeRole) Run(ctx context.Context, active func() bool) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.set(ctx, active())
+		select {
+		case <-ctx.Done():
+			clearCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			r.set(clearCtx, false)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// set patches the node when active differs from what it was last patched to
+func (r *NodeRole) set(ctx context.Context, active bool) {
+	if r.labeled != nil && *r.labeled == active {
+		return
+	}
+	patch, err := rolePatch(active, time.Now())
+	if err != nil {
+		r.logger.Errorf("director: unable to build the role patch of node %s. %v", r.node, err)
+		return
+	}
+	if err := r.patch(ctx, patch); err != nil {
+		r.logger.Warnf("director: unable to label node %s with %s active=%v. retrying in %v. %v", r.node, types.RoleLabel, active, r.interval, err)
+		return
+	}
+	if active {
+		r.logger.Infof("director: labeled node %s %s=%s", r.node, types.RoleLabel, types.RoleDirectorActive)
+	} else if r.labeled != nil {
+		r.logger.Infof("director: cleared %s from node %s", types.RoleLabel, r.node)
+	}
+	r.labeled = &active
+}
+
+// rolePatch is the merge patch that labels and annotates an active director's
+// node, or that removes both, null deleting a key in a merge patch
+func rolePatch(active bool, now time.Time) ([]byte, error) {
+	var label, since interface{}
+	if active {
+		label, since = types.RoleDirectorActive, now.UTC().Format(time.RFC3339)
+	}
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]interface{}{types.RoleLabel: label},
+			"annotations": map[string]interface{}{types.ActiveSinceAnnotation: since},
+		},
+	})
+}
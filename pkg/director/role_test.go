@@ -0,0 +1,62 @@
+package director
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestNodeRole(t *testing.T) {
+	patches := []string{}
+	var fail error
+	r := &NodeRole{
+		node:     "director-a",
+		interval: time.Second,
+		patch: func(_ context.Context, patch []byte) error {
+			if fail != nil {
+				return fail
+			}
+			patches = append(patches, string(patch))
+			return nil
+		},
+		logger: logrus.New(),
+	}
+	clear := `{"metadata":{"annotations":{"ravel.comcast.com/director-active-since":null},"labels":{"ravel.comcast.com/role":null}}}`
+
+	// a label left behind by an earlier run is cleared at once
+	r.set(context.Background(), false)
+	r.set(context.Background(), false)
+	if len(patches) != 1 || patches[0] != clear {
+		t.Fatalf("expected one patch clearing the label. have %v", patches)
+	}
+
+	// a failed patch is retried
+	fail = errors.New("forbidden")
+	r.set(context.Background(), true)
+	fail = nil
+	r.set(context.Background(), true)
+	r.set(context.Background(), true)
+	if len(patches) != 2 {
+		t.Fatalf("expected the label to be set once. have %v", patches)
+	}
+
+	// demotion clears it
+	r.set(context.Background(), false)
+	if len(patches) != 3 || patches[2] != clear {
+		t.Fatalf("expected the label to be cleared on demotion. have %v", patches)
+	}
+}
+
+func TestRolePatch(t *testing.T) {
+	patch, err := rolePatch(true, time.Date(2020, 3, 27, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"metadata":{"annotations":{"ravel.comcast.com/director-active-since":"2020-03-27T12:00:00Z"},"labels":{"ravel.comcast.com/role":"director-active"}}}`
+	if string(patch) != expected {
+		t.Fatalf("expected %s. have %s", expected, patch)
+	}
+}
@@ -0,0 +1,159 @@
+// Package handoff lets a new ravel process take a node over from the one it
+// replaces without a gap in service, as during a DaemonSet rolling update with
+// maxSurge. The running process serves a unix socket on a path both pods mount
+// from the host. A starting process connects to it and asks for the node; the
+// running process stops reconciling, without cleaning up, and answers once it
+// has. The new process then adopts the kernel state as it is, rather than
+// flushing it, and the old one exits.
+//
+// The protocol is a single line each way: the request "handoff", answered by
+// "released" or "error: <reason>".
+package handoff
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	request  = "handoff"
+	released = "released"
+
+	// DefaultTimeout is how long a request waits for the running process to
+	// release the node
+	DefaultTimeout = 30 * time.Second
+
+	// readTimeout is how long a connection may take to send its request
+	readTimeout = 5 * time.Second
+)
+
+// Request asks the process serving the socket at path to release the node, and
+// returns true once it has. When no process serves the socket, as on the first
+// start on a node, it returns false and no error.
+func Request(ctx context.Context, path string, timeout time.Duration, logger log.FieldLogger) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+		logger.Infof("handoff: no running process at %s to hand off from", path)
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("handoff: unable to connect to %s. %v", path, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	logger.Infof("handoff: asking the running process at %s to release the node", path)
+	if _, err := fmt.Fprintln(conn, request); err != nil {
+		return false, fmt.Errorf("handoff: unable to send request. %v", err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return false, fmt.Errorf("handoff: no reply from the running process. %v", err)
+	}
+	reply = strings.TrimSpace(reply)
+	if reply != released {
+		return false, fmt.Errorf("handoff: the running process refused. %s", reply)
+	}
+	logger.Info("handoff: the running process released the node")
+	return true, nil
+}
+
+// Serve answers handoff requests on a unix socket at path until ctx is done,
+// replacing any socket left there by a predecessor. The first request calls
+// release, which must stop reconciling without cleaning up. Once it returns
+// nil, the requester is told, the socket is closed, and the returned channel is
+// closed to tell the caller to exit. A release that fails is reported to the
+// requester, and the process keeps serving.
+func Serve(ctx context.Context, path string, release func() error, logger log.FieldLogger) (<-chan struct{}, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("handoff: unable to create the directory of %s. %v", path, err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("handoff: unable to remove the stale socket at %s. %v", path, err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("handoff: unable to listen at %s. %v", path, err)
+	}
+	listener := l.(*net.UnixListener)
+
+	done := make(chan struct{})
+	var once sync.Once
+	closeListener := func() { once.Do(func() { listener.Close() }) }
+
+	go func() {
+		<-ctx.Done()
+		closeListener()
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-ctx.Done():
+				case <-done:
+				default:
+					logger.Errorf("handoff: stopped serving %s. %v", path, err)
+				}
+				return
+			}
+			if serve(conn, release, listener, logger) {
+				close(done)
+				closeListener()
+				return
+			}
+		}
+	}()
+
+	logger.Infof("handoff: serving handoff requests at %s", path)
+	return done, nil
+}
+
+// serve answers a single connection, returning true when the node was released
+func serve(conn net.Conn, release func() error, listener *net.UnixListener, logger log.FieldLogger) bool {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		logger.Warnf("handoff: unable to read request. %v", err)
+		return false
+	}
+	if strings.TrimSpace(line) != request {
+		fmt.Fprintf(conn, "error: unknown request %q\n", strings.TrimSpace(line))
+		return false
+	}
+
+	logger.Info("handoff: a new process asked for the node. releasing it")
+	if err := release(); err != nil {
+		logger.Errorf("handoff: unable to release the node. %v", err)
+		fmt.Fprintf(conn, "error: %v\n", err)
+		return false
+	}
+
+	// the successor listens at the same path as soon as it has the reply, so
+	// closing this listener must not remove its socket
+	listener.SetUnlinkOnClose(false)
+	conn.SetWriteDeadline(time.Now().Add(readTimeout))
+	if _, err := fmt.Fprintln(conn, released); err != nil {
+		logger.Warnf("handoff: released the node, but unable to tell the new process. %v", err)
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package handoff
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestHandoff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handoff.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// nothing serves the socket on a node's first start
+	if ok, err := Request(ctx, path, time.Second, logrus.New()); ok || err != nil {
+		t.Fatalf("expected no handoff without a running process. have %v %v", ok, err)
+	}
+
+	// a release that fails leaves the running process serving
+	fail := true
+	releases := 0
+	done, err := Serve(ctx, path, func() error {
+		releases++
+		if fail {
+			return errors.New("reconcile in progress")
+		}
+		return nil
+	}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := Request(ctx, path, time.Second, logrus.New()); ok || err == nil {
+		t.Fatalf("expected the failed release to be reported. have %v %v", ok, err)
+	}
+	select {
+	case <-done:
+		t.Fatal("expected the running process to keep serving after a failed release")
+	default:
+	}
+
+	fail = false
+	if ok, err := Request(ctx, path, time.Second, logrus.New()); !ok || err != nil {
+		t.Fatalf("expected the node to be handed off. have %v %v", ok, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the running process to be told to exit")
+	}
+	if releases != 2 {
+		t.Fatalf("expected 2 releases. have %d", releases)
+	}
+
+	// the successor takes over the socket for the next handoff
+	next, err := Serve(ctx, path, func() error { return nil }, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := Request(ctx, path, time.Second, logrus.New()); !ok || err != nil {
+		t.Fatalf("expected the successor to hand off in turn. have %v %v", ok, err)
+	}
+	<-next
+}
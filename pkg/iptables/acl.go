@@ -0,0 +1,142 @@
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// aclChain is the mangle table chain that drops the clients a VIP port's ACL shuts out
+func (i *IPTables) aclChain() string {
+	return i.chain.String() + "-ACL"
+}
+
+// GenerateACLRules creates the mangle table rules that enforce the ACLs of the
+// v4 VIP ports, or of the v6 VIP ports when v6 is set. The rules hang off
+// PREROUTING, which sees VIP traffic before IPVS does on directors and before
+// the nat rules do on realservers. For each port the denied clients are
+// dropped first, then the allowed ones return and the rest are dropped. Ports
+// are rendered in sorted order so that an unchanged config renders identically.
+func (i *IPTables) GenerateACLRules(config *types.ClusterConfig, v6 bool) map[string]*RuleSet {
+	chain := i.aclChain()
+
+	rules := []string{}
+	if config != nil {
+		ports := config.Config
+		if v6 {
+			ports = config.Config6
+		}
+		for _, vp := range sortedVIPPorts(ports) {
+			def := ports[vp.vip][vp.port]
+			if def == nil || def.ACL.Empty() || def.Translated() {
+				continue
+			}
+			dest := fmt.Sprintf("%s/%d", vp.vip, hostPrefixLen(vp.vip))
+			for _, protocol := range getServiceProtocols(def.TCPEnabled, def.UDPEnabled) {
+				match := fmt.Sprintf("-d %s -p %s -m %s --dport %s", dest, protocol, protocol, vp.port)
+				for _, cidr := range cidrsOfFamily(def.ACL.Deny, v6) {
+					rules = append(rules, fmt.Sprintf("-A %s -s %s %s -j DROP", chain, cidr, match))
+				}
+				if len(def.ACL.Allow) == 0 {
+					continue
+				}
+				for _, cidr := range cidrsOfFamily(def.ACL.Allow, v6) {
+					rules = append(rules, fmt.Sprintf("-A %s -s %s %s -j RETURN", chain, cidr, match))
+				}
+				rules = append(rules, fmt.Sprintf("-A %s %s -j DROP", chain, match))
+			}
+		}
+	}
+
+	return map[string]*RuleSet{
+		"PREROUTING": {
+			ChainRule: ":PREROUTING ACCEPT",
+			Rules: []string{
+				"-A PREROUTING -j " + chain,
+			},
+		},
+		chain: {
+			ChainRule: ":" + chain + " - [0:0]",
+			Rules:     rules,
+		},
+	}
+}
+
+// ACLRulesBytes renders the v4 acl chain as iptables-restore input for the mangle table
+func (i *IPTables) ACLRulesBytes(config *types.ClusterConfig) []byte {
+	return bytesFromRulesForTable(util.TableMangle, i.GenerateACLRules(config, false))
+}
+
+// SetACL writes the acl chain into the v4 mangle table, and into the v6 one
+// when a v6 VIP port has an ACL or had one on the last pass, leaving any
+// chains that ravel does not own untouched. A table is only written when the
+// chain changes.
+func (i *IPTables) SetACL(config *types.ClusterConfig) error {
+	var err error
+	var written4, written6 bool
+	start := time.Now()
+	defer func() {
+		if written4 || written6 || err != nil {
+			i.metrics.IPTables("acl", 1, err, time.Since(start))
+		}
+	}()
+
+	if written4, err = i.restoreOwnedChain(util.TableMangle, i.aclChain(), i.GenerateACLRules(config, false)); err != nil {
+		return err
+	}
+
+	if !i.acl6 && !config.HasACL(true) {
+		return nil
+	}
+	if i.iptables6 == nil {
+		i.iptables6 = i.newRunner6()
+	}
+	if written6, err = restoreOwnedChain(i.iptables6, util.TableMangle, i.aclChain(), i.GenerateACLRules(config, true)); err != nil {
+		return err
+	}
+	// keep writing the v6 chain after the last v6 ACL goes, so that it is emptied
+	i.acl6 = config.HasACL(true)
+	return nil
+}
+
+// vipPort is a port of a VIP in the cluster config
+type vipPort struct {
+	vip  types.ServiceIP
+	port string
+}
+
+// sortedVIPPorts returns the VIP ports of config sorted by VIP and port
+func sortedVIPPorts(config map[types.ServiceIP]types.PortMap) []vipPort {
+	out := []vipPort{}
+	for vip, ports := range config {
+		for port := range ports {
+			out = append(out, vipPort{vip: vip, port: port})
+		}
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if out[a].vip != out[b].vip {
+			return out[a].vip < out[b].vip
+		}
+		return out[a].port < out[b].port
+	})
+	return out
+}
+
+// cidrsOfFamily returns the CIDRs in cidrs that are v6, when v6 is set, or v4
+func cidrsOfFamily(cidrs []string, v6 bool) []string {
+	out := []string{}
+	for _, cidr := range cidrs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		if (ip.To4() == nil) == v6 {
+			out = append(out, cidr)
+		}
+	}
+	return out
+}
@@ -0,0 +1,83 @@
+package iptables
+
+import (
+	"strings"
+)
+
+// Cardinality is the size of the ravel chains of a table, which iptables
+// slows down with as its rules grow and packets traverse them in sequence
+type Cardinality struct {
+	// Chains and Rules are the number of ravel chains and of the rules in
+	// them, and Longest is the number of rules of the longest one
+	Chains  int
+	Rules   int
+	Longest int
+
+	// Depth is the most ravel chains a packet can pass through, following
+	// the jumps between them
+	Depth int
+}
+
+// cardinality measures the chains of rules named with prefix
+func cardinality(prefix string, rules map[string]*RuleSet) Cardinality {
+	c := Cardinality{}
+	for chain, set := range rules {
+		if !strings.HasPrefix(chain, prefix) {
+			continue
+		}
+		c.Chains++
+		c.Rules += len(set.Rules)
+		if len(set.Rules) > c.Longest {
+			c.Longest = len(set.Rules)
+		}
+	}
+
+	depths := map[string]int{}
+	visiting := map[string]bool{}
+	var depth func(chain string) int
+	depth = func(chain string) int {
+		if d, ok := depths[chain]; ok {
+			return d
+		}
+		// a loop of jumps is refused by iptables, but the rules given may not
+		// have been restored yet
+		if visiting[chain] {
+			return 0
+		}
+		visiting[chain] = true
+		deepest := 0
+		for _, rule := range rules[chain].Rules {
+			target := jumpTarget(rule)
+			if _, ok := rules[target]; !ok || !strings.HasPrefix(target, prefix) {
+				continue
+			}
+			if d := depth(target); d > deepest {
+				deepest = d
+			}
+		}
+		visiting[chain] = false
+		depths[chain] = deepest + 1
+		return deepest + 1
+	}
+	for chain := range rules {
+		if !strings.HasPrefix(chain, prefix) {
+			continue
+		}
+		if d := depth(chain); d > c.Depth {
+			c.Depth = d
+		}
+	}
+	return c
+}
+
+// jumpTarget returns the chain a rule jumps or goes to, or an empty string
+func jumpTarget(rule string) string {
+	fields := strings.Fields(rule)
+	for n := 0; n < len(fields)-1; n++ {
+		switch fields[n] {
+		case "-j", "--jump", "-g", "--goto":
+			return fields[n+1]
+		}
+	}
+	return ""
+}
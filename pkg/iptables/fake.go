@@ -0,0 +1,227 @@
+package iptables
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// FakeRuleApplier is an in-memory RuleApplier for tests. Rule generation and
+// merging are the production implementations; Save, Restore and Flush act on
+// Table instead of the host.
+type FakeRuleApplier struct {
+	*IPTables
+
+	mu sync.Mutex
+
+	// Table is the current nat table
+	Table map[string]*RuleSet
+
+	// Raw is the current raw table
+	Raw map[string]*RuleSet
+
+	// Filter is the current filter table
+	Filter map[string]*RuleSet
+
+	// Mangle and Mangle6 are the current v4 and v6 mangle tables, and Mappings
+	// the address mappings of the translator
+	Mangle   map[string]*RuleSet
+	Mangle6  map[string]*RuleSet
+	Mappings []string
+
+	Restores int
+	Flushes  int
+
+	// RestoreErr, when set, is returned by Restore
+	RestoreErr error
+}
+
+// NewFakeRuleApplier creates a FakeRuleApplier with an empty nat table
+func NewFakeRuleApplier(chain string, masq bool, logger log.FieldLogger) *FakeRuleApplier {
+	return &FakeRuleApplier{
+		IPTables: &IPTables{
+			chain:     util.Chain(chain),
+			masqChain: util.Chain(chain + "-MASQ"),
+			table:     util.TableNAT,
+			masq:      masq,
+			ctx:       context.Background(),
+			logger:    logger,
+			metrics:   nopMetrics{},
+		},
+		Table: map[string]*RuleSet{
+			"PREROUTING": {ChainRule: ":PREROUTING ACCEPT [0:0]"},
+		},
+	}
+}
+
+func (f *FakeRuleApplier) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Flushes++
+	if set, ok := f.Table[f.chain.String()]; ok {
+		set.Rules = nil
+	}
+	return nil
+}
+
+func (f *FakeRuleApplier) Save() (map[string]*RuleSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := map[string]*RuleSet{}
+	for chain, set := range f.Table {
+		out[chain] = &RuleSet{
+			ChainRule: set.ChainRule,
+			Rules:     append([]string{}, set.Rules...),
+		}
+	}
+	return out, nil
+}
+
+func (f *FakeRuleApplier) Restore(rules map[string]*RuleSet) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Restores++
+	if f.RestoreErr != nil {
+		return f.RestoreErr
+	}
+	// copied, as the merged rules share their slices with the caller's sets
+	f.Table = map[string]*RuleSet{}
+	for chain, set := range rules {
+		f.Table[chain] = &RuleSet{
+			ChainRule: set.ChainRule,
+			Rules:     append([]string{}, set.Rules...),
+		}
+	}
+	return nil
+}
+
+func (f *FakeRuleApplier) SetNotrack(config *types.ClusterConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Raw = restoreOwnedFake(f.Raw, f.notrackChain(), f.GenerateNotrackRules(config))
+	return nil
+}
+
+func (f *FakeRuleApplier) SetMaintenance(config *types.ClusterConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Filter = restoreOwnedFake(f.Filter, f.maintenanceChain(), f.GenerateMaintenanceRules(config))
+	return nil
+}
+
+func (f *FakeRuleApplier) SetTranslation(config *types.ClusterConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Mangle = restoreOwnedFake(f.Mangle, f.translateChain(), f.GenerateTranslationRules(config, false))
+	f.Mangle6 = restoreOwnedFake(f.Mangle6, f.translateChain(), f.GenerateTranslationRules(config, true))
+	f.Mappings = TranslationMappings(config)
+	return nil
+}
+
+func (f *FakeRuleApplier) SetACL(config *types.ClusterConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Mangle = restoreOwnedFake(f.Mangle, f.aclChain(), f.GenerateACLRules(config, false))
+	f.Mangle6 = restoreOwnedFake(f.Mangle6, f.aclChain(), f.GenerateACLRules(config, true))
+	return nil
+}
+
+func (f *FakeRuleApplier) SetSYNProxy(config *types.ClusterConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	raw, filter := f.GenerateSYNProxyRules(config)
+	f.Filter = restoreOwnedFake(f.Filter, f.synproxyChain(), filter)
+	f.Raw = restoreOwnedFake(f.Raw, f.synproxyChain(), raw)
+	return nil
+}
+
+func (f *FakeRuleApplier) SetTProxy(config *types.ClusterConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.tproxyMark == 0 {
+		return nil
+	}
+	f.Mangle = restoreOwnedFake(f.Mangle, f.tproxyChain(), f.GenerateTProxyRules(config, false))
+	f.Mangle6 = restoreOwnedFake(f.Mangle6, f.tproxyChain(), f.GenerateTProxyRules(config, true))
+	return nil
+}
+
+func (f *FakeRuleApplier) SetMirror(config *types.ClusterConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.mirrorMark == 0 {
+		return nil
+	}
+	f.Mangle = restoreOwnedFake(f.Mangle, f.mirrorChain(), f.GenerateMirrorRules(config, false))
+	f.Mangle6 = restoreOwnedFake(f.Mangle6, f.mirrorChain(), f.GenerateMirrorRules(config, true))
+	return nil
+}
+
+func (f *FakeRuleApplier) SetFwmarks(marks []types.ECMPFwmark, steering []types.SteeringFwmark) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Mangle = restoreOwnedFake(f.Mangle, f.fwmarkChain(), f.GenerateFwmarkRules(marks, steering))
+	return nil
+}
+
+// restoreOwnedFake is restoreOwnedChain for an in-memory table, which several
+// owned chains share
+func restoreOwnedFake(table map[string]*RuleSet, chain string, generated map[string]*RuleSet) map[string]*RuleSet {
+	if table == nil {
+		table = map[string]*RuleSet{}
+	}
+	for name, set := range generated {
+		if name == chain {
+			table[name] = set
+			continue
+		}
+		if _, ok := table[name]; !ok {
+			table[name] = &RuleSet{ChainRule: set.ChainRule}
+		}
+		for _, rule := range set.Rules {
+			found := false
+			for _, existing := range table[name].Rules {
+				if rule == existing {
+					found = true
+					break
+				}
+			}
+			if !found {
+				table[name].Rules = append(table[name].Rules, rule)
+			}
+		}
+	}
+	return table
+}
+
+// Lines returns every rule in the table that starts with prefix
+func (f *FakeRuleApplier) Lines(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := []string{}
+	for _, set := range f.Table {
+		for _, rule := range set.Rules {
+			if strings.HasPrefix(rule, prefix) {
+				out = append(out, rule)
+			}
+		}
+	}
+	return out
+}
+
+// nopMetrics discards iptables metrics so that fakes don't register collectors
+type nopMetrics struct{}
+
+func (nopMetrics) IPTables(operation string, tries int, err error, d time.Duration) {}
+func (nopMetrics) Restored(mode string, chains, rules, bytes int)                   {}
+func (nopMetrics) Cardinality(c Cardinality)                                        {}
+func (nopMetrics) ChainRemoved(name, rule string)                                   {}
+func (nopMetrics) ChainGauge(l int, kind string)                                    {}
+func (nopMetrics) LockWait(family string)                                           {}
+
+var _ RuleApplier = &FakeRuleApplier{}
@@ -0,0 +1,99 @@
+package iptables
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// fwmarkChain is the mangle table chain that marks ECMP and steered VIP traffic
+func (i *IPTables) fwmarkChain() string {
+	return i.chain.String() + "-FWMARK"
+}
+
+// GenerateFwmarkRules creates the mangle table rules that mark inbound VIP traffic
+// with the fwmarks that IPVS uses for ECMP services and steered clients. The
+// steering rules come first, in the order they match clients, and return once
+// a mark is set so that neither a later steering rule nor the ECMP mark of the
+// VIP port replaces it. The mark replaces any mark the packet already has, see
+// types.ECMPFwmarkMask.
+func (i *IPTables) GenerateFwmarkRules(marks []types.ECMPFwmark, steering []types.SteeringFwmark) map[string]*RuleSet {
+	chain := i.fwmarkChain()
+
+	rules := []string{}
+	for _, m := range steering {
+		for _, source := range m.Rule.Sources {
+			rules = append(rules, fmt.Sprintf("-A %s -s %s -d %s/32 -p %s -m %s --dport %s -j MARK --set-xmark %#x/%#x",
+				chain, source, m.VIP, m.Protocol, m.Protocol, m.Port, m.Mark, types.ECMPFwmarkMask))
+		}
+		rules = append(rules, fmt.Sprintf("-A %s -m mark --mark %#x/%#x -j RETURN", chain, m.Mark, types.ECMPFwmarkMask))
+	}
+	for _, m := range marks {
+		rules = append(rules, fmt.Sprintf("-A %s -d %s/32 -p %s -m %s --dport %s -j MARK --set-xmark %#x/%#x",
+			chain, m.VIP, m.Protocol, m.Protocol, m.Port, m.Mark, types.ECMPFwmarkMask))
+	}
+
+	return map[string]*RuleSet{
+		"PREROUTING": {
+			ChainRule: ":PREROUTING ACCEPT",
+			Rules: []string{
+				"-A PREROUTING -j " + chain,
+			},
+		},
+		chain: {
+			ChainRule: ":" + chain + " - [0:0]",
+			Rules:     rules,
+		},
+	}
+}
+
+// FwmarkRulesBytes renders the fwmark chain as iptables-restore input for the mangle table
+func (i *IPTables) FwmarkRulesBytes(marks []types.ECMPFwmark, steering []types.SteeringFwmark) []byte {
+	return bytesFromRulesForTable(util.TableMangle, i.GenerateFwmarkRules(marks, steering))
+}
+
+// SetFwmarks writes the fwmark chain into the mangle table, leaving any
+// chains that ravel does not own untouched.
+func (i *IPTables) SetFwmarks(marks []types.ECMPFwmark, steering []types.SteeringFwmark) error {
+	var err error
+	start := time.Now()
+	defer func() {
+		i.metrics.IPTables("fwmark", 1, err, time.Since(start))
+	}()
+
+	_, err = i.restoreOwnedChain(util.TableMangle, i.fwmarkChain(), i.GenerateFwmarkRules(marks, steering))
+	return err
+}
+
+// restoreOwnedChain replaces chain in table with the generated rules and makes
+// sure the generated jump rules in the builtin chains are present, with
+// iptables-restore --noflush. Chains that ravel does not own are left untouched. Nothing is written when the table
+// already holds the generated rules, and the returned bool reports whether
+// the table was written.
+func (i *IPTables) restoreOwnedChain(table util.Table, chain string, generated map[string]*RuleSet) (bool, error) {
+	return restoreOwnedChain(i.iptables, table, chain, generated)
+}
+
+// restoreOwnedChain is IPTables.restoreOwnedChain for any runner, so that
+// ip6tables chains can be written too
+func restoreOwnedChain(runner *util.Runner, table util.Table, chain string, generated map[string]*RuleSet) (bool, error) {
+	b, err := runner.Save(table)
+	if err != nil {
+		return false, fmt.Errorf("iptables: unable to save %s table. %v", table, err)
+	}
+	existing, err := GetSaveLines(table, b)
+	if err != nil {
+		return false, err
+	}
+
+	// only the chain, and the jumps missing from the builtin chains, are
+	// written, so the chains of other programs are never flushed
+	out, _, _ := scopedRestore(table, chain, false, generated, existing)
+	if out == nil {
+		return false, nil
+	}
+	err = runner.Restore(table, out, util.NoFlushTables, util.RestoreCounters)
+	return err == nil, err
+}
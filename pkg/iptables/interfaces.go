@@ -0,0 +1,28 @@
+package iptables
+
+import (
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// RuleApplier describes generation and application of the ravel iptables chains.
+// IPTables is the production implementation; FakeRuleApplier holds the table in memory.
+type RuleApplier interface {
+	Flush() error
+	Save() (map[string]*RuleSet, error)
+	Restore(rules map[string]*RuleSet) error
+	Merge(subset map[string]*RuleSet, wholeset map[string]*RuleSet) (map[string]*RuleSet, int, error)
+	BaseChain() string
+	GenerateRules(config *types.ClusterConfig) (map[string]*RuleSet, error)
+	GenerateRulesForNodeClassic(w *watcher.Watcher, nodeName string, config *types.ClusterConfig, useWeightedService bool) (map[string]*RuleSet, error)
+	SetNotrack(config *types.ClusterConfig) error
+	SetMaintenance(config *types.ClusterConfig) error
+	SetTranslation(config *types.ClusterConfig) error
+	SetACL(config *types.ClusterConfig) error
+	SetSYNProxy(config *types.ClusterConfig) error
+	SetTProxy(config *types.ClusterConfig) error
+	SetMirror(config *types.ClusterConfig) error
+	SetFwmarks(marks []types.ECMPFwmark, steering []types.SteeringFwmark) error
+}
+
+var _ RuleApplier = &IPTables{}
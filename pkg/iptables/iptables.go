@@ -1,15 +1,19 @@
 package iptables
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/base32"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/Comcast/Ravel/pkg/types"
 	"github.com/Comcast/Ravel/pkg/util"
+	utildbus "github.com/Comcast/Ravel/pkg/util/dbus"
+	utilexec "github.com/Comcast/Ravel/pkg/util/exec"
 	"github.com/Comcast/Ravel/pkg/watcher"
 	log "github.com/sirupsen/logrus"
 )
@@ -32,6 +36,57 @@ type IPTables struct {
 	// cli flag to exclude packets where the client ip is in this cidr range
 	podCidrMasq string
 
+	// probeMark, when set, sends locally generated packets carrying the mark
+	// through the ravel chain
+	probeMark int
+
+	// verify reads the nat table back after every restore, see SetVerify
+	verify        bool
+	verifyRetries int
+	verifyMetrics verifyMetrics
+
+	// scoped restores only write the ravel chains that differ from saved, the
+	// table as of the last Save. see SetScopedRestore
+	scoped bool
+	saved  map[string]*RuleSet
+
+	// jumpFirst places the ravel jumps ahead of other rules in the builtin
+	// chains, see SetJumpFirst
+	jumpFirst bool
+
+	// diffLog records the changes each Merge makes, see SetDiffLog
+	diffLog *util.DiffLog
+
+	// waiting for the xtables lock, see SetLockWait
+	lockWait    time.Duration
+	lockRetries int
+
+	// translation of VIP ports into the other family, see EnableTranslation.
+	// iptables6 writes the v6 mangle table and exec runs jool_siit
+	siitInstance string
+	siitPool6    string
+	iptables6    *util.Runner
+	exec         utilexec.Interface
+
+	// acl6 is set while the v6 acl chain holds rules, see SetACL
+	acl6 bool
+
+	// transparent proxying of VIP ports, see EnableTProxy. tproxy4 and tproxy6
+	// are set while the policy routing of the family is in place
+	tproxyMark  int
+	tproxyTable int
+	tproxy4     bool
+	tproxy6     bool
+
+	// mirroring of VIP ports to a shadow backend, see EnableMirror. mirror4
+	// and mirror6 are set while the chain of the family holds rules
+	mirrorMark int
+	mirror4    bool
+	mirror6    bool
+
+	// scope, when set, is the context commands run under, see SetScope
+	scope *util.Scope
+
 	ctx     context.Context
 	logger  log.FieldLogger
 	metrics iptablesMetrics
@@ -53,6 +108,43 @@ func NewIPTables(ctx context.Context, lbKind, configKey, podCidrMasq, chain stri
 	}, nil
 }
 
+// SetExec runs iptables and the other commands of the manager through exec,
+// i.e. a privileged agent, rather than directly. Call it before the other setters.
+func (i *IPTables) SetExec(exec utilexec.Interface) {
+	i.exec = exec
+	i.iptables = util.New(exec, utildbus.New(), util.ProtocolIpv4)
+	i.iptables.SetLockWait(i.lockWait, i.lockRetries, func() { i.metrics.LockWait("ipv4") })
+	if i.scope != nil {
+		i.iptables.SetScope(i.scope)
+	}
+}
+
+// SetScope runs the iptables commands under the context of scope, so that a
+// reconcile that binds it cancels the commands it started once it runs out of
+// time or is stopped
+func (i *IPTables) SetScope(scope *util.Scope) {
+	i.scope = scope
+	i.iptables.SetScope(scope)
+	if i.iptables6 != nil {
+		i.iptables6.SetScope(scope)
+	}
+}
+
+// cmdContext is the context commands run under
+func (i *IPTables) cmdContext() context.Context {
+	if i.scope != nil {
+		return i.scope.Context()
+	}
+	return i.ctx
+}
+
+// EnableProbeMark routes locally generated packets carrying mark through the ravel
+// chain, so that a realserver can send probes through its own VIP rules. Only
+// marked packets are affected; other local traffic to a VIP is left alone.
+func (i *IPTables) EnableProbeMark(mark int) {
+	i.probeMark = mark
+}
+
 func (i *IPTables) Flush() error {
 	// Make several attempts to flush the chain.  Warn on failures.
 	var err error
@@ -91,37 +183,65 @@ func (i *IPTables) Save() (map[string]*RuleSet, error) {
 	if err != nil {
 		return nil, err
 	}
-	return i.rulesFromBytes(b)
+	rules, err := i.rulesFromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	if i.scoped {
+		i.saved = rules
+	}
+	return rules, nil
 }
 
+// Restore writes rules to the nat table. With SetVerify, the table is read back
+// afterwards and restored again while the ravel chains don't match rules.
 func (i *IPTables) Restore(rules map[string]*RuleSet) error {
+	if err := i.restore(rules); err != nil {
+		return err
+	}
+	if i.verify {
+		return i.verifyRestore(rules)
+	}
+	return nil
+}
+
+func (i *IPTables) restore(rules map[string]*RuleSet) error {
+	if i.scoped {
+		if ok, err := i.restoreScoped(rules); ok {
+			return err
+		}
+	}
+
 	var err error
 	start := time.Now()
 	defer func() {
 		i.metrics.IPTables("restore", 1, err, time.Since(start))
 	}()
+	total := 0
+	for _, set := range rules {
+		total += len(set.Rules)
+	}
 	b := BytesFromRules(rules)
+	i.metrics.Restored("full", len(rules), total, len(b))
+	i.metrics.Cardinality(cardinality(i.chain.String(), rules))
 	err = i.iptables.Restore(i.table, b, util.FlushTables, util.RestoreCounters)
 	return err
 }
 
+// Merge returns wholeset with the ravel chains replaced by those in subset and
+// the jumps in subset added to the builtin chains. The rules of chains that are
+// kept as they are share their slices with wholeset rather than being copied, so
+// neither set may be modified afterwards.
 func (i *IPTables) Merge(subset map[string]*RuleSet, wholeset map[string]*RuleSet) (map[string]*RuleSet, int, error) {
-	out := map[string]*RuleSet{}
+	out := make(map[string]*RuleSet, len(wholeset)+len(subset))
 
-	// create a copy of the whole set, excluding the kube-ipvs chain
+	// take the whole set, excluding the ravel chains
 	for chain, set := range wholeset {
 		// Remove any prefixed chains. We want to deal with them separately
 		if strings.HasPrefix(chain, i.chain.String()) {
 			continue
 		}
-		out[chain] = &RuleSet{
-			ChainRule: set.ChainRule,
-			Rules:     make([]string, len(set.Rules)),
-		}
-
-		for i, rule := range set.Rules {
-			out[chain].Rules[i] = rule
-		}
+		out[chain] = set
 
 		// This is a fix for the KUBE-MARK-DROP chain in kubernetes 1.11.
 		// This chain is supposed to contain a single packet marking rule, but in kube 1.11,
@@ -129,32 +249,45 @@ func (i *IPTables) Merge(subset map[string]*RuleSet, wholeset map[string]*RuleSe
 		// service chain.
 		if chain == "KUBE-MARK-DROP" {
 			kubeMarkDropSeen := map[string]bool{}
-			rules := []string{}
+			rules := make([]string, 0, len(set.Rules))
 			for _, rule := range set.Rules {
 				if _, seen := kubeMarkDropSeen[rule]; seen {
 					continue
 				}
 				rules = append(rules, rule)
 			}
-			out[chain].Rules = rules
+			out[chain] = &RuleSet{ChainRule: set.ChainRule, Rules: rules}
 		}
 	}
 
-	// update prerouting if necessary
-	for _, subsetRule := range subset["PREROUTING"].Rules {
-		found := false
-		for _, rule := range wholeset["PREROUTING"].Rules {
-			if subsetRule == rule {
-				found = true
-			}
+	// add the jumps into the builtin chains if necessary. the rest of a builtin
+	// chain belongs to other programs, i.e. kube-proxy, and is left as is
+	for _, builtin := range builtinChains {
+		set, ok := subset[builtin]
+		if !ok {
+			continue
+		}
+		existing, ok := out[builtin]
+		if !ok {
+			existing = &RuleSet{ChainRule: set.ChainRule}
 		}
-		if !found {
-			out["PREROUTING"].Rules = append(out["PREROUTING"].Rules, subsetRule)
+		if i.jumpFirst {
+			out[builtin] = &RuleSet{ChainRule: existing.ChainRule, Rules: rulesFirst(set.Rules, existing.Rules)}
+			continue
+		}
+		missing := missingRules(set.Rules, existing.Rules)
+		if len(missing) == 0 {
+			out[builtin] = existing
+			continue
 		}
+		// copied, so that appending doesn't write into wholeset
+		rules := make([]string, 0, len(existing.Rules)+len(missing))
+		rules = append(rules, existing.Rules...)
+		out[builtin] = &RuleSet{ChainRule: existing.ChainRule, Rules: append(rules, missing...)}
 	}
 
 	for chainName, ruleSet := range subset {
-		if chainName == "PREROUTING" {
+		if isBuiltinChain(chainName) {
 			continue
 		}
 		out[chainName] = ruleSet
@@ -175,9 +308,73 @@ func (i *IPTables) Merge(subset map[string]*RuleSet, wholeset map[string]*RuleSe
 	i.metrics.ChainGauge(sep, "ravel-endpoints")
 	i.metrics.ChainGauge(all, "total")
 
+	if i.diffLog != nil {
+		i.diffLog.Log("iptables-"+string(i.table), ruleLines(i.table, wholeset), ruleLines(i.table, out))
+	}
+
 	return out, 0, nil
 }
 
+// SetDiffLog records the diff between the existing and the merged rules of
+// every Merge in l
+func (i *IPTables) SetDiffLog(l *util.DiffLog) {
+	i.diffLog = l
+}
+
+// ruleLines renders rules as the lines of an iptables-restore input
+func ruleLines(table util.Table, rules map[string]*RuleSet) []string {
+	return strings.Split(strings.TrimSuffix(string(bytesFromRulesForTable(table, rules)), "\n"), "\n")
+}
+
+// SetJumpFirst places the ravel jumps at the head of the builtin chains, moving
+// them there when they are found further down, so that they are evaluated before
+// the rules of other programs such as kube-proxy
+func (i *IPTables) SetJumpFirst() {
+	i.jumpFirst = true
+}
+
+// rulesFirst returns first followed by the rules of existing that aren't in first
+func rulesFirst(first, existing []string) []string {
+	in := make(map[string]bool, len(first))
+	for _, rule := range first {
+		in[rule] = true
+	}
+	rules := make([]string, 0, len(first)+len(existing))
+	rules = append(rules, first...)
+	for _, rule := range existing {
+		if !in[rule] {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// addProbeMarkJump adds the jump of locally generated packets carrying the
+// probe mark into the ravel chain to out, when the mark is set
+func (i *IPTables) addProbeMarkJump(out map[string]*RuleSet) {
+	if i.probeMark == 0 {
+		return
+	}
+	out["OUTPUT"] = &RuleSet{
+		ChainRule: ":OUTPUT ACCEPT",
+		Rules: []string{
+			fmt.Sprintf("-A OUTPUT -m mark --mark %#x/%#x -j %s", i.probeMark, i.probeMark, i.chain),
+		},
+	}
+}
+
+// builtinChains are the nat chains that ravel jumps from but doesn't own
+var builtinChains = []string{"PREROUTING", "OUTPUT"}
+
+func isBuiltinChain(chain string) bool {
+	for _, builtin := range builtinChains {
+		if chain == builtin {
+			return true
+		}
+	}
+	return false
+}
+
 func chainStats(prefix string, subset map[string]*RuleSet) (total, match, svc, sep int) {
 	for key, chain := range subset {
 		ruleCount := len(chain.Rules)
@@ -194,17 +391,30 @@ func chainStats(prefix string, subset map[string]*RuleSet) (total, match, svc, s
 	return total, match, svc, sep
 }
 
+// configuredPorts is the number of VIP ports in config, for sizing the rules
+// generated from it up front
+func configuredPorts(config *types.ClusterConfig) int {
+	ports := 0
+	for _, services := range config.Config {
+		ports += len(services)
+	}
+	return ports
+}
+
 // GenerateRules generates a ruleset for only kube-ipvs.  a different function ought to merge these
 // XXX chain rule.  This os only used by realserver package stuff seemingly.
 func (i *IPTables) GenerateRules(config *types.ClusterConfig) (map[string]*RuleSet, error) {
-	// output the configured servces that rules will be generated with to help with debugging
-	services := []string{}
-	for _, v := range config.Config {
-		for _, sc := range v {
-			services = append(services, sc.Namespace+"/"+sc.Service+":"+sc.PortName)
+	// output the configured servces that rules will be generated with to help with debugging.
+	// the list is only built when it will be logged
+	if log.IsLevelEnabled(log.DebugLevel) {
+		services := []string{}
+		for _, v := range config.Config {
+			for _, sc := range v {
+				services = append(services, sc.Namespace+"/"+sc.Service+":"+sc.PortName)
+			}
 		}
+		log.Debugln("iptables: GenerateRules: running for", len(config.Config), "services:", strings.Join(services, ","))
 	}
-	log.Debugln("iptables: GenerateRules: running for", len(config.Config), "services:", strings.Join(services, ","))
 
 	out := map[string]*RuleSet{
 		"PREROUTING": {
@@ -223,21 +433,44 @@ func (i *IPTables) GenerateRules(config *types.ClusterConfig) (map[string]*RuleS
 			ChainRule: ":" + i.chain.String() + " - [0:0]",
 		},
 	}
+	i.addProbeMarkJump(out)
 
 	// format strings for masq and jump rules
 	masqFmt := fmt.Sprintf(`-A %s -d %%s/32 -p %%s -m %%s --dport %%s -m comment --comment "%%s" -j %s`, i.chain, i.masqChain)
 	jumpFmt := fmt.Sprintf(`-A %s -d %%s/32 -p %%s -m %%s --dport %%s -m comment --comment "%%s" -j %%s`, i.chain)
+	steerFmt := fmt.Sprintf(`-A %s -s %%s -d %%s/32 -p %%s -m %%s --dport %%s -m comment --comment "%%s" -j %%s`, i.chain)
 
 	// walk the service configuration and apply all rules
-	rules := []string{}
+	rules := make([]string, 0, 2*configuredPorts(config))
 	for serviceIP, services := range config.Config {
+		// traffic to VIPs in maintenance is stopped by the maintenance chain
+		if _, ok := config.InMaintenance(serviceIP); ok {
+			continue
+		}
 		dest := string(serviceIP)
 		for dport, service := range services {
+			// translated ports reach the realservers in the family of the paired VIP
+			if service.Translated() {
+				continue
+			}
 			protocols := getServiceProtocols(service.TCPEnabled, service.UDPEnabled)
 			ident := types.MakeIdent(service.Namespace, service.Service, service.PortName)
 			for _, prot := range protocols {
 				chain := servicePortChainName(ident, prot)
 				rules = append(rules, fmt.Sprintf(masqFmt, dest, prot, prot, dport, ident))
+
+				// clients steered to another service go to its chain instead
+				for _, steer := range service.Steering {
+					if steer.Service == "" {
+						continue
+					}
+					target := steer.Target(service)
+					targetIdent := types.MakeIdent(target.Namespace, target.Service, target.PortName)
+					for _, source := range steer.Sources {
+						rules = append(rules, fmt.Sprintf(steerFmt, source, dest, prot, prot, dport, targetIdent, servicePortChainName(targetIdent, prot)))
+					}
+				}
+
 				rules = append(rules, fmt.Sprintf(jumpFmt, dest, prot, prot, dport, ident, chain))
 			}
 		}
@@ -272,19 +505,33 @@ func (i *IPTables) GenerateRulesForNodeClassic(w *watcher.Watcher, nodeName stri
 			ChainRule: ":" + i.chain.String() + " - [0:0]",
 		},
 	}
+	i.addProbeMarkJump(out)
 
 	// format strings for masq and jump rules
 	// -A RAVEL -d 10.131.66.53/32 -p tcp -m tcp --dport 7888 -m comment --comment "altcon-sp-prod-01/fourier-proxy:proxy" -j RAVEL-SVC-BGKZXXYGCDWHIHEO
 	masqFmt := fmt.Sprintf(`-A %s -d %%s/32 -p %%s -m %%s --dport %%s -m comment --comment "%%s" -j %s`, i.chain, i.masqChain)
 	weightedJumpFmt := fmt.Sprintf(`-A %s -d %%s/32 -p %%s -m %%s --dport %%s -m comment --comment "%%s"  -m statistic --mode random --probability %%0.11f -j %%s`, i.chain)
 	jumpFmt := fmt.Sprintf(`-A %s -d %%s/32 -p %%s -m %%s --dport %%s -m comment --comment "%%s" -j %%s`, i.chain)
+	hairpinFmt := fmt.Sprintf(`-A %s -s %%s -d %%s/32 -p %%s -m %%s --dport %%s -m comment --comment "%%s" -j MARK --set-xmark %s`, i.chain, masqMark)
+
+	// traffic from the node's own pods to hairpinned VIP ports is marked for
+	// masquerade, bypassing the pod cidr exclusion of the masq chain
+	podCIDRs := cidrsOfFamily(w.PodCIDRsForNode(nodeName), false)
 
 	// walk the service configuration and apply all rules
 	// eg: this section appears to be for pods ON on this node, but NOT on other nodes?
-	rules := []string{}
+	rules := make([]string, 0, 2*configuredPorts(config))
 	for serviceIP, services := range config.Config {
+		// traffic to VIPs in maintenance is stopped by the maintenance chain
+		if _, ok := config.InMaintenance(serviceIP); ok {
+			continue
+		}
 		dest := string(serviceIP)
 		for dport, service := range services {
+			// translated ports reach the realservers in the family of the paired VIP
+			if service.Translated() {
+				continue
+			}
 
 			ident := types.MakeIdent(service.Namespace, service.Service, service.PortName)
 			if !w.NodeHasServiceRunning(nodeName, service.Namespace, service.Service, service.PortName) {
@@ -298,6 +545,11 @@ func (i *IPTables) GenerateRulesForNodeClassic(w *watcher.Watcher, nodeName stri
 				if i.masq {
 					rules = append(rules, fmt.Sprintf(masqFmt, dest, prot, prot, dport, ident))
 				}
+				if service.Hairpin {
+					for _, cidr := range podCIDRs {
+						rules = append(rules, fmt.Sprintf(hairpinFmt, cidr, dest, prot, prot, dport, ident))
+					}
+				}
 				nodeProbability := w.GetLocalServiceWeight(nodeName, service.Namespace, service.Service, service.PortName)
 				var newRule string
 				if useWeightedService {
@@ -345,8 +597,13 @@ func (i *IPTables) GenerateRulesForNodeClassic(w *watcher.Watcher, nodeName stri
 				}
 
 				portNumber := w.GetPortNumberForService(service.Namespace, service.Service, service.PortName)
-				serviceRules := []string{}
 				podIPs := w.GetPodIPsOnNode(nodeName, service.Service, service.Namespace, service.PortName)
+				// rewritten ports are resolved for each pod, from its own endpoint subset
+				var targetPorts map[string]int32
+				if service.PortRewrite != nil {
+					targetPorts = w.GetTargetPortsOnNode(nodeName, service.Service, service.Namespace, service.PortName, service.PortRewrite)
+				}
+				serviceRules := make([]string, 0, len(podIPs))
 				log.Debugln("iptables:", nodeName, service.Service, service.Namespace, service.PortName, "has", len(podIPs), "pod IPs")
 
 				for n, ip := range podIPs {
@@ -355,11 +612,15 @@ func (i *IPTables) GenerateRulesForNodeClassic(w *watcher.Watcher, nodeName stri
 
 					serviceRules = append(serviceRules, probFmt)
 
+					targetPort := portNumber
+					if port, ok := targetPorts[ip]; ok {
+						targetPort = port
+					}
 					out[sepChain] = &RuleSet{
 						ChainRule: ":" + sepChain + " - [0:0]",
 						Rules: []string{
 							fmt.Sprintf(`-A %s -d %s/32 -m comment --comment "%s" -j %s`, sepChain, ip, ident, i.masqChain),
-							fmt.Sprintf(`-A %s -p %s -m comment --comment "%s" -m %s -j DNAT --to-destination %s:%d`, sepChain, prot, ident, prot, ip, portNumber),
+							fmt.Sprintf(`-A %s -p %s -m comment --comment "%s" -m %s -j DNAT --to-destination %s:%d`, sepChain, prot, ident, prot, ip, targetPort),
 						},
 					}
 
@@ -534,11 +795,14 @@ func (i *IPTables) rulesFromBytes(b []byte) (map[string]*RuleSet, error) {
 	return GetSaveLines(i.table, b)
 }
 
+// masqMark is the mark that kube-proxy masquerades packets carrying in POSTROUTING
+const masqMark = "0x4000/0x4000"
+
 func (i *IPTables) generateMasqRule() string {
 	if i.podCidrMasq != "" {
-		return fmt.Sprintf("-A %s -j MARK ! -s %s --set-xmark 0x4000/0x4000", i.masqChain.String(), i.podCidrMasq)
+		return fmt.Sprintf("-A %s -j MARK ! -s %s --set-xmark %s", i.masqChain.String(), i.podCidrMasq, masqMark)
 	}
-	return fmt.Sprintf("-A %s -j MARK --set-xmark 0x4000/0x4000", i.masqChain.String())
+	return fmt.Sprintf("-A %s -j MARK --set-xmark %s", i.masqChain.String(), masqMark)
 }
 
 // simple fetch of protocol strings for later
@@ -603,22 +867,47 @@ func computeServiceEndpointString(chain, ident, sepChain string, length, i int)
 
 // BytesFromRules turns a map of RuleSet pointers into a slic eof bytes
 func BytesFromRules(rules map[string]*RuleSet) []byte {
-	iptablesLines := []string{"*nat"}
+	return bytesFromRulesForTable(util.TableNAT, rules)
+}
+
+// bytesFromRulesForTable renders rules as iptables-restore input for the given
+// table. The size of the output is counted first, so that rendering a large
+// table allocates it once rather than growing into it.
+func bytesFromRulesForTable(table util.Table, rules map[string]*RuleSet) []byte {
+	// walk chains in a stable order so the output can be diffed
+	chains := make([]string, 0, len(rules))
+	size := len(table) + len("*\nCOMMIT\n")
+	for chain, set := range rules {
+		chains = append(chains, chain)
+		size += len(set.ChainRule) + 1
+		for _, rule := range set.Rules {
+			size += len(rule) + 1
+		}
+	}
+	sort.Strings(chains)
+
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+
+	buf.WriteString("*")
+	buf.WriteString(string(table))
 
 	// Add the chain rule to the iptables rules string
 	// Chain rules must be added before jumps/masqs
-	for _, kubeRule := range rules {
-		// Append the chain to the string
-		iptablesLines = append(iptablesLines, kubeRule.ChainRule)
+	for _, chain := range chains {
+		buf.WriteString("\n")
+		buf.WriteString(rules[chain].ChainRule)
 	}
 
 	// Add the chain rule to the iptables rules string
-	for _, kubeRule := range rules {
-		iptablesLines = append(iptablesLines, kubeRule.Rules...)
+	for _, chain := range chains {
+		for _, rule := range rules[chain].Rules {
+			buf.WriteString("\n")
+			buf.WriteString(rule)
+		}
 	}
 
 	// Finish with the commit at the end (newline after COMMIT required)
-	iptablesLines = append(iptablesLines, "COMMIT\n")
+	buf.WriteString("\nCOMMIT\n")
 
-	return []byte(strings.Join(iptablesLines, "\n"))
+	return buf.Bytes()
 }
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/Comcast/Ravel/pkg/stats"
@@ -13,6 +15,7 @@ import (
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func getTestJSON(fileDesc string) ([]byte, error) {
@@ -54,6 +57,468 @@ func TestGenerateRulesForNodeClassic(t *testing.T) {
 
 }
 
+func TestMergeProbeMark(t *testing.T) {
+	ipTables, err := NewIPTables(context.Background(), stats.KindIpvsBackend, "", "", "RAVEL", true, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipTables.EnableProbeMark(0x200000)
+
+	generated, err := ipTables.GenerateRulesForNodeClassic(&watcher.Watcher{}, "node", &types.ClusterConfig{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jump := "-A OUTPUT -m mark --mark 0x200000/0x200000 -j RAVEL"
+	if output, ok := generated["OUTPUT"]; !ok || len(output.Rules) != 1 || output.Rules[0] != jump {
+		t.Fatalf("expected the probe mark jump in OUTPUT. have %v", generated["OUTPUT"])
+	}
+
+	existing := map[string]*RuleSet{
+		"PREROUTING": {ChainRule: ":PREROUTING ACCEPT", Rules: []string{"-A PREROUTING -j KUBE-SERVICES"}},
+		"OUTPUT":     {ChainRule: ":OUTPUT ACCEPT", Rules: []string{"-A OUTPUT -j KUBE-SERVICES"}},
+	}
+	merged, _, err := ipTables.Merge(generated, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := merged["OUTPUT"].Rules; len(rules) != 2 || rules[0] != "-A OUTPUT -j KUBE-SERVICES" || rules[1] != jump {
+		t.Fatalf("expected the kube OUTPUT rule to be kept and the probe jump appended. have %v", rules)
+	}
+	if len(existing["OUTPUT"].Rules) != 1 {
+		t.Fatal("expected the existing rules to be unchanged")
+	}
+
+	merged, _, err = ipTables.Merge(generated, merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged["OUTPUT"].Rules) != 2 {
+		t.Fatalf("expected the probe jump to be added once. have %v", merged["OUTPUT"].Rules)
+	}
+}
+
+func TestHairpin(t *testing.T) {
+	ipTables, err := NewIPTables(context.Background(), stats.KindIpvsMaster, "", "10.244.0.0/16", "RAVEL", true, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeName := "node"
+	w := &watcher.Watcher{
+		Nodes: []*v1.Node{{
+			ObjectMeta: metav1.ObjectMeta{Name: nodeName},
+			Spec:       v1.NodeSpec{PodCIDRs: []string{"10.244.1.0/24", "fd00:1::/64"}},
+		}},
+		AllPodsByNode: map[string][]*v1.Pod{
+			nodeName: {{Status: v1.PodStatus{PodIP: "10.244.1.5"}}},
+		},
+		AllEndpoints: map[string]*v1.Endpoints{
+			"web/app": {
+				ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "app"},
+				Subsets: []v1.EndpointSubset{{
+					Addresses: []v1.EndpointAddress{{IP: "10.244.1.5", NodeName: &nodeName}},
+					Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+				}},
+			},
+		},
+	}
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.0.1": {"80": {Namespace: "web", Service: "app", PortName: "http", TCPEnabled: true, Hairpin: true}},
+			"10.54.0.2": {"80": {Namespace: "web", Service: "app", PortName: "http", TCPEnabled: true}},
+		},
+	}
+
+	generated, err := ipTables.GenerateRulesForNodeClassic(w, nodeName, config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hairpin := `-A RAVEL -s 10.244.1.0/24 -d 10.54.0.1/32 -p tcp -m tcp --dport 80 -m comment --comment "web/app:http" -j MARK --set-xmark 0x4000/0x4000`
+	marked := 0
+	for _, rule := range generated["RAVEL"].Rules {
+		if strings.Contains(rule, "--set-xmark") {
+			marked++
+			if rule != hairpin {
+				t.Fatalf("expected only the hairpinned VIP port to be masqueraded for local pods. have %s", rule)
+			}
+		}
+	}
+	if marked != 1 {
+		t.Fatalf("expected a single hairpin rule. have %v", generated["RAVEL"].Rules)
+	}
+}
+
+func TestPortRewrite(t *testing.T) {
+	ipTables, err := NewIPTables(context.Background(), stats.KindIpvsMaster, "", "10.244.0.0/16", "RAVEL", true, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the canary pods serve the VIP port on https-alt, the others on https
+	nodeName := "node"
+	w := &watcher.Watcher{
+		AllPodsByNode: map[string][]*v1.Pod{
+			nodeName: {
+				{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"track": "stable"}}, Status: v1.PodStatus{PodIP: "10.244.1.5"}},
+				{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"track": "canary"}}, Status: v1.PodStatus{PodIP: "10.244.1.6"}},
+			},
+		},
+		AllEndpoints: map[string]*v1.Endpoints{
+			"web/app": {
+				ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "app"},
+				Subsets: []v1.EndpointSubset{
+					{
+						Addresses: []v1.EndpointAddress{{IP: "10.244.1.5", NodeName: &nodeName}},
+						Ports:     []v1.EndpointPort{{Name: "https", Port: 443}},
+					},
+					{
+						Addresses: []v1.EndpointAddress{{IP: "10.244.1.6", NodeName: &nodeName}},
+						Ports:     []v1.EndpointPort{{Name: "https", Port: 443}, {Name: "https-alt", Port: 8443}},
+					},
+				},
+			},
+		},
+	}
+	rewrite := &types.PortRewrite{Backends: []types.BackendPortRewrite{{Selector: map[string]string{"track": "canary"}, TargetPortName: "https-alt"}}}
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.0.1": {"443": {Namespace: "web", Service: "app", PortName: "https", TCPEnabled: true, PortRewrite: rewrite}},
+		},
+	}
+
+	generated, err := ipTables.GenerateRulesForNodeClassic(w, nodeName, config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnat := map[string]bool{}
+	for _, set := range generated {
+		for _, rule := range set.Rules {
+			if strings.Contains(rule, "DNAT") {
+				dnat[rule[strings.Index(rule, "--to-destination")+len("--to-destination "):]] = true
+			}
+		}
+	}
+	if len(dnat) != 2 || !dnat["10.244.1.5:443"] || !dnat["10.244.1.6:8443"] {
+		t.Fatalf("expected only the canary pod to be sent to https-alt. have %v", dnat)
+	}
+}
+
+func TestGenerateMaintenanceRules(t *testing.T) {
+	ipTables, err := NewIPTables(context.Background(), stats.KindIpvsBackend, "", "", "RAVEL", true, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {
+				"80": &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "http", TCPEnabled: true},
+				"53": &types.ServiceDef{Namespace: "syseng", Service: "dns", PortName: "dns", UDPEnabled: true},
+			},
+			"10.54.213.166": {
+				"80": &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "http", TCPEnabled: true},
+			},
+			"10.54.213.167": {
+				"80": &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "http", TCPEnabled: true},
+			},
+		},
+		Maintenance: map[types.ServiceIP]types.Maintenance{
+			"10.54.213.165": {},
+			"10.54.213.166": {Action: types.MaintenanceDrop},
+		},
+	}
+
+	rules := ipTables.GenerateMaintenanceRules(config)
+	expected := []string{
+		"-A RAVEL-MAINT -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j REJECT --reject-with tcp-reset",
+		"-A RAVEL-MAINT -d 10.54.213.165/32 -p udp -m udp --dport 53 -j REJECT --reject-with icmp-port-unreachable",
+		"-A RAVEL-MAINT -d 10.54.213.166/32 -p tcp -m tcp --dport 80 -j DROP",
+	}
+	if fmt.Sprint(rules["RAVEL-MAINT"].Rules) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected maintenance rules %v", rules["RAVEL-MAINT"].Rules)
+	}
+	if input := rules["INPUT"].Rules; len(input) != 1 || input[0] != "-A INPUT -j RAVEL-MAINT" {
+		t.Fatalf("expected a jump from INPUT. have %v", input)
+	}
+
+	generated, err := ipTables.GenerateRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range generated["RAVEL"].Rules {
+		if !strings.Contains(rule, "10.54.213.167/32") {
+			t.Fatalf("expected no nat rules for VIPs in maintenance. have %s", rule)
+		}
+	}
+	if len(generated["RAVEL"].Rules) != 2 {
+		t.Fatalf("expected nat rules for the VIP out of maintenance. have %v", generated["RAVEL"].Rules)
+	}
+}
+
+func TestGenerateTranslationRules(t *testing.T) {
+	ipTables, err := NewIPTables(context.Background(), stats.KindIpvsMaster, "", "", "RAVEL", true, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipTables.siitInstance = "ravel"
+
+	web := &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "http", TCPEnabled: true}
+	config := &types.ClusterConfig{
+		IPV6: map[types.ServiceIP]string{
+			"10.54.213.165": "2001:558:1044:1ae:10ad:ba1a:0000:0007",
+			"10.54.213.166": "2001:db8::6",
+		},
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {"80": web},
+			"10.54.213.166": {
+				"53": &types.ServiceDef{Namespace: "syseng", Service: "dns", PortName: "dns", UDPEnabled: true, Translate: types.TranslateSIIT},
+			},
+		},
+		Config6: map[types.ServiceIP]types.PortMap{
+			"2001:558:1044:1ae:10ad:ba1a:0000:0007": {
+				"80": &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "http", TCPEnabled: true, Translate: types.TranslateSIIT},
+			},
+			"2001:db8::6": {
+				"53": &types.ServiceDef{Namespace: "syseng", Service: "dns", PortName: "dns", UDPEnabled: true},
+			},
+		},
+	}
+
+	rules := ipTables.GenerateTranslationRules(config, false)
+	expected := []string{"-A RAVEL-XLAT -d 10.54.213.166/32 -p udp -m udp --dport 53 -j JOOL_SIIT --instance ravel"}
+	if fmt.Sprint(rules["RAVEL-XLAT"].Rules) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected v4 translation rules %v", rules["RAVEL-XLAT"].Rules)
+	}
+	if prerouting := rules["PREROUTING"].Rules; len(prerouting) != 1 || prerouting[0] != "-A PREROUTING -j RAVEL-XLAT" {
+		t.Fatalf("expected a jump from PREROUTING. have %v", prerouting)
+	}
+
+	rules = ipTables.GenerateTranslationRules(config, true)
+	expected = []string{"-A RAVEL-XLAT -d 2001:558:1044:1ae:10ad:ba1a:0000:0007/128 -p tcp -m tcp --dport 80 -j JOOL_SIIT --instance ravel"}
+	if fmt.Sprint(rules["RAVEL-XLAT"].Rules) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected v6 translation rules %v", rules["RAVEL-XLAT"].Rules)
+	}
+
+	mappings := TranslationMappings(config)
+	expected = []string{"2001:558:1044:1ae:10ad:ba1a:0:7/128 10.54.213.165/32", "2001:db8::6/128 10.54.213.166/32"}
+	if fmt.Sprint(mappings) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected mappings %v", mappings)
+	}
+
+	have := parseMappings([]byte("2001:db8::6/128,10.54.213.166/32\n2001:db8::9/128,10.54.213.169/32\n"))
+	add, remove := diffMappings(have, mappings)
+	if fmt.Sprint(add) != fmt.Sprint(expected[:1]) || fmt.Sprint(remove) != "[2001:db8::9/128 10.54.213.169/32]" {
+		t.Fatalf("unexpected mapping changes. add %v remove %v", add, remove)
+	}
+
+	generated, err := ipTables.GenerateRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range generated["RAVEL"].Rules {
+		if strings.Contains(rule, "10.54.213.166/32") {
+			t.Fatalf("expected no nat rules for translated ports. have %s", rule)
+		}
+	}
+}
+
+func TestGenerateSteeringRules(t *testing.T) {
+	ipTables, err := NewIPTables(context.Background(), stats.KindIpvsMaster, "", "", "RAVEL", true, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {
+				"80": &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "http", TCPEnabled: true, Steering: []types.Steering{
+					{Sources: []string{"10.0.0.0/8", "172.16.0.0/12"}, Service: "web-canary"},
+				}},
+			},
+		},
+	}
+	steering, err := types.SteeringFwmarks(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marks := []types.ECMPFwmark{{VIP: "10.54.213.165", Port: "80", Protocol: "tcp", Mark: 0x100000}}
+
+	rules := ipTables.GenerateFwmarkRules(marks, steering)["RAVEL-FWMARK"].Rules
+	mark := steering[0].Mark
+	expected := []string{
+		fmt.Sprintf("-A RAVEL-FWMARK -s 10.0.0.0/8 -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j MARK --set-xmark %#x/0xffffffff", mark),
+		fmt.Sprintf("-A RAVEL-FWMARK -s 172.16.0.0/12 -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j MARK --set-xmark %#x/0xffffffff", mark),
+		fmt.Sprintf("-A RAVEL-FWMARK -m mark --mark %#x/0xffffffff -j RETURN", mark),
+		"-A RAVEL-FWMARK -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j MARK --set-xmark 0x100000/0xffffffff",
+	}
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected fwmark rules\n%s", strings.Join(rules, "\n"))
+	}
+
+	// realservers send the steered clients to the other service's chain ahead of
+	// the port's own
+	generated, err := ipTables.GenerateRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jumps := []string{}
+	for _, rule := range generated["RAVEL"].Rules {
+		if !strings.Contains(rule, "RAVEL-MASQ") {
+			jumps = append(jumps, rule)
+		}
+	}
+	if len(jumps) != 3 || !strings.Contains(jumps[0], "-s 10.0.0.0/8") || !strings.Contains(jumps[0], "syseng/web-canary:http") ||
+		!strings.Contains(jumps[1], "-s 172.16.0.0/12") || strings.Contains(jumps[2], " -s ") {
+		t.Fatalf("unexpected steering jumps\n%s", strings.Join(jumps, "\n"))
+	}
+}
+
+func TestGenerateACLRules(t *testing.T) {
+	ipTables, err := NewIPTables(context.Background(), stats.KindIpvsMaster, "", "", "RAVEL", true, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acl := &types.ACL{Allow: []string{"10.0.0.0/8", "2001:db8:1::/48"}, Deny: []string{"10.1.0.0/16"}}
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {
+				"80":  &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "http", TCPEnabled: true, ACL: acl},
+				"443": &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "https", TCPEnabled: true},
+			},
+		},
+		Config6: map[types.ServiceIP]types.PortMap{
+			"2001:db8::7": {
+				"53": &types.ServiceDef{Namespace: "syseng", Service: "dns", PortName: "dns", UDPEnabled: true, ACL: &types.ACL{Deny: []string{"2001:db8:2::/48"}}},
+			},
+		},
+	}
+
+	rules := ipTables.GenerateACLRules(config, false)["RAVEL-ACL"].Rules
+	expected := []string{
+		"-A RAVEL-ACL -s 10.1.0.0/16 -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j DROP",
+		"-A RAVEL-ACL -s 10.0.0.0/8 -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j RETURN",
+		"-A RAVEL-ACL -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j DROP",
+	}
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected v4 acl rules\n%s", strings.Join(rules, "\n"))
+	}
+
+	rules = ipTables.GenerateACLRules(config, true)["RAVEL-ACL"].Rules
+	expected = []string{"-A RAVEL-ACL -s 2001:db8:2::/48 -d 2001:db8::7/128 -p udp -m udp --dport 53 -j DROP"}
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected v6 acl rules\n%s", strings.Join(rules, "\n"))
+	}
+}
+
+func TestGenerateSYNProxyRules(t *testing.T) {
+	ipTables, err := NewIPTables(context.Background(), stats.KindIpvsMaster, "", "", "RAVEL", true, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {
+				"443": &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "https", TCPEnabled: true},
+				"53":  &types.ServiceDef{Namespace: "syseng", Service: "dns", PortName: "dns", UDPEnabled: true},
+			},
+			"10.54.213.166": {
+				"443": &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "https", TCPEnabled: true},
+			},
+		},
+		Defense: map[types.ServiceIP]types.Defense{
+			"10.54.213.165": {SYNProxy: true, MSS: 1400},
+			"10.54.213.166": {MSS: 1400},
+		},
+	}
+
+	raw, filter := ipTables.GenerateSYNProxyRules(config)
+	expected := []string{"-A RAVEL-SYNPROXY -d 10.54.213.165/32 -p tcp -m tcp --dport 443 --tcp-flags FIN,SYN,RST,ACK SYN -j CT --notrack"}
+	if strings.Join(raw["RAVEL-SYNPROXY"].Rules, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected raw syn proxy rules\n%s", strings.Join(raw["RAVEL-SYNPROXY"].Rules, "\n"))
+	}
+	expected = []string{
+		"-A RAVEL-SYNPROXY -d 10.54.213.165/32 -p tcp -m tcp --dport 443 -m conntrack --ctstate INVALID,UNTRACKED -j SYNPROXY --sack-perm --timestamp --wscale 7 --mss 1400",
+		"-A RAVEL-SYNPROXY -d 10.54.213.165/32 -p tcp -m tcp --dport 443 -m conntrack --ctstate INVALID -j DROP",
+	}
+	if strings.Join(filter["RAVEL-SYNPROXY"].Rules, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected filter syn proxy rules\n%s", strings.Join(filter["RAVEL-SYNPROXY"].Rules, "\n"))
+	}
+	if input := filter["INPUT"].Rules; len(input) != 1 || input[0] != "-A INPUT -j RAVEL-SYNPROXY" {
+		t.Fatalf("expected a jump from INPUT. have %v", input)
+	}
+}
+
+func TestGenerateTProxyRules(t *testing.T) {
+	ipTables, err := NewIPTables(context.Background(), stats.KindIpvsMaster, "", "", "RAVEL", true, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipTables.EnableTProxy(0x40000000, 100)
+
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {
+				"80":  &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "http", TCPEnabled: true, TProxyPort: 15001},
+				"443": &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "https", TCPEnabled: true},
+			},
+		},
+		Config6: map[types.ServiceIP]types.PortMap{
+			"2001:db8::7": {
+				"53": &types.ServiceDef{Namespace: "syseng", Service: "dns", PortName: "dns", TCPEnabled: true, UDPEnabled: true, TProxyPort: 5353},
+			},
+		},
+	}
+
+	rules := ipTables.GenerateTProxyRules(config, false)["RAVEL-TPROXY"].Rules
+	expected := []string{"-A RAVEL-TPROXY -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j TPROXY --on-port 15001 --on-ip 0.0.0.0 --tproxy-mark 0x40000000/0x40000000"}
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected v4 tproxy rules\n%s", strings.Join(rules, "\n"))
+	}
+
+	rules = ipTables.GenerateTProxyRules(config, true)["RAVEL-TPROXY"].Rules
+	expected = []string{
+		"-A RAVEL-TPROXY -d 2001:db8::7/128 -p tcp -m tcp --dport 53 -j TPROXY --on-port 5353 --on-ip :: --tproxy-mark 0x40000000/0x40000000",
+		"-A RAVEL-TPROXY -d 2001:db8::7/128 -p udp -m udp --dport 53 -j TPROXY --on-port 5353 --on-ip :: --tproxy-mark 0x40000000/0x40000000",
+	}
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected v6 tproxy rules\n%s", strings.Join(rules, "\n"))
+	}
+}
+
+func TestGenerateMirrorRules(t *testing.T) {
+	ipTables, err := NewIPTables(context.Background(), stats.KindIpvsMaster, "", "", "RAVEL", true, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipTables.EnableMirror(0x20000000)
+
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {
+				"80":   &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "http", TCPEnabled: true, Mirror: &types.Mirror{Gateway: "10.54.100.9", Percent: 25}},
+				"443":  &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "https", TCPEnabled: true, Mirror: &types.Mirror{Gateway: "10.54.100.9"}},
+				"8080": &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "alt", TCPEnabled: true},
+			},
+		},
+	}
+
+	rules := ipTables.GenerateMirrorRules(config, false)["RAVEL-MIRROR"].Rules
+	expected := []string{
+		"-A RAVEL-MIRROR -d 10.54.213.165/32 -p tcp -m tcp --dport 443 -j TEE --gateway 10.54.100.9",
+		"-A RAVEL-MIRROR -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -m conntrack --ctstate NEW -m statistic --mode random --probability 0.25000 -j CONNMARK --set-xmark 0x20000000/0x20000000",
+		"-A RAVEL-MIRROR -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -m connmark --mark 0x20000000/0x20000000 -j TEE --gateway 10.54.100.9",
+	}
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected mirror rules\n%s", strings.Join(rules, "\n"))
+	}
+
+	if rules := ipTables.GenerateMirrorRules(config, true)["RAVEL-MIRROR"].Rules; len(rules) != 0 {
+		t.Fatalf("expected no v6 mirror rules. have %v", rules)
+	}
+}
+
 func TestCIDRMasq(t *testing.T) {
 	b, err := getTestJSON("./endpoint_test_data.json")
 	if err != nil {
@@ -145,6 +610,230 @@ func TestWeightEndpoints(t *testing.T) {
 	}
 }
 
+func TestDivergence(t *testing.T) {
+	want := map[string]*RuleSet{
+		"PREROUTING": {Rules: []string{"-A PREROUTING -j RAVEL"}},
+		"RAVEL": {Rules: []string{
+			"-A RAVEL -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j RAVEL-SVC-A",
+			"-A RAVEL -d 10.54.213.166/32 -p tcp -m tcp --dport 80 -j RAVEL-SVC-B",
+		}},
+		"RAVEL-SVC-A":   {Rules: []string{"-A RAVEL-SVC-A -j DNAT --to-destination 10.131.153.76:8080"}},
+		"RAVEL-SVC-B":   {},
+		"KUBE-SERVICES": {Rules: []string{"-A KUBE-SERVICES -j KUBE-NODEPORTS"}},
+	}
+
+	have := map[string]*RuleSet{
+		"PREROUTING": {Rules: []string{"-A PREROUTING -j KUBE-SERVICES", "-A PREROUTING -j RAVEL"}},
+		"RAVEL": {Rules: []string{
+			"-A RAVEL -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j RAVEL-SVC-A",
+			"-A RAVEL -d 10.54.213.166/32 -p tcp -m tcp --dport 80 -j RAVEL-SVC-B",
+		}},
+		"RAVEL-SVC-A": {Rules: []string{"-A RAVEL-SVC-A -j DNAT --to-destination 10.131.153.76:8080"}},
+		"RAVEL-SVC-B": {},
+	}
+	if chains, rules := divergence("RAVEL", want, have); len(chains) != 0 || rules != 0 {
+		t.Fatalf("expected no divergence. have %d rules in %v", rules, chains)
+	}
+
+	// a missing jump, a changed endpoint, a missing chain and a stale chain
+	have["PREROUTING"].Rules = have["PREROUTING"].Rules[:1]
+	have["RAVEL-SVC-A"].Rules = []string{"-A RAVEL-SVC-A -j DNAT --to-destination 10.131.153.77:8080"}
+	delete(have, "RAVEL-SVC-B")
+	have["RAVEL-SVC-C"] = &RuleSet{Rules: []string{"-A RAVEL-SVC-C -j DNAT --to-destination 10.131.153.78:8080"}}
+
+	chains, rules := divergence("RAVEL", want, have)
+	expected := []string{"PREROUTING", "RAVEL-SVC-A", "RAVEL-SVC-B", "RAVEL-SVC-C"}
+	if !reflect.DeepEqual(chains, expected) || rules != 6 {
+		t.Fatalf("expected 6 rules in %v to diverge. have %d rules in %v", expected, rules, chains)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	rules := func() map[string]*RuleSet {
+		return map[string]*RuleSet{
+			"PREROUTING":    {ChainRule: ":PREROUTING ACCEPT [0:0]", Rules: []string{"-A PREROUTING -j KUBE-SERVICES", "-A PREROUTING -j RAVEL"}},
+			"RAVEL":         {ChainRule: ":RAVEL - [0:0]", Rules: []string{"-A RAVEL -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j RAVEL-SVC-A"}},
+			"RAVEL-SVC-A":   {ChainRule: ":RAVEL-SVC-A - [0:0]", Rules: []string{"-A RAVEL-SVC-A -j DNAT --to-destination 10.131.153.76:8080"}},
+			"KUBE-SERVICES": {ChainRule: ":KUBE-SERVICES - [0:0]", Rules: []string{"-A KUBE-SERVICES -j KUBE-NODEPORTS"}},
+		}
+	}
+	base := Fingerprint("RAVEL", rules())
+
+	// counters and the rules of other programs aren't ravel's
+	same := rules()
+	same["PREROUTING"].ChainRule = ":PREROUTING ACCEPT [1204:96320]"
+	same["PREROUTING"].Rules = append([]string{"-A PREROUTING -j CALICO"}, same["PREROUTING"].Rules...)
+	same["KUBE-SERVICES"].Rules = nil
+	if Fingerprint("RAVEL", same) != base {
+		t.Fatal("expected the fingerprint to ignore counters and the rules of other programs")
+	}
+
+	for name, tamper := range map[string]func(map[string]*RuleSet){
+		"flushed jump":     func(r map[string]*RuleSet) { r["PREROUTING"].Rules = r["PREROUTING"].Rules[:1] },
+		"changed endpoint": func(r map[string]*RuleSet) { r["RAVEL-SVC-A"].Rules[0] += "1" },
+		"deleted chain":    func(r map[string]*RuleSet) { delete(r, "RAVEL-SVC-A") },
+		"flushed chain":    func(r map[string]*RuleSet) { r["RAVEL"].Rules = nil },
+		"added chain":      func(r map[string]*RuleSet) { r["RAVEL-SVC-B"] = &RuleSet{} },
+	} {
+		r := rules()
+		tamper(r)
+		if Fingerprint("RAVEL", r) == base {
+			t.Errorf("expected a %s to change the fingerprint", name)
+		}
+	}
+}
+
+func TestScopedRestore(t *testing.T) {
+	want := map[string]*RuleSet{
+		"PREROUTING":    {ChainRule: ":PREROUTING ACCEPT [0:0]", Rules: []string{"-A PREROUTING -j RAVEL"}},
+		"RAVEL":         {ChainRule: ":RAVEL - [0:0]", Rules: []string{"-A RAVEL -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j RAVEL-SVC-A"}},
+		"RAVEL-SVC-A":   {ChainRule: ":RAVEL-SVC-A - [0:0]", Rules: []string{"-A RAVEL-SVC-A -j DNAT --to-destination 10.131.153.76:8080"}},
+		"KUBE-SERVICES": {ChainRule: ":KUBE-SERVICES - [0:0]", Rules: []string{"-A KUBE-SERVICES -j KUBE-NODEPORTS"}},
+	}
+	have := map[string]*RuleSet{
+		"PREROUTING":    {ChainRule: ":PREROUTING ACCEPT [0:0]", Rules: []string{"-A PREROUTING -j KUBE-SERVICES", "-A PREROUTING -j RAVEL"}},
+		"RAVEL":         {ChainRule: ":RAVEL - [0:0]", Rules: []string{"-A RAVEL -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j RAVEL-SVC-A"}},
+		"RAVEL-SVC-A":   {ChainRule: ":RAVEL-SVC-A - [0:0]", Rules: []string{"-A RAVEL-SVC-A -j DNAT --to-destination 10.131.153.76:8080"}},
+		"KUBE-SERVICES": {ChainRule: ":KUBE-SERVICES - [0:0]", Rules: []string{"-A KUBE-SERVICES -j KUBE-NODEPORTS", "-A KUBE-SERVICES -j KUBE-MARK-MASQ"}},
+	}
+	if b, chains, rules := scopedRestore("nat", "RAVEL", false, want, have); b != nil || chains != 0 || rules != 0 {
+		t.Fatalf("expected nothing to restore. saw %d chains and %d rules\n%s", chains, rules, b)
+	}
+
+	// a missing jump, a changed endpoint and a stale chain. chains that ravel
+	// doesn't own are never written
+	have["PREROUTING"].Rules = have["PREROUTING"].Rules[:1]
+	have["RAVEL-SVC-A"].Rules = []string{"-A RAVEL-SVC-A -j DNAT --to-destination 10.131.153.77:8080"}
+	have["RAVEL-SVC-B"] = &RuleSet{ChainRule: ":RAVEL-SVC-B - [0:0]", Rules: []string{"-A RAVEL-SVC-B -j DNAT --to-destination 10.131.153.78:8080"}}
+
+	b, chains, rules := scopedRestore("nat", "RAVEL", false, want, have)
+	expected := strings.Join([]string{
+		"*nat",
+		":RAVEL-SVC-A - [0:0]",
+		":RAVEL-SVC-B - [0:0]",
+		"-A PREROUTING -j RAVEL",
+		"-A RAVEL-SVC-A -j DNAT --to-destination 10.131.153.76:8080",
+		"-X RAVEL-SVC-B",
+		"COMMIT\n",
+	}, "\n")
+	if string(b) != expected || chains != 2 || rules != 2 {
+		t.Fatalf("expected 2 chains and 2 rules\n%s\nsaw %d chains and %d rules\n%s", expected, chains, rules, b)
+	}
+}
+
+func TestJumpFirst(t *testing.T) {
+	ipTables, err := NewIPTables(context.Background(), stats.KindIpvsBackend, "", "", "RAVEL", true, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipTables.SetJumpFirst()
+
+	want := map[string]*RuleSet{
+		"PREROUTING": {ChainRule: ":PREROUTING ACCEPT [0:0]", Rules: []string{"-A PREROUTING -j RAVEL"}},
+	}
+	have := map[string]*RuleSet{
+		"PREROUTING": {ChainRule: ":PREROUTING ACCEPT [0:0]", Rules: []string{"-A PREROUTING -j KUBE-SERVICES", "-A PREROUTING -j RAVEL"}},
+	}
+	merged, _, err := ipTables.Merge(want, have)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := merged["PREROUTING"].Rules; len(rules) != 2 || rules[0] != "-A PREROUTING -j RAVEL" || rules[1] != "-A PREROUTING -j KUBE-SERVICES" {
+		t.Fatalf("expected the ravel jump to be moved ahead of kube-proxy's. have %v", rules)
+	}
+
+	b, _, rules := scopedRestore("nat", "RAVEL", true, want, have)
+	expected := strings.Join([]string{
+		"*nat",
+		"-D PREROUTING -j RAVEL",
+		"-I PREROUTING 1 -j RAVEL",
+		"COMMIT\n",
+	}, "\n")
+	if string(b) != expected || rules != 2 {
+		t.Fatalf("expected the jump to be moved\n%s\nsaw %d rules\n%s", expected, rules, b)
+	}
+
+	if b, _, _ := scopedRestore("nat", "RAVEL", true, want, merged); b != nil {
+		t.Fatalf("expected nothing to restore with the jump first. saw\n%s", b)
+	}
+}
+
+// benchmarkTable returns a nat table with chains kube service chains of rules
+// rules each, and the ravel chains generated for the same number of services
+func benchmarkTable(chains, rules int) (wholeset, subset map[string]*RuleSet) {
+	wholeset = map[string]*RuleSet{
+		"PREROUTING": {ChainRule: ":PREROUTING ACCEPT [0:0]", Rules: []string{"-A PREROUTING -j KUBE-SERVICES", "-A PREROUTING -j RAVEL"}},
+	}
+	subset = map[string]*RuleSet{
+		"PREROUTING": {ChainRule: ":PREROUTING ACCEPT", Rules: []string{"-A PREROUTING -j RAVEL"}},
+	}
+	for c := 0; c < chains; c++ {
+		for _, prefix := range []string{"KUBE", "RAVEL"} {
+			chain := fmt.Sprintf("%s-SVC-%016d", prefix, c)
+			set := &RuleSet{ChainRule: ":" + chain + " - [0:0]"}
+			for r := 0; r < rules; r++ {
+				set.Rules = append(set.Rules, fmt.Sprintf(`-A %s -m comment --comment "syseng/web-%d:http" -m statistic --mode random --probability 0.50000000000 -j %s-SEP-%016d`, chain, c, prefix, r))
+			}
+			wholeset[chain] = set
+			if prefix == "RAVEL" {
+				subset[chain] = set
+			}
+		}
+	}
+	return wholeset, subset
+}
+
+func BenchmarkMerge(b *testing.B) {
+	ipTables := &IPTables{chain: "RAVEL", metrics: nopMetrics{}}
+	wholeset, subset := benchmarkTable(1000, 5)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, _, err := ipTables.Merge(subset, wholeset); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBytesFromRules(b *testing.B) {
+	wholeset, _ := benchmarkTable(1000, 5)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		BytesFromRules(wholeset)
+	}
+}
+
+func TestCardinality(t *testing.T) {
+	rules := map[string]*RuleSet{
+		"PREROUTING": {ChainRule: ":PREROUTING ACCEPT [0:0]", Rules: []string{
+			"-A PREROUTING -j RAVEL",
+			"-A PREROUTING -j KUBE-SERVICES",
+		}},
+		"RAVEL": {ChainRule: ":RAVEL - [0:0]", Rules: []string{
+			"-A RAVEL -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j RAVEL-SVC-A",
+			"-A RAVEL -d 10.54.213.165/32 -p tcp -m tcp --dport 443 -j RAVEL-SVC-B",
+		}},
+		"RAVEL-SVC-A": {ChainRule: ":RAVEL-SVC-A - [0:0]", Rules: []string{
+			"-A RAVEL-SVC-A -m statistic --mode random --probability 0.50000000000 -j RAVEL-SEP-A1",
+			"-A RAVEL-SVC-A -j RAVEL-SEP-A2",
+			"-A RAVEL-SVC-A -j KUBE-MARK-DROP",
+		}},
+		"RAVEL-SVC-B":   {ChainRule: ":RAVEL-SVC-B - [0:0]", Rules: []string{"-A RAVEL-SVC-B -j KUBE-MARK-DROP"}},
+		"RAVEL-SEP-A1":  {ChainRule: ":RAVEL-SEP-A1 - [0:0]", Rules: []string{"-A RAVEL-SEP-A1 -p tcp -j DNAT --to-destination 10.131.153.76:8080"}},
+		"RAVEL-SEP-A2":  {ChainRule: ":RAVEL-SEP-A2 - [0:0]", Rules: []string{"-A RAVEL-SEP-A2 -p tcp -j DNAT --to-destination 10.131.153.77:8080"}},
+		"KUBE-SERVICES": {ChainRule: ":KUBE-SERVICES - [0:0]", Rules: []string{"-A KUBE-SERVICES -j KUBE-NODEPORTS"}},
+	}
+
+	c := cardinality("RAVEL", rules)
+	if c.Chains != 5 || c.Rules != 8 || c.Longest != 3 {
+		t.Fatalf("unexpected size of the ravel chains %+v", c)
+	}
+	if c.Depth != 3 {
+		t.Fatalf("expected packets to pass through RAVEL, a service and an endpoint chain. have %d", c.Depth)
+	}
+}
+
 func TestComputeProbability(t *testing.T) {
 	probabilities := []string{
 		"0.20000000000",
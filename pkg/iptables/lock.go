@@ -0,0 +1,36 @@
+package iptables
+
+import (
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/util"
+	utildbus "github.com/Comcast/Ravel/pkg/util/dbus"
+)
+
+// SetLockWait makes iptables commands and restores wait up to wait for the
+// xtables lock, which kube-proxy and others hold while they write, and retries
+// those that still fail on it up to retries times with a backoff. Every time
+// the lock is found held is counted by the iptables_lock_wait_count metric.
+func (i *IPTables) SetLockWait(wait time.Duration, retries int) {
+	i.lockWait = wait
+	i.lockRetries = retries
+	i.iptables.SetLockWait(wait, retries, func() { i.metrics.LockWait("ipv4") })
+	if i.iptables6 != nil {
+		i.iptables6.SetLockWait(wait, retries, func() { i.metrics.LockWait("ipv6") })
+	}
+}
+
+// newRunner6 creates the ip6tables runner, waiting for the lock as set by
+// SetLockWait and running through the exec of SetExec, under the scope of
+// SetScope
+func (i *IPTables) newRunner6() *util.Runner {
+	r := util.NewDefault6()
+	if i.exec != nil {
+		r = util.New(i.exec, utildbus.New(), util.ProtocolIpv6)
+	}
+	if i.scope != nil {
+		r.SetScope(i.scope)
+	}
+	r.SetLockWait(i.lockWait, i.lockRetries, func() { i.metrics.LockWait("ipv6") })
+	return r
+}
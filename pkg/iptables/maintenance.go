@@ -0,0 +1,90 @@
+package iptables
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// maintenanceChain is the filter table chain that rejects or drops traffic to VIPs in maintenance
+func (i *IPTables) maintenanceChain() string {
+	return i.chain.String() + "-MAINT"
+}
+
+// GenerateMaintenanceRules creates the filter table rules that stop traffic to
+// every port of the IPv4 VIPs in maintenance. The rules hang off INPUT, which
+// sees VIP traffic before IPVS does on directors, and on realservers once the
+// nat rules for the VIP have been left out. Rules are sorted so that an
+// unchanged config renders identically.
+func (i *IPTables) GenerateMaintenanceRules(config *types.ClusterConfig) map[string]*RuleSet {
+	chain := i.maintenanceChain()
+
+	rules := []string{}
+	if config != nil {
+		for vip, ports := range config.Config {
+			m, ok := config.InMaintenance(vip)
+			if !ok {
+				continue
+			}
+			for port, def := range ports {
+				if def == nil {
+					continue
+				}
+				for _, protocol := range getServiceProtocols(def.TCPEnabled, def.UDPEnabled) {
+					rules = append(rules, fmt.Sprintf("-A %s -d %s/32 -p %s -m %s --dport %s -j %s",
+						chain, vip, protocol, protocol, port, maintenanceTarget(m, protocol)))
+				}
+			}
+		}
+	}
+	sort.Strings(rules)
+
+	return map[string]*RuleSet{
+		"INPUT": {
+			ChainRule: ":INPUT ACCEPT",
+			Rules: []string{
+				"-A INPUT -j " + chain,
+			},
+		},
+		chain: {
+			ChainRule: ":" + chain + " - [0:0]",
+			Rules:     rules,
+		},
+	}
+}
+
+// maintenanceTarget returns the iptables target that handles protocol traffic for m
+func maintenanceTarget(m types.Maintenance, protocol string) string {
+	if m.Action == types.MaintenanceDrop {
+		return "DROP"
+	}
+	if protocol == "tcp" {
+		return "REJECT --reject-with tcp-reset"
+	}
+	return "REJECT --reject-with icmp-port-unreachable"
+}
+
+// MaintenanceRulesBytes renders the maintenance chain as iptables-restore input for the filter table
+func (i *IPTables) MaintenanceRulesBytes(config *types.ClusterConfig) []byte {
+	return bytesFromRulesForTable(util.TableFilter, i.GenerateMaintenanceRules(config))
+}
+
+// SetMaintenance writes the maintenance chain into the filter table, leaving any
+// chains that ravel does not own untouched. The table is only written when the
+// chain changes.
+func (i *IPTables) SetMaintenance(config *types.ClusterConfig) error {
+	var err error
+	var written bool
+	start := time.Now()
+	defer func() {
+		if written || err != nil {
+			i.metrics.IPTables("maintenance", 1, err, time.Since(start))
+		}
+	}()
+
+	written, err = i.restoreOwnedChain(util.TableFilter, i.maintenanceChain(), i.GenerateMaintenanceRules(config))
+	return err
+}
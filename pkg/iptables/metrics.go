@@ -2,6 +2,7 @@ package iptables
 
 import (
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Comcast/Ravel/pkg/stats"
@@ -10,9 +11,13 @@ import (
 
 type iptablesMetrics interface {
 	IPTables(operation string, tries int, err error, d time.Duration)
+	Restored(mode string, chains, rules, bytes int)
+	Cardinality(c Cardinality)
 
 	ChainRemoved(name, rule string)
 	ChainGauge(len int, kind string)
+
+	LockWait(family string)
 }
 
 type metrics struct {
@@ -24,6 +29,11 @@ type metrics struct {
 
 	chainRemoved *prometheus.CounterVec
 	chainGauge   *prometheus.GaugeVec
+
+	restoreSize *prometheus.GaugeVec
+	cardinality *prometheus.GaugeVec
+
+	lockWaits *prometheus.CounterVec
 }
 
 func (m *metrics) IPTables(operation string, tries int, err error, d time.Duration) {
@@ -40,6 +50,29 @@ func (m *metrics) IPTables(operation string, tries int, err error, d time.Durati
 	m.iptablesLatency.With(labels).Observe(float64(d.Nanoseconds() / 1000))
 }
 
+// Restored records the size of the last restore, in chains and rules written
+// and bytes of iptables-restore input. mode is full when the whole table was
+// written, scoped when only changes were.
+func (m *metrics) Restored(mode string, chains, rules, bytes int) {
+	labels := prometheus.Labels{"lb": m.lbKind, "seczone": m.configKey, "mode": mode}
+	labels["kind"] = "chains"
+	m.restoreSize.With(labels).Set(float64(chains))
+	labels["kind"] = "rules"
+	m.restoreSize.With(labels).Set(float64(rules))
+	labels["kind"] = "bytes"
+	m.restoreSize.With(labels).Set(float64(bytes))
+}
+
+// Cardinality records the size of the ravel chains the last restore left in
+// the table
+func (m *metrics) Cardinality(c Cardinality) {
+	labels := prometheus.Labels{"lb": m.lbKind, "seczone": m.configKey}
+	for kind, v := range map[string]int{"chains": c.Chains, "rules": c.Rules, "longest_chain": c.Longest, "depth": c.Depth} {
+		labels["kind"] = kind
+		m.cardinality.With(labels).Set(float64(v))
+	}
+}
+
 func (m *metrics) ChainRemoved(name, rule string) {
 	// If the cardinality of this metric becomes a problem in production,
 	// refer to the reset lifecycle in pkg/system/watcherMetrics.go for
@@ -58,8 +91,30 @@ func (m *metrics) ChainGauge(l int, kind string) {
 	}).Set(float64(l))
 }
 
+// LockWait counts a command that found the xtables lock of family held
+func (m *metrics) LockWait(family string) {
+	m.lockWaits.With(prometheus.Labels{"lb": m.lbKind, "seczone": m.configKey, "family": family}).Add(1)
+}
+
+// the iptables metric vectors are shared by every metrics so that more than one
+// iptables manager can be created in a process without registering the same
+// collectors twice.
+var (
+	metricVecsOnce sync.Once
+	metricVecs     *metrics
+)
+
 // NewMetrics creates a new metrics struct tha tholds metrics for iptables
 func NewMetrics(lbKind, configKey string) *metrics {
+	metricVecsOnce.Do(func() { metricVecs = newMetricVecs() })
+
+	m := *metricVecs
+	m.lbKind = lbKind
+	m.configKey = configKey
+	return &m
+}
+
+func newMetricVecs() *metrics {
 
 	defaultLabels := []string{"lb", "seczone"}
 	iptablesLabels := append(defaultLabels, []string{"operation", "attempts", "outcome"}...)
@@ -91,19 +146,42 @@ func NewMetrics(lbKind, configKey string) *metrics {
 		Help: "is twi guages, one for the inbound/calculated chain size, and one for the configured size.",
 	}, chainGaugeLabels)
 
+	// gauge iptables_restore_size
+	restoreSize := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: stats.Prefix + "iptables_restore_size",
+		Help: "is a gauge of the chains, rules and bytes written by the last iptables restore. labels for mode full|scoped and kind chains|rules|bytes",
+	}, append(defaultLabels, "mode", "kind"))
+
+	// gauge iptables_ravel_cardinality
+	cardinality := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: stats.Prefix + "iptables_ravel_cardinality",
+		Help: "is a gauge of the size of the ravel chains after the last iptables restore. label for kind chains|rules|longest_chain|depth, where depth is the most ravel chains a packet passes through",
+	}, chainGaugeLabels)
+
 	prometheus.MustRegister(iptablesCount)
 	prometheus.MustRegister(iptablesLatency)
 	prometheus.MustRegister(chainRemoved)
 	prometheus.MustRegister(chainGauge)
+	// counter iptables_lock_wait_count
+	lockWaits := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: stats.Prefix + "iptables_lock_wait_count",
+		Help: "is a count of iptables commands and restores that found the xtables lock held by another program, i.e. kube-proxy. label for family ipv4|ipv6",
+	}, append(defaultLabels, "family"))
 
-	return &metrics{
-		lbKind:    lbKind,
-		configKey: configKey,
+	prometheus.MustRegister(restoreSize)
+	prometheus.MustRegister(cardinality)
+	prometheus.MustRegister(lockWaits)
 
+	return &metrics{
 		iptablesCount:   iptablesCount,
 		iptablesLatency: iptablesLatency,
 
 		chainRemoved: chainRemoved,
 		chainGauge:   chainGauge,
+
+		restoreSize: restoreSize,
+		cardinality: cardinality,
+
+		lockWaits: lockWaits,
 	}
 }
@@ -0,0 +1,111 @@
+package iptables
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// mirrorChain is the mangle table chain that copies the traffic of mirrored VIP ports to their shadow backend
+func (i *IPTables) mirrorChain() string {
+	return i.chain.String() + "-MIRROR"
+}
+
+// EnableMirror lets VIP ports with a mirror in the cluster config have their
+// traffic copied to a shadow backend. The connections of sampled ports that
+// are picked for mirroring carry mark in their connmark.
+func (i *IPTables) EnableMirror(mark int) {
+	i.mirrorMark = mark
+}
+
+// GenerateMirrorRules creates the mangle table rules that copy the traffic of
+// the mirrored ports of the v4 VIPs, or of the v6 VIPs when v6 is set, to the
+// mirror's gateway with TEE. A sampled port picks its share of the new
+// connections at random and marks them, and only the packets of marked
+// connections are copied. Rules are sorted so that an unchanged config
+// renders identically.
+func (i *IPTables) GenerateMirrorRules(config *types.ClusterConfig, v6 bool) map[string]*RuleSet {
+	chain := i.mirrorChain()
+	mark := fmt.Sprintf("%#x/%#x", i.mirrorMark, i.mirrorMark)
+
+	rules := []string{}
+	if config != nil {
+		ports := config.Config
+		if v6 {
+			ports = config.Config6
+		}
+		for _, vp := range sortedVIPPorts(ports) {
+			def := ports[vp.vip][vp.port]
+			if !def.Mirrored() {
+				continue
+			}
+			for _, protocol := range getServiceProtocols(def.TCPEnabled, def.UDPEnabled) {
+				match := fmt.Sprintf("-d %s/%d -p %s -m %s --dport %s", vp.vip, hostPrefixLen(vp.vip), protocol, protocol, vp.port)
+				if !def.Mirror.Sampled() {
+					rules = append(rules, fmt.Sprintf("-A %s %s -j TEE --gateway %s", chain, match, def.Mirror.Gateway))
+					continue
+				}
+				rules = append(rules,
+					fmt.Sprintf("-A %s %s -m conntrack --ctstate NEW -m statistic --mode random --probability %.5f -j CONNMARK --set-xmark %s",
+						chain, match, float64(def.Mirror.Percent)/100, mark),
+					fmt.Sprintf("-A %s %s -m connmark --mark %s -j TEE --gateway %s", chain, match, mark, def.Mirror.Gateway))
+			}
+		}
+	}
+
+	return map[string]*RuleSet{
+		"PREROUTING": {
+			ChainRule: ":PREROUTING ACCEPT",
+			Rules: []string{
+				"-A PREROUTING -j " + chain,
+			},
+		},
+		chain: {
+			ChainRule: ":" + chain + " - [0:0]",
+			Rules:     rules,
+		},
+	}
+}
+
+// MirrorRulesBytes renders the v4 mirror chain as iptables-restore input for the mangle table
+func (i *IPTables) MirrorRulesBytes(config *types.ClusterConfig) []byte {
+	return bytesFromRulesForTable(util.TableMangle, i.GenerateMirrorRules(config, false))
+}
+
+// SetMirror writes the mirror chain into the mangle table of each family that
+// has mirrored ports, or had them on the last pass. A table is only written
+// when the chain changes. Nothing is done unless EnableMirror was called.
+func (i *IPTables) SetMirror(config *types.ClusterConfig) error {
+	if i.mirrorMark == 0 {
+		return nil
+	}
+
+	var err error
+	var written4, written6 bool
+	start := time.Now()
+	defer func() {
+		if written4 || written6 || err != nil {
+			i.metrics.IPTables("mirror", 1, err, time.Since(start))
+		}
+	}()
+
+	if want := config.HasMirror(false); want || i.mirror4 {
+		if written4, err = i.restoreOwnedChain(util.TableMangle, i.mirrorChain(), i.GenerateMirrorRules(config, false)); err != nil {
+			return err
+		}
+		// keep writing the chain after the last mirror goes, so that it is emptied
+		i.mirror4 = want
+	}
+	if want := config.HasMirror(true); want || i.mirror6 {
+		if i.iptables6 == nil {
+			i.iptables6 = i.newRunner6()
+		}
+		if written6, err = restoreOwnedChain(i.iptables6, util.TableMangle, i.mirrorChain(), i.GenerateMirrorRules(config, true)); err != nil {
+			return err
+		}
+		i.mirror6 = want
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package iptables
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// notrackChain is the raw table chain that exempts VIP traffic from connection tracking
+func (i *IPTables) notrackChain() string {
+	return i.chain.String() + "-NOTRACK"
+}
+
+// GenerateNotrackRules creates the raw table rules that bypass connection tracking
+// for every IPv4 VIP port with NoTrack set in the cluster config. Rules are sorted
+// so that an unchanged config renders identically.
+func (i *IPTables) GenerateNotrackRules(config *types.ClusterConfig) map[string]*RuleSet {
+	chain := i.notrackChain()
+
+	rules := []string{}
+	if config != nil {
+		for vip, ports := range config.Config {
+			for port, def := range ports {
+				if def == nil || !def.NoTrack {
+					continue
+				}
+				for _, protocol := range getServiceProtocols(def.TCPEnabled, def.UDPEnabled) {
+					rules = append(rules, fmt.Sprintf("-A %s -d %s/32 -p %s -m %s --dport %s -j CT --notrack",
+						chain, vip, protocol, protocol, port))
+				}
+			}
+		}
+	}
+	sort.Strings(rules)
+
+	return map[string]*RuleSet{
+		"PREROUTING": {
+			ChainRule: ":PREROUTING ACCEPT",
+			Rules: []string{
+				"-A PREROUTING -j " + chain,
+			},
+		},
+		chain: {
+			ChainRule: ":" + chain + " - [0:0]",
+			Rules:     rules,
+		},
+	}
+}
+
+// NotrackRulesBytes renders the notrack chain as iptables-restore input for the raw table
+func (i *IPTables) NotrackRulesBytes(config *types.ClusterConfig) []byte {
+	return bytesFromRulesForTable(util.TableRaw, i.GenerateNotrackRules(config))
+}
+
+// SetNotrack writes the notrack chain into the raw table, leaving any chains that
+// ravel does not own untouched. The table is only written when the chain changes.
+func (i *IPTables) SetNotrack(config *types.ClusterConfig) error {
+	var err error
+	var written bool
+	start := time.Now()
+	defer func() {
+		if written || err != nil {
+			i.metrics.IPTables("notrack", 1, err, time.Since(start))
+		}
+	}()
+
+	written, err = i.restoreOwnedChain(util.TableRaw, i.notrackChain(), i.GenerateNotrackRules(config))
+	return err
+}
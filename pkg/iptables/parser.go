@@ -1,6 +1,7 @@
 package iptables
 
 import (
+	"bytes"
 	"strings"
 
 	"github.com/Comcast/Ravel/pkg/util"
@@ -17,11 +18,14 @@ type RuleSet struct {
 func GetSaveLines(table util.Table, save []byte) (map[string]*RuleSet, error) {
 	chainsMap := map[string]*RuleSet{}
 
+	// every line is a substring of a single copy of the save
+	saveString := string(save)
+
 	tablePrefix := "*" + string(table)
 	readIndex := 0
 	// find beginning of table
-	for readIndex < len(save) {
-		line, n := ReadLine(readIndex, save)
+	for readIndex < len(saveString) {
+		line, n := readLine(readIndex, saveString)
 		readIndex = n
 		if strings.HasPrefix(line, tablePrefix) {
 			break
@@ -29,12 +33,12 @@ func GetSaveLines(table util.Table, save []byte) (map[string]*RuleSet, error) {
 	}
 
 	// parse table lines
-	for readIndex < len(save) {
+	for readIndex < len(saveString) {
 
-		line, n := ReadLine(readIndex, save)
+		line, n := readLine(readIndex, saveString)
 		readIndex = n
 		// Ignore empty lines with whitespace stripped
-		if len(strings.Join(strings.Fields(line), "")) == 0 {
+		if strings.TrimSpace(line) == "" {
 			continue
 		}
 
@@ -47,7 +51,7 @@ func GetSaveLines(table util.Table, save []byte) (map[string]*RuleSet, error) {
 		} else if strings.HasPrefix(line, "#") {
 			continue
 		} else if strings.HasPrefix(line, ":") {
-			chain = strings.SplitN(line[1:], " ", 2)[0]
+			chain = firstField(line[1:])
 			// Get the ruleset if it exists in the map, otherwise create it
 			if _, ok := chainsMap[chain]; !ok {
 				chainsMap[chain] = &RuleSet{
@@ -56,7 +60,7 @@ func GetSaveLines(table util.Table, save []byte) (map[string]*RuleSet, error) {
 			}
 
 		} else if strings.HasPrefix(line, "-") {
-			chain = strings.SplitN(line[3:], " ", 2)[0]
+			chain = firstField(line[3:])
 		}
 
 		// Capture the line
@@ -67,13 +71,36 @@ func GetSaveLines(table util.Table, save []byte) (map[string]*RuleSet, error) {
 	return chainsMap, nil
 }
 
+// firstField returns s up to the first space. unlike strings.SplitN it doesn't
+// allocate, which adds up over the tens of thousands of lines of a large table
+func firstField(s string) string {
+	if n := strings.IndexByte(s, ' '); n >= 0 {
+		return s[:n]
+	}
+	return s
+}
+
 // ReadLine reads a bunch of networking rules from a byte array
 func ReadLine(readIndex int, byteArray []byte) (string, int) {
+	// only the line being read is converted to a string
+	end := len(byteArray)
+	if n := bytes.IndexByte(byteArray[readIndex:], '\n'); n >= 0 {
+		end = readIndex + n + 1
+	}
+	line, n := readLine(0, string(byteArray[readIndex:end]))
+	return line, readIndex + n
+}
+
+// readLine reads the line of s starting at readIndex, with the surrounding
+// spaces trimmed, and returns it along with the index of the next line. The
+// line is a substring of s, so parsing a whole save held in a single string
+// doesn't allocate a string per line.
+func readLine(readIndex int, s string) (string, int) {
 	currentReadIndex := readIndex
 
 	// consume left spaces
-	for currentReadIndex < len(byteArray) {
-		if byteArray[currentReadIndex] == ' ' {
+	for currentReadIndex < len(s) {
+		if s[currentReadIndex] == ' ' {
 			currentReadIndex++
 		} else {
 			break
@@ -87,13 +114,13 @@ func ReadLine(readIndex int, byteArray []byte) (string, int) {
 	// it is set to -1 since the correct value has not yet been determined.
 	rightTrimIndex := -1
 
-	for ; currentReadIndex < len(byteArray); currentReadIndex++ {
-		if byteArray[currentReadIndex] == ' ' {
+	for ; currentReadIndex < len(s); currentReadIndex++ {
+		if s[currentReadIndex] == ' ' {
 			// set rightTrimIndex
 			if rightTrimIndex == -1 {
 				rightTrimIndex = currentReadIndex
 			}
-		} else if (byteArray[currentReadIndex] == '\n') || (currentReadIndex == (len(byteArray) - 1)) {
+		} else if (s[currentReadIndex] == '\n') || (currentReadIndex == (len(s) - 1)) {
 			// end of line or byte buffer is reached
 			if currentReadIndex <= leftTrimIndex {
 				return "", currentReadIndex + 1
@@ -101,13 +128,13 @@ func ReadLine(readIndex int, byteArray []byte) (string, int) {
 			// set the rightTrimIndex
 			if rightTrimIndex == -1 {
 				rightTrimIndex = currentReadIndex
-				if currentReadIndex == (len(byteArray)-1) && (byteArray[currentReadIndex] != '\n') {
+				if currentReadIndex == (len(s)-1) && (s[currentReadIndex] != '\n') {
 					// ensure that the last character is part of the returned string,
 					// unless the last character is '\n'
 					rightTrimIndex = currentReadIndex + 1
 				}
 			}
-			return string(byteArray[leftTrimIndex:rightTrimIndex]), currentReadIndex + 1
+			return s[leftTrimIndex:rightTrimIndex], currentReadIndex + 1
 		} else {
 			// unset rightTrimIndex
 			rightTrimIndex = -1
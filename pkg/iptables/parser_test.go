@@ -1,6 +1,9 @@
 package iptables
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 var testData []byte = []byte(`# Generated by iptables-save v1.4.21 on Wed Mar 22 00:38:34 2017
 *nat
@@ -40,3 +43,26 @@ func TestGetSaveLines(t *testing.T) {
 		t.Fatalf("expected five rules total. saw %d", sum)
 	}
 }
+
+func TestBytesFromRulesRoundTrip(t *testing.T) {
+	wholeset, _ := benchmarkTable(10, 3)
+	r, err := GetSaveLines("nat", BytesFromRules(wholeset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, wholeset) {
+		t.Fatalf("expected the rendered rules to parse back to the same rules. saw %v", r)
+	}
+}
+
+func BenchmarkGetSaveLines(b *testing.B) {
+	wholeset, _ := benchmarkTable(1000, 5)
+	save := BytesFromRules(wholeset)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := GetSaveLines("nat", save); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package iptables
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// SetScopedRestore makes Restore write only what changed in the chains ravel owns
+// since the last Save, using iptables-restore --noflush. Chains owned by other
+// programs are left alone instead of being rewritten every cycle, and missing
+// jumps are appended to the builtin chains, or inserted at their head with
+// SetJumpFirst. A Restore that doesn't follow a
+// Save writes the whole table, as it does without scoping.
+func (i *IPTables) SetScopedRestore() {
+	i.scoped = true
+}
+
+// scopedRestore returns the iptables-restore --noflush input that turns the
+// chains starting with prefix in have into those in want, along with the number
+// of chains and rules written. Declaring a chain in --noflush mode flushes it,
+// so changed chains are declared and written in full, and stale chains are
+// declared and then deleted. With jumpFirst, jumps that aren't at the head of a
+// builtin chain are deleted and inserted there. It returns nil when nothing differs.
+func scopedRestore(table util.Table, prefix string, jumpFirst bool, want, have map[string]*RuleSet) ([]byte, int, int) {
+	declare := []string{}
+	rules := []string{}
+	remove := []string{}
+
+	chains := make([]string, 0, len(want))
+	for chain := range want {
+		chains = append(chains, chain)
+	}
+	sort.Strings(chains)
+
+	for _, chain := range chains {
+		set := want[chain]
+		var haveRules []string
+		h, found := have[chain]
+		if found {
+			haveRules = h.Rules
+		}
+
+		if isBuiltinChain(chain) {
+			// other programs own the rest of a builtin chain, so only the
+			// missing jumps are appended
+			if !jumpFirst {
+				rules = append(rules, missingRules(set.Rules, haveRules)...)
+				continue
+			}
+			if len(haveRules) >= len(set.Rules) && equalRules(set.Rules, haveRules[:len(set.Rules)]) {
+				continue
+			}
+			present := map[string]bool{}
+			for _, rule := range haveRules {
+				present[rule] = true
+			}
+			for _, rule := range set.Rules {
+				if present[rule] {
+					rules = append(rules, "-D"+strings.TrimPrefix(rule, "-A"))
+				}
+			}
+			for n, rule := range set.Rules {
+				rules = append(rules, fmt.Sprintf("-I %s %d%s", chain, n+1, strings.TrimPrefix(rule, "-A "+chain)))
+			}
+			continue
+		}
+		if !strings.HasPrefix(chain, prefix) {
+			continue
+		}
+		if found && equalRules(set.Rules, haveRules) {
+			continue
+		}
+		declare = append(declare, set.ChainRule)
+		rules = append(rules, set.Rules...)
+	}
+
+	stale := []string{}
+	for chain := range have {
+		if _, ok := want[chain]; !ok && strings.HasPrefix(chain, prefix) {
+			stale = append(stale, chain)
+		}
+	}
+	sort.Strings(stale)
+	for _, chain := range stale {
+		declare = append(declare, ":"+chain+" - [0:0]")
+		remove = append(remove, "-X "+chain)
+	}
+
+	if len(declare)+len(rules) == 0 {
+		return nil, 0, 0
+	}
+
+	lines := []string{"*" + string(table)}
+	lines = append(lines, declare...)
+	lines = append(lines, rules...)
+	lines = append(lines, remove...)
+	lines = append(lines, "COMMIT\n")
+	return []byte(strings.Join(lines, "\n")), len(declare), len(rules)
+}
+
+// restoreScoped writes the difference between rules and the last Save. It returns
+// false, without writing anything, when there is no Save to compare with.
+func (i *IPTables) restoreScoped(rules map[string]*RuleSet) (bool, error) {
+	saved := i.saved
+	i.saved = nil
+	if saved == nil {
+		return false, nil
+	}
+
+	var err error
+	start := time.Now()
+	b, chains, written := scopedRestore(i.table, i.chain.String(), i.jumpFirst, rules, saved)
+	i.metrics.Restored("scoped", chains, written, len(b))
+	i.metrics.Cardinality(cardinality(i.chain.String(), rules))
+	if b == nil {
+		i.logger.Debugf("iptables: no changes to restore")
+		return true, nil
+	}
+	defer func() {
+		i.metrics.IPTables("restore", 1, err, time.Since(start))
+	}()
+	err = i.iptables.Restore(i.table, b, util.NoFlushTables, util.RestoreCounters)
+	return true, err
+}
@@ -0,0 +1,99 @@
+package iptables
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// synproxyChain is the raw and filter table chain that hands the handshakes of
+// VIPs with the SYN proxy enabled to SYNPROXY
+func (i *IPTables) synproxyChain() string {
+	return i.chain.String() + "-SYNPROXY"
+}
+
+// GenerateSYNProxyRules creates the raw and filter table rules of the SYN proxy
+// for every tcp port of the IPv4 VIPs that enable it. The raw rules exempt the
+// initial SYN from connection tracking, so that it reaches SYNPROXY in the
+// filter table as untracked. SYNPROXY answers it with a cookie and, once the
+// client returns a valid one, lets the handshake through to IPVS. Anything
+// else that conntrack doesn't recognize is dropped.
+func (i *IPTables) GenerateSYNProxyRules(config *types.ClusterConfig) (raw, filter map[string]*RuleSet) {
+	chain := i.synproxyChain()
+
+	rawRules := []string{}
+	filterRules := []string{}
+	if config != nil {
+		for _, vp := range sortedVIPPorts(config.Config) {
+			def := config.Config[vp.vip][vp.port]
+			d, ok := config.SYNProxy(vp.vip)
+			if !ok || def == nil || !def.TCPEnabled || def.Translated() {
+				continue
+			}
+			mss, wscale := d.Options()
+			match := fmt.Sprintf("-d %s/32 -p tcp -m tcp --dport %s", vp.vip, vp.port)
+			rawRules = append(rawRules,
+				fmt.Sprintf("-A %s %s --tcp-flags FIN,SYN,RST,ACK SYN -j CT --notrack", chain, match))
+			filterRules = append(filterRules,
+				fmt.Sprintf("-A %s %s -m conntrack --ctstate INVALID,UNTRACKED -j SYNPROXY --sack-perm --timestamp --wscale %d --mss %d", chain, match, wscale, mss),
+				fmt.Sprintf("-A %s %s -m conntrack --ctstate INVALID -j DROP", chain, match))
+		}
+	}
+
+	raw = map[string]*RuleSet{
+		"PREROUTING": {
+			ChainRule: ":PREROUTING ACCEPT",
+			Rules: []string{
+				"-A PREROUTING -j " + chain,
+			},
+		},
+		chain: {
+			ChainRule: ":" + chain + " - [0:0]",
+			Rules:     rawRules,
+		},
+	}
+	filter = map[string]*RuleSet{
+		"INPUT": {
+			ChainRule: ":INPUT ACCEPT",
+			Rules: []string{
+				"-A INPUT -j " + chain,
+			},
+		},
+		chain: {
+			ChainRule: ":" + chain + " - [0:0]",
+			Rules:     filterRules,
+		},
+	}
+	return raw, filter
+}
+
+// SYNProxyRulesBytes renders the syn proxy chains as iptables-restore input for
+// the raw table followed by the filter table
+func (i *IPTables) SYNProxyRulesBytes(config *types.ClusterConfig) []byte {
+	raw, filter := i.GenerateSYNProxyRules(config)
+	return append(bytesFromRulesForTable(util.TableRaw, raw), bytesFromRulesForTable(util.TableFilter, filter)...)
+}
+
+// SetSYNProxy writes the syn proxy chains into the raw and filter tables,
+// leaving any chains that ravel does not own untouched. The filter table goes
+// first, so that no untracked SYN is let through before SYNPROXY is there to
+// answer it. A table is only written when its chain changes.
+func (i *IPTables) SetSYNProxy(config *types.ClusterConfig) error {
+	var err error
+	var writtenRaw, writtenFilter bool
+	start := time.Now()
+	defer func() {
+		if writtenRaw || writtenFilter || err != nil {
+			i.metrics.IPTables("synproxy", 1, err, time.Since(start))
+		}
+	}()
+
+	raw, filter := i.GenerateSYNProxyRules(config)
+	if writtenFilter, err = i.restoreOwnedChain(util.TableFilter, i.synproxyChain(), filter); err != nil {
+		return err
+	}
+	writtenRaw, err = i.restoreOwnedChain(util.TableRaw, i.synproxyChain(), raw)
+	return err
+}
@@ -0,0 +1,175 @@
+package iptables
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+	utilexec "github.com/Comcast/Ravel/pkg/util/exec"
+)
+
+// tproxyChain is the mangle table chain that delivers VIP ports to their local transparent proxy
+func (i *IPTables) tproxyChain() string {
+	return i.chain.String() + "-TPROXY"
+}
+
+// EnableTProxy lets VIP ports with tproxyPort set in the cluster config be
+// delivered to a transparent proxy on the director. TPROXY marks their
+// packets with mark, and a policy routing rule sends marked packets to table,
+// which routes everything to the local host.
+func (i *IPTables) EnableTProxy(mark, table int) {
+	i.tproxyMark = mark
+	i.tproxyTable = table
+	if i.exec == nil {
+		i.exec = utilexec.New()
+	}
+}
+
+// GenerateTProxyRules creates the mangle table rules that hand traffic to the
+// transparently proxied ports of the v4 VIPs, or of the v6 VIPs when v6 is
+// set, to the proxy listening on the port's tproxyPort. TPROXY happens in
+// PREROUTING, so the traffic never reaches IPVS. Rules are sorted so that an
+// unchanged config renders identically.
+func (i *IPTables) GenerateTProxyRules(config *types.ClusterConfig, v6 bool) map[string]*RuleSet {
+	chain := i.tproxyChain()
+
+	onIP := "0.0.0.0"
+	if v6 {
+		onIP = "::"
+	}
+
+	rules := []string{}
+	if config != nil {
+		ports := config.Config
+		if v6 {
+			ports = config.Config6
+		}
+		for _, vp := range sortedVIPPorts(ports) {
+			def := ports[vp.vip][vp.port]
+			if !def.TProxied() {
+				continue
+			}
+			for _, protocol := range getServiceProtocols(def.TCPEnabled, def.UDPEnabled) {
+				rules = append(rules, fmt.Sprintf("-A %s -d %s/%d -p %s -m %s --dport %s -j TPROXY --on-port %d --on-ip %s --tproxy-mark %#x/%#x",
+					chain, vp.vip, hostPrefixLen(vp.vip), protocol, protocol, vp.port, def.TProxyPort, onIP, i.tproxyMark, i.tproxyMark))
+			}
+		}
+	}
+
+	return map[string]*RuleSet{
+		"PREROUTING": {
+			ChainRule: ":PREROUTING ACCEPT",
+			Rules: []string{
+				"-A PREROUTING -j " + chain,
+			},
+		},
+		chain: {
+			ChainRule: ":" + chain + " - [0:0]",
+			Rules:     rules,
+		},
+	}
+}
+
+// TProxyRulesBytes renders the v4 tproxy chain as iptables-restore input for the mangle table
+func (i *IPTables) TProxyRulesBytes(config *types.ClusterConfig) []byte {
+	return bytesFromRulesForTable(util.TableMangle, i.GenerateTProxyRules(config, false))
+}
+
+// SetTProxy puts the policy routing in place and writes the tproxy chains into
+// the mangle tables of each family that has transparently proxied ports, or
+// had them on the last pass. Nothing is done unless EnableTProxy was called.
+func (i *IPTables) SetTProxy(config *types.ClusterConfig) error {
+	if i.tproxyMark == 0 {
+		return nil
+	}
+
+	var err error
+	var written4, written6 bool
+	start := time.Now()
+	defer func() {
+		if written4 || written6 || err != nil {
+			i.metrics.IPTables("tproxy", 1, err, time.Since(start))
+		}
+	}()
+
+	if want := config.HasTProxy(false); want || i.tproxy4 {
+		if written4, err = i.setTProxy(config, false, want); err != nil {
+			return err
+		}
+		i.tproxy4 = want
+	}
+	if want := config.HasTProxy(true); want || i.tproxy6 {
+		if i.iptables6 == nil {
+			i.iptables6 = i.newRunner6()
+		}
+		if written6, err = i.setTProxy(config, true, want); err != nil {
+			return err
+		}
+		i.tproxy6 = want
+	}
+	return nil
+}
+
+// setTProxy brings the routing and chain of a family in line with config. The
+// routing goes in before the rules that mark packets for it, and comes out
+// after them.
+func (i *IPTables) setTProxy(config *types.ClusterConfig, v6, want bool) (bool, error) {
+	runner := i.iptables
+	if v6 {
+		runner = i.iptables6
+	}
+
+	if want {
+		if err := i.setTProxyRouting(v6, true); err != nil {
+			return false, err
+		}
+	}
+	written, err := restoreOwnedChain(runner, util.TableMangle, i.tproxyChain(), i.GenerateTProxyRules(config, v6))
+	if err != nil || want {
+		return written, err
+	}
+	return written, i.setTProxyRouting(v6, false)
+}
+
+// setTProxyRouting adds, or removes when enabled is false, the rule that looks
+// up packets carrying the tproxy mark in the tproxy table, and the route in
+// that table that delivers everything locally
+func (i *IPTables) setTProxyRouting(v6, enabled bool) error {
+	family, all := "-4", "0.0.0.0/0"
+	if v6 {
+		family, all = "-6", "::/0"
+	}
+	mark := fmt.Sprintf("%#x/%#x", i.tproxyMark, i.tproxyMark)
+	table := strconv.Itoa(i.tproxyTable)
+
+	out, err := i.run("ip", family, "rule", "show")
+	if err != nil {
+		return fmt.Errorf("iptables: unable to list routing rules. %v", err)
+	}
+	installed := strings.Contains(string(out), "fwmark "+mark+" lookup "+table)
+
+	if !enabled {
+		if installed {
+			if _, err := i.run("ip", family, "rule", "del", "fwmark", mark, "lookup", table); err != nil {
+				return util.Errorf(util.ErrKernelApply, "iptables: unable to remove tproxy routing rule. %v", err)
+			}
+		}
+		if _, err := i.run("ip", family, "route", "del", "local", all, "dev", "lo", "table", table); err != nil && !strings.Contains(err.Error(), "No such process") {
+			return util.Errorf(util.ErrKernelApply, "iptables: unable to remove tproxy route. %v", err)
+		}
+		return nil
+	}
+
+	if !installed {
+		if _, err := i.run("ip", family, "rule", "add", "fwmark", mark, "lookup", table); err != nil {
+			return util.Errorf(util.ErrKernelApply, "iptables: unable to add tproxy routing rule. %v", err)
+		}
+	}
+	if _, err := i.run("ip", family, "route", "replace", "local", all, "dev", "lo", "table", table); err != nil {
+		return util.Errorf(util.ErrKernelApply, "iptables: unable to add tproxy route. %v", err)
+	}
+	return nil
+}
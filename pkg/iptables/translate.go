@@ -0,0 +1,221 @@
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+	utilexec "github.com/Comcast/Ravel/pkg/util/exec"
+)
+
+// siitBinary manages the jool SIIT translator
+const siitBinary = "jool_siit"
+
+// translateChain is the mangle table chain that hands translated VIP traffic to jool
+func (i *IPTables) translateChain() string {
+	return i.chain.String() + "-XLAT"
+}
+
+// EnableTranslation lets VIP ports with translate set in the cluster config be
+// served by their paired VIP of the other family. Their traffic is handed to
+// the jool SIIT instance, run in iptables mode, whose explicit address mappings
+// translate each VIP to its pair. Addresses without a mapping, the clients,
+// are translated with pool6.
+func (i *IPTables) EnableTranslation(instance, pool6 string) {
+	i.siitInstance = instance
+	i.siitPool6 = pool6
+	if i.exec == nil {
+		i.exec = utilexec.New()
+	}
+	i.iptables6 = i.newRunner6()
+}
+
+// GenerateTranslationRules creates the mangle table rules that send traffic to
+// the translated ports of the v4 VIPs, or of the v6 VIPs when v6 is set, to
+// the jool instance. Translation happens in PREROUTING, before IPVS sees the
+// traffic, and the translated packets are load balanced by the paired VIP.
+func (i *IPTables) GenerateTranslationRules(config *types.ClusterConfig, v6 bool) map[string]*RuleSet {
+	chain := i.translateChain()
+
+	rules := []string{}
+	for _, t := range config.Translations() {
+		if isV6(t.VIP) != v6 {
+			continue
+		}
+		for _, protocol := range getServiceProtocols(t.Def.TCPEnabled, t.Def.UDPEnabled) {
+			rules = append(rules, fmt.Sprintf("-A %s -d %s/%d -p %s -m %s --dport %s -j JOOL_SIIT --instance %s",
+				chain, t.VIP, hostPrefixLen(t.VIP), protocol, protocol, t.Port, i.siitInstance))
+		}
+	}
+	sort.Strings(rules)
+
+	return map[string]*RuleSet{
+		"PREROUTING": {
+			ChainRule: ":PREROUTING ACCEPT",
+			Rules: []string{
+				"-A PREROUTING -j " + chain,
+			},
+		},
+		chain: {
+			ChainRule: ":" + chain + " - [0:0]",
+			Rules:     rules,
+		},
+	}
+}
+
+// TranslationMappings returns the explicit address mappings the jool instance
+// needs for config, as "v6/128 v4/32" in sorted order
+func TranslationMappings(config *types.ClusterConfig) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, t := range config.Translations() {
+		v4, v6 := t.VIP, t.Target
+		if isV6(t.VIP) {
+			v4, v6 = t.Target, t.VIP
+		}
+		// jool displays the addresses in their canonical form
+		m := fmt.Sprintf("%s/128 %s/32", net.ParseIP(string(v6)), net.ParseIP(string(v4)))
+		if !seen[m] {
+			seen[m] = true
+			out = append(out, m)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// SetTranslation writes the translation chains into the v4 and v6 mangle
+// tables and brings the address mappings of the jool instance in line with
+// the config. Nothing is done unless EnableTranslation was called.
+func (i *IPTables) SetTranslation(config *types.ClusterConfig) error {
+	if i.siitInstance == "" {
+		return nil
+	}
+
+	var err error
+	var written4, written6 bool
+	start := time.Now()
+	defer func() {
+		if written4 || written6 || err != nil {
+			i.metrics.IPTables("translate", 1, err, time.Since(start))
+		}
+	}()
+
+	// the mappings go in first, so that no traffic reaches jool for a VIP it
+	// can't translate
+	if err = i.setTranslationMappings(TranslationMappings(config)); err != nil {
+		return err
+	}
+	if written4, err = i.restoreOwnedChain(util.TableMangle, i.translateChain(), i.GenerateTranslationRules(config, false)); err != nil {
+		return err
+	}
+	written6, err = restoreOwnedChain(i.iptables6, util.TableMangle, i.translateChain(), i.GenerateTranslationRules(config, true))
+	return err
+}
+
+// setTranslationMappings adds and removes explicit address mappings of the jool
+// instance until they match want, creating the instance if it doesn't exist
+func (i *IPTables) setTranslationMappings(want []string) error {
+	have, err := i.siit("-i", i.siitInstance, "eamt", "display", "--csv", "--no-headers")
+	if err != nil {
+		if _, err := i.siit("instance", "add", i.siitInstance, "--iptables", "--pool6", i.siitPool6); err != nil {
+			return util.Errorf(util.ErrKernelApply, "iptables: unable to create translator instance %s. %v", i.siitInstance, err)
+		}
+		have = nil
+	}
+
+	add, remove := diffMappings(parseMappings(have), want)
+	for _, m := range remove {
+		if _, err := i.siit(append([]string{"-i", i.siitInstance, "eamt", "remove"}, strings.Fields(m)...)...); err != nil {
+			return util.Errorf(util.ErrKernelApply, "iptables: unable to remove translator mapping %s. %v", m, err)
+		}
+	}
+	for _, m := range add {
+		if _, err := i.siit(append([]string{"-i", i.siitInstance, "eamt", "add"}, strings.Fields(m)...)...); err != nil {
+			return util.Errorf(util.ErrKernelApply, "iptables: unable to add translator mapping %s. %v", m, err)
+		}
+	}
+	return nil
+}
+
+// CheckTranslation returns an error that says what is missing unless the
+// jool_siit binary can reach the jool_siit kernel module, so that a node
+// without jool fails at startup rather than on the first translated VIP
+func (i *IPTables) CheckTranslation() error {
+	if _, err := i.siit("instance", "display"); err != nil {
+		return fmt.Errorf("iptables: jool is unusable. the jool_siit binary from jool-tools must be installed and the jool_siit kernel module loaded on the node. %v", err)
+	}
+	return nil
+}
+
+// siit runs a jool_siit command
+func (i *IPTables) siit(args ...string) ([]byte, error) {
+	return i.run(siitBinary, args...)
+}
+
+// run runs a command other than iptables, returning its output and, on
+// failure, an error that includes it
+func (i *IPTables) run(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(i.cmdContext(), 10*time.Second)
+	defer cancel()
+
+	out, err := i.exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v (%s)", err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// parseMappings reads the csv output of an eamt display, one "v6,v4" pair per
+// line, into the "v6 v4" form of TranslationMappings
+func parseMappings(b []byte) []string {
+	out := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) != 2 {
+			continue
+		}
+		out = append(out, fields[0]+" "+fields[1])
+	}
+	return out
+}
+
+// diffMappings returns the mappings in want that aren't in have, and those in
+// have that aren't in want
+func diffMappings(have, want []string) (add, remove []string) {
+	haveSet := map[string]bool{}
+	for _, m := range have {
+		haveSet[m] = true
+	}
+	wantSet := map[string]bool{}
+	for _, m := range want {
+		wantSet[m] = true
+		if !haveSet[m] {
+			add = append(add, m)
+		}
+	}
+	for _, m := range have {
+		if !wantSet[m] {
+			remove = append(remove, m)
+		}
+	}
+	return add, remove
+}
+
+// isV6 reports whether vip is an IPv6 address
+func isV6(vip types.ServiceIP) bool {
+	return strings.Contains(string(vip), ":")
+}
+
+// hostPrefixLen is the prefix length that matches only vip
+func hostPrefixLen(vip types.ServiceIP) int {
+	if isV6(vip) {
+		return 128
+	}
+	return 32
+}
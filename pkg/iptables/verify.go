@@ -0,0 +1,173 @@
+package iptables
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// verifyMetrics records what the read back after a restore found
+type verifyMetrics interface {
+	ApplyVerified(what string, retried, divergent int)
+}
+
+// SetVerify reads the nat table back after every Restore and checks that the
+// ravel chains, and the jumps into them, match what was written. A table that
+// doesn't is restored again, up to retries times. When it still diverges after
+// that, the differences are logged and recorded, and Restore fails.
+func (i *IPTables) SetVerify(retries int, metrics verifyMetrics) {
+	i.verify = true
+	i.verifyRetries = retries
+	i.verifyMetrics = metrics
+}
+
+// divergence compares the chains that ravel owns, those starting with prefix,
+// and the rules it adds to the builtin chains between want and have. It returns
+// the chains that differ and the number of rules that differ in them.
+func divergence(prefix string, want, have map[string]*RuleSet) ([]string, int) {
+	chains := []string{}
+	rules := 0
+
+	for chain, set := range want {
+		var haveRules []string
+		if h, ok := have[chain]; ok {
+			haveRules = h.Rules
+		}
+
+		if isBuiltinChain(chain) {
+			// other programs own the rest of a builtin chain
+			missing := len(missingRules(set.Rules, haveRules))
+			if missing > 0 {
+				chains = append(chains, chain)
+				rules += missing
+			}
+			continue
+		}
+		if !strings.HasPrefix(chain, prefix) {
+			continue
+		}
+
+		_, found := have[chain]
+		differ := len(missingRules(set.Rules, haveRules)) + len(missingRules(haveRules, set.Rules))
+		if differ == 0 && !equalRules(set.Rules, haveRules) {
+			// same rules in a different order
+			differ = 1
+		}
+		if !found && differ == 0 {
+			// an empty chain that doesn't exist
+			differ = 1
+		}
+		if differ > 0 {
+			chains = append(chains, chain)
+			rules += differ
+		}
+	}
+
+	// stale ravel chains that should have been removed
+	for chain, set := range have {
+		if _, ok := want[chain]; ok || !strings.HasPrefix(chain, prefix) {
+			continue
+		}
+		chains = append(chains, chain)
+		rules += len(set.Rules) + 1
+	}
+
+	sort.Strings(chains)
+	return chains, rules
+}
+
+// Fingerprint is a checksum of the rules ravel owns in rules: the chains
+// starting with prefix, and the rules of the builtin chains that jump into
+// them. It changes when any of them is added, removed or reordered, but not
+// with the packet counters of the chains.
+func Fingerprint(prefix string, rules map[string]*RuleSet) string {
+	chains := make([]string, 0, len(rules))
+	for chain := range rules {
+		if isBuiltinChain(chain) || strings.HasPrefix(chain, prefix) {
+			chains = append(chains, chain)
+		}
+	}
+	sort.Strings(chains)
+
+	h := sha256.New()
+	for _, chain := range chains {
+		builtin := isBuiltinChain(chain)
+		owned := []string{}
+		for _, rule := range rules[chain].Rules {
+			if !builtin || strings.Contains(rule, prefix) {
+				owned = append(owned, rule)
+			}
+		}
+		if builtin && len(owned) == 0 {
+			continue
+		}
+		fmt.Fprintf(h, "%s\n", chain)
+		for _, rule := range owned {
+			fmt.Fprintf(h, "\t%s\n", rule)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// missingRules returns the rules in a that are not in b
+func missingRules(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, rule := range b {
+		in[rule] = true
+	}
+	missing := []string{}
+	for _, rule := range a {
+		if !in[rule] {
+			missing = append(missing, rule)
+		}
+	}
+	return missing
+}
+
+func equalRules(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for n := range a {
+		if a[n] != b[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyRestore reads the nat table back and restores rules again while the
+// ravel chains don't match them
+func (i *IPTables) verifyRestore(rules map[string]*RuleSet) error {
+	var chains []string
+	divergent, retried := 0, 0
+	for attempt := 0; ; attempt++ {
+		have, err := i.Save()
+		if err != nil {
+			return fmt.Errorf("unable to read back restored rules. %v", err)
+		}
+
+		chains, divergent = divergence(i.chain.String(), rules, have)
+		if divergent == 0 || attempt == i.verifyRetries {
+			break
+		}
+
+		i.logger.Warnf("iptables: %d rules in chains %s did not take effect. restoring again", divergent, strings.Join(chains, ","))
+		retried += divergent
+		if err := i.restore(rules); err != nil {
+			return err
+		}
+	}
+
+	if i.verifyMetrics != nil {
+		i.verifyMetrics.ApplyVerified("iptables", retried, divergent)
+	}
+	if divergent > 0 {
+		return util.Errorf(util.ErrKernelApply, "%d rules in chains %s did not take effect after %d retries", divergent, strings.Join(chains, ","), i.verifyRetries)
+	}
+	return nil
+}
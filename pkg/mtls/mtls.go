@@ -0,0 +1,364 @@
+// Package mtls secures the network apis of ravel, the control api, the watch
+// plane and the dashboard, with mutual TLS. The certificate, key and CA are read from
+// files, such as those of a mounted secret, and read again once they change,
+// so that they are rotated without a restart.
+//
+// The identities of a peer are the DNS and URI SANs of its certificate. A
+// Policy names the identities that may call each rpc method, and a call it
+// refuses is answered with an error without reaching the service. Handler
+// applies the same policy to an http api, as a single method.
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how often the files are checked for a rotation at most, and how long a
+// peer has to complete its handshake
+const (
+	reloadInterval   = 10 * time.Second
+	handshakeTimeout = 10 * time.Second
+)
+
+// Config names the files of mutual TLS. It is disabled without CertFile.
+type Config struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+
+	// ServerName, when set, is the name clients require in the certificate
+	// of the server. Otherwise they only require that the CA signed it, as
+	// servers are often dialed by pod address.
+	ServerName string
+
+	// Policy is the rules of the Policy servers authorize calls with, see
+	// ParsePolicy
+	Policy []string
+}
+
+// Enabled is whether mutual TLS is configured
+func (c Config) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// Validate makes sure that the files are all named or none are, and that the
+// policy parses
+func (c Config) Validate() error {
+	if !c.Enabled() {
+		if c.KeyFile != "" || c.CAFile != "" || len(c.Policy) > 0 {
+			return fmt.Errorf("tls-key, tls-ca and tls-policy need tls-cert")
+		}
+		return nil
+	}
+	if c.KeyFile == "" || c.CAFile == "" {
+		return fmt.Errorf("tls-cert needs tls-key and tls-ca")
+	}
+	_, err := ParsePolicy(c.Policy)
+	return err
+}
+
+// Files are the certificate, key and CA of a Config, reloaded when the files
+// change
+type Files struct {
+	sync.Mutex
+
+	config  Config
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	mtimes  []time.Time
+	checked time.Time
+
+	logger log.FieldLogger
+}
+
+// Load reads the files of config
+func Load(config Config, logger log.FieldLogger) (*Files, error) {
+	f := &Files{config: config, logger: logger.WithFields(log.Fields{"module": "mtls"})}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	f.checked = time.Now()
+	return f, nil
+}
+
+func (f *Files) paths() []string {
+	return []string{f.config.CertFile, f.config.KeyFile, f.config.CAFile}
+}
+
+func (f *Files) load() error {
+	mtimes := []time.Time{}
+	for _, path := range f.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("mtls: %v", err)
+		}
+		mtimes = append(mtimes, info.ModTime())
+	}
+	cert, err := tls.LoadX509KeyPair(f.config.CertFile, f.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("mtls: unable to load the certificate %s. %v", f.config.CertFile, err)
+	}
+	ca, err := ioutil.ReadFile(f.config.CAFile)
+	if err != nil {
+		return fmt.Errorf("mtls: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("mtls: no certificates in the CA %s", f.config.CAFile)
+	}
+	f.cert, f.pool, f.mtimes = &cert, pool, mtimes
+	return nil
+}
+
+// current returns the certificate and CA, reloading them first when the files
+// changed. Files that fail to load, as when a secret is caught mid-update,
+// leave the last in place until the next check.
+func (f *Files) current() (*tls.Certificate, *x509.CertPool) {
+	f.Lock()
+	defer f.Unlock()
+	if time.Since(f.checked) < reloadInterval {
+		return f.cert, f.pool
+	}
+	f.checked = time.Now()
+	for n, path := range f.paths() {
+		info, err := os.Stat(path)
+		if err == nil && info.ModTime().Equal(f.mtimes[n]) {
+			continue
+		}
+		if err := f.load(); err != nil {
+			f.logger.Errorf("mtls: keeping the last certificate. %v", err)
+		} else {
+			f.logger.Infof("mtls: reloaded the certificate %s", f.config.CertFile)
+		}
+		break
+	}
+	return f.cert, f.pool
+}
+
+// ServerConfig is the config of a server that requires clients to present a
+// certificate the CA signed
+func (f *Files) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := f.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    pool,
+			}, nil
+		},
+	}
+}
+
+// ClientConfig is the config of a client that presents its certificate and
+// requires the CA to have signed the server's, for the ServerName if any
+func (f *Files) ClientConfig() *tls.Config {
+	cert, pool := f.current()
+	serverName := f.config.ServerName
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*cert},
+		// the chain is verified below, where the name can be left out
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("mtls: the server presented no certificate")
+			}
+			opts := x509.VerifyOptions{
+				Roots:         pool,
+				DNSName:       serverName,
+				Intermediates: x509.NewCertPool(),
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
+
+// Identities returns the DNS and URI SANs of the certificate of the peer
+func Identities(cs tls.ConnectionState) []string {
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := cs.PeerCertificates[0]
+	ids := append([]string{}, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		ids = append(ids, uri.String())
+	}
+	return ids
+}
+
+// Policy authorizes rpc methods by the identities of the caller
+type Policy struct {
+	rules map[string]map[string]bool
+}
+
+// ParsePolicy parses rules of the form method=identity,identity. The method
+// is a Service.Method, every method of a service as Service.*, or * for any
+// method. The identity * is any caller the CA signed. The most specific rule
+// of a method decides, and a method with no rule is refused. Without rules,
+// any caller the CA signed may call any method.
+func ParsePolicy(rules []string) (Policy, error) {
+	p := Policy{rules: map[string]map[string]bool{}}
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		method := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || method == "" {
+			return Policy{}, fmt.Errorf("tls policy %q must be method=identity,identity", rule)
+		}
+		if method != "*" && !strings.Contains(method, ".") {
+			return Policy{}, fmt.Errorf("tls policy %q must name a Service.Method, a Service.* or *", rule)
+		}
+		if p.rules[method] == nil {
+			p.rules[method] = map[string]bool{}
+		}
+		for _, id := range strings.Split(parts[1], ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				p.rules[method][id] = true
+			}
+		}
+	}
+	return p, nil
+}
+
+// Allows is whether a caller of identities may call method
+func (p Policy) Allows(method string, identities []string) bool {
+	if len(p.rules) == 0 {
+		return true
+	}
+	candidates := []string{method}
+	if dot := strings.Index(method, "."); dot >= 0 {
+		candidates = append(candidates, method[:dot]+".*")
+	}
+	for _, candidate := range append(candidates, "*") {
+		allowed, ok := p.rules[candidate]
+		if !ok {
+			continue
+		}
+		if allowed["*"] {
+			return true
+		}
+		for _, id := range identities {
+			if allowed[id] {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// Listen listens on addr, for TLS connections when files are set
+func Listen(addr string, files *Files) (net.Listener, error) {
+	if files == nil {
+		return net.Listen("tcp", addr)
+	}
+	return tls.Listen("tcp", addr, files.ServerConfig())
+}
+
+// Dial connects to addr, with TLS when files are set
+func Dial(ctx context.Context, addr string, files *Files, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if files == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	return (&tls.Dialer{NetDialer: dialer, Config: files.ClientConfig()}).DialContext(ctx, "tcp", addr)
+}
+
+// ServerCodec returns the JSON rpc codec of a connection accepted by Listen.
+// The calls made over a TLS connection are authorized by policy.
+func ServerCodec(conn net.Conn, policy Policy, logger log.FieldLogger) (rpc.ServerCodec, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return jsonrpc.NewServerCodec(conn), nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("mtls: handshake with %s failed. %v", conn.RemoteAddr(), err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return &authorizedCodec{
+		ServerCodec: jsonrpc.NewServerCodec(conn),
+		policy:      policy,
+		identities:  Identities(tlsConn.ConnectionState()),
+		remote:      conn.RemoteAddr().String(),
+		logger:      logger,
+	}, nil
+}
+
+// authorizedCodec answers the calls its policy refuses with an error, and
+// passes the others on to the server
+type authorizedCodec struct {
+	rpc.ServerCodec
+
+	policy     Policy
+	identities []string
+	remote     string
+	logger     log.FieldLogger
+
+	// writes is held by every response, as refusals are written from the
+	// reading goroutine while the server writes the replies of its calls
+	writes sync.Mutex
+}
+
+func (c *authorizedCodec) ReadRequestHeader(r *rpc.Request) error {
+	for {
+		if err := c.ServerCodec.ReadRequestHeader(r); err != nil {
+			return err
+		}
+		if c.policy.Allows(r.ServiceMethod, c.identities) {
+			return nil
+		}
+		c.logger.Warnf("mtls: refused %s to %s with identities %v", r.ServiceMethod, c.remote, c.identities)
+		if err := c.ServerCodec.ReadRequestBody(nil); err != nil {
+			return err
+		}
+		refusal := &rpc.Response{ServiceMethod: r.ServiceMethod, Seq: r.Seq, Error: "mtls: " + r.ServiceMethod + " is not permitted to the caller"}
+		if err := c.WriteResponse(refusal, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// Handler serves the requests of handler that policy allows method to. Over
+// TLS, the identities are those of the client's certificate; a request not
+// made over TLS is served as is, as it is by ServerCodec.
+func Handler(handler http.Handler, policy Policy, method string, logger log.FieldLogger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			identities := Identities(*r.TLS)
+			if !policy.Allows(method, identities) {
+				logger.Warnf("mtls: refused %s to %s with identities %v", method, r.RemoteAddr, identities)
+				http.Error(w, "mtls: "+method+" is not permitted to the caller", http.StatusForbidden)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (c *authorizedCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.writes.Lock()
+	defer c.writes.Unlock()
+	return c.ServerCodec.WriteResponse(r, body)
+}
@@ -0,0 +1,321 @@
+package mtls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// authority signs the certificates of a test
+type authority struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newAuthority(t *testing.T, dir string) *authority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ravel test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &authority{t: t, dir: dir, cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for the DNS name and its key to the files of
+// name, and returns their config
+func (a *authority) issue(name, dnsName string) Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	c := Config{
+		CertFile: filepath.Join(a.dir, name+".crt"),
+		KeyFile:  filepath.Join(a.dir, name+".key"),
+		CAFile:   filepath.Join(a.dir, name+"-ca.crt"),
+	}
+	for path, b := range map[string][]byte{
+		c.CertFile: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		c.KeyFile:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		c.CAFile:   a.pem,
+	} {
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			a.t.Fatal(err)
+		}
+	}
+	return c
+}
+
+type Echo struct{}
+
+func (Echo) Get(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+func (Echo) Set(args string, reply *string) error {
+	*reply = "set " + args
+	return nil
+}
+
+func TestPolicy(t *testing.T) {
+	p, err := ParsePolicy([]string{
+		"Control.GetState=dashboard.ravel, ravelctl.ravel",
+		"Control.*=ravelctl.ravel",
+		"WatchPlane.Next=*",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		method     string
+		identities []string
+		allowed    bool
+	}{
+		{"Control.GetState", []string{"dashboard.ravel"}, true},
+		{"Control.GetState", []string{"ravelctl.ravel"}, true},
+		{"Control.WithdrawVIP", []string{"dashboard.ravel"}, false},
+		{"Control.WithdrawVIP", []string{"node.ravel", "ravelctl.ravel"}, true},
+		{"WatchPlane.Next", []string{"anyone.ravel"}, true},
+		{"Agent.Exec", []string{"ravelctl.ravel"}, false},
+		{"Control.GetState", nil, false},
+	} {
+		if p.Allows(c.method, c.identities) != c.allowed {
+			t.Errorf("expected %s by %v allowed to be %v", c.method, c.identities, c.allowed)
+		}
+	}
+
+	if open, _ := ParsePolicy(nil); !open.Allows("Control.WithdrawVIP", nil) {
+		t.Error("expected an empty policy to allow any caller")
+	}
+	for _, invalid := range []string{"Control.GetState", "=dashboard.ravel", "GetState=dashboard.ravel"} {
+		if _, err := ParsePolicy([]string{invalid}); err == nil {
+			t.Errorf("expected %q to be refused", invalid)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t, dir)
+	serverConfig := ca.issue("director", "director.ravel")
+	server, err := Load(serverConfig, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, _ := ParsePolicy([]string{"Echo.Get=dashboard.ravel"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener, err := Listen("127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rpcServer := rpc.NewServer()
+	rpcServer.Register(Echo{})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				codec, err := ServerCodec(conn, policy, logrus.New())
+				if err != nil {
+					conn.Close()
+					return
+				}
+				rpcServer.ServeCodec(codec)
+			}()
+		}
+	}()
+	addr := listener.Addr().String()
+
+	clientConfig := ca.issue("dashboard", "dashboard.ravel")
+	clientConfig.ServerName = "director.ravel"
+	client, err := Load(clientConfig, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := Dial(ctx, addr, client, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := jsonrpc.NewClient(conn)
+	defer c.Close()
+
+	var reply string
+	if err := c.Call("Echo.Get", "vip", &reply); err != nil || reply != "vip" {
+		t.Fatalf("expected the call to be permitted. have %q %v", reply, err)
+	}
+	if err := c.Call("Echo.Set", "vip", &reply); err == nil || !strings.Contains(err.Error(), "not permitted") {
+		t.Fatalf("expected the call to be refused. have %v", err)
+	}
+	// the connection is still served after a refusal
+	if err := c.Call("Echo.Get", "again", &reply); err != nil || reply != "again" {
+		t.Fatalf("expected the call to be permitted. have %q %v", reply, err)
+	}
+
+	// a server whose name isn't the one required is refused by the client
+	wrongName := clientConfig
+	wrongName.ServerName = "other.ravel"
+	other, _ := Load(wrongName, logrus.New())
+	if conn, err := Dial(ctx, addr, other, time.Second); err == nil {
+		conn.Close()
+		t.Fatal("expected a server of another name to be refused")
+	}
+
+	// a client of another CA is refused by the server
+	stranger, err := Load(newAuthority(t, t.TempDir()).issue("stranger", "dashboard.ravel"), logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger.pool = client.pool
+	if conn, err := Dial(ctx, addr, stranger, time.Second); err == nil {
+		c := jsonrpc.NewClient(conn)
+		err = c.Call("Echo.Get", "vip", &reply)
+		c.Close()
+		if err == nil {
+			t.Fatal("expected a client of another CA to be refused")
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t, dir)
+	server, err := Load(ca.issue("dashboard", "dashboard.ravel"), logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, _ := ParsePolicy([]string{"Dashboard.GetState=operator.ravel"})
+
+	listener, err := Listen("127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := &http.Server{Handler: Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fleet"))
+	}), policy, "Dashboard.GetState", logrus.New())}
+	go served.Serve(listener)
+	defer served.Close()
+	url := "https://" + listener.Addr().String() + "/api/state"
+
+	get := func(name, dnsName string) (int, error) {
+		config := ca.issue(name, dnsName)
+		config.ServerName = "dashboard.ravel"
+		files, err := Load(config, logrus.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Timeout: time.Second, Transport: &http.Transport{TLSClientConfig: files.ClientConfig()}}
+		resp, err := client.Get(url)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	if code, err := get("operator", "operator.ravel"); err != nil || code != http.StatusOK {
+		t.Fatalf("expected the request to be permitted. have %d %v", code, err)
+	}
+	if code, err := get("node", "node.ravel"); err != nil || code != http.StatusForbidden {
+		t.Fatalf("expected the request to be refused. have %d %v", code, err)
+	}
+
+	// a client without a certificate is refused in the handshake
+	plain := &http.Client{Timeout: time.Second, Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	if resp, err := plain.Get(url); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected a client without a certificate to be refused")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newAuthority(t, dir)
+	config := ca.issue("node", "node-a.ravel")
+	files, err := Load(config, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := files.current()
+
+	// the secret is rotated to a certificate of another name
+	ca.issue("node", "node-b.ravel")
+	later := time.Now().Add(time.Minute)
+	for _, path := range files.paths() {
+		os.Chtimes(path, later, later)
+	}
+	if cert, _ := files.current(); cert != first {
+		t.Fatal("expected the certificate to be kept until the next check")
+	}
+	files.checked = time.Time{}
+	cert, _ := files.current()
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.DNSNames[0] != "node-b.ravel" {
+		t.Fatalf("expected the rotated certificate. have %v", parsed.DNSNames)
+	}
+
+	// a rotation caught half written keeps the last certificate
+	ioutil.WriteFile(config.KeyFile, []byte("partial"), 0600)
+	os.Chtimes(config.KeyFile, later.Add(time.Minute), later.Add(time.Minute))
+	files.checked = time.Time{}
+	if kept, _ := files.current(); kept != cert {
+		t.Fatal("expected the last certificate to be kept")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"reflect"
 	"sort"
 	"strconv"
@@ -15,6 +16,8 @@ import (
 	"github.com/Comcast/Ravel/pkg/iptables"
 	"github.com/Comcast/Ravel/pkg/stats"
 	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
 	"github.com/Comcast/Ravel/pkg/watcher"
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
@@ -24,6 +27,18 @@ import (
 type RealServer interface {
 	Start() error
 	Stop() error
+
+	// Adopt makes the next Start keep the addresses and iptables rules a
+	// predecessor handed off, rather than cleaning them up
+	Adopt()
+
+	// Release stops the realserver like Stop, but leaves its addresses and
+	// iptables rules in place for a successor that adopts the node
+	Release() error
+
+	// ServeHTTP reports the VIP ports the node is ready to serve, and at what
+	// weight, for the health monitors of external load balancers
+	ServeHTTP(w http.ResponseWriter, req *http.Request)
 }
 
 // TODO - remove
@@ -39,15 +54,18 @@ type realserver struct {
 	haproxy haproxy.HAProxySet
 
 	watcher   *watcher.Watcher
-	ipPrimary *system.IP
-	ipDevices *system.IP
-	ipvs      *system.IPVS
-	iptables  *iptables.IPTables
+	ipPrimary system.AddressManager
+	ipDevices system.AddressManager
+	ipvs      system.IPVSExecutor
+	iptables  iptables.RuleApplier
 
 	nodeName string
 
 	doneChan chan struct{}
 
+	// adopt skips the cleanup of the next Start, see Adopt
+	adopt bool
+
 	// config *types.ClusterConfig
 	// configChan chan *types.ClusterConfig
 	// node       *v1.Node
@@ -58,7 +76,25 @@ type realserver struct {
 	reconfiguring     bool
 	lastInboundUpdate time.Time
 	lastReconfigure   time.Time
-	forcedReconfigure bool
+	// forcedReconfigureInterval is how often configuration is reapplied without
+	// a parity check. zero disables forced reconfiguration
+	forcedReconfigureInterval time.Duration
+
+	// parityInterval is how often the chains, sysctls and VIP devices are
+	// checked and repaired on their own, see checkParity. zero disables it
+	parityInterval time.Duration
+
+	// portConflicts, when set, withholds VIP ports that conflict with the node
+	portConflicts *system.PortConflictChecker
+
+	// probe configures the self-probe through the local rules
+	probe ProbeConfig
+
+	// cachedGeneration is the generation last written to the config cache
+	cachedGeneration uint64
+	// convergedAt is the EventTime of the cluster config last applied or found
+	// in parity, see converged
+	convergedAt time.Time
 
 	ctx     context.Context
 	logger  log.FieldLogger
@@ -66,7 +102,7 @@ type realserver struct {
 }
 
 // NewRealServer creates a new realserver
-func NewRealServer(ctx context.Context, nodeName string, configKey string, watcher *watcher.Watcher, ipPrimary *system.IP, ipDevices *system.IP, ipvs *system.IPVS, ipt *iptables.IPTables, forcedReconfigure bool, haproxy *haproxy.HAProxySetManager, logger log.FieldLogger) (RealServer, error) {
+func NewRealServer(ctx context.Context, nodeName string, configKey string, watcher *watcher.Watcher, ipPrimary system.AddressManager, ipDevices system.AddressManager, ipvs system.IPVSExecutor, ipt iptables.RuleApplier, forcedReconfigureInterval, parityInterval time.Duration, portConflicts *system.PortConflictChecker, probe ProbeConfig, haproxy *haproxy.HAProxySetManager, logger log.FieldLogger) (RealServer, error) {
 	return &realserver{
 		watcher:   watcher,
 		ipPrimary: ipPrimary,
@@ -81,10 +117,13 @@ func NewRealServer(ctx context.Context, nodeName string, configKey string, watch
 		// configChan: make(chan *types.ClusterConfig, 1),
 		// nodeChan:   make(chan []*v1.Node, 1),
 
-		ctx:               ctx,
-		logger:            logger,
-		metrics:           stats.NewWorkerStateMetrics(stats.KindIpvsBackend, configKey),
-		forcedReconfigure: forcedReconfigure,
+		ctx:                       ctx,
+		logger:                    logger,
+		metrics:                   stats.NewWorkerStateMetrics(stats.KindIpvsBackend, configKey),
+		forcedReconfigureInterval: forcedReconfigureInterval,
+		parityInterval:            parityInterval,
+		portConflicts:             portConflicts,
+		probe:                     probe,
 	}, nil
 }
 
@@ -97,6 +136,38 @@ func (r *realserver) Stop() error {
 	r.setReconfiguring(true)
 	defer func() { r.setReconfiguring(false) }()
 
+	r.halt()
+
+	// remove config VIP addresses from the compute interface
+	ctxDestroy, cxl := context.WithTimeout(context.Background(), 5000*time.Millisecond)
+	defer cxl()
+
+	r.logger.Info("starting cleanup")
+	err := r.cleanup(ctxDestroy)
+	r.logger.Infof("cleanup complete. error=%v", err)
+	return err
+}
+
+func (r *realserver) Release() error {
+	if r.reconfiguring {
+		return fmt.Errorf("unable to release. reconfiguration already in progress")
+	}
+	r.setReconfiguring(true)
+	defer func() { r.setReconfiguring(false) }()
+
+	r.halt()
+	r.logger.Info("released the node without cleanup")
+	return nil
+}
+
+func (r *realserver) Adopt() {
+	r.Lock()
+	defer r.Unlock()
+	r.adopt = true
+}
+
+// halt stops the periodic tasks that configure and true up iptables
+func (r *realserver) halt() {
 	// This is a little different from the BGP approach. Because the load balancer
 	// can be stopped and restarted, we use the cxlWatch context to determine whether
 	// the periodic task is complete.
@@ -108,14 +179,6 @@ func (r *realserver) Stop() error {
 	case <-r.doneChan:
 	case <-time.After(5000 * time.Millisecond):
 	}
-	// remove config VIP addresses from the compute interface
-	ctxDestroy, cxl := context.WithTimeout(context.Background(), 5000*time.Millisecond)
-	defer cxl()
-
-	r.logger.Info("starting cleanup")
-	err := r.cleanup(ctxDestroy)
-	r.logger.Infof("cleanup complete. error=%v", err)
-	return err
 }
 
 // cleanup removes all iptables deviecs and flushes rules for clean shutdown
@@ -123,8 +186,8 @@ func (r *realserver) cleanup(ctx context.Context) error {
 	errs := []string{}
 
 	// delete all k2i addresses from loopback
-	if r.watcher.ClusterConfig != nil {
-		if err := r.ipDevices.Teardown(ctx, r.watcher.ClusterConfig.Config, r.watcher.ClusterConfig.Config6); err != nil {
+	if config := r.watcher.Snapshot().ClusterConfig; config != nil {
+		if err := r.ipDevices.Teardown(ctx, config.Config, config.Config6); err != nil {
 			errs = append(errs, fmt.Sprintf("cleanup - failed to remove ip addresses - %v", err))
 		}
 	}
@@ -144,9 +207,14 @@ func (r *realserver) cleanup(ctx context.Context) error {
 func (r *realserver) setup() error {
 	var err error
 
-	// run cleanup
-	err = r.cleanup(r.ctx)
-	if err != nil {
+	// run cleanup, unless a predecessor handed its state off to this run
+	r.Lock()
+	adopt := r.adopt
+	r.adopt = false
+	r.Unlock()
+	if adopt {
+		r.logger.Info("adopting the addresses and iptables rules handed off by the previous process")
+	} else if err = r.cleanup(r.ctx); err != nil {
 		return err
 	}
 
@@ -195,7 +263,8 @@ func (r *realserver) Start() error {
 		return err
 	}
 
-	go r.periodic()
+	go r.runPeriodic()
+	go r.probes(r.ctxWatch)
 	// go r.watches()
 
 	return nil
@@ -253,6 +322,29 @@ func (r *realserver) Start() error {
 
 // }
 
+// runPeriodic runs periodic until the watch context is done. A reconcile that
+// panics is recovered, leaving the kernel state as it found it, and periodic
+// is started again after a second. The node reports unhealthy until a later
+// reconcile succeeds.
+func (r *realserver) runPeriodic() {
+	for {
+		err := util.Recover("realserver: periodic", r.periodic)
+		p, ok := err.(*util.PanicError)
+		if !ok {
+			return
+		}
+		r.logger.Errorf("realserver: %v", p)
+		r.metrics.ReconcilePanic()
+		util.MarkUnhealthy(stats.KindIpvsBackend, fmt.Sprintf("reconcile panicked: %v", p.Value))
+
+		select {
+		case <-time.After(time.Second):
+		case <-r.ctxWatch.Done():
+			return
+		}
+	}
+}
+
 // This function is the meat of the realserver struct. ALL CHANGES MADE HERE MUST BE MIRRORED IN pkg/bgp/worker.go
 func (r *realserver) periodic() error {
 
@@ -263,60 +355,82 @@ func (r *realserver) periodic() error {
 	checkTicker := time.NewTicker(3 * time.Second)
 	defer checkTicker.Stop()
 
-	forcedReconfigureInterval := time.Minute * 10
-	forceReconfigure := time.NewTicker(forcedReconfigureInterval)
+	// staggered by node name so that realservers started together don't all
+	// rewrite their rules at the same moment
+	forceReconfigure := util.NewStaggeredTicker(r.forcedReconfigureInterval, r.nodeName)
 	defer forceReconfigure.Stop()
 
+	// a nil channel never delivers when the parity check is disabled
+	var parityC <-chan time.Time
+	if r.parityInterval > 0 {
+		parityTicker := time.NewTicker(r.parityInterval)
+		defer parityTicker.Stop()
+		parityC = parityTicker.C
+	}
+
 	for {
 		select {
 		// if a force reconfigure happens, we do this
 		case <-forceReconfigure.C:
-			if r.forcedReconfigure {
-				/*
-					note on error fall through: configure and configure6 are similar,
-					but different configuration efforts. I don't see why we would
-					ever _not_ want to attempt a config6() call if config() fails,
-					with the reasoning that a potentially partial working state is
-					better than giving up
-
-					However, if we fail to configure6(), new haproxy calls will fail
-					with error to start haproxy. For that reason, we continue
-					in that error block
-				*/
-				start := time.Now()
-				r.logger.Info("realserver: forced reconfigure, not performing parity check")
-				if err, _ := r.configure(); err != nil {
-					r.logger.Errorf("realserver: unable to apply ipv4 configuration, %v", err)
-					r.metrics.Reconfigure("error", time.Since(start))
-				}
+			/*
+				note on error fall through: configure and configure6 are similar,
+				but different configuration efforts. I don't see why we would
+				ever _not_ want to attempt a config6() call if config() fails,
+				with the reasoning that a potentially partial working state is
+				better than giving up
+
+				However, if we fail to configure6(), new haproxy calls will fail
+				with error to start haproxy. For that reason, we continue
+				in that error block
+			*/
+			start := time.Now()
+			snapshot := r.watcher.Snapshot()
+			config := snapshot.ClusterConfig
+			r.logger.Info("realserver: forced reconfigure, not performing parity check")
+			r.setMaintenance(snapshot)
+			if err, _ := r.configure(snapshot, r.desiredConfig(snapshot)); err != nil {
+				r.logger.Errorf("realserver: unable to apply ipv4 configuration, %v", err)
+				r.metrics.Reconfigure("error", time.Since(start))
+			}
 
-				if err, _ := r.configure6(); err != nil {
-					r.logger.Errorf("realserver: unable to apply ipv6 configuration, %v", err)
-					r.metrics.Reconfigure("error", time.Since(start))
-					continue // new haproxies will fail if this block fails. see note above on continue statements
-				}
+			if err, _ := r.configure6(snapshot); err != nil {
+				r.logger.Errorf("realserver: unable to apply ipv6 configuration, %v", err)
+				r.metrics.Reconfigure("error", time.Since(start))
+				continue // new haproxies will fail if this block fails. see note above on continue statements
+			}
 
-				// configure haproxy for v6-v4 NAT gateway
-				err := r.ConfigureHAProxy()
-				if err != nil {
-					r.logger.Errorf("realserver: error applying haproxy config in realserver. %v", err)
-					r.metrics.Reconfigure("error", time.Since(start))
-					continue
-				}
+			// configure haproxy for v6-v4 NAT gateway
+			err := r.ConfigureHAProxy(snapshot)
+			if err != nil {
+				r.logger.Errorf("realserver: error applying haproxy config in realserver. %v", err)
+				r.metrics.Reconfigure("error", time.Since(start))
+				continue
+			}
 
-				now := time.Now()
-				r.logger.Infof("realserver: reconfiguration completed successfully in %v", now.Sub(start))
-				r.lastReconfigure = start
+			now := time.Now()
+			r.logger.Infof("realserver: reconfiguration completed successfully in %v", now.Sub(start))
+			r.lastReconfigure = start
 
-				r.metrics.Reconfigure("complete", time.Since(start))
-			}
+			util.MarkHealthy(stats.KindIpvsBackend)
+			r.metrics.Reconfigure("complete", time.Since(start))
+			r.converged(config, true)
+			r.saveCache(snapshot, true)
 
 		// check config parity every time this ticks and configure haproxy for NAT gateway support
 		case <-adapterTicker.C:
 
 			start := time.Now()
+			snapshot := r.watcher.Snapshot()
+			config := snapshot.ClusterConfig
 			r.logger.Infof("realserver: reconfig triggered due to periodic parity check")
-			same, err := r.checkConfigParity()
+
+			// the maintenance and acl rules live in the filter and mangle tables,
+			// which the parity check doesn't cover, so they are reconciled on every pass
+			r.setMaintenance(snapshot)
+
+			// the port conflicts are checked once for the parity check and the apply
+			desired := r.desiredConfig(snapshot)
+			same, err := r.checkConfigParity(snapshot, desired)
 			if err != nil {
 				// what is a better way to handle this scenario?
 				r.logger.Errorf("realserver: parity check failed. %v", err)
@@ -325,23 +439,26 @@ func (r *realserver) periodic() error {
 			if same {
 				// noop
 				r.logger.Debugf("realserver: configuration has parity")
+				util.MarkHealthy(stats.KindIpvsBackend)
+				r.converged(config, false)
+				r.saveCache(snapshot, false)
 				continue
 			}
 			r.logger.Debugf("realserver: configuration needs updated")
 
-			if err, _ := r.configure(); err != nil {
+			if err, _ := r.configure(snapshot, desired); err != nil {
 				r.metrics.Reconfigure("error", time.Since(start))
 				r.logger.Errorf("realserver: unable to apply ipv4 configuration, %v", err)
 			}
 
-			if err, _ := r.configure6(); err != nil {
+			if err, _ := r.configure6(snapshot); err != nil {
 				r.metrics.Reconfigure("error", time.Since(start))
 				r.logger.Errorf("realserver: unable to apply ipv6 configuration, %v", err)
 				continue // new haproxies will fail if this block fails. see note above on continue statements
 			}
 
 			// configure haproxy for v6-v4 NAT gateway
-			err = r.ConfigureHAProxy()
+			err = r.ConfigureHAProxy(snapshot)
 			if err != nil {
 				r.logger.Errorf("realserver: error applying haproxy config in realserver. %v", err)
 				r.metrics.Reconfigure("error", time.Since(start))
@@ -352,7 +469,10 @@ func (r *realserver) periodic() error {
 			r.logger.Infof("realserver: reconfiguration completed successfully in %v", now.Sub(start))
 			r.lastReconfigure = start
 
+			util.MarkHealthy(stats.KindIpvsBackend)
 			r.metrics.Reconfigure("complete", time.Since(start))
+			r.converged(config, true)
+			r.saveCache(snapshot, true)
 
 		// every time this ticks, we reconfigure all iptables rules and check config parity
 		case <-checkTicker.C:
@@ -373,7 +493,9 @@ func (r *realserver) periodic() error {
 
 			// r.metrics.QueueDepth(len(r.configChan))
 
-			if r.watcher.ClusterConfig == nil {
+			snapshot := r.watcher.Snapshot()
+			config := snapshot.ClusterConfig
+			if config == nil {
 				log.Warningln("realserver: can not check parity because config is nil")
 				r.metrics.Reconfigure("noop", time.Since(start))
 				continue
@@ -385,7 +507,8 @@ func (r *realserver) periodic() error {
 			}
 
 			log.Debugln("realserver: checking configuration parity")
-			same, err := r.checkConfigParity()
+			desired := r.desiredConfig(snapshot)
+			same, err := r.checkConfigParity(snapshot, desired)
 			if err != nil {
 				// what is a better way to handle this scenario?
 				r.logger.Errorf("realserver: parity check failed. %v", err)
@@ -393,23 +516,26 @@ func (r *realserver) periodic() error {
 			} else if same {
 				// noop
 				r.logger.Debugf("realserver: configuration has parity")
+				util.MarkHealthy(stats.KindIpvsBackend)
+				r.converged(config, false)
+				r.saveCache(snapshot, false)
 				continue
 			}
 
-			err, _ = r.configure()
+			err, _ = r.configure(snapshot, desired)
 			if err != nil {
 				r.logger.Errorf("realserver: error applying configuration in realserver. %v", err)
 				r.metrics.Reconfigure("error", time.Since(start))
 			}
 
-			if err, _ = r.configure6(); err != nil {
+			if err, _ = r.configure6(snapshot); err != nil {
 				r.metrics.Reconfigure("error", time.Since(start))
 				r.logger.Errorf("realserver: unable to apply ipv6 configuration, %v", err)
 				continue // new haproxies will fail if this block fails. see note above on continue statements
 			}
 
 			// configure haproxy for v6-v4 NAT gateway
-			err = r.ConfigureHAProxy()
+			err = r.ConfigureHAProxy(snapshot)
 			if err != nil {
 				r.logger.Errorf("realserver: error applying haproxy config in realserver. %v", err)
 				r.metrics.Reconfigure("error", time.Since(start))
@@ -420,7 +546,16 @@ func (r *realserver) periodic() error {
 			r.logger.Infof("realserver: reconfiguration completed successfully in %v", now.Sub(start))
 			r.lastReconfigure = start
 
+			util.MarkHealthy(stats.KindIpvsBackend)
 			r.metrics.Reconfigure("complete", time.Since(start))
+			r.converged(config, true)
+			r.saveCache(snapshot, true)
+
+		// repair the parts of the kernel state that drifted from the config
+		case <-parityC:
+			if repaired := r.checkParity(); len(repaired) > 0 {
+				r.logger.Infof("realserver: parity: repaired %s", strings.Join(repaired, ", "))
+			}
 
 		case <-r.ctx.Done():
 			return nil
@@ -438,7 +573,7 @@ func (r *realserver) periodic() error {
 // haproxy instance for each backend that maps the VIP:PORT to a list of backend
 // these are the pod ips, not the service IPs, to ensure traffic stays on-node
 // creates 1 config - per - ipv6addr + port pair
-func (r *realserver) ConfigureHAProxy() error {
+func (r *realserver) ConfigureHAProxy(snapshot *watcher.Watcher) error {
 
 	// measure the time it took to do this operation
 	configureStartTime := time.Now()
@@ -448,14 +583,18 @@ func (r *realserver) ConfigureHAProxy() error {
 	}()
 
 	configSet := []haproxy.VIPConfig{}
-	for ip, config := range r.watcher.ClusterConfig.Config6 {
+	for ip, config := range snapshot.ClusterConfig.Config6 {
 		// make a single haproxy server for each v6 VIP with all backends
 		for port, service := range config {
+			// translated ports reach the realservers as v4 traffic of the paired VIP
+			if service.Translated() {
+				continue
+			}
 
-			mtu := r.watcher.ClusterConfig.MTUConfig6[ip]
+			mtu := snapshot.ClusterConfig.MTUConfig6[ip]
 
 			// fetch the service config and pluck the clusterIP
-			if !r.watcher.ServiceHasValidEndpoints(service.Namespace, service.Service) {
+			if !snapshot.ServiceHasValidEndpoints(service.Namespace, service.Service) {
 				// r.logger.Warnf("realserver: no service found for configuration [%s]:(%s/%s), skipping haproxy config", string(ip), service.Namespace, service.Service)
 				continue
 			}
@@ -465,8 +604,8 @@ func (r *realserver) ConfigureHAProxy() error {
 				log.Warningln("realserver: can not get pod IPs for node because node is blank")
 				continue
 			}
-			ips := r.watcher.GetPodIPsOnNode(r.nodeName, service.Service, service.Namespace, service.PortName)
-			services := r.watcher.Services()
+			ips := snapshot.GetPodIPsOnNode(r.nodeName, service.Service, service.Namespace, service.PortName)
+			services := snapshot.Services()
 			serviceName := fmt.Sprintf("%s/%s", service.Namespace, service.Service)
 			serviceForConfig, ok := services[serviceName]
 			if !ok {
@@ -542,20 +681,20 @@ func (r *realserver) ConfigureHAProxy() error {
 	return nil
 }
 
-// configure applies the desired realserver configuration to iptables
-func (r *realserver) configure() (error, int) {
-	if r.watcher.ClusterConfig == nil {
+// configure applies the desired realserver configuration of snapshot to iptables
+func (r *realserver) configure(snapshot *watcher.Watcher, desired *types.ClusterConfig) (error, int) {
+	if snapshot.ClusterConfig == nil {
 		return fmt.Errorf("realserver: could not configure. cluster config is nil"), 0
 	}
 
 	// log the services that exist for this node at the start of rule generation
 	services := []string{}
-	for _, portMap := range r.watcher.ClusterConfig.Config {
+	for _, portMap := range snapshot.ClusterConfig.Config {
 		for _, sc := range portMap {
 			services = append(services, sc.Namespace+"/"+sc.Service+":"+sc.PortName)
 		}
 	}
-	log.Debugln("realserver: configure: running for", len(r.watcher.ClusterConfig.Config), "service IPs hosting", len(services), "services total:", strings.Join(services, ","))
+	log.Debugln("realserver: configure: running for", len(snapshot.ClusterConfig.Config), "service IPs hosting", len(services), "services total:", strings.Join(services, ","))
 
 	// log the duration of time it took to do the reconfiguration
 	configureStartTime := time.Now()
@@ -564,39 +703,57 @@ func (r *realserver) configure() (error, int) {
 		r.logger.Infoln("realserver: IPVS reconfiguration took", configureDuration)
 	}()
 
-	removals := 0
 	r.logger.Debugf("realserver: setting addresses")
 	// add vip addresses to loopback
-	if err := r.setAddresses(); err != nil {
-		return err, removals
+	start := time.Now()
+	err := r.setAddresses(snapshot)
+	r.metrics.Stage(stats.StageAddresses, time.Since(start))
+	if err != nil {
+		return err, 0
 	}
+	return r.applyRules(snapshot, desired)
+}
 
+// applyRules generates the iptables rules of desired, the config returned by
+// desiredConfig, and applies them to the nat table, merged with the rules of
+// other programs
+func (r *realserver) applyRules(snapshot *watcher.Watcher, desired *types.ClusterConfig) (error, int) {
+	removals := 0
 	r.logger.Debugf("realserver: capturing existing iptables rules")
 	// generate and apply iptables rules
+	start := time.Now()
 	existing, err := r.iptables.Save()
+	r.metrics.Stage(stats.StageIPTablesSave, time.Since(start))
 	if err != nil {
 		return err, removals
 	}
 	r.logger.Debugf("realserver: got %d existing rules", len(existing))
 
 	// generate desired iptables configurations
-	generated, err := r.iptables.GenerateRulesForNodeClassic(r.watcher, r.nodeName, r.watcher.ClusterConfig, false)
+	start = time.Now()
+	generated, err := r.iptables.GenerateRulesForNodeClassic(snapshot, r.nodeName, desired, false)
+	r.metrics.Stage(stats.StageIPTablesGenerate, time.Since(start))
 	if err != nil {
 		return err, removals
 	}
 	r.logger.Debugf("realserver: got %d generated rules", len(generated))
 
 	r.logger.Debugf("realserver: merging iptables rules")
+	start = time.Now()
 	merged, removals, err := r.iptables.Merge(generated, existing) // subset, all rules
+	r.metrics.Stage(stats.StageIPTablesMerge, time.Since(start))
 	if err != nil {
 		return err, removals
 	}
 	r.logger.Debugf("realserver: got %d merged rules", len(merged))
 
 	// r.logger.Debugf("applying updated rules")
+	start = time.Now()
 	err = r.iptables.Restore(merged)
+	r.metrics.Stage(stats.StageIPTablesRestore, time.Since(start))
 	if err != nil {
-		// set our failure gauge for iptables alertmanagers
+		// set our failure gauge for iptables alertmanagers. the change that
+		// failed is also in the rule diff log, when it is enabled
 		r.metrics.IptablesWriteFailure(1)
 		// write erroneous rule set to file to capture later
 		r.logger.Errorf("realserver: error applying rules. writing erroneous rule change to /tmp/realserver-ruleset-err for debugging")
@@ -614,29 +771,102 @@ func (r *realserver) configure() (error, int) {
 	return nil, removals
 }
 
+// desiredConfig returns the cluster config to forward. When the port conflict
+// check is enabled, the conflicts with host listeners or kube-proxy nodePorts
+// are reported, and the VIP ports are left out when they are withheld. It reads
+// the host listeners, so a pass calls it once and hands the result on.
+func (r *realserver) desiredConfig(snapshot *watcher.Watcher) *types.ClusterConfig {
+	if r.portConflicts == nil || snapshot.ClusterConfig == nil {
+		return snapshot.ClusterConfig
+	}
+	config, conflicts, err := r.portConflicts.Check(snapshot.ClusterConfig)
+	if err != nil {
+		r.logger.Errorf("realserver: unable to check host listeners for port conflicts. %v", err)
+	}
+
+	byReason := map[string]int{system.ConflictListener: 0, system.ConflictNodePort: 0}
+	for _, c := range conflicts {
+		byReason[c.Reason]++
+	}
+	for reason, n := range byReason {
+		r.metrics.PortConflicts(reason, n)
+	}
+	return config
+}
+
+// setMaintenance writes the rules that stop traffic to VIPs in maintenance. The nat
+// rules of those VIPs are left out by rule generation, so their traffic reaches
+// the maintenance chain instead of the pods.
+func (r *realserver) setMaintenance(snapshot *watcher.Watcher) {
+	if snapshot.ClusterConfig == nil {
+		return
+	}
+	if err := r.iptables.SetMaintenance(snapshot.ClusterConfig); err != nil {
+		r.logger.Errorf("realserver: unable to configure maintenance rules. %v", err)
+	}
+	// the acl rules are reconciled alongside them, for the same reason
+	if err := r.iptables.SetACL(snapshot.ClusterConfig); err != nil {
+		r.logger.Errorf("realserver: unable to configure acl rules. %v", err)
+	}
+}
+
 // configure6 configures the HAProxy deployment for ipv4 to ipv6 translation.
 // We omit iptables rules here, set v6 addresses on loopback
-func (r *realserver) configure6() (error, int) {
+func (r *realserver) configure6(snapshot *watcher.Watcher) (error, int) {
 
 	removals := 0
 	// add vip addresses to loopback
-	if err := r.setAddresses6(); err != nil {
+	start := time.Now()
+	err := r.setAddresses6(snapshot)
+	r.metrics.Stage(stats.StageAddresses, time.Since(start))
+	if err != nil {
 		return err, removals
 	}
 	return nil, removals
 }
 
+// saveCache writes the state behind a successful reconcile to the config cache.
+// Reconciles that found parity only write it when the generation has changed.
+func (r *realserver) saveCache(snapshot *watcher.Watcher, applied bool) {
+	generation := snapshot.ClusterConfig.Generation
+	if !applied && r.cachedGeneration == generation {
+		return
+	}
+	r.cachedGeneration = generation
+
+	if err := r.watcher.WriteCache(snapshot); err != nil {
+		r.logger.Errorf("realserver: %v", err)
+	}
+}
+
+// converged records the time the changes to endpoints in config took to land in
+// the kernel, once per change, when the reconcile that applied it changed the kernel
+func (r *realserver) converged(config *types.ClusterConfig, changed bool) {
+	if config == nil || !config.EventTime.After(r.convergedAt) {
+		return
+	}
+	r.convergedAt = config.EventTime
+	if changed {
+		r.metrics.Converged(time.Since(config.EventTime))
+	}
+}
+
 // checkConfigParity checks all the dummy interfaces and ensures that they are
 // properly configured and applied to iptables chains
-func (r *realserver) checkConfigParity() (bool, error) {
+func (r *realserver) checkConfigParity(snapshot *watcher.Watcher, desired *types.ClusterConfig) (bool, error) {
 
 	// =======================================================
 	// == Perform check whether we're ready to start working
 	// =======================================================
-	if r.watcher.ClusterConfig == nil {
+	if snapshot.ClusterConfig == nil {
 		return true, nil
 	}
 
+	start := time.Now()
+	defer func() {
+		r.metrics.Stage(stats.StageParity, time.Since(start))
+	}()
+
 	// =======================================================
 	// == Perform check on ethernet device configuration
 	// =======================================================
@@ -649,14 +879,14 @@ func (r *realserver) checkConfigParity() (bool, error) {
 
 	// get desired set of VIP addresses
 	vipsV4 := []string{}
-	for ip := range r.watcher.ClusterConfig.Config {
+	for ip := range snapshot.ClusterConfig.Config {
 		vipsV4 = append(vipsV4, string(ip))
 	}
 	sort.Strings(vipsV4)
 
 	// and, v6 addresses
 	vipsV6 := []string{}
-	for ip := range r.watcher.ClusterConfig.Config6 {
+	for ip := range snapshot.ClusterConfig.Config6 {
 		vipsV6 = append(vipsV6, string(ip))
 	}
 	sort.Strings(vipsV6)
@@ -679,7 +909,7 @@ func (r *realserver) checkConfigParity() (bool, error) {
 	// generated, err := r.iptables.GenerateRulesForNode(r.node, r.config, false)
 
 	// generate desired iptables configurations
-	generated, err := r.iptables.GenerateRules(r.watcher.ClusterConfig)
+	generated, err := r.iptables.GenerateRules(desired)
 	if err != nil {
 		return false, err
 	}
@@ -704,7 +934,7 @@ func (r *realserver) checkConfigParity() (bool, error) {
 }
 
 // setAddresses sets all the VIP addresses into iptables along with the proper MTUs
-func (r *realserver) setAddresses() error {
+func (r *realserver) setAddresses(snapshot *watcher.Watcher) error {
 
 	log.Infoln("fetching dummy interfaces via realserver setAddresses")
 
@@ -717,7 +947,7 @@ func (r *realserver) setAddresses() error {
 	// get desired set VIP addresses
 	desired := []string{}
 	devToAddr := map[string]string{}
-	for ip := range r.watcher.ClusterConfig.Config {
+	for ip := range snapshot.ClusterConfig.Config {
 		devName := r.ipDevices.Device(string(ip), false)
 		desired = append(desired, devName)
 		devToAddr[devName] = string(ip)
@@ -744,17 +974,18 @@ func (r *realserver) setAddresses() error {
 	// now iterate across configured and see if we have a non-standard MTU
 	// setting it where applicable
 	// pull existing
-	err = r.ipDevices.SetMTU(r.watcher.ClusterConfig.MTUConfig, false)
+	err = r.ipDevices.SetMTU(snapshot.ClusterConfig.MTUConfig, false)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// and send the replies of the VIPs out of the interfaces they are routed through
+	return r.ipDevices.SetReturnRoutes(snapshot.ClusterConfig.ReturnRoutes(false), false)
 }
 
 // setAddresses6 adds ipv6 virtual network devices to iptables and removes any
 // that should not exist
-func (r *realserver) setAddresses6() error {
+func (r *realserver) setAddresses6(snapshot *watcher.Watcher) error {
 	// log.Infoln("fetching dummy interfaces via realserver setAddresses6")
 
 	// pull existing
@@ -766,7 +997,7 @@ func (r *realserver) setAddresses6() error {
 	// get desired set VIP addresses
 	desired := []string{}
 	devToAddr := map[string]string{}
-	for ip := range r.watcher.ClusterConfig.Config6 {
+	for ip := range snapshot.ClusterConfig.Config6 {
 		devName := r.ipDevices.Device(string(ip), true)
 		desired = append(desired, devName)
 		devToAddr[devName] = string(ip)
@@ -794,12 +1025,13 @@ func (r *realserver) setAddresses6() error {
 	// now iterate across configured and see if we have a non-standard MTU
 	// setting it where applicable
 	// pull existing
-	err = r.ipDevices.SetMTU(r.watcher.ClusterConfig.MTUConfig6, true)
+	err = r.ipDevices.SetMTU(snapshot.ClusterConfig.MTUConfig6, true)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// and send the replies of the VIPs out of the interfaces they are routed through
+	return r.ipDevices.SetReturnRoutes(snapshot.ClusterConfig.ReturnRoutes(true), true)
 }
 
 func createErrorLog(err error, rules []byte) []byte {
@@ -0,0 +1,220 @@
+package realserver
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// the parts of the kernel state the parity check covers, each repaired on
+// its own
+const (
+	ParityChains  = "chains"
+	ParitySysctls = "sysctls"
+	ParityVIPs    = "vips"
+)
+
+// checkParity checks the iptables chains, the arp and rp_filter settings and
+// the VIP devices of the node against the config, and repairs only the parts
+// that drifted, rather than reapplying everything as a reconfigure does. It
+// returns the parts that were repaired.
+func (r *realserver) checkParity() []string {
+	snapshot := r.watcher.Snapshot()
+	if snapshot.ClusterConfig == nil {
+		return nil
+	}
+	desired := r.desiredConfig(snapshot)
+	repaired := []string{}
+	for _, c := range []struct {
+		what   string
+		drift  func() ([]string, error)
+		repair func() error
+	}{
+		{ParityVIPs, func() ([]string, error) { return r.vipDrift(snapshot) }, func() error { return r.repairVIPs(snapshot) }},
+		{ParitySysctls, r.sysctlDrift, r.repairSysctls},
+		{ParityChains, func() ([]string, error) { return r.chainDrift(snapshot, desired) }, func() error { return r.repairChains(snapshot, desired) }},
+	} {
+		drift, err := c.drift()
+		if err != nil {
+			r.logger.Errorf("realserver: parity: unable to check %s. %v", c.what, err)
+			continue
+		}
+		if len(drift) == 0 {
+			continue
+		}
+		r.logger.Warnf("realserver: parity: %s drifted from the config. repairing %s", c.what, strings.Join(drift, ", "))
+		err = c.repair()
+		r.metrics.ParityRepair(c.what, err)
+		if err != nil {
+			r.logger.Errorf("realserver: parity: unable to repair %s. %v", c.what, err)
+			continue
+		}
+		repaired = append(repaired, c.what)
+	}
+	return repaired
+}
+
+// vipDrift returns the VIP devices to add and remove, as +device and -device
+func (r *realserver) vipDrift(snapshot *watcher.Watcher) ([]string, error) {
+	configured4, configured6, err := r.ipDevices.Get()
+	if err != nil {
+		return nil, err
+	}
+	drift := []string{}
+	for _, family := range []struct {
+		configured []string
+		vips       []string
+		compare    func(configured, desired []string) ([]string, []string)
+		isV6       bool
+	}{
+		{configured4, vips(snapshot.ClusterConfig, false), r.ipDevices.Compare4, false},
+		{configured6, vips(snapshot.ClusterConfig, true), r.ipDevices.Compare6, true},
+	} {
+		desired := []string{}
+		for _, vip := range family.vips {
+			desired = append(desired, r.ipDevices.Device(vip, family.isV6))
+		}
+		removals, additions := family.compare(family.configured, desired)
+		for _, device := range removals {
+			drift = append(drift, "-"+device)
+		}
+		for _, device := range additions {
+			drift = append(drift, "+"+device)
+		}
+	}
+	return drift, nil
+}
+
+// vips returns the VIPs of one family in config
+func vips(config *types.ClusterConfig, isV6 bool) []string {
+	family := config.Config
+	if isV6 {
+		family = config.Config6
+	}
+	vips := []string{}
+	for ip := range family {
+		vips = append(vips, string(ip))
+	}
+	sort.Strings(vips)
+	return vips
+}
+
+func (r *realserver) repairVIPs(snapshot *watcher.Watcher) error {
+	if err := r.setAddresses(snapshot); err != nil {
+		return err
+	}
+	return r.setAddresses6(snapshot)
+}
+
+// sysctlDrift returns the arp settings of the VIP and primary devices, and the
+// rp_filter settings, that no longer hold what setup wrote. Address managers
+// that can't report them are skipped.
+func (r *realserver) sysctlDrift() ([]string, error) {
+	drift := []string{}
+	if devices, ok := r.ipDevices.(system.SysctlDrifter); ok {
+		arp, err := devices.ARPDrift()
+		if err != nil {
+			return nil, err
+		}
+		rp, err := devices.RPFilterDrift()
+		if err != nil {
+			return nil, err
+		}
+		drift = append(append(drift, arp...), rp...)
+	}
+	if primary, ok := r.ipPrimary.(system.SysctlDrifter); ok {
+		arp, err := primary.ARPDrift()
+		if err != nil {
+			return nil, err
+		}
+		drift = append(drift, arp...)
+	}
+	return drift, nil
+}
+
+func (r *realserver) repairSysctls() error {
+	if err := r.ipDevices.SetARP(); err != nil {
+		return err
+	}
+	if err := r.ipDevices.SetRPFilter(); err != nil {
+		return err
+	}
+	return r.ipPrimary.SetARP()
+}
+
+// chainDrift returns the nat chains the rules generated for the config put
+// in place that are missing or hold other rules
+func (r *realserver) chainDrift(snapshot *watcher.Watcher, desired *types.ClusterConfig) ([]string, error) {
+	existing, err := r.iptables.Save()
+	if err != nil {
+		return nil, err
+	}
+	generated, err := r.iptables.GenerateRulesForNodeClassic(snapshot, r.nodeName, desired, false)
+	if err != nil {
+		return nil, err
+	}
+	return chainDrift(generated, existing), nil
+}
+
+func (r *realserver) repairChains(snapshot *watcher.Watcher, desired *types.ClusterConfig) error {
+	err, _ := r.applyRules(snapshot, desired)
+	return err
+}
+
+// chainDrift returns the chains of generated that existing lacks or that hold
+// other rules, sorted. The builtin chains also hold the rules of other
+// programs, so only the rules generated into them are looked for.
+func chainDrift(generated, existing map[string]*iptables.RuleSet) []string {
+	drift := []string{}
+	for chain, want := range generated {
+		have, found := existing[chain]
+		switch {
+		case !found:
+			drift = append(drift, chain)
+		case isBuiltinChain(chain):
+			rules := map[string]bool{}
+			for _, rule := range have.Rules {
+				rules[rule] = true
+			}
+			for _, rule := range want.Rules {
+				if !rules[rule] {
+					drift = append(drift, chain)
+					break
+				}
+			}
+		default:
+			if !sameRules(want.Rules, have.Rules) {
+				drift = append(drift, chain)
+			}
+		}
+	}
+	sort.Strings(drift)
+	return drift
+}
+
+// isBuiltinChain returns true for the chains of the nat table that iptables
+// creates, which ravel only jumps from
+func isBuiltinChain(chain string) bool {
+	switch chain {
+	case "PREROUTING", "INPUT", "OUTPUT", "POSTROUTING":
+		return true
+	}
+	return false
+}
+
+// sameRules returns true when a and b hold the same rules, in any order
+func sameRules(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
+}
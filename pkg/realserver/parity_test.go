@@ -0,0 +1,83 @@
+package realserver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+func TestChainDrift(t *testing.T) {
+	generated := map[string]*iptables.RuleSet{
+		"PREROUTING":  {Rules: []string{"-A PREROUTING -j RAVEL"}},
+		"RAVEL":       {Rules: []string{"-A RAVEL -d 10.54.213.147/32 -j RAVEL-SVC-A", "-A RAVEL -d 10.54.213.148/32 -j RAVEL-SVC-B"}},
+		"RAVEL-MASQ":  {Rules: []string{"-A RAVEL-MASQ -j MASQUERADE"}},
+		"RAVEL-SVC-A": {Rules: []string{"-A RAVEL-SVC-A -j DNAT --to-destination 100.64.0.1:8080"}},
+	}
+	existing := map[string]*iptables.RuleSet{
+		// other programs' rules in a builtin chain are left alone
+		"PREROUTING": {Rules: []string{"-A PREROUTING -j KUBE-SERVICES", "-A PREROUTING -j RAVEL"}},
+		// the order of the rules doesn't matter
+		"RAVEL":       {Rules: []string{"-A RAVEL -d 10.54.213.148/32 -j RAVEL-SVC-B", "-A RAVEL -d 10.54.213.147/32 -j RAVEL-SVC-A"}},
+		"RAVEL-SVC-A": {Rules: []string{}},
+	}
+	if drift := chainDrift(generated, existing); !reflect.DeepEqual(drift, []string{"RAVEL-MASQ", "RAVEL-SVC-A"}) {
+		t.Fatalf("expected the missing and emptied chains to drift. have %v", drift)
+	}
+
+	existing["PREROUTING"].Rules = []string{"-A PREROUTING -j KUBE-SERVICES"}
+	existing["RAVEL-MASQ"] = generated["RAVEL-MASQ"]
+	existing["RAVEL-SVC-A"] = generated["RAVEL-SVC-A"]
+	if drift := chainDrift(generated, existing); !reflect.DeepEqual(drift, []string{"PREROUTING"}) {
+		t.Fatalf("expected the missing jump to drift. have %v", drift)
+	}
+}
+
+func TestCheckParity(t *testing.T) {
+	web := &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "http", TCPEnabled: true}
+	devices := system.NewFakeIP()
+	ipt := iptables.NewFakeRuleApplier("RAVEL", false, logrus.New())
+	r := &realserver{
+		nodeName: "node-a",
+		watcher: &watcher.Watcher{
+			ClusterConfig: &types.ClusterConfig{
+				Config:  map[types.ServiceIP]types.PortMap{"10.54.213.147": {"80": web}},
+				Config6: map[types.ServiceIP]types.PortMap{"2001:db8::7": {"80": web}},
+			},
+		},
+		ipDevices: devices,
+		ipPrimary: system.NewFakeIP(),
+		iptables:  ipt,
+		logger:    logrus.New(),
+		metrics:   stats.NewWorkerStateMetrics(stats.KindIpvsBackend, "test"),
+	}
+
+	if repaired := r.checkParity(); !reflect.DeepEqual(repaired, []string{ParityVIPs, ParityChains}) {
+		t.Fatalf("expected the VIPs and chains of an empty node to be repaired. have %v", repaired)
+	}
+	if len(devices.Devices) != 2 || ipt.Table["RAVEL"] == nil {
+		t.Fatalf("expected the VIP devices and the ravel chain to be in place. have %v and %v", devices.Devices, ipt.Table)
+	}
+	if repaired := r.checkParity(); len(repaired) != 0 {
+		t.Fatalf("expected nothing to drift after the repair. have %v", repaired)
+	}
+
+	// only the part that drifted is repaired
+	restores := ipt.Restores
+	for device := range devices.Devices {
+		delete(devices.Devices, device)
+		break
+	}
+	if repaired := r.checkParity(); !reflect.DeepEqual(repaired, []string{ParityVIPs}) || ipt.Restores != restores {
+		t.Fatalf("expected only the VIPs to be repaired. have %v after %d restores", repaired, ipt.Restores-restores)
+	}
+	if len(devices.Devices) != 2 {
+		t.Fatalf("expected the removed VIP device to be put back. have %v", devices.Devices)
+	}
+}
@@ -0,0 +1,141 @@
+package realserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// ProbeConfig enables the self-probe. Every Interval the realserver connects to
+// each tcp VIP port that it forwards to local pods, marking the probe packets
+// with Mark so that they take the same nat rules as inbound VIP traffic. A
+// probe that can't connect within Timeout means the rules on this node are
+// broken even if they match the config. A zero Interval disables probing.
+type ProbeConfig struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Mark     int
+}
+
+// probeTarget is a VIP port forwarded to pods on this node
+type probeTarget struct {
+	vip     string
+	port    string
+	service string
+}
+
+func (t probeTarget) address() string {
+	return net.JoinHostPort(t.vip, t.port)
+}
+
+// probes probes the VIP ports forwarded by this node until ctx is done
+func (r *realserver) probes(ctx context.Context) {
+	if r.probe.Interval <= 0 {
+		return
+	}
+	r.logger.Infof("realserver: probing forwarded VIP ports every %v with mark %#x", r.probe.Interval, r.probe.Mark)
+
+	ticker := time.NewTicker(r.probe.Interval)
+	defer ticker.Stop()
+
+	probed := map[probeTarget]bool{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			probed = r.probeOnce(ctx, probed)
+		}
+	}
+}
+
+// probeOnce probes every target and records the results, dropping the results of
+// targets in previous that are no longer forwarded. It returns the targets probed.
+func (r *realserver) probeOnce(ctx context.Context, previous map[probeTarget]bool) map[probeTarget]bool {
+	snapshot := r.watcher.Snapshot()
+	if snapshot.ClusterConfig == nil {
+		return previous
+	}
+
+	current := map[probeTarget]bool{}
+	for _, target := range r.probeTargets(snapshot, r.desiredConfig(snapshot)) {
+		err := r.dialProbe(ctx, target.address())
+		if err != nil {
+			r.logger.Warnf("realserver: probe of %s for %s through the local rules failed. %v", target.address(), target.service, err)
+		}
+		r.metrics.ProbeReachable(target.vip, target.port, target.service, err == nil)
+		current[target] = true
+	}
+
+	for target := range previous {
+		if !current[target] {
+			r.metrics.ProbeRemoved(target.vip, target.port, target.service)
+		}
+	}
+	return current
+}
+
+// probeTargets returns the tcp VIP ports in config that have pods on this node
+// in snapshot, which are the ports the node has rules for
+func (r *realserver) probeTargets(snapshot *watcher.Watcher, config *types.ClusterConfig) []probeTarget {
+	targets := []probeTarget{}
+	if config == nil {
+		return targets
+	}
+	for vip, ports := range config.Config {
+		// VIPs in maintenance are expected to refuse traffic
+		if _, ok := config.InMaintenance(vip); ok {
+			continue
+		}
+		for port, def := range ports {
+			if def == nil || !def.TCPEnabled {
+				continue
+			}
+			if !snapshot.NodeHasServiceRunning(r.nodeName, def.Namespace, def.Service, def.PortName) {
+				continue
+			}
+			targets = append(targets, probeTarget{
+				vip:     string(vip),
+				port:    port,
+				service: types.MakeIdent(def.Namespace, def.Service, def.PortName),
+			})
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].address() < targets[j].address()
+	})
+	return targets
+}
+
+// dialProbe connects to address with the probe mark set on the socket
+func (r *realserver) dialProbe(ctx context.Context, address string) error {
+	ctx, cancel := context.WithTimeout(ctx, r.probe.Timeout)
+	defer cancel()
+
+	mark := r.probe.Mark
+	dialer := net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = markSocket(fd, mark)
+			}); cerr != nil {
+				return cerr
+			}
+			if err != nil {
+				return fmt.Errorf("unable to mark probe socket. %v", err)
+			}
+			return nil
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
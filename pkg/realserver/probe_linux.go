@@ -0,0 +1,8 @@
+package realserver
+
+import "syscall"
+
+// markSocket sets the firewall mark of the socket fd
+func markSocket(fd uintptr, mark int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+}
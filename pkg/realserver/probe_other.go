@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package realserver
+
+import "fmt"
+
+// markSocket returns an error, as sockets only carry firewall marks on linux
+func markSocket(fd uintptr, mark int) error {
+	return fmt.Errorf("firewall marks are only available on linux")
+}
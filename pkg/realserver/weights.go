@@ -0,0 +1,116 @@
+package realserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// WeightsPath is where a realserver serves the weights of its VIP ports, see ServeHTTP
+const WeightsPath = "/weights"
+
+// VIPWeight is whether the node is ready to serve a VIP port, and at what
+// weight, for the health monitors of an external load balancer. The weight is
+// the number of ready pods of the service on the node, and zero when it isn't
+// ready.
+type VIPWeight struct {
+	VIP     string `json:"vip"`
+	Port    string `json:"port"`
+	Service string `json:"service"`
+	Ready   bool   `json:"ready"`
+	Weight  int    `json:"weight"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// weights returns the weights of the VIP ports the node forwards, those of the
+// port conflict check aside, sorted by VIP and port
+func (r *realserver) weights() []VIPWeight {
+	snapshot := r.watcher.Snapshot()
+	config := r.desiredConfig(snapshot)
+	weights := []VIPWeight{}
+	if config == nil {
+		return weights
+	}
+	unhealthy, isUnhealthy := util.UnhealthyReasons()[stats.KindIpvsBackend]
+
+	for _, vips := range []map[types.ServiceIP]types.PortMap{config.Config, config.Config6} {
+		for vip, ports := range vips {
+			_, inMaintenance := config.InMaintenance(vip)
+			for port, def := range ports {
+				if def == nil {
+					continue
+				}
+				w := VIPWeight{
+					VIP:     string(vip),
+					Port:    port,
+					Service: types.MakeIdent(def.Namespace, def.Service, def.PortName),
+				}
+				pods := len(snapshot.GetPodIPsOnNode(r.nodeName, def.Service, def.Namespace, def.PortName))
+				switch {
+				case isUnhealthy:
+					w.Reason = "node unhealthy: " + unhealthy
+				case inMaintenance:
+					w.Reason = "in maintenance"
+				case pods == 0:
+					w.Reason = "no ready pods on the node"
+				default:
+					w.Ready, w.Weight = true, pods
+				}
+				weights = append(weights, w)
+			}
+		}
+	}
+	sort.Slice(weights, func(i, j int) bool {
+		if weights[i].VIP != weights[j].VIP {
+			return weights[i].VIP < weights[j].VIP
+		}
+		return weights[i].Port < weights[j].Port
+	})
+	return weights
+}
+
+// ServeHTTP serves the weights of every VIP port the node forwards as json at
+// WeightsPath. At WeightsPath/<vip>/<port> it serves one, in the form health
+// monitors of hardware load balancers match on: 200 with "ready weight=<n>"
+// when the node is ready to serve it, and 503 with the reason it isn't.
+func (r *realserver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	weights := r.weights()
+
+	target := strings.Trim(strings.TrimPrefix(req.URL.Path, WeightsPath), "/")
+	if target == "" {
+		b, err := json.MarshalIndent(weights, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+		return
+	}
+
+	parts := strings.Split(target, "/")
+	if len(parts) != 2 {
+		http.Error(w, fmt.Sprintf("expected %s/<vip>/<port>", WeightsPath), http.StatusBadRequest)
+		return
+	}
+	for _, vw := range weights {
+		if vw.VIP != parts[0] || vw.Port != parts[1] {
+			continue
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		if !vw.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready: %s\n", vw.Reason)
+			return
+		}
+		fmt.Fprintf(w, "ready weight=%d\n", vw.Weight)
+		return
+	}
+	http.Error(w, fmt.Sprintf("%s:%s is not forwarded by this node", parts[0], parts[1]), http.StatusNotFound)
+}
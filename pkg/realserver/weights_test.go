@@ -0,0 +1,63 @@
+package realserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+func TestWeights(t *testing.T) {
+	web := &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "http", TCPEnabled: true}
+	api := &types.ServiceDef{Namespace: "syseng", Service: "api", PortName: "http", TCPEnabled: true}
+	r := &realserver{
+		nodeName: "node-a",
+		watcher: &watcher.Watcher{
+			ClusterConfig: &types.ClusterConfig{
+				Config: map[types.ServiceIP]types.PortMap{
+					"10.54.213.147": {"80": web, "8080": api},
+					"10.54.213.148": {"80": web},
+				},
+				Maintenance: map[types.ServiceIP]types.Maintenance{"10.54.213.148": {}},
+			},
+			AllPodsByNode: map[string][]*v1.Pod{
+				"node-a": {
+					{Status: v1.PodStatus{PodIP: "100.64.0.1"}},
+					{Status: v1.PodStatus{PodIP: "100.64.0.2"}},
+				},
+			},
+			AllEndpoints: map[string]*v1.Endpoints{
+				"syseng/web": {
+					ObjectMeta: metav1.ObjectMeta{Namespace: "syseng", Name: "web"},
+					Subsets: []v1.EndpointSubset{{
+						Addresses: []v1.EndpointAddress{{IP: "100.64.0.1"}, {IP: "100.64.0.2"}, {IP: "100.64.1.1"}},
+						Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+					}},
+				},
+			},
+		},
+	}
+
+	for path, want := range map[string]struct {
+		code int
+		body string
+	}{
+		"/weights/10.54.213.147/80":   {http.StatusOK, "ready weight=2"},
+		"/weights/10.54.213.147/8080": {http.StatusServiceUnavailable, "not ready: no ready pods on the node"},
+		"/weights/10.54.213.148/80":   {http.StatusServiceUnavailable, "not ready: in maintenance"},
+		"/weights/10.54.213.149/80":   {http.StatusNotFound, "is not forwarded by this node"},
+		"/weights":                    {http.StatusOK, `"weight": 2`},
+	} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want.code || !strings.Contains(rec.Body.String(), want.body) {
+			t.Errorf("%s: expected %d %q. saw %d %q", path, want.code, want.body, rec.Code, rec.Body.String())
+		}
+	}
+}
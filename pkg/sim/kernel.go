@@ -0,0 +1,124 @@
+// Package sim runs the director end to end against an in-memory kernel, so that
+// reconciliation can be tested in CI without a privileged container.
+package sim
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+// Kernel is an in-memory model of the state Ravel programs into the kernel: the
+// IPVS table, the VIP addresses, the iptables chains and the kernel parameters
+// the config can change. Kernel implements system.CommandRunner for ipvsadm, so
+// the production IPVS code runs against it unmodified.
+type Kernel struct {
+	IPVS     *system.FakeIPVS
+	IP       *system.FakeIP
+	IPTables *iptables.FakeRuleApplier
+	Sysctl   *system.FakeSysctl
+}
+
+// NewKernel creates an empty Kernel
+func NewKernel(chain string, masq bool, logger log.FieldLogger) *Kernel {
+	return &Kernel{
+		IPVS:     system.NewFakeIPVS(),
+		IP:       system.NewFakeIP(),
+		IPTables: iptables.NewFakeRuleApplier(chain, masq, logger),
+		Sysctl: system.NewFakeSysctl(map[string]string{
+			"net/ipv4/tcp_syncookies":              "1",
+			"net/netfilter/nf_conntrack_tcp_loose": "1",
+			"net/ipv4/vs/drop_entry":               "0",
+			"net/ipv4/vs/drop_packet":              "0",
+			"net/ipv4/vs/secure_tcp":               "0",
+			"net/ipv4/vs/amemthresh":               "1024",
+		}),
+	}
+}
+
+// Run executes ipvsadm -Sn, -R and -C against the in-memory IPVS table
+func (k *Kernel) Run(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	if name != "ipvsadm" || len(args) == 0 {
+		return nil, fmt.Errorf("sim: unsupported command %s %s", name, strings.Join(args, " "))
+	}
+
+	switch args[0] {
+	case "-Sn":
+		k.IPVS.Lock()
+		defer k.IPVS.Unlock()
+		return []byte(strings.Join(k.IPVS.Rules, "\n")), nil
+	case "-R":
+		rules := []string{}
+		for _, r := range strings.Split(string(stdin), "\n") {
+			if strings.TrimSpace(r) != "" {
+				rules = append(rules, r)
+			}
+		}
+		return k.IPVS.Set(rules)
+	case "-C":
+		return nil, k.IPVS.Teardown(ctx)
+	}
+	return nil, fmt.Errorf("sim: unsupported command %s %s", name, strings.Join(args, " "))
+}
+
+// VIPs returns the sorted addresses configured on the VIP interface
+func (k *Kernel) VIPs() []string {
+	k.IP.Lock()
+	defer k.IP.Unlock()
+	out := []string{}
+	for _, addr := range k.IP.Devices {
+		out = append(out, addr)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Services returns the virtual services in the IPVS table, i.e. `-t 10.1.2.3:80`
+func (k *Kernel) Services() []string {
+	k.IPVS.Lock()
+	defer k.IPVS.Unlock()
+	out := []string{}
+	for _, r := range k.IPVS.Rules {
+		fields := strings.Fields(r)
+		if len(fields) >= 3 && fields[0] == "-A" {
+			out = append(out, fields[1]+" "+fields[2])
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Backends returns the realservers and their weights for a virtual service,
+// i.e. `-t 10.1.2.3:80`
+func (k *Kernel) Backends(service string) map[string]int {
+	k.IPVS.Lock()
+	defer k.IPVS.Unlock()
+	out := map[string]int{}
+	for _, r := range k.IPVS.Rules {
+		fields := strings.Fields(r)
+		if len(fields) < 3 || fields[0] != "-a" || fields[1]+" "+fields[2] != service {
+			continue
+		}
+		var realserver string
+		var weight int
+		for n := 3; n < len(fields)-1; n++ {
+			switch fields[n] {
+			case "-r":
+				realserver = fields[n+1]
+			case "-w":
+				weight, _ = strconv.Atoi(fields[n+1])
+			}
+		}
+		out[realserver] = weight
+	}
+	return out
+}
+
+var _ system.CommandRunner = &Kernel{}
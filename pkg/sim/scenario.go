@@ -0,0 +1,238 @@
+package sim
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/Comcast/Ravel/pkg/dataplane"
+	"github.com/Comcast/Ravel/pkg/director"
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// DefaultMaxRounds is the number of reconciles Converge allows before giving up
+const DefaultMaxRounds = 3
+
+// Event is a synthetic watch event. Exactly one of Node, Endpoints or Config is set.
+type Event struct {
+	Type      watch.EventType
+	Node      *v1.Node
+	Endpoints *v1.Endpoints
+	Config    *types.ClusterConfig
+}
+
+// Step is one stage of a scenario: the events to feed the watcher, and the
+// state the kernel must converge to afterwards.
+type Step struct {
+	Name   string
+	Events []Event
+
+	// VIPs is the expected set of addresses on the VIP interface
+	VIPs []string
+
+	// Backends maps a virtual service, i.e. `-t 10.1.2.3:80`, to its expected
+	// realservers and weights. Services not listed must not exist.
+	Backends map[string]map[string]int
+}
+
+// Scenario wires a director to an in-memory Kernel and a watcher that is fed
+// synthetic events instead of talking to kubernetes.
+type Scenario struct {
+	Kernel   *Kernel
+	Watcher  *watcher.Watcher
+	Director director.Director
+
+	ipvs      *system.IPVS
+	maxRounds int
+	logger    log.FieldLogger
+}
+
+// NewScenario creates a director for nodeName, whose primary address is primaryIP
+func NewScenario(ctx context.Context, nodeName, primaryIP string, logger log.FieldLogger) (*Scenario, error) {
+	return newScenario(ctx, nodeName, primaryIP, false, logger)
+}
+
+// NewScenarioIPv6Only creates a director for nodeName in a cluster with no IPv4
+// at all, which programs only the VIPs in Config6
+func NewScenarioIPv6Only(ctx context.Context, nodeName, primaryIP string, logger log.FieldLogger) (*Scenario, error) {
+	return newScenario(ctx, nodeName, primaryIP, true, logger)
+}
+
+func newScenario(ctx context.Context, nodeName, primaryIP string, ipv6Only bool, logger log.FieldLogger) (*Scenario, error) {
+	kernel := NewKernel("RAVEL", true, logger)
+
+	w := &watcher.Watcher{
+		AllServices:   map[string]*v1.Service{},
+		AllEndpoints:  map[string]*v1.Endpoints{},
+		AllPods:       map[string]*v1.Pod{},
+		AllPodsByNode: map[string][]*v1.Pod{},
+		ClusterConfig: &types.ClusterConfig{Config: map[types.ServiceIP]types.PortMap{}},
+		Nodes:         []*v1.Node{},
+	}
+
+	ipvs, err := system.NewIPVS(ctx, primaryIP, false, true, logger, stats.KindIpvsMaster)
+	if err != nil {
+		return nil, err
+	}
+	ipvs.SetCommandRunner(kernel)
+
+	plane := dataplane.NewIPVS(ipvs, kernel.IP, kernel.IPTables, kernel.Sysctl, dataplane.ColocationDisabled, ipv6Only, "sim", logger)
+	d, err := director.NewDirector(ctx, nodeName, "sim", false, w, plane, kernel.IP, ipv6Only, 0, nil, nil, director.Supervision{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Scenario{
+		Kernel:    kernel,
+		Watcher:   w,
+		Director:  d,
+		ipvs:      ipvs,
+		maxRounds: DefaultMaxRounds,
+		logger:    logger.WithFields(log.Fields{"module": "sim"}),
+	}, nil
+}
+
+// EnableECMP configures the director's IPVS services as ECMP fwmark services
+func (s *Scenario) EnableECMP(fwmarkBase int) {
+	s.ipvs.EnableECMP(fwmarkBase)
+}
+
+// Apply feeds events to the watcher
+func (s *Scenario) Apply(events ...Event) {
+	s.Watcher.Lock()
+	defer s.Watcher.Unlock()
+
+	for _, e := range events {
+		switch {
+		case e.Config != nil:
+			s.Watcher.ClusterConfig = e.Config
+		case e.Node != nil:
+			nodes := []*v1.Node{}
+			for _, n := range s.Watcher.Nodes {
+				if n.Name != e.Node.Name {
+					nodes = append(nodes, n)
+				}
+			}
+			if e.Type != watch.Deleted {
+				nodes = append(nodes, e.Node)
+			}
+			s.Watcher.Nodes = nodes
+		case e.Endpoints != nil:
+			identity := e.Endpoints.Namespace + "/" + e.Endpoints.Name
+			if e.Type == watch.Deleted {
+				delete(s.Watcher.AllEndpoints, identity)
+			} else {
+				s.Watcher.AllEndpoints[identity] = e.Endpoints
+			}
+		}
+	}
+}
+
+// Converge reconciles until the kernel has parity with the watcher's configuration
+func (s *Scenario) Converge() error {
+	for round := 0; round < s.maxRounds; round++ {
+		same, err := s.parity()
+		if err != nil {
+			return err
+		}
+		if same {
+			return nil
+		}
+		if err := s.Director.Reconcile(false); err != nil {
+			return fmt.Errorf("sim: reconcile round %d failed. %v", round, err)
+		}
+	}
+	return fmt.Errorf("sim: no parity after %d reconciles", s.maxRounds)
+}
+
+func (s *Scenario) parity() (bool, error) {
+	v4, v6, err := s.Kernel.IP.Get()
+	if err != nil {
+		return false, err
+	}
+	return s.ipvs.CheckConfigParity(s.Watcher, s.Watcher.ClusterConfig, append(v4, v6...))
+}
+
+// Run applies each step in order, converges, and checks the resulting kernel state
+func (s *Scenario) Run(steps []Step) error {
+	for _, step := range steps {
+		s.logger.Infof("sim: running step %s", step.Name)
+		s.Apply(step.Events...)
+		if err := s.Converge(); err != nil {
+			return fmt.Errorf("sim: step %s: %v", step.Name, err)
+		}
+		if err := s.Verify(step); err != nil {
+			return fmt.Errorf("sim: step %s: %v", step.Name, err)
+		}
+	}
+	return nil
+}
+
+// Verify compares the kernel state with the expectations of a step
+func (s *Scenario) Verify(step Step) error {
+	errs := []string{}
+
+	if have := s.Kernel.VIPs(); !reflect.DeepEqual(stringSet(have), stringSet(step.VIPs)) {
+		errs = append(errs, fmt.Sprintf("vips: want %v, have %v", step.VIPs, have))
+	}
+
+	services := s.Kernel.Services()
+	if len(services) != len(step.Backends) {
+		errs = append(errs, fmt.Sprintf("services: want %d, have %v", len(step.Backends), services))
+	}
+	for service, backends := range step.Backends {
+		if have := s.Kernel.Backends(service); !reflect.DeepEqual(have, backends) {
+			errs = append(errs, fmt.Sprintf("backends for %s: want %v, have %v", service, backends, have))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+func stringSet(in []string) map[string]bool {
+	out := map[string]bool{}
+	for _, s := range in {
+		out[s] = true
+	}
+	return out
+}
+
+// ReadyNode returns a schedulable node in the Ready state with an internal address
+func ReadyNode(name, address string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: address}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	}
+}
+
+// Endpoints returns an endpoints object for a service port, with one address
+// for each entry in podNodes, which maps pod ip to node name.
+func Endpoints(namespace, service, portName string, port int32, podNodes map[string]string) *v1.Endpoints {
+	addresses := []v1.EndpointAddress{}
+	for ip, node := range podNodes {
+		node := node
+		addresses = append(addresses, v1.EndpointAddress{IP: ip, NodeName: &node})
+	}
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: service},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: addresses,
+			Ports:     []v1.EndpointPort{{Name: portName, Port: port, Protocol: v1.ProtocolTCP}},
+		}},
+	}
+}
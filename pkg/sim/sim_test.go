@@ -0,0 +1,149 @@
+package sim
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+func TestScenarioConverges(t *testing.T) {
+	s, err := NewScenario(context.Background(), "director-0", "10.1.1.1", logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {
+				"80": &types.ServiceDef{Namespace: "syseng", Service: "mod-super8", PortName: "http", TCPEnabled: true},
+			},
+		},
+	}
+	empty := &types.ClusterConfig{Config: map[types.ServiceIP]types.PortMap{}}
+
+	steps := []Step{
+		{
+			Name: "initial config",
+			Events: []Event{
+				{Type: watch.Added, Config: config},
+				{Type: watch.Added, Node: ReadyNode("node-a", "10.1.2.1")},
+				{Type: watch.Added, Node: ReadyNode("node-b", "10.1.2.2")},
+				{Type: watch.Added, Endpoints: Endpoints("syseng", "mod-super8", "http", 8080, map[string]string{
+					"100.64.0.1": "node-a",
+					"100.64.0.2": "node-a",
+					"100.64.1.1": "node-b",
+				})},
+			},
+			VIPs: []string{"10.54.213.165"},
+			Backends: map[string]map[string]int{
+				"-t 10.54.213.165:80": {"10.1.2.1:80": 2, "10.1.2.2:80": 1},
+			},
+		},
+		{
+			Name:   "node removed",
+			Events: []Event{{Type: watch.Deleted, Node: ReadyNode("node-b", "10.1.2.2")}},
+			VIPs:   []string{"10.54.213.165"},
+			Backends: map[string]map[string]int{
+				"-t 10.54.213.165:80": {"10.1.2.1:80": 2},
+			},
+		},
+		{
+			Name:     "vip removed",
+			Events:   []Event{{Type: watch.Modified, Config: empty}},
+			VIPs:     []string{},
+			Backends: map[string]map[string]int{},
+		},
+	}
+
+	if err := s.Run(steps); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKernelRunIPVS(t *testing.T) {
+	k := NewKernel("RAVEL", true, logrus.New())
+	ctx := context.Background()
+
+	rules := "-A -t 10.54.213.165:80 -s wrr\n-a -t 10.54.213.165:80 -r 10.1.2.1:80 -i -w 3 -x 0 -y 0\n"
+	if _, err := k.Run(ctx, []byte(rules), "ipvsadm", "-R"); err != nil {
+		t.Fatal(err)
+	}
+	if backends := k.Backends("-t 10.54.213.165:80"); backends["10.1.2.1:80"] != 3 {
+		t.Errorf("expected realserver with weight 3, have %v", backends)
+	}
+
+	if _, err := k.Run(ctx, nil, "ipvsadm", "-C"); err != nil {
+		t.Fatal(err)
+	}
+	if services := k.Services(); len(services) != 0 {
+		t.Errorf("expected empty table, have %v", services)
+	}
+
+	if _, err := k.Run(ctx, nil, "iptables-save"); err == nil {
+		t.Error("expected unsupported command to fail")
+	}
+}
+
+func TestScenarioIPv6OnlyConverges(t *testing.T) {
+	s, err := NewScenarioIPv6Only(context.Background(), "director-0", "2001:db8::1", logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{},
+		Config6: map[types.ServiceIP]types.PortMap{
+			"2001:558:1044:1ae:10ad:ba1a:0:7": {
+				"80": &types.ServiceDef{Namespace: "syseng", Service: "mod-super8", PortName: "http", TCPEnabled: true},
+			},
+		},
+	}
+	empty := &types.ClusterConfig{Config: map[types.ServiceIP]types.PortMap{}, Config6: map[types.ServiceIP]types.PortMap{}}
+
+	steps := []Step{
+		{
+			Name: "initial config",
+			Events: []Event{
+				{Type: watch.Added, Config: config},
+				{Type: watch.Added, Node: ReadyNode("node-a", "2001:db8::a")},
+				{Type: watch.Added, Node: ReadyNode("node-b", "2001:db8::b")},
+				{Type: watch.Added, Endpoints: Endpoints("syseng", "mod-super8", "http", 8080, map[string]string{
+					"fd00::1": "node-a",
+					"fd00::2": "node-a",
+					"fd00::3": "node-b",
+				})},
+			},
+			VIPs: []string{"2001:558:1044:1ae:10ad:ba1a:0:7"},
+			Backends: map[string]map[string]int{
+				"-t [2001:558:1044:1ae:10ad:ba1a:0:7]:80": {"[2001:db8::a]:80": 2, "[2001:db8::b]:80": 1},
+			},
+		},
+		{
+			Name:   "node removed",
+			Events: []Event{{Type: watch.Deleted, Node: ReadyNode("node-b", "2001:db8::b")}},
+			VIPs:   []string{"2001:558:1044:1ae:10ad:ba1a:0:7"},
+			Backends: map[string]map[string]int{
+				"-t [2001:558:1044:1ae:10ad:ba1a:0:7]:80": {"[2001:db8::a]:80": 2},
+			},
+		},
+		{
+			Name:     "vip removed",
+			Events:   []Event{{Type: watch.Modified, Config: empty}},
+			VIPs:     []string{},
+			Backends: map[string]map[string]int{},
+		},
+	}
+
+	if err := s.Run(steps); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range s.Kernel.IP.Advertised {
+		if addr != "2001:558:1044:1ae:10ad:ba1a:0:7" {
+			t.Errorf("expected only the v6 VIP to be announced. saw %v", s.Kernel.IP.Advertised)
+		}
+	}
+}
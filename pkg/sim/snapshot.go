@@ -0,0 +1,63 @@
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// LoadEvents reads a cluster config of any schema version, a NodeList and an EndpointsList from JSON or
+// YAML files and returns them as Added events. The node and endpoint paths may be
+// empty.
+func LoadEvents(configPath, nodesPath, endpointsPath string) ([]Event, error) {
+	raw := json.RawMessage{}
+	if err := decodeFile(configPath, &raw); err != nil {
+		return nil, err
+	}
+	config, err := types.ParseClusterConfig(raw)
+	if err != nil {
+		return nil, fmt.Errorf("sim: unable to parse %s. %v", configPath, err)
+	}
+	events := []Event{{Type: watch.Added, Config: config}}
+
+	if nodesPath != "" {
+		nodes := &v1.NodeList{}
+		if err := decodeFile(nodesPath, nodes); err != nil {
+			return nil, err
+		}
+		for n := range nodes.Items {
+			events = append(events, Event{Type: watch.Added, Node: &nodes.Items[n]})
+		}
+	}
+
+	if endpointsPath != "" {
+		endpoints := &v1.EndpointsList{}
+		if err := decodeFile(endpointsPath, endpoints); err != nil {
+			return nil, err
+		}
+		for n := range endpoints.Items {
+			events = append(events, Event{Type: watch.Added, Endpoints: &endpoints.Items[n]})
+		}
+	}
+
+	return events, nil
+}
+
+func decodeFile(path string, into interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("sim: unable to open %s. %v", path, err)
+	}
+	defer f.Close()
+
+	if err := yaml.NewYAMLOrJSONDecoder(f, 4096).Decode(into); err != nil {
+		return fmt.Errorf("sim: unable to decode %s. %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+// Package state exports and imports the complete load balancer state of a node,
+// so that a replacement director can be brought up with a known-good configuration.
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/bgp"
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// SnapshotVersion is incremented whenever the Snapshot format changes incompatibly
+const SnapshotVersion = 1
+
+// Snapshot is the desired and applied state of a node
+type Snapshot struct {
+	Version  int       `json:"version"`
+	Created  time.Time `json:"created"`
+	NodeName string    `json:"nodeName"`
+
+	// Desired is the cluster config the node was working from
+	Desired *types.ClusterConfig `json:"desired,omitempty"`
+
+	// Addresses and Addresses6 are the VIPs configured on the node
+	Addresses  []string `json:"addresses"`
+	Addresses6 []string `json:"addresses6"`
+
+	// IPVS is the ipvsadm -Sn output for both address families
+	IPVS []string `json:"ipvs"`
+
+	// IPTables holds the ravel-owned chains of the nat table
+	IPTables map[string]*iptables.RuleSet `json:"iptables,omitempty"`
+
+	// BGPRoutes are the addresses advertised by gobgp
+	BGPRoutes []string `json:"bgpRoutes,omitempty"`
+}
+
+// Host reads and writes the state of the local node. IPTables and BGP are optional.
+type Host struct {
+	IPVS     system.IPVSExecutor
+	IP       system.AddressManager
+	IPTables iptables.RuleApplier
+	BGP      bgp.Controller
+
+	// Communities are attached to BGP routes on import
+	Communities []string
+
+	logger log.FieldLogger
+}
+
+// NewHost creates a Host. ipt and bgpController may be nil.
+func NewHost(ipvs system.IPVSExecutor, ip system.AddressManager, ipt iptables.RuleApplier, bgpController bgp.Controller, communities []string, logger log.FieldLogger) *Host {
+	return &Host{
+		IPVS:        ipvs,
+		IP:          ip,
+		IPTables:    ipt,
+		BGP:         bgpController,
+		Communities: communities,
+		logger:      logger.WithFields(log.Fields{"module": "state"}),
+	}
+}
+
+// Export captures the applied state of the node along with the desired config, which may be nil
+func (h *Host) Export(ctx context.Context, nodeName string, desired *types.ClusterConfig) (*Snapshot, error) {
+	s := &Snapshot{
+		Version:    SnapshotVersion,
+		Created:    time.Now().UTC(),
+		NodeName:   nodeName,
+		Desired:    desired,
+		Addresses:  []string{},
+		Addresses6: []string{},
+	}
+
+	devices4, devices6, err := h.IP.Get()
+	if err != nil {
+		return nil, fmt.Errorf("state: unable to get addresses. %v", err)
+	}
+	for _, d := range devices4 {
+		s.Addresses = append(s.Addresses, strings.Replace(d, "_", ".", -1))
+	}
+
+	// v6 device names are truncated, so they are matched back to the addresses
+	// in the desired config
+	if len(devices6) > 0 && desired != nil {
+		configured := map[string]bool{}
+		for _, d := range devices6 {
+			configured[d] = true
+		}
+		for vip := range desired.Config6 {
+			if configured[h.IP.Device(string(vip), true)] {
+				s.Addresses6 = append(s.Addresses6, string(vip))
+			}
+		}
+	}
+	if len(devices6) != len(s.Addresses6) {
+		h.logger.Warnf("state: exported %d of %d v6 addresses. addresses not in the desired config are skipped", len(s.Addresses6), len(devices6))
+	}
+
+	rules, err := h.IPVS.Get()
+	if err != nil {
+		return nil, fmt.Errorf("state: unable to get ipvs rules. %v", err)
+	}
+	rules6, err := h.IPVS.GetV6()
+	if err != nil {
+		return nil, fmt.Errorf("state: unable to get ipvs v6 rules. %v", err)
+	}
+	s.IPVS = append(rules, rules6...)
+
+	if h.IPTables != nil {
+		saved, err := h.IPTables.Save()
+		if err != nil {
+			return nil, fmt.Errorf("state: unable to save iptables. %v", err)
+		}
+		s.IPTables = map[string]*iptables.RuleSet{
+			"PREROUTING": {ChainRule: ":PREROUTING ACCEPT", Rules: []string{}},
+		}
+		for chain, set := range saved {
+			if strings.HasPrefix(chain, h.IPTables.BaseChain()) {
+				s.IPTables[chain] = set
+			}
+		}
+		// keep only the jumps into ravel chains from PREROUTING
+		if prerouting, ok := saved["PREROUTING"]; ok {
+			for _, rule := range prerouting.Rules {
+				if strings.Contains(rule, "-j "+h.IPTables.BaseChain()) {
+					s.IPTables["PREROUTING"].Rules = append(s.IPTables["PREROUTING"].Rules, rule)
+				}
+			}
+		}
+	}
+
+	if h.BGP != nil {
+		routes, err := h.BGP.Get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("state: unable to get bgp routes. %v", err)
+		}
+		s.BGPRoutes = routes
+	}
+
+	return s, nil
+}
+
+// Import applies the state in a snapshot to the node. The IPVS table is replaced,
+// ravel-owned iptables chains are merged into the existing nat table, and addresses
+// and routes are added if missing.
+func (h *Host) Import(ctx context.Context, s *Snapshot) error {
+	if s.Version != SnapshotVersion {
+		return fmt.Errorf("state: snapshot version %d is not supported. expected %d", s.Version, SnapshotVersion)
+	}
+
+	devices4, devices6, err := h.IP.Get()
+	if err != nil {
+		return fmt.Errorf("state: unable to get addresses. %v", err)
+	}
+	existing := map[string]bool{}
+	for _, d := range append(devices4, devices6...) {
+		existing[d] = true
+	}
+	for _, addr := range s.Addresses {
+		if existing[h.IP.Device(addr, false)] {
+			continue
+		}
+		if err := h.IP.Add(addr); err != nil {
+			return fmt.Errorf("state: unable to add address %s. %v", addr, err)
+		}
+	}
+	for _, addr := range s.Addresses6 {
+		if existing[h.IP.Device(addr, true)] {
+			continue
+		}
+		if err := h.IP.Add6(addr); err != nil {
+			return fmt.Errorf("state: unable to add address %s. %v", addr, err)
+		}
+	}
+	h.logger.Infof("state: imported %d addresses", len(s.Addresses)+len(s.Addresses6))
+
+	if err := h.IPVS.Teardown(ctx); err != nil {
+		return fmt.Errorf("state: unable to clear ipvs. %v", err)
+	}
+	if len(s.IPVS) > 0 {
+		if out, err := h.IPVS.Set(s.IPVS); err != nil {
+			return fmt.Errorf("state: unable to set ipvs rules. %s %v", string(out), err)
+		}
+	}
+	h.logger.Infof("state: imported %d ipvs rules", len(s.IPVS))
+
+	if h.IPTables != nil && len(s.IPTables) > 0 {
+		existing, err := h.IPTables.Save()
+		if err != nil {
+			return fmt.Errorf("state: unable to save iptables. %v", err)
+		}
+		// Merge expects PREROUTING on both sides
+		for _, set := range []map[string]*iptables.RuleSet{s.IPTables, existing} {
+			if _, ok := set["PREROUTING"]; !ok {
+				set["PREROUTING"] = &iptables.RuleSet{ChainRule: ":PREROUTING ACCEPT", Rules: []string{}}
+			}
+		}
+		merged, _, err := h.IPTables.Merge(s.IPTables, existing)
+		if err != nil {
+			return fmt.Errorf("state: unable to merge iptables. %v", err)
+		}
+		if err := h.IPTables.Restore(merged); err != nil {
+			return fmt.Errorf("state: unable to restore iptables. %v", err)
+		}
+		h.logger.Infof("state: imported %d iptables chains", len(s.IPTables))
+	}
+
+	if h.BGP != nil && len(s.BGPRoutes) > 0 {
+		configured, err := h.BGP.Get(ctx)
+		if err != nil {
+			h.logger.Warnf("state: unable to get bgp routes, advertising all. %v", err)
+		}
+		if err := h.BGP.Set(ctx, s.BGPRoutes, configured, h.Communities); err != nil {
+			return fmt.Errorf("state: unable to advertise bgp routes. %v", err)
+		}
+		h.logger.Infof("state: imported %d bgp routes", len(s.BGPRoutes))
+	}
+
+	return nil
+}
+
+// WriteFile writes a snapshot as indented JSON
+func WriteFile(path string, s *Snapshot) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("state: unable to marshal snapshot. %v", err)
+	}
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		return fmt.Errorf("state: unable to write %s. %v", path, err)
+	}
+	return nil
+}
+
+// ReadFile reads a snapshot written by WriteFile
+func ReadFile(path string) (*Snapshot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("state: unable to read %s. %v", path, err)
+	}
+	s := &Snapshot{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("state: unable to unmarshal %s. %v", path, err)
+	}
+	return s, nil
+}
@@ -0,0 +1,109 @@
+package state
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+type fakeBGP struct {
+	routes []string
+}
+
+func (f *fakeBGP) Get(ctx context.Context) ([]string, error) { return f.routes, nil }
+func (f *fakeBGP) Set(ctx context.Context, addresses, configured []string, communities []string) error {
+	f.routes = append(f.routes, addresses...)
+	return nil
+}
+func (f *fakeBGP) SetV6(ctx context.Context, addresses []string, communities []string) error {
+	return nil
+}
+func (f *fakeBGP) Withdraw(ctx context.Context, addresses, configured []string) error {
+	return nil
+}
+func (f *fakeBGP) GetV6(ctx context.Context) ([]string, error) { return nil, nil }
+func (f *fakeBGP) WithdrawV6(ctx context.Context, addresses, configured []string) error {
+	return nil
+}
+func (f *fakeBGP) Teardown(ctx context.Context) error { return nil }
+
+func newTestHost() (*Host, *system.FakeIPVS, *system.FakeIP, *iptables.FakeRuleApplier, *fakeBGP) {
+	ipvs := system.NewFakeIPVS()
+	ip := system.NewFakeIP()
+	ipt := iptables.NewFakeRuleApplier("RAVEL", true, logrus.New())
+	b := &fakeBGP{}
+	return NewHost(ipvs, ip, ipt, b, nil, logrus.New()), ipvs, ip, ipt, b
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	src, srcIPVS, srcIP, srcIPT, srcBGP := newTestHost()
+	srcIP.Add("10.54.213.165")
+	srcIPVS.Set([]string{
+		"-A -t 10.54.213.165:80 -s wrr",
+		"-a -t 10.54.213.165:80 -r 10.1.2.1:80 -i -w 1 -x 0 -y 0",
+	})
+	srcIPT.Table = map[string]*iptables.RuleSet{
+		"PREROUTING": {ChainRule: ":PREROUTING ACCEPT", Rules: []string{"-A PREROUTING -j RAVEL", "-A PREROUTING -j KUBE-SERVICES"}},
+		"RAVEL":      {ChainRule: ":RAVEL - [0:0]", Rules: []string{"-A RAVEL -d 10.54.213.165/32 -p tcp -m tcp --dport 80 -j RAVEL-SVC-X"}},
+		"KUBE-SVC-Y": {ChainRule: ":KUBE-SVC-Y - [0:0]", Rules: []string{}},
+	}
+	srcBGP.routes = []string{"10.54.213.165"}
+
+	snapshot, err := src.Export(ctx, "director-0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := snapshot.IPTables["KUBE-SVC-Y"]; ok {
+		t.Error("expected chains not owned by ravel to be skipped")
+	}
+	if rules := snapshot.IPTables["PREROUTING"].Rules; len(rules) != 1 {
+		t.Errorf("expected only the ravel jump in PREROUTING, have %v", rules)
+	}
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := WriteFile(path, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, dstIPVS, dstIP, dstIPT, dstBGP := newTestHost()
+	if err := dst.Import(ctx, read); err != nil {
+		t.Fatal(err)
+	}
+
+	if dstIP.Devices["10_54_213_165"] != "10.54.213.165" {
+		t.Errorf("expected vip to be imported, have %v", dstIP.Devices)
+	}
+	want, _ := srcIPVS.Get()
+	have, _ := dstIPVS.Get()
+	sort.Strings(want)
+	sort.Strings(have)
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("ipvs mismatch. want %v, have %v", want, have)
+	}
+	if _, ok := dstIPT.Table["RAVEL"]; !ok {
+		t.Errorf("expected ravel chain to be imported, have %v", dstIPT.Table)
+	}
+	if !reflect.DeepEqual(dstBGP.routes, []string{"10.54.213.165"}) {
+		t.Errorf("expected route to be imported, have %v", dstBGP.routes)
+	}
+}
+
+func TestImportRejectsUnknownVersion(t *testing.T) {
+	h, _, _, _, _ := newTestHost()
+	if err := h.Import(context.Background(), &Snapshot{Version: SnapshotVersion + 1}); err == nil {
+		t.Error("expected an error for an unsupported snapshot version")
+	}
+}
@@ -0,0 +1,84 @@
+package stats
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// registryForwarder sends the metrics registered with prometheus by the rest of
+// ravel - worker state, watcher, iptables and so on - to sinks that prometheus
+// doesn't scrape. Counters are sent as the increase since the last forward and
+// histograms and summaries as their _count and _sum counters.
+type registryForwarder struct {
+	gatherer prometheus.Gatherer
+	sink     MetricsSink
+
+	// skip are the metrics the sink already receives directly
+	skip map[string]bool
+	// last is the last value of every counter, keyed by seriesKey
+	last map[string]float64
+}
+
+func newRegistryForwarder(gatherer prometheus.Gatherer, sink MetricsSink, skip ...string) *registryForwarder {
+	f := &registryForwarder{
+		gatherer: gatherer,
+		sink:     sink,
+		skip:     map[string]bool{},
+		last:     map[string]float64{},
+	}
+	for _, name := range skip {
+		f.skip[name] = true
+	}
+	return f
+}
+
+// forward gathers the registry and emits every metric to the sink
+func (f *registryForwarder) forward() error {
+	families, err := f.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	for _, mf := range families {
+		name := mf.GetName()
+		if f.skip[name] {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string, len(m.GetLabel()))
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				f.counter(name, labels, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				f.sink.Gauge(name, labels, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				f.sink.Gauge(name, labels, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				f.counter(name+"_count", labels, float64(m.GetHistogram().GetSampleCount()))
+				f.counter(name+"_sum", labels, m.GetHistogram().GetSampleSum())
+			case dto.MetricType_SUMMARY:
+				f.counter(name+"_count", labels, float64(m.GetSummary().GetSampleCount()))
+				f.counter(name+"_sum", labels, m.GetSummary().GetSampleSum())
+			}
+		}
+	}
+	return nil
+}
+
+// counter emits the increase of a counter since it was last seen. Counters
+// start at zero with the process, so the first value seen is all increase.
+func (f *registryForwarder) counter(name string, labels map[string]string, total float64) {
+	key := seriesKey(name, labels)
+	delta := total - f.last[key]
+	if delta < 0 {
+		// the counter was reset
+		delta = total
+	}
+	f.last[key] = total
+	if delta > 0 {
+		f.sink.Counter(name, labels, delta)
+	}
+}
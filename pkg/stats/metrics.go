@@ -1,7 +1,5 @@
 package stats
 
-import "github.com/prometheus/client_golang/prometheus"
-
 type LBKind string
 
 const KindBGPDirector = "bgp"
@@ -28,36 +26,44 @@ var (
 	stateRst    = "rst"
 
 	LatencyBuckets []float64 = []float64{100, 1000, 10000, 50000, 100000, 200000, 300000, 400000, 500000, 600000, 700000, 800000, 900000, 1000000, 1500000, 2000000, 3000000}
+
+	// ConvergenceBuckets are in seconds. a change waits at least the publish
+	// delay of the watcher before it is reconciled
+	ConvergenceBuckets []float64 = []float64{0.5, 1, 2, 3, 5, 10, 15, 30, 60, 120, 300, 600}
 )
 
-var standardLabels = []string{"lb", "vip", "port", "protocol", "port_name", "namespace", "service"}
-var stateLabels = []string{"lb", "vip", "port", "state_event", "protocol", "port_name", "namespace", "service"}
+// metricHelp returns the help text of the flow metrics. Other metrics are
+// described by their name.
+func metricHelp(name string) string {
+	switch name {
+	case metricTcpState:
+		return helpTcpState
+	case metricFlows:
+		return helpFlows
+	case metricTx:
+		return helpTx
+	case metricRx:
+		return helpRx
+	}
+	return name
+}
 
+// flowMetrics emits the flow statistics to the configured sinks
 type flowMetrics struct {
-	// counters for all state events
-	rxMetric    *prometheus.CounterVec
-	txMetric    *prometheus.CounterVec
-	stateMetric *prometheus.CounterVec
-	flowsMetric *prometheus.CounterVec
-
+	sink   MetricsSink
 	lbKind string
 }
 
 // simple instantiation of all maps
-func newFlowMetrics(kind LBKind) *flowMetrics {
+func newFlowMetrics(kind LBKind, sink MetricsSink) *flowMetrics {
 	return &flowMetrics{
-
+		sink:   sink,
 		lbKind: string(kind),
-
-		txMetric:    newCounter(metricTx, helpTx, standardLabels),
-		rxMetric:    newCounter(metricRx, helpRx, standardLabels),
-		stateMetric: newCounter(metricTcpState, helpTcpState, stateLabels),
-		flowsMetric: newCounter(metricFlows, helpFlows, standardLabels),
 	}
 }
 
-func (p *flowMetrics) tx(vip, port, protocol, namespace, portName, service string, value uint64) {
-	p.txMetric.With(prometheus.Labels{
+func (p *flowMetrics) labels(vip, port, protocol, namespace, portName, service string) map[string]string {
+	return map[string]string{
 		"lb":        p.lbKind,
 		"vip":       vip,
 		"port":      port,
@@ -65,51 +71,23 @@ func (p *flowMetrics) tx(vip, port, protocol, namespace, portName, service strin
 		"service":   service,
 		"port_name": portName,
 		"protocol":  protocol,
-	}).Add(float64(value))
+	}
+}
+
+func (p *flowMetrics) tx(vip, port, protocol, namespace, portName, service string, value uint64) {
+	p.sink.Counter(metricTx, p.labels(vip, port, protocol, namespace, portName, service), float64(value))
 }
 
 func (p *flowMetrics) rx(vip, port, protocol, namespace, portName, service string, value uint64) {
-	p.rxMetric.With(prometheus.Labels{
-		"lb":        p.lbKind,
-		"vip":       vip,
-		"port":      port,
-		"namespace": namespace,
-		"service":   service,
-		"port_name": portName,
-		"protocol":  protocol,
-	}).Add(float64(value))
+	p.sink.Counter(metricRx, p.labels(vip, port, protocol, namespace, portName, service), float64(value))
 }
 
 func (p *flowMetrics) flows(vip, port, protocol, namespace, portName, service string, value uint64) {
-	p.flowsMetric.With(prometheus.Labels{
-		"lb":        p.lbKind,
-		"vip":       vip,
-		"port":      port,
-		"namespace": namespace,
-		"service":   service,
-		"port_name": portName,
-		"protocol":  protocol,
-	}).Add(float64(value))
+	p.sink.Counter(metricFlows, p.labels(vip, port, protocol, namespace, portName, service), float64(value))
 }
 
 func (p *flowMetrics) tcpState(vip, port, stateEvent, protocol, namespace, portName, service string, value uint64) {
-	p.stateMetric.With(prometheus.Labels{
-		"lb":          p.lbKind,
-		"vip":         vip,
-		"port":        port,
-		"state_event": stateEvent,
-		"namespace":   namespace,
-		"service":     service,
-		"port_name":   portName,
-		"protocol":    protocol,
-	}).Add(float64(value))
-}
-
-func newCounter(name, help string, labels []string) *prometheus.CounterVec {
-	newCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: name,
-		Help: help,
-	}, labels)
-	prometheus.MustRegister(newCounter)
-	return newCounter
+	labels := p.labels(vip, port, protocol, namespace, portName, service)
+	labels["state_event"] = stateEvent
+	p.sink.Counter(metricTcpState, labels, float64(value))
 }
@@ -0,0 +1,189 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// otlpSink sends metrics to an OTLP/HTTP receiver as json. Counters are sent as
+// monotonic sums with delta temporality, holding the increase since the last
+// flush; gauges hold their last value.
+type otlpSink struct {
+	sync.Mutex
+	endpoint string
+	service  string
+	client   *http.Client
+
+	start  time.Time
+	sums   map[string]*otlpSeries
+	gauges map[string]*otlpSeries
+}
+
+type otlpSeries struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// NewOTLPSink creates a sink that posts metrics to the OTLP/HTTP endpoint, with
+// service as the service.name of the resource
+func NewOTLPSink(endpoint, service string) MetricsSink {
+	return &otlpSink{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		start:    time.Now(),
+		sums:     map[string]*otlpSeries{},
+		gauges:   map[string]*otlpSeries{},
+	}
+}
+
+func (o *otlpSink) Counter(name string, labels map[string]string, delta float64) {
+	o.Lock()
+	defer o.Unlock()
+	key := seriesKey(name, labels)
+	if s, ok := o.sums[key]; ok {
+		s.value += delta
+		return
+	}
+	o.sums[key] = &otlpSeries{name: name, labels: labels, value: delta}
+}
+
+func (o *otlpSink) Gauge(name string, labels map[string]string, value float64) {
+	o.Lock()
+	defer o.Unlock()
+	o.gauges[seriesKey(name, labels)] = &otlpSeries{name: name, labels: labels, value: value}
+}
+
+// Flush posts the metrics collected since the last flush
+func (o *otlpSink) Flush() error {
+	o.Lock()
+	sums, gauges, start := o.sums, o.gauges, o.start
+	now := time.Now()
+	o.sums = map[string]*otlpSeries{}
+	o.gauges = map[string]*otlpSeries{}
+	o.start = now
+	o.Unlock()
+
+	if len(sums)+len(gauges) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(otlpRequest(o.service, sums, gauges, start, now))
+	if err != nil {
+		return fmt.Errorf("unable to encode otlp metrics. %v", err)
+	}
+	resp, err := o.client.Post(o.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("unable to send otlp metrics to %s. %v", o.endpoint, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp receiver at %s returned %s", o.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// the subset of the OTLP/HTTP json encoding of ExportMetricsServiceRequest
+// that ravel sends
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          float64         `json:"asDouble"`
+}
+
+type otlpSum struct {
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name  string     `json:"name"`
+	Sum   *otlpSum   `json:"sum,omitempty"`
+	Gauge *otlpGauge `json:"gauge,omitempty"`
+}
+
+// otlpTemporalityDelta is AGGREGATION_TEMPORALITY_DELTA
+const otlpTemporalityDelta = 1
+
+func otlpAttributes(labels map[string]string) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(labels))
+	for _, label := range labelNames(labels) {
+		a := otlpAttribute{Key: label}
+		a.Value.StringValue = labels[label]
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+// otlpRequest builds the request body, with one metric per name in name order
+func otlpRequest(service string, sums, gauges map[string]*otlpSeries, start, now time.Time) map[string]interface{} {
+	startNano := strconv.FormatInt(start.UnixNano(), 10)
+	nowNano := strconv.FormatInt(now.UnixNano(), 10)
+
+	metrics := map[string]*otlpMetric{}
+	for _, s := range sums {
+		m, ok := metrics[s.name]
+		if !ok {
+			m = &otlpMetric{Name: s.name, Sum: &otlpSum{AggregationTemporality: otlpTemporalityDelta, IsMonotonic: true}}
+			metrics[s.name] = m
+		}
+		m.Sum.DataPoints = append(m.Sum.DataPoints, otlpDataPoint{Attributes: otlpAttributes(s.labels), StartTimeUnixNano: startNano, TimeUnixNano: nowNano, AsDouble: s.value})
+	}
+	for _, s := range gauges {
+		m, ok := metrics[s.name]
+		if !ok {
+			m = &otlpMetric{Name: s.name, Gauge: &otlpGauge{}}
+			metrics[s.name] = m
+		}
+		if m.Gauge == nil {
+			// a name used as both a counter and a gauge keeps the first kind seen
+			continue
+		}
+		m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpDataPoint{Attributes: otlpAttributes(s.labels), TimeUnixNano: nowNano, AsDouble: s.value})
+	}
+
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]*otlpMetric, 0, len(names))
+	for _, name := range names {
+		out = append(out, metrics[name])
+	}
+
+	return map[string]interface{}{
+		"resourceMetrics": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{"service.name": "ravel-" + service}),
+				},
+				"scopeMetrics": []interface{}{
+					map[string]interface{}{
+						"scope":   map[string]string{"name": "github.com/Comcast/Ravel/pkg/stats"},
+						"metrics": out,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,223 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The stats sinks that can be selected
+const (
+	SinkPrometheus = "prometheus"
+	SinkStatsd     = "statsd"
+	SinkOTLP       = "otlp"
+	SinkNone       = "none"
+)
+
+// MetricsSink receives the metrics ravel emits. Counters carry the increase since
+// the last call and gauges the current value. Flush is called once per stats
+// interval, after all of the metrics for the interval have been emitted.
+type MetricsSink interface {
+	Counter(name string, labels map[string]string, delta float64)
+	Gauge(name string, labels map[string]string, value float64)
+	Flush() error
+}
+
+// SinkConfig selects where metrics are sent
+type SinkConfig struct {
+	// Sinks are the names of the sinks, any of prometheus, statsd and otlp, or none
+	Sinks []string
+	// StatsdAddr is the host:port that statsd lines are sent to over udp
+	StatsdAddr string
+	// StatsdTagFormat is how labels are sent to statsd, any of dogstatsd,
+	// influxdb and none. StatsdTags, key=value, are added to every metric,
+	// i.e. the cluster, datacenter and role
+	StatsdTagFormat string
+	StatsdTags      []string
+	// OTLPEndpoint is the url of an OTLP/HTTP metrics receiver, i.e.
+	// http://otel-collector:4318/v1/metrics
+	OTLPEndpoint string
+}
+
+// Validate returns an error for unknown sinks and missing sink settings
+func (c SinkConfig) Validate() error {
+	if len(c.Sinks) == 0 {
+		return fmt.Errorf("at least one stats sink must be selected. use %s to disable metrics", SinkNone)
+	}
+	for _, name := range c.Sinks {
+		switch name {
+		case SinkPrometheus:
+		case SinkStatsd:
+			if c.StatsdAddr == "" {
+				return fmt.Errorf("the statsd sink requires an address")
+			}
+			switch c.StatsdTagFormat {
+			case "", StatsdTagsDogStatsD, StatsdTagsInfluxDB, StatsdTagsNone:
+			default:
+				return fmt.Errorf("unknown statsd tag format %q", c.StatsdTagFormat)
+			}
+			if _, err := ParseStatsdTags(c.StatsdTags); err != nil {
+				return err
+			}
+		case SinkOTLP:
+			if c.OTLPEndpoint == "" {
+				return fmt.Errorf("the otlp sink requires an endpoint")
+			}
+		case SinkNone:
+			if len(c.Sinks) > 1 {
+				return fmt.Errorf("the %s sink can't be combined with other sinks", SinkNone)
+			}
+		default:
+			return fmt.Errorf("unknown stats sink %q", name)
+		}
+	}
+	return nil
+}
+
+// has returns true when the sink called name is selected
+func (c SinkConfig) has(name string) bool {
+	for _, n := range c.Sinks {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sinks are the sinks built from a SinkConfig. flow receives the flow statistics
+// and goes to every sink. push holds the sinks other than prometheus, which the
+// prometheus registry is forwarded to, and is nil when there are none.
+type sinks struct {
+	flow  MetricsSink
+	push  MetricsSink
+	serve bool
+}
+
+func newSinks(c SinkConfig, kind LBKind) (*sinks, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	push := multiSink{}
+	if c.has(SinkStatsd) {
+		tags, _ := ParseStatsdTags(c.StatsdTags)
+		s, err := NewStatsdSink(c.StatsdAddr, c.StatsdTagFormat, tags)
+		if err != nil {
+			return nil, err
+		}
+		push = append(push, s)
+	}
+	if c.has(SinkOTLP) {
+		push = append(push, NewOTLPSink(c.OTLPEndpoint, string(kind)))
+	}
+
+	out := &sinks{serve: c.has(SinkPrometheus)}
+	flow := multiSink{}
+	if out.serve {
+		flow = append(flow, NewPrometheusSink())
+	}
+	flow = append(flow, push...)
+
+	out.flow = flow
+	if len(push) > 0 {
+		out.push = push
+	}
+	return out, nil
+}
+
+// multiSink fans metrics out to several sinks
+type multiSink []MetricsSink
+
+func (m multiSink) Counter(name string, labels map[string]string, delta float64) {
+	for _, s := range m {
+		s.Counter(name, labels, delta)
+	}
+}
+
+func (m multiSink) Gauge(name string, labels map[string]string, value float64) {
+	for _, s := range m {
+		s.Gauge(name, labels, value)
+	}
+}
+
+// Flush flushes every sink, even when some of them fail
+func (m multiSink) Flush() error {
+	errs := []string{}
+	for _, s := range m {
+		if err := s.Flush(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// prometheusSink registers a vector for each metric the first time it is seen
+// and serves it from the /metrics endpoint
+type prometheusSink struct {
+	sync.Mutex
+	counters map[string]*prometheus.CounterVec
+	gauges   map[string]*prometheus.GaugeVec
+}
+
+// NewPrometheusSink creates a sink that registers its metrics with the default
+// prometheus registry
+func NewPrometheusSink() MetricsSink {
+	return &prometheusSink{
+		counters: map[string]*prometheus.CounterVec{},
+		gauges:   map[string]*prometheus.GaugeVec{},
+	}
+}
+
+func (p *prometheusSink) Counter(name string, labels map[string]string, delta float64) {
+	p.Lock()
+	c, ok := p.counters[name]
+	if !ok {
+		c = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: metricHelp(name)}, labelNames(labels))
+		prometheus.MustRegister(c)
+		p.counters[name] = c
+	}
+	p.Unlock()
+	c.With(labels).Add(delta)
+}
+
+func (p *prometheusSink) Gauge(name string, labels map[string]string, value float64) {
+	p.Lock()
+	g, ok := p.gauges[name]
+	if !ok {
+		g = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: metricHelp(name)}, labelNames(labels))
+		prometheus.MustRegister(g)
+		p.gauges[name] = g
+	}
+	p.Unlock()
+	g.With(labels).Set(value)
+}
+
+// Flush does nothing. prometheus scrapes the sink.
+func (p *prometheusSink) Flush() error {
+	return nil
+}
+
+// labelNames returns the sorted names of labels
+func labelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// seriesKey identifies a metric and its label values
+func seriesKey(name string, labels map[string]string) string {
+	parts := []string{name}
+	for _, label := range labelNames(labels) {
+		parts = append(parts, label+"="+labels[label])
+	}
+	return strings.Join(parts, ",")
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
@@ -45,6 +46,11 @@ type Stats struct {
 	flowMetrics        *flowMetrics
 	flowMetricsEnabled bool
 
+	// sinks are where metrics are sent, and forwarder sends the prometheus
+	// registry to the sinks that don't scrape it
+	sinks     *sinks
+	forwarder *registryForwarder
+
 	ctx    context.Context
 	logger log.FieldLogger
 }
@@ -122,7 +128,15 @@ func (s *Stats) captureFlowStatistics() {
 	}
 }
 
-func NewStats(ctx context.Context, kind LBKind, device, statsHost, prometheusPort string, freq time.Duration, logger logrus.FieldLogger) (*Stats, error) {
+// NewStats creates the stats collector, sending metrics to the sinks selected
+// by sinkConfig. The prometheus endpoint is only served when the prometheus sink
+// is selected.
+func NewStats(ctx context.Context, kind LBKind, device, statsHost, prometheusPort string, freq time.Duration, sinkConfig SinkConfig, logger logrus.FieldLogger) (*Stats, error) {
+	sinks, err := newSinks(sinkConfig, kind)
+	if err != nil {
+		return nil, err
+	}
+
 	s := &Stats{
 		kind:   kind,
 		target: statsHost,
@@ -136,11 +150,21 @@ func NewStats(ctx context.Context, kind LBKind, device, statsHost, prometheusPor
 
 		prometheusPort: prometheusPort,
 
+		sinks: sinks,
+
 		ctx:    ctx,
 		logger: logger,
 	}
 
+	if sinks.push != nil {
+		s.forwarder = newRegistryForwarder(prometheus.DefaultGatherer, sinks.push, metricTx, metricRx, metricTcpState, metricFlows)
+	}
+
 	go s.run()
+	if !sinks.serve {
+		s.logger.Infof("prometheus sink not selected. not serving metrics on port %v", s.prometheusPort)
+		return s, nil
+	}
 	if err := s.startServer(); err != nil {
 		return nil, err
 	}
@@ -166,6 +190,7 @@ func (s *Stats) run() {
 			return
 		case <-s.interval.C:
 			s.captureFlowStatistics()
+			s.flush()
 		case newConfig := <-s.configChan:
 			// log.Debugln("new configuration inbound")
 			s.loadConfiguration(newConfig)
@@ -173,6 +198,19 @@ func (s *Stats) run() {
 	}
 }
 
+// flush forwards the prometheus registry to the sinks that don't scrape it and
+// flushes every sink
+func (s *Stats) flush() {
+	if s.forwarder != nil {
+		if err := s.forwarder.forward(); err != nil {
+			s.logger.Warnf("unable to gather metrics to forward. %v", err)
+		}
+	}
+	if err := s.sinks.flow.Flush(); err != nil {
+		s.logger.Warnf("unable to flush metrics. %v", err)
+	}
+}
+
 // loadConfiguration takes a ClusterConfig and populates a set of
 // VIP, Port tuples for use in the internal pcap capture mechanism
 func (s *Stats) loadConfiguration(c *types.ClusterConfig) error {
@@ -292,7 +330,7 @@ func (s *Stats) capture() {
 // initMetrics initialize the prometheus flowMetrics stats handlers + server
 func (s *Stats) initMetrics() error {
 	// initialize all the stats
-	s.flowMetrics = newFlowMetrics(s.kind)
+	s.flowMetrics = newFlowMetrics(s.kind, s.sinks.flow)
 	return nil
 }
 
@@ -4,6 +4,10 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestCounters(t *testing.T) {
@@ -22,12 +26,191 @@ func TestCounters(t *testing.T) {
 	}
 }
 
+func TestWatchHealth(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	h := NewWatchHealth("test", "zone", registry)
+	h.SetSynced("services", func() bool { return true })
+	h.SetSynced("nodes", func() bool { return false })
+
+	if !h.LastEvent("services").IsZero() {
+		t.Fatal("expected no event to be recorded for services")
+	}
+	h.Event("services")
+	if time.Since(h.LastEvent("services")) > time.Second {
+		t.Fatalf("expected a recent event for services. saw %v", h.LastEvent("services"))
+	}
+	h.Reconnect("nodes")
+	if h.Synced() {
+		t.Fatal("expected the health to be unsynced while nodes are unsynced")
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	h.Collect(ch)
+	close(ch)
+	if len(ch) != 4 {
+		t.Fatalf("expected an age and a synced metric per resource. saw %d metrics", len(ch))
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 3 {
+		t.Fatalf("expected the reconnects, age and synced metrics to be registered. saw %d", len(families))
+	}
+}
+
+func TestStage(t *testing.T) {
+	w := NewWorkerStateMetrics("stage-test", "zone")
+	stages := []string{StageParity, StageAddresses, StageIPVS}
+
+	// the vectors are shared by the process, so the observations are counted
+	// from what the stages already had
+	observed := func(stage string) uint64 {
+		m := &dto.Metric{}
+		if err := w.stageLatency.With(prometheus.Labels{"lb": "stage-test", "seczone": "zone", "stage": stage}).(prometheus.Metric).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+	before := map[string]uint64{}
+	for _, stage := range stages {
+		before[stage] = observed(stage)
+	}
+
+	w.Stage(StageParity, time.Millisecond)
+	w.Stage(StageAddresses, 2*time.Millisecond)
+	w.Stage(StageIPVS, 3*time.Millisecond)
+	w.Stage(StageIPVS, 4*time.Millisecond)
+
+	for stage, expected := range map[string]uint64{StageParity: 1, StageAddresses: 1, StageIPVS: 2} {
+		if n := observed(stage) - before[stage]; n != expected {
+			t.Errorf("expected %d observations of %s. saw %d", expected, stage, n)
+		}
+	}
+}
+
 func TestSetBPFFilter(t *testing.T) {
 	ips := []string{"1.2.3.4", "2.3.4.5"}
 	filters := strings.Join(ips, " or ")
 	fmt.Println(filters)
 }
 
+// recordingSink keeps the last value emitted for every series
+type recordingSink struct {
+	counters map[string]float64
+	gauges   map[string]float64
+	flushes  int
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{counters: map[string]float64{}, gauges: map[string]float64{}}
+}
+
+func (r *recordingSink) Counter(name string, labels map[string]string, delta float64) {
+	r.counters[seriesKey(name, labels)] += delta
+}
+func (r *recordingSink) Gauge(name string, labels map[string]string, value float64) {
+	r.gauges[seriesKey(name, labels)] = value
+}
+func (r *recordingSink) Flush() error {
+	r.flushes++
+	return nil
+}
+
+func TestSinkConfigValidate(t *testing.T) {
+	for _, c := range []struct {
+		config SinkConfig
+		valid  bool
+	}{
+		{SinkConfig{Sinks: []string{SinkPrometheus}}, true},
+		{SinkConfig{Sinks: []string{SinkPrometheus, SinkStatsd}, StatsdAddr: "127.0.0.1:8125"}, true},
+		{SinkConfig{Sinks: []string{SinkOTLP}, OTLPEndpoint: "http://127.0.0.1:4318/v1/metrics"}, true},
+		{SinkConfig{Sinks: []string{SinkNone}}, true},
+		{SinkConfig{}, false},
+		{SinkConfig{Sinks: []string{SinkStatsd}}, false},
+		{SinkConfig{Sinks: []string{SinkOTLP}}, false},
+		{SinkConfig{Sinks: []string{SinkNone, SinkPrometheus}}, false},
+		{SinkConfig{Sinks: []string{"graphite"}}, false},
+	} {
+		if err := c.config.Validate(); (err == nil) != c.valid {
+			t.Errorf("expected %+v valid=%v. saw %v", c.config, c.valid, err)
+		}
+	}
+}
+
+func TestStatsdFormat(t *testing.T) {
+	labels := map[string]string{"vip": "10.54.213.165", "lb": "director"}
+	line := statsdLine(StatsdTagsDogStatsD, "rdei_lb_rx_bytes", labels, 1024, "c")
+	if line != "rdei_lb_rx_bytes:1024|c|#lb:director,vip:10.54.213.165" {
+		t.Fatalf("unexpected statsd line %q", line)
+	}
+	if line := statsdLine(StatsdTagsDogStatsD, "rdei_lb_config_frozen", nil, 0.5, "g"); line != "rdei_lb_config_frozen:0.5|g" {
+		t.Fatalf("unexpected statsd line %q", line)
+	}
+	line = statsdLine(StatsdTagsInfluxDB, "rdei_lb_rx_bytes", map[string]string{"vip": "2001:db8::10", "lb": "director"}, 1024, "c")
+	if line != "rdei_lb_rx_bytes,lb=director,vip=2001_db8__10:1024|c" {
+		t.Fatalf("unexpected influxdb line %q", line)
+	}
+	if line := statsdLine(StatsdTagsNone, "rdei_lb_rx_bytes", labels, 1024, "c"); line != "rdei_lb_rx_bytes:1024|c" {
+		t.Fatalf("unexpected untagged line %q", line)
+	}
+
+	// global tags are added to every metric, and lose to its labels
+	tags, err := ParseStatsdTags([]string{"cluster=ho-1", "role=edge", "lb=ignored"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &statsdSink{format: StatsdTagsDogStatsD, tags: tags}
+	s.Counter("rdei_lb_rx_bytes", labels, 1)
+	if s.lines[0] != "rdei_lb_rx_bytes:1|c|#cluster:ho-1,lb:director,role:edge,vip:10.54.213.165" {
+		t.Fatalf("unexpected tagged line %q", s.lines[0])
+	}
+	if _, err := ParseStatsdTags([]string{"cluster"}); err == nil {
+		t.Fatal("expected a tag without a value to be refused")
+	}
+
+	packets := statsdPackets([]string{"a:1|c", "b:1|c", "c:1|c"}, 11)
+	if len(packets) != 2 || packets[0] != "a:1|c\nb:1|c" || packets[1] != "c:1|c" {
+		t.Fatalf("unexpected statsd packets %q", packets)
+	}
+}
+
+func TestRegistryForwarder(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_count", Help: "test"}, []string{"lb"})
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "test"}, []string{"lb"})
+	skipped := prometheus.NewCounterVec(prometheus.CounterOpts{Name: metricRx, Help: "test"}, []string{"lb"})
+	registry.MustRegister(counter, gauge, skipped)
+
+	sink := newRecordingSink()
+	var flow MetricsSink = multiSink{sink}
+	f := newRegistryForwarder(registry, flow, metricRx)
+
+	counter.With(prometheus.Labels{"lb": "director"}).Add(3)
+	gauge.With(prometheus.Labels{"lb": "director"}).Set(7)
+	skipped.With(prometheus.Labels{"lb": "director"}).Add(1)
+	if err := f.forward(); err != nil {
+		t.Fatal(err)
+	}
+	counter.With(prometheus.Labels{"lb": "director"}).Add(2)
+	if err := f.forward(); err != nil {
+		t.Fatal(err)
+	}
+	if err := flow.Flush(); err != nil || sink.flushes != 1 {
+		t.Fatalf("expected the sink to be flushed once. saw %d %v", sink.flushes, err)
+	}
+
+	if v := sink.counters["test_count,lb=director"]; v != 5 {
+		t.Fatalf("expected the counter increases to add up to 5. saw %v", v)
+	}
+	if v := sink.gauges["test_gauge,lb=director"]; v != 7 {
+		t.Fatalf("expected the gauge to be 7. saw %v", v)
+	}
+	if _, ok := sink.counters[metricRx+",lb=director"]; ok {
+		t.Fatal("expected the skipped metric not to be forwarded")
+	}
+}
+
 // doing nothing takes .29ns/op
 // mutex lock/unlock takes 5.4ns/op
 // atomic addition takes 5.4ns/op
@@ -0,0 +1,159 @@
+package stats
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxStatsdPacket keeps statsd datagrams under a typical ethernet MTU
+const maxStatsdPacket = 1432
+
+// The formats the statsd sink sends labels in
+const (
+	// StatsdTagsDogStatsD sends labels as DogStatsD tags, i.e.
+	// rdei_lb_rx_bytes:1024|c|#lb:director,vip:10.54.213.165
+	StatsdTagsDogStatsD = "dogstatsd"
+	// StatsdTagsInfluxDB sends labels in the name as the statsd input of
+	// telegraf reads them, i.e. rdei_lb_rx_bytes,lb=director,vip=10.54.213.165:1024|c
+	StatsdTagsInfluxDB = "influxdb"
+	// StatsdTagsNone drops labels, for statsd servers that take no tags
+	StatsdTagsNone = "none"
+)
+
+// statsdSink sends metrics to statsd over udp, with their labels and the
+// global tags in format
+type statsdSink struct {
+	sync.Mutex
+	conn   net.Conn
+	format string
+	tags   map[string]string
+	lines  []string
+}
+
+// NewStatsdSink creates a sink that sends metrics to the statsd server at addr.
+// tags are added to the labels of every metric, which win when they share a name.
+func NewStatsdSink(addr, format string, tags map[string]string) (MetricsSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to statsd at %s. %v", addr, err)
+	}
+	if format == "" {
+		format = StatsdTagsDogStatsD
+	}
+	return &statsdSink{conn: conn, format: format, tags: tags}, nil
+}
+
+func (s *statsdSink) Counter(name string, labels map[string]string, delta float64) {
+	s.add(statsdLine(s.format, name, s.tagged(labels), delta, "c"))
+}
+
+func (s *statsdSink) Gauge(name string, labels map[string]string, value float64) {
+	s.add(statsdLine(s.format, name, s.tagged(labels), value, "g"))
+}
+
+// tagged returns labels with the global tags added
+func (s *statsdSink) tagged(labels map[string]string) map[string]string {
+	if len(s.tags) == 0 {
+		return labels
+	}
+	out := make(map[string]string, len(s.tags)+len(labels))
+	for k, v := range s.tags {
+		out[k] = v
+	}
+	for k, v := range labels {
+		out[k] = v
+	}
+	return out
+}
+
+func (s *statsdSink) add(line string) {
+	s.Lock()
+	defer s.Unlock()
+	s.lines = append(s.lines, line)
+}
+
+// Flush sends the lines collected since the last flush, packing as many into
+// each datagram as fit
+func (s *statsdSink) Flush() error {
+	s.Lock()
+	lines := s.lines
+	s.lines = nil
+	s.Unlock()
+
+	for _, packet := range statsdPackets(lines, maxStatsdPacket) {
+		if _, err := s.conn.Write([]byte(packet)); err != nil {
+			return fmt.Errorf("unable to send metrics to statsd. %v", err)
+		}
+	}
+	return nil
+}
+
+// statsdTagValue replaces the characters that end a tag in each format. VIPs
+// are v6 addresses as often as not, so the colons of the influxdb format,
+// which end the name, are replaced too.
+var statsdTagValue = map[string]*strings.Replacer{
+	StatsdTagsDogStatsD: strings.NewReplacer(",", "_", "|", "_", "#", "_"),
+	StatsdTagsInfluxDB:  strings.NewReplacer(",", "_", "|", "_", "=", "_", ":", "_", " ", "_"),
+}
+
+// statsdLine formats a single statsd line of kind c or g, with labels in format
+func statsdLine(format, name string, labels map[string]string, value float64, kind string) string {
+	sample := ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind
+	if len(labels) == 0 || format == StatsdTagsNone {
+		return name + sample
+	}
+	replacer := statsdTagValue[format]
+	tags := make([]string, 0, len(labels))
+	switch format {
+	case StatsdTagsInfluxDB:
+		for _, label := range labelNames(labels) {
+			tags = append(tags, replacer.Replace(label)+"="+replacer.Replace(labels[label]))
+		}
+		return name + "," + strings.Join(tags, ",") + sample
+	default:
+		for _, label := range labelNames(labels) {
+			tags = append(tags, replacer.Replace(label)+":"+replacer.Replace(labels[label]))
+		}
+		return name + sample + "|#" + strings.Join(tags, ",")
+	}
+}
+
+// ParseStatsdTags parses tags given as key=value
+func ParseStatsdTags(tags []string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, tag := range tags {
+		if tag == "" {
+			continue
+		}
+		spl := strings.SplitN(tag, "=", 2)
+		if len(spl) != 2 || spl[0] == "" || spl[1] == "" {
+			return nil, fmt.Errorf("statsd tag %q must be in the format key=value", tag)
+		}
+		out[spl[0]] = spl[1]
+	}
+	return out, nil
+}
+
+// statsdPackets joins lines with newlines into packets of at most max bytes. A
+// line longer than max is sent on its own.
+func statsdPackets(lines []string, max int) []string {
+	packets := []string{}
+	packet := ""
+	for _, line := range lines {
+		if packet != "" && len(packet)+1+len(line) > max {
+			packets = append(packets, packet)
+			packet = ""
+		}
+		if packet != "" {
+			packet += "\n"
+		}
+		packet += line
+	}
+	if packet != "" {
+		packets = append(packets, packet)
+	}
+	return packets
+}
@@ -0,0 +1,153 @@
+package stats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WatchHealth reports how fresh the kubernetes data behind a worker is. Event
+// ages and informer sync status are computed at scrape time, so they keep
+// growing when the api server goes quiet rather than freezing at their last value.
+type WatchHealth struct {
+	sync.Mutex
+
+	kind    string
+	secZone string
+	started time.Time
+
+	lastEvent map[string]time.Time
+	synced    map[string]func() bool
+
+	reconnects *prometheus.CounterVec
+	ageDesc    *prometheus.Desc
+	syncedDesc *prometheus.Desc
+}
+
+// NewWatchHealth creates the watch health metrics and registers them with
+// registerer, which is prometheus.DefaultRegisterer outside of tests
+func NewWatchHealth(kind, secZone string, registerer prometheus.Registerer) *WatchHealth {
+	labels := []string{"lb", "seczone", "resource"}
+
+	// counter watch_reconnect_count
+	reconnects := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "watch_reconnect_count",
+		Help: "is a count of watch restarts, broken out by the resource whose watch closed or failed",
+	}, labels)
+
+	h := &WatchHealth{
+		kind:      kind,
+		secZone:   secZone,
+		started:   time.Now(),
+		lastEvent: map[string]time.Time{},
+		synced:    map[string]func() bool{},
+
+		reconnects: reconnects,
+
+		// gauge watch_last_event_age_seconds
+		ageDesc: prometheus.NewDesc(Prefix+"watch_last_event_age_seconds",
+			"is the number of seconds since the last event was received for a resource, or since startup if none has been. a growing value means the worker is acting on stale data",
+			labels, nil),
+
+		// gauge watch_informer_synced
+		syncedDesc: prometheus.NewDesc(Prefix+"watch_informer_synced",
+			"is 1 when the informer cache for a resource has completed its initial list, 0 otherwise",
+			labels, nil),
+	}
+
+	registerer.MustRegister(reconnects, h)
+	return h
+}
+
+// Event records a successful watch event for resource
+func (h *WatchHealth) Event(resource string) {
+	h.Lock()
+	defer h.Unlock()
+	h.lastEvent[resource] = time.Now()
+}
+
+// LastEvent returns the time of the last event for resource, or the zero time if none was seen
+func (h *WatchHealth) LastEvent(resource string) time.Time {
+	h.Lock()
+	defer h.Unlock()
+	return h.lastEvent[resource]
+}
+
+// Latest returns the time of the last event for any resource, or the time the
+// health was created if no event was seen
+func (h *WatchHealth) Latest() time.Time {
+	h.Lock()
+	defer h.Unlock()
+	latest := h.started
+	for _, last := range h.lastEvent {
+		if last.After(latest) {
+			latest = last
+		}
+	}
+	return latest
+}
+
+// Reconnect records that the watch for resource was restarted
+func (h *WatchHealth) Reconnect(resource string) {
+	h.reconnects.With(prometheus.Labels{"lb": h.kind, "seczone": h.secZone, "resource": resource}).Add(1)
+}
+
+// SetSynced registers the HasSynced function of the informer behind resource,
+// replacing any earlier one when the watch is restarted
+func (h *WatchHealth) SetSynced(resource string, hasSynced func() bool) {
+	h.Lock()
+	defer h.Unlock()
+	h.synced[resource] = hasSynced
+}
+
+// Unsynced forgets every registered informer, as when their watches are
+// stopped, so that Synced is false until the informers replacing them register
+// and sync
+func (h *WatchHealth) Unsynced() {
+	h.Lock()
+	defer h.Unlock()
+	h.synced = map[string]func() bool{}
+}
+
+// Synced returns true when every registered informer has synced
+func (h *WatchHealth) Synced() bool {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.synced) == 0 {
+		return false
+	}
+	for _, hasSynced := range h.synced {
+		if !hasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// Describe implements prometheus.Collector
+func (h *WatchHealth) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.ageDesc
+	ch <- h.syncedDesc
+}
+
+// Collect implements prometheus.Collector
+func (h *WatchHealth) Collect(ch chan<- prometheus.Metric) {
+	h.Lock()
+	defer h.Unlock()
+
+	now := time.Now()
+	for resource, hasSynced := range h.synced {
+		last, ok := h.lastEvent[resource]
+		if !ok {
+			last = h.started
+		}
+		ch <- prometheus.MustNewConstMetric(h.ageDesc, prometheus.GaugeValue, now.Sub(last).Seconds(), h.kind, h.secZone, resource)
+
+		synced := 0.0
+		if hasSynced() {
+			synced = 1
+		}
+		ch <- prometheus.MustNewConstMetric(h.syncedDesc, prometheus.GaugeValue, synced, h.kind, h.secZone, resource)
+	}
+}
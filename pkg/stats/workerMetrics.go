@@ -2,6 +2,7 @@ package stats
 
 import (
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -13,6 +14,8 @@ type WorkerStateMetrics struct {
 
 	reconfigure        *prometheus.CounterVec
 	reconfigureLatency *prometheus.HistogramVec
+	stageLatency       *prometheus.HistogramVec
+	convergence        *prometheus.HistogramVec
 	queueDepth         *prometheus.GaugeVec
 	nodeUpdate         *prometheus.CounterVec
 	configUpdate       *prometheus.CounterVec
@@ -28,6 +31,36 @@ type WorkerStateMetrics struct {
 	loopbackTotalConfigured *prometheus.GaugeVec
 	loopbackConfigHealthy   *prometheus.GaugeVec
 	iptablesWriteFail       *prometheus.GaugeVec
+	appliedGeneration       *prometheus.GaugeVec
+	portConflicts           *prometheus.GaugeVec
+	probeReachable          *prometheus.GaugeVec
+	configFrozen            *prometheus.GaugeVec
+	standby                 *prometheus.GaugeVec
+	advertisedVIPs          *prometheus.GaugeVec
+	removalsDeferred        *prometheus.GaugeVec
+	removalsDeferredCount   *prometheus.CounterVec
+	shrinkRefused           *prometheus.GaugeVec
+	applyDivergent          *prometheus.GaugeVec
+	applyRetries            *prometheus.CounterVec
+	subsystemRestarts       *prometheus.CounterVec
+	subsystemFailures       *prometheus.GaugeVec
+	reconcilePanics         *prometheus.CounterVec
+	reconcileErrors         *prometheus.CounterVec
+	applyBreakerOpen        *prometheus.GaugeVec
+	kernelTampered          *prometheus.CounterVec
+	linkRepairs             *prometheus.CounterVec
+	parityRepairs           *prometheus.CounterVec
+	reconcileSkipped        *prometheus.CounterVec
+	reconcileOverBudget     *prometheus.CounterVec
+	dataPlaneObjects        *prometheus.GaugeVec
+	backendSaturated        *prometheus.GaugeVec
+	backendEjected          *prometheus.GaugeVec
+	lastBackendGuarded      *prometheus.GaugeVec
+	nodeDraining            *prometheus.GaugeVec
+	flowRecords             *prometheus.CounterVec
+	announcements           *prometheus.CounterVec
+	mtuMismatches           *prometheus.GaugeVec
+	addressConflicts        *prometheus.CounterVec
 }
 
 // Reconfigure is the end-to-end reconfiguration event.
@@ -39,6 +72,30 @@ func (w *WorkerStateMetrics) Reconfigure(outcome string, d time.Duration) {
 	w.reconfigureLatency.With(labels).Observe(float64(d.Nanoseconds() / 1000))
 }
 
+// The stages of a reconcile that are timed separately
+const (
+	StageParity           = "parity_check"
+	StageAddresses        = "address_set"
+	StageIPTablesSave     = "iptables_save"
+	StageIPTablesGenerate = "iptables_generate"
+	StageIPTablesMerge    = "iptables_merge"
+	StageIPTablesRestore  = "iptables_restore"
+	StageIPVS             = "ipvs_set"
+)
+
+// Stage is the time taken by one stage of a reconcile, whatever its outcome
+// bucket reconcile_stage_latency_microseconds
+func (w *WorkerStateMetrics) Stage(stage string, d time.Duration) {
+	w.stageLatency.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "stage": stage}).Observe(float64(d.Nanoseconds() / 1000))
+}
+
+// Converged is the time from a change to endpoints to the reconcile that landed
+// it in the kernel
+// bucket convergence_latency_seconds
+func (w *WorkerStateMetrics) Converged(d time.Duration) {
+	w.convergence.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone}).Observe(d.Seconds())
+}
+
 // QueueDepth is the depth of the configuration channel
 // gauge config_chan_depth
 func (w *WorkerStateMetrics) QueueDepth(depth int) {
@@ -81,6 +138,264 @@ func (w *WorkerStateMetrics) IptablesWriteFailure(status int) {
 	w.iptablesWriteFail.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "addrKind": ""}).Set(float64(status))
 }
 
+// AppliedGeneration is the generation of the cluster config last applied successfully
+// gauge applied_config_generation
+func (w *WorkerStateMetrics) AppliedGeneration(generation uint64) {
+	w.appliedGeneration.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone}).Set(float64(generation))
+}
+
+// PortConflicts is the number of VIP ports that conflict with the node, withheld or only reported
+// gauge port_conflicts
+func (w *WorkerStateMetrics) PortConflicts(reason string, conflicts int) {
+	w.portConflicts.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "reason": reason}).Set(float64(conflicts))
+}
+
+// MTUMismatches is the number of VIP devices left without the MTU they are configured with
+// gauge mtu_mismatches
+func (w *WorkerStateMetrics) MTUMismatches(reason string, devices int) {
+	w.mtuMismatches.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "reason": reason}).Set(float64(devices))
+}
+
+// AddressConflict records a VIP withheld because another host answered a probe for it
+// counter address_conflict_count
+func (w *WorkerStateMetrics) AddressConflict(vip string) {
+	w.addressConflicts.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "vip": vip}).Add(1)
+}
+
+// ProbeReachable records whether the last probe of a VIP port through the local rules succeeded
+// gauge probe_reachable
+func (w *WorkerStateMetrics) ProbeReachable(vip, port, service string, reachable bool) {
+	v := 0.0
+	if reachable {
+		v = 1
+	}
+	w.probeReachable.With(w.probeLabels(vip, port, service)).Set(v)
+}
+
+// ProbeRemoved drops the probe result of a VIP port that is no longer probed
+func (w *WorkerStateMetrics) ProbeRemoved(vip, port, service string) {
+	w.probeReachable.Delete(w.probeLabels(vip, port, service))
+}
+
+// ConfigFrozen records whether a freeze window is holding back configuration changes
+// gauge config_frozen
+func (w *WorkerStateMetrics) ConfigFrozen(frozen bool) {
+	v := 0.0
+	if frozen {
+		v = 1
+	}
+	w.configFrozen.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone}).Set(v)
+}
+
+// Standby records whether the director is a warm standby, with its routes
+// withdrawn until it is promoted
+// gauge director_standby
+func (w *WorkerStateMetrics) Standby(standby bool) {
+	v := 0.0
+	if standby {
+		v = 1
+	}
+	w.standby.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone}).Set(v)
+}
+
+// AdvertisedVIPs is the number of VIPs of a family the director advertised at
+// its last apply, its shard of them when the VIPs are divided across directors
+// gauge bgp_advertised_vips
+func (w *WorkerStateMetrics) AdvertisedVIPs(addrKind string, n int) {
+	w.advertisedVIPs.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "addrKind": addrKind}).Set(float64(n))
+}
+
+// DataPlaneObjects is the number of objects - services, backends or
+// addresses - a data plane was serving after the last apply
+// gauge dataplane_objects
+func (w *WorkerStateMetrics) DataPlaneObjects(dataplane, object string, n int) {
+	w.dataPlaneObjects.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "dataplane": dataplane, "object": object}).Set(float64(n))
+}
+
+// BackendSaturated records whether the saturation guard has quiesced backend
+// for having too many active connections
+// gauge backend_saturated
+func (w *WorkerStateMetrics) BackendSaturated(backend string, saturated bool) {
+	v := 0.0
+	if saturated {
+		v = 1
+	}
+	w.backendSaturated.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "backend": backend}).Set(v)
+}
+
+// BackendEjected records whether passive ejection has taken backend, an
+// address and port, out of service for failing its connections
+// gauge backend_ejected
+func (w *WorkerStateMetrics) BackendEjected(backend string, ejected bool) {
+	v := 0.0
+	if ejected {
+		v = 1
+	}
+	w.backendEjected.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "backend": backend}).Set(v)
+}
+
+// LastBackendGuarded records whether a change leaves service, an ipvs virtual
+// service, without a healthy backend, and the last backend guard's policy
+// alerts on or blocks it
+// gauge last_backend_guarded
+func (w *WorkerStateMetrics) LastBackendGuarded(service, policy string, guarded bool) {
+	v := 0.0
+	if guarded {
+		v = 1
+	}
+	w.lastBackendGuarded.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "service": service, "policy": policy}).Set(v)
+}
+
+// NodeDraining records whether node is cordoned or annotated to drain, and so
+// has its weight ramped down
+// gauge node_draining
+func (w *WorkerStateMetrics) NodeDraining(node string, draining bool) {
+	v := 0.0
+	if draining {
+		v = 1
+	}
+	w.nodeDraining.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "node": node}).Set(v)
+}
+
+// FlowsExported records an export of flow records to the collector, the
+// records sent or the error that stopped the export
+// counter flow_records_count
+func (w *WorkerStateMetrics) FlowsExported(records int, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	w.flowRecords.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "outcome": outcome}).Add(float64(records))
+}
+
+// Announced records an announcement of vip with strategy, and whether it
+// could be sent
+// counter announce_count
+func (w *WorkerStateMetrics) Announced(strategy, vip string, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	w.announcements.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "strategy": strategy, "vip": vip, "outcome": outcome}).Add(1)
+}
+
+// RemovalsDeferred is the number of backend removals held back by the removal budget
+// in the last reconcile
+// gauge ipvs_removals_deferred
+// counter ipvs_removals_deferred_count
+func (w *WorkerStateMetrics) RemovalsDeferred(deferred int) {
+	labels := prometheus.Labels{"lb": w.kind, "seczone": w.secZone}
+	w.removalsDeferred.With(labels).Set(float64(deferred))
+	w.removalsDeferredCount.With(labels).Add(float64(deferred))
+}
+
+// ShrinkRefused records whether the shrink guard is refusing a change to what,
+// either the config or the backends
+// gauge shrink_refused
+func (w *WorkerStateMetrics) ShrinkRefused(what string, refused bool) {
+	v := 0.0
+	if refused {
+		v = 1
+	}
+	w.shrinkRefused.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "what": what}).Set(v)
+}
+
+// ApplyVerified records the read back after applying what, either iptables or
+// ipvs-ipv4|ipvs-ipv6: the rules retried and the rules still not reflected by the kernel
+// gauge apply_divergent_rules
+// counter apply_retry_count
+func (w *WorkerStateMetrics) ApplyVerified(what string, retried, divergent int) {
+	labels := prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "what": what}
+	w.applyDivergent.With(labels).Set(float64(divergent))
+	w.applyRetries.With(labels).Add(float64(retried))
+}
+
+// SubsystemFailed records a failure of a supervised subsystem, such as the
+// periodic apply loop or the watch sync, and its restart. failures is the number
+// of consecutive failures, and is set back to 0 by SubsystemHealthy.
+// counter subsystem_restart_count
+// gauge subsystem_consecutive_failures
+func (w *WorkerStateMetrics) SubsystemFailed(subsystem string, failures int) {
+	labels := prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "subsystem": subsystem}
+	w.subsystemRestarts.With(labels).Add(1)
+	w.subsystemFailures.With(labels).Set(float64(failures))
+}
+
+// SubsystemHealthy clears the consecutive failures of subsystem
+func (w *WorkerStateMetrics) SubsystemHealthy(subsystem string) {
+	w.subsystemFailures.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "subsystem": subsystem}).Set(0)
+}
+
+// ReconcilePanic records a reconcile that panicked and was recovered
+// counter reconcile_panic_count
+func (w *WorkerStateMetrics) ReconcilePanic() {
+	w.reconcilePanics.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone}).Add(1)
+}
+
+// ReconcileError records a reconcile that failed with an error of class, see
+// util.ErrorClass
+// counter reconcile_error_count
+func (w *WorkerStateMetrics) ReconcileError(class string) {
+	w.reconcileErrors.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "class": class}).Add(1)
+}
+
+// ApplyBreakerOpen records whether applies have failed so many times in a row
+// that they are retried with backoff rather than on every tick
+// gauge apply_breaker_open
+func (w *WorkerStateMetrics) ApplyBreakerOpen(open bool) {
+	v := 0.0
+	if open {
+		v = 1
+	}
+	w.applyBreakerOpen.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone}).Set(v)
+}
+
+// KernelTampered records a change to what, either iptables or ipvs, that was
+// made to the kernel state ravel owns outside of ravel
+// counter kernel_tamper_count
+func (w *WorkerStateMetrics) KernelTampered(what string) {
+	w.kernelTampered.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "what": what}).Add(1)
+}
+
+// LinkRepair records a reconcile started at once because of a change to the
+// links or addresses of the node, by the change: address-removed, link-up or
+// overrun
+// counter link_repair_count
+func (w *WorkerStateMetrics) LinkRepair(change string) {
+	w.linkRepairs.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "change": change}).Add(1)
+}
+
+// ParityRepair records the repair of a part of the kernel state a realserver
+// keeps that drifted from the config, by what: chains, sysctls or vips, and
+// whether it could be repaired
+// counter parity_repair_count
+func (w *WorkerStateMetrics) ParityRepair(what string, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	w.parityRepairs.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "what": what, "outcome": outcome}).Add(1)
+}
+
+// ReconcileSkipped records a reconcile that wasn't run for reason: running,
+// as another was still running, or overlap, as its tick came while the last
+// reconcile ran
+// counter reconcile_skipped_count
+func (w *WorkerStateMetrics) ReconcileSkipped(reason string) {
+	w.reconcileSkipped.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "reason": reason}).Add(1)
+}
+
+// ReconcileOverBudget records a stage of a reconcile that ran past its budget
+// and had its commands killed
+// counter reconcile_over_budget_count
+func (w *WorkerStateMetrics) ReconcileOverBudget(stage string) {
+	w.reconcileOverBudget.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "stage": stage}).Add(1)
+}
+
+func (w *WorkerStateMetrics) probeLabels(vip, port, service string) prometheus.Labels {
+	return prometheus.Labels{"lb": w.kind, "seczone": w.secZone, "vip": vip, "port": port, "service": service}
+}
+
 // ArpingFailure switch on what type of metric we should increment
 func (w *WorkerStateMetrics) ArpingFailure(err error) {
 	switch {
@@ -111,7 +426,29 @@ func (w *WorkerStateMetrics) arpingUnknownFail() {
 	w.arpingFailUnknown.With(prometheus.Labels{"lb": w.kind, "seczone": w.secZone}).Add(float64(1))
 }
 
+// the worker metric vectors are shared by every WorkerStateMetrics so that more than
+// one worker can run in a process without registering the same collectors twice.
+var (
+	workerVecsOnce sync.Once
+	workerVecs     *WorkerStateMetrics
+)
+
 func NewWorkerStateMetrics(kind, secZone string) *WorkerStateMetrics {
+	workerVecsOnce.Do(func() { workerVecs = newWorkerStateVecs() })
+
+	w := *workerVecs
+	w.kind = kind
+	w.secZone = secZone
+
+	// init error counters to 0
+	w.arpingDupIP.With(prometheus.Labels{"lb": kind, "seczone": secZone})
+	w.arpingIFDown.With(prometheus.Labels{"lb": kind, "seczone": secZone})
+	w.arpingFailUnknown.With(prometheus.Labels{"lb": kind, "seczone": secZone})
+
+	return &w
+}
+
+func newWorkerStateVecs() *WorkerStateMetrics {
 
 	defaultLabels := []string{"lb", "seczone"}
 	lvsLabels := []string{"lb", "seczone", "addrKind"}
@@ -130,6 +467,20 @@ func NewWorkerStateMetrics(kind, secZone string) *WorkerStateMetrics {
 		Buckets: LatencyBuckets,
 	}, reconfigLabels)
 
+	// histogram reconcile_stage_latency
+	stage_bucket := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    Prefix + "reconcile_stage_latency_microseconds",
+		Help:    "is a histogram denoting the amount of time each stage of a reconfiguration took, split out by labels on the stage. stages are parity_check|address_set|iptables_save|iptables_generate|iptables_merge|iptables_restore|ipvs_set",
+		Buckets: LatencyBuckets,
+	}, append(defaultLabels, "stage"))
+
+	// histogram convergence_latency_seconds
+	convergence_bucket := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    Prefix + "convergence_latency_seconds",
+		Help:    "is a histogram denoting the time from a change to kubernetes endpoints, as the endpoints controller recorded it, to the reconcile that landed it in the kernel",
+		Buckets: ConvergenceBuckets,
+	}, defaultLabels)
+
 	// gauge channel_depth
 	channel_depth := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: Prefix + "channel_depth",
@@ -208,9 +559,181 @@ func NewWorkerStateMetrics(kind, secZone string) *WorkerStateMetrics {
 		Help: "is a gauge indicating if we failed to write to iptables",
 	}, lvsLabels)
 
+	// applied config generation
+	applied_generation := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "applied_config_generation",
+		Help: "is the generation of the cluster config last applied by the worker. compare with watch_cluster_config_generation to find workers that are behind",
+	}, defaultLabels)
+
+	// VIP ports that conflict with the node
+	port_conflicts := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "port_conflicts",
+		Help: "is a gauge of VIP ports that a host process listens on or that are in the nodePort range, labeled by reason. they are not forwarded with --port-conflict-withhold",
+	}, append(defaultLabels, "reason"))
+
+	// VIP devices without their MTU
+	mtu_mismatches := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "mtu_mismatches",
+		Help: "is a gauge of VIP devices whose MTU differs from the one configured, labeled by reason: invalid, exceeds-parent or apply-failed",
+	}, append(defaultLabels, "reason"))
+
+	// VIPs another host answers for
+	address_conflict_count := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "address_conflict_count",
+		Help: "is a count of the times a VIP was not added because another host answered an arp probe for it",
+	}, append(defaultLabels, "vip"))
+
+	// reachability of VIP ports through the local rules
+	probe_reachable := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "probe_reachable",
+		Help: "is a gauge that is 1 when the last probe of a VIP port through this node's own rules connected to a pod, and 0 when it failed",
+	}, append(defaultLabels, "vip", "port", "service"))
+
+	// freeze windows
+	config_frozen := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "config_frozen",
+		Help: "is a gauge that is 1 while a freeze window holds back every configuration change except removals",
+	}, defaultLabels)
+
+	// warm standby
+	director_standby := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "director_standby",
+		Help: "is a gauge that is 1 while the director is a warm standby, with its rules applied and its routes withdrawn",
+	}, defaultLabels)
+
+	// director pool
+	advertised_vips := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "bgp_advertised_vips",
+		Help: "is a gauge of the VIPs the director advertised at its last apply, by address family",
+	}, append(defaultLabels, "addrKind"))
+
+	// removal budget
+	removals_deferred := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "ipvs_removals_deferred",
+		Help: "is a gauge of the ipvs backend removals held back by the removal budget in the last reconcile. a value that stays above 0 means backends are being drained in batches",
+	}, defaultLabels)
+	removals_deferred_count := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "ipvs_removals_deferred_count",
+		Help: "is a count of ipvs backend removals held back by the removal budget",
+	}, defaultLabels)
+
+	// shrink guard
+	shrink_refused := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "shrink_refused",
+		Help: "is a gauge that is 1 while the shrink guard refuses a change that removes too many VIP ports (what=config) or ipvs backends (what=backends-ipv4|backends-ipv6). annotate the configmap with ravel.comcast.com/allow-shrink=true to let it through",
+	}, append(defaultLabels, "what"))
+
+	// post-apply verification
+	apply_divergent := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "apply_divergent_rules",
+		Help: "is a gauge of the rules that the kernel did not reflect when read back after the last apply and its retries. labels for what iptables|ipvs-ipv4|ipvs-ipv6",
+	}, append(defaultLabels, "what"))
+	apply_retry_count := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "apply_retry_count",
+		Help: "is a count of rules applied again because they were missing when read back",
+	}, append(defaultLabels, "what"))
+
+	// supervision
+	subsystem_restart_count := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "subsystem_restart_count",
+		Help: "is a count of supervised subsystems restarted after a fatal error. labels for subsystem, the director goroutine: periodic|watches|arps|causePeriodicWatcherSync",
+	}, append(defaultLabels, "subsystem"))
+	subsystem_consecutive_failures := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "subsystem_consecutive_failures",
+		Help: "is a gauge of the consecutive fatal errors of a supervised subsystem. it is 0 once the subsystem runs cleanly again",
+	}, append(defaultLabels, "subsystem"))
+	reconcile_panic_count := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "reconcile_panic_count",
+		Help: "is a count of reconciles that panicked. the kernel state is left as the panic found it and the node reports unhealthy until a reconcile succeeds",
+	}, defaultLabels)
+	reconcile_error_count := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "reconcile_error_count",
+		Help: "is a count of reconciles that failed. labels for class, transient|kernel_apply|config_invalid|unknown, which decides whether the reconcile is retried",
+	}, append(defaultLabels, "class"))
+
+	// gauge apply_breaker_open
+	apply_breaker_open := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "apply_breaker_open",
+		Help: "is a gauge indicating that applies have failed so many times in a row that they are retried with backoff rather than on every tick",
+	}, defaultLabels)
+
+	// counter kernel_tamper_count
+	kernel_tamper_count := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "kernel_tamper_count",
+		Help: "is a count of the changes the watchdog found to the kernel state ravel owns that were made outside of ravel. labels for what, iptables|ipvs",
+	}, append(defaultLabels, "what"))
+
+	// counter link_repair_count
+	link_repair_count := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "link_repair_count",
+		Help: "is a count of the reconciles started at once because a VIP address was removed, the primary interface came back up, or link changes were dropped. labels for change, address-removed|link-up|overrun",
+	}, append(defaultLabels, "change"))
+
+	// counter parity_repair_count
+	parity_repair_count := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "parity_repair_count",
+		Help: "is a count of the repairs of the kernel state a realserver keeps that drifted from the config. labels for what, chains|sysctls|vips, and outcome, success|error",
+	}, append(defaultLabels, "what", "outcome"))
+
+	// counter reconcile_skipped_count
+	reconcile_skipped_count := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "reconcile_skipped_count",
+		Help: "is a count of the reconciles skipped because the last was still running. labels for reason, running|overlap",
+	}, append(defaultLabels, "reason"))
+
+	// counter reconcile_over_budget_count
+	reconcile_over_budget_count := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "reconcile_over_budget_count",
+		Help: "is a count of the reconcile stages that ran past their budget and were canceled. labels for stage, parity|addresses|services",
+	}, append(defaultLabels, "stage"))
+
+	// data plane
+	dataplane_objects := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "dataplane_objects",
+		Help: "is a gauge of what the data plane was serving after the last apply. labels for dataplane, the provider in use, and object services|backends|addresses",
+	}, append(defaultLabels, "dataplane", "object"))
+
+	// saturation guard
+	backend_saturated := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "backend_saturated",
+		Help: "is a gauge that is 1 while the saturation guard keeps new connections from a backend node whose active ipvs connections exceed the ceiling",
+	}, append(defaultLabels, "backend"))
+
+	// gauge backend_ejected
+	backend_ejected := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "backend_ejected",
+		Help: "is a gauge that is 1 while passive ejection keeps new connections from a backend whose sampled ipvs connections keep failing",
+	}, append(defaultLabels, "backend"))
+
+	// gauge last_backend_guarded
+	last_backend_guarded := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "last_backend_guarded",
+		Help: "is a gauge that is 1 while a change would leave an ipvs virtual service without a healthy backend, and the last backend guard alerts on it (policy=alert) or keeps its configured reals (policy=block)",
+	}, append(defaultLabels, "service", "policy"))
+
+	// node drain
+	node_draining := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "node_draining",
+		Help: "is a gauge that is 1 while a node is cordoned or annotated with ravel.comcast.com/drain=true and its weight is ramped down in every pool",
+	}, append(defaultLabels, "node"))
+
+	// flow export
+	flow_records_count := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "flow_records_count",
+		Help: "is a count of the IPFIX flow records sent to the flow collector, with an outcome of error when an export failed",
+	}, append(defaultLabels, "outcome"))
+
+	// counter announce_count
+	announce_count := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "announce_count",
+		Help: "is a count of the announcements of each VIP sent by the director, labeled by strategy and by an outcome of error when one couldn't be sent",
+	}, append(defaultLabels, "strategy", "vip", "outcome"))
+
 	prometheus.MustRegister(reconfig_count)
 	prometheus.MustRegister(channel_depth)
 	prometheus.MustRegister(reconfig_bucket)
+	prometheus.MustRegister(stage_bucket)
+	prometheus.MustRegister(convergence_bucket)
 	prometheus.MustRegister(node_update_count)
 	prometheus.MustRegister(config_update_count)
 	prometheus.MustRegister(arping_dup_ip)
@@ -223,18 +746,42 @@ func NewWorkerStateMetrics(kind, secZone string) *WorkerStateMetrics {
 	prometheus.MustRegister(loopback_total_configured)
 	prometheus.MustRegister(loopback_configuration_healthy)
 	prometheus.MustRegister(iptables_write_failure)
-
-	// init error counters to 0
-	arping_dup_ip.With(prometheus.Labels{"lb": kind, "seczone": secZone})
-	arping_if_down.With(prometheus.Labels{"lb": kind, "seczone": secZone})
-	arping_unknown.With(prometheus.Labels{"lb": kind, "seczone": secZone})
+	prometheus.MustRegister(applied_generation)
+	prometheus.MustRegister(port_conflicts)
+	prometheus.MustRegister(probe_reachable)
+	prometheus.MustRegister(config_frozen)
+	prometheus.MustRegister(director_standby)
+	prometheus.MustRegister(advertised_vips)
+	prometheus.MustRegister(removals_deferred)
+	prometheus.MustRegister(removals_deferred_count)
+	prometheus.MustRegister(shrink_refused)
+	prometheus.MustRegister(apply_divergent)
+	prometheus.MustRegister(apply_retry_count)
+	prometheus.MustRegister(subsystem_restart_count)
+	prometheus.MustRegister(subsystem_consecutive_failures)
+	prometheus.MustRegister(reconcile_panic_count)
+	prometheus.MustRegister(reconcile_error_count)
+	prometheus.MustRegister(apply_breaker_open)
+	prometheus.MustRegister(kernel_tamper_count)
+	prometheus.MustRegister(link_repair_count)
+	prometheus.MustRegister(parity_repair_count)
+	prometheus.MustRegister(reconcile_skipped_count)
+	prometheus.MustRegister(reconcile_over_budget_count)
+	prometheus.MustRegister(dataplane_objects)
+	prometheus.MustRegister(backend_saturated)
+	prometheus.MustRegister(backend_ejected)
+	prometheus.MustRegister(last_backend_guarded)
+	prometheus.MustRegister(node_draining)
+	prometheus.MustRegister(flow_records_count)
+	prometheus.MustRegister(announce_count)
+	prometheus.MustRegister(mtu_mismatches)
+	prometheus.MustRegister(address_conflict_count)
 
 	return &WorkerStateMetrics{
-		kind:    kind,
-		secZone: secZone,
-
 		reconfigure:             reconfig_count,
 		reconfigureLatency:      reconfig_bucket,
+		stageLatency:            stage_bucket,
+		convergence:             convergence_bucket,
 		queueDepth:              channel_depth,
 		nodeUpdate:              node_update_count,
 		configUpdate:            config_update_count,
@@ -248,5 +795,35 @@ func NewWorkerStateMetrics(kind, secZone string) *WorkerStateMetrics {
 		loopbackTotalConfigured: loopback_total_configured,
 		loopbackConfigHealthy:   loopback_configuration_healthy,
 		iptablesWriteFail:       iptables_write_failure,
+		appliedGeneration:       applied_generation,
+		portConflicts:           port_conflicts,
+		probeReachable:          probe_reachable,
+		configFrozen:            config_frozen,
+		standby:                 director_standby,
+		advertisedVIPs:          advertised_vips,
+		removalsDeferred:        removals_deferred,
+		removalsDeferredCount:   removals_deferred_count,
+		shrinkRefused:           shrink_refused,
+		applyDivergent:          apply_divergent,
+		applyRetries:            apply_retry_count,
+		subsystemRestarts:       subsystem_restart_count,
+		subsystemFailures:       subsystem_consecutive_failures,
+		reconcilePanics:         reconcile_panic_count,
+		reconcileErrors:         reconcile_error_count,
+		applyBreakerOpen:        apply_breaker_open,
+		kernelTampered:          kernel_tamper_count,
+		linkRepairs:             link_repair_count,
+		parityRepairs:           parity_repair_count,
+		reconcileSkipped:        reconcile_skipped_count,
+		reconcileOverBudget:     reconcile_over_budget_count,
+		dataPlaneObjects:        dataplane_objects,
+		backendSaturated:        backend_saturated,
+		backendEjected:          backend_ejected,
+		lastBackendGuarded:      last_backend_guarded,
+		nodeDraining:            node_draining,
+		flowRecords:             flow_records_count,
+		announcements:           announce_count,
+		mtuMismatches:           mtu_mismatches,
+		addressConflicts:        address_conflict_count,
 	}
 }
@@ -0,0 +1,370 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+const (
+	// adaptiveScale multiplies the weights of adaptively weighted services, so
+	// that the weight of a real with a single endpoint can still be lowered.
+	// wrr only cares about the ratio between weights.
+	adaptiveScale = 100
+	// adaptiveHysteresis is the smallest change of a factor that is applied,
+	// so that noise doesn't rewrite the rules on every measurement
+	adaptiveHysteresis = 0.05
+	// adaptiveSmoothing is the share of a new measurement in a real's factor
+	adaptiveSmoothing = 0.5
+	// adaptiveExpiry is how many intervals a real is remembered after its
+	// service stops generating rules for it
+	adaptiveExpiry = 3
+	maxIPVSWeight  = 65535
+)
+
+// IPVSRealStats are the counters IPVS keeps for a real of a virtual service
+type IPVSRealStats struct {
+	Weight        int
+	ActiveConns   int
+	InactiveConns int
+}
+
+// ParseIPVSStats parses the output of `ipvsadm -Ln` into the stats of each
+// real, keyed by virtual service, i.e. `-t 10.1.2.3:80`, and by the address
+// and port of the real, i.e. `10.131.153.76:80`
+func ParseIPVSStats(out string) map[string]map[string]IPVSRealStats {
+	services := map[string]map[string]IPVSRealStats{}
+	service := ""
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "TCP":
+			service = "-t " + fields[1]
+		case "UDP":
+			service = "-u " + fields[1]
+		case "FWM":
+			service = "-f " + fields[1]
+		case "->":
+			if service == "" || len(fields) < 6 {
+				continue
+			}
+			weight, err1 := strconv.Atoi(fields[3])
+			active, err2 := strconv.Atoi(fields[4])
+			inactive, err3 := strconv.Atoi(fields[5])
+			if err1 != nil || err2 != nil || err3 != nil {
+				// the column headings
+				continue
+			}
+			if services[service] == nil {
+				services[service] = map[string]IPVSRealStats{}
+			}
+			services[service][fields[1]] = IPVSRealStats{Weight: weight, ActiveConns: active, InactiveConns: inactive}
+		default:
+			service = ""
+		}
+	}
+	return services
+}
+
+// adaptiveKey identifies a real of a VIP port, across its protocols
+type adaptiveKey struct {
+	// service is the VIP and port, i.e. 10.1.2.3:80
+	service string
+	// real is the address of the real
+	real string
+}
+
+// adaptiveTarget is a real whose weight is adapted, as last generated
+type adaptiveTarget struct {
+	config types.AdaptiveWeight
+	port   string
+	base   int
+	seen   time.Time
+}
+
+// adaptiveWeights measures the reals of services that enable adaptive
+// weighting, and scales their weights by how each does against the average
+type adaptiveWeights struct {
+	sync.Mutex
+
+	interval time.Duration
+	stats    func(ctx context.Context) (map[string]map[string]IPVSRealStats, error)
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+	logger   log.FieldLogger
+
+	targets map[adaptiveKey]adaptiveTarget
+	factors map[adaptiveKey]float64
+}
+
+func newAdaptiveWeights(interval time.Duration, stats func(ctx context.Context) (map[string]map[string]IPVSRealStats, error), logger log.FieldLogger) *adaptiveWeights {
+	dialer := &net.Dialer{}
+	return &adaptiveWeights{
+		interval: interval,
+		stats:    stats,
+		dial:     dialer.DialContext,
+		logger:   logger,
+		targets:  map[adaptiveKey]adaptiveTarget{},
+		factors:  map[adaptiveKey]float64{},
+	}
+}
+
+// SetAdaptiveWeights measures the reals of services that enable adaptive
+// weighting every interval, and scales their weights by the result until the
+// IPVS manager's context is done
+func (i *IPVS) SetAdaptiveWeights(interval time.Duration) {
+	i.adaptive = newAdaptiveWeights(interval, i.readStats, i.logger)
+	go i.adaptive.run(i.ctx)
+}
+
+// readStats returns the counters IPVS keeps for every real
+func (i *IPVS) readStats(ctx context.Context) (map[string]map[string]IPVSRealStats, error) {
+	cmdCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	out, err := i.runner.Run(cmdCtx, nil, "ipvsadm", "-Ln")
+	if err != nil {
+		return nil, fmt.Errorf("ipvs: ipvsadm -Ln failed with %v", err)
+	}
+	return ParseIPVSStats(string(out)), nil
+}
+
+// realWeight is the weight of a real in the rules of a VIP port, adapted to
+// how the real performs when the port enables adaptive weighting, and then
+// limited as backendWeight does. It is 0 while the real is ejected. realPort is
+// the port of the real the VIP port is sent to, see types.BackendPort.
+func (i *IPVS) realWeight(vip types.ServiceIP, port, real, realPort string, base int, serviceConfig *types.ServiceDef) int {
+	weight := base
+	if i.adaptive != nil && serviceConfig.AdaptiveWeight != nil {
+		weight = i.adaptive.weight(string(vip), port, real, realPort, base, serviceConfig.AdaptiveWeight)
+	}
+	return i.ejection.weight(net.JoinHostPort(real, realPort), i.backendWeight(real, weight))
+}
+
+// backendWeight is 0 while the saturation guard quiesces the backend, and
+// otherwise weight ramped down while the backend's node drains
+func (i *IPVS) backendWeight(backend string, weight int) int {
+	return i.drain.weight(backend, i.saturation.weight(backend, weight))
+}
+
+// weight records the real as a target of the next measurement, and returns its
+// base weight scaled by its current factor. Reals with no weight keep none,
+// and reals with some weight always keep some.
+func (a *adaptiveWeights) weight(vip, port, real, realPort string, base int, config *types.AdaptiveWeight) int {
+	a.Lock()
+	defer a.Unlock()
+
+	key := adaptiveKey{service: net.JoinHostPort(vip, port), real: real}
+	a.targets[key] = adaptiveTarget{config: *config, port: realPort, base: base, seen: time.Now()}
+
+	if base <= 0 {
+		return 0
+	}
+	factor, ok := a.factors[key]
+	if !ok {
+		factor = 1
+	}
+	weight := int(math.Round(float64(base) * factor * adaptiveScale))
+	if weight < 1 {
+		weight = 1
+	}
+	if weight > maxIPVSWeight {
+		weight = maxIPVSWeight
+	}
+	return weight
+}
+
+func (a *adaptiveWeights) run(ctx context.Context) {
+	if a.interval <= 0 {
+		return
+	}
+	a.logger.Infof("ipvs: measuring adaptively weighted reals every %v", a.interval)
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.measure(ctx)
+		}
+	}
+}
+
+// measure takes one measurement of every target and updates their factors
+func (a *adaptiveWeights) measure(ctx context.Context) {
+	a.Lock()
+	services := map[string][]adaptiveKey{}
+	targets := map[adaptiveKey]adaptiveTarget{}
+	expiry := time.Now().Add(-adaptiveExpiry * a.interval)
+	for key, target := range a.targets {
+		if target.seen.Before(expiry) {
+			delete(a.targets, key)
+			delete(a.factors, key)
+			continue
+		}
+		targets[key] = target
+		services[key.service] = append(services[key.service], key)
+	}
+	a.Unlock()
+
+	var conns map[string]int
+	for _, keys := range services {
+		if targets[keys[0]].config.SignalName() == types.AdaptiveConnections {
+			stats, err := a.stats(ctx)
+			if err != nil {
+				a.logger.Warnf("ipvs: unable to measure connections for adaptive weights. %v", err)
+				break
+			}
+			conns = activeConnsByReal(stats)
+			break
+		}
+	}
+
+	factors := map[adaptiveKey]float64{}
+	for service, keys := range services {
+		sort.Slice(keys, func(n, m int) bool { return keys[n].real < keys[m].real })
+		config := targets[keys[0]].config
+
+		// load is what a real is measured by, lower being better
+		load := map[adaptiveKey]float64{}
+		failed := map[adaptiveKey]bool{}
+		switch config.SignalName() {
+		case types.AdaptiveConnections:
+			if conns == nil {
+				continue
+			}
+			for _, key := range keys {
+				if base := targets[key].base; base > 0 {
+					load[key] = float64(conns[key.service+" "+key.real]) / float64(base)
+				}
+			}
+		case types.AdaptiveLatency:
+			for _, key := range keys {
+				if targets[key].base <= 0 {
+					continue
+				}
+				// the reals of a port may listen on different ports, see
+				// types.BackendPort
+				port := targets[key].port
+				if config.ProbePort != 0 {
+					port = strconv.Itoa(config.ProbePort)
+				}
+				latency, err := a.probe(ctx, net.JoinHostPort(key.real, port))
+				if err != nil {
+					a.logger.Debugf("ipvs: adaptive weight probe of %s for %s failed. %v", key.real, service, err)
+					failed[key] = true
+					continue
+				}
+				load[key] = latency.Seconds()
+			}
+		}
+
+		for key, factor := range adaptFactors(load, failed, config) {
+			factors[key] = factor
+		}
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	for key, measured := range factors {
+		previous, ok := a.factors[key]
+		if !ok {
+			previous = 1
+		}
+		factor := previous + adaptiveSmoothing*(measured-previous)
+		if math.Abs(factor-previous) < adaptiveHysteresis {
+			continue
+		}
+		a.factors[key] = factor
+		a.logger.Debugf("ipvs: adaptive weight of %s for %s is now %.2f of its base weight", key.real, key.service, factor)
+	}
+}
+
+// probe returns the time taken to open a tcp connection to address
+func (a *adaptiveWeights) probe(ctx context.Context, address string) (time.Duration, error) {
+	timeout := a.interval / 2
+	if timeout > 2*time.Second {
+		timeout = 2 * time.Second
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := a.dial(dialCtx, "tcp", address)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	conn.Close()
+	return elapsed, nil
+}
+
+// adaptFactors compares the load of every real with the average, giving reals
+// with less load than average a factor above 1 and those with more a factor
+// below, within the bounds of config. Reals that failed to be measured get the
+// lower bound.
+func adaptFactors(load map[adaptiveKey]float64, failed map[adaptiveKey]bool, config types.AdaptiveWeight) map[adaptiveKey]float64 {
+	min, max := config.Bounds()
+	factors := map[adaptiveKey]float64{}
+	for key := range failed {
+		factors[key] = min
+	}
+	if len(load) == 0 {
+		return factors
+	}
+
+	total := 0.0
+	for _, l := range load {
+		total += l
+	}
+	average := total / float64(len(load))
+	for key, l := range load {
+		factor := max
+		switch {
+		case average == 0:
+			// nothing to tell the reals apart by
+			factor = 1
+		case l > 0:
+			factor = average / l
+		}
+		factors[key] = math.Min(max, math.Max(min, factor))
+	}
+	return factors
+}
+
+// activeConnsByReal sums the active connections of each real across the
+// protocols of a VIP port, keyed by `10.1.2.3:80 10.131.153.76`
+func activeConnsByReal(stats map[string]map[string]IPVSRealStats) map[string]int {
+	out := map[string]int{}
+	for service, reals := range stats {
+		fields := strings.Fields(service)
+		if len(fields) != 2 || fields[0] == "-f" {
+			continue
+		}
+		vip, port, err := net.SplitHostPort(fields[1])
+		if err != nil {
+			continue
+		}
+		for real, s := range reals {
+			host, _, err := net.SplitHostPort(real)
+			if err != nil {
+				continue
+			}
+			out[net.JoinHostPort(vip, port)+" "+host] += s.ActiveConns
+		}
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package system
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+const ipvsStats = `IP Virtual Server version 1.2.1 (size=4096)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port           Forward Weight ActiveConn InActConn
+TCP  10.54.213.165:80 wrr
+  -> 10.131.153.76:80             Route   100    10         3
+  -> 10.131.153.77:80             Route   100    10         0
+  -> 10.131.153.78:80             Route   100    40         12
+UDP  10.54.213.165:80 wrr
+  -> 10.131.153.76:80             Route   100    0          7
+TCP  [2001:db8::7]:53 wrr
+  -> [2001:db8::10]:53            Route   1      2          0
+FWM  5 mh
+  -> 10.131.153.76:80             Route   1      9          0
+`
+
+func TestParseIPVSStats(t *testing.T) {
+	stats := ParseIPVSStats(ipvsStats)
+	if len(stats) != 4 {
+		t.Fatalf("expected 4 services. have %v", stats)
+	}
+	if s := stats["-t 10.54.213.165:80"]["10.131.153.78:80"]; s != (IPVSRealStats{Weight: 100, ActiveConns: 40, InactiveConns: 12}) {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if s := stats["-t [2001:db8::7]:53"]["[2001:db8::10]:53"]; s.ActiveConns != 2 {
+		t.Fatalf("unexpected v6 stats %+v", s)
+	}
+	if s := stats["-f 5"]["10.131.153.76:80"]; s.ActiveConns != 9 {
+		t.Fatalf("unexpected fwmark stats %+v", s)
+	}
+
+	conns := activeConnsByReal(stats)
+	if conns["10.54.213.165:80 10.131.153.76"] != 10 || conns["[2001:db8::7]:53 2001:db8::10"] != 2 {
+		t.Fatalf("unexpected active connections %v", conns)
+	}
+}
+
+func TestAdaptiveWeightsConnections(t *testing.T) {
+	runner := NewRecordingCommandRunner()
+	runner.Respond("ipvsadm -Ln", ipvsStats, nil)
+	i := &IPVS{ctx: context.Background(), logger: logrus.New(), runner: runner}
+	i.adaptive = newAdaptiveWeights(time.Second, i.readStats, i.logger)
+
+	service := &types.ServiceDef{TCPEnabled: true, UDPEnabled: true, AdaptiveWeight: &types.AdaptiveWeight{}}
+	reals := []string{"10.131.153.76", "10.131.153.77", "10.131.153.78"}
+	weights := func() []int {
+		out := []int{}
+		for _, real := range reals {
+			out = append(out, i.realWeight("10.54.213.165", "80", real, "80", 1, service))
+		}
+		return out
+	}
+	if w := weights(); w[0] != 100 || w[1] != 100 || w[2] != 100 {
+		t.Fatalf("expected unmeasured reals to keep their scaled weight. have %v", w)
+	}
+	if w := i.realWeight("10.54.213.165", "80", "10.131.153.79", "80", 0, service); w != 0 {
+		t.Fatalf("expected a real without weight to keep none. have %d", w)
+	}
+	if w := i.realWeight("10.54.213.165", "443", "10.131.153.76", "443", 3, &types.ServiceDef{}); w != 3 {
+		t.Fatalf("expected a port without adaptive weighting to keep its weight. have %d", w)
+	}
+
+	// the busiest real has twice the average load, and is smoothed half way
+	// towards half its weight
+	i.adaptive.measure(context.Background())
+	if w := weights(); w[0] != 100 || w[1] != 100 || w[2] != 75 {
+		t.Fatalf("unexpected weights after one measurement %v", w)
+	}
+	i.adaptive.measure(context.Background())
+	if w := weights(); w[2] != 63 {
+		t.Fatalf("unexpected weights after two measurements %v", w)
+	}
+
+	runner.Respond("ipvsadm -Ln", "", errors.New("exit status 2"))
+	i.adaptive.measure(context.Background())
+	if w := weights(); w[2] != 63 {
+		t.Fatalf("expected a failed measurement to keep the weights. have %v", w)
+	}
+}
+
+func TestAdaptiveWeightsLatency(t *testing.T) {
+	a := newAdaptiveWeights(time.Second, nil, logrus.New())
+	dialed := map[string]bool{}
+	a.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed[address] = true
+		if address == "10.131.153.77:8080" {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+
+	config := &types.AdaptiveWeight{Signal: types.AdaptiveLatency, ProbePort: 8080}
+	a.weight("10.54.213.165", "80", "10.131.153.76", "80", 2, config)
+	a.weight("10.54.213.165", "80", "10.131.153.77", "80", 2, config)
+	a.measure(context.Background())
+
+	if !dialed["10.131.153.76:8080"] || !dialed["10.131.153.77:8080"] {
+		t.Fatalf("expected the probe port of both reals to be dialed. have %v", dialed)
+	}
+	if w := a.weight("10.54.213.165", "80", "10.131.153.77", "80", 2, config); w != 110 {
+		t.Fatalf("expected the unreachable real to move towards its lower bound. have %d", w)
+	}
+	if w := a.weight("10.54.213.165", "80", "10.131.153.76", "80", 2, config); w < 110 || w > 200 {
+		t.Fatalf("expected the reachable real to keep more weight. have %d", w)
+	}
+}
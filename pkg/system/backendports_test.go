@@ -0,0 +1,45 @@
+package system
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+func TestGenerateRulesBackendPorts(t *testing.T) {
+	nodes := []*v1.Node{
+		testNode("old", "10.131.153.76", map[string]string{"pool": "old"}),
+		testNode("new", "10.131.153.77", map[string]string{"pool": "new"}),
+	}
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {"80": {
+				Service:     "web",
+				TCPEnabled:  true,
+				IPVSOptions: types.IPVSOptions{RawForwardingMethod: "m"},
+				BackendPorts: []types.BackendPort{
+					{NodeSelector: map[string]string{"pool": "new"}, TargetPort: 30080},
+				},
+			}},
+		},
+	}
+	i := &IPVS{weightOverride: true, defaultWeight: 1}
+
+	rules, err := i.generateRules(&watcher.Watcher{Nodes: nodes}, nodes, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		"-a -t 10.54.213.165:80 -r 10.131.153.76:80 -m -w 1 -x 0 -y 0":    true,
+		"-a -t 10.54.213.165:80 -r 10.131.153.77:30080 -m -w 1 -x 0 -y 0": true,
+	}
+	for _, rule := range rules {
+		delete(want, rule)
+	}
+	if len(want) != 0 {
+		t.Fatalf("expected rules %v. have %v", want, rules)
+	}
+}
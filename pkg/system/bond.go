@@ -0,0 +1,55 @@
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Bond is the state of a bonding master, as sysfs reports it
+type Bond struct {
+	// Mode is the bonding mode, i.e. active-backup
+	Mode string
+
+	// ActiveSlave is the slave that carries the bond's traffic, empty in the
+	// modes that balance over every slave
+	ActiveSlave string
+
+	Slaves []string
+}
+
+// ReadBond returns the state of the bond device, or nil when device isn't a
+// bond. Teams don't report their state in sysfs, and are nil as well.
+func ReadBond(device string) (*Bond, error) {
+	return readBond("/sys/class/net", device)
+}
+
+// readBond reads the state of the bond device from the sysfs root, i.e.
+// /sys/class/net
+func readBond(root, device string) (*Bond, error) {
+	dir := filepath.Join(root, device, "bonding")
+	mode, err := ioutil.ReadFile(filepath.Join(dir, "mode"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	bond := &Bond{}
+	// the mode is named and numbered, i.e. 'active-backup 1'
+	if fields := strings.Fields(string(mode)); len(fields) > 0 {
+		bond.Mode = fields[0]
+	}
+	active, err := ioutil.ReadFile(filepath.Join(dir, "active_slave"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	bond.ActiveSlave = strings.TrimSpace(string(active))
+	slaves, err := ioutil.ReadFile(filepath.Join(dir, "slaves"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	bond.Slaves = strings.Fields(string(slaves))
+	return bond, nil
+}
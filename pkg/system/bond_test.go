@@ -0,0 +1,43 @@
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadBond(t *testing.T) {
+	root := t.TempDir()
+	bonding := filepath.Join(root, "bond0", "bonding")
+	if err := os.MkdirAll(bonding, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"mode":         "active-backup 1\n",
+		"active_slave": "ens2\n",
+		"slaves":       "ens1 ens2\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(bonding, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(root, "eth0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	bond, err := readBond(root, "bond0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Bond{Mode: "active-backup", ActiveSlave: "ens2", Slaves: []string{"ens1", "ens2"}}
+	if !reflect.DeepEqual(bond, want) {
+		t.Fatalf("expected %+v. have %+v", want, bond)
+	}
+
+	// an interface that isn't a bond has no bond state
+	if bond, err := readBond(root, "eth0"); bond != nil || err != nil {
+		t.Fatalf("expected no bond for eth0. have %+v and %v", bond, err)
+	}
+}
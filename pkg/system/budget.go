@@ -0,0 +1,78 @@
+package system
+
+import (
+	"sort"
+	"strings"
+)
+
+// removalBudgetMetrics records the backend removals held back by the removal budget
+type removalBudgetMetrics interface {
+	RemovalsDeferred(deferred int)
+}
+
+// SetRemovalBudget limits the backends removed by a single reconcile to max.
+// Removals over the budget are held back; the next reconcile finds them again
+// and applies the next batch, so a mass node flap or an empty endpoint list
+// drains backends gradually instead of all at once. A max of zero disables
+// the budget. Removing a whole virtual service is not limited.
+func (i *IPVS) SetRemovalBudget(max int, metrics removalBudgetMetrics) {
+	i.removalBudget = max
+	i.budgetMetrics = metrics
+}
+
+// isBackendRemoval returns true for ipvsadm rules that delete a real server
+func isBackendRemoval(rule string) bool {
+	return strings.HasPrefix(rule, "-d ")
+}
+
+// backendService returns the virtual service of a backend rule, i.e. -t 10.54.213.165:80
+func backendService(rule string) string {
+	fields := strings.Fields(rule)
+	if len(fields) < 3 {
+		return ""
+	}
+	return fields[1] + " " + fields[2]
+}
+
+// limitRemovals returns rules with no more than budget backend removals, along
+// with the number of removals kept and held back. Removals are kept in sorted
+// order, so consecutive reconciles work through the same backlog. The backends
+// of virtual services that are removed in the same rules don't count.
+func limitRemovals(rules []string, budget int) ([]string, int, int) {
+	// -D -t 10.54.213.165:80 removes the service, -d -t 10.54.213.165:80 -r ... a backend
+	removedServices := map[string]bool{}
+	for _, rule := range rules {
+		if strings.HasPrefix(rule, "-D ") {
+			removedServices[strings.TrimPrefix(rule, "-D ")] = true
+		}
+	}
+
+	removals := []string{}
+	kept := []string{}
+	for _, rule := range rules {
+		if isBackendRemoval(rule) && !removedServices[backendService(rule)] {
+			removals = append(removals, rule)
+			continue
+		}
+		kept = append(kept, rule)
+	}
+	if budget < 0 {
+		budget = 0
+	}
+	if len(removals) <= budget {
+		return rules, len(removals), 0
+	}
+
+	sort.Strings(removals)
+	return append(kept, removals[:budget]...), budget, len(removals) - budget
+}
+
+// recordDeferred logs and records the removals held back by a reconcile
+func (i *IPVS) recordDeferred(deferred int) {
+	if deferred > 0 {
+		i.logger.Warnf("ipvs: holding back %d backend removals over the budget of %d per reconcile", deferred, i.removalBudget)
+	}
+	if i.budgetMetrics != nil {
+		i.budgetMetrics.RemovalsDeferred(deferred)
+	}
+}
@@ -0,0 +1,44 @@
+package system
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLimitRemovals(t *testing.T) {
+	rules := []string{
+		"-d -t 10.54.213.165:80 -r 10.131.153.78:80",
+		"-a -t 10.54.213.165:80 -r 10.131.153.79:80 -g -w 1",
+		"-d -t 10.54.213.165:80 -r 10.131.153.77:80",
+		"-D -t 10.54.213.166:80",
+		"-d -t 10.54.213.165:80 -r 10.131.153.76:80",
+		"-d -t 10.54.213.166:80 -r 10.131.153.76:80",
+	}
+
+	kept, used, deferred := limitRemovals(rules, 2)
+	if used != 2 || deferred != 1 {
+		t.Fatalf("expected 2 removals kept and 1 held back. have %d and %d", used, deferred)
+	}
+	sort.Strings(kept)
+	expected := []string{
+		"-D -t 10.54.213.166:80",
+		"-a -t 10.54.213.165:80 -r 10.131.153.79:80 -g -w 1",
+		"-d -t 10.54.213.165:80 -r 10.131.153.76:80",
+		"-d -t 10.54.213.165:80 -r 10.131.153.77:80",
+		"-d -t 10.54.213.166:80 -r 10.131.153.76:80",
+	}
+	if !reflect.DeepEqual(kept, expected) {
+		t.Fatalf("expected the first removals in order, and every other rule including the backends of removed services. have %v", kept)
+	}
+
+	kept, used, deferred = limitRemovals(rules, 0)
+	if used != 0 || deferred != 3 || len(kept) != 3 {
+		t.Fatalf("expected every removal to be held back with no budget left. have %v", kept)
+	}
+
+	kept, _, deferred = limitRemovals(rules, 5)
+	if deferred != 0 || len(kept) != len(rules) {
+		t.Fatalf("expected every rule within the budget. have %v", kept)
+	}
+}
@@ -0,0 +1,113 @@
+package system
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// CommandRunner runs a single command on the host. IPVS and IP shell out
+// through a CommandRunner so that tests can substitute a RecordingCommandRunner.
+type CommandRunner interface {
+	// Run executes name with args, feeding stdin to the process when it is not nil,
+	// and returns its standard output. When the command fails, the standard error
+	// follows the standard output, so that the failure can be reported; warnings
+	// written to the standard error of a command that succeeds are never parsed
+	// along with its output.
+	Run(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error)
+}
+
+// execCommandRunner runs commands with os/exec
+type execCommandRunner struct{}
+
+// NewCommandRunner creates a CommandRunner that executes commands on the host
+func NewCommandRunner() CommandRunner {
+	return execCommandRunner{}
+}
+
+func (execCommandRunner) Run(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return append(stdout.Bytes(), stderr.Bytes()...), err
+	}
+	return stdout.Bytes(), nil
+}
+
+// RecordedCommand is a command captured by a RecordingCommandRunner
+type RecordedCommand struct {
+	Name  string
+	Args  []string
+	Stdin string
+}
+
+// String renders the command as it would be typed on a shell
+func (c RecordedCommand) String() string {
+	return strings.TrimSpace(c.Name + " " + strings.Join(c.Args, " "))
+}
+
+// CommandResponse is the canned output and error for a command
+type CommandResponse struct {
+	Output []byte
+	Err    error
+}
+
+// RecordingCommandRunner is a test double that records every command it is
+// asked to run and replies from a table of canned responses keyed by the
+// command line, i.e. "ipvsadm -Sn". Commands without a response succeed with
+// no output.
+type RecordingCommandRunner struct {
+	sync.Mutex
+	Responses map[string]CommandResponse
+	Commands  []RecordedCommand
+}
+
+// NewRecordingCommandRunner creates a RecordingCommandRunner with no canned responses
+func NewRecordingCommandRunner() *RecordingCommandRunner {
+	return &RecordingCommandRunner{
+		Responses: map[string]CommandResponse{},
+	}
+}
+
+// Respond sets the output and error returned for the command line
+func (r *RecordingCommandRunner) Respond(commandLine string, output string, err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.Responses[commandLine] = CommandResponse{Output: []byte(output), Err: err}
+}
+
+func (r *RecordingCommandRunner) Run(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	c := RecordedCommand{Name: name, Args: args, Stdin: string(stdin)}
+	r.Commands = append(r.Commands, c)
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", c.String(), err)
+	}
+	resp, ok := r.Responses[c.String()]
+	if !ok {
+		return []byte{}, nil
+	}
+	return resp.Output, resp.Err
+}
+
+// CommandLines returns every recorded command as a string, in order
+func (r *RecordingCommandRunner) CommandLines() []string {
+	r.Lock()
+	defer r.Unlock()
+	out := make([]string, 0, len(r.Commands))
+	for _, c := range r.Commands {
+		out = append(out, c.String())
+	}
+	return out
+}
@@ -0,0 +1,140 @@
+package system
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestIPVSGetWithRecordingRunner(t *testing.T) {
+	runner := NewRecordingCommandRunner()
+	runner.Respond("ipvsadm -Sn", `-A -t 10.54.213.165:80 -s wrr
+-a -t 10.54.213.165:80 -r 10.54.213.10:80 -g -w 1
+-A -t [2001:558:1044:19c::1]:80 -s wrr
+`, nil)
+
+	i := &IPVS{ctx: context.Background(), logger: logrus.New(), runner: runner}
+	rules, err := i.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"-A -t 10.54.213.165:80 -s wrr",
+		"-a -t 10.54.213.165:80 -r 10.54.213.10:80 -g -w 1",
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("expected %v, got %v", expected, rules)
+	}
+}
+
+func TestIPVSSetWithRecordingRunner(t *testing.T) {
+	runner := NewRecordingCommandRunner()
+	i := &IPVS{ctx: context.Background(), logger: logrus.New(), runner: runner}
+
+	if _, err := i.Set([]string{"-A -t 10.54.213.165:80 -s wrr", "-D -t 10.54.213.165:81"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(runner.Commands) != 1 {
+		t.Fatalf("expected 1 command, got %d", len(runner.Commands))
+	}
+	if runner.Commands[0].String() != "ipvsadm -R" {
+		t.Fatalf("unexpected command %s", runner.Commands[0].String())
+	}
+	if runner.Commands[0].Stdin != "-A -t 10.54.213.165:80 -s wrr\n-D -t 10.54.213.165:81" {
+		t.Fatalf("unexpected stdin %q", runner.Commands[0].Stdin)
+	}
+}
+
+func TestIPAddWithRecordingRunner(t *testing.T) {
+	runner := NewRecordingCommandRunner()
+	ip := &IP{ctx: context.Background(), logger: logrus.New(), runner: runner}
+
+	if err := ip.Add("10.54.213.165"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"ip link add 10_54_213_165 type dummy",
+		"ip link set dev 10_54_213_165 alias ravel",
+		"ip address add 10.54.213.165 dev 10_54_213_165",
+	}
+	if !reflect.DeepEqual(runner.CommandLines(), expected) {
+		t.Fatalf("expected %v, got %v", expected, runner.CommandLines())
+	}
+}
+
+func TestExecCommandRunnerOutput(t *testing.T) {
+	runner := NewCommandRunner()
+
+	// warnings on stderr aren't returned with the output of a command that succeeds
+	out, err := runner.Run(context.Background(), nil, "sh", "-c", "echo -A -t 10.54.213.165:80 -s wrr; echo warning >&2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "-A -t 10.54.213.165:80 -s wrr\n" {
+		t.Fatalf("expected only the standard output. have %q", out)
+	}
+
+	// the standard error of a failed command follows its output
+	out, err = runner.Run(context.Background(), nil, "sh", "-c", "echo partial; echo failed >&2; exit 2")
+	if err == nil {
+		t.Fatal("expected the command to fail")
+	}
+	if string(out) != "partial\nfailed\n" {
+		t.Fatalf("expected the standard output and error. have %q", out)
+	}
+}
+
+func TestFakeIPVSSet(t *testing.T) {
+	f := NewFakeIPVS()
+	f.Set([]string{
+		"-A -t 10.54.213.165:80 -s wrr",
+		"-a -t 10.54.213.165:80 -r 10.54.213.10:80 -g -w 1",
+		"-A -t 10.54.213.165:8080 -s wrr",
+	})
+	f.Set([]string{
+		"-e -t 10.54.213.165:80 -r 10.54.213.10:80 -g -w 3",
+		"-D -t 10.54.213.165:8080",
+	})
+
+	rules, _ := f.Get()
+	expected := []string{
+		"-A -t 10.54.213.165:80 -s wrr",
+		"-a -t 10.54.213.165:80 -r 10.54.213.10:80 -g -w 3",
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("expected %v, got %v", expected, rules)
+	}
+}
+
+func TestIPVSSetFlushesConntrack(t *testing.T) {
+	runner := NewRecordingCommandRunner()
+	runner.Respond("conntrack -D -f ipv4 -p tcp --orig-dst 10.54.213.165 --orig-port-dst 81", "conntrack v1.4.6 (conntrack-tools): 0 flow entries have been deleted.", errors.New("exit status 1"))
+	i := &IPVS{ctx: context.Background(), logger: logrus.New(), runner: runner}
+	c := NewConntrack(context.Background(), logrus.New())
+	c.SetCommandRunner(runner)
+	i.SetConntrack(c)
+
+	rules := []string{
+		"-A -t 10.54.213.165:80 -s wrr",
+		"-D -t 10.54.213.165:81",
+		"-d -u [2001:558:1044:1ae::7]:53 -r [2001:558:1044:1ae::100]:53",
+		"-e -t 10.54.213.165:80 -r 10.54.213.10:80 -g -w 0",
+		"-D -f 100",
+	}
+	if _, err := i.Set(rules); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"ipvsadm -R",
+		"conntrack -D -f ipv4 -p tcp --orig-dst 10.54.213.165 --orig-port-dst 81",
+		"conntrack -D -f ipv6 -p udp --orig-dst 2001:558:1044:1ae::7 --orig-port-dst 53 --reply-src 2001:558:1044:1ae::100",
+	}
+	if commands := runner.CommandLines(); !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("expected %v, got %v", expected, runner.CommandLines())
+	}
+}
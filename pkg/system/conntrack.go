@@ -0,0 +1,214 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Conntrack deletes connection tracking entries that would otherwise keep
+// steering flows at a virtual service or backend that has been removed. It
+// talks ctnetlink to the kernel, and only deletes entries matching the removed
+// destination.
+//
+// Setups that exempt VIP traffic from tracking with NOTRACK have no entries to
+// flush and should leave the Conntrack off the IPVS.
+type Conntrack struct {
+	ctx    context.Context
+	logger log.FieldLogger
+	runner CommandRunner
+}
+
+// NewConntrack creates a Conntrack that deletes entries over ctnetlink
+func NewConntrack(ctx context.Context, logger log.FieldLogger) *Conntrack {
+	return &Conntrack{
+		ctx:    ctx,
+		logger: logger,
+	}
+}
+
+// SetCommandRunner deletes the entries by running conntrack(8) with r
+// instead. ctnetlink needs NET_ADMIN in the process that opens the socket,
+// and a controller without it sends its operations to the agent, which only
+// executes commands, see pkg/agent.
+func (c *Conntrack) SetCommandRunner(r CommandRunner) {
+	c.runner = r
+}
+
+// FlushService deletes the entries for connections to vip:port
+func (c *Conntrack) FlushService(protocol, vip, port string) error {
+	return c.flush(protocol, vip, port, "")
+}
+
+// FlushBackend deletes the entries for connections to vip:port that were
+// translated to backend
+func (c *Conntrack) FlushBackend(protocol, vip, port, backend string) error {
+	return c.flush(protocol, vip, port, backend)
+}
+
+// FlushRemoved flushes the entries for every virtual service and backend that
+// ipvsadm restore rules delete. Other rules are ignored. Failures are logged
+// and do not stop the remaining flushes.
+func (c *Conntrack) FlushRemoved(rules []string) {
+	for _, rule := range rules {
+		r, ok := parseRemovalRule(rule)
+		if !ok {
+			continue
+		}
+		var err error
+		if r.backend == "" {
+			err = c.FlushService(r.protocol, r.vip, r.port)
+		} else {
+			err = c.FlushBackend(r.protocol, r.vip, r.port, r.backend)
+		}
+		if err != nil {
+			c.logger.Errorf("conntrack: %v", err)
+		}
+	}
+}
+
+func (c *Conntrack) flush(protocol, vip, port, backend string) error {
+	if c.runner != nil {
+		return c.exec(protocol, vip, port, backend)
+	}
+	f, err := newCtFilter(protocol, vip, port, backend)
+	if err != nil {
+		return err
+	}
+	deleted, err := deleteConntrack(f)
+	if err != nil {
+		return fmt.Errorf("unable to flush entries for %s %s:%s backend=%q: %v", protocol, vip, port, backend, err)
+	}
+	c.logger.Debugf("conntrack: flushed %d entries for %s %s:%s backend=%q", deleted, protocol, vip, port, backend)
+	return nil
+}
+
+// exec deletes the entries with conntrack(8), see SetCommandRunner
+func (c *Conntrack) exec(protocol, vip, port, backend string) error {
+	family := "ipv4"
+	if ip := net.ParseIP(vip); ip != nil && ip.To4() == nil {
+		family = "ipv6"
+	}
+	args := []string{"-D", "-f", family, "-p", protocol, "--orig-dst", vip, "--orig-port-dst", port}
+	if backend != "" {
+		args = append(args, "--reply-src", backend)
+	}
+
+	cmdCtx, cmdContextCancel := context.WithTimeout(c.ctx, time.Second*20)
+	defer cmdContextCancel()
+
+	out, err := c.runner.Run(cmdCtx, nil, "conntrack", args...)
+	// conntrack exits non-zero when nothing matched, which is the usual case
+	if err != nil && !strings.Contains(string(out), "0 flow entries") {
+		return fmt.Errorf("unable to flush entries with 'conntrack %s': %v. Saw output: %s", strings.Join(args, " "), err, string(out))
+	}
+	c.logger.Debugf("conntrack: flushed entries for %s %s:%s backend=%q. %s", protocol, vip, port, backend, strings.TrimSpace(string(out)))
+	return nil
+}
+
+// ctProtocols are the protocol numbers of the protocols of virtual services
+var ctProtocols = map[string]uint8{"tcp": syscall.IPPROTO_TCP, "udp": syscall.IPPROTO_UDP, "sctp": 132}
+
+// ctEntry is a conntrack entry, as far as flushing needs it: the destination
+// of its original direction, the source of its reply, which is the backend
+// IPVS translated the destination to, and the raw original tuple and zone the
+// entry is deleted by
+type ctEntry struct {
+	proto    uint8
+	dst      net.IP
+	dport    uint16
+	replySrc net.IP
+
+	orig []byte
+	zone []byte
+}
+
+// ctFilter matches the entries of connections to vip:port of proto, and only
+// those translated to backend when it is set
+type ctFilter struct {
+	proto   uint8
+	vip     net.IP
+	port    uint16
+	backend net.IP
+}
+
+func newCtFilter(protocol, vip, port, backend string) (ctFilter, error) {
+	f := ctFilter{vip: net.ParseIP(vip)}
+	var ok bool
+	if f.proto, ok = ctProtocols[protocol]; !ok {
+		return ctFilter{}, fmt.Errorf("unable to flush entries of protocol %q", protocol)
+	}
+	if f.vip == nil {
+		return ctFilter{}, fmt.Errorf("unable to flush entries of vip %q", vip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return ctFilter{}, fmt.Errorf("unable to flush entries of port %q. %v", port, err)
+	}
+	f.port = uint16(p)
+	if backend != "" {
+		if f.backend = net.ParseIP(backend); f.backend == nil {
+			return ctFilter{}, fmt.Errorf("unable to flush entries of backend %q", backend)
+		}
+	}
+	return f, nil
+}
+
+func (f ctFilter) matches(e ctEntry) bool {
+	if e.proto != f.proto || e.dport != f.port || !e.dst.Equal(f.vip) {
+		return false
+	}
+	return f.backend == nil || f.backend.Equal(e.replySrc)
+}
+
+// conntrackRemoval is a virtual service, or a single backend of one, deleted by an ipvsadm rule
+type conntrackRemoval struct {
+	protocol string
+	vip      string
+	port     string
+	backend  string
+}
+
+// parseRemovalRule parses ipvsadm restore rules that delete a virtual service
+// or a backend, i.e. '-D -t 10.54.213.165:80' or
+// '-d -u [2001:558:1044:1ae::7]:53 -r [2001:558:1044:1ae::100]:53'. Fwmark
+// services carry no destination to match on and are skipped.
+func parseRemovalRule(rule string) (conntrackRemoval, bool) {
+	words := strings.Fields(rule)
+	if len(words) < 3 || (words[0] != "-D" && words[0] != "-d") {
+		return conntrackRemoval{}, false
+	}
+
+	r := conntrackRemoval{}
+	switch words[1] {
+	case "-t":
+		r.protocol = "tcp"
+	case "-u":
+		r.protocol = "udp"
+	case "--sctp-service":
+		r.protocol = "sctp"
+	default:
+		return conntrackRemoval{}, false
+	}
+
+	var err error
+	if r.vip, r.port, err = net.SplitHostPort(words[2]); err != nil {
+		return conntrackRemoval{}, false
+	}
+
+	if words[0] == "-d" {
+		if len(words) < 5 || words[3] != "-r" {
+			return conntrackRemoval{}, false
+		}
+		if r.backend, _, err = net.SplitHostPort(words[4]); err != nil {
+			return conntrackRemoval{}, false
+		}
+	}
+	return r, true
+}
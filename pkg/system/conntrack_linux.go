@@ -0,0 +1,223 @@
+package system
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// the ctnetlink messages of nfnetlink, and the attributes of a conntrack
+// entry, which syscall doesn't define
+const (
+	nfnlSubsysCtnetlink = 1
+	ipctnlMsgCtGet      = 1
+	ipctnlMsgCtDelete   = 2
+
+	ctaTupleOrig  = 1
+	ctaTupleReply = 2
+	ctaZone       = 18
+
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoNum     = 1
+	ctaProtoSrcPort = 2
+	ctaProtoDstPort = 3
+
+	nlaFNested  = 0x8000
+	nlaTypeMask = 0x3fff
+
+	// sizeofNfgenmsg is the header of every nfnetlink message, its family,
+	// version and resource id
+	sizeofNfgenmsg = 4
+)
+
+// conntrackTimeout bounds each read of the netlink socket, so that a kernel
+// that never answers doesn't hold up the flushes
+const conntrackTimeout = 5 * time.Second
+
+// deleteConntrack deletes the entries f matches over ctnetlink. The table of
+// the family is dumped and every match deleted by its original tuple, as
+// conntrack(8) does, and an entry that expired in between is not an error.
+func deleteConntrack(f ctFilter) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return 0, fmt.Errorf("unable to open netlink socket. %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return 0, fmt.Errorf("unable to bind netlink socket. %v", err)
+	}
+	tv := syscall.NsecToTimeval(conntrackTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return 0, fmt.Errorf("unable to set the netlink read timeout. %v", err)
+	}
+
+	family := uint8(syscall.AF_INET)
+	if f.vip.To4() == nil {
+		family = syscall.AF_INET6
+	}
+	matched := []ctEntry{}
+	err = ctRoundTrip(fd, ctMessage(ipctnlMsgCtGet, syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP, 1, family), func(msg *syscall.NetlinkMessage) {
+		if e, ok := parseCtEntry(msg.Data); ok && f.matches(e) {
+			matched = append(matched, e)
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("unable to dump the conntrack table. %v", err)
+	}
+
+	deleted := 0
+	for n, e := range matched {
+		req := ctMessage(ipctnlMsgCtDelete, syscall.NLM_F_REQUEST|syscall.NLM_F_ACK, uint32(n+2), family, ctDeleteAttrs(e)...)
+		switch err := ctRoundTrip(fd, req, nil); err {
+		case nil:
+			deleted++
+		case syscall.ENOENT:
+		default:
+			return deleted, fmt.Errorf("unable to delete a conntrack entry to %s:%d. %v", e.dst, e.dport, err)
+		}
+	}
+	return deleted, nil
+}
+
+// ctRoundTrip sends req and reads its answer, passing each entry of a dump to
+// each, until the dump is done or the request is acknowledged
+func ctRoundTrip(fd int, req []byte, each func(*syscall.NetlinkMessage)) error {
+	if err := syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	b := make([]byte, 1<<16)
+	for {
+		n, _, err := syscall.Recvfrom(fd, b, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(b[:n])
+		if err != nil {
+			return err
+		}
+		for i := range msgs {
+			msg := &msgs[i]
+			switch msg.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				if len(msg.Data) < 4 {
+					return fmt.Errorf("truncated netlink error")
+				}
+				if errno := -*(*int32)(unsafe.Pointer(&msg.Data[0])); errno != 0 {
+					return syscall.Errno(errno)
+				}
+				return nil
+			default:
+				if each != nil {
+					each(msg)
+				}
+			}
+		}
+	}
+}
+
+// ctMessage encodes a ctnetlink request of typ for family, with attrs after
+// its header
+func ctMessage(typ uint16, flags uint16, seq uint32, family uint8, attrs ...[]byte) []byte {
+	payload := []byte{family, 0, 0, 0}
+	for _, a := range attrs {
+		payload = append(payload, a...)
+	}
+	h := syscall.NlMsghdr{
+		Len:   uint32(syscall.NLMSG_HDRLEN + len(payload)),
+		Type:  nfnlSubsysCtnetlink<<8 | typ,
+		Flags: flags,
+		Seq:   seq,
+	}
+	b := make([]byte, syscall.NLMSG_HDRLEN, int(h.Len))
+	copy(b, (*[syscall.SizeofNlMsghdr]byte)(unsafe.Pointer(&h))[:])
+	return append(b, payload...)
+}
+
+// ctAttr encodes the netlink attribute typ with value, padded to its alignment
+func ctAttr(typ uint16, value []byte) []byte {
+	rta := syscall.RtAttr{Len: uint16(syscall.SizeofRtAttr + len(value)), Type: typ}
+	b := make([]byte, (int(rta.Len)+syscall.RTA_ALIGNTO-1)&^(syscall.RTA_ALIGNTO-1))
+	copy(b, (*[syscall.SizeofRtAttr]byte)(unsafe.Pointer(&rta))[:])
+	copy(b[syscall.SizeofRtAttr:], value)
+	return b
+}
+
+// ctAttrs returns the netlink attributes in b by their type, without the
+// nested and byte order flags
+func ctAttrs(b []byte) map[uint16][]byte {
+	attrs := map[uint16][]byte{}
+	for len(b) >= syscall.SizeofRtAttr {
+		rta := (*syscall.RtAttr)(unsafe.Pointer(&b[0]))
+		if int(rta.Len) < syscall.SizeofRtAttr || int(rta.Len) > len(b) {
+			break
+		}
+		attrs[rta.Type&nlaTypeMask] = b[syscall.SizeofRtAttr:rta.Len]
+		aligned := (int(rta.Len) + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+		if aligned >= len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return attrs
+}
+
+// parseCtEntry parses the entry of a ctnetlink dump message
+func parseCtEntry(data []byte) (ctEntry, bool) {
+	if len(data) < sizeofNfgenmsg {
+		return ctEntry{}, false
+	}
+	attrs := ctAttrs(data[sizeofNfgenmsg:])
+	orig, ok := attrs[ctaTupleOrig]
+	if !ok {
+		return ctEntry{}, false
+	}
+	e := ctEntry{orig: orig, zone: attrs[ctaZone]}
+
+	tuple := ctAttrs(orig)
+	ips := ctAttrs(tuple[ctaTupleIP])
+	if dst, ok := ips[ctaIPv4Dst]; ok {
+		e.dst = net.IP(dst)
+	} else if dst, ok := ips[ctaIPv6Dst]; ok {
+		e.dst = net.IP(dst)
+	}
+	proto := ctAttrs(tuple[ctaTupleProto])
+	if num := proto[ctaProtoNum]; len(num) == 1 {
+		e.proto = num[0]
+	}
+	if port := proto[ctaProtoDstPort]; len(port) == 2 {
+		e.dport = binary.BigEndian.Uint16(port)
+	}
+
+	reply := ctAttrs(ctAttrs(attrs[ctaTupleReply])[ctaTupleIP])
+	if src, ok := reply[ctaIPv4Src]; ok {
+		e.replySrc = net.IP(src)
+	} else if src, ok := reply[ctaIPv6Src]; ok {
+		e.replySrc = net.IP(src)
+	}
+	return e, e.dst != nil
+}
+
+// ctDeleteAttrs are the attributes that delete e. The original tuple is
+// always among them, as a delete without a tuple flushes the whole table.
+func ctDeleteAttrs(e ctEntry) [][]byte {
+	attrs := [][]byte{ctAttr(ctaTupleOrig|nlaFNested, e.orig)}
+	if e.zone != nil {
+		attrs = append(attrs, ctAttr(ctaZone, e.zone))
+	}
+	return attrs
+}
@@ -0,0 +1,105 @@
+package system
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// ctTuple encodes a conntrack tuple of src:sport to dst:dport
+func ctTuple(proto uint8, src, dst string, sport, dport uint16) []byte {
+	srcType, dstType, ip := uint16(ctaIPv4Src), uint16(ctaIPv4Dst), func(s string) []byte { return net.ParseIP(s).To4() }
+	if net.ParseIP(src).To4() == nil {
+		srcType, dstType, ip = ctaIPv6Src, ctaIPv6Dst, func(s string) []byte { return net.ParseIP(s).To16() }
+	}
+	ips := append(ctAttr(srcType, ip(src)), ctAttr(dstType, ip(dst))...)
+	ports := append(ctAttr(ctaProtoNum, []byte{proto}), ctAttr(ctaProtoSrcPort, []byte{byte(sport >> 8), byte(sport)})...)
+	ports = append(ports, ctAttr(ctaProtoDstPort, []byte{byte(dport >> 8), byte(dport)})...)
+	return append(ctAttr(ctaTupleIP|nlaFNested, ips), ctAttr(ctaTupleProto|nlaFNested, ports)...)
+}
+
+func TestParseCtEntry(t *testing.T) {
+	orig := ctTuple(syscall.IPPROTO_TCP, "10.0.0.9", "10.54.213.165", 40000, 80)
+	reply := ctTuple(syscall.IPPROTO_TCP, "10.54.213.10", "10.0.0.9", 80, 40000)
+	zone := []byte{0, 7}
+	msg := netlinkMessage(nfnlSubsysCtnetlink<<8|0, []byte{syscall.AF_INET, 0, 0, 0},
+		netlinkAttr{ctaTupleOrig | nlaFNested, orig},
+		netlinkAttr{ctaTupleReply | nlaFNested, reply},
+		netlinkAttr{ctaZone, zone},
+	)
+	msgs, err := syscall.ParseNetlinkMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := parseCtEntry(msgs[0].Data)
+	if !ok {
+		t.Fatal("expected the entry to be parsed")
+	}
+	if e.proto != syscall.IPPROTO_TCP || !e.dst.Equal(net.ParseIP("10.54.213.165")) || e.dport != 80 || !e.replySrc.Equal(net.ParseIP("10.54.213.10")) {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+
+	for _, c := range []struct {
+		protocol, vip, port, backend string
+		matches                      bool
+	}{
+		{"tcp", "10.54.213.165", "80", "", true},
+		{"tcp", "10.54.213.165", "80", "10.54.213.10", true},
+		{"tcp", "10.54.213.165", "80", "10.54.213.11", false},
+		{"tcp", "10.54.213.165", "81", "", false},
+		{"udp", "10.54.213.165", "80", "", false},
+		{"tcp", "10.54.213.166", "80", "", false},
+	} {
+		f, err := newCtFilter(c.protocol, c.vip, c.port, c.backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.matches(e) != c.matches {
+			t.Errorf("expected %s %s:%s backend=%q to match %v", c.protocol, c.vip, c.port, c.backend, c.matches)
+		}
+	}
+
+	// the entry is deleted by the tuple and zone it was dumped with
+	req := ctMessage(ipctnlMsgCtDelete, syscall.NLM_F_REQUEST|syscall.NLM_F_ACK, 2, syscall.AF_INET, ctDeleteAttrs(e)...)
+	msgs, err = syscall.ParseNetlinkMessage(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs[0].Header.Type != nfnlSubsysCtnetlink<<8|ipctnlMsgCtDelete {
+		t.Fatalf("unexpected message type %#x", msgs[0].Header.Type)
+	}
+	attrs := ctAttrs(msgs[0].Data[sizeofNfgenmsg:])
+	if !bytes.Equal(attrs[ctaTupleOrig], orig) || !bytes.Equal(attrs[ctaZone], zone) {
+		t.Fatalf("expected the delete to carry the original tuple and zone. have %v", attrs)
+	}
+	if _, ok := attrs[ctaTupleReply]; ok {
+		t.Fatal("expected the delete to carry only the original tuple")
+	}
+}
+
+func TestParseCtEntryIPv6(t *testing.T) {
+	orig := ctTuple(syscall.IPPROTO_UDP, "2001:558::9", "2001:558:1044:1ae::7", 40000, 53)
+	reply := ctTuple(syscall.IPPROTO_UDP, "2001:558:1044:1ae::100", "2001:558::9", 53, 40000)
+	msg := netlinkMessage(nfnlSubsysCtnetlink<<8|0, []byte{syscall.AF_INET6, 0, 0, 0},
+		netlinkAttr{ctaTupleOrig | nlaFNested, orig},
+		netlinkAttr{ctaTupleReply | nlaFNested, reply},
+	)
+	msgs, _ := syscall.ParseNetlinkMessage(msg)
+	e, ok := parseCtEntry(msgs[0].Data)
+	if !ok {
+		t.Fatal("expected the entry to be parsed")
+	}
+	f, _ := newCtFilter("udp", "2001:558:1044:1ae::7", "53", "2001:558:1044:1ae::100")
+	if !f.matches(e) {
+		t.Fatalf("expected %+v to match", e)
+	}
+	if e.zone != nil {
+		t.Fatal("expected no zone")
+	}
+
+	// a message without an original tuple is no entry
+	if _, ok := parseCtEntry([]byte{syscall.AF_INET6, 0, 0, 0}); ok {
+		t.Fatal("expected a message without a tuple to be skipped")
+	}
+}
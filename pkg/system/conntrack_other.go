@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package system
+
+import "fmt"
+
+// deleteConntrack returns an error, as conntrack entries are only deleted
+// over ctnetlink on linux
+func deleteConntrack(f ctFilter) (int, error) {
+	return 0, fmt.Errorf("conntrack entries can only be deleted on linux")
+}
@@ -0,0 +1,118 @@
+package system
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// drainMetrics records the nodes the node drain is ramping down
+type drainMetrics interface {
+	NodeDraining(node string, draining bool)
+}
+
+// nodeDrain ramps the weight of draining nodes down to 0, so that they lose new
+// connections gradually and keep their established ones, rather than dropping
+// out of the pools once their endpoints are gone
+type nodeDrain struct {
+	sync.Mutex
+
+	ramp    time.Duration
+	now     func() time.Time
+	logger  log.FieldLogger
+	metrics drainMetrics
+
+	// since is when each draining node was first seen draining, by name, and
+	// byAddress the same by each of its backend addresses
+	since     map[string]time.Time
+	byAddress map[string]time.Time
+}
+
+// SetNodeDrain ramps the weight of a node that is cordoned, or annotated with
+// ravel.comcast.com/drain=true, down to 0 over ramp, in every pool it is a
+// backend of. The weight follows the ramp with each parity check, and comes
+// back in full once the node is no longer draining. As every director watches
+// the nodes, the whole fleet drains a node together.
+//
+// Cordoned nodes stay eligible backends, whatever the cordon setting, so that
+// they are ramped down rather than removed. A drain starts when this process
+// first sees it, so a director that restarts mid-drain ramps down anew.
+func (i *IPVS) SetNodeDrain(ramp time.Duration, metrics drainMetrics) {
+	i.ignoreCordon = true
+	i.drain = &nodeDrain{
+		ramp:      ramp,
+		now:       time.Now,
+		logger:    i.logger,
+		metrics:   metrics,
+		since:     map[string]time.Time{},
+		byAddress: map[string]time.Time{},
+	}
+	i.logger.Infof("ipvs: ramping the weight of draining nodes down to 0 over %v", ramp)
+}
+
+// observe records which of nodes are draining, and since when
+func (d *nodeDrain) observe(nodes []*v1.Node) {
+	if d == nil {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+
+	now := d.now()
+	since := map[string]time.Time{}
+	byAddress := map[string]time.Time{}
+	for _, n := range nodes {
+		if !types.IsDraining(n) {
+			continue
+		}
+		started, ok := d.since[n.Name]
+		if !ok {
+			started = now
+			d.logger.Infof("ipvs: node %s is draining. ramping its weight down to 0 over %v", n.Name, d.ramp)
+			if d.metrics != nil {
+				d.metrics.NodeDraining(n.Name, true)
+			}
+		}
+		since[n.Name] = started
+		for _, v6 := range []bool{false, true} {
+			if address, err := backendAddress(n, v6); err == nil {
+				byAddress[address] = started
+			}
+		}
+	}
+	for name := range d.since {
+		if _, ok := since[name]; !ok {
+			d.logger.Infof("ipvs: node %s is no longer draining. restoring its weight", name)
+			if d.metrics != nil {
+				d.metrics.NodeDraining(name, false)
+			}
+		}
+	}
+	d.since = since
+	d.byAddress = byAddress
+}
+
+// weight returns weight scaled down by how far along its ramp the node at
+// backend is, and weight itself for a node that isn't draining
+func (d *nodeDrain) weight(backend string, weight int) int {
+	if d == nil {
+		return weight
+	}
+	d.Lock()
+	defer d.Unlock()
+
+	started, ok := d.byAddress[backend]
+	if !ok {
+		return weight
+	}
+	left := d.ramp - d.now().Sub(started)
+	if left <= 0 {
+		return 0
+	}
+	return int(math.Ceil(float64(weight) * float64(left) / float64(d.ramp)))
+}
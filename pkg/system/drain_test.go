@@ -0,0 +1,74 @@
+package system
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+func TestNodeDrain(t *testing.T) {
+	now := time.Unix(1000, 0)
+	metrics := newFakeMetrics()
+	i := &IPVS{logger: logrus.New()}
+	i.SetNodeDrain(time.Minute, metrics)
+	i.drain.now = func() time.Time { return now }
+
+	if !i.ignoreCordon {
+		t.Fatal("expected cordoned nodes to stay eligible backends while draining")
+	}
+
+	cordoned := testNode("cordoned", "10.0.0.1", nil)
+	cordoned.Spec.Unschedulable = true
+	annotated := testNode("annotated", "10.0.0.2", nil)
+	annotated.Annotations = map[string]string{types.DrainAnnotation: "true"}
+	serving := testNode("serving", "10.0.0.3", nil)
+	nodes := []*v1.Node{cordoned, annotated, serving}
+
+	i.drain.observe(nodes)
+	expected := map[string]bool{"cordoned": true, "annotated": true}
+	if !reflect.DeepEqual(metrics.state, expected) {
+		t.Fatalf("expected %v to be draining. have %v", expected, metrics.state)
+	}
+	if w := i.backendWeight("10.0.0.1", 10); w != 10 {
+		t.Fatalf("expected a drain to start at full weight. have %d", w)
+	}
+
+	// halfway down the ramp, rounding up so the node keeps some weight until
+	// the ramp is over
+	now = now.Add(30 * time.Second)
+	i.drain.observe(nodes)
+	if w := i.backendWeight("10.0.0.2", 3); w != 2 {
+		t.Fatalf("expected the weight halfway down the ramp. have %d", w)
+	}
+	if w := i.backendWeight("10.0.0.3", 3); w != 3 {
+		t.Fatalf("expected a node that isn't draining to keep its weight. have %d", w)
+	}
+
+	now = now.Add(30 * time.Second)
+	i.drain.observe(nodes)
+	if w := i.backendWeight("10.0.0.1", 10); w != 0 {
+		t.Fatalf("expected no weight at the end of the ramp. have %d", w)
+	}
+
+	// an uncordoned node gets its weight back at once
+	cordoned.Spec.Unschedulable = false
+	i.drain.observe(nodes)
+	if w := i.backendWeight("10.0.0.1", 10); w != 10 {
+		t.Fatalf("expected an uncordoned node to get its weight back. have %d", w)
+	}
+	if metrics.state["cordoned"] || !metrics.state["annotated"] {
+		t.Fatalf("expected only the annotated node to be draining. have %v", metrics.state)
+	}
+
+	// a drain that starts again ramps down anew
+	cordoned.Spec.Unschedulable = true
+	i.drain.observe(nodes)
+	if w := i.backendWeight("10.0.0.1", 10); w != 10 {
+		t.Fatalf("expected a new drain to start at full weight. have %d", w)
+	}
+}
@@ -0,0 +1,252 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ejectionMaxBackoff is how many times its ejection duration a backend that
+// keeps failing its recovery probe is ejected for at most
+const ejectionMaxBackoff = 8
+
+// ejectionMetrics records the backends passive ejection has taken out of service
+type ejectionMetrics interface {
+	BackendEjected(backend string, ejected bool)
+}
+
+// EjectionConfig configures the passive ejection of backends, see SetEjection
+type EjectionConfig struct {
+	// Interval is how often the IPVS connection table is sampled
+	Interval time.Duration
+	// A backend is ejected once at least MinFailures of its connections in a
+	// sample, and at least FailurePercent of them, failed
+	MinFailures    int
+	FailurePercent int
+	// Duration is how long a backend stays ejected before it is probed. It
+	// doubles every time the probe fails, up to 8 times Duration.
+	Duration time.Duration
+	// MaxPercent is the largest share of the backends that are ejected at once
+	MaxPercent int
+}
+
+// connCounts are the connections to a backend in a sample of the IPVS
+// connection table, and those of them that failed
+type connCounts struct {
+	total  int
+	failed int
+}
+
+// ejectedBackend is a backend taken out of service until it is probed again
+type ejectedBackend struct {
+	until    time.Time
+	duration time.Duration
+}
+
+// ejection takes backends whose connections fail out of service, complementing
+// the active probes of adaptive weighting with what the clients see. An ejected
+// backend is given a weight of 0, which keeps its established connections but
+// sends it no new ones.
+type ejection struct {
+	sync.Mutex
+
+	config  EjectionConfig
+	sample  func(ctx context.Context) (map[string]connCounts, error)
+	probe   func(ctx context.Context, address string) error
+	logger  log.FieldLogger
+	metrics ejectionMetrics
+
+	// ejected is keyed by the address and port of the backend, i.e. 10.131.153.76:80
+	ejected map[string]ejectedBackend
+}
+
+// SetEjection samples the IPVS connection table every config.Interval until the
+// IPVS manager's context is done, and ejects backends whose connections fail.
+// With direct routing the director only sees the client side of a connection,
+// so a backend that resets or refuses connections leaves them in SYN_RECV, the
+// client never completing the handshake, or in CLOSE. An ejected backend is
+// probed with a tcp connection once its ejection ends, and gets new connections
+// again when the probe succeeds. No more than config.MaxPercent of the backends
+// are ejected at once, the worst first.
+func (i *IPVS) SetEjection(config EjectionConfig, metrics ejectionMetrics) {
+	dialer := &net.Dialer{}
+	timeout := config.Interval / 2
+	if timeout > 2*time.Second {
+		timeout = 2 * time.Second
+	}
+	i.ejection = &ejection{
+		config: config,
+		sample: i.readConnStates,
+		probe: func(ctx context.Context, address string) error {
+			dialCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			conn, err := dialer.DialContext(dialCtx, "tcp", address)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		},
+		logger:  i.logger,
+		metrics: metrics,
+		ejected: map[string]ejectedBackend{},
+	}
+	go i.ejection.run(i.ctx)
+}
+
+// readConnStates samples the IPVS connection table
+func (i *IPVS) readConnStates(ctx context.Context) (map[string]connCounts, error) {
+	cmdCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	out, err := i.runner.Run(cmdCtx, nil, "ipvsadm", "-Lnc")
+	if err != nil {
+		return nil, fmt.Errorf("ipvs: ipvsadm -Lnc failed with %v", err)
+	}
+	return parseConnStates(string(out)), nil
+}
+
+// parseConnStates counts the tcp connections of `ipvsadm -Lnc` by destination,
+// and those of them in SYN_RECV or CLOSE, i.e.
+//
+//	TCP 00:57  SYN_RECV    10.0.0.1:51234     10.54.213.165:80   10.131.153.76:80
+func parseConnStates(out string) map[string]connCounts {
+	counts := map[string]connCounts{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 6 || fields[0] != "TCP" {
+			continue
+		}
+		c := counts[fields[5]]
+		c.total++
+		if fields[2] == "SYN_RECV" || fields[2] == "CLOSE" {
+			c.failed++
+		}
+		counts[fields[5]] = c
+	}
+	return counts
+}
+
+// weight returns 0 for an ejected backend, and weight for any other
+func (e *ejection) weight(backend string, weight int) int {
+	if e == nil {
+		return weight
+	}
+	e.Lock()
+	defer e.Unlock()
+	if _, ok := e.ejected[backend]; ok {
+		return 0
+	}
+	return weight
+}
+
+func (e *ejection) run(ctx context.Context) {
+	e.logger.Infof("ipvs: ejecting backends with %d or more failed connections, %d%% of theirs, sampled every %v", e.config.MinFailures, e.config.FailurePercent, e.config.Interval)
+
+	ticker := time.NewTicker(e.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.measure(ctx, time.Now())
+		}
+	}
+}
+
+// measure probes the backends whose ejection has ended and ejects those that
+// fail in a new sample. The director picks the change up with its next parity
+// check.
+func (e *ejection) measure(ctx context.Context, now time.Time) {
+	counts, err := e.sample(ctx)
+	if err != nil {
+		e.logger.Warnf("ipvs: unable to sample connections for ejection. %v", err)
+		return
+	}
+
+	e.Lock()
+	due := map[string]ejectedBackend{}
+	for backend, ej := range e.ejected {
+		if !now.Before(ej.until) {
+			due[backend] = ej
+		}
+	}
+	e.Unlock()
+
+	// the probes run without the lock, as rules are generated with it
+	recovered := map[string]bool{}
+	for backend := range due {
+		if err := e.probe(ctx, backend); err != nil {
+			e.logger.Debugf("ipvs: recovery probe of ejected backend %s failed. %v", backend, err)
+			continue
+		}
+		recovered[backend] = true
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	for backend, ej := range due {
+		if recovered[backend] {
+			e.logger.Infof("ipvs: ejected backend %s answered its recovery probe. sending it new connections again", backend)
+			delete(e.ejected, backend)
+			e.record(backend, false)
+			continue
+		}
+		ej.duration *= 2
+		if max := e.config.Duration * ejectionMaxBackoff; ej.duration > max {
+			ej.duration = max
+		}
+		ej.until = now.Add(ej.duration)
+		e.ejected[backend] = ej
+	}
+
+	candidates := []string{}
+	for backend, c := range counts {
+		if _, ok := e.ejected[backend]; ok || recovered[backend] {
+			continue
+		}
+		if c.failed >= e.config.MinFailures && c.failed*100 >= c.total*e.config.FailurePercent {
+			candidates = append(candidates, backend)
+		}
+	}
+	sort.Slice(candidates, func(n, m int) bool {
+		if counts[candidates[n]].failed != counts[candidates[m]].failed {
+			return counts[candidates[n]].failed > counts[candidates[m]].failed
+		}
+		return candidates[n] < candidates[m]
+	})
+
+	backends := len(counts)
+	for backend := range e.ejected {
+		if _, ok := counts[backend]; !ok {
+			backends++
+		}
+	}
+	limit := backends*e.config.MaxPercent/100 - len(e.ejected)
+	if limit < 0 {
+		limit = 0
+	}
+	if len(candidates) > limit {
+		e.logger.Warnf("ipvs: %d backends are failing connections, but only %d more of %d may be ejected", len(candidates), limit, backends)
+		candidates = candidates[:limit]
+	}
+
+	for _, backend := range candidates {
+		c := counts[backend]
+		e.logger.Warnf("ipvs: backend %s failed %d of %d sampled connections. sending it no new connections for %v", backend, c.failed, c.total, e.config.Duration)
+		e.ejected[backend] = ejectedBackend{until: now.Add(e.config.Duration), duration: e.config.Duration}
+		e.record(backend, true)
+	}
+}
+
+func (e *ejection) record(backend string, ejected bool) {
+	if e.metrics != nil {
+		e.metrics.BackendEjected(backend, ejected)
+	}
+}
@@ -0,0 +1,76 @@
+package system
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+const ipvsConns = `IPVS connection entries
+pro expire state       source             virtual            destination
+TCP 00:57  SYN_RECV    10.0.0.1:51234     10.54.213.165:80   10.131.153.76:80
+TCP 00:55  SYN_RECV    10.0.0.2:51234     10.54.213.165:80   10.131.153.76:80
+TCP 00:09  CLOSE       10.0.0.3:51234     10.54.213.165:80   10.131.153.76:80
+TCP 14:59  ESTABLISHED 10.0.0.4:51234     10.54.213.165:80   10.131.153.76:80
+TCP 00:57  SYN_RECV    10.0.0.5:51234     10.54.213.165:80   10.131.153.77:80
+TCP 14:59  ESTABLISHED 10.0.0.6:51234     10.54.213.165:80   10.131.153.77:80
+TCP 14:59  ESTABLISHED 10.0.0.7:51234     10.54.213.165:80   10.131.153.77:80
+TCP 00:57  SYN_RECV    10.0.0.8:51234     10.54.213.165:80   10.131.153.78:80
+TCP 00:57  SYN_RECV    10.0.0.9:51234     10.54.213.165:80   10.131.153.78:80
+TCP 00:57  SYN_RECV    10.0.0.10:51234    10.54.213.165:80   10.131.153.78:80
+UDP 04:59  UDP         10.0.0.11:53       10.54.213.165:53   10.131.153.79:53
+`
+
+func TestEjection(t *testing.T) {
+	runner := NewRecordingCommandRunner()
+	runner.Respond("ipvsadm -Lnc", ipvsConns, nil)
+	metrics := newFakeMetrics()
+	probes := map[string]error{}
+	i := &IPVS{ctx: context.Background(), logger: logrus.New(), runner: runner}
+	i.ejection = &ejection{
+		config:  EjectionConfig{Interval: time.Second, MinFailures: 3, FailurePercent: 50, Duration: 10 * time.Second, MaxPercent: 34},
+		sample:  i.readConnStates,
+		probe:   func(_ context.Context, address string) error { return probes[address] },
+		logger:  i.logger,
+		metrics: metrics,
+		ejected: map[string]ejectedBackend{},
+	}
+
+	// .76 failed 3 of 4 connections and .78 all 3, but only one of the three
+	// backends may be ejected. .77 failed too few.
+	now := time.Now()
+	i.ejection.measure(context.Background(), now)
+	if expected := map[string]bool{"10.131.153.76:80": true}; !reflect.DeepEqual(metrics.state, expected) {
+		t.Fatalf("expected %v to be ejected. have %v", expected, metrics.state)
+	}
+	if w := i.realWeight("10.54.213.165", "80", "10.131.153.76", "80", 3, &types.ServiceDef{}); w != 0 {
+		t.Fatalf("expected an ejected backend to get no new connections. have weight %d", w)
+	}
+	if w := i.realWeight("10.54.213.165", "443", "10.131.153.76", "443", 3, &types.ServiceDef{}); w != 3 {
+		t.Fatalf("expected the other ports of an ejected backend to keep their weight. have %d", w)
+	}
+
+	// a backend that fails its recovery probe is ejected for twice as long
+	probes["10.131.153.76:80"] = errors.New("connection refused")
+	i.ejection.measure(context.Background(), now.Add(10*time.Second))
+	if ej := i.ejection.ejected["10.131.153.76:80"]; ej.duration != 20*time.Second {
+		t.Fatalf("expected the ejection to back off to 20s. have %v", ej.duration)
+	}
+
+	// and returns once it answers
+	delete(probes, "10.131.153.76:80")
+	runner.Respond("ipvsadm -Lnc", "", nil)
+	i.ejection.measure(context.Background(), now.Add(30*time.Second))
+	if metrics.state["10.131.153.76:80"] {
+		t.Fatalf("expected the backend to return after its probe succeeded. have %v", metrics.state)
+	}
+	if w := i.realWeight("10.54.213.165", "80", "10.131.153.76", "80", 3, &types.ServiceDef{}); w != 3 {
+		t.Fatalf("expected a recovered backend to get its weight back. have %d", w)
+	}
+}
@@ -0,0 +1,315 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// FakeIPVS is an in-memory IPVSExecutor for tests. Rules passed to Set are
+// applied to Rules as ipvsadm -R would, and every SetIPVS call is recorded.
+type FakeIPVS struct {
+	sync.Mutex
+
+	Rules []string
+
+	// Parity is returned by CheckConfigParity
+	Parity bool
+
+	// SetIPVSCalls records the ipType of every SetIPVS call
+	SetIPVSCalls []string
+	Teardowns    int
+
+	// Err, when set, is returned by every operation
+	Err error
+}
+
+// NewFakeIPVS creates an empty FakeIPVS
+func NewFakeIPVS() *FakeIPVS {
+	return &FakeIPVS{Rules: []string{}}
+}
+
+func (f *FakeIPVS) Get() ([]string, error) {
+	f.Lock()
+	defer f.Unlock()
+	out := []string{}
+	for _, r := range f.Rules {
+		if !strings.Contains(r, "[") {
+			out = append(out, r)
+		}
+	}
+	return out, f.Err
+}
+
+func (f *FakeIPVS) GetV6() ([]string, error) {
+	f.Lock()
+	defer f.Unlock()
+	out := []string{}
+	for _, r := range f.Rules {
+		if strings.Contains(r, "[") {
+			out = append(out, r)
+		}
+	}
+	return out, f.Err
+}
+
+// Set applies add (-A, -a), edit (-e) and delete (-D, -d) rules to the in-memory rule set
+func (f *FakeIPVS) Set(rules []string) ([]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	existing := map[string]string{}
+	for _, r := range f.Rules {
+		existing[fakeIPVSRuleKey(r)] = r
+	}
+	for _, r := range rules {
+		r = strings.TrimSpace(r)
+		switch {
+		case strings.HasPrefix(r, "-A"), strings.HasPrefix(r, "-a"):
+			existing[fakeIPVSRuleKey(r)] = r
+		case strings.HasPrefix(r, "-e"):
+			r = strings.Replace(r, "-e", "-a", 1)
+			existing[fakeIPVSRuleKey(r)] = r
+		case strings.HasPrefix(r, "-D"):
+			service := fakeIPVSService(r)
+			for k := range existing {
+				if fakeIPVSService(k) == service {
+					delete(existing, k)
+				}
+			}
+		case strings.HasPrefix(r, "-d"):
+			delete(existing, fakeIPVSRuleKey(strings.Replace(r, "-d", "-a", 1)))
+		}
+	}
+
+	f.Rules = []string{}
+	for _, r := range existing {
+		f.Rules = append(f.Rules, r)
+	}
+	sort.Sort(ipvsRules(f.Rules))
+	return []byte{}, nil
+}
+
+// fakeIPVSService returns the service portion of a rule, i.e. `-t 10.1.2.3:80`
+func fakeIPVSService(rule string) string {
+	fields := strings.Fields(rule)
+	if len(fields) < 3 {
+		return rule
+	}
+	return fields[1] + " " + fields[2]
+}
+
+// fakeIPVSRuleKey identifies a rule by its service and realserver, ignoring weights and flags
+func fakeIPVSRuleKey(rule string) string {
+	fields := strings.Fields(rule)
+	if len(fields) < 3 {
+		return rule
+	}
+	key := strings.ToLower(fields[0]) + " " + fields[1] + " " + fields[2]
+	for n := 3; n < len(fields)-1; n++ {
+		if fields[n] == "-r" {
+			key += " -r " + fields[n+1]
+		}
+	}
+	return key
+}
+
+func (f *FakeIPVS) Teardown(ctx context.Context) error {
+	f.Lock()
+	defer f.Unlock()
+	f.Teardowns++
+	f.Rules = []string{}
+	return f.Err
+}
+
+func (f *FakeIPVS) SetIPVS(w *watcher.Watcher, config *types.ClusterConfig, logger log.FieldLogger, ipType string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.SetIPVSCalls = append(f.SetIPVSCalls, ipType)
+	return f.Err
+}
+
+func (f *FakeIPVS) CheckConfigParity(w *watcher.Watcher, config *types.ClusterConfig, addresses []string) (bool, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.Parity, f.Err
+}
+
+// FakeIP is an in-memory AddressManager for tests. Devices are named the same
+// way IP names them, so Compare4 and Compare6 behave as they do in production.
+type FakeIP struct {
+	sync.Mutex
+
+	// Devices maps device name to the address it carries
+	Devices map[string]string
+	MTUs    map[types.ServiceIP]string
+
+	// Routes are the return routes of both families
+	Routes map[types.ServiceIP]types.ReturnRoute
+
+	// Advertised records every address passed to AdvertiseMacAddress or AdvertiseNeighbor
+	Advertised []string
+
+	// Err, when set, is returned by every operation
+	Err error
+
+	ip *IP
+}
+
+// NewFakeIP creates a FakeIP with no devices
+func NewFakeIP() *FakeIP {
+	return &FakeIP{
+		Devices: map[string]string{},
+		MTUs:    map[types.ServiceIP]string{},
+		Routes:  map[types.ServiceIP]types.ReturnRoute{},
+		ip:      &IP{},
+	}
+}
+
+func (f *FakeIP) Get() ([]string, []string, error) {
+	f.Lock()
+	defer f.Unlock()
+	devices := []string{}
+	for d := range f.Devices {
+		devices = append(devices, d)
+	}
+	v4, v6 := f.ip.parseAddressData(devices)
+	return v4, v6, f.Err
+}
+
+func (f *FakeIP) Device(addr string, isV6 bool) string {
+	return f.ip.generateDeviceLabel(addr, isV6)
+}
+
+func (f *FakeIP) Add(addr string) error {
+	return f.add(addr, false)
+}
+
+func (f *FakeIP) Add6(addr string) error {
+	return f.add(addr, true)
+}
+
+func (f *FakeIP) add(addr string, isV6 bool) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.Devices[f.ip.generateDeviceLabel(addr, isV6)] = addr
+	return nil
+}
+
+// Del removes a device. Like the production code, the device may be given in
+// its dotted form.
+func (f *FakeIP) Del(device string) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	delete(f.Devices, device)
+	delete(f.Devices, strings.Replace(device, ".", "_", -1))
+	return nil
+}
+
+func (f *FakeIP) SetMTU(config map[types.ServiceIP]string, isIP6 bool) error {
+	f.Lock()
+	defer f.Unlock()
+	for k, v := range config {
+		f.MTUs[k] = v
+	}
+	return f.Err
+}
+
+// SetReturnRoutes replaces the routes of one family
+func (f *FakeIP) SetReturnRoutes(routes map[types.ServiceIP]types.ReturnRoute, isIP6 bool) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	for vip := range f.Routes {
+		if strings.Contains(string(vip), ":") == isIP6 {
+			delete(f.Routes, vip)
+		}
+	}
+	for vip, r := range routes {
+		f.Routes[vip] = r
+	}
+	return nil
+}
+
+func (f *FakeIP) AdvertiseMacAddress(addr string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.Advertised = append(f.Advertised, addr)
+	return f.Err
+}
+
+func (f *FakeIP) AdvertiseNeighbor(addr string) error {
+	return f.AdvertiseMacAddress(addr)
+}
+
+func (f *FakeIP) SetRPFilter() error { return f.Err }
+func (f *FakeIP) SetARP() error      { return f.Err }
+
+func (f *FakeIP) Compare4(configured, desired []string) ([]string, []string) {
+	return f.ip.Compare(configured, desired, false)
+}
+
+func (f *FakeIP) Compare6(configured, desired []string) ([]string, []string) {
+	return f.ip.Compare(configured, desired, true)
+}
+
+func (f *FakeIP) Teardown(ctx context.Context, config4 map[types.ServiceIP]types.PortMap, config6 map[types.ServiceIP]types.PortMap) error {
+	return f.Err
+}
+
+var _ IPVSExecutor = &FakeIPVS{}
+var _ AddressManager = &FakeIP{}
+
+// FakeSysctl is an in-memory Sysctl for tests
+type FakeSysctl struct {
+	sync.Mutex
+
+	Values map[string]string
+
+	// Sets counts the writes
+	Sets int
+}
+
+// NewFakeSysctl creates a FakeSysctl holding values
+func NewFakeSysctl(values map[string]string) *FakeSysctl {
+	if values == nil {
+		values = map[string]string{}
+	}
+	return &FakeSysctl{Values: values}
+}
+
+func (f *FakeSysctl) Get(name string) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	v, ok := f.Values[name]
+	if !ok {
+		return "", fmt.Errorf("sysctl: %s does not exist", name)
+	}
+	return v, nil
+}
+
+func (f *FakeSysctl) Set(name, value string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.Sets++
+	f.Values[name] = value
+	return nil
+}
@@ -0,0 +1,52 @@
+package system
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeMetrics records the reports of the drain, ejection, last backend and
+// saturation guards. state is the last report of each node, backend or
+// service, and calls every report in order.
+type fakeMetrics struct {
+	state map[string]bool
+	calls []string
+}
+
+func newFakeMetrics() *fakeMetrics {
+	return &fakeMetrics{state: map[string]bool{}}
+}
+
+func (f *fakeMetrics) record(call, key string, value bool) {
+	f.state[key] = value
+	f.calls = append(f.calls, fmt.Sprintf("%s %s %v", call, key, value))
+}
+
+func (f *fakeMetrics) NodeDraining(node string, draining bool) {
+	f.record("NodeDraining", node, draining)
+}
+
+func (f *fakeMetrics) BackendEjected(backend string, ejected bool) {
+	f.record("BackendEjected", backend, ejected)
+}
+
+func (f *fakeMetrics) LastBackendGuarded(service, policy string, guarded bool) {
+	f.record("LastBackendGuarded "+policy, service, guarded)
+}
+
+func (f *fakeMetrics) BackendSaturated(backend string, saturated bool) {
+	f.record("BackendSaturated", backend, saturated)
+}
+
+// testNode is a ready node with the internal address and labels
+func testNode(name, address string, labels map[string]string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: address}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	}
+}
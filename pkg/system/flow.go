@@ -0,0 +1,507 @@
+package system
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+const (
+	// ipfixVersion is the version number of an IPFIX message header
+	ipfixVersion = 10
+	// ipfixTemplateSet is the set id of a template set
+	ipfixTemplateSet = 2
+	// ipfixTemplate4 and ipfixTemplate6 are the templates of v4 and v6 flows
+	ipfixTemplate4 = 256
+	ipfixTemplate6 = 257
+	// ipfixMaxMessage keeps messages within the MTU of the path to the collector
+	ipfixMaxMessage = 1400
+)
+
+// ipfixField is an information element of a template, see RFC 7012
+type ipfixField struct {
+	id     uint16
+	length uint16
+}
+
+// the information elements of the flow templates, in the order of the records
+var (
+	ipfixFields4 = []ipfixField{
+		{8, 4},   // sourceIPv4Address
+		{7, 2},   // sourceTransportPort
+		{12, 4},  // destinationIPv4Address
+		{11, 2},  // destinationTransportPort
+		{4, 1},   // protocolIdentifier
+		{226, 4}, // postNATDestinationIPv4Address
+		{1, 8},   // octetDeltaCount
+		{2, 8},   // packetDeltaCount
+	}
+	ipfixFields6 = []ipfixField{
+		{27, 16},  // sourceIPv6Address
+		{7, 2},    // sourceTransportPort
+		{28, 16},  // destinationIPv6Address
+		{11, 2},   // destinationTransportPort
+		{4, 1},    // protocolIdentifier
+		{282, 16}, // postNATDestinationIPv6Address
+		{1, 8},    // octetDeltaCount
+		{2, 8},    // packetDeltaCount
+	}
+)
+
+// flowMetrics records the records the flow exporter sends
+type flowMetrics interface {
+	FlowsExported(records int, err error)
+}
+
+// flowKey identifies a connection to a VIP port by its original direction
+type flowKey struct {
+	protocol   string
+	client     string
+	clientPort int
+	vip        string
+	vipPort    int
+}
+
+// flowCounters are the packets and bytes a connection has moved from the client
+type flowCounters struct {
+	packets uint64
+	bytes   uint64
+}
+
+// Flow is the traffic of a connection to a VIP port since the last sample
+type Flow struct {
+	Protocol   string
+	Client     net.IP
+	ClientPort int
+	VIP        net.IP
+	VIPPort    int
+	// Backend is the real the connection was scheduled to, nil when neither
+	// conntrack nor IPVS knows it
+	Backend net.IP
+	Packets uint64
+	Bytes   uint64
+}
+
+// FlowExporter samples the connection tracking entries of the VIP ports that
+// enable flowExport and sends the traffic each connection moved since the
+// last sample as IPFIX records to a collector over UDP. Byte and packet counts
+// need net.netfilter.nf_conntrack_acct=1. The backend comes from the reply
+// direction of the entry when IPVS NATs the connection, and from the IPVS
+// connection table otherwise. Traffic moved by a connection after its last
+// sample isn't exported.
+type FlowExporter struct {
+	ctx      context.Context
+	logger   log.FieldLogger
+	runner   CommandRunner
+	metrics  flowMetrics
+	interval time.Duration
+
+	// sampleRate exports one in every sampleRate connections, picked by a hash
+	// of the connection so that a connection is always or never exported
+	sampleRate int
+	config     func() *types.ClusterConfig
+
+	collector string
+	conn      net.Conn
+	domain    uint32
+	sequence  uint32
+
+	last map[flowKey]flowCounters
+}
+
+// NewFlowExporter creates a FlowExporter that sends to collector, a host:port,
+// every interval once Run is called. nodeIP identifies the director to the
+// collector as the observation domain of the messages.
+func NewFlowExporter(ctx context.Context, collector string, interval time.Duration, sampleRate int, nodeIP string, config func() *types.ClusterConfig, metrics flowMetrics, logger log.FieldLogger) *FlowExporter {
+	if sampleRate < 1 {
+		sampleRate = 1
+	}
+	domain := uint32(0)
+	if ip := net.ParseIP(nodeIP).To4(); ip != nil {
+		domain = binary.BigEndian.Uint32(ip)
+	}
+	return &FlowExporter{
+		ctx:        ctx,
+		logger:     logger,
+		runner:     execCommandRunner{},
+		metrics:    metrics,
+		interval:   interval,
+		sampleRate: sampleRate,
+		config:     config,
+		collector:  collector,
+		domain:     domain,
+		last:       map[flowKey]flowCounters{},
+	}
+}
+
+// SetCommandRunner replaces the runner used to execute conntrack and ipvsadm
+func (e *FlowExporter) SetCommandRunner(r CommandRunner) {
+	e.runner = r
+}
+
+// Run samples and exports the flows every interval until the context is done
+func (e *FlowExporter) Run() {
+	e.logger.Infof("flow: exporting flows of VIP ports with flowExport set to %s every %v, sampling 1 in %d connections", e.collector, e.interval, e.sampleRate)
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.ctx.Done():
+			if e.conn != nil {
+				e.conn.Close()
+			}
+			return
+		case <-ticker.C:
+			n, err := e.export()
+			if err != nil {
+				e.logger.Warnf("flow: unable to export flows. %v", err)
+			}
+			if e.metrics != nil {
+				e.metrics.FlowsExported(n, err)
+			}
+		}
+	}
+}
+
+// export samples the flows and sends them, returning the records sent
+func (e *FlowExporter) export() (int, error) {
+	flows, err := e.Sample()
+	if err != nil || len(flows) == 0 {
+		return 0, err
+	}
+	if e.conn == nil {
+		if e.conn, err = net.Dial("udp", e.collector); err != nil {
+			return 0, fmt.Errorf("unable to reach collector %s. %v", e.collector, err)
+		}
+	}
+	for _, message := range e.Encode(flows, time.Now()) {
+		if _, err := e.conn.Write(message); err != nil {
+			return 0, fmt.Errorf("unable to send to collector %s. %v", e.collector, err)
+		}
+	}
+	return len(flows), nil
+}
+
+// Sample reads the connection tracking entries of both families and returns
+// the traffic of the exported connections since the last sample. Connections
+// that moved nothing are left out.
+func (e *FlowExporter) Sample() ([]Flow, error) {
+	ports := exportedPorts(e.config())
+	if len(ports) == 0 {
+		e.last = map[flowKey]flowCounters{}
+		return nil, nil
+	}
+
+	cmdCtx, cancel := context.WithTimeout(e.ctx, 10*time.Second)
+	defer cancel()
+
+	entries := []conntrackEntry{}
+	for _, family := range []string{"ipv4", "ipv6"} {
+		out, err := e.runner.Run(cmdCtx, nil, "conntrack", "-L", "-f", family)
+		if err != nil && !strings.Contains(string(out), "0 flow entries") {
+			return nil, fmt.Errorf("conntrack -L -f %s failed with %v", family, err)
+		}
+		entries = append(entries, parseConntrackEntries(string(out))...)
+	}
+
+	// the ipvs connection table only matters for backends conntrack doesn't know
+	var backends map[flowKey]string
+	flows := []Flow{}
+	seen := map[flowKey]flowCounters{}
+	for _, entry := range entries {
+		k := entry.key
+		if !ports[net.JoinHostPort(k.vip, strconv.Itoa(k.vipPort))] || !e.sampled(k) {
+			continue
+		}
+		seen[k] = entry.counters
+
+		last := e.last[k]
+		delta := entry.counters
+		// a smaller count is a new connection reusing the tuple
+		if delta.bytes >= last.bytes && delta.packets >= last.packets {
+			delta.bytes -= last.bytes
+			delta.packets -= last.packets
+		}
+		if delta.bytes == 0 && delta.packets == 0 {
+			continue
+		}
+
+		backend := entry.backend
+		if backend == "" {
+			if backends == nil {
+				backends = e.ipvsBackends(cmdCtx)
+			}
+			backend = backends[k]
+		}
+		flows = append(flows, Flow{
+			Protocol:   k.protocol,
+			Client:     net.ParseIP(k.client),
+			ClientPort: k.clientPort,
+			VIP:        net.ParseIP(k.vip),
+			VIPPort:    k.vipPort,
+			Backend:    net.ParseIP(backend),
+			Packets:    delta.packets,
+			Bytes:      delta.bytes,
+		})
+	}
+	e.last = seen
+	return flows, nil
+}
+
+// sampled reports whether the connection is one of those exported
+func (e *FlowExporter) sampled(k flowKey) bool {
+	if e.sampleRate <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s %s %d %s %d", k.protocol, k.client, k.clientPort, k.vip, k.vipPort)
+	return h.Sum32()%uint32(e.sampleRate) == 0
+}
+
+// ipvsBackends reads the destinations of the IPVS connections, keyed by
+// connection. Failures leave the backends unknown.
+func (e *FlowExporter) ipvsBackends(ctx context.Context) map[flowKey]string {
+	out, err := e.runner.Run(ctx, nil, "ipvsadm", "-Lnc")
+	if err != nil {
+		e.logger.Debugf("flow: unable to read the ipvs connections. %v", err)
+		return map[flowKey]string{}
+	}
+	return parseIPVSConnections(string(out))
+}
+
+// Encode renders flows as IPFIX messages, each carrying the templates of the
+// families of its records and no larger than ipfixMaxMessage
+func (e *FlowExporter) Encode(flows []Flow, now time.Time) [][]byte {
+	messages := [][]byte{}
+	for _, v6 := range []bool{false, true} {
+		template, fields := uint16(ipfixTemplate4), ipfixFields4
+		if v6 {
+			template, fields = ipfixTemplate6, ipfixFields6
+		}
+
+		records := [][]byte{}
+		for _, f := range flows {
+			if (f.VIP.To4() == nil) == v6 {
+				records = append(records, encodeFlowRecord(f, v6))
+			}
+		}
+		for len(records) > 0 {
+			templateSet := encodeTemplateSet(template, fields)
+			room := ipfixMaxMessage - 16 - len(templateSet) - 4
+			n := 0
+			for size := 0; n < len(records) && size+len(records[n]) <= room; n++ {
+				size += len(records[n])
+			}
+			messages = append(messages, e.encodeMessage(now, templateSet, template, records[:n]))
+			records = records[n:]
+		}
+	}
+	return messages
+}
+
+// encodeMessage renders the header, the template set and a data set of
+// records. The sequence number counts the data records sent before.
+func (e *FlowExporter) encodeMessage(now time.Time, templateSet []byte, template uint16, records [][]byte) []byte {
+	data := []byte{}
+	for _, r := range records {
+		data = append(data, r...)
+	}
+	length := 16 + len(templateSet) + 4 + len(data)
+
+	b := make([]byte, 16, length)
+	binary.BigEndian.PutUint16(b[0:], ipfixVersion)
+	binary.BigEndian.PutUint16(b[2:], uint16(length))
+	binary.BigEndian.PutUint32(b[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(b[8:], e.sequence)
+	binary.BigEndian.PutUint32(b[12:], e.domain)
+	b = append(b, templateSet...)
+	b = appendUint16(b, template)
+	b = appendUint16(b, uint16(4+len(data)))
+	b = append(b, data...)
+
+	e.sequence += uint32(len(records))
+	return b
+}
+
+// encodeTemplateSet renders a template set holding the template
+func encodeTemplateSet(template uint16, fields []ipfixField) []byte {
+	b := []byte{}
+	b = appendUint16(b, ipfixTemplateSet)
+	b = appendUint16(b, uint16(4+4+4*len(fields)))
+	b = appendUint16(b, template)
+	b = appendUint16(b, uint16(len(fields)))
+	for _, f := range fields {
+		b = appendUint16(b, f.id)
+		b = appendUint16(b, f.length)
+	}
+	return b
+}
+
+// encodeFlowRecord renders a flow in the order of the fields of its template.
+// An unknown backend is the unspecified address.
+func encodeFlowRecord(f Flow, v6 bool) []byte {
+	addr := func(ip net.IP) []byte {
+		if v6 {
+			if ip = ip.To16(); ip == nil {
+				return net.IPv6unspecified
+			}
+			return ip
+		}
+		if ip = ip.To4(); ip == nil {
+			return net.IPv4zero.To4()
+		}
+		return ip
+	}
+
+	b := []byte{}
+	b = append(b, addr(f.Client)...)
+	b = appendUint16(b, uint16(f.ClientPort))
+	b = append(b, addr(f.VIP)...)
+	b = appendUint16(b, uint16(f.VIPPort))
+	b = append(b, protocolNumber(f.Protocol))
+	b = append(b, addr(f.Backend)...)
+	b = appendUint64(b, f.Bytes)
+	b = appendUint64(b, f.Packets)
+	return b
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// protocolNumber is the IANA number of a protocol name
+func protocolNumber(protocol string) byte {
+	switch protocol {
+	case "tcp":
+		return 6
+	case "udp":
+		return 17
+	case "sctp":
+		return 132
+	}
+	return 0
+}
+
+// exportedPorts returns the VIP ports of config with flowExport set, as vip:port
+func exportedPorts(config *types.ClusterConfig) map[string]bool {
+	out := map[string]bool{}
+	if config == nil {
+		return out
+	}
+	for _, c := range []map[types.ServiceIP]types.PortMap{config.Config, config.Config6} {
+		for vip, ports := range c {
+			for port, def := range ports {
+				if def != nil && def.FlowExport {
+					out[net.JoinHostPort(string(vip), port)] = true
+				}
+			}
+		}
+	}
+	return out
+}
+
+// conntrackEntry is a connection tracking entry of a connection to a VIP port
+type conntrackEntry struct {
+	key      flowKey
+	counters flowCounters
+	// backend is the source of the reply direction, when IPVS NATs the
+	// connection to it
+	backend string
+}
+
+// parseConntrackEntries parses the output of `conntrack -L`, i.e.
+// 'tcp 6 431999 ESTABLISHED src=10.0.0.1 dst=10.54.213.165 sport=5555
+// dport=80 packets=3 bytes=180 src=10.1.1.5 dst=10.0.0.1 sport=80 dport=5555
+// packets=2 bytes=112 [ASSURED] mark=0 use=1'. The first tuple is the
+// original direction and the second the reply. Entries without counters
+// count nothing.
+func parseConntrackEntries(out string) []conntrackEntry {
+	entries := []conntrackEntry{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		original, reply := map[string]string{}, map[string]string{}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			k, v := kv[0], kv[1]
+			if _, dup := original[k]; dup {
+				if _, dup := reply[k]; !dup {
+					reply[k] = v
+				}
+				continue
+			}
+			original[k] = v
+		}
+		if original["src"] == "" || original["dst"] == "" {
+			continue
+		}
+		sport, err1 := strconv.Atoi(original["sport"])
+		dport, err2 := strconv.Atoi(original["dport"])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		packets, _ := strconv.ParseUint(original["packets"], 10, 64)
+		bytes, _ := strconv.ParseUint(original["bytes"], 10, 64)
+
+		entry := conntrackEntry{
+			key:      flowKey{protocol: fields[0], client: original["src"], clientPort: sport, vip: original["dst"], vipPort: dport},
+			counters: flowCounters{packets: packets, bytes: bytes},
+		}
+		if src := reply["src"]; src != "" && src != original["dst"] {
+			entry.backend = src
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// parseIPVSConnections parses the output of `ipvsadm -Lnc`, i.e.
+// 'TCP 14:59 ESTABLISHED 10.0.0.1:5555 10.54.213.165:80 10.1.1.5:80', into
+// the address of the destination of each connection
+func parseIPVSConnections(out string) map[flowKey]string {
+	backends := map[flowKey]string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		protocol := strings.ToLower(fields[0])
+		if protocolNumber(protocol) == 0 {
+			continue
+		}
+		client, clientPort, err1 := net.SplitHostPort(fields[3])
+		vip, vipPort, err2 := net.SplitHostPort(fields[4])
+		backend, _, err3 := net.SplitHostPort(fields[5])
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		cport, err1 := strconv.Atoi(clientPort)
+		vport, err2 := strconv.Atoi(vipPort)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		backends[flowKey{protocol: protocol, client: client, clientPort: cport, vip: vip, vipPort: vport}] = backend
+	}
+	return backends
+}
@@ -0,0 +1,86 @@
+package system
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+const conntrackFlows = `tcp      6 431999 ESTABLISHED src=10.0.0.1 dst=10.54.213.165 sport=5555 dport=80 packets=3 bytes=180 src=10.54.213.165 dst=10.0.0.1 sport=80 dport=5555 packets=2 bytes=112 [ASSURED] mark=0 use=1
+tcp      6 431999 ESTABLISHED src=10.0.0.2 dst=10.54.213.165 sport=6666 dport=80 packets=5 bytes=300 src=10.131.153.77 dst=10.0.0.2 sport=8080 dport=6666 packets=4 bytes=200 [ASSURED] mark=0 use=1
+tcp      6 431999 ESTABLISHED src=10.0.0.3 dst=10.54.213.165 sport=7777 dport=443 packets=5 bytes=300 src=10.54.213.165 dst=10.0.0.3 sport=443 dport=7777 packets=4 bytes=200 [ASSURED] mark=0 use=1
+conntrack v1.4.5 (conntrack-tools): 3 flow entries have been shown.
+`
+
+const ipvsConnections = `IPVS connection entries
+pro expire state       source             virtual            destination
+TCP 14:59  ESTABLISHED 10.0.0.1:5555      10.54.213.165:80   10.131.153.76:80
+`
+
+func TestFlowExporter(t *testing.T) {
+	runner := NewRecordingCommandRunner()
+	runner.Respond("conntrack -L -f ipv4", conntrackFlows, nil)
+	runner.Respond("ipvsadm -Lnc", ipvsConnections, nil)
+
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {
+				"80":  &types.ServiceDef{Service: "web", TCPEnabled: true, FlowExport: true},
+				"443": &types.ServiceDef{Service: "web", TCPEnabled: true},
+			},
+		},
+	}
+	e := NewFlowExporter(context.Background(), "127.0.0.1:4739", time.Second, 1, "10.54.213.10", func() *types.ClusterConfig { return config }, nil, logrus.New())
+	e.SetCommandRunner(runner)
+
+	flows, err := e.Sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 2 {
+		t.Fatalf("expected the two connections to port 80. have %+v", flows)
+	}
+	// the first is direct routed and its backend comes from ipvs, the second
+	// is NATed and its backend is the source of the replies
+	if flows[0].Backend.String() != "10.131.153.76" || flows[0].Bytes != 180 || flows[0].Packets != 3 {
+		t.Fatalf("unexpected first flow %+v", flows[0])
+	}
+	if flows[1].Backend.String() != "10.131.153.77" || flows[1].Bytes != 300 {
+		t.Fatalf("unexpected second flow %+v", flows[1])
+	}
+
+	// only the traffic since the last sample is exported
+	runner.Respond("conntrack -L -f ipv4", strings.Replace(conntrackFlows, "packets=3 bytes=180", "packets=4 bytes=240", 1), nil)
+	flows, err = e.Sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 1 || flows[0].Bytes != 60 || flows[0].Packets != 1 {
+		t.Fatalf("expected only the delta of the first connection. have %+v", flows)
+	}
+
+	messages := e.Encode(flows, time.Unix(1700000000, 0))
+	if len(messages) != 1 {
+		t.Fatalf("expected a single message. have %d", len(messages))
+	}
+	m := messages[0]
+	if binary.BigEndian.Uint16(m[0:]) != ipfixVersion || int(binary.BigEndian.Uint16(m[2:])) != len(m) {
+		t.Fatalf("unexpected message header % x", m[:16])
+	}
+	if binary.BigEndian.Uint32(m[12:]) != 0x0a36d50a {
+		t.Fatalf("expected the node address as the observation domain. have %#x", binary.BigEndian.Uint32(m[12:]))
+	}
+	// header, template set of 8 fields, data set header and one 33 byte record
+	if len(m) != 16+4+4+8*4+4+33 {
+		t.Fatalf("unexpected message length %d", len(m))
+	}
+	if e.sequence != 1 {
+		t.Fatalf("expected the sequence to count the record. have %d", e.sequence)
+	}
+}
@@ -0,0 +1,237 @@
+package system
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The strategies an InterfaceDetector tries. A cidr strategy is written with
+// its CIDR, i.e. 'cidr:10.131.0.0/16'.
+const (
+	InterfaceDefaultRoute = "default-route"
+	InterfaceCIDR         = "cidr"
+	InterfaceAnnotation   = "annotation"
+)
+
+// InterfaceDetector picks the primary interface of a node, the one VIP traffic
+// arrives on, so that one configuration can serve nodes whose interfaces are
+// named differently. Its strategies are tried in order:
+//
+//   - annotation is the interface named by an annotation of the node
+//   - cidr:<cidr> is the first interface, by index, with an address in the CIDR
+//   - default-route is the interface of the default route with the lowest metric
+//
+// Detect falls back to the static interface when no strategy finds one.
+type InterfaceDetector struct {
+	strategies []string
+	static     string
+
+	// annotation returns the interface the node's annotation names, empty
+	// when it names none
+	annotation func(ctx context.Context) (string, error)
+
+	// interfaces and addrs list the interfaces of the node and their
+	// addresses, and routes4 and routes6 open its routing tables
+	interfaces func() ([]net.Interface, error)
+	addrs      func(iface net.Interface) ([]net.Addr, error)
+	routes4    func() (io.ReadCloser, error)
+	routes6    func() (io.ReadCloser, error)
+}
+
+// NewInterfaceDetector creates an InterfaceDetector that tries strategies, and
+// then static. annotation may be nil when strategies don't include it.
+func NewInterfaceDetector(strategies []string, static string, annotation func(ctx context.Context) (string, error)) (*InterfaceDetector, error) {
+	if err := ValidInterfaceStrategies(strategies); err != nil {
+		return nil, err
+	}
+	return &InterfaceDetector{
+		strategies: strategies,
+		static:     static,
+		annotation: annotation,
+		interfaces: net.Interfaces,
+		addrs:      func(iface net.Interface) ([]net.Addr, error) { return iface.Addrs() },
+		routes4:    func() (io.ReadCloser, error) { return os.Open("/proc/net/route") },
+		routes6:    func() (io.ReadCloser, error) { return os.Open("/proc/net/ipv6_route") },
+	}, nil
+}
+
+// ValidInterfaceStrategies returns an error for a strategy that isn't known,
+// or a cidr strategy without a valid CIDR
+func ValidInterfaceStrategies(strategies []string) error {
+	for _, s := range strategies {
+		switch {
+		case s == InterfaceDefaultRoute, s == InterfaceAnnotation:
+		case strings.HasPrefix(s, InterfaceCIDR+":"):
+			if _, _, err := net.ParseCIDR(strings.TrimPrefix(s, InterfaceCIDR+":")); err != nil {
+				return fmt.Errorf("interface strategy %q has an invalid cidr. %v", s, err)
+			}
+		default:
+			return fmt.Errorf("interface strategy %q must be %s, %s:<cidr> or %s", s, InterfaceDefaultRoute, InterfaceCIDR, InterfaceAnnotation)
+		}
+	}
+	return nil
+}
+
+// Detect returns the primary interface and the strategy that found it, which
+// is static for the fallback. A strategy that fails is skipped, and its error
+// only returned when nothing, the fallback included, finds an interface.
+func (d *InterfaceDetector) Detect(ctx context.Context) (string, string, error) {
+	errs := []string{}
+	for _, s := range d.strategies {
+		var iface string
+		var err error
+		switch {
+		case s == InterfaceAnnotation:
+			if d.annotation == nil {
+				err = fmt.Errorf("no node to read the annotation of")
+				break
+			}
+			iface, err = d.annotation(ctx)
+			if err == nil && iface != "" && !d.exists(iface) {
+				err = fmt.Errorf("the annotation names %s, which isn't an interface of the node", iface)
+			}
+		case s == InterfaceDefaultRoute:
+			iface, err = d.defaultRoute()
+		case strings.HasPrefix(s, InterfaceCIDR+":"):
+			_, cidr, _ := net.ParseCIDR(strings.TrimPrefix(s, InterfaceCIDR+":"))
+			iface, err = d.inCIDR(cidr)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", s, err))
+			continue
+		}
+		if iface != "" {
+			return iface, s, nil
+		}
+	}
+	if d.static != "" {
+		return d.static, "static", nil
+	}
+	if len(errs) > 0 {
+		return "", "", fmt.Errorf("unable to detect the primary interface. %s", strings.Join(errs, ". "))
+	}
+	return "", "", fmt.Errorf("unable to detect the primary interface. no strategy found one")
+}
+
+// exists returns true when the node has an interface named name
+func (d *InterfaceDetector) exists(name string) bool {
+	ifaces, err := d.interfaces()
+	if err != nil {
+		return false
+	}
+	for _, iface := range ifaces {
+		if iface.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// inCIDR returns the first interface, by index, that is up and has an address
+// in cidr, skipping loopbacks and the VIP devices ravel creates
+func (d *InterfaceDetector) inCIDR(cidr *net.IPNet) (string, error) {
+	ifaces, err := d.interfaces()
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(ifaces, func(n, m int) bool { return ifaces[n].Index < ifaces[m].Index })
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || isVIPDevice(iface.Name) {
+			continue
+		}
+		addrs, err := d.addrs(iface)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && cidr.Contains(ipNet.IP) {
+				return iface.Name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// isVIPDevice returns true for the dummy devices ravel puts VIPs on, which
+// carry the ravel alias
+func isVIPDevice(name string) bool {
+	alias, err := ioutil.ReadFile("/sys/class/net/" + name + "/ifalias")
+	return err == nil && strings.TrimSpace(string(alias)) == "ravel"
+}
+
+// defaultRoute returns the interface of the ipv4 default route with the lowest
+// metric, or of the ipv6 one when there is no ipv4 default route
+func (d *InterfaceDetector) defaultRoute() (string, error) {
+	iface, err := readDefaultRoute(d.routes4, parseRoute4)
+	if err != nil || iface != "" {
+		return iface, err
+	}
+	return readDefaultRoute(d.routes6, parseRoute6)
+}
+
+// readDefaultRoute returns the interface of the default route in the table
+// open returns, by the lowest metric, as parse reads each line
+func readDefaultRoute(open func() (io.ReadCloser, error), parse func(fields []string) (string, int64, bool)) (string, error) {
+	f, err := open()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer f.Close()
+
+	best, bestMetric := "", int64(-1)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		iface, metric, ok := parse(strings.Fields(scanner.Text()))
+		if ok && iface != "lo" && (bestMetric < 0 || metric < bestMetric) {
+			best, bestMetric = iface, metric
+		}
+	}
+	return best, scanner.Err()
+}
+
+// parseRoute4 reads a line of /proc/net/route, i.e.
+// 'eth0	00000000	0101A8C0	0003	0	0	100	00000000	0	0	0',
+// returning its interface and metric when it is a default route that is up
+func parseRoute4(fields []string) (string, int64, bool) {
+	if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+		return "", 0, false
+	}
+	flags, err := strconv.ParseUint(fields[3], 16, 32)
+	if err != nil || flags&0x1 == 0 {
+		return "", 0, false
+	}
+	metric, err := strconv.ParseInt(fields[6], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return fields[0], metric, true
+}
+
+// parseRoute6 reads a line of /proc/net/ipv6_route, whose destination and
+// prefix length come first, and metric and interface last, returning its
+// interface and metric when it is a default route that is up
+func parseRoute6(fields []string) (string, int64, bool) {
+	if len(fields) < 10 || fields[0] != strings.Repeat("0", 32) || fields[1] != "00" {
+		return "", 0, false
+	}
+	flags, err := strconv.ParseUint(fields[8], 16, 32)
+	if err != nil || flags&0x1 == 0 {
+		return "", 0, false
+	}
+	metric, err := strconv.ParseInt(fields[5], 16, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return fields[9], metric, true
+}
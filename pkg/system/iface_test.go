@@ -0,0 +1,99 @@
+package system
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testRoutes4 = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth1	00000000	0101A8C0	0003	0	0	200	00000000	0	0	0
+eth0	00000000	0100830A	0003	0	0	100	00000000	0	0	0
+eth0	0000830A	00000000	0001	0	0	100	0000FFFF	0	0	0
+`
+
+const testRoutes6 = `00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003 eth2
+`
+
+func testDetector(strategies []string, static string, annotation string, routes4, routes6 string) *InterfaceDetector {
+	d, _ := NewInterfaceDetector(strategies, static, func(ctx context.Context) (string, error) { return annotation, nil })
+	d.interfaces = func() ([]net.Interface, error) {
+		return []net.Interface{
+			{Index: 3, Name: "eth1", Flags: net.FlagUp},
+			{Index: 1, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+			{Index: 2, Name: "eth0", Flags: net.FlagUp},
+			{Index: 4, Name: "eth3"},
+		}, nil
+	}
+	d.addrs = func(iface net.Interface) ([]net.Addr, error) {
+		cidrs := map[string]string{"lo": "127.0.0.1/8", "eth0": "10.131.4.20/16", "eth1": "192.168.1.20/24", "eth3": "172.16.0.5/24"}
+		_, ipNet, _ := net.ParseCIDR(cidrs[iface.Name])
+		ip, _, _ := net.ParseCIDR(cidrs[iface.Name])
+		ipNet.IP = ip
+		return []net.Addr{ipNet}, nil
+	}
+	open := func(table string) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) {
+			if table == "" {
+				return nil, os.ErrNotExist
+			}
+			return ioutil.NopCloser(strings.NewReader(table)), nil
+		}
+	}
+	d.routes4 = open(routes4)
+	d.routes6 = open(routes6)
+	return d
+}
+
+func TestInterfaceDetector(t *testing.T) {
+	tests := []struct {
+		name       string
+		strategies []string
+		static     string
+		annotation string
+		routes4    string
+		routes6    string
+		iface      string
+		strategy   string
+		err        bool
+	}{
+		{"default route by metric", []string{"default-route"}, "", "", testRoutes4, testRoutes6, "eth0", "default-route", false},
+		{"ipv6 default route", []string{"default-route"}, "", "", "", testRoutes6, "eth2", "default-route", false},
+		{"cidr", []string{"cidr:192.168.0.0/16"}, "", "", testRoutes4, "", "eth1", "cidr:192.168.0.0/16", false},
+		{"cidr skips down interfaces", []string{"cidr:172.16.0.0/24", "default-route"}, "", "", testRoutes4, "", "eth0", "default-route", false},
+		{"annotation first", []string{"annotation", "default-route"}, "", "eth1", testRoutes4, "", "eth1", "annotation", false},
+		{"empty annotation", []string{"annotation", "default-route"}, "", "", testRoutes4, "", "eth0", "default-route", false},
+		{"annotation of a missing interface", []string{"annotation", "default-route"}, "", "bond0", testRoutes4, "", "eth0", "default-route", false},
+		{"static fallback", []string{"cidr:172.20.0.0/16", "default-route"}, "eth9", "", "", "", "eth9", "static", false},
+		{"nothing found", []string{"annotation", "default-route"}, "", "bond0", "", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testDetector(tt.strategies, tt.static, tt.annotation, tt.routes4, tt.routes6)
+			iface, strategy, err := d.Detect(context.Background())
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if iface != tt.iface || strategy != tt.strategy {
+				t.Fatalf("expected %s by %s, got %s by %s", tt.iface, tt.strategy, iface, strategy)
+			}
+		})
+	}
+}
+
+func TestValidInterfaceStrategies(t *testing.T) {
+	for _, s := range [][]string{nil, {"default-route"}, {"annotation", "cidr:10.0.0.0/8", "cidr:fd00::/8"}} {
+		if err := ValidInterfaceStrategies(s); err != nil {
+			t.Fatalf("expected %v to be valid, got %v", s, err)
+		}
+	}
+	for _, s := range [][]string{{"route"}, {"cidr"}, {"cidr:10.0.0.0"}, {"default-route", "label"}} {
+		if err := ValidInterfaceStrategies(s); err == nil {
+			t.Fatalf("expected %v to be invalid", s)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// Backends returns the counters IPVS keeps for every real, keyed as
+// ParseIPVSStats keys them
+func (i *IPVS) Backends(ctx context.Context) (map[string]map[string]IPVSRealStats, error) {
+	return i.readStats(ctx)
+}
+
+// Diff returns how the rules in the kernel differ from the rules w and config
+// generate, as the parity check compares them. Rules only in the kernel are
+// prefixed with "- ", and rules only generated with "+ ". An empty diff means
+// the node is in parity, as far as the virtual services go.
+func (i *IPVS) Diff(w *watcher.Watcher, config *types.ClusterConfig) ([]string, error) {
+	if config == nil {
+		return nil, fmt.Errorf("ipvs: no cluster config to compare against")
+	}
+
+	configured, err := i.Get()
+	if err != nil {
+		return nil, fmt.Errorf("ipvs: unable to read the configured rules. %v", err)
+	}
+	generated, err := i.generateRules(w, w.Nodes, config)
+	if err != nil {
+		return nil, fmt.Errorf("ipvs: unable to generate rules. %v", err)
+	}
+	if len(config.Config6) > 0 {
+		configured6, err := i.GetV6()
+		if err != nil {
+			return nil, fmt.Errorf("ipvs: unable to read the configured IPv6 rules. %v", err)
+		}
+		generated6, err := i.generateRulesV6(w, w.Nodes, config)
+		if err != nil {
+			return nil, fmt.Errorf("ipvs: unable to generate IPv6 rules. %v", err)
+		}
+		configured = append(configured, configured6...)
+		generated = append(generated, generated6...)
+	}
+
+	have := map[string]bool{}
+	for _, rule := range configured {
+		have[i.sanitizeIPVSRule(rule)] = true
+	}
+	want := map[string]bool{}
+	for _, rule := range generated {
+		want[i.sanitizeIPVSRule(rule)] = true
+	}
+
+	diff := []string{}
+	for rule := range have {
+		if !want[rule] {
+			diff = append(diff, "- "+rule)
+		}
+	}
+	for rule := range want {
+		if !have[rule] {
+			diff = append(diff, "+ "+rule)
+		}
+	}
+	// order by rule rather than by side, so that a changed rule's two lines
+	// sit together
+	sort.Slice(diff, func(a, b int) bool {
+		if diff[a][2:] == diff[b][2:] {
+			return diff[a] < diff[b]
+		}
+		return diff[a][2:] < diff[b][2:]
+	})
+	return diff, nil
+}
@@ -0,0 +1,52 @@
+package system
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// IPVSExecutor describes the IPVS operations the director and realserver depend on.
+// IPVS is the production implementation; FakeIPVS holds the rules in memory.
+type IPVSExecutor interface {
+	Get() ([]string, error)
+	GetV6() ([]string, error)
+	Set(rules []string) ([]byte, error)
+	Teardown(ctx context.Context) error
+	SetIPVS(w *watcher.Watcher, config *types.ClusterConfig, logger log.FieldLogger, ipType string) error
+	CheckConfigParity(w *watcher.Watcher, config *types.ClusterConfig, addresses []string) (bool, error)
+}
+
+// AddressManager describes management of VIP addresses and the arp/mtu settings
+// of the devices that carry them. IP is the production implementation; FakeIP
+// holds the devices in memory.
+type AddressManager interface {
+	Get() ([]string, []string, error)
+	Device(addr string, isV6 bool) string
+	Add(addr string) error
+	Add6(addr string) error
+	Del(device string) error
+	SetMTU(config map[types.ServiceIP]string, isIP6 bool) error
+	SetReturnRoutes(routes map[types.ServiceIP]types.ReturnRoute, isIP6 bool) error
+	AdvertiseMacAddress(addr string) error
+	AdvertiseNeighbor(addr string) error
+	SetRPFilter() error
+	SetARP() error
+	Compare4(configured, desired []string) ([]string, []string)
+	Compare6(configured, desired []string) ([]string, []string)
+	Teardown(ctx context.Context, config4 map[types.ServiceIP]types.PortMap, config6 map[types.ServiceIP]types.PortMap) error
+}
+
+// SysctlDrifter reports the arp and rp_filter settings an AddressManager wrote
+// that have since been changed, see IP.ARPDrift
+type SysctlDrifter interface {
+	ARPDrift() ([]string, error)
+	RPFilterDrift() ([]string, error)
+}
+
+var _ IPVSExecutor = &IPVS{}
+var _ AddressManager = &IP{}
+var _ SysctlDrifter = &IP{}
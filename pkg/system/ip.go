@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"sort"
@@ -13,6 +15,7 @@ import (
 	"time"
 
 	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -30,6 +33,27 @@ type IP struct {
 
 	// interfaceGetMu locks operations that fetch interfaces so more than one don't run at once
 	interfaceGetMu sync.Mutex
+
+	runner CommandRunner
+
+	// sysctl, when set, writes the arp settings instead of /netconf
+	sysctl Sysctl
+
+	// mtuOverrides are the MTUs of devices set on the node, and mtuParent the
+	// device their MTU can't exceed, see SetMTU
+	mtuOverrides map[string]int
+	mtuParent    string
+	mtuMetrics   mtuMetrics
+	mtuMu        sync.Mutex
+	mtuStatus4   []MTUStatus
+	mtuStatus6   []MTUStatus
+
+	// adoptUnlabeled removes the dummy devices ravel didn't create, see
+	// SetAdoptUnlabeled
+	adoptUnlabeled bool
+
+	// scope, when set, is the context commands run under, see SetScope
+	scope *util.Scope
 }
 
 // NewIP creates a new ipManager struct for manging ip binary operations
@@ -43,9 +67,36 @@ func NewIP(ctx context.Context, device string, gateway string, announce, ignore
 		ctx:            ctx,
 		logger:         logger,
 		interfaceGetMu: sync.Mutex{},
+		runner:         execCommandRunner{},
 	}, nil
 }
 
+// SetCommandRunner replaces the runner used to execute ip, ifconfig and arping
+func (i *IP) SetCommandRunner(r CommandRunner) {
+	i.runner = r
+}
+
+// SetScope runs ip and ifconfig under the context of scope, so that a
+// reconcile that binds it cancels the commands it started once it runs out of
+// time or is stopped
+func (i *IP) SetScope(scope *util.Scope) {
+	i.scope = scope
+}
+
+// cmdContext is the context commands run under
+func (i *IP) cmdContext() context.Context {
+	if i.scope != nil {
+		return i.scope.Context()
+	}
+	return i.ctx
+}
+
+// SetSysctl writes the arp settings of SetARP through sysctl, i.e. a privileged
+// agent, rather than to the files below /netconf
+func (i *IP) SetSysctl(sysctl Sysctl) {
+	i.sysctl = sysctl
+}
+
 func (i *IP) Get() ([]string, []string, error) {
 	// log.Infoln("ipManager fetching dummy interfaces...")
 	return i.get()
@@ -54,45 +105,10 @@ func (i *IP) Get() ([]string, []string, error) {
 func (i *IP) Device(addr string, isV6 bool) string {
 	return i.generateDeviceLabel(addr, isV6)
 }
-func (i *IP) Add(addr string) error  { return i.add(i.ctx, addr, false) }
-func (i *IP) Add6(addr string) error { return i.add(i.ctx, addr, true) }
-
-func (i *IP) Del(device string) error { return i.del(i.ctx, device) }
-
-func (i *IP) SetMTU(config map[types.ServiceIP]string, isIP6 bool) error {
-	for ip, mtu := range config {
-		// guard against dated provisioner versions (bulkhead deploy), erroneous configurations
-		// otherwise, don't skip standard (1500), could be setting back from a different MTU
-		if mtu == "" {
-			continue
-		}
-
-		// convert to int for validation
-		backendAsInt, err := strconv.Atoi(mtu)
-		if err != nil {
-			i.logger.Warnf("VIP %s was unable to convert MTU field to int from string %s: %v. Skipping", ip, mtu, err)
-			continue
-		}
-
-		if backendAsInt < 1500 || backendAsInt > 9000 {
-			i.logger.Warnf("mtu value for VIP %s was out of valid range 1500-9000: %d. Skipping...", ip, backendAsInt)
-		}
+func (i *IP) Add(addr string) error  { return i.add(i.cmdContext(), addr, false) }
+func (i *IP) Add6(addr string) error { return i.add(i.cmdContext(), addr, true) }
 
-		// create the device name
-		dev := i.generateDeviceLabel(string(ip), isIP6)
-
-		// then set args and either set or ensure parity on the interface
-		args := []string{dev, "mtu", mtu}
-		cmdCtx, cmdContextCancel := context.WithTimeout(i.ctx, time.Second*20)
-		defer cmdContextCancel()
-		cmd := exec.CommandContext(cmdCtx, "ifconfig", args...)
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("error setting mtu on device %s: %v. Saw output: %v", dev, err, string(out))
-		}
-	}
-	return nil
-}
+func (i *IP) Del(device string) error { return i.del(i.cmdContext(), device) }
 
 // AdvertiseMacAddress does a gratuitous ARP a specific VIP on a specific interface.
 // Exec's the command: arping -c 1 -s $VIP_IP $gateway_ip -I $interface
@@ -106,17 +122,31 @@ func (i *IP) AdvertiseMacAddress(addr string) error {
 	// use primary no matter what device we are using
 	cmdLine := "/usr/sbin/arping"
 	args := []string{"-c", "1", "-s", addr, i.gateway, "-I", i.device}
-	cmdCtx, cmdContextCancel := context.WithTimeout(i.ctx, time.Second*20)
+	cmdCtx, cmdContextCancel := context.WithTimeout(i.cmdContext(), time.Second*20)
 	defer cmdContextCancel()
-	cmd := exec.CommandContext(cmdCtx, cmdLine, args...)
-	out, err := cmd.CombinedOutput()
+	out, err := i.runner.Run(cmdCtx, nil, cmdLine, args...)
 	if err != nil {
-		return fmt.Errorf("ipManager: unable to advertise arp. Saw error %s with output %s. addr=%s gateway=%s device=%s command: %s", err, string(out), addr, i.gateway, i.device, cmd.String())
+		return fmt.Errorf("ipManager: unable to advertise arp. Saw error %s with output %s. addr=%s gateway=%s device=%s command: %s %s", err, string(out), addr, i.gateway, i.device, cmdLine, strings.Join(args, " "))
 	}
 	// log.Debugln("Successfully arped for", addr, "with command", cmd.String())
 	return nil
 }
 
+// AdvertiseNeighbor sends an unsolicited IPv6 neighbor advertisement for a
+// specific VIP out of the primary interface, the IPv6 counterpart of
+// AdvertiseMacAddress. It is sent from a raw socket rather than an external
+// binary, see NeighborAdvertisement.
+func (i *IP) AdvertiseNeighbor(addr string) error {
+	ip := net.ParseIP(addr)
+	err := sendFrame(i.device, etherTypeIPv6, func(mac net.HardwareAddr) ([]byte, error) {
+		return NeighborAdvertisement(mac, ip)
+	})
+	if err != nil {
+		return fmt.Errorf("ipManager: unable to advertise neighbor. %v. addr=%s device=%s", err, addr, i.device)
+	}
+	return nil
+}
+
 func (i *IP) SetRPFilter() error {
 	log.Debugln("ipManager: setting RPFilter")
 	tunl0File := "/netconf/tunl0/rp_filter"
@@ -154,6 +184,13 @@ func (i *IP) SetARP() error {
 	log.Debugf("ipManager: seting arp_announce for %s to %d\n", i.device, i.announce)
 	log.Debugf("ipManager: seting arp_ignore for %s to %d\n", i.device, i.ignore)
 
+	if i.sysctl != nil {
+		if err := i.sysctl.Set("net/ipv4/conf/"+i.device+"/arp_announce", strconv.Itoa(i.announce)); err != nil {
+			return err
+		}
+		return i.sysctl.Set("net/ipv4/conf/"+i.device+"/arp_ignore", strconv.Itoa(i.ignore))
+	}
+
 	fAnnounce, err := os.OpenFile(announceFile, os.O_RDWR, 0666)
 	if err != nil {
 		return err
@@ -179,12 +216,67 @@ func (i *IP) SetARP() error {
 	return nil
 }
 
+// ARPDrift returns the arp settings of the device that no longer hold what
+// SetARP writes, as name=value of the value they hold instead
+func (i *IP) ARPDrift() ([]string, error) {
+	return i.confDrift(map[string]string{
+		i.device + "/arp_announce": strconv.Itoa(i.announce),
+		i.device + "/arp_ignore":   strconv.Itoa(i.ignore),
+	})
+}
+
+// RPFilterDrift returns the rp_filter settings that no longer hold what
+// SetRPFilter writes, as ARPDrift does
+func (i *IP) RPFilterDrift() ([]string, error) {
+	return i.confDrift(map[string]string{
+		"all/rp_filter":   "0",
+		"tunl0/rp_filter": "0",
+	})
+}
+
+// confDrift returns the settings of want, named under net/ipv4/conf, that
+// hold other values. They are read through sysctl when it is set, and from
+// /netconf otherwise.
+func (i *IP) confDrift(want map[string]string) ([]string, error) {
+	drift := []string{}
+	for name, value := range want {
+		var have string
+		if i.sysctl != nil {
+			v, err := i.sysctl.Get("net/ipv4/conf/" + name)
+			if err != nil {
+				return nil, err
+			}
+			have = v
+		} else {
+			b, err := ioutil.ReadFile("/netconf/" + name)
+			if err != nil {
+				return nil, err
+			}
+			have = strings.TrimSpace(string(b))
+		}
+		if have != value {
+			drift = append(drift, name+"="+have)
+		}
+	}
+	sort.Strings(drift)
+	return drift, nil
+}
+
+// Compare4 returns the v4 devices to remove and the addresses to add. Only the
+// devices ravel created are removed, see SetAdoptUnlabeled, and the devices of
+// desired VIPs are labeled as ravel's when they are found.
 func (i *IP) Compare4(configured, desired []string) ([]string, []string) {
-	return i.Compare(configured, desired, false)
+	removals, additions := i.Compare(configured, desired, false)
+	return i.ownedRemovals(configured, removals), additions
 }
 
+// Compare6 returns the v6 devices to remove and the devices to add. As with
+// Compare4, only the devices ravel created are removed. It matters more here,
+// since every dummy device without an underscore in its name is read as a v6
+// VIP, such as the kube-ipvs0 of kube-proxy.
 func (i *IP) Compare6(configured, desired []string) ([]string, []string) {
-	return i.Compare(configured, desired, true)
+	removals, additions := i.Compare(configured, desired, true)
+	return i.ownedRemovals(configured, removals), additions
 }
 
 type Comp struct {
@@ -268,6 +360,10 @@ func (i *IP) generateDeviceLabel(addr string, isIP6 bool) string {
 		// probably will never have to worry about it
 		addrStripped := strings.Replace(addr, ":", "", -1)
 		l := len(addrStripped)
+		if l <= 15 {
+			// short, compressed addresses fit as they are
+			return addrStripped
+		}
 		return string(addrStripped[l-15:])
 	}
 	return strings.Replace(addr, ".", "_", -1)
@@ -283,8 +379,7 @@ func (i *IP) add(ctx context.Context, addr string, isIP6 bool) error {
 	cmdCtx, cmdContextCancel := context.WithTimeout(ctx, time.Second*20)
 	defer cmdContextCancel()
 
-	cmd := exec.CommandContext(cmdCtx, "ip", args...)
-	out, err := cmd.CombinedOutput()
+	out, err := i.runner.Run(cmdCtx, nil, "ip", args...)
 	// if it exists, we know we have already added the iface for it, and
 	// the relevant address. Exit success from this method
 	if err != nil && strings.Contains(string(out), "File exists") {
@@ -294,7 +389,12 @@ func (i *IP) add(ctx context.Context, addr string, isIP6 bool) error {
 
 	// if the error _does not_ indicate the file exists, we have a real error
 	if err != nil {
-		return fmt.Errorf("ipManager: failed to create device %s for addr %s: %v. Saw output: %s", device, addr, err, string(out))
+		return util.Errorf(util.ErrKernelApply, "ipManager: failed to create device %s for addr %s: %v. Saw output: %s", device, addr, err, string(out))
+	}
+
+	// mark the device as ravel's, so that only ravel's devices are removed
+	if err := i.label(device); err != nil {
+		return err
 	}
 
 	// add the command to the specific interface we are using
@@ -314,10 +414,9 @@ func (i *IP) add(ctx context.Context, addr string, isIP6 bool) error {
 
 	cmdCtx, cmdContextCancel = context.WithTimeout(ctx, time.Second*20)
 	defer cmdContextCancel()
-	cmd = exec.CommandContext(cmdCtx, "ip", args...)
-	out, err = cmd.CombinedOutput()
+	out, err = i.runner.Run(cmdCtx, nil, "ip", args...)
 	if err != nil {
-		return fmt.Errorf("ipManager: unable to add ip on second try address='%s' on device='%s' with args='%v'. %v. Saw output: %s", addr, device, args, err, string(out))
+		return util.Errorf(util.ErrKernelApply, "ipManager: unable to add ip on second try address='%s' on device='%s' with args='%v'. %v. Saw output: %s", addr, device, args, err, string(out))
 	}
 
 	log.Debugln("ipManager: successfully added dummy loopback adapter with address", addr)
@@ -337,12 +436,11 @@ func (i *IP) del(ctx context.Context, device string) error {
 	cmdCtx, cmdContextCancel := context.WithTimeout(ctx, time.Second*20)
 	defer cmdContextCancel()
 
-	cmd := exec.CommandContext(cmdCtx, "ip", args...)
-	out, err := cmd.CombinedOutput()
+	out, err := i.runner.Run(cmdCtx, nil, "ip", args...)
 	// if it doesnt exist, this may be indicative of a bug in the add / remove code
 	// but if it's already gone, no problem
 	if err != nil && !strings.Contains(string(out), "Cannot find device") {
-		return fmt.Errorf("ipManager: failed to delete device %s: %v", device, err)
+		return util.Errorf(util.ErrKernelApply, "ipManager: failed to delete device %s: %v", device, err)
 	}
 
 	return nil
@@ -460,7 +558,7 @@ func (i *IP) retrieveDummyIFaces() ([]string, error) {
 	}()
 
 	// create a context timeout for our processes
-	ctx, ctxCancel := context.WithTimeout(i.ctx, time.Minute)
+	ctx, ctxCancel := context.WithTimeout(i.cmdContext(), time.Minute)
 	defer ctxCancel()
 
 	commandA := []string{i.IPCommandPath, "-details", "link", "show"}
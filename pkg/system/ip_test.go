@@ -2,11 +2,16 @@ package system
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/types"
 )
 
 func TestDiffAddressSets(t *testing.T) {
@@ -23,6 +28,19 @@ func TestDiffAddressSets(t *testing.T) {
 	}
 }
 
+func TestGenerateDeviceLabel(t *testing.T) {
+	instance := &IP{}
+	for addr, want := range map[string]string{
+		"10.54.213.165":                        "10_54_213_165",
+		"2001:558:1044:1ae:10ad:ba1a:a83:9979": "10adba1aa839979",
+		"2001:db8::10":                         "2001db810",
+	} {
+		if device := instance.generateDeviceLabel(addr, !strings.Contains(addr, ".")); device != want {
+			t.Errorf("expected device %s for %s. saw %s", want, addr, device)
+		}
+	}
+}
+
 func TestGetDummyInterfaces(t *testing.T) {
 	if os.Getenv("TEST_OS") != "mac" {
 		t.Skip("This test only works with a faked 'ip' command script")
@@ -96,3 +114,281 @@ func TestParseAddressData(t *testing.T) {
 		t.Errorf("unexpected address %v", addresses4)
 	}
 }
+
+type fakeMTUMetrics map[string]int
+
+func (f fakeMTUMetrics) MTUMismatches(reason string, devices int) { f[reason] = devices }
+
+func TestSetMTU(t *testing.T) {
+	link := func(n int, device string, mtu int) string {
+		return fmt.Sprintf(`%d: %s: <BROADCAST,NOARP,UP,LOWER_UP> mtu %d qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000\    link/ether 9e:64:3a:2c:0e:1f brd ff:ff:ff:ff:ff:ff`, n, device, mtu)
+	}
+	newRunner := func() *RecordingCommandRunner {
+		runner := NewRecordingCommandRunner()
+		runner.Respond("ip -o link show dev eth0", link(2, "eth0", 9000), nil)
+		for n, device := range []string{"10_0_0_1", "10_0_0_2", "10_0_0_3", "10_0_0_4"} {
+			runner.Respond("ip -o link show dev "+device, link(n+5, device, 1500), nil)
+		}
+		return runner
+	}
+	runner := newRunner()
+
+	ip, err := NewIP(context.Background(), "eth0", "10.0.0.254", 2, 1, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := fakeMTUMetrics{}
+	ip.SetCommandRunner(runner)
+	ip.SetMTUMetrics(metrics)
+	ip.SetMTUOverrides(map[string]int{"10.0.0.4": 1400, "10_0_0_9": 1400})
+
+	config := map[types.ServiceIP]string{
+		"10.0.0.1": "9000",
+		"10.0.0.2": "jumbo",
+		"10.0.0.3": "9100",
+		"10.0.0.4": "1500",
+	}
+	if err := ip.SetMTU(config, false); err != nil {
+		t.Fatal(err)
+	}
+	set := []string{}
+	for _, c := range runner.CommandLines() {
+		if strings.HasPrefix(c, "ifconfig") {
+			set = append(set, c)
+		}
+	}
+	if want := []string{"ifconfig 10_0_0_1 mtu 9000", "ifconfig 10_0_0_4 mtu 1400"}; !reflect.DeepEqual(set, want) {
+		t.Fatalf("expected %v. saw %v", want, set)
+	}
+	want := []MTUStatus{
+		{Device: "10_0_0_1", VIP: "10.0.0.1", Desired: 9000, Current: 9000},
+		{Device: "10_0_0_2", VIP: "10.0.0.2", Current: 1500, Reason: MTUInvalid},
+		{Device: "10_0_0_3", VIP: "10.0.0.3", Desired: 9100, Current: 1500, Reason: MTUExceedsParent},
+		{Device: "10_0_0_4", VIP: "10.0.0.4", Desired: 1400, Current: 1400},
+	}
+	if status := ip.MTUStatus(); !reflect.DeepEqual(status, want) {
+		t.Fatalf("expected %+v. saw %+v", want, status)
+	}
+	if want := (fakeMTUMetrics{MTUInvalid: 1, MTUExceedsParent: 1, MTUApplyFailed: 0}); !reflect.DeepEqual(metrics, want) {
+		t.Fatalf("expected metrics %v. saw %v", want, metrics)
+	}
+
+	// a device that can't take its mtu sets the devices changed before it back
+	runner = newRunner()
+	runner.Respond("ifconfig 10_0_0_4 mtu 1400", "SIOCSIFMTU: Invalid argument", errors.New("exit status 1"))
+	ip.SetCommandRunner(runner)
+	if err := ip.SetMTU(config, false); err == nil {
+		t.Fatal("expected the failure to set the mtu of 10_0_0_4")
+	}
+	if last := runner.CommandLines()[len(runner.CommandLines())-1]; last != "ifconfig 10_0_0_1 mtu 1500" {
+		t.Fatalf("expected 10_0_0_1 to be set back to 1500. saw %s", last)
+	}
+	if status := ip.MTUStatus(); len(status) != 4 || status[3].Reason != MTUApplyFailed {
+		t.Fatalf("expected 10_0_0_4 to have failed. saw %+v", status)
+	}
+	if metrics[MTUApplyFailed] != 1 {
+		t.Fatalf("expected an apply failure. saw %v", metrics)
+	}
+}
+
+func TestCompare4Ownership(t *testing.T) {
+	runner := NewRecordingCommandRunner()
+	runner.Respond("ip -o link show type dummy", strings.Join([]string{
+		`5: 10_0_0_1: <BROADCAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000\    link/ether 9e:64:3a:2c:0e:1f brd ff:ff:ff:ff:ff:ff\    alias ravel`,
+		`6: 10_0_0_2: <BROADCAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000\    link/ether 1a:2b:3c:4d:5e:6f brd ff:ff:ff:ff:ff:ff`,
+		`7: 10_0_0_3: <BROADCAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000\    link/ether 2a:2b:3c:4d:5e:6f brd ff:ff:ff:ff:ff:ff\    alias keepalived`,
+	}, "\n"), nil)
+
+	ip, err := NewIP(context.Background(), "eth0", "10.0.0.254", 2, 1, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip.SetCommandRunner(runner)
+
+	removals, additions := ip.Compare4([]string{"10_0_0_1", "10_0_0_2", "10_0_0_3"}, []string{"10.0.0.4"})
+	if !reflect.DeepEqual(removals, []string{"10.0.0.1"}) {
+		t.Fatalf("expected only the labeled device to be removed. saw %v", removals)
+	}
+	if !reflect.DeepEqual(additions, []string{"10.0.0.4"}) {
+		t.Fatalf("expected 10.0.0.4 to be added. saw %v", additions)
+	}
+
+	// adopted devices are labeled as they are removed
+	ip.SetAdoptUnlabeled(true)
+	removals, _ = ip.Compare4([]string{"10_0_0_1", "10_0_0_2", "10_0_0_3"}, []string{"10.0.0.4"})
+	if !reflect.DeepEqual(removals, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}) {
+		t.Fatalf("expected every device to be removed. saw %v", removals)
+	}
+	labeled := []string{}
+	for _, c := range runner.CommandLines() {
+		if strings.HasPrefix(c, "ip link set") {
+			labeled = append(labeled, c)
+		}
+	}
+	if want := []string{"ip link set dev 10_0_0_2 alias ravel", "ip link set dev 10_0_0_3 alias ravel"}; !reflect.DeepEqual(labeled, want) {
+		t.Fatalf("expected %v. saw %v", want, labeled)
+	}
+
+	// desired devices are labeled when they are found, whether or not
+	// unlabeled devices are adopted
+	ip.SetAdoptUnlabeled(false)
+	runner.Commands = nil
+	removals, _ = ip.Compare4([]string{"10_0_0_1", "10_0_0_2"}, []string{"10.0.0.1", "10.0.0.2"})
+	if len(removals) != 0 {
+		t.Fatalf("expected no removals. saw %v", removals)
+	}
+	if want := []string{"ip -o link show type dummy", "ip link set dev 10_0_0_2 alias ravel"}; !reflect.DeepEqual(runner.CommandLines(), want) {
+		t.Fatalf("expected %v. saw %v", want, runner.CommandLines())
+	}
+
+	// nothing is removed when ownership can't be read
+	runner.Respond("ip -o link show type dummy", "", errors.New("exit status 1"))
+	if removals, _ := ip.Compare4([]string{"10_0_0_1"}, []string{}); len(removals) != 0 {
+		t.Fatalf("expected no removals. saw %v", removals)
+	}
+}
+
+func TestCompare6Ownership(t *testing.T) {
+	runner := NewRecordingCommandRunner()
+	runner.Respond("ip -o link show type dummy", strings.Join([]string{
+		`4: kube-ipvs0: <BROADCAST,NOARP> mtu 1500 qdisc noop state DOWN mode DEFAULT group default\    link/ether 6e:0f:1d:2c:3b:4a brd ff:ff:ff:ff:ff:ff`,
+		`5: 2001db8100: <BROADCAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000\    link/ether 9e:64:3a:2c:0e:1f brd ff:ff:ff:ff:ff:ff\    alias ravel`,
+		`6: 2001db8101: <BROADCAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000\    link/ether 9e:64:3a:2c:0e:20 brd ff:ff:ff:ff:ff:ff\    alias ravel`,
+	}, "\n"), nil)
+
+	ip, err := NewIP(context.Background(), "eth0", "10.0.0.254", 2, 1, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip.SetCommandRunner(runner)
+
+	// 2001:db8::101 was removed from Config6, and 2001:db8::102 added
+	desired := []string{ip.Device("2001:db8::100", true), ip.Device("2001:db8::102", true)}
+	removals, additions := ip.Compare6([]string{"2001db8100", "2001db8101", "kube-ipvs0"}, desired)
+	if !reflect.DeepEqual(removals, []string{"2001db8101"}) {
+		t.Fatalf("expected only the stale device of ravel to be removed. saw %v", removals)
+	}
+	if !reflect.DeepEqual(additions, []string{"2001db8102"}) {
+		t.Fatalf("expected 2001:db8::102 to be added. saw %v", additions)
+	}
+}
+
+func TestSetReturnRoutes(t *testing.T) {
+	runner := NewRecordingCommandRunner()
+	runner.Respond("ip -4 rule show", strings.Join([]string{
+		"0:	from all lookup local",
+		"10100:	from 10.0.0.1 lookup 200",
+		"10100:	from 10.0.0.2 lookup 201",
+		"10100:	from 10.0.0.3 lookup 202",
+		"32766:	from all lookup main",
+		"32767:	from all lookup default",
+	}, "\n"), nil)
+
+	ip, err := NewIP(context.Background(), "eth0", "10.0.0.254", 2, 1, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip.SetCommandRunner(runner)
+
+	// .1 is routed already, .2 moves to table 200, .3 is no longer routed and
+	// .4 is new
+	err = ip.SetReturnRoutes(map[types.ServiceIP]types.ReturnRoute{
+		"10.0.0.1": {Interface: "eth1", Gateway: "10.1.0.1", Table: 200},
+		"10.0.0.2": {Interface: "eth1", Gateway: "10.1.0.1", Table: 200},
+		"10.0.0.4": {Interface: "eth2", Table: 203},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ip -4 rule show",
+		"ip -4 route replace default via 10.1.0.1 dev eth1 table 200",
+		"ip -4 route replace default dev eth2 table 203",
+		"ip -4 rule del from 10.0.0.2 lookup 201 priority 10100",
+		"ip -4 rule add from 10.0.0.2 lookup 200 priority 10100",
+		"ip -4 rule add from 10.0.0.4 lookup 203 priority 10100",
+		"ip -4 rule del from 10.0.0.3 lookup 202 priority 10100",
+		"ip -4 route del default table 201",
+		"ip -4 route del default table 202",
+	}
+	if !reflect.DeepEqual(runner.CommandLines(), want) {
+		t.Fatalf("expected %v. saw %v", want, runner.CommandLines())
+	}
+}
+
+func TestSetVRFs(t *testing.T) {
+	runner := NewRecordingCommandRunner()
+	runner.Respond("ip -d -o link show type vrf", strings.Join([]string{
+		`7: tenant-a: <NOARP,MASTER,UP,LOWER_UP> mtu 65575 qdisc noqueue state UP mode DEFAULT group default qlen 1000\    link/ether 5e:1c:2a:0b:3d:01 brd ff:ff:ff:ff:ff:ff promiscuity 0 \    vrf table 100 addrgenmode eui64 \    alias ravel`,
+		`8: tenant-b: <NOARP,MASTER,UP,LOWER_UP> mtu 65575 qdisc noqueue state UP mode DEFAULT group default qlen 1000\    link/ether 5e:1c:2a:0b:3d:02 brd ff:ff:ff:ff:ff:ff promiscuity 0 \    vrf table 300 addrgenmode eui64 \    alias ravel`,
+		`9: tenant-c: <NOARP,MASTER,UP,LOWER_UP> mtu 65575 qdisc noqueue state UP mode DEFAULT group default qlen 1000\    link/ether 5e:1c:2a:0b:3d:03 brd ff:ff:ff:ff:ff:ff promiscuity 0 \    vrf table 102 addrgenmode eui64 \    alias ravel`,
+		`10: mgmt: <NOARP,MASTER,UP,LOWER_UP> mtu 65575 qdisc noqueue state UP mode DEFAULT group default qlen 1000\    link/ether 5e:1c:2a:0b:3d:04 brd ff:ff:ff:ff:ff:ff promiscuity 0 \    vrf table 10 addrgenmode eui64`,
+	}, "\n"), nil)
+	runner.Respond("ip -o link show type dummy", strings.Join([]string{
+		`11: 10_0_0_1: <BROADCAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000\    link/ether 9e:64:3a:2c:0e:01 brd ff:ff:ff:ff:ff:ff\    alias ravel`,
+		`12: 10_0_0_2: <BROADCAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000\    link/ether 9e:64:3a:2c:0e:02 brd ff:ff:ff:ff:ff:ff\    alias ravel`,
+		`13: 10_0_0_3: <BROADCAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue master tenant-c state UNKNOWN mode DEFAULT group default qlen 1000\    link/ether 9e:64:3a:2c:0e:03 brd ff:ff:ff:ff:ff:ff\    alias ravel`,
+		`14: 10_0_0_4: <BROADCAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue master mgmt state UNKNOWN mode DEFAULT group default qlen 1000\    link/ether 9e:64:3a:2c:0e:04 brd ff:ff:ff:ff:ff:ff\    alias ravel`,
+		`15: 10_0_0_5: <BROADCAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000\    link/ether 9e:64:3a:2c:0e:05 brd ff:ff:ff:ff:ff:ff`,
+		`16: 2001db81: <BROADCAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000\    link/ether 9e:64:3a:2c:0e:06 brd ff:ff:ff:ff:ff:ff\    alias ravel`,
+	}, "\n"), nil)
+
+	ip, err := NewIP(context.Background(), "eth0", "10.0.0.254", 2, 1, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip.SetCommandRunner(runner)
+
+	// tenant-a is in place, tenant-b changes its table and tenant-c is no
+	// longer configured. mgmt and the devices in it aren't ravel's
+	err = ip.SetVRFs(map[string]types.VRF{
+		"tenant-a": {Table: 100, VIPs: []types.ServiceIP{"10.0.0.1", "2001:db8::1"}},
+		"tenant-b": {Table: 101, VIPs: []types.ServiceIP{"10.0.0.2", "10.0.0.5"}},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ip -d -o link show type vrf",
+		"ip link del tenant-b type vrf",
+		"ip link add tenant-b type vrf table 101",
+		"ip link set dev tenant-b alias ravel",
+		"ip link set dev tenant-b up",
+		"ip -o link show type dummy",
+		"ip link set dev 10_0_0_1 master tenant-a",
+		"ip link set dev 10_0_0_2 master tenant-b",
+		"ip link set dev 10_0_0_3 nomaster",
+		"ip link del tenant-c type vrf",
+	}
+	if !reflect.DeepEqual(runner.CommandLines(), want) {
+		t.Fatalf("expected %v. saw %v", want, runner.CommandLines())
+	}
+}
+
+func TestSysctlDrift(t *testing.T) {
+	sysctl := NewFakeSysctl(map[string]string{
+		"net/ipv4/conf/lo/arp_announce":   "2",
+		"net/ipv4/conf/lo/arp_ignore":     "0",
+		"net/ipv4/conf/all/rp_filter":     "0",
+		"net/ipv4/conf/tunl0/rp_filter":   "1",
+		"net/ipv4/conf/eth0/arp_ignore":   "1",
+		"net/ipv4/conf/eth0/arp_announce": "2",
+	})
+	ip := &IP{device: "lo", announce: 2, ignore: 1, sysctl: sysctl}
+
+	drift, err := ip.ARPDrift()
+	if err != nil || !reflect.DeepEqual(drift, []string{"lo/arp_ignore=0"}) {
+		t.Fatalf("expected arp_ignore to drift. have %v, %v", drift, err)
+	}
+	drift, err = ip.RPFilterDrift()
+	if err != nil || !reflect.DeepEqual(drift, []string{"tunl0/rp_filter=1"}) {
+		t.Fatalf("expected the rp_filter of tunl0 to drift. have %v, %v", drift, err)
+	}
+
+	if err := ip.SetARP(); err != nil {
+		t.Fatal(err)
+	}
+	if drift, err := ip.ARPDrift(); err != nil || len(drift) != 0 {
+		t.Fatalf("expected SetARP to repair the drift. have %v, %v", drift, err)
+	}
+}
@@ -6,9 +6,8 @@ import (
 	"context"
 	"fmt"
 	"github.com/Comcast/Ravel/pkg/stats"
-	"io"
+	"net"
 	"os"
-	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
@@ -18,6 +17,7 @@ import (
 	v1 "k8s.io/api/core/v1"
 
 	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
 	"github.com/Comcast/Ravel/pkg/watcher"
 )
 
@@ -36,6 +36,10 @@ type IPVS struct {
 	ignoreCordon   bool
 	weightOverride bool
 	defaultWeight  int
+
+	// weightedLimits divides the connection limits of a service among its
+	// nodes by weight, see SetWeightedLimits
+	weightedLimits bool
 	ctx            context.Context
 	logger         log.FieldLogger
 	waitMs         int
@@ -43,6 +47,61 @@ type IPVS struct {
 	logrule        bool
 	skipMasterNode bool
 	ravelMode      string
+
+	// ecmp is set when several directors advertise the same VIPs. Services are
+	// configured as fwmark services with a consistent-hash scheduler.
+	ecmp           bool
+	ecmpFwmarkBase int
+
+	// conntrack, when set, flushes the entries of removed services and backends
+	conntrack *Conntrack
+
+	// removalBudget, when above zero, limits the backends removed by a reconcile
+	removalBudget int
+	budgetMetrics removalBudgetMetrics
+
+	// shrinkGuard, when above zero, is the largest percentage of backends that
+	// a reconcile may remove
+	shrinkGuard   int
+	shrinkMetrics shrinkMetrics
+
+	// lastBackendPolicy is consulted before a virtual service loses its last
+	// healthy backend, see SetLastBackendGuard. lastBackendGuarded are the
+	// virtual services it last acted on, by ipType.
+	lastBackendPolicy  string
+	lastBackendMetrics lastBackendMetrics
+	lastBackendGuarded map[string]map[string]bool
+
+	// verify reads the rules back after every apply, see SetVerify
+	verify        bool
+	verifyRetries int
+	verifyMetrics verifyMetrics
+
+	runner CommandRunner
+
+	// diffLog records the changes of every apply, see SetDiffLog
+	diffLog *util.DiffLog
+
+	// adaptive scales the weights of reals by how they perform, see
+	// SetAdaptiveWeights
+	adaptive *adaptiveWeights
+
+	// saturation quiesces backends with too many active connections, see
+	// SetSaturationGuard
+	saturation *saturationGuard
+
+	// drain ramps the weight of draining nodes down, see SetNodeDrain
+	drain *nodeDrain
+
+	// ejection takes backends whose connections fail out of service, see
+	// SetEjection
+	ejection *ejection
+
+	// scope, when set, is the context commands run under, see SetScope
+	scope *util.Scope
+
+	// parityDiff is what differed in the last parity check, see ParityDiff
+	parityDiff ParityDiff
 }
 
 // NewIPVS creates a new IPVS struct which manages ipvsadm
@@ -71,9 +130,100 @@ func NewIPVS(ctx context.Context, primaryIP string, weightOverride bool, ignoreC
 		defaultWeight:  1, // just so there's no magic numbers to hunt down
 		waitMs:         waitMs,
 		earlylate:      earlylate,
+		runner:         execCommandRunner{},
 	}, nil
 }
 
+// SetCommandRunner replaces the runner used to execute ipvsadm
+func (i *IPVS) SetCommandRunner(r CommandRunner) {
+	i.runner = r
+}
+
+// CommandRunner returns the runner used to execute ipvsadm, so that it can be wrapped
+func (i *IPVS) CommandRunner() CommandRunner {
+	return i.runner
+}
+
+// SetWeightedLimits divides the uThreshold and lThreshold of every service
+// among its nodes in proportion to their weights, the ready pods of the
+// service each hosts, instead of equally. A node the service scaled onto with
+// more replicas then takes more connections before it is overloaded. It has
+// no effect when weights are overridden.
+func (i *IPVS) SetWeightedLimits(enabled bool) {
+	i.weightedLimits = enabled
+}
+
+// SetScope runs ipvsadm under the context of scope, so that a reconcile that
+// binds it cancels the commands it started once it runs out of time or is stopped
+func (i *IPVS) SetScope(scope *util.Scope) {
+	i.scope = scope
+}
+
+// cmdContext is the context commands run under
+func (i *IPVS) cmdContext() context.Context {
+	if i.scope != nil {
+		return i.scope.Context()
+	}
+	return i.ctx
+}
+
+// SetDiffLog records the diff between the configured and the generated rules
+// of every apply in l
+func (i *IPVS) SetDiffLog(l *util.DiffLog) {
+	i.diffLog = l
+}
+
+// logDiff records the change from configured to generated in the diff log. Both
+// are sorted first, since ipvsadm lists services in its own order.
+func (i *IPVS) logDiff(ipType string, configured, generated []string) {
+	if i.diffLog == nil {
+		return
+	}
+	configured = append([]string(nil), configured...)
+	generated = append([]string(nil), generated...)
+	sort.Strings(configured)
+	sort.Strings(generated)
+	i.diffLog.Log("ipvs-"+ipType, configured, generated)
+}
+
+// SetConntrack flushes the connection tracking entries of every virtual service
+// and backend that Set removes, so flows don't stay pinned to them
+func (i *IPVS) SetConntrack(c *Conntrack) {
+	i.conntrack = c
+}
+
+// EnableECMP switches IPv4 rule generation to ECMP mode, where every director
+// in the ECMP set produces identical fwmark services and uses a consistent-hash
+// scheduler, so a flow lands on the same realserver no matter which director
+// the router picks.
+func (i *IPVS) EnableECMP(fwmarkBase int) {
+	i.logger.Infof("ipvs: enabling ecmp mode with fwmark base %#x", fwmarkBase)
+	i.ecmp = true
+	i.ecmpFwmarkBase = fwmarkBase
+}
+
+// ECMPEnabled returns true when EnableECMP has been called
+func (i *IPVS) ECMPEnabled() bool {
+	return i.ecmp
+}
+
+// ECMPFwmarks returns the fwmarks used for the IPv4 services in config
+func (i *IPVS) ECMPFwmarks(config *types.ClusterConfig) ([]types.ECMPFwmark, error) {
+	return types.ECMPFwmarks(config, i.ecmpFwmarkBase)
+}
+
+// virtualService returns the service portion of an ipvsadm rule, i.e. `-t 10.1.2.3:80`,
+// or `-f 1048580` when running in ECMP mode.
+func (i *IPVS) virtualService(marks map[string]int, vip types.ServiceIP, port string, protocol string) string {
+	if i.ecmp {
+		return fmt.Sprintf("-f %d", marks[types.ECMPFwmarkKey(vip, port, protocol)])
+	}
+	if protocol == "udp" {
+		return fmt.Sprintf("-u %s:%s", vip, port)
+	}
+	return fmt.Sprintf("-t %s:%s", vip, port)
+}
+
 // =====================================================================================================
 
 // getConfiguredIPVS returns the output of `ipvsadm -Sn`
@@ -89,11 +239,10 @@ func (i *IPVS) Get() ([]string, error) {
 	// run the ipvsadm command
 	// log.Debugln("ipvs: Get(): Running ipvsadm -Sn")
 
-	cmdCtx, cmdContextCancel := context.WithTimeout(i.ctx, time.Second*20)
+	cmdCtx, cmdContextCancel := context.WithTimeout(i.cmdContext(), time.Second*20)
 	defer cmdContextCancel()
 
-	cmd := exec.CommandContext(cmdCtx, "ipvsadm", "-Sn")
-	stdout, err := cmd.Output()
+	stdout, err := i.runner.Run(cmdCtx, nil, "ipvsadm", "-Sn")
 	if err != nil {
 		return nil, fmt.Errorf("ipvs: ipvsadm -Sn failed with %v", err)
 	}
@@ -136,12 +285,11 @@ func (i *IPVS) GetV6() ([]string, error) {
 
 	log.Debugln("ipvs: GetV6: Running ipvsadm -Sn")
 
-	cmdCtx, cmdContextCancel := context.WithTimeout(i.ctx, time.Second*20)
+	cmdCtx, cmdContextCancel := context.WithTimeout(i.cmdContext(), time.Second*20)
 	defer cmdContextCancel()
 
 	// run the ipvsadm command
-	cmd := exec.CommandContext(cmdCtx, "ipvsadm", "-Sn")
-	stdout, err := cmd.Output()
+	stdout, err := i.runner.Run(cmdCtx, nil, "ipvsadm", "-Sn")
 	if err != nil {
 		return nil, fmt.Errorf("ipvs: ipvsadm -Sn failed with %v", err)
 	}
@@ -177,31 +325,17 @@ func (i *IPVS) Set(rules []string) ([]byte, error) {
 	// 	log.Debugln("ipvs: setting rule: ipvsadm", r)
 	// }
 
-	cmdCtx, cmdContextCancel := context.WithTimeout(i.ctx, time.Minute)
+	cmdCtx, cmdContextCancel := context.WithTimeout(i.cmdContext(), time.Minute)
 	defer cmdContextCancel()
 
 	// run the ipvsadm command
-	cmd := exec.CommandContext(cmdCtx, "ipvsadm", "-R")
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return nil, fmt.Errorf("ipvs: ipvsadm -R failed with %v", err)
-	}
-	defer stdin.Close()
-
-	var b bytes.Buffer
-	cmd.Stdout = &b
-	cmd.Stderr = &b
-
 	input := strings.Join(rules, "\n")
 	// log.Debugln("ipvs: inputting ipvsadm rules:", input)
-	err = cmd.Start()
-	if err != nil {
-		return nil, err
+	out, err := i.runner.Run(cmdCtx, []byte(input), "ipvsadm", "-R")
+	if err == nil && i.conntrack != nil {
+		i.conntrack.FlushRemoved(rules)
 	}
-	io.WriteString(stdin, input)
-	stdin.Close()
-	// log.Debugln("ipvs: done inputting ipvsadm rules")
-	return b.Bytes(), cmd.Wait()
+	return out, util.WithClass(util.ErrKernelApply, err)
 }
 
 func (i *IPVS) Teardown(ctx context.Context) error {
@@ -210,17 +344,23 @@ func (i *IPVS) Teardown(ctx context.Context) error {
 	cmdCtx, cmdContextCancel := context.WithTimeout(ctx, time.Second*20)
 	defer cmdContextCancel()
 
-	cmd := exec.CommandContext(cmdCtx, "ipvsadm", "-C")
-	return cmd.Run()
+	_, err := i.runner.Run(cmdCtx, nil, "ipvsadm", "-C")
+	return err
 }
 
-func pickFirstInternalIP(node *v1.Node) (string, error) {
-	for _, ip := range node.Status.Addresses {
-		if ip.Type == v1.NodeInternalIP {
-			return ip.Address, nil
+// backendAddress returns the address of node in the family of the rules being
+// generated. The address is the one the node's weights are keyed by.
+func backendAddress(node *v1.Node, v6 bool) (string, error) {
+	if v6 {
+		if ip := types.IPV6(node); ip != "" {
+			return ip, nil
 		}
+		return "", fmt.Errorf("node %s has no IPv6 address set", node.Name)
+	}
+	if ip := types.IPV4(node); ip != "" {
+		return ip, nil
 	}
-	return "", fmt.Errorf("node %s has no internal IP address set", node.Name)
+	return "", fmt.Errorf("node %s has no IPv4 address set", node.Name)
 }
 
 // generateRules takes a list of nodes and a clusterconfig and creates a complete
@@ -235,6 +375,17 @@ func (i *IPVS) generateRules(w *watcher.Watcher, nodes []*v1.Node, config *types
 		log.Debugln("ipvs: generateRules run time:", time.Since(startTime))
 	}()
 
+	marks := map[string]int{}
+	if i.ecmp {
+		fwmarks, err := i.ECMPFwmarks(config)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fwmarks {
+			marks[f.Key()] = f.Mark
+		}
+	}
+
 	for vip, ports := range config.Config {
 
 		// vipStartTime := time.Now()
@@ -242,31 +393,41 @@ func (i *IPVS) generateRules(w *watcher.Watcher, nodes []*v1.Node, config *types
 
 		// Add rules for Frontend ipvsadm
 		for port, serviceConfig := range ports {
+			// translated ports are served by the service of the paired VIP, and
+			// transparently proxied ones by the local proxy
+			if serviceConfig.Translated() || serviceConfig.TProxied() {
+				continue
+			}
 
 			// log.Debugln("ipvs: The scheduler for service", serviceConfig.Service, serviceConfig.PortName, "is set to", serviceConfig.IPVSOptions.Scheduler())
 			// log.Debugln("ipvs: The raw scheduler for service", serviceConfig.Service, serviceConfig.PortName, "is set to", serviceConfig.IPVSOptions.RawScheduler)
 
-			// If we have the scheduler set to `mh`, and flags are blank, then set flag-1,flag-2.
-			// This prevents dropped packets when maglev is used.
-			if serviceConfig.IPVSOptions.Scheduler() == "mh" && serviceConfig.IPVSOptions.Flags == "" {
-				log.Infoln("ipvs: Assuming flag-1,flag-2 for mh scheduler without flags.  Name:", serviceConfig.Service)
-				serviceConfig.IPVSOptions.Flags = "flag-1,flag-2"
+			// in ecmp mode, only consistent-hash schedulers keep flows on the same realserver
+			// when the router moves them between directors
+			scheduler := serviceConfig.IPVSOptions.Scheduler()
+			if i.ecmp {
+				scheduler = types.ECMPScheduler(serviceConfig.IPVSOptions)
 			}
 
+			// If we have the scheduler set to `mh`, and flags are blank, then set flag-1,flag-2.
+			// This prevents dropped packets when maglev is used. The config is shared
+			// with other readers, so the default is applied to a copy of the flags.
+			flags := ipvsFlags(scheduler, serviceConfig.IPVSOptions)
+
 			// log.Debugln("ipvs: generating ipvs rule for", port, serviceConfig)
 			// set rules for tcp / udp
 			if serviceConfig.TCPEnabled {
 				rule := fmt.Sprintf(
-					"-A -t %s:%s -s %s",
-					vip,
-					port,
-					serviceConfig.IPVSOptions.Scheduler(),
+					"-A %s -s %s",
+					i.virtualService(marks, vip, port, "tcp"),
+					scheduler,
 				)
 
 				// flags default empty; only append if we have arguments
-				if serviceConfig.IPVSOptions.Flags != "" {
-					rule = fmt.Sprintf("%s -b %s", rule, serviceConfig.IPVSOptions.Flags)
+				if flags != "" {
+					rule = fmt.Sprintf("%s -b %s", rule, flags)
 				}
+				rule += serviceConfig.IPVSOptions.PersistenceArgs(false)
 
 				rules = append(rules, rule)
 			}
@@ -274,16 +435,17 @@ func (i *IPVS) generateRules(w *watcher.Watcher, nodes []*v1.Node, config *types
 			if serviceConfig.UDPEnabled {
 				// log.Debugln("ipvs: generating udp ipvs rule for", port, serviceConfig)
 				rule := fmt.Sprintf(
-					"-A -u %s:%s -s %s",
-					vip,
-					port,
-					serviceConfig.IPVSOptions.Scheduler(),
+					"-A %s -s %s",
+					i.virtualService(marks, vip, port, "udp"),
+					scheduler,
 				)
 
 				// flags default empty; only append if we have arguments
-				if serviceConfig.IPVSOptions.Flags != "" {
-					rule = fmt.Sprintf("%s -b %s", rule, serviceConfig.IPVSOptions.Flags)
+				if flags != "" {
+					rule = fmt.Sprintf("%s -b %s", rule, flags)
 				}
+				rule += serviceConfig.IPVSOptions.PersistenceArgs(false)
+				rule += serviceConfig.IPVSOptions.UDPArgs()
 
 				// log.Debugln("ipvs: Generated IPVS rule:", rule)
 				rules = append(rules, rule)
@@ -295,6 +457,7 @@ func (i *IPVS) generateRules(w *watcher.Watcher, nodes []*v1.Node, config *types
 	// filter to just eligible nodes. right now this can be done at the
 	// outer scope, but if nodes are to be filtered on the basis of endpoints,
 	// this functionality may need to move to the inner loop.
+	i.drain.observe(nodes)
 	eligibleNodes := []*v1.Node{}
 	for _, node := range nodes {
 		eligible, _ := types.IsEligibleBackendV4(node, config.NodeLabels, i.nodeIP, i.ignoreCordon, i.skipMasterNode)
@@ -312,24 +475,31 @@ func (i *IPVS) generateRules(w *watcher.Watcher, nodes []*v1.Node, config *types
 		// Now iterate over the whole set of services and all of the nodes for each
 		// service writing ipvsadm rules for each element of the full set
 		for port, serviceConfig := range ports {
+			// translated ports are served by the service of the paired VIP, and
+			// transparently proxied ones by the local proxy
+			if serviceConfig.Translated() || serviceConfig.TProxied() {
+				continue
+			}
 			// log.Debugln("ipvs: generating ipvs rule for", port)
-			nodeSettings := getNodeWeightsAndLimits(eligibleNodes, w, serviceConfig, i.weightOverride, i.defaultWeight)
+			nodeSettings := getNodeWeightsAndLimits(eligibleNodes, w, serviceConfig, i.weightOverride, i.weightedLimits, i.defaultWeight)
 			for _, n := range eligibleNodes {
-				nodeAddress, err := pickFirstInternalIP(n)
+				nodeAddress, err := backendAddress(n, false)
 				if err != nil {
 					log.Errorln("ipvs: unable to find node IP:", err)
 					continue
 				}
+				realPort := serviceConfig.RealPort(port, n.Labels)
+				weight := i.realWeight(vip, port, nodeAddress, realPort, nodeSettings[nodeAddress].weight, serviceConfig)
 				// log.Debugln("ipvs: generating backend ipvs rule for node", n.Name, "at address", nodeAddress)
 				// ipvsadm -a -t $VIP_ADDR:<port> -r $backend:<port> -g -w 1 -x 0 -y 0
 
 				if serviceConfig.TCPEnabled {
 					rule := fmt.Sprintf(
-						"-a -t %s:%s -r %s:%s -%s -w %d -x %d -y %d",
-						vip, port,
-						nodeAddress, port,
+						"-a %s -r %s:%s -%s -w %d -x %d -y %d",
+						i.virtualService(marks, vip, port, "tcp"),
+						nodeAddress, realPort,
 						nodeSettings[nodeAddress].forwardingMethod,
-						nodeSettings[nodeAddress].weight,
+						weight,
 						nodeSettings[nodeAddress].uThreshold,
 						nodeSettings[nodeAddress].lThreshold,
 					)
@@ -340,11 +510,11 @@ func (i *IPVS) generateRules(w *watcher.Watcher, nodes []*v1.Node, config *types
 
 				if serviceConfig.UDPEnabled {
 					rule := fmt.Sprintf(
-						"-a -u %s:%s -r %s:%s -%s -w %d -x %d -y %d",
-						vip, port,
-						nodeAddress, port,
+						"-a %s -r %s:%s -%s -w %d -x %d -y %d",
+						i.virtualService(marks, vip, port, "udp"),
+						nodeAddress, realPort,
 						nodeSettings[nodeAddress].forwardingMethod,
-						nodeSettings[nodeAddress].weight,
+						weight,
 						nodeSettings[nodeAddress].uThreshold,
 						nodeSettings[nodeAddress].lThreshold,
 					)
@@ -356,10 +526,89 @@ func (i *IPVS) generateRules(w *watcher.Watcher, nodes []*v1.Node, config *types
 		}
 	}
 
+	steering, err := i.generateSteeringRules(w, nodes, config)
+	if err != nil {
+		return nil, err
+	}
+	rules = append(rules, steering...)
+
 	sort.Sort(ipvsRules(rules))
 	return rules, nil
 }
 
+// ipvsFlags returns the flags of a virtual service using scheduler. The mh
+// scheduler is given flag-1,flag-2 when options set none.
+func ipvsFlags(scheduler string, options types.IPVSOptions) string {
+	if scheduler == "mh" && options.Flags == "" {
+		return "flag-1,flag-2"
+	}
+	return options.Flags
+}
+
+// generateSteeringRules creates a fwmark service for the clients of each
+// steering rule, whose traffic the mangle table marks. Its backends are the
+// eligible nodes that also carry the labels of the rule, weighted by the
+// endpoints of the rule's service.
+func (i *IPVS) generateSteeringRules(w *watcher.Watcher, nodes []*v1.Node, config *types.ClusterConfig) ([]string, error) {
+	marks, err := types.SteeringFwmarks(config)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []string{}
+	for _, m := range marks {
+		serviceConfig := config.Config[m.VIP][m.Port]
+
+		scheduler := serviceConfig.IPVSOptions.Scheduler()
+		if i.ecmp {
+			scheduler = types.ECMPScheduler(serviceConfig.IPVSOptions)
+		}
+		rule := fmt.Sprintf("-A -f %d -s %s", m.Mark, scheduler)
+		if flags := ipvsFlags(scheduler, serviceConfig.IPVSOptions); flags != "" {
+			rule = fmt.Sprintf("%s -b %s", rule, flags)
+		}
+		rule += serviceConfig.IPVSOptions.PersistenceArgs(false)
+		if m.Protocol == "udp" {
+			rule += serviceConfig.IPVSOptions.UDPArgs()
+		}
+		rules = append(rules, rule)
+
+		labels := map[string]string{}
+		for k, v := range config.NodeLabels {
+			labels[k] = v
+		}
+		for k, v := range m.Rule.NodeLabels {
+			labels[k] = v
+		}
+		backends := []*v1.Node{}
+		for _, node := range nodes {
+			if eligible, _ := types.IsEligibleBackendV4(node, labels, i.nodeIP, i.ignoreCordon, i.skipMasterNode); eligible {
+				backends = append(backends, node)
+			}
+		}
+
+		nodeSettings := getNodeWeightsAndLimits(backends, w, m.Rule.Target(serviceConfig), i.weightOverride, i.weightedLimits, i.defaultWeight)
+		for _, n := range backends {
+			nodeAddress, err := backendAddress(n, false)
+			if err != nil {
+				log.Errorln("ipvs: unable to find node IP:", err)
+				continue
+			}
+			realPort := serviceConfig.RealPort(m.Port, n.Labels)
+			rules = append(rules, fmt.Sprintf(
+				"-a -f %d -r %s:%s -%s -w %d -x %d -y %d",
+				m.Mark,
+				nodeAddress, realPort,
+				nodeSettings[nodeAddress].forwardingMethod,
+				i.ejection.weight(net.JoinHostPort(nodeAddress, realPort), i.backendWeight(nodeAddress, nodeSettings[nodeAddress].weight)),
+				nodeSettings[nodeAddress].uThreshold,
+				nodeSettings[nodeAddress].lThreshold,
+			))
+		}
+	}
+	return rules, nil
+}
+
 // generateRules takes a list of nodes and a clusterconfig and creates a complete
 // set of IPVS rules for application.
 // In order to accept IPVS Options, what do we do?
@@ -378,14 +627,15 @@ func (i *IPVS) generateRulesV6(w *watcher.Watcher, nodes []*v1.Node, config *typ
 	for vip, ports := range config.Config6 {
 		// Add rules for Frontend ipvsadm as tcp / udp
 		for port, serviceConfig := range ports {
+			// translated ports are served by the service of the paired VIP, and
+			// transparently proxied ones by the local proxy
+			if serviceConfig.Translated() || serviceConfig.TProxied() {
+				continue
+			}
 
 			// If we have the scheduler set to `mh`, and flags are blank, then set flag-1,flag-2.
 			// This prevents dropped packets when maglev is used.
-			if serviceConfig.IPVSOptions.Scheduler() == "mh" && serviceConfig.IPVSOptions.Flags == "" {
-				serviceConfig.IPVSOptions.Flags = "flag-1,flag-2"
-				// log.Debugln("v6 ipvs: The scheduler for service", serviceConfig.Service, serviceConfig.PortName, "is set to", serviceConfig.IPVSOptions.Scheduler())
-				// log.Debugln("v6 ipvs: The raw scheduler for service", serviceConfig.Service, serviceConfig.PortName, "is set to", serviceConfig.IPVSOptions.RawScheduler)
-			}
+			flags := ipvsFlags(serviceConfig.IPVSOptions.Scheduler(), serviceConfig.IPVSOptions)
 
 			// set rules for tcp / udp
 			if serviceConfig.TCPEnabled {
@@ -397,9 +647,10 @@ func (i *IPVS) generateRulesV6(w *watcher.Watcher, nodes []*v1.Node, config *typ
 				)
 
 				// flags default empty; only append if we have arguments
-				if serviceConfig.IPVSOptions.Flags != "" {
-					rule = fmt.Sprintf("%s -b %s", rule, serviceConfig.IPVSOptions.Flags)
+				if flags != "" {
+					rule = fmt.Sprintf("%s -b %s", rule, flags)
 				}
+				rule += serviceConfig.IPVSOptions.PersistenceArgs(true)
 
 				rules = append(rules, rule)
 			}
@@ -413,9 +664,11 @@ func (i *IPVS) generateRulesV6(w *watcher.Watcher, nodes []*v1.Node, config *typ
 				)
 
 				// flags default empty; only append if we have arguments
-				if serviceConfig.IPVSOptions.Flags != "" {
-					rule = fmt.Sprintf("%s -b %s", rule, serviceConfig.IPVSOptions.Flags)
+				if flags != "" {
+					rule = fmt.Sprintf("%s -b %s", rule, flags)
 				}
+				rule += serviceConfig.IPVSOptions.PersistenceArgs(true)
+				rule += serviceConfig.IPVSOptions.UDPArgs()
 
 				// log.Debugln("ipvs: Generated IPVS V6 rule:", rule, "for vip", vip)
 				rules = append(rules, rule)
@@ -426,6 +679,7 @@ func (i *IPVS) generateRulesV6(w *watcher.Watcher, nodes []*v1.Node, config *typ
 	// filter to just eligible nodes. right now this can be done at the
 	// outer scope, but if nodes are to be filtered on the basis of endpoints,
 	// this functionality may need to move to the inner loop.
+	i.drain.observe(nodes)
 	eligibleNodes := []*v1.Node{}
 	for _, node := range nodes {
 		eligible, _ := types.IsEligibleBackendV6(node, config.NodeLabels, i.nodeIP, i.ignoreCordon, i.skipMasterNode)
@@ -441,21 +695,28 @@ func (i *IPVS) generateRulesV6(w *watcher.Watcher, nodes []*v1.Node, config *typ
 		// Now iterate over the whole set of services and all of the nodes for each
 		// service writing ipvsadm rules for each element of the full set
 		for port, serviceConfig := range ports {
-			nodeSettings := getNodeWeightsAndLimits(eligibleNodes, w, serviceConfig, i.weightOverride, i.defaultWeight)
+			// translated ports are served by the service of the paired VIP, and
+			// transparently proxied ones by the local proxy
+			if serviceConfig.Translated() || serviceConfig.TProxied() {
+				continue
+			}
+			nodeSettings := getNodeWeightsAndLimits(eligibleNodes, w, serviceConfig, i.weightOverride, i.weightedLimits, i.defaultWeight)
 			for _, n := range eligibleNodes {
-				nodeAddress, err := pickFirstInternalIP(n)
+				nodeAddress, err := backendAddress(n, true)
 				if err != nil {
 					log.Errorln("ipvs: unable to find node IP:", err)
 					continue
 				}
+				realPort := serviceConfig.RealPort(port, n.Labels)
+				weight := i.realWeight(vip, port, nodeAddress, realPort, nodeSettings[nodeAddress].weight, serviceConfig)
 				// ipvsadm -a -t $VIP_ADDR:<port> -r $backend:<port> -g -w 1 -x 0 -y 0
 				if serviceConfig.TCPEnabled {
 					rule := fmt.Sprintf(
 						"-a -t [%s]:%s -r [%s]:%s -%s -w %d -x %d -y %d",
 						vip, port,
-						nodeAddress, port,
+						nodeAddress, realPort,
 						nodeSettings[nodeAddress].forwardingMethod,
-						nodeSettings[nodeAddress].weight,
+						weight,
 						nodeSettings[nodeAddress].uThreshold,
 						nodeSettings[nodeAddress].lThreshold,
 					)
@@ -466,9 +727,9 @@ func (i *IPVS) generateRulesV6(w *watcher.Watcher, nodes []*v1.Node, config *typ
 					rule := fmt.Sprintf(
 						"-a -u [%s]:%s -r [%s]:%s -%s -w %d -x %d -y %d",
 						vip, port,
-						nodeAddress, port,
+						nodeAddress, realPort,
 						nodeSettings[nodeAddress].forwardingMethod,
-						nodeSettings[nodeAddress].weight,
+						weight,
 						nodeSettings[nodeAddress].uThreshold,
 						nodeSettings[nodeAddress].lThreshold,
 					)
@@ -486,7 +747,7 @@ func (i *IPVS) WaitAWhile() {
 
 	select {
 	case <-time.After(time.Duration(i.waitMs) * time.Millisecond):
-	case <-i.ctx.Done():
+	case <-i.cmdContext().Done():
 		return
 	}
 
@@ -566,6 +827,11 @@ func (i *IPVS) SetIPVSEarlyLate(w *watcher.Watcher, config *types.ClusterConfig,
 	}
 	log.Debugln("ipvs: done generating rules after", time.Since(startTime))
 
+	ipvsGenerated = i.guardLastBackends(w.ConfigMap, ipType, ipvsConfigured, ipvsGenerated)
+	if err := i.checkShrink(w.ConfigMap, ipType, ipvsConfigured, ipvsGenerated); err != nil {
+		return err
+	}
+
 	// generate a set of deletions + creations
 	log.Debugln("ipvs: start merging rules after", time.Since(startTime))
 
@@ -573,6 +839,15 @@ func (i *IPVS) SetIPVSEarlyLate(w *watcher.Watcher, config *types.ClusterConfig,
 	rulesEarly, rulesLate := i.mergeEarlyLate(ipvsConfigured, ipvsGenerated)
 	log.Debugln("ipvs: merging rules duration", time.Since(startTime2))
 
+	if i.removalBudget > 0 {
+		var used, deferredEarly, deferredLate int
+		rulesEarly, used, deferredEarly = limitRemovals(rulesEarly, i.removalBudget)
+		rulesLate, _, deferredLate = limitRemovals(rulesLate, i.removalBudget-used)
+		i.recordDeferred(deferredEarly + deferredLate)
+	}
+
+	i.logDiff(ipType, ipvsConfigured, ipvsGenerated)
+
 	if i.logrule && len(rulesEarly)+len(rulesLate) > 0 {
 		i.logRules("configured", ipvsConfigured, ts)
 		i.logRules("generated", ipvsGenerated, ts)
@@ -613,6 +888,10 @@ func (i *IPVS) SetIPVSEarlyLate(w *watcher.Watcher, config *types.ClusterConfig,
 		log.Debugln("ipvs: done applying rules after", time.Since(startTime))
 	}
 
+	if err := i.verifyApplied(ipType, append(rulesEarly, rulesLate...)); err != nil {
+		return err
+	}
+
 	log.Debugln("ipvs: done merging and applying rules after", time.Since(startTime))
 	// log.Debugln("ipvs: done merging and applying rules")
 	return nil
@@ -655,6 +934,11 @@ func (i *IPVS) SetIPVSRules(w *watcher.Watcher, config *types.ClusterConfig, log
 	}
 	log.Debugln("ipvs: done generating rules after", time.Since(startTime))
 
+	ipvsGenerated = i.guardLastBackends(w.ConfigMap, ipType, ipvsConfigured, ipvsGenerated)
+	if err := i.checkShrink(w.ConfigMap, ipType, ipvsConfigured, ipvsGenerated); err != nil {
+		return err
+	}
+
 	// generate a set of deletions + creations
 	log.Debugln("ipvs: start merging rules after", time.Since(startTime))
 
@@ -662,6 +946,14 @@ func (i *IPVS) SetIPVSRules(w *watcher.Watcher, config *types.ClusterConfig, log
 
 	log.Debugln("ipvs: done merging rules after", time.Since(startTime))
 
+	if i.removalBudget > 0 {
+		var deferred int
+		rules, _, deferred = limitRemovals(rules, i.removalBudget)
+		i.recordDeferred(deferred)
+	}
+
+	i.logDiff(ipType, ipvsConfigured, ipvsGenerated)
+
 	if i.logrule && len(rules) > 0 {
 
 		i.logRules("configured", ipvsConfigured, ts)
@@ -683,6 +975,10 @@ func (i *IPVS) SetIPVSRules(w *watcher.Watcher, config *types.ClusterConfig, log
 		log.Debugln("ipvs: done applying rules after", time.Since(startTime))
 	}
 
+	if err := i.verifyApplied(ipType, rules); err != nil {
+		return err
+	}
+
 	log.Debugln("ipvs: done merging and applying rules after", time.Since(startTime))
 	// log.Debugln("ipvs: done merging and applying rules")
 	return nil
@@ -737,33 +1033,44 @@ type nodeConfig struct {
 }
 
 // getNodeWeights returns the relative weighting for each node, and computes
-// connection limits based on those weights. currently all nodes have an equal
-// weight, so the computation is easy. In the future, when endpoints are considered
-// here, perNodeX and perNodeY will be adjusted on the basis of relative weight
-func getNodeWeightsAndLimits(eligibleNodes []*v1.Node, w *watcher.Watcher, serviceConfig *types.ServiceDef, weightOverride bool, defaultWeight int) map[string]nodeConfig {
+// connection limits based on those weights. A node's weight is the number of
+// ready pods of the service it hosts, so it grows and shrinks with the
+// service's replicas, i.e. as an autoscaler scales them. The limits are divided
+// equally across the nodes, or, with weightedLimits, in proportion to the
+// node's share of the weight of the eligible nodes.
+func getNodeWeightsAndLimits(eligibleNodes []*v1.Node, w *watcher.Watcher, serviceConfig *types.ServiceDef, weightOverride bool, weightedLimits bool, defaultWeight int) map[string]nodeConfig {
 
 	nodeWeights := map[string]nodeConfig{}
 	if len(eligibleNodes) == 0 {
 		return nodeWeights
 	}
 
-	perNodeX := serviceConfig.IPVSOptions.UThreshold() / len(w.Nodes)
-	perNodeY := serviceConfig.IPVSOptions.LThreshold() / len(w.Nodes)
-
-	// if either of the per-node calcs exceed the limits for ipvs, nuke em both
-	if perNodeX > 65535 || perNodeY > 65535 {
-		perNodeX, perNodeY = 0, 0
+	weights := make([]int, len(eligibleNodes))
+	totalWeight := 0
+	for n, node := range eligibleNodes {
+		weights[n] = defaultWeight
+		if !weightOverride {
+			weights[n] = getNodeWeightForService(w, node.Name, serviceConfig)
+		}
+		totalWeight += weights[n]
 	}
 
-	for _, node := range eligibleNodes {
-		weight := defaultWeight
-		if !weightOverride {
-			weight = getNodeWeightForService(w, node.Name, serviceConfig)
+	for n, node := range eligibleNodes {
+		perNodeX := serviceConfig.IPVSOptions.UThreshold() / len(w.Nodes)
+		perNodeY := serviceConfig.IPVSOptions.LThreshold() / len(w.Nodes)
+		if weightedLimits && !weightOverride && totalWeight > 0 {
+			perNodeX = weightedShare(serviceConfig.IPVSOptions.UThreshold(), weights[n], totalWeight)
+			perNodeY = weightedShare(serviceConfig.IPVSOptions.LThreshold(), weights[n], totalWeight)
+		}
+
+		// if either of the per-node calcs exceed the limits for ipvs, nuke em both
+		if perNodeX > 65535 || perNodeY > 65535 {
+			perNodeX, perNodeY = 0, 0
 		}
 
 		cfg := nodeConfig{
 			forwardingMethod: serviceConfig.IPVSOptions.ForwardingMethod(),
-			weight:           weight,
+			weight:           weights[n],
 			uThreshold:       perNodeX,
 			lThreshold:       perNodeY,
 		}
@@ -775,8 +1082,21 @@ func getNodeWeightsAndLimits(eligibleNodes []*v1.Node, w *watcher.Watcher, servi
 	return nodeWeights
 }
 
+// weightedShare returns the share of limit of a node with weight out of total.
+// A positive share that rounds down to 0 is 1, since a limit of 0 leaves the
+// node unlimited rather than limited the most.
+func weightedShare(limit, weight, total int) int {
+	share := limit * weight / total
+	if share == 0 && limit > 0 && weight > 0 {
+		return 1
+	}
+	return share
+}
+
 // getNodeWeightForService gets the weight for a specific node as it relates to a specific
-// service configuration
+// service configuration. Endpoints only list ready pods, so a node whose pods are all
+// terminating gets a weight of 0, which keeps its established connections but sends it
+// no new ones.
 func getNodeWeightForService(watcher *watcher.Watcher, node string, serviceConfig *types.ServiceDef) int {
 	var weight int
 	serviceEndpoints := watcher.GetEndpointAddressesForService(serviceConfig.Service, serviceConfig.Namespace, serviceConfig.PortName)
@@ -1199,6 +1519,7 @@ func (i *IPVS) CheckConfigParity(w *watcher.Watcher, config *types.ClusterConfig
 	defer func() {
 		log.Debugln("ipvs: CheckConfigParity run time:", time.Since(startTime))
 	}()
+	i.parityDiff = ParityDiff{}
 
 	// =======================================================
 	// == Perform check whether we're ready to start working
@@ -1243,6 +1564,12 @@ func (i *IPVS) CheckConfigParity(w *watcher.Watcher, config *types.ClusterConfig
 		return false, fmt.Errorf("ipvs: CheckConfigParity: error generating new IPVS rules: %v", err)
 	}
 
+	// count what differs, so that a mismatch can be explained without debug logs
+	diff := ParityDiff{}
+	diff.diffAddresses(vips, addresses)
+	i.diffRules(&diff, ipvsConfigured, ipvsGenerated)
+	i.parityDiff = diff
+
 	// compare and return
 	// XXX this might not be platform-independent...
 	if !compareIPSlices(vips, addresses) {
@@ -1258,6 +1585,25 @@ func (i *IPVS) CheckConfigParity(w *watcher.Watcher, config *types.ClusterConfig
 		log.Debugln("ipvs: CheckConfigParity: ipvsEquality returned equal")
 	}
 
+	// v6 rules are only compared when there are v6 vips, so that clusters
+	// without them don't pay for a second pass
+	if isEqual && len(config.Config6) > 0 {
+		ipvsConfigured6, err := i.GetV6()
+		if err != nil {
+			return false, fmt.Errorf("ipvs: CheckConfigParity: ipvsConfigured6 had an error: %w", err)
+		}
+		ipvsGenerated6, err := i.generateRulesV6(w, w.Nodes, config)
+		if err != nil {
+			return false, fmt.Errorf("ipvs: CheckConfigParity: error generating new IPv6 IPVS rules: %v", err)
+		}
+		isEqual = i.ipvsEquality(ipvsConfigured6, ipvsGenerated6)
+		if !isEqual {
+			log.Debugln("ipvs: CheckConfigParity: ipvsEquality returned NOT equal for IPv6")
+			i.diffRules(&diff, ipvsConfigured6, ipvsGenerated6)
+			i.parityDiff = diff
+		}
+	}
+
 	return isEqual, nil
 }
 
@@ -1412,7 +1758,8 @@ func (r ipvsRules) Less(i, j int) bool {
 		// splitting out data to determine whether vips are the same
 		iPair := strings.Split(iVIP, ":")
 		jPair := strings.Split(jVIP, ":")
-		if iPair[0] != jPair[0] {
+		if iPair[0] != jPair[0] || len(iPair) < 2 || len(jPair) < 2 {
+			// fwmark services (-f 1048580) carry no port
 			return iPair[0] < jPair[0]
 		}
 
@@ -16,6 +16,7 @@ import (
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func loadFile (file string) []string {
@@ -227,6 +228,24 @@ func TestGenerateRules(t *testing.T) {
 
 }
 
+func TestGenerateRulesLeavesConfig(t *testing.T) {
+	def := &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "http", TCPEnabled: true, IPVSOptions: types.IPVSOptions{RawScheduler: "mh"}}
+	config := &types.ClusterConfig{Config: map[types.ServiceIP]types.PortMap{"10.54.213.147": {"80": def}}}
+
+	i := IPVS{}
+	rules, err := i.generateRules(&watcher.Watcher{}, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) == 0 || !strings.Contains(rules[0], "-s mh -b flag-1,flag-2") {
+		t.Fatalf("expected the mh scheduler to default its flags. have %v", rules)
+	}
+	// the config is shared with other readers, so it must not be changed
+	if def.IPVSOptions.Flags != "" {
+		t.Fatalf("expected the config flags to be left alone. have %q", def.IPVSOptions.Flags)
+	}
+}
+
 // /app # ipvsadm -Sn
 var ipvsadmDump string = `-A -t 172.27.223.81:80 -s wlc
 -a -t 172.27.223.81:80 -r 172.27.223.102:80 -g -w 1
@@ -354,7 +373,7 @@ func TestGetNodeWeightsAndLimits(t *testing.T) {
 		sc := &types.ServiceDef{
 			IPVSOptions: test.i,
 		}
-		out := getNodeWeightsAndLimits(nodes, watcher, sc, false, 0)
+		out := getNodeWeightsAndLimits(nodes, watcher, sc, false, false, 0)
 		if len(out) != len(nodes) {
 			t.Fatalf("expected %d nodes. saw %d", len(nodes), len(out))
 		}
@@ -367,6 +386,71 @@ func TestGetNodeWeightsAndLimits(t *testing.T) {
 
 }
 
+func TestGetNodeWeightsAndLimitsWeighted(t *testing.T) {
+	nodes := []*v1.Node{}
+	addresses := []v1.EndpointAddress{}
+	for n, pods := range []int{2, 5, 3, 0} {
+		name := fmt.Sprintf("node-%d", n)
+		nodes = append(nodes, &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: fmt.Sprintf("10.11.12.%d", n)}}},
+		})
+		for p := 0; p < pods; p++ {
+			nodeName := name
+			addresses = append(addresses, v1.EndpointAddress{IP: fmt.Sprintf("100.64.%d.%d", n, p), NodeName: &nodeName})
+		}
+	}
+	w := &watcher.Watcher{
+		Nodes: nodes,
+		AllEndpoints: map[string]*v1.Endpoints{
+			"syseng/web": {
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "syseng"},
+				Subsets:    []v1.EndpointSubset{{Addresses: addresses, Ports: []v1.EndpointPort{{Name: "http"}}}},
+			},
+		},
+	}
+	sc := &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "http", IPVSOptions: types.IPVSOptions{RawUThreshold: 50000, RawLThreshold: 25000}}
+
+	// the weights follow the ready pods, and the limits divide by them
+	expected := map[string]nodeConfig{
+		"10.11.12.0": {"g", 2, 10000, 5000},
+		"10.11.12.1": {"g", 5, 25000, 12500},
+		"10.11.12.2": {"g", 3, 15000, 7500},
+		"10.11.12.3": {"g", 0, 0, 0},
+	}
+	out := getNodeWeightsAndLimits(nodes, w, sc, false, true, 1)
+	for address, want := range expected {
+		if out[address] != want {
+			t.Fatalf("expected %s to be %+v with weighted limits. have %+v", address, want, out[address])
+		}
+	}
+
+	// without, every node has an equal share of the limits
+	out = getNodeWeightsAndLimits(nodes, w, sc, false, false, 1)
+	if have := out["10.11.12.1"]; have.weight != 5 || have.uThreshold != 12500 || have.lThreshold != 6250 {
+		t.Fatalf("expected an equal share of the limits. have %+v", have)
+	}
+
+	// overridden weights are equal, and so are the limits
+	out = getNodeWeightsAndLimits(nodes, w, sc, true, true, 1)
+	if have := out["10.11.12.1"]; have.weight != 1 || have.uThreshold != 12500 {
+		t.Fatalf("expected overridden weights to share the limits equally. have %+v", have)
+	}
+
+	// a share too small to round to a connection is one, never unlimited
+	sc.IPVSOptions = types.IPVSOptions{RawUThreshold: 4, RawLThreshold: 2}
+	out = getNodeWeightsAndLimits(nodes, w, sc, false, true, 1)
+	if have := out["10.11.12.0"]; have.uThreshold != 1 || have.lThreshold != 1 {
+		t.Fatalf("expected the small share to be clamped to 1. have %+v", have)
+	}
+	if have := out["10.11.12.1"]; have.uThreshold != 2 || have.lThreshold != 1 {
+		t.Fatalf("expected the larger share to be kept. have %+v", have)
+	}
+	if have := out["10.11.12.3"]; have.uThreshold != 0 || have.lThreshold != 0 {
+		t.Fatalf("expected a node without weight to have no share. have %+v", have)
+	}
+}
+
 func TestCreateDeleteRule(t *testing.T) {
 
 	ipvsManager := IPVS{
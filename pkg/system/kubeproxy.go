@@ -0,0 +1,151 @@
+package system
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+// the modes kube-proxy programs services in
+const (
+	KubeProxyIPTables = "iptables"
+	KubeProxyIPVS     = "ipvs"
+	KubeProxyNFTables = "nftables"
+	// KubeProxyNone is a node without kube-proxy, or one whose mode couldn't be
+	// detected
+	KubeProxyNone = "none"
+)
+
+// reasons ravel conflicts with kube-proxy
+const (
+	ConflictShadowing = "shadowing"
+	ConflictIPVSTable = "ipvs-table"
+	ConflictNFTHook   = "nft-hook"
+)
+
+// KubeProxyConflict is a way kube-proxy, in the mode it runs in, interferes with
+// the rules ravel writes on the node
+type KubeProxyConflict struct {
+	Reason string `json:"reason"`
+	Detail string `json:"detail"`
+}
+
+// KubeProxyReport is the kube-proxy mode of the node, how it was found, and the
+// conflicts it has with ravel. JumpFirst is set when the ravel jumps are placed
+// ahead of kube-proxy's in the builtin nat chains to avoid them.
+type KubeProxyReport struct {
+	Mode      string              `json:"mode"`
+	Source    string              `json:"source"`
+	JumpFirst bool                `json:"jumpFirst"`
+	Conflicts []KubeProxyConflict `json:"conflicts"`
+}
+
+// ValidKubeProxyMode returns true for the modes that can be given instead of
+// being detected, and for auto
+func ValidKubeProxyMode(mode string) bool {
+	switch mode {
+	case "auto", KubeProxyIPTables, KubeProxyIPVS, KubeProxyNFTables, KubeProxyNone:
+		return true
+	}
+	return false
+}
+
+// DetectKubeProxyMode asks kube-proxy for its mode on the /proxyMode endpoint of
+// its metrics server at metricsAddr, i.e. 127.0.0.1:10249. When kube-proxy
+// doesn't answer, the mode is inferred from what it leaves in the kernel. It
+// returns the mode and where it was found.
+func DetectKubeProxyMode(ctx context.Context, runner CommandRunner, metricsAddr string) (string, string) {
+	if metricsAddr != "" {
+		if mode, err := proxyModeEndpoint(ctx, metricsAddr); err == nil {
+			return mode, "http://" + metricsAddr + "/proxyMode"
+		}
+	}
+
+	cmdCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	// ipvs mode also writes KUBE-SERVICES, so it's checked first
+	if _, err := runner.Run(cmdCtx, nil, "ip", "link", "show", "kube-ipvs0"); err == nil {
+		return KubeProxyIPVS, "the kube-ipvs0 interface"
+	}
+	if _, err := runner.Run(cmdCtx, nil, "nft", "list", "table", "ip", "kube-proxy"); err == nil {
+		return KubeProxyNFTables, "the kube-proxy nftables table"
+	}
+	if out, err := runner.Run(cmdCtx, nil, "iptables-save", "-t", "nat"); err == nil && strings.Contains(string(out), ":KUBE-SERVICES ") {
+		return KubeProxyIPTables, "the KUBE-SERVICES nat chain"
+	}
+	return KubeProxyNone, "no kube-proxy state on the node"
+}
+
+// proxyModeEndpoint reads the mode from kube-proxy's metrics server
+func proxyModeEndpoint(ctx context.Context, metricsAddr string) (string, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, "http://"+metricsAddr+"/proxyMode", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(reqCtx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("kube-proxy answered /proxyMode with %s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	mode := strings.TrimSpace(string(b))
+	switch mode {
+	case KubeProxyIPTables, KubeProxyIPVS, KubeProxyNFTables:
+		return mode, nil
+	}
+	return "", fmt.Errorf("kube-proxy reported an unknown mode %q", mode)
+}
+
+// NewKubeProxyReport returns the conflicts between a ravel worker of lbKind and
+// kube-proxy in mode. In the iptables and ipvs modes kube-proxy's KUBE-SERVICES
+// jump precedes ravel's in PREROUTING, so a VIP that is also the external or
+// load balancer IP of a service is DNATed, or marked for masquerading, by
+// kube-proxy first. Those are avoided by jumping to ravel first.
+func NewKubeProxyReport(mode, source, lbKind string) *KubeProxyReport {
+	r := &KubeProxyReport{Mode: mode, Source: source, Conflicts: []KubeProxyConflict{}}
+	switch mode {
+	case KubeProxyIPTables, KubeProxyIPVS:
+		r.JumpFirst = true
+		r.Conflicts = append(r.Conflicts, KubeProxyConflict{
+			Reason: ConflictShadowing,
+			Detail: "KUBE-SERVICES shadows VIPs that are also service external or load balancer IPs. the ravel jumps are placed first in PREROUTING and OUTPUT",
+		})
+	case KubeProxyNFTables:
+		r.Conflicts = append(r.Conflicts, KubeProxyConflict{
+			Reason: ConflictNFTHook,
+			Detail: "kube-proxy's nftables nat chains hook prerouting at the same priority as iptables, so which of them NATs a VIP that is also a service external or load balancer IP is undefined. it can't be avoided by chain placement",
+		})
+	}
+	if mode == KubeProxyIPVS && lbKind == stats.KindIpvsMaster {
+		r.Conflicts = append(r.Conflicts, KubeProxyConflict{
+			Reason: ConflictIPVSTable,
+			Detail: "kube-proxy shares the ipvs table with the director, which removes virtual services it didn't generate. don't run kube-proxy in ipvs mode on directors",
+		})
+	}
+	return r
+}
+
+// ServeHTTP writes the report as json
+func (r *KubeProxyReport) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,68 @@
+package system
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Comcast/Ravel/pkg/stats"
+)
+
+func TestDetectKubeProxyMode(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/proxyMode" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ipvs"))
+	}))
+	defer server.Close()
+
+	runner := NewRecordingCommandRunner()
+	if mode, _ := DetectKubeProxyMode(ctx, runner, strings.TrimPrefix(server.URL, "http://")); mode != KubeProxyIPVS {
+		t.Fatalf("expected the mode reported by kube-proxy. have %s", mode)
+	}
+	if len(runner.CommandLines()) != 0 {
+		t.Fatalf("expected no commands when kube-proxy answers. have %v", runner.CommandLines())
+	}
+
+	// without kube-proxy's answer, the mode is read from the kernel
+	missing := errors.New("exit status 1")
+	runner.Respond("ip link show kube-ipvs0", "", missing)
+	runner.Respond("nft list table ip kube-proxy", "", missing)
+	runner.Respond("iptables-save -t nat", "*nat\n:PREROUTING ACCEPT [0:0]\n:KUBE-SERVICES - [0:0]\nCOMMIT\n", nil)
+	if mode, _ := DetectKubeProxyMode(ctx, runner, ""); mode != KubeProxyIPTables {
+		t.Fatalf("expected iptables from the KUBE-SERVICES chain. have %s", mode)
+	}
+
+	runner.Respond("iptables-save -t nat", "*nat\n:PREROUTING ACCEPT [0:0]\nCOMMIT\n", nil)
+	if mode, _ := DetectKubeProxyMode(ctx, runner, ""); mode != KubeProxyNone {
+		t.Fatalf("expected no kube-proxy. have %s", mode)
+	}
+}
+
+func TestKubeProxyReport(t *testing.T) {
+	r := NewKubeProxyReport(KubeProxyIPTables, "test", stats.KindIpvsBackend)
+	if !r.JumpFirst || len(r.Conflicts) != 1 || r.Conflicts[0].Reason != ConflictShadowing {
+		t.Fatalf("expected the jumps to be placed first for iptables mode. have %+v", r)
+	}
+
+	r = NewKubeProxyReport(KubeProxyIPVS, "test", stats.KindIpvsMaster)
+	if !r.JumpFirst || len(r.Conflicts) != 2 || r.Conflicts[1].Reason != ConflictIPVSTable {
+		t.Fatalf("expected a shared ipvs table on a director. have %+v", r)
+	}
+
+	r = NewKubeProxyReport(KubeProxyNFTables, "test", stats.KindIpvsBackend)
+	if r.JumpFirst || len(r.Conflicts) != 1 || r.Conflicts[0].Reason != ConflictNFTHook {
+		t.Fatalf("expected an unavoidable conflict for nftables mode. have %+v", r)
+	}
+
+	r = NewKubeProxyReport(KubeProxyNone, "test", stats.KindIpvsMaster)
+	if r.JumpFirst || len(r.Conflicts) != 0 {
+		t.Fatalf("expected no conflicts without kube-proxy. have %+v", r)
+	}
+}
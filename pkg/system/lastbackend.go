@@ -0,0 +1,163 @@
+package system
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// The policies of the last backend guard, see SetLastBackendGuard
+const (
+	LastBackendAllow = "allow"
+	LastBackendAlert = "alert"
+	LastBackendBlock = "block"
+)
+
+// lastBackendMetrics records the virtual services the last backend guard acts on
+type lastBackendMetrics interface {
+	LastBackendGuarded(service, policy string, guarded bool)
+}
+
+// SetLastBackendGuard consults policy before applying rules that leave a
+// virtual service that had a healthy backend, a real with weight, without one.
+// The weights follow the endpoints, health checks, ejection and drains, so
+// this is what maintenance automation that drains or deletes too much looks
+// like. alert logs and records the change, and applies it. block keeps the
+// configured reals of the virtual service as they are, with the rest of the
+// change applied, until it has a healthy backend again or the ravel configmap
+// carries types.AllowShrinkAnnotation. allow, the default, applies the change
+// as it is. Virtual services that are removed from the config aren't guarded.
+func (i *IPVS) SetLastBackendGuard(policy string, metrics lastBackendMetrics) {
+	i.lastBackendPolicy = policy
+	i.lastBackendMetrics = metrics
+	i.lastBackendGuarded = map[string]map[string]bool{}
+}
+
+// ValidLastBackendPolicy returns an error for a policy that isn't allow, alert or block
+func ValidLastBackendPolicy(policy string) error {
+	switch policy {
+	case LastBackendAllow, LastBackendAlert, LastBackendBlock:
+		return nil
+	}
+	return fmt.Errorf("last backend policy %q must be %s, %s or %s", policy, LastBackendAllow, LastBackendAlert, LastBackendBlock)
+}
+
+// realsByService groups the real server rules of rules by their virtual
+// service, i.e. '-t 10.54.213.165:80'
+func realsByService(rules []string) map[string][]string {
+	reals := map[string][]string{}
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) >= 5 && fields[0] == "-a" && fields[3] == "-r" {
+			service := strings.Join(fields[1:3], " ")
+			reals[service] = append(reals[service], rule)
+		}
+	}
+	return reals
+}
+
+// hasServices returns the virtual services rules create, i.e. '-t 10.54.213.165:80'
+func hasServices(rules []string) map[string]bool {
+	services := map[string]bool{}
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) >= 3 && fields[0] == "-A" {
+			services[strings.Join(fields[1:3], " ")] = true
+		}
+	}
+	return services
+}
+
+// healthy returns true when any of the real server rules has a weight
+func healthy(reals []string) bool {
+	for _, rule := range reals {
+		fields := strings.Fields(rule)
+		for n := 0; n < len(fields)-1; n++ {
+			if fields[n] != "-w" {
+				continue
+			}
+			if w, err := strconv.Atoi(fields[n+1]); err == nil && w > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// guardLastBackends returns the generated rules of ipType with the last
+// backend guard's policy applied to the virtual services that lose their last
+// healthy backend going from the configured rules
+func (i *IPVS) guardLastBackends(configMap *v1.ConfigMap, ipType string, configured, generated []string) []string {
+	if i.lastBackendPolicy == "" || i.lastBackendPolicy == LastBackendAllow {
+		return generated
+	}
+
+	before := realsByService(configured)
+	after := realsByService(generated)
+	services := hasServices(generated)
+	guarded := map[string]bool{}
+	for service, reals := range before {
+		if !services[service] || !healthy(reals) || healthy(after[service]) {
+			continue
+		}
+		guarded[service] = true
+	}
+
+	policy := i.lastBackendPolicy
+	if policy == LastBackendBlock && len(guarded) > 0 && types.AllowShrink(configMap) {
+		i.logger.Warnf("ipvs: leaving %d virtual services without a healthy backend because the configmap is annotated with %s", len(guarded), types.AllowShrinkAnnotation)
+		policy = LastBackendAlert
+	}
+
+	keys := make([]string, 0, len(guarded))
+	for service := range guarded {
+		keys = append(keys, service)
+	}
+	sort.Strings(keys)
+	for _, service := range keys {
+		if policy == LastBackendBlock {
+			i.logger.Errorf("ipvs: keeping the configured reals of %s, which the change leaves without a healthy backend", service)
+		} else {
+			i.logger.Errorf("ipvs: the change leaves %s without a healthy backend", service)
+		}
+	}
+	i.recordLastBackends(ipType, guarded)
+
+	if policy != LastBackendBlock || len(guarded) == 0 {
+		return generated
+	}
+	out := make([]string, 0, len(generated))
+	for _, rule := range generated {
+		fields := strings.Fields(rule)
+		if len(fields) >= 5 && fields[0] == "-a" && guarded[strings.Join(fields[1:3], " ")] {
+			continue
+		}
+		out = append(out, rule)
+	}
+	for _, service := range keys {
+		out = append(out, before[service]...)
+	}
+	return out
+}
+
+// recordLastBackends records the virtual services of ipType the guard acts on,
+// and clears those it no longer does
+func (i *IPVS) recordLastBackends(ipType string, guarded map[string]bool) {
+	if i.lastBackendMetrics == nil {
+		return
+	}
+	for service := range i.lastBackendGuarded[ipType] {
+		if !guarded[service] {
+			i.lastBackendMetrics.LastBackendGuarded(service, i.lastBackendPolicy, false)
+		}
+	}
+	for service := range guarded {
+		i.lastBackendMetrics.LastBackendGuarded(service, i.lastBackendPolicy, true)
+	}
+	i.lastBackendGuarded[ipType] = guarded
+}
@@ -0,0 +1,71 @@
+package system
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+func TestGuardLastBackends(t *testing.T) {
+	configured := []string{
+		"-A -t 10.54.213.165:80 -s wrr",
+		"-a -t 10.54.213.165:80 -r 10.131.153.76:80 -g -w 1 -x 0 -y 0",
+		"-a -t 10.54.213.165:80 -r 10.131.153.77:80 -g -w 1 -x 0 -y 0",
+		"-A -t 10.54.213.165:443 -s wrr",
+		"-a -t 10.54.213.165:443 -r 10.131.153.76:443 -g -w 1 -x 0 -y 0",
+		"-A -t 10.54.213.166:80 -s wrr",
+		"-a -t 10.54.213.166:80 -r 10.131.153.76:80 -g -w 1 -x 0 -y 0",
+	}
+	// :80 loses its last healthy backend, :443 keeps one and 10.54.213.166 is
+	// removed from the config
+	generated := []string{
+		"-A -t 10.54.213.165:80 -s wrr",
+		"-a -t 10.54.213.165:80 -r 10.131.153.76:80 -g -w 0 -x 0 -y 0",
+		"-A -t 10.54.213.165:443 -s wrr",
+		"-a -t 10.54.213.165:443 -r 10.131.153.78:443 -g -w 1 -x 0 -y 0",
+	}
+
+	metrics := newFakeMetrics()
+	i := &IPVS{logger: logrus.New()}
+	i.SetLastBackendGuard(LastBackendAlert, metrics)
+	if rules := i.guardLastBackends(nil, addrKindIPV4, configured, generated); !reflect.DeepEqual(rules, generated) {
+		t.Fatalf("expected alert to apply the change as it is. have %v", rules)
+	}
+	if expected := []string{"LastBackendGuarded alert -t 10.54.213.165:80 true"}; !reflect.DeepEqual(metrics.calls, expected) {
+		t.Fatalf("expected %v to be reported. have %v", expected, metrics.calls)
+	}
+
+	i.SetLastBackendGuard(LastBackendBlock, metrics)
+	rules := i.guardLastBackends(nil, addrKindIPV4, configured, generated)
+	sort.Strings(rules)
+	expected := []string{
+		"-A -t 10.54.213.165:443 -s wrr",
+		"-A -t 10.54.213.165:80 -s wrr",
+		"-a -t 10.54.213.165:443 -r 10.131.153.78:443 -g -w 1 -x 0 -y 0",
+		"-a -t 10.54.213.165:80 -r 10.131.153.76:80 -g -w 1 -x 0 -y 0",
+		"-a -t 10.54.213.165:80 -r 10.131.153.77:80 -g -w 1 -x 0 -y 0",
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("expected block to keep the configured reals of :80.\nexpected %v\nhave     %v", expected, rules)
+	}
+
+	// the configmap annotation lets the change through
+	allow := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{types.AllowShrinkAnnotation: "true"}}}
+	if rules := i.guardLastBackends(allow, addrKindIPV4, configured, generated); !reflect.DeepEqual(rules, generated) {
+		t.Fatalf("expected the annotation to let the change through. have %v", rules)
+	}
+
+	// and the guard stands down once the service is healthy again
+	if rules := i.guardLastBackends(nil, addrKindIPV4, configured, configured); !reflect.DeepEqual(rules, configured) {
+		t.Fatalf("expected healthy rules to be applied as they are. have %v", rules)
+	}
+	if metrics.state["-t 10.54.213.165:80"] {
+		t.Fatalf("expected the guard to be cleared. have %v", metrics.calls)
+	}
+}
@@ -0,0 +1,45 @@
+package system
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// The changes a LinkMonitor reports
+const (
+	LinkUp         = "link-up"
+	LinkDown       = "link-down"
+	LinkDeleted    = "link-deleted"
+	AddressAdded   = "address-added"
+	AddressRemoved = "address-removed"
+
+	// BondFailover is reported when a bond moved its traffic to another slave
+	BondFailover = "bond-failover"
+
+	// LinksOverrun is reported when the kernel dropped changes because they
+	// weren't read fast enough, so that any of the others may have been missed
+	LinksOverrun = "overrun"
+)
+
+// LinkEvent is a change the kernel made to a link or an address. Device is
+// empty when the link of an address is gone by the time it is reported.
+// Master is the index of the bond or team a link is a slave of.
+type LinkEvent struct {
+	Type    string
+	Index   int
+	Device  string
+	Address string
+	Master  int
+}
+
+// LinkMonitor reports the changes to links and addresses that the kernel
+// broadcasts over rtnetlink, so that what vanishes underneath ravel, such as
+// the VIPs of an interface that bounced, is noticed at once rather than at the
+// next parity check. It needs no privileges.
+type LinkMonitor struct {
+	logger log.FieldLogger
+}
+
+// NewLinkMonitor creates a LinkMonitor
+func NewLinkMonitor(logger log.FieldLogger) *LinkMonitor {
+	return &LinkMonitor{logger: logger}
+}
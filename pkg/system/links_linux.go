@@ -0,0 +1,174 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// the rtnetlink multicast groups of link and address changes, which syscall
+// doesn't define
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+)
+
+// the link attribute that carries the event a link change was made for, and
+// the event of a bond failover, which syscall doesn't define either
+const (
+	iflaEvent                = 44
+	iflaEventBondingFailover = 3
+)
+
+// linkReadTimeout bounds each read of the netlink socket, so that Run notices
+// its ctx is done
+const linkReadTimeout = time.Second
+
+// Run sends the changes to links and addresses to events until ctx is done
+func (m *LinkMonitor) Run(ctx context.Context, events chan<- LinkEvent) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("links: unable to open netlink socket. %v", err)
+	}
+	defer syscall.Close(fd)
+
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr,
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		return fmt.Errorf("links: unable to subscribe to link and address changes. %v", err)
+	}
+	tv := syscall.NsecToTimeval(linkReadTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return fmt.Errorf("links: unable to set the netlink read timeout. %v", err)
+	}
+
+	b := make([]byte, 1<<16)
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		n, _, err := syscall.Recvfrom(fd, b, 0)
+		switch err {
+		case nil:
+		case syscall.EAGAIN, syscall.EINTR:
+			continue
+		case syscall.ENOBUFS:
+			m.logger.Warn("links: the kernel dropped link and address changes before they were read")
+			if !sendLinkEvent(ctx, events, LinkEvent{Type: LinksOverrun}) {
+				return nil
+			}
+			continue
+		default:
+			return fmt.Errorf("links: unable to read from netlink socket. %v", err)
+		}
+
+		parsed, err := parseLinkMessages(b[:n])
+		if err != nil {
+			m.logger.Warnf("links: unable to parse netlink messages. %v", err)
+			continue
+		}
+		for _, ev := range parsed {
+			if !sendLinkEvent(ctx, events, ev) {
+				return nil
+			}
+		}
+	}
+}
+
+// sendLinkEvent sends ev to events, returning false when ctx is done first
+func sendLinkEvent(ctx context.Context, events chan<- LinkEvent, ev LinkEvent) bool {
+	select {
+	case events <- ev:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// parseLinkMessages returns the link and address changes of the rtnetlink
+// messages in b, skipping those of other types
+func parseLinkMessages(b []byte) ([]LinkEvent, error) {
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	events := []LinkEvent{}
+	for n := range msgs {
+		msg := &msgs[n]
+		switch msg.Header.Type {
+		case syscall.RTM_NEWLINK, syscall.RTM_DELLINK:
+			if len(msg.Data) < syscall.SizeofIfInfomsg {
+				continue
+			}
+			info := (*syscall.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+			ev := LinkEvent{Type: LinkDown, Index: int(info.Index)}
+			switch {
+			case msg.Header.Type == syscall.RTM_DELLINK:
+				ev.Type = LinkDeleted
+			case info.Flags&syscall.IFF_UP != 0 && info.Flags&syscall.IFF_RUNNING != 0:
+				ev.Type = LinkUp
+			}
+			attrs, err := syscall.ParseNetlinkRouteAttr(msg)
+			if err != nil {
+				return nil, err
+			}
+			for _, attr := range attrs {
+				switch attr.Attr.Type {
+				case syscall.IFLA_IFNAME:
+					ev.Device = strings.TrimRight(string(attr.Value), "\x00")
+				case syscall.IFLA_MASTER:
+					if len(attr.Value) >= 4 {
+						ev.Master = int(*(*uint32)(unsafe.Pointer(&attr.Value[0])))
+					}
+				case iflaEvent:
+					if len(attr.Value) >= 4 && *(*uint32)(unsafe.Pointer(&attr.Value[0])) == iflaEventBondingFailover && ev.Type != LinkDeleted {
+						ev.Type = BondFailover
+					}
+				}
+			}
+			events = append(events, ev)
+
+		case syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+			if len(msg.Data) < syscall.SizeofIfAddrmsg {
+				continue
+			}
+			info := (*syscall.IfAddrmsg)(unsafe.Pointer(&msg.Data[0]))
+			ev := LinkEvent{Type: AddressAdded, Index: int(info.Index)}
+			if msg.Header.Type == syscall.RTM_DELADDR {
+				ev.Type = AddressRemoved
+			}
+			attrs, err := syscall.ParseNetlinkRouteAttr(msg)
+			if err != nil {
+				return nil, err
+			}
+			// IFA_LOCAL is the address of the interface itself. IFA_ADDRESS
+			// is its peer on point to point links, and the same otherwise.
+			for _, attr := range attrs {
+				switch attr.Attr.Type {
+				case syscall.IFA_LOCAL:
+					ev.Address = net.IP(attr.Value).String()
+				case syscall.IFA_ADDRESS:
+					if ev.Address == "" {
+						ev.Address = net.IP(attr.Value).String()
+					}
+				case syscall.IFA_LABEL:
+					ev.Device = strings.TrimRight(string(attr.Value), "\x00")
+				}
+			}
+			if ev.Device == "" {
+				if iface, err := net.InterfaceByIndex(ev.Index); err == nil {
+					ev.Device = iface.Name
+				}
+			}
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
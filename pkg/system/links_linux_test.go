@@ -0,0 +1,108 @@
+package system
+
+import (
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// netlinkAttr is an attribute of a route message, see netlinkMessage
+type netlinkAttr struct {
+	typ   uint16
+	value []byte
+}
+
+// netlinkMessage encodes an rtnetlink message of typ, with body as the header
+// of its type and attrs after it, as the kernel sends them
+func netlinkMessage(typ uint16, body []byte, attrs ...netlinkAttr) []byte {
+	align := func(n int) int { return (n + syscall.NLMSG_ALIGNTO - 1) &^ (syscall.NLMSG_ALIGNTO - 1) }
+
+	payload := append([]byte{}, body...)
+	for _, a := range attrs {
+		rta := syscall.RtAttr{Len: uint16(syscall.SizeofRtAttr + len(a.value)), Type: a.typ}
+		attr := make([]byte, align(int(rta.Len)))
+		copy(attr, (*[syscall.SizeofRtAttr]byte)(unsafe.Pointer(&rta))[:])
+		copy(attr[syscall.SizeofRtAttr:], a.value)
+		payload = append(payload, attr...)
+	}
+
+	h := syscall.NlMsghdr{Len: uint32(syscall.NLMSG_HDRLEN + len(payload)), Type: typ}
+	b := make([]byte, align(int(h.Len)))
+	copy(b, (*[syscall.SizeofNlMsghdr]byte)(unsafe.Pointer(&h))[:])
+	copy(b[syscall.NLMSG_HDRLEN:], payload)
+	return b
+}
+
+func linkMessage(typ uint16, index int32, flags uint32, name string) []byte {
+	info := syscall.IfInfomsg{Index: index, Flags: flags}
+	body := (*[syscall.SizeofIfInfomsg]byte)(unsafe.Pointer(&info))[:]
+	return netlinkMessage(typ, body, netlinkAttr{syscall.IFLA_IFNAME, append([]byte(name), 0)})
+}
+
+func addressMessage(typ uint16, index uint32, addr, label string) []byte {
+	info := syscall.IfAddrmsg{Family: syscall.AF_INET, Prefixlen: 32, Index: index}
+	body := (*[syscall.SizeofIfAddrmsg]byte)(unsafe.Pointer(&info))[:]
+	attrs := []netlinkAttr{
+		{syscall.IFA_ADDRESS, net.ParseIP(addr).To4()},
+		{syscall.IFA_LOCAL, net.ParseIP(addr).To4()},
+	}
+	if label != "" {
+		attrs = append(attrs, netlinkAttr{syscall.IFA_LABEL, append([]byte(label), 0)})
+	}
+	return netlinkMessage(typ, body, attrs...)
+}
+
+func TestParseLinkMessages(t *testing.T) {
+	b := []byte{}
+	b = append(b, linkMessage(syscall.RTM_NEWLINK, 2, syscall.IFF_UP|syscall.IFF_RUNNING, "eth0")...)
+	b = append(b, linkMessage(syscall.RTM_NEWLINK, 2, syscall.IFF_UP, "eth0")...)
+	b = append(b, linkMessage(syscall.RTM_DELLINK, 9, 0, "10_54_213_165")...)
+	b = append(b, addressMessage(syscall.RTM_DELADDR, 9, "10.54.213.165", "10_54_213_165")...)
+	b = append(b, addressMessage(syscall.RTM_NEWADDR, 9, "10.54.213.166", "10_54_213_166")...)
+	// routes aren't reported
+	b = append(b, netlinkMessage(syscall.RTM_NEWROUTE, make([]byte, syscall.SizeofRtMsg))...)
+
+	events, err := parseLinkMessages(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LinkEvent{
+		{Type: LinkUp, Index: 2, Device: "eth0"},
+		{Type: LinkDown, Index: 2, Device: "eth0"},
+		{Type: LinkDeleted, Index: 9, Device: "10_54_213_165"},
+		{Type: AddressRemoved, Index: 9, Device: "10_54_213_165", Address: "10.54.213.165"},
+		{Type: AddressAdded, Index: 9, Device: "10_54_213_166", Address: "10.54.213.166"},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("expected %+v. have %+v", want, events)
+	}
+}
+
+func TestParseBondMessages(t *testing.T) {
+	master := make([]byte, 4)
+	*(*uint32)(unsafe.Pointer(&master[0])) = 4
+	failover := make([]byte, 4)
+	*(*uint32)(unsafe.Pointer(&failover[0])) = iflaEventBondingFailover
+
+	up := syscall.IfInfomsg{Index: 4, Flags: syscall.IFF_UP | syscall.IFF_RUNNING}
+	slave := syscall.IfInfomsg{Index: 2}
+	b := []byte{}
+	b = append(b, netlinkMessage(syscall.RTM_NEWLINK, (*[syscall.SizeofIfInfomsg]byte)(unsafe.Pointer(&slave))[:],
+		netlinkAttr{syscall.IFLA_IFNAME, append([]byte("ens1"), 0)}, netlinkAttr{syscall.IFLA_MASTER, master})...)
+	b = append(b, netlinkMessage(syscall.RTM_NEWLINK, (*[syscall.SizeofIfInfomsg]byte)(unsafe.Pointer(&up))[:],
+		netlinkAttr{syscall.IFLA_IFNAME, append([]byte("bond0"), 0)}, netlinkAttr{iflaEvent, failover})...)
+
+	events, err := parseLinkMessages(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LinkEvent{
+		{Type: LinkDown, Index: 2, Device: "ens1", Master: 4},
+		{Type: BondFailover, Index: 4, Device: "bond0"},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("expected %+v. have %+v", want, events)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package system
+
+import (
+	"context"
+	"fmt"
+)
+
+// Run returns an error, as links and addresses are only monitored over
+// rtnetlink on linux
+func (m *LinkMonitor) Run(ctx context.Context, events chan<- LinkEvent) error {
+	return fmt.Errorf("links: link and address changes can only be monitored on linux")
+}
@@ -0,0 +1,262 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// the reasons a VIP device is left without the MTU it is configured with
+const (
+	MTUInvalid       = "invalid"
+	MTUExceedsParent = "exceeds-parent"
+	MTUApplyFailed   = "apply-failed"
+)
+
+// mtuReasons are every reason, so that a reason that clears is set back to 0
+var mtuReasons = []string{MTUInvalid, MTUExceedsParent, MTUApplyFailed}
+
+// the MTUs a device of each family can carry
+const (
+	minMTU4 = 68
+	minMTU6 = 1280
+	maxMTU  = 65535
+)
+
+// MTUStatus is the MTU a VIP device is configured with and the one it has.
+// Reason is set when they differ.
+type MTUStatus struct {
+	Device  string `json:"device"`
+	VIP     string `json:"vip,omitempty"`
+	Desired int    `json:"desired"`
+	Current int    `json:"current"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type mtuMetrics interface {
+	MTUMismatches(reason string, devices int)
+}
+
+// ParseMTUOverrides parses overrides given as vip=mtu or device=mtu, for
+// SetMTUOverrides
+func ParseMTUOverrides(overrides []string) (map[string]int, error) {
+	out := map[string]int{}
+	for _, o := range overrides {
+		if o == "" {
+			continue
+		}
+		spl := strings.Split(o, "=")
+		if len(spl) != 2 || spl[0] == "" {
+			return nil, fmt.Errorf("mtu override %q must be in the format vip=mtu or device=mtu", o)
+		}
+		mtu, err := strconv.Atoi(spl[1])
+		if err != nil || mtu < minMTU4 || mtu > maxMTU {
+			return nil, fmt.Errorf("mtu override %q must set an mtu between %d and %d", o, minMTU4, maxMTU)
+		}
+		out[spl[0]] = mtu
+	}
+	return out, nil
+}
+
+// SetMTUOverrides sets the MTU of VIP devices regardless of the MTU the
+// cluster config gives their VIPs, i.e. to work around a node whose network
+// can't carry the MTU of the rest of the cluster. overrides are keyed by VIP
+// or by device name, and a VIP takes precedence over its device.
+func (i *IP) SetMTUOverrides(overrides map[string]int) {
+	i.mtuOverrides = overrides
+}
+
+// SetMTUParent sets the device that VIP traffic arrives on, whose MTU the VIP
+// devices can't exceed, when it isn't the device of the manager, i.e. on
+// realservers that hold the VIPs on the loopback device
+func (i *IP) SetMTUParent(device string) {
+	i.mtuParent = device
+}
+
+// SetMTUMetrics records the VIP devices left without their MTU after each
+// SetMTU in m
+func (i *IP) SetMTUMetrics(m mtuMetrics) {
+	i.mtuMetrics = m
+}
+
+// MTUStatus returns the MTU of every VIP device with one configured, as of
+// the last SetMTU of each family
+func (i *IP) MTUStatus() []MTUStatus {
+	i.mtuMu.Lock()
+	defer i.mtuMu.Unlock()
+	out := append([]MTUStatus{}, i.mtuStatus4...)
+	return append(out, i.mtuStatus6...)
+}
+
+// SetMTU reconciles the MTU of the VIP devices of one family with config,
+// which maps VIPs to their MTU, and with the overrides of SetMTUOverrides. An
+// MTU that isn't a number the family can carry, or is larger than the MTU
+// of the parent device, see SetMTUParent, is left unapplied. When an MTU can't
+// be applied, the devices changed in the same pass are set back to the MTU
+// they had, so that the VIPs aren't left with a mix of old and new MTUs.
+func (i *IP) SetMTU(config map[types.ServiceIP]string, isIP6 bool) error {
+	desired := map[string]MTUStatus{}
+	for ip, mtu := range config {
+		// guard against dated provisioner versions (bulkhead deploy), erroneous configurations
+		// otherwise, don't skip standard (1500), could be setting back from a different MTU
+		if mtu == "" {
+			continue
+		}
+		dev := i.generateDeviceLabel(string(ip), isIP6)
+		status := MTUStatus{Device: dev, VIP: string(ip)}
+		n, err := strconv.Atoi(mtu)
+		if err != nil {
+			i.logger.Warnf("VIP %s was unable to convert MTU field to int from string %s: %v. Skipping", ip, mtu, err)
+			status.Reason = MTUInvalid
+		}
+		status.Desired = n
+		desired[dev] = status
+	}
+
+	// devices first, so that the override of a VIP replaces its device's. v4
+	// devices are named with underscores, see generateDeviceLabel
+	overrides := map[string]MTUStatus{}
+	for key, mtu := range i.mtuOverrides {
+		if net.ParseIP(key) == nil && strings.Contains(key, "_") != isIP6 {
+			overrides[key] = MTUStatus{Device: key, Desired: mtu}
+		}
+	}
+	for key, mtu := range i.mtuOverrides {
+		if ip := net.ParseIP(key); ip != nil && (ip.To4() == nil) == isIP6 {
+			dev := i.generateDeviceLabel(key, isIP6)
+			overrides[dev] = MTUStatus{Device: dev, VIP: key, Desired: mtu}
+		}
+	}
+	for dev, status := range overrides {
+		if _, ok := desired[dev]; !ok {
+			// config doesn't list every VIP, so only override the devices of
+			// VIPs on the node
+			if _, err := i.deviceMTU(dev); err != nil {
+				continue
+			}
+		}
+		if status.VIP == "" {
+			status.VIP = desired[dev].VIP
+		}
+		desired[dev] = status
+	}
+
+	parentDevice := i.device
+	if i.mtuParent != "" {
+		parentDevice = i.mtuParent
+	}
+	parent, err := i.deviceMTU(parentDevice)
+	if err != nil {
+		return err
+	}
+	minMTU := minMTU4
+	if isIP6 {
+		minMTU = minMTU6
+	}
+
+	devices := make([]string, 0, len(desired))
+	for dev := range desired {
+		devices = append(devices, dev)
+	}
+	sort.Strings(devices)
+
+	statuses := make([]MTUStatus, 0, len(devices))
+	defer func() { i.recordMTUStatus(statuses, isIP6) }()
+
+	type change struct {
+		device   string
+		previous int
+	}
+	changed := []change{}
+	for _, dev := range devices {
+		status := desired[dev]
+		if status.Reason == "" && (status.Desired < minMTU || status.Desired > maxMTU) {
+			i.logger.Warnf("mtu value for device %s was out of valid range %d-%d: %d. Skipping", dev, minMTU, maxMTU, status.Desired)
+			status.Reason = MTUInvalid
+		}
+		if status.Reason == "" && status.Desired > parent {
+			i.logger.Warnf("mtu value for device %s of %d is larger than the mtu of %s, %d. Skipping", dev, status.Desired, parentDevice, parent)
+			status.Reason = MTUExceedsParent
+		}
+
+		current, err := i.deviceMTU(dev)
+		status.Current = current
+		if err == nil && status.Reason == "" && current != status.Desired {
+			err = i.setDeviceMTU(dev, status.Desired)
+			if err == nil {
+				changed = append(changed, change{dev, current})
+				status.Current = status.Desired
+			}
+		}
+		if err != nil && status.Reason == "" {
+			status.Reason = MTUApplyFailed
+			statuses = append(statuses, status)
+			for _, c := range changed {
+				if rollbackErr := i.setDeviceMTU(c.device, c.previous); rollbackErr != nil {
+					i.logger.Errorf("unable to set the mtu of %s back to %d. %v", c.device, c.previous, rollbackErr)
+				}
+			}
+			return err
+		}
+		statuses = append(statuses, status)
+	}
+	return nil
+}
+
+func (i *IP) recordMTUStatus(statuses []MTUStatus, isIP6 bool) {
+	i.mtuMu.Lock()
+	if isIP6 {
+		i.mtuStatus6 = statuses
+	} else {
+		i.mtuStatus4 = statuses
+	}
+	all := append(append([]MTUStatus{}, i.mtuStatus4...), i.mtuStatus6...)
+	i.mtuMu.Unlock()
+
+	if i.mtuMetrics == nil {
+		return
+	}
+	byReason := map[string]int{}
+	for _, s := range all {
+		if s.Reason != "" {
+			byReason[s.Reason]++
+		}
+	}
+	for _, reason := range mtuReasons {
+		i.mtuMetrics.MTUMismatches(reason, byReason[reason])
+	}
+}
+
+// deviceMTU reads the MTU of device from `ip -o link show dev <device>`
+func (i *IP) deviceMTU(device string) (int, error) {
+	cmdCtx, cmdContextCancel := context.WithTimeout(i.cmdContext(), time.Second*20)
+	defer cmdContextCancel()
+	out, err := i.runner.Run(cmdCtx, nil, "ip", "-o", "link", "show", "dev", device)
+	if err != nil {
+		return 0, util.Errorf(util.ErrKernelApply, "unable to read the mtu of device %s: %v. Saw output: %v", device, err, string(out))
+	}
+	fields := strings.Fields(string(out))
+	for n := 0; n < len(fields)-1; n++ {
+		if fields[n] == "mtu" {
+			return strconv.Atoi(fields[n+1])
+		}
+	}
+	return 0, fmt.Errorf("no mtu in the link of device %s: %s", device, string(out))
+}
+
+func (i *IP) setDeviceMTU(device string, mtu int) error {
+	cmdCtx, cmdContextCancel := context.WithTimeout(i.cmdContext(), time.Second*20)
+	defer cmdContextCancel()
+	out, err := i.runner.Run(cmdCtx, nil, "ifconfig", device, "mtu", strconv.Itoa(mtu))
+	if err != nil {
+		return util.Errorf(util.ErrKernelApply, "error setting mtu on device %s: %v. Saw output: %v", device, err, string(out))
+	}
+	return nil
+}
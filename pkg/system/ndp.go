@@ -0,0 +1,86 @@
+package system
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	// ethernet type of IPv6, and the fields of an unsolicited neighbor advertisement
+	etherTypeIPv6            = 0x86dd
+	ipv6HeaderLen            = 40
+	icmpv6Protocol           = 58
+	icmpv6NeighborAdvert     = 136
+	ndpOptTargetLinkLayer    = 2
+	ndpFlagOverride          = 0x20
+	neighborAdvertLen        = 24
+	ndpOptTargetLinkLayerLen = 8
+)
+
+// allNodesMAC and allNodes are the ethernet and IPv6 addresses of the
+// link-local all-nodes multicast group
+var (
+	allNodesMAC = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+	allNodes    = net.ParseIP("ff02::1")
+)
+
+// NeighborAdvertisement encodes the ethernet frame of an unsolicited neighbor
+// advertisement for ip from mac: sent to all nodes, from and for ip, with the
+// override flag set, so that neighbors and the gateway replace the entry they
+// hold for ip with mac
+func NeighborAdvertisement(mac net.HardwareAddr, ip net.IP) ([]byte, error) {
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("ndp: %s is not an ethernet address", mac)
+	}
+	if ip.To4() != nil || ip.To16() == nil {
+		return nil, fmt.Errorf("ndp: %s is not an IPv6 address", ip)
+	}
+
+	payloadLen := neighborAdvertLen + ndpOptTargetLinkLayerLen
+	b := make([]byte, 14+ipv6HeaderLen+payloadLen)
+	copy(b[0:6], allNodesMAC)
+	copy(b[6:12], mac)
+	binary.BigEndian.PutUint16(b[12:14], etherTypeIPv6)
+
+	ip6 := b[14:]
+	ip6[0] = 6 << 4
+	binary.BigEndian.PutUint16(ip6[4:6], uint16(payloadLen))
+	ip6[6] = icmpv6Protocol
+	ip6[7] = 255 // neighbor discovery is only accepted with the maximum hop limit
+	copy(ip6[8:24], ip.To16())
+	copy(ip6[24:40], allNodes)
+
+	na := ip6[ipv6HeaderLen:]
+	na[0] = icmpv6NeighborAdvert
+	na[4] = ndpFlagOverride
+	copy(na[8:24], ip.To16())
+	na[24] = ndpOptTargetLinkLayer
+	na[25] = 1 // option length in units of 8 bytes
+	copy(na[26:32], mac)
+	binary.BigEndian.PutUint16(na[2:4], icmpv6Checksum(ip6[8:24], ip6[24:40], na))
+	return b, nil
+}
+
+// icmpv6Checksum is the checksum of an ICMPv6 message from src to dst, which
+// covers the IPv6 pseudo header, RFC 4443
+func icmpv6Checksum(src, dst net.IP, msg []byte) uint16 {
+	pseudo := make([]byte, 0, 40+len(msg))
+	pseudo = append(pseudo, src...)
+	pseudo = append(pseudo, dst...)
+	pseudo = append(pseudo, byte(len(msg)>>24), byte(len(msg)>>16), byte(len(msg)>>8), byte(len(msg)))
+	pseudo = append(pseudo, 0, 0, 0, icmpv6Protocol)
+	pseudo = append(pseudo, msg...)
+
+	var sum uint32
+	for i := 0; i+1 < len(pseudo); i += 2 {
+		sum += uint32(pseudo[i])<<8 | uint32(pseudo[i+1])
+	}
+	if len(pseudo)%2 == 1 {
+		sum += uint32(pseudo[len(pseudo)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,35 @@
+package system
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// sendFrame sends an ethernet frame of etherType out of device from a raw
+// packet socket, which needs CAP_NET_RAW. build encodes the frame from the
+// ethernet address of device.
+func sendFrame(device string, etherType uint16, build func(mac net.HardwareAddr) ([]byte, error)) error {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return fmt.Errorf("unable to find interface %s. %v", device, err)
+	}
+	frame, err := build(iface.HardwareAddr)
+	if err != nil {
+		return err
+	}
+
+	protocol := etherType<<8 | etherType>>8
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, int(protocol))
+	if err != nil {
+		return fmt.Errorf("unable to open raw socket. %v", err)
+	}
+	defer syscall.Close(fd)
+
+	addr := &syscall.SockaddrLinklayer{Protocol: protocol, Ifindex: iface.Index, Halen: 6}
+	copy(addr.Addr[:], frame[0:6])
+	if err := syscall.Sendto(fd, frame, 0, addr); err != nil {
+		return fmt.Errorf("unable to send on %s. %v", device, err)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package system
+
+import (
+	"fmt"
+	"net"
+)
+
+// sendFrame returns an error, as raw packet sockets are only available on linux
+func sendFrame(device string, etherType uint16, build func(mac net.HardwareAddr) ([]byte, error)) error {
+	return fmt.Errorf("raw packet sockets are only available on linux")
+}
@@ -0,0 +1,35 @@
+package system
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestNeighborAdvertisement(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02}
+	vip := net.ParseIP("2001:558:1044:1ae::7")
+	frame, err := NeighborAdvertisement(mac, vip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame) != 86 || !bytes.Equal(frame[0:6], allNodesMAC) || !bytes.Equal(frame[6:12], mac) || frame[12] != 0x86 || frame[13] != 0xdd {
+		t.Fatalf("unexpected ethernet header % x", frame[:14])
+	}
+	ip6 := frame[14:]
+	if ip6[6] != icmpv6Protocol || ip6[7] != 255 || !net.IP(ip6[8:24]).Equal(vip) || !net.IP(ip6[24:40]).Equal(allNodes) {
+		t.Fatalf("unexpected ipv6 header % x", ip6[:40])
+	}
+	na := ip6[40:]
+	if na[0] != icmpv6NeighborAdvert || na[4] != ndpFlagOverride || !net.IP(na[8:24]).Equal(vip) || !bytes.Equal(na[26:32], mac) {
+		t.Fatalf("unexpected neighbor advertisement % x", na)
+	}
+	// a message with a valid checksum sums to zero
+	if sum := icmpv6Checksum(ip6[8:24], ip6[24:40], na); sum != 0 {
+		t.Fatalf("invalid checksum %#x", sum)
+	}
+
+	if _, err := NeighborAdvertisement(mac, net.ParseIP("10.54.213.165")); err == nil {
+		t.Fatal("expected an error for an IPv4 address")
+	}
+}
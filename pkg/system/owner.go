@@ -0,0 +1,141 @@
+package system
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// ownerAlias is the alias ravel sets on the dummy devices it creates, so that
+// the devices of other tooling on the node are never taken for stale VIPs.
+// A link alias is used rather than an address label, since labels are
+// limited to IPv4 and to 15 characters, and ravel owns whole devices.
+const ownerAlias = "ravel"
+
+// SetAdoptUnlabeled makes ravel take the dummy devices that don't carry its
+// alias as its own, labeling them as it finds them, i.e. to adopt the VIPs
+// added before devices were labeled. Otherwise they are never removed.
+func (i *IP) SetAdoptUnlabeled(adopt bool) {
+	i.adoptUnlabeled = adopt
+}
+
+// ownedRemovals returns the devices of removals that ravel owns, in the
+// dotted form Compare returns them in. The other devices of configured, the
+// VIPs still desired, are labeled when they aren't yet, so that a VIP whose
+// device ravel found rather than created, or that predates labeling, is
+// removed once it is no longer configured. When ownership can't be read,
+// nothing is removed or labeled.
+func (i *IP) ownedRemovals(configured, removals []string) []string {
+	if len(configured) == 0 {
+		return removals
+	}
+	labeled, err := i.labeledDevices()
+	if err != nil {
+		i.logger.Errorf("ipManager: unable to read which devices ravel owns, removing none. %v", err)
+		return []string{}
+	}
+
+	removed := map[string]bool{}
+	for _, removal := range removals {
+		removed[removal] = true
+	}
+	for _, kept := range configured {
+		device := strings.ReplaceAll(kept, ".", "_")
+		if removed[kept] || labeled[device] {
+			continue
+		}
+		if err := i.label(device); err != nil {
+			i.logger.Errorf("ipManager: unable to label desired device %s. %v", device, err)
+			continue
+		}
+		i.logger.Infof("ipManager: labeled desired device %s", device)
+	}
+
+	owned := []string{}
+	for _, removal := range removals {
+		device := strings.ReplaceAll(removal, ".", "_")
+		if !labeled[device] {
+			if !i.adoptUnlabeled {
+				i.logger.Warnf("ipManager: not removing device %s, which ravel didn't create. adopt-unlabeled-vips removes it", device)
+				continue
+			}
+			if err := i.label(device); err != nil {
+				i.logger.Errorf("ipManager: unable to adopt device %s. %v", device, err)
+				continue
+			}
+			i.logger.Infof("ipManager: adopted device %s", device)
+		}
+		owned = append(owned, removal)
+	}
+	return owned
+}
+
+// labeledDevices returns the dummy devices that carry the alias of ravel
+func (i *IP) labeledDevices() (map[string]bool, error) {
+	cmdCtx, cmdContextCancel := context.WithTimeout(i.cmdContext(), time.Second*20)
+	defer cmdContextCancel()
+	out, err := i.runner.Run(cmdCtx, nil, "ip", "-o", "link", "show", "type", "dummy")
+	if err != nil {
+		return nil, err
+	}
+
+	labeled := map[string]bool{}
+	for device, l := range parseLinks(string(out)) {
+		if l.alias == ownerAlias {
+			labeled[device] = true
+		}
+	}
+	return labeled, nil
+}
+
+// link is what ravel reads of a device from `ip -o link show`
+type link struct {
+	alias  string
+	master string
+
+	// table is the table of a vrf, read with -d
+	table int
+}
+
+// parseLinks returns the devices in the output of `ip -o link show`, one line
+// per device, i.e.
+// 5: 10_54_213_147: <BROADCAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue master tenant-a ... \    link/ether 9e:64:3a:2c:0e:1f brd ff:ff:ff:ff:ff:ff\    alias ravel
+func parseLinks(out string) map[string]link {
+	links := map[string]link{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(strings.ReplaceAll(line, `\`, " "))
+		if len(fields) < 2 {
+			continue
+		}
+		device := strings.TrimSuffix(fields[1], ":")
+		l := link{}
+		for n := 2; n < len(fields)-1; n++ {
+			switch fields[n] {
+			case "alias":
+				l.alias = fields[n+1]
+			case "master":
+				l.master = fields[n+1]
+			case "vrf":
+				if fields[n+1] == "table" && n+2 < len(fields) {
+					l.table, _ = strconv.Atoi(fields[n+2])
+				}
+			}
+		}
+		links[device] = l
+	}
+	return links
+}
+
+// label sets the alias of ravel on device
+func (i *IP) label(device string) error {
+	cmdCtx, cmdContextCancel := context.WithTimeout(i.cmdContext(), time.Second*20)
+	defer cmdContextCancel()
+	out, err := i.runner.Run(cmdCtx, nil, "ip", "link", "set", "dev", device, "alias", ownerAlias)
+	if err != nil {
+		return util.Errorf(util.ErrKernelApply, "ipManager: unable to label device %s: %v. Saw output: %s", device, err, string(out))
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package system
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ParityDiff counts what differed between the node and the config in a parity
+// check. Missing is what the config has and the node doesn't, extra what the
+// node has and the config doesn't, and changed what both have with different
+// options, such as a weight or a scheduler. The rules of v6 are only counted
+// when the v4 rules were in parity.
+type ParityDiff struct {
+	MissingAddresses int
+	ExtraAddresses   int
+
+	MissingServices int
+	ExtraServices   int
+	ChangedServices int
+
+	MissingDestinations int
+	ExtraDestinations   int
+	ChangedDestinations int
+}
+
+// Empty returns true when nothing differed
+func (d ParityDiff) Empty() bool {
+	return d == ParityDiff{}
+}
+
+// Fields returns the counts as log fields
+func (d ParityDiff) Fields() log.Fields {
+	return log.Fields{
+		"missing_addresses":    d.MissingAddresses,
+		"extra_addresses":      d.ExtraAddresses,
+		"missing_services":     d.MissingServices,
+		"extra_services":       d.ExtraServices,
+		"changed_services":     d.ChangedServices,
+		"missing_destinations": d.MissingDestinations,
+		"extra_destinations":   d.ExtraDestinations,
+		"changed_destinations": d.ChangedDestinations,
+	}
+}
+
+// ParityDiff returns what differed in the last parity check
+func (i *IPVS) ParityDiff() ParityDiff {
+	return i.parityDiff
+}
+
+// diffAddresses counts the vips missing from addresses, and the addresses that
+// aren't vips, in the formats compareIPSlices takes
+func (d *ParityDiff) diffAddresses(vips, addresses []string) {
+	for _, ip := range vips {
+		if !compareIPSlicesFindMatch(addresses, ip) {
+			d.MissingAddresses++
+		}
+	}
+	for _, ip := range addresses {
+		if !compareIPSlicesFindMatch(vips, ip) {
+			d.ExtraAddresses++
+		}
+	}
+}
+
+// diffRules counts the virtual services and destinations that differ between
+// the configured and the generated rules into d. A service is keyed by its
+// address, i.e. '-A -t 10.54.213.165:80', and a destination by its service and
+// real server, i.e. '-a -t 10.54.213.165:80 -r 10.131.153.76:80'.
+func (i *IPVS) diffRules(d *ParityDiff, configured, generated []string) {
+	have := i.parityRules(configured)
+	want := i.parityRules(generated)
+	for key, rule := range want {
+		existing, ok := have[key]
+		switch {
+		case !ok && strings.HasPrefix(key, "-A"):
+			d.MissingServices++
+		case !ok:
+			d.MissingDestinations++
+		case existing != rule && strings.HasPrefix(key, "-A"):
+			d.ChangedServices++
+		case existing != rule:
+			d.ChangedDestinations++
+		}
+	}
+	for key := range have {
+		if _, ok := want[key]; ok {
+			continue
+		}
+		if strings.HasPrefix(key, "-A") {
+			d.ExtraServices++
+		} else {
+			d.ExtraDestinations++
+		}
+	}
+}
+
+// parityRules keys the sanitized service and destination rules of rules as
+// diffRules does
+func (i *IPVS) parityRules(rules []string) map[string]string {
+	keyed := make(map[string]string, len(rules))
+	for _, rule := range rules {
+		rule = i.sanitizeIPVSRule(rule)
+		fields := strings.Fields(rule)
+		switch {
+		case len(fields) >= 3 && fields[0] == "-A":
+			keyed[strings.Join(fields[:3], " ")] = rule
+		case len(fields) >= 5 && fields[0] == "-a" && fields[3] == "-r":
+			keyed[strings.Join(fields[:5], " ")] = rule
+		}
+	}
+	return keyed
+}
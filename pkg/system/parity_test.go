@@ -0,0 +1,49 @@
+package system
+
+import (
+	"testing"
+)
+
+func TestParityDiff(t *testing.T) {
+	configured := []string{
+		"-A -t 10.54.213.165:80 -s wrr",
+		"-a -t 10.54.213.165:80 -r 10.131.153.76:80 -g -w 1 -x 0 -y 0",
+		"-a -t 10.54.213.165:80 -r 10.131.153.77:80 -g -w 1 -x 0 -y 0",
+		"-A -t 10.54.213.166:80 -s wrr",
+		"-a -t 10.54.213.166:80 -r 10.131.153.76:80 -g -w 1 -x 0 -y 0",
+	}
+	// the scheduler of 10.54.213.165 changes, 10.131.153.77 is reweighted and
+	// 10.131.153.78 added to it, 10.54.213.166 is removed with its backend and
+	// 10.54.213.167 added without one
+	generated := []string{
+		"-A -t 10.54.213.165:80 -s mh",
+		"-a -t 10.54.213.165:80 -r 10.131.153.76:80 -g -w 1",
+		"-a -t 10.54.213.165:80 -r 10.131.153.77:80 -g -w 0",
+		"-a -t 10.54.213.165:80 -r 10.131.153.78:80 -g -w 1",
+		"-A -t 10.54.213.167:443 -s wrr",
+	}
+
+	diff := ParityDiff{}
+	diff.diffAddresses([]string{"10.54.213.165", "10.54.213.167"}, []string{"10_54_213_165", "10_54_213_166"})
+	(&IPVS{}).diffRules(&diff, configured, generated)
+
+	want := ParityDiff{
+		MissingAddresses:    1,
+		ExtraAddresses:      1,
+		MissingServices:     1,
+		ExtraServices:       1,
+		ChangedServices:     1,
+		MissingDestinations: 1,
+		ExtraDestinations:   1,
+		ChangedDestinations: 1,
+	}
+	if diff != want {
+		t.Fatalf("expected %+v. have %+v", want, diff)
+	}
+
+	diff = ParityDiff{}
+	(&IPVS{}).diffRules(&diff, configured, configured)
+	if !diff.Empty() {
+		t.Fatalf("expected no difference. have %+v", diff)
+	}
+}
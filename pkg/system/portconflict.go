@@ -0,0 +1,335 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// reasons a VIP port conflicts with the node
+const (
+	ConflictListener = "listener"
+	ConflictNodePort = "nodeport"
+)
+
+// Listener is a socket bound on the host, as read from /proc/net
+type Listener struct {
+	Protocol string `json:"protocol"`
+	IP       net.IP `json:"ip"`
+	Port     int    `json:"port"`
+}
+
+// PortRange is an inclusive range of ports. The zero value matches nothing.
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// ParsePortRange parses a range in the form used by kube-proxy, i.e. 30000-32767.
+// An empty string disables the range.
+func ParsePortRange(s string) (PortRange, error) {
+	if s == "" {
+		return PortRange{}, nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return PortRange{}, fmt.Errorf("port range %q must be in the form min-max", s)
+	}
+	min, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return PortRange{}, fmt.Errorf("port range %q has an invalid minimum. %v", s, err)
+	}
+	max, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return PortRange{}, fmt.Errorf("port range %q has an invalid maximum. %v", s, err)
+	}
+	if min < 1 || max > 65535 || min > max {
+		return PortRange{}, fmt.Errorf("port range %q must be within 1-65535 with min <= max", s)
+	}
+	return PortRange{Min: min, Max: max}, nil
+}
+
+// Contains returns true when port is within the range
+func (p PortRange) Contains(port int) bool {
+	return p.Min > 0 && port >= p.Min && port <= p.Max
+}
+
+// PortConflict is a VIP port that would take traffic away from something
+// already using the port on the node
+type PortConflict struct {
+	VIP      string `json:"vip"`
+	Port     string `json:"port"`
+	Protocol string `json:"protocol"`
+	Service  string `json:"service"`
+	Reason   string `json:"reason"`
+	Detail   string `json:"detail"`
+}
+
+// FindPortConflicts returns the IPv4 VIP ports in config that are also bound by a
+// host listener, on the VIP itself or on a wildcard address, or that fall in
+// the kube-proxy nodePort range. Conflicts are sorted by VIP, port and protocol.
+func FindPortConflicts(config *types.ClusterConfig, listeners []Listener, nodePorts PortRange) []PortConflict {
+	conflicts := []PortConflict{}
+	if config == nil {
+		return conflicts
+	}
+
+	for vip, ports := range config.Config {
+		vipIP := net.ParseIP(string(vip))
+		for port, def := range ports {
+			if def == nil {
+				continue
+			}
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				continue
+			}
+			service := def.Namespace + "/" + def.Service + ":" + def.PortName
+
+			for _, protocol := range serviceProtocols(def) {
+				if nodePorts.Contains(p) {
+					conflicts = append(conflicts, PortConflict{
+						VIP: string(vip), Port: port, Protocol: protocol, Service: service,
+						Reason: ConflictNodePort,
+						Detail: fmt.Sprintf("port is in the nodePort range %d-%d", nodePorts.Min, nodePorts.Max),
+					})
+					continue
+				}
+				for _, l := range listeners {
+					if l.Protocol != protocol || l.Port != p || !(l.IP.IsUnspecified() || l.IP.Equal(vipIP)) {
+						continue
+					}
+					conflicts = append(conflicts, PortConflict{
+						VIP: string(vip), Port: port, Protocol: protocol, Service: service,
+						Reason: ConflictListener,
+						Detail: fmt.Sprintf("a host process is listening on %s", net.JoinHostPort(l.IP.String(), port)),
+					})
+					break
+				}
+			}
+		}
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		a, b := conflicts[i], conflicts[j]
+		if a.VIP != b.VIP {
+			return a.VIP < b.VIP
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return a.Protocol < b.Protocol
+	})
+	return conflicts
+}
+
+// WithoutConflicts returns a copy of config with the protocols of every conflicting
+// VIP port disabled. Ports left without a protocol are removed.
+func WithoutConflicts(config *types.ClusterConfig, conflicts []PortConflict) *types.ClusterConfig {
+	if config == nil || len(conflicts) == 0 {
+		return config
+	}
+	out := config.DeepCopy()
+	for _, c := range conflicts {
+		def, ok := out.Config[types.ServiceIP(c.VIP)][c.Port]
+		if !ok || def == nil {
+			continue
+		}
+		switch c.Protocol {
+		case "tcp":
+			def.TCPEnabled = false
+		case "udp":
+			def.UDPEnabled = false
+		}
+		if !def.TCPEnabled && !def.UDPEnabled {
+			delete(out.Config[types.ServiceIP(c.VIP)], c.Port)
+		}
+	}
+	return out
+}
+
+// serviceProtocols returns the protocols forwarded for a service, as iptables
+// rule generation does
+func serviceProtocols(def *types.ServiceDef) []string {
+	protocols := []string{}
+	if def.TCPEnabled {
+		protocols = append(protocols, "tcp")
+	}
+	if def.UDPEnabled {
+		protocols = append(protocols, "udp")
+	}
+	return protocols
+}
+
+// ReadListeners returns the tcp sockets in the LISTEN state and the bound udp
+// sockets on the host
+func ReadListeners() ([]Listener, error) {
+	out := []Listener{}
+	for _, f := range []struct{ path, protocol string }{
+		{"/proc/net/tcp", "tcp"},
+		{"/proc/net/tcp6", "tcp"},
+		{"/proc/net/udp", "udp"},
+		{"/proc/net/udp6", "udp"},
+	} {
+		b, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read listeners from %s. %v", f.path, err)
+		}
+		listeners, err := parseProcNet(b, f.protocol)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s. %v", f.path, err)
+		}
+		out = append(out, listeners...)
+	}
+	return out, nil
+}
+
+const (
+	procNetStateListen = "0A"
+	procNetStateClose  = "07"
+)
+
+// parseProcNet parses the socket table format shared by /proc/net/{tcp,tcp6,udp,udp6},
+// where each line after the header holds the slot, the local and remote
+// address as hex ip:port, and the socket state, i.e. '0: 0100007F:1F90 00000000:0000 0A'
+func parseProcNet(b []byte, protocol string) ([]Listener, error) {
+	out := []Listener{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		state := fields[3]
+		if (protocol == "tcp" && state != procNetStateListen) || (protocol == "udp" && state != procNetStateClose) {
+			continue
+		}
+		if protocol == "udp" && !strings.HasSuffix(fields[2], ":0000") {
+			// connected udp sockets don't accept traffic for other peers
+			continue
+		}
+
+		parts := strings.SplitN(fields[1], ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid local address %q", fields[1])
+		}
+		ip, err := parseProcNetIP(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.ParseUint(parts[1], 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local port %q. %v", parts[1], err)
+		}
+		out = append(out, Listener{Protocol: protocol, IP: ip, Port: int(port)})
+	}
+	return out, scanner.Err()
+}
+
+// parseProcNetIP decodes an address from /proc/net, which the kernel prints as
+// 32 bit words in host byte order
+func parseProcNetIP(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, fmt.Errorf("invalid local address %q", s)
+	}
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	return net.IP(b), nil
+}
+
+// PortConflictChecker finds the VIP ports that conflict with the node before a
+// configuration is applied, and serves the most recent conflicts over http.
+// The conflicts are only reported unless it withholds them.
+type PortConflictChecker struct {
+	sync.Mutex
+
+	nodePorts PortRange
+	withhold  bool
+	conflicts []PortConflict
+
+	// listeners returns the sockets bound on the host. replaced in tests.
+	listeners func() ([]Listener, error)
+
+	logger log.FieldLogger
+}
+
+// NewPortConflictChecker creates a PortConflictChecker. nodePortRange is the
+// kube-proxy nodePort range; an empty range only checks host listeners. withhold
+// leaves the conflicting VIP ports out of the config that Check returns.
+func NewPortConflictChecker(nodePortRange string, withhold bool, logger log.FieldLogger) (*PortConflictChecker, error) {
+	nodePorts, err := ParsePortRange(nodePortRange)
+	if err != nil {
+		return nil, err
+	}
+	return &PortConflictChecker{
+		nodePorts: nodePorts,
+		withhold:  withhold,
+		conflicts: []PortConflict{},
+		listeners: ReadListeners,
+		logger:    logger,
+	}, nil
+}
+
+// Check returns the conflicts found with the node, and config without the
+// conflicting VIP ports when they are withheld, or config itself when they are
+// only reported. If the host listeners can't be read, only the nodePort range is
+// checked and the error is returned alongside the result.
+func (c *PortConflictChecker) Check(config *types.ClusterConfig) (*types.ClusterConfig, []PortConflict, error) {
+	listeners, err := c.listeners()
+	conflicts := FindPortConflicts(config, listeners, c.nodePorts)
+
+	c.Lock()
+	changed := !reflect.DeepEqual(c.conflicts, conflicts)
+	c.conflicts = conflicts
+	c.Unlock()
+
+	if changed {
+		for _, conflict := range conflicts {
+			if c.withhold {
+				c.logger.Warnf("port conflict: not forwarding %s %s:%s for %s. %s", conflict.Protocol, conflict.VIP, conflict.Port, conflict.Service, conflict.Detail)
+				continue
+			}
+			c.logger.Warnf("port conflict: forwarding %s %s:%s for %s anyway. %s", conflict.Protocol, conflict.VIP, conflict.Port, conflict.Service, conflict.Detail)
+		}
+	}
+
+	if !c.withhold {
+		return config, conflicts, err
+	}
+	return WithoutConflicts(config, conflicts), conflicts, err
+}
+
+// Conflicts returns the conflicts found by the last Check
+func (c *PortConflictChecker) Conflicts() []PortConflict {
+	c.Lock()
+	defer c.Unlock()
+	return append([]PortConflict{}, c.conflicts...)
+}
+
+// ServeHTTP writes the conflicts found by the last Check as json
+func (c *PortConflictChecker) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	b, err := json.MarshalIndent(c.Conflicts(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,139 @@
+package system
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+const procNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 21045 1 0000000000000000 100 0 0 10 0
+   1: A5D5360A:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 21046 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:1F90 0200007F:C350 01 00000000:00000000 00:00000000 00000000     0        0 21047 1 0000000000000000 100 0 0 10 0
+`
+
+const procNetTCP6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:1F90 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 21048 1 0000000000000000 100 0 0 10 0
+`
+
+func TestParseProcNet(t *testing.T) {
+	listeners, err := parseProcNet([]byte(procNetTCP), "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("expected the established socket to be skipped. have %v", listeners)
+	}
+	if !listeners[0].IP.Equal(net.IPv4zero) || listeners[0].Port != 22 {
+		t.Errorf("unexpected listener %+v", listeners[0])
+	}
+	if !listeners[1].IP.Equal(net.ParseIP("10.54.213.165")) || listeners[1].Port != 80 {
+		t.Errorf("unexpected listener %+v", listeners[1])
+	}
+
+	listeners, err = parseProcNet([]byte(procNetTCP6), "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || !listeners[0].IP.Equal(net.IPv6unspecified) || listeners[0].Port != 8080 {
+		t.Fatalf("unexpected ipv6 listeners %v", listeners)
+	}
+}
+
+func TestFindPortConflicts(t *testing.T) {
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {
+				"80":    &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "http", TCPEnabled: true},
+				"22":    &types.ServiceDef{Namespace: "syseng", Service: "git", PortName: "ssh", TCPEnabled: true, UDPEnabled: true},
+				"31000": &types.ServiceDef{Namespace: "syseng", Service: "np", PortName: "np", TCPEnabled: true},
+				"443":   &types.ServiceDef{Namespace: "syseng", Service: "web", PortName: "https", TCPEnabled: true},
+			},
+		},
+	}
+	listeners := []Listener{
+		{Protocol: "tcp", IP: net.IPv4zero, Port: 22},
+		{Protocol: "tcp", IP: net.ParseIP("10.54.213.165"), Port: 80},
+		{Protocol: "tcp", IP: net.ParseIP("127.0.0.1"), Port: 443},
+	}
+
+	nodePorts, err := ParsePortRange("30000-32767")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflicts := FindPortConflicts(config, listeners, nodePorts)
+	if len(conflicts) != 3 {
+		t.Fatalf("expected 3 conflicts. have %+v", conflicts)
+	}
+	if conflicts[0].Port != "22" || conflicts[0].Protocol != "tcp" || conflicts[0].Reason != ConflictListener {
+		t.Errorf("unexpected conflict %+v", conflicts[0])
+	}
+	if conflicts[1].Port != "31000" || conflicts[1].Reason != ConflictNodePort {
+		t.Errorf("unexpected conflict %+v", conflicts[1])
+	}
+	if conflicts[2].Port != "80" {
+		t.Errorf("unexpected conflict %+v", conflicts[2])
+	}
+
+	filtered := WithoutConflicts(config, conflicts)
+	ports := filtered.Config["10.54.213.165"]
+	if len(ports) != 2 || ports["22"].TCPEnabled || !ports["22"].UDPEnabled || ports["443"] == nil {
+		t.Fatalf("expected only the conflicting protocols to be withheld. have %v", ports)
+	}
+	if !config.Config["10.54.213.165"]["22"].TCPEnabled || len(config.Config["10.54.213.165"]) != 4 {
+		t.Fatal("expected the original config to be unchanged")
+	}
+}
+
+func TestPortConflictCheckerListenerError(t *testing.T) {
+	c, err := NewPortConflictChecker("30000-32767", true, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.listeners = func() ([]Listener, error) { return nil, errors.New("no /proc") }
+
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {"31000": &types.ServiceDef{TCPEnabled: true}},
+		},
+	}
+	filtered, conflicts, err := c.Check(config)
+	if err == nil {
+		t.Fatal("expected the listener error to be returned")
+	}
+	if len(conflicts) != 1 || len(filtered.Config["10.54.213.165"]) != 0 || len(c.Conflicts()) != 1 {
+		t.Fatalf("expected the nodePort range to be checked without listeners. have %v", conflicts)
+	}
+
+	if _, err := NewPortConflictChecker("32767-30000", false, logrus.New()); err == nil {
+		t.Fatal("expected an error for an inverted range")
+	}
+}
+
+func TestPortConflictCheckerReportOnly(t *testing.T) {
+	c, err := NewPortConflictChecker("30000-32767", false, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.listeners = func() ([]Listener, error) { return nil, nil }
+
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {"31000": &types.ServiceDef{TCPEnabled: true}},
+		},
+	}
+	filtered, conflicts, err := c.Check(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || len(c.Conflicts()) != 1 {
+		t.Fatalf("expected the conflict to be reported. have %v", conflicts)
+	}
+	if filtered != config {
+		t.Fatal("expected the config to be forwarded as is when conflicts are only reported")
+	}
+}
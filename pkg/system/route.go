@@ -0,0 +1,147 @@
+package system
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// returnRulePriority is the priority of the policy routing rules of return
+// routes, by which ravel tells its rules from the others of the node
+const returnRulePriority = "10100"
+
+// SetReturnRoutes reconciles the policy routing of the VIPs of one family
+// with routes: a rule per VIP that looks up its replies in the VIP's table,
+// and the default route of each table. Rules of VIPs no longer routed are
+// removed, with the routes of the tables they used that no rule uses anymore.
+// Tables are routed before the rules that send traffic to them are added.
+func (i *IP) SetReturnRoutes(routes map[types.ServiceIP]types.ReturnRoute, isIP6 bool) error {
+	family := "-4"
+	if isIP6 {
+		family = "-6"
+	}
+
+	out, err := i.runIP(family, "rule", "show")
+	if err != nil {
+		return util.Errorf(util.ErrKernelApply, "ipManager: unable to list routing rules: %v. Saw output: %s", err, string(out))
+	}
+	installed := parseReturnRules(string(out))
+
+	tables := map[int]types.ReturnRoute{}
+	for _, r := range routes {
+		tables[r.Table] = r
+	}
+	for _, table := range sortedTables(tables) {
+		r := tables[table]
+		args := []string{family, "route", "replace", "default"}
+		if r.Gateway != "" {
+			args = append(args, "via", r.Gateway)
+		}
+		args = append(args, "dev", r.Interface, "table", strconv.Itoa(table))
+		if out, err := i.runIP(args...); err != nil {
+			return util.Errorf(util.ErrKernelApply, "ipManager: unable to route table %d through %s: %v. Saw output: %s", table, r.Interface, err, string(out))
+		}
+	}
+
+	vips := make([]string, 0, len(routes))
+	for vip := range routes {
+		vips = append(vips, string(vip))
+	}
+	sort.Strings(vips)
+	for _, vip := range vips {
+		table := routes[types.ServiceIP(vip)].Table
+		if current, ok := installed[vip]; ok {
+			if current == table {
+				continue
+			}
+			if err := i.delReturnRule(family, vip, current); err != nil {
+				return err
+			}
+		}
+		if out, err := i.runIP(family, "rule", "add", "from", vip, "lookup", strconv.Itoa(table), "priority", returnRulePriority); err != nil {
+			return util.Errorf(util.ErrKernelApply, "ipManager: unable to add the return rule of %s: %v. Saw output: %s", vip, err, string(out))
+		}
+	}
+
+	// the tables the rules of ravel used, and no longer do
+	stale := map[int]types.ReturnRoute{}
+	sources := make([]string, 0, len(installed))
+	for vip := range installed {
+		sources = append(sources, vip)
+	}
+	sort.Strings(sources)
+	for _, vip := range sources {
+		table := installed[vip]
+		if _, ok := tables[table]; !ok {
+			stale[table] = types.ReturnRoute{}
+		}
+		if _, ok := routes[types.ServiceIP(vip)]; ok {
+			continue
+		}
+		if err := i.delReturnRule(family, vip, table); err != nil {
+			return err
+		}
+	}
+	for _, table := range sortedTables(stale) {
+		if out, err := i.runIP(family, "route", "del", "default", "table", strconv.Itoa(table)); err != nil && !strings.Contains(string(out), "No such process") {
+			return util.Errorf(util.ErrKernelApply, "ipManager: unable to remove the route of table %d: %v. Saw output: %s", table, err, string(out))
+		}
+	}
+	return nil
+}
+
+func (i *IP) delReturnRule(family, vip string, table int) error {
+	if out, err := i.runIP(family, "rule", "del", "from", vip, "lookup", strconv.Itoa(table), "priority", returnRulePriority); err != nil {
+		return util.Errorf(util.ErrKernelApply, "ipManager: unable to remove the return rule of %s: %v. Saw output: %s", vip, err, string(out))
+	}
+	return nil
+}
+
+func (i *IP) runIP(args ...string) ([]byte, error) {
+	cmdCtx, cmdContextCancel := context.WithTimeout(i.cmdContext(), time.Second*20)
+	defer cmdContextCancel()
+	return i.runner.Run(cmdCtx, nil, "ip", args...)
+}
+
+// parseReturnRules returns the table of each source of the rules at the
+// priority of return routes in the output of `ip rule show`, i.e.
+// 10100:	from 10.54.213.147 lookup 200
+func parseReturnRules(out string) map[string]int {
+	rules := map[string]int{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] != returnRulePriority+":" {
+			continue
+		}
+		var from string
+		table := -1
+		for n := 1; n < len(fields)-1; n++ {
+			switch fields[n] {
+			case "from":
+				from = fields[n+1]
+			case "lookup":
+				if t, err := strconv.Atoi(fields[n+1]); err == nil {
+					table = t
+				}
+			}
+		}
+		if from != "" && table >= 0 {
+			rules[from] = table
+		}
+	}
+	return rules
+}
+
+func sortedTables(tables map[int]types.ReturnRoute) []int {
+	out := make([]int, 0, len(tables))
+	for table := range tables {
+		out = append(out, table)
+	}
+	sort.Ints(out)
+	return out
+}
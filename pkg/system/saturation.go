@@ -0,0 +1,151 @@
+package system
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// saturationRecoveryPercent is the share of the ceiling that a saturated
+// backend's active connections must fall to before it gets new connections
+// again, so that a backend near the ceiling doesn't flap
+const saturationRecoveryPercent = 80
+
+// saturationMetrics records the backends the saturation guard has quiesced
+type saturationMetrics interface {
+	BackendSaturated(backend string, saturated bool)
+}
+
+// saturationGuard quiesces backends whose active connections, across every
+// virtual service, exceed a ceiling. A quiesced backend is given a weight of 0,
+// which keeps its established connections but sends it no new ones.
+type saturationGuard struct {
+	sync.Mutex
+
+	max      int
+	interval time.Duration
+	stats    func(ctx context.Context) (map[string]map[string]IPVSRealStats, error)
+	logger   log.FieldLogger
+	metrics  saturationMetrics
+
+	saturated map[string]bool
+}
+
+// SetSaturationGuard quiesces a backend while its active connections exceed
+// maxActiveConns, measuring them every interval until the IPVS manager's
+// context is done. A backend gets new connections again once it is down to 80%
+// of the ceiling. No more than half of the backends are quiesced at once, the
+// busiest first, so that the rest aren't overloaded in turn.
+func (i *IPVS) SetSaturationGuard(maxActiveConns int, interval time.Duration, metrics saturationMetrics) {
+	i.saturation = &saturationGuard{
+		max:       maxActiveConns,
+		interval:  interval,
+		stats:     i.readStats,
+		logger:    i.logger,
+		metrics:   metrics,
+		saturated: map[string]bool{},
+	}
+	go i.saturation.run(i.ctx)
+}
+
+// weight returns 0 for a quiesced backend, and weight for any other
+func (g *saturationGuard) weight(backend string, weight int) int {
+	if g == nil {
+		return weight
+	}
+	g.Lock()
+	defer g.Unlock()
+	if g.saturated[backend] {
+		return 0
+	}
+	return weight
+}
+
+func (g *saturationGuard) run(ctx context.Context) {
+	g.logger.Infof("ipvs: quiescing backends with more than %d active connections, measured every %v", g.max, g.interval)
+
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.measure(ctx)
+		}
+	}
+}
+
+// measure reads the active connections of every backend and decides which are
+// quiesced. The director picks the change up with its next parity check.
+func (g *saturationGuard) measure(ctx context.Context) {
+	stats, err := g.stats(ctx)
+	if err != nil {
+		g.logger.Warnf("ipvs: unable to measure active connections for the saturation guard. %v", err)
+		return
+	}
+	conns := activeConnsByBackend(stats)
+
+	g.Lock()
+	defer g.Unlock()
+
+	recovery := g.max * saturationRecoveryPercent / 100
+	candidates := []string{}
+	for backend, n := range conns {
+		if n > g.max || (g.saturated[backend] && n > recovery) {
+			candidates = append(candidates, backend)
+		}
+	}
+	sort.Slice(candidates, func(n, m int) bool {
+		if conns[candidates[n]] != conns[candidates[m]] {
+			return conns[candidates[n]] > conns[candidates[m]]
+		}
+		return candidates[n] < candidates[m]
+	})
+	if limit := len(conns) / 2; len(candidates) > limit {
+		g.logger.Warnf("ipvs: %d of %d backends are saturated. quiescing only the busiest %d", len(candidates), len(conns), limit)
+		candidates = candidates[:limit]
+	}
+
+	saturated := map[string]bool{}
+	for _, backend := range candidates {
+		saturated[backend] = true
+		if !g.saturated[backend] {
+			g.logger.Warnf("ipvs: backend %s has %d active connections, more than %d. sending it no new connections", backend, conns[backend], g.max)
+		}
+	}
+	for backend := range g.saturated {
+		if !saturated[backend] {
+			g.logger.Infof("ipvs: backend %s is down to %d active connections. sending it new connections again", backend, conns[backend])
+		}
+	}
+	if g.metrics != nil {
+		for backend := range g.saturated {
+			g.metrics.BackendSaturated(backend, saturated[backend])
+		}
+		for backend := range saturated {
+			g.metrics.BackendSaturated(backend, true)
+		}
+	}
+	g.saturated = saturated
+}
+
+// activeConnsByBackend sums the active connections of each backend address
+// across every virtual service
+func activeConnsByBackend(stats map[string]map[string]IPVSRealStats) map[string]int {
+	out := map[string]int{}
+	for _, reals := range stats {
+		for real, s := range reals {
+			host, _, err := net.SplitHostPort(real)
+			if err != nil {
+				continue
+			}
+			out[host] += s.ActiveConns
+		}
+	}
+	return out
+}
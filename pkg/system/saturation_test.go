@@ -0,0 +1,67 @@
+package system
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+func TestSaturationGuard(t *testing.T) {
+	runner := NewRecordingCommandRunner()
+	runner.Respond("ipvsadm -Ln", ipvsStats, nil)
+	metrics := newFakeMetrics()
+	i := &IPVS{ctx: context.Background(), logger: logrus.New(), runner: runner}
+	i.saturation = &saturationGuard{max: 15, interval: time.Second, stats: i.readStats, logger: i.logger, metrics: metrics, saturated: map[string]bool{}}
+
+	if w := i.saturation.weight("10.131.153.78", 3); w != 3 {
+		t.Fatalf("expected an unmeasured backend to keep its weight. have %d", w)
+	}
+
+	// 10.131.153.76 has 19 active connections across its tcp, udp and fwmark
+	// services, and 10.131.153.78 has 40
+	i.saturation.measure(context.Background())
+	expected := map[string]bool{"10.131.153.76": true, "10.131.153.78": true}
+	if !reflect.DeepEqual(metrics.state, expected) {
+		t.Fatalf("expected %v to be saturated. have %v", expected, metrics.state)
+	}
+	if w := i.saturation.weight("10.131.153.78", 3); w != 0 {
+		t.Fatalf("expected a saturated backend to get no new connections. have weight %d", w)
+	}
+	if w := i.saturation.weight("10.131.153.77", 3); w != 3 {
+		t.Fatalf("expected a backend under the ceiling to keep its weight. have %d", w)
+	}
+
+	// a backend only recovers once it is down to 80% of the ceiling
+	runner.Respond("ipvsadm -Ln", `TCP  10.54.213.165:80 wrr
+  -> 10.131.153.76:80             Route   0      5          20
+  -> 10.131.153.77:80             Route   100    14         0
+  -> 10.131.153.78:80             Route   0      13         30
+`, nil)
+	i.saturation.measure(context.Background())
+	expected = map[string]bool{"10.131.153.76": false, "10.131.153.78": true}
+	if !reflect.DeepEqual(metrics.state, expected) {
+		t.Fatalf("expected %v. have %v", expected, metrics.state)
+	}
+	if w := i.realWeight("10.54.213.165", "80", "10.131.153.76", "80", 3, &types.ServiceDef{}); w != 3 {
+		t.Fatalf("expected a recovered backend to get its weight back. have %d", w)
+	}
+}
+
+func TestSaturationGuardLimit(t *testing.T) {
+	runner := NewRecordingCommandRunner()
+	runner.Respond("ipvsadm -Ln", ipvsStats, nil)
+	i := &IPVS{ctx: context.Background(), logger: logrus.New(), runner: runner}
+	i.saturation = &saturationGuard{max: 1, interval: time.Second, stats: i.readStats, logger: i.logger, saturated: map[string]bool{}}
+
+	// every backend is over the ceiling, so only the busiest half is quiesced
+	i.saturation.measure(context.Background())
+	expected := map[string]bool{"10.131.153.76": true, "10.131.153.78": true}
+	if !reflect.DeepEqual(i.saturation.saturated, expected) {
+		t.Fatalf("expected %v to be saturated. have %v", expected, i.saturation.saturated)
+	}
+}
@@ -0,0 +1,66 @@
+package system
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// shrinkMetrics records whether the shrink guard is refusing a change
+type shrinkMetrics interface {
+	ShrinkRefused(what string, refused bool)
+}
+
+// SetShrinkGuard refuses to apply rules that remove more than maxPercent of the
+// configured backends at once, unless the ravel configmap carries
+// types.AllowShrinkAnnotation. A maxPercent of zero disables the guard.
+func (i *IPVS) SetShrinkGuard(maxPercent int, metrics shrinkMetrics) {
+	i.shrinkGuard = maxPercent
+	i.shrinkMetrics = metrics
+}
+
+// backendKeys returns the virtual service and real server of every backend in
+// rules, i.e. '-t 10.54.213.165:80 -r 10.131.153.76:80'
+func backendKeys(rules []string) map[string]bool {
+	keys := map[string]bool{}
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) >= 5 && fields[0] == "-a" && fields[3] == "-r" {
+			keys[strings.Join(fields[1:5], " ")] = true
+		}
+	}
+	return keys
+}
+
+// checkShrink returns an error when going from the configured to the generated
+// rules of ipType would remove more backends than the shrink guard allows
+func (i *IPVS) checkShrink(configMap *v1.ConfigMap, ipType string, configured, generated []string) error {
+	if i.shrinkGuard <= 0 {
+		return nil
+	}
+
+	before := backendKeys(configured)
+	after := backendKeys(generated)
+	removed := 0
+	for key := range before {
+		if !after[key] {
+			removed++
+		}
+	}
+
+	refused := types.Shrinks(len(before), removed, i.shrinkGuard)
+	if refused && types.AllowShrink(configMap) {
+		i.logger.Warnf("ipvs: removing %d of %d backends because the configmap is annotated with %s", removed, len(before), types.AllowShrinkAnnotation)
+		refused = false
+	}
+	if i.shrinkMetrics != nil {
+		i.shrinkMetrics.ShrinkRefused("backends-"+ipType, refused)
+	}
+	if refused {
+		return util.Errorf(util.ErrConfigInvalid, "ipvs: refusing to remove %d of %d %s backends, more than the %d%% allowed. annotate the configmap with %s=true to apply the change", removed, len(before), ipType, i.shrinkGuard, types.AllowShrinkAnnotation)
+	}
+	return nil
+}
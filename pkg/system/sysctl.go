@@ -0,0 +1,110 @@
+package system
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Sysctl reads and writes kernel parameters. Names are paths below /proc/sys,
+// i.e. net/ipv4/vs/drop_entry.
+type Sysctl interface {
+	Get(name string) (string, error)
+	Set(name, value string) error
+}
+
+type procSysctl struct {
+	root string
+}
+
+// NewSysctl creates a Sysctl that acts on /proc/sys
+func NewSysctl() Sysctl {
+	return &procSysctl{root: "/proc/sys"}
+}
+
+func (p *procSysctl) Get(name string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(p.root, name))
+	if err != nil {
+		return "", fmt.Errorf("sysctl: unable to read %s. %v", name, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (p *procSysctl) Set(name, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(p.root, name), []byte(value), 0644); err != nil {
+		return fmt.Errorf("sysctl: unable to set %s to %s. %v", name, value, err)
+	}
+	return nil
+}
+
+// SysctlOverrides applies kernel parameters from the cluster config over the
+// node's own values. The value a parameter had before it was first overridden
+// is restored once the config stops setting it.
+type SysctlOverrides struct {
+	sync.Mutex
+
+	sysctl Sysctl
+	saved  map[string]string
+}
+
+// NewSysctlOverrides creates a SysctlOverrides that writes through sysctl
+func NewSysctlOverrides(sysctl Sysctl) *SysctlOverrides {
+	return &SysctlOverrides{
+		sysctl: sysctl,
+		saved:  map[string]string{},
+	}
+}
+
+// Apply sets every parameter in want, and restores those of earlier calls
+// that want no longer holds. Parameters already at the wanted value aren't
+// written. Every parameter is attempted, and the first error is returned.
+func (o *SysctlOverrides) Apply(want map[string]string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	var firstErr error
+	record := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// restore in a stable order, so that failures repeat identically
+	restore := []string{}
+	for name := range o.saved {
+		if _, ok := want[name]; !ok {
+			restore = append(restore, name)
+		}
+	}
+	sort.Strings(restore)
+	for _, name := range restore {
+		if err := o.sysctl.Set(name, o.saved[name]); err != nil {
+			record(err)
+			continue
+		}
+		delete(o.saved, name)
+	}
+
+	names := make([]string, 0, len(want))
+	for name := range want {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		current, err := o.sysctl.Get(name)
+		if err != nil {
+			record(err)
+			continue
+		}
+		if _, ok := o.saved[name]; !ok {
+			o.saved[name] = current
+		}
+		if current != want[name] {
+			record(o.sysctl.Set(name, want[name]))
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,40 @@
+package system
+
+import (
+	"testing"
+)
+
+func TestSysctlOverrides(t *testing.T) {
+	sysctl := NewFakeSysctl(map[string]string{
+		"net/ipv4/vs/drop_entry": "0",
+		"net/ipv4/vs/secure_tcp": "0",
+	})
+	overrides := NewSysctlOverrides(sysctl)
+
+	if err := overrides.Apply(map[string]string{"net/ipv4/vs/drop_entry": "1", "net/ipv4/vs/secure_tcp": "0"}); err != nil {
+		t.Fatal(err)
+	}
+	if sysctl.Values["net/ipv4/vs/drop_entry"] != "1" || sysctl.Sets != 1 {
+		t.Fatalf("expected only the changed parameter to be written. have %v after %d writes", sysctl.Values, sysctl.Sets)
+	}
+
+	// a value set by hand while overridden is not what gets restored
+	sysctl.Values["net/ipv4/vs/drop_entry"] = "2"
+	if err := overrides.Apply(map[string]string{"net/ipv4/vs/drop_entry": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if sysctl.Values["net/ipv4/vs/drop_entry"] != "1" {
+		t.Fatalf("expected the override to be reapplied. have %v", sysctl.Values)
+	}
+
+	if err := overrides.Apply(map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	if sysctl.Values["net/ipv4/vs/drop_entry"] != "0" || sysctl.Values["net/ipv4/vs/secure_tcp"] != "0" {
+		t.Fatalf("expected the node's values to be restored. have %v", sysctl.Values)
+	}
+
+	if err := overrides.Apply(map[string]string{"net/ipv4/vs/missing": "1"}); err == nil {
+		t.Fatal("expected an error for a parameter the kernel doesn't have")
+	}
+}
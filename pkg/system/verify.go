@@ -0,0 +1,97 @@
+package system
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// verifyMetrics records what the read back after an apply found
+type verifyMetrics interface {
+	ApplyVerified(what string, retried, divergent int)
+}
+
+// SetVerify reads ipvs back after every apply and checks that each applied rule
+// took effect. Rules that didn't are applied again, up to retries times. Rules
+// that still diverge after that are logged and recorded, and the apply fails.
+func (i *IPVS) SetVerify(retries int, metrics verifyMetrics) {
+	i.verify = true
+	i.verifyRetries = retries
+	i.verifyMetrics = metrics
+}
+
+// unapplied returns the rules in applied that the configured rules, as read back
+// from ipvsadm -Sn, don't reflect. Adds and edits must be present, deletes absent.
+func (i *IPVS) unapplied(configured, applied []string) []string {
+	present := map[string]bool{}
+	deletes := map[string]bool{}
+	for _, rule := range configured {
+		rule = i.sanitizeIPVSRule(rule)
+		present[rule] = true
+		deletes[i.createDeleteRuleFromAddRule(rule)] = true
+	}
+
+	out := []string{}
+	for _, rule := range applied {
+		r := i.sanitizeIPVSRule(rule)
+		ok := true
+		switch {
+		case strings.HasPrefix(r, "-A "), strings.HasPrefix(r, "-a "):
+			ok = present[r]
+		case strings.HasPrefix(r, "-e "):
+			ok = present["-a "+r[3:]]
+		case strings.HasPrefix(r, "-D "), strings.HasPrefix(r, "-d "):
+			ok = !deletes[r]
+		}
+		if !ok {
+			out = append(out, rule)
+		}
+	}
+	return out
+}
+
+// verifyApplied reads back the ipvs rules of ipType and applies the rules that
+// did not take effect again
+func (i *IPVS) verifyApplied(ipType string, applied []string) error {
+	if !i.verify {
+		return nil
+	}
+
+	pending := applied
+	retried := 0
+	for attempt := 0; len(pending) > 0; attempt++ {
+		var configured []string
+		var err error
+		if ipType == addrKindIPV4 {
+			configured, err = i.Get()
+		} else {
+			configured, err = i.GetV6()
+		}
+		if err != nil {
+			return fmt.Errorf("ipvs: unable to read back applied rules. %v", err)
+		}
+
+		pending = i.unapplied(configured, pending)
+		if len(pending) == 0 || attempt == i.verifyRetries {
+			break
+		}
+
+		i.logger.Warnf("ipvs: %d of %d applied %s rules did not take effect. applying them again", len(pending), len(applied), ipType)
+		retried += len(pending)
+		if out, err := i.Set(pending); err != nil {
+			i.logger.Errorf("ipvs: error applying rules again: %v/%v", string(out), err)
+		}
+	}
+
+	if i.verifyMetrics != nil {
+		i.verifyMetrics.ApplyVerified("ipvs-"+ipType, retried, len(pending))
+	}
+	if len(pending) > 0 {
+		for _, rule := range pending {
+			i.logger.Errorf("ipvs: rule did not take effect: ipvsadm %s", rule)
+		}
+		return util.Errorf(util.ErrKernelApply, "ipvs: %d of %d applied %s rules did not take effect after %d retries", len(pending), len(applied), ipType, i.verifyRetries)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package system
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnapplied(t *testing.T) {
+	i := &IPVS{}
+	configured := []string{
+		"-A -t 10.54.213.165:80 -s mh -b flag-1,flag-2",
+		"-a -t 10.54.213.165:80 -r 10.131.153.76:80 -g -w 1 --tun-type ipip",
+		"-a -t 10.54.213.165:80 -r 10.131.153.77:80 -g -w 0",
+	}
+	applied := []string{
+		"-A -t 10.54.213.165:80 -s mh -b flag-1,flag-2",
+		"-a -t 10.54.213.165:80 -r 10.131.153.76:80 -g -w 1",
+		"-a -t 10.54.213.165:80 -r 10.131.153.78:80 -g -w 1",
+		"-e -t 10.54.213.165:80 -r 10.131.153.77:80 -g -w 1",
+		"-d -t 10.54.213.165:80 -r 10.131.153.79:80",
+		"-d -t 10.54.213.165:80 -r 10.131.153.77:80",
+		"-D -t 10.54.213.166:80",
+	}
+
+	expected := []string{
+		"-a -t 10.54.213.165:80 -r 10.131.153.78:80 -g -w 1",
+		"-e -t 10.54.213.165:80 -r 10.131.153.77:80 -g -w 1",
+		"-d -t 10.54.213.165:80 -r 10.131.153.77:80",
+	}
+	if out := i.unapplied(configured, applied); !reflect.DeepEqual(out, expected) {
+		t.Fatalf("expected %v to be unapplied. have %v", expected, out)
+	}
+
+	if out := i.unapplied(configured, nil); len(out) != 0 {
+		t.Fatalf("expected nothing to be unapplied. have %v", out)
+	}
+}
@@ -0,0 +1,123 @@
+package system
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// SetVRFs reconciles the VRF devices of the node with vrfs, and places the VIP
+// devices of one family in the VRF of their VIP, see types.VRF. VRFs are
+// created with the alias of ravel, and only those are recreated or removed: a
+// VRF of the same name that ravel didn't create must have the table vrfs gives
+// it already. The devices of VIPs that aren't added yet are placed by the next
+// call, and the devices of VIPs taken out of a VRF leave it.
+func (i *IP) SetVRFs(vrfs map[string]types.VRF, isIP6 bool) error {
+	out, err := i.runIP("-d", "-o", "link", "show", "type", "vrf")
+	if err != nil {
+		return util.Errorf(util.ErrKernelApply, "ipManager: unable to list vrf devices: %v. Saw output: %s", err, string(out))
+	}
+	installed := parseLinks(string(out))
+
+	names := make([]string, 0, len(vrfs))
+	for name := range vrfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		table := vrfs[name].Table
+		if l, ok := installed[name]; ok {
+			if l.table == table {
+				continue
+			}
+			if l.alias != ownerAlias {
+				return util.Errorf(util.ErrKernelApply, "ipManager: vrf %s has table %d rather than %d, and wasn't created by ravel", name, l.table, table)
+			}
+			// the table of a vrf can't be changed, so it is created anew
+			if out, err := i.runIP("link", "del", name, "type", "vrf"); err != nil {
+				return util.Errorf(util.ErrKernelApply, "ipManager: unable to delete vrf %s: %v. Saw output: %s", name, err, string(out))
+			}
+		}
+		if err := i.addVRF(name, table); err != nil {
+			return err
+		}
+		installed[name] = link{alias: ownerAlias, table: table}
+	}
+
+	// the VRF each VIP device of the family is placed in
+	desired := map[string]string{}
+	for _, name := range names {
+		for _, vip := range vrfs[name].VIPs {
+			if (strings.Contains(string(vip), ":")) == isIP6 {
+				desired[i.generateDeviceLabel(string(vip), isIP6)] = name
+			}
+		}
+	}
+
+	out, err = i.runIP("-o", "link", "show", "type", "dummy")
+	if err != nil {
+		return util.Errorf(util.ErrKernelApply, "ipManager: unable to list vip devices: %v. Saw output: %s", err, string(out))
+	}
+	devices := parseLinks(string(out))
+	deviceNames := make([]string, 0, len(devices))
+	for device := range devices {
+		deviceNames = append(deviceNames, device)
+	}
+	sort.Strings(deviceNames)
+	for _, device := range deviceNames {
+		l := devices[device]
+		// v4 devices are named with underscores, see generateDeviceLabel
+		if l.alias != ownerAlias || strings.Contains(device, "_") == isIP6 {
+			continue
+		}
+		vrf, ok := desired[device]
+		switch {
+		case ok && l.master != vrf:
+			if out, err := i.runIP("link", "set", "dev", device, "master", vrf); err != nil {
+				return util.Errorf(util.ErrKernelApply, "ipManager: unable to place device %s in vrf %s: %v. Saw output: %s", device, vrf, err, string(out))
+			}
+			i.logger.Infof("ipManager: placed device %s in vrf %s", device, vrf)
+		case !ok && l.master != "" && installed[l.master].alias == ownerAlias:
+			if out, err := i.runIP("link", "set", "dev", device, "nomaster"); err != nil {
+				return util.Errorf(util.ErrKernelApply, "ipManager: unable to take device %s out of vrf %s: %v. Saw output: %s", device, l.master, err, string(out))
+			}
+			i.logger.Infof("ipManager: took device %s out of vrf %s", device, l.master)
+		}
+	}
+
+	// the vrfs of ravel no longer configured. deleting a vrf releases the
+	// devices of the other family too
+	stale := []string{}
+	for name, l := range installed {
+		if _, ok := vrfs[name]; !ok && l.alias == ownerAlias {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	for _, name := range stale {
+		if out, err := i.runIP("link", "del", name, "type", "vrf"); err != nil {
+			return util.Errorf(util.ErrKernelApply, "ipManager: unable to delete vrf %s: %v. Saw output: %s", name, err, string(out))
+		}
+		i.logger.Infof("ipManager: deleted vrf %s", name)
+	}
+	return nil
+}
+
+// addVRF creates the vrf device name with table, labeled as ravel's, and sets
+// it up
+func (i *IP) addVRF(name string, table int) error {
+	if out, err := i.runIP("link", "add", name, "type", "vrf", "table", strconv.Itoa(table)); err != nil {
+		return util.Errorf(util.ErrKernelApply, "ipManager: unable to add vrf %s with table %d: %v. Saw output: %s", name, table, err, string(out))
+	}
+	if err := i.label(name); err != nil {
+		return err
+	}
+	if out, err := i.runIP("link", "set", "dev", name, "up"); err != nil {
+		return util.Errorf(util.ErrKernelApply, "ipManager: unable to set vrf %s up: %v. Saw output: %s", name, err, string(out))
+	}
+	i.logger.Infof("ipManager: added vrf %s with table %d", name, table)
+	return nil
+}
@@ -0,0 +1,74 @@
+package types
+
+import (
+	"fmt"
+	"net"
+)
+
+// ACL restricts the clients that may reach a VIP port. Clients in Deny are
+// dropped. When Allow is set only the clients in it get through, the others
+// are dropped. Entries are CIDRs of either family, and each family of the
+// VIP port uses the entries of its own, so an allowlist without v6 entries
+// shuts out every v6 client of a dual-stack port.
+type ACL struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Empty reports whether the ACL lets every client through
+func (a *ACL) Empty() bool {
+	return a == nil || (len(a.Allow) == 0 && len(a.Deny) == 0)
+}
+
+// HasACL reports whether any VIP port of the config, of the v6 VIPs when v6
+// is set, restricts its clients
+func (c *ClusterConfig) HasACL(v6 bool) bool {
+	if c == nil {
+		return false
+	}
+	config := c.Config
+	if v6 {
+		config = c.Config6
+	}
+	for _, ports := range config {
+		for _, def := range ports {
+			if def != nil && !def.ACL.Empty() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateACLs makes sure every ACL entry is a CIDR. Translated ports are
+// handed to the translator before an ACL could see them, so they can't have one.
+func (c *ClusterConfig) validateACLs() error {
+	for _, config := range []map[ServiceIP]PortMap{c.Config, c.Config6} {
+		for vip, ports := range config {
+			for port, def := range ports {
+				if def == nil || def.ACL == nil {
+					continue
+				}
+				if def.Translated() && !def.ACL.Empty() {
+					return fmt.Errorf("%s:%s can't have an acl and be translated", vip, port)
+				}
+				for _, cidr := range append(append([]string{}, def.ACL.Deny...), def.ACL.Allow...) {
+					if _, _, err := net.ParseCIDR(cidr); err != nil {
+						return fmt.Errorf("acl entry %q for %s:%s is not a CIDR", cidr, vip, port)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func copyACL(in *ACL) *ACL {
+	if in == nil {
+		return nil
+	}
+	return &ACL{
+		Allow: append([]string(nil), in.Allow...),
+		Deny:  append([]string(nil), in.Deny...),
+	}
+}
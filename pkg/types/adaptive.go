@@ -0,0 +1,96 @@
+package types
+
+import "fmt"
+
+// signals that adaptive weighting measures reals by
+const (
+	AdaptiveConnections = "connections"
+	AdaptiveLatency     = "latency"
+)
+
+// default bounds of adaptive weights, as percentages of a real's own weight
+const (
+	DefaultAdaptiveMinPercent = 10
+	DefaultAdaptiveMaxPercent = 100
+	maxAdaptivePercent        = 1000
+)
+
+// AdaptiveWeight scales the weight of each real of a VIP port by how it
+// performs against the other reals, so that slow or busy reals receive less
+// traffic. A real that does as well as the average keeps its weight.
+type AdaptiveWeight struct {
+	// Signal is connections, the active connections IPVS counts per real
+	// relative to its weight, or latency, the time a real takes to accept a
+	// tcp connection. Defaults to connections. In ecmp mode, where ports are
+	// fwmark services, only latency tells the reals apart.
+	Signal string `json:"signal,omitempty"`
+
+	// ProbePort is the port of the reals that the latency signal connects to.
+	// Defaults to the VIP port, which reals only answer on their own address
+	// when they aren't in direct routing mode.
+	ProbePort int `json:"probePort,omitempty"`
+
+	// MinPercent and MaxPercent bound the weight of a real as a percentage of
+	// its unadjusted weight. They default to 10 and 100, so that reals are only
+	// ever slowed down.
+	MinPercent int `json:"minPercent,omitempty"`
+	MaxPercent int `json:"maxPercent,omitempty"`
+}
+
+// Bounds returns the smallest and largest factor a real's weight is scaled by
+func (a AdaptiveWeight) Bounds() (float64, float64) {
+	min, max := a.MinPercent, a.MaxPercent
+	if min == 0 {
+		min = DefaultAdaptiveMinPercent
+	}
+	if max == 0 {
+		max = DefaultAdaptiveMaxPercent
+	}
+	return float64(min) / 100, float64(max) / 100
+}
+
+// SignalName returns the signal, with the default filled in
+func (a AdaptiveWeight) SignalName() string {
+	if a.Signal == "" {
+		return AdaptiveConnections
+	}
+	return a.Signal
+}
+
+// validateAdaptiveWeights makes sure adaptive weights use a known signal and
+// bounds that leave every real some traffic
+func (c *ClusterConfig) validateAdaptiveWeights() error {
+	for _, config := range []map[ServiceIP]PortMap{c.Config, c.Config6} {
+		for vip, ports := range config {
+			for port, def := range ports {
+				if def == nil || def.AdaptiveWeight == nil {
+					continue
+				}
+				a := def.AdaptiveWeight
+				switch a.Signal {
+				case "", AdaptiveConnections, AdaptiveLatency:
+				default:
+					return fmt.Errorf("adaptive weight signal %q for %s:%s must be %s or %s", a.Signal, vip, port, AdaptiveConnections, AdaptiveLatency)
+				}
+				if a.ProbePort < 0 || a.ProbePort > 65535 {
+					return fmt.Errorf("adaptive weight probe port %d for %s:%s must be between 1 and 65535", a.ProbePort, vip, port)
+				}
+				if a.MinPercent < 0 || a.MaxPercent < 0 || a.MaxPercent > maxAdaptivePercent {
+					return fmt.Errorf("adaptive weight bounds for %s:%s must be between 1 and %d percent", vip, port, maxAdaptivePercent)
+				}
+				if min, max := a.Bounds(); min > max {
+					return fmt.Errorf("adaptive weight minPercent for %s:%s must not exceed maxPercent", vip, port)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func copyAdaptiveWeight(in *AdaptiveWeight) *AdaptiveWeight {
+	if in == nil {
+		return nil
+	}
+	out := *in
+	return &out
+}
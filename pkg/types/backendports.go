@@ -0,0 +1,89 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// BackendPort sends the traffic of a VIP port to TargetPort of the nodes
+// carrying every label of NodeSelector, instead of the VIP port, i.e. while a
+// service moves to a new nodePort one node group at a time. IPVS only changes
+// the port of the traffic it NATs, so a VIP port with backend ports must use
+// the masquerading forwarding method.
+type BackendPort struct {
+	NodeSelector map[string]string `json:"nodeSelector"`
+	TargetPort   int               `json:"targetPort"`
+}
+
+// RealPort returns the port the traffic of the VIP port is sent to on a node
+// with nodeLabels: the TargetPort of the first of BackendPorts that selects the
+// node, or port when none does
+func (d *ServiceDef) RealPort(port string, nodeLabels map[string]string) string {
+	for _, b := range d.BackendPorts {
+		if selects(b.NodeSelector, nodeLabels) {
+			return strconv.Itoa(b.TargetPort)
+		}
+	}
+	return port
+}
+
+// selects returns true when labels carry every label of selector
+func selects(selector, labels map[string]string) bool {
+	for k, v := range selector {
+		if l, ok := labels[k]; !ok || l != v {
+			return false
+		}
+	}
+	return true
+}
+
+func copyBackendPorts(in []BackendPort) []BackendPort {
+	if in == nil {
+		return nil
+	}
+	out := make([]BackendPort, len(in))
+	for n, b := range in {
+		selector := make(map[string]string, len(b.NodeSelector))
+		for k, v := range b.NodeSelector {
+			selector[k] = v
+		}
+		out[n] = BackendPort{NodeSelector: selector, TargetPort: b.TargetPort}
+	}
+	return out
+}
+
+// validateBackendPorts makes sure every backend port selects nodes and names a
+// port, and that none is covered by an earlier one, which selects every node it
+// does, and so would never apply. Backend ports that only partly overlap are
+// applied in order.
+func (c *ClusterConfig) validateBackendPorts() error {
+	for _, config := range []map[ServiceIP]PortMap{c.Config, c.Config6} {
+		for vip, ports := range config {
+			for port, def := range ports {
+				if def == nil || len(def.BackendPorts) == 0 {
+					continue
+				}
+				if def.Translated() || def.TProxied() {
+					return fmt.Errorf("%s:%s isn't load balanced by ipvs, so it can't have backend ports", vip, port)
+				}
+				if def.IPVSOptions.ForwardingMethod() != "m" {
+					return fmt.Errorf("backend ports of %s:%s need the masquerading forwarding method 'm', as ipvs only changes the port of the traffic it NATs", vip, port)
+				}
+				for n, b := range def.BackendPorts {
+					if len(b.NodeSelector) == 0 {
+						return fmt.Errorf("backend port %d of %s:%s has no nodeSelector", n, vip, port)
+					}
+					if b.TargetPort < 1 || b.TargetPort > 65535 {
+						return fmt.Errorf("backend port %d of %s:%s has targetPort %d. it must be between 1 and 65535", n, vip, port, b.TargetPort)
+					}
+					for m := 0; m < n; m++ {
+						if selects(def.BackendPorts[m].NodeSelector, b.NodeSelector) {
+							return fmt.Errorf("backend port %d of %s:%s would never apply, as backend port %d selects every node it does", n, vip, port, m)
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -1,10 +1,11 @@
 package types
 
 import (
-	"encoding/json"
 	"fmt"
+	"net"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
@@ -21,8 +22,23 @@ import (
 //
 // i.e. sharing a single VIP across a pile of namespaces and services,
 // all with different (but unique for the VIP) input ports
+//
+// A ClusterConfig published by the watcher is never modified afterwards; every
+// change produces a new config. Consumers that need to modify one must DeepCopy
+// it first, and can compare Generation to detect change without a deep comparison.
 type ClusterConfig struct {
 	sync.RWMutex
+
+	// Generation is assigned by the watcher when the config is published and is
+	// incremented only when the content differs from the previous config
+	Generation uint64 `json:"-"`
+
+	// EventTime is when the earliest change to endpoints folded into the config
+	// since the previous one was published was triggered, or zero when there
+	// was none. The time from it to the reconcile that lands the config in the
+	// kernel is how long the load balancer took to converge.
+	EventTime time.Time `json:"-"`
+
 	VIPPool    []string              `json:"vipPool"`
 	MTUConfig  map[ServiceIP]string  `json:"mtuConfig"`
 	MTUConfig6 map[ServiceIP]string  `json:"mtuConfig6"`
@@ -30,14 +46,76 @@ type ClusterConfig struct {
 	IPV6       map[ServiceIP]string  `json:"ipv6"`
 	Config     map[ServiceIP]PortMap `json:"config"`
 	Config6    map[ServiceIP]PortMap `json:"config6"`
+
+	// DualStack serves the ipv6Enabled ports of each v4 VIP on the v6 VIP that
+	// IPV6 pairs it with, see expandDualStack. Without it ipv6Enabled and IPV6
+	// keep their meaning from before dual-stack services.
+	DualStack bool `json:"dualStack,omitempty"`
+
+	// Announce selects how each VIP is announced to the network - arp, ndp, bgp
+	// or vrrp. VIPs that aren't listed use the default of the load balancer.
+	Announce map[ServiceIP]string `json:"announce,omitempty"`
+
+	// Maintenance takes VIPs out of service without removing their config. The
+	// VIP keeps its address and announcement, but its traffic is rejected or
+	// dropped by the node instead of being forwarded.
+	Maintenance map[ServiceIP]Maintenance `json:"maintenance,omitempty"`
+
+	// Defense enables SYN flood mitigations for internet facing VIPs, and
+	// IPVSDefense tunes the strategies IPVS uses when its connection table
+	// fills up
+	Defense     map[ServiceIP]Defense `json:"defense,omitempty"`
+	IPVSDefense *IPVSDefense          `json:"ipvsDefense,omitempty"`
+
+	// Directors orders the directors of the pool that advertise each VIP, and
+	// Sharding spreads the rest across it
+	Directors map[ServiceIP]DirectorPolicy `json:"directors,omitempty"`
+	Sharding  *Sharding                    `json:"sharding,omitempty"`
+
+	// Templates configure the kubernetes services they match, which the
+	// watcher expands into VIP ports of Config and Config6, see
+	// ServiceTemplate
+	Templates []ServiceTemplate `json:"templates,omitempty"`
+
+	// Routes send the replies of VIPs out of the interface they name, see
+	// ReturnRoute
+	Routes map[ServiceIP]ReturnRoute `json:"routes,omitempty"`
+
+	// VRFs place VIPs in the Linux VRFs they are named after, see VRF
+	VRFs map[string]VRF `json:"vrfs,omitempty"`
+}
+
+// maintenance actions
+const (
+	MaintenanceReject = "reject"
+	MaintenanceDrop   = "drop"
+)
+
+// Maintenance is how traffic to a VIP in maintenance is handled
+type Maintenance struct {
+	// Action is reject, which answers tcp with a reset and udp with port
+	// unreachable, or drop. An empty action rejects.
+	Action string `json:"action,omitempty"`
+
+	// Withdraw also stops advertising the VIP over BGP, so that upstream
+	// routers send its traffic elsewhere
+	Withdraw bool `json:"withdraw,omitempty"`
+}
+
+// InMaintenance returns the maintenance settings of vip, and whether the VIP
+// is in maintenance
+func (c *ClusterConfig) InMaintenance(vip ServiceIP) (Maintenance, bool) {
+	if c == nil {
+		return Maintenance{}, false
+	}
+	m, ok := c.Maintenance[vip]
+	return m, ok
 }
 
 func NewClusterConfig(config *v1.ConfigMap, configKey string) (*ClusterConfig, error) {
 
 	// log.Debugln("NewClusterConfig fetching configmap with configKey", configKey)
 
-	clusterConfig := &ClusterConfig{}
-
 	// check for the existence of the requested key.
 	if _, ok := config.Data[configKey]; !ok {
 		keys := []string{}
@@ -47,9 +125,9 @@ func NewClusterConfig(config *v1.ConfigMap, configKey string) (*ClusterConfig, e
 		return nil, fmt.Errorf("config key '%s' not found in configmap. have '%v'", configKey, keys)
 	}
 
-	err := json.Unmarshal([]byte(config.Data[configKey]), &clusterConfig)
+	clusterConfig, err := ParseClusterConfig([]byte(config.Data[configKey]))
 	if err != nil {
-		return nil, fmt.Errorf("json unmarshal error. %v", err)
+		return nil, err
 	}
 
 	var portConfigCount int
@@ -59,6 +137,9 @@ func NewClusterConfig(config *v1.ConfigMap, configKey string) (*ClusterConfig, e
 	log.Debugln("NewClusterConfig: loaded configmap configKey", configKey, "from configmap", config.Name, "with", len(clusterConfig.Config), "IPv4 config entries")
 
 	// TODO: validate the cluster config in depth
+	if clusterConfig.DualStack {
+		clusterConfig.expandDualStack()
+	}
 	if err := clusterConfig.Validate(); err != nil {
 		return nil, fmt.Errorf("validation error. %v", err)
 	}
@@ -67,7 +148,262 @@ func NewClusterConfig(config *v1.ConfigMap, configKey string) (*ClusterConfig, e
 
 func (c *ClusterConfig) Validate() error {
 	// TODO: add validation!
-	return nil
+	for vip, m := range c.Maintenance {
+		switch m.Action {
+		case "", MaintenanceReject, MaintenanceDrop:
+		default:
+			return fmt.Errorf("maintenance action %q for %s must be %s or %s", m.Action, vip, MaintenanceReject, MaintenanceDrop)
+		}
+	}
+	if err := c.validatePorts(); err != nil {
+		return err
+	}
+	if err := c.validateDefense(); err != nil {
+		return err
+	}
+	if err := c.validateACLs(); err != nil {
+		return err
+	}
+	if err := c.validateTProxy(); err != nil {
+		return err
+	}
+	if err := c.validateAdaptiveWeights(); err != nil {
+		return err
+	}
+	if err := c.validatePersistence(); err != nil {
+		return err
+	}
+	if err := c.validateOnePacket(); err != nil {
+		return err
+	}
+	if err := c.validateSteering(); err != nil {
+		return err
+	}
+	if err := c.validateDirectors(); err != nil {
+		return err
+	}
+	if err := c.validateMirrors(); err != nil {
+		return err
+	}
+	if err := c.validateTemplates(); err != nil {
+		return err
+	}
+	if err := c.validateRoutes(); err != nil {
+		return err
+	}
+	if err := c.validateVRFs(); err != nil {
+		return err
+	}
+	if err := c.validateFlowExport(); err != nil {
+		return err
+	}
+	if err := c.validatePortRewrites(); err != nil {
+		return err
+	}
+	if err := c.validateBackendPorts(); err != nil {
+		return err
+	}
+	return c.validateTranslations()
+}
+
+// expandDualStack adds the ipv6Enabled ports of each v4 VIP to Config6 under
+// the v6 VIP that IPV6 maps it to, so that a dual-stack service is declared
+// once and built in both IPVS families from the same endpoints. VIPs without a
+// v6 mapping are skipped, as are mappings to an address that isn't IPv6, which
+// are logged rather than rejecting the whole config. A port that is already in
+// Config6 is left as configured.
+func (c *ClusterConfig) expandDualStack() {
+	for vip, v6 := range c.IPV6 {
+		if ip := net.ParseIP(v6); ip == nil || ip.To4() != nil {
+			log.Warnf("ipv6 address %q for %s is not an IPv6 address. not serving it dual-stack", v6, vip)
+		}
+	}
+	for vip, ports := range c.Config {
+		for port, def := range ports {
+			if def == nil || !def.IPV6Enabled {
+				continue
+			}
+			v6, ok := c.IPV6[vip]
+			if ip := net.ParseIP(v6); !ok || ip == nil || ip.To4() != nil {
+				continue
+			}
+			v6vip := ServiceIP(v6)
+			if _, ok := c.Config6[v6vip][port]; ok {
+				continue
+			}
+			if c.Config6 == nil {
+				c.Config6 = map[ServiceIP]PortMap{}
+			}
+			if c.Config6[v6vip] == nil {
+				c.Config6[v6vip] = PortMap{}
+			}
+			// steering only applies to v4 clients, the mirror gateway is v4 and
+			// v6 VIP ports aren't NATed by the realservers
+			d := *def
+			d.Steering = nil
+			d.Mirror = nil
+			d.PortRewrite = nil
+			d.ACL = copyACL(def.ACL)
+			d.AdaptiveWeight = copyAdaptiveWeight(def.AdaptiveWeight)
+			d.BackendPorts = copyBackendPorts(def.BackendPorts)
+			c.Config6[v6vip][port] = &d
+		}
+	}
+}
+
+// DeepCopy returns a copy of the config that shares no maps, slices or
+// service definitions with the original, so it can't change underneath a reader.
+func (c *ClusterConfig) DeepCopy() *ClusterConfig {
+	if c == nil {
+		return nil
+	}
+	c.RLock()
+	defer c.RUnlock()
+
+	out := &ClusterConfig{
+		Generation: c.Generation,
+		EventTime:  c.EventTime,
+		MTUConfig:  copyServiceIPMap(c.MTUConfig),
+		MTUConfig6: copyServiceIPMap(c.MTUConfig6),
+		IPV6:       copyServiceIPMap(c.IPV6),
+		DualStack:  c.DualStack,
+		Announce:   copyServiceIPMap(c.Announce),
+		Config:     copyPortMaps(c.Config),
+		Config6:    copyPortMaps(c.Config6),
+	}
+	if c.Maintenance != nil {
+		out.Maintenance = make(map[ServiceIP]Maintenance, len(c.Maintenance))
+		for vip, m := range c.Maintenance {
+			out.Maintenance[vip] = m
+		}
+	}
+	if c.Defense != nil {
+		out.Defense = make(map[ServiceIP]Defense, len(c.Defense))
+		for vip, d := range c.Defense {
+			out.Defense[vip] = d
+		}
+	}
+	if c.Directors != nil {
+		out.Directors = make(map[ServiceIP]DirectorPolicy, len(c.Directors))
+		for vip, d := range c.Directors {
+			d.Preferred = append([]string(nil), d.Preferred...)
+			out.Directors[vip] = d
+		}
+	}
+	if c.Routes != nil {
+		out.Routes = make(map[ServiceIP]ReturnRoute, len(c.Routes))
+		for vip, r := range c.Routes {
+			out.Routes[vip] = r
+		}
+	}
+	if c.Sharding != nil {
+		sharding := *c.Sharding
+		out.Sharding = &sharding
+	}
+	out.IPVSDefense = copyIPVSDefense(c.IPVSDefense)
+	out.Templates = copyTemplates(c.Templates)
+	out.VRFs = copyVRFs(c.VRFs)
+	if c.VIPPool != nil {
+		out.VIPPool = append([]string{}, c.VIPPool...)
+	}
+	if c.NodeLabels != nil {
+		out.NodeLabels = make(map[string]string, len(c.NodeLabels))
+		for k, v := range c.NodeLabels {
+			out.NodeLabels[k] = v
+		}
+	}
+	return out
+}
+
+// RemovalsOnly returns applied with only the removals that desired makes to it:
+// the VIP ports of applied that are no longer in desired are removed, and
+// everything else is kept as applied. When nothing has been applied, desired
+// is returned.
+func RemovalsOnly(applied, desired *ClusterConfig) *ClusterConfig {
+	if applied == nil || desired == nil {
+		return desired
+	}
+	out := applied.DeepCopy()
+	removeMissingPorts(out.Config, desired.Config)
+	removeMissingPorts(out.Config6, desired.Config6)
+	return out
+}
+
+// removeMissingPorts deletes the VIP ports in out that aren't in keep, and VIPs left without ports
+func removeMissingPorts(out, keep map[ServiceIP]PortMap) {
+	for vip, ports := range out {
+		for port := range ports {
+			if _, ok := keep[vip][port]; !ok {
+				delete(ports, port)
+			}
+		}
+		if len(ports) == 0 {
+			delete(out, vip)
+		}
+	}
+}
+
+func copyServiceIPMap(in map[ServiceIP]string) map[ServiceIP]string {
+	if in == nil {
+		return nil
+	}
+	out := make(map[ServiceIP]string, len(in))
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
+
+func copyPortMaps(in map[ServiceIP]PortMap) map[ServiceIP]PortMap {
+	if in == nil {
+		return nil
+	}
+	out := make(map[ServiceIP]PortMap, len(in))
+	for vip, ports := range in {
+		if ports == nil {
+			out[vip] = nil
+			continue
+		}
+		pm := make(PortMap, len(ports))
+		for port, def := range ports {
+			if def != nil {
+				def = copyServiceDef(def)
+			}
+			pm[port] = def
+		}
+		out[vip] = pm
+	}
+	return out
+}
+
+func copyServiceDef(def *ServiceDef) *ServiceDef {
+	d := *def
+	d.Steering = copySteering(def.Steering)
+	d.ACL = copyACL(def.ACL)
+	d.AdaptiveWeight = copyAdaptiveWeight(def.AdaptiveWeight)
+	d.Mirror = copyMirror(def.Mirror)
+	d.PortRewrite = copyPortRewrite(def.PortRewrite)
+	d.BackendPorts = copyBackendPorts(def.BackendPorts)
+	return &d
+}
+
+func copySteering(in []Steering) []Steering {
+	if in == nil {
+		return nil
+	}
+	out := make([]Steering, len(in))
+	for n, rule := range in {
+		rule.Sources = append([]string(nil), rule.Sources...)
+		if rule.NodeLabels != nil {
+			labels := make(map[string]string, len(rule.NodeLabels))
+			for k, v := range rule.NodeLabels {
+				labels[k] = v
+			}
+			rule.NodeLabels = labels
+		}
+		out[n] = rule
+	}
+	return out
 }
 
 // ServiceIP stores a service VIP for iptables and IPVS to manage.
@@ -88,11 +424,69 @@ type ServiceDef struct {
 	// as any other per-LB options
 	IPVSOptions IPVSOptions `json:"ipvsOptions"`
 
-	IPV4Enabled          bool `json:"ipv4Enabled"`
-	IPV6Enabled          bool `json:"ipv6Enabled"`
-	TCPEnabled           bool `json:"tcpEnabled"`
-	UDPEnabled           bool `json:"udpEnabled"`
+	IPV4Enabled bool `json:"ipv4Enabled"`
+
+	// IPV6Enabled on a port of a v4 VIP also serves the port on the v6 VIP
+	// that the ipv6 map of the cluster config pairs with it
+	IPV6Enabled bool `json:"ipv6Enabled"`
+	TCPEnabled  bool `json:"tcpEnabled"`
+	UDPEnabled  bool `json:"udpEnabled"`
+
+	// ProxyProtocolEnabled records that the backends of the VIP port expect
+	// connections to start with a PROXY protocol header, written by the
+	// client or a proxy in front of ravel. Ravel forwards at layer 4 and
+	// neither adds nor strips the header, and the header carries the original
+	// destination port, so backends reached through PortRewrite see the VIP
+	// port in it rather than the one they listen on.
 	ProxyProtocolEnabled bool `json:"proxyProtocolEnabled"`
+
+	// NoTrack exempts traffic to the VIP port from connection tracking on the
+	// directors, for services with packet rates that would exhaust the conntrack
+	// table. Not applied on directors colocated with realservers, which NAT.
+	NoTrack bool `json:"noTrack,omitempty"`
+
+	// Translate hands traffic to the VIP port to the paired VIP of the other
+	// family instead of load balancing it in its own, see TranslateSIIT
+	Translate string `json:"translate,omitempty"`
+
+	// Steering sends clients from the given source CIDRs to other backends,
+	// in order of the first rule that matches, see Steering
+	Steering []Steering `json:"steering,omitempty"`
+
+	// ACL allows or denies clients of the VIP port by source CIDR, ahead of
+	// load balancing, see ACL
+	ACL *ACL `json:"acl,omitempty"`
+
+	// TProxyPort delivers traffic to the VIP port to the transparent proxy
+	// listening on this port of the director, i.e. for L7 inspection, instead
+	// of load balancing it with IPVS. Other ports of the VIP are unaffected.
+	TProxyPort int `json:"tproxyPort,omitempty"`
+
+	// AdaptiveWeight scales the weights of the port's reals by how they
+	// perform, see AdaptiveWeight
+	AdaptiveWeight *AdaptiveWeight `json:"adaptiveWeight,omitempty"`
+
+	// Hairpin masquerades traffic to the VIP port from pods on the node that
+	// NATs it to local pods, as colocated directors and realservers do, so
+	// that a pod reaching the VIP gets its replies even when it is sent back
+	// to itself. IPv4 VIP ports only.
+	Hairpin bool `json:"hairpin,omitempty"`
+
+	// Mirror copies a sample of the port's connections to a shadow backend,
+	// see Mirror
+	Mirror *Mirror `json:"mirror,omitempty"`
+
+	// FlowExport has the directors export IPFIX records of the port's
+	// connections, sampled from connection tracking, to the flow collector
+	FlowExport bool `json:"flowExport,omitempty"`
+
+	// PortRewrite sends the port's traffic to other ports of its backends
+	// when the realservers NAT it, see PortRewrite
+	PortRewrite *PortRewrite `json:"portRewrite,omitempty"`
+
+	// BackendPorts send the port's traffic to other ports on some groups of
+	// nodes, the first that selects a node applying, see BackendPort
+	BackendPorts []BackendPort `json:"backendPorts,omitempty"`
 }
 
 // IPVSOptions contains per-service options for the IPVS configuration.
@@ -137,6 +531,24 @@ type IPVSOptions struct {
 	// Flags are optional args for a new virtual server
 	// if flags: -b <flag-1>,<flag-2>,... (default empty)
 	Flags string `json:"flags"`
+
+	// Persistence sends a client to the same realserver for this many seconds
+	// after its last connection. 0 disables persistence.
+	// -p 300
+	Persistence int `json:"persistence,omitempty"`
+
+	// PersistencePrefix and PersistencePrefix6 widen persistence from single
+	// clients to whole IPv4 and IPv6 prefixes of this length, so that i.e. all
+	// of a /24 lands on the same realserver. 0 keeps single clients.
+	// -M 255.255.255.0 or -M 64
+	PersistencePrefix  int `json:"persistencePrefix,omitempty"`
+	PersistencePrefix6 int `json:"persistencePrefix6,omitempty"`
+
+	// OnePacket schedules every UDP datagram on its own instead of keeping a
+	// connection entry for the client, i.e. for DNS and syslog. TCP is
+	// unaffected.
+	// -o
+	OnePacket bool `json:"onePacket,omitempty"`
 }
 
 // Scheduler returns a scheduler
@@ -195,6 +607,8 @@ func (i *IPVSOptions) ForwardingMethod() string {
 		method = "g"
 	case "i":
 		method = "i"
+	case "m":
+		method = "m"
 	default:
 		method = "g"
 	}
@@ -0,0 +1,164 @@
+package types
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// defaults announced to clients by the SYN proxy
+const (
+	DefaultSYNProxyMSS    = 1460
+	DefaultSYNProxyWScale = 7
+)
+
+// Defense holds the SYN flood mitigations of an IPv4 VIP
+type Defense struct {
+	// SYNProxy answers the handshakes of the VIP's tcp ports with SYN cookies
+	// and only lets the clients that complete them through
+	SYNProxy bool `json:"synProxy,omitempty"`
+
+	// MSS and WScale are the tcp options the proxy announces to clients in
+	// place of the backends'. They default to 1460 and 7.
+	MSS    int `json:"mss,omitempty"`
+	WScale int `json:"wscale,omitempty"`
+}
+
+// Options returns the MSS and window scale the proxy announces, with defaults filled in
+func (d Defense) Options() (mss, wscale int) {
+	mss, wscale = d.MSS, d.WScale
+	if mss == 0 {
+		mss = DefaultSYNProxyMSS
+	}
+	if wscale == 0 {
+		wscale = DefaultSYNProxyWScale
+	}
+	return mss, wscale
+}
+
+// IPVSDefense sets the IPVS defense strategies against connection table
+// exhaustion. They apply to every VIP of a director and override the
+// --ipvs-sysctl settings while set. Unset fields leave the node's value.
+// See http://www.linuxvirtualserver.org/docs/defense.html
+type IPVSDefense struct {
+	DropEntry  *int `json:"dropEntry,omitempty"`
+	DropPacket *int `json:"dropPacket,omitempty"`
+	SecureTCP  *int `json:"secureTcp,omitempty"`
+	AmemThresh *int `json:"amemthresh,omitempty"`
+}
+
+// sysctl names of the syn proxy prerequisites and the ipvs defense strategies
+const (
+	sysctlSYNCookies   = "net/ipv4/tcp_syncookies"
+	sysctlTCPLoose     = "net/netfilter/nf_conntrack_tcp_loose"
+	sysctlDropEntry    = "net/ipv4/vs/drop_entry"
+	sysctlDropPacket   = "net/ipv4/vs/drop_packet"
+	sysctlSecureTCP    = "net/ipv4/vs/secure_tcp"
+	sysctlAmemThresh   = "net/ipv4/vs/amemthresh"
+	defenseStrategyMax = 3
+)
+
+// SYNProxy returns the defense of vip, and whether it has the SYN proxy enabled
+func (c *ClusterConfig) SYNProxy(vip ServiceIP) (Defense, bool) {
+	if c == nil {
+		return Defense{}, false
+	}
+	d, ok := c.Defense[vip]
+	return d, ok && d.SYNProxy
+}
+
+// HasSYNProxy reports whether any VIP of the config has the SYN proxy enabled
+func (c *ClusterConfig) HasSYNProxy() bool {
+	if c == nil {
+		return false
+	}
+	for vip := range c.Defense {
+		if _, ok := c.SYNProxy(vip); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// DefenseSysctls returns the kernel parameters, as paths below /proc/sys, that
+// the defenses of the config need. The SYN proxy needs syn cookies and
+// conntrack that doesn't pick up connections midstream.
+func (c *ClusterConfig) DefenseSysctls() map[string]string {
+	out := map[string]string{}
+	if c == nil {
+		return out
+	}
+	if c.HasSYNProxy() {
+		out[sysctlSYNCookies] = "1"
+		out[sysctlTCPLoose] = "0"
+	}
+	if d := c.IPVSDefense; d != nil {
+		for name, value := range map[string]*int{
+			sysctlDropEntry:  d.DropEntry,
+			sysctlDropPacket: d.DropPacket,
+			sysctlSecureTCP:  d.SecureTCP,
+			sysctlAmemThresh: d.AmemThresh,
+		} {
+			if value != nil {
+				out[name] = strconv.Itoa(*value)
+			}
+		}
+	}
+	return out
+}
+
+// validateDefense makes sure the SYN proxy is only enabled for IPv4 VIPs whose
+// traffic is tracked, with options the kernel accepts, and that the IPVS
+// strategies are in range
+func (c *ClusterConfig) validateDefense() error {
+	for vip, d := range c.Defense {
+		if ip := net.ParseIP(string(vip)); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("defense for %s is only available for IPv4 VIPs", vip)
+		}
+		if d.MSS != 0 && (d.MSS < 536 || d.MSS > 65535) {
+			return fmt.Errorf("syn proxy mss %d for %s must be between 536 and 65535", d.MSS, vip)
+		}
+		if d.WScale < 0 || d.WScale > 14 {
+			return fmt.Errorf("syn proxy wscale %d for %s must be between 0 and 14", d.WScale, vip)
+		}
+		if !d.SYNProxy {
+			continue
+		}
+		for port, def := range c.Config[vip] {
+			if def != nil && def.NoTrack {
+				return fmt.Errorf("%s:%s can't bypass connection tracking behind a syn proxy", vip, port)
+			}
+		}
+	}
+
+	if d := c.IPVSDefense; d != nil {
+		for name, value := range map[string]*int{"dropEntry": d.DropEntry, "dropPacket": d.DropPacket, "secureTcp": d.SecureTCP} {
+			if value != nil && (*value < 0 || *value > defenseStrategyMax) {
+				return fmt.Errorf("ipvs defense %s %d must be between 0 and %d", name, *value, defenseStrategyMax)
+			}
+		}
+		if d.AmemThresh != nil && *d.AmemThresh <= 0 {
+			return fmt.Errorf("ipvs defense amemthresh %d must be positive", *d.AmemThresh)
+		}
+	}
+	return nil
+}
+
+func copyIPVSDefense(in *IPVSDefense) *IPVSDefense {
+	if in == nil {
+		return nil
+	}
+	copyInt := func(v *int) *int {
+		if v == nil {
+			return nil
+		}
+		n := *v
+		return &n
+	}
+	return &IPVSDefense{
+		DropEntry:  copyInt(in.DropEntry),
+		DropPacket: copyInt(in.DropPacket),
+		SecureTCP:  copyInt(in.SecureTCP),
+		AmemThresh: copyInt(in.AmemThresh),
+	}
+}
@@ -0,0 +1,133 @@
+package types
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// DirectorPolicy decides which directors of the pool advertise a VIP, so that
+// the traffic of different VIPs lands on different directors rather than all
+// of it on every one. The pool is the directors that are up, see
+// --bgp-director-pool-selector. VIPs without a policy are advertised by every
+// director unless the config is sharded, and a VIP whose policy matches no
+// director of the pool is too, so that a VIP is never left without one.
+type DirectorPolicy struct {
+	// Preferred are director nodes in order of preference. The VIP is
+	// advertised by the first of them that is in the pool.
+	Preferred []string `json:"preferred,omitempty"`
+
+	// Spread advertises the VIP from one director of the pool, picked by a
+	// hash of the VIP so that every director picks the same one, and so that a
+	// director leaving the pool only moves its own VIPs. When Preferred is set
+	// too, it applies once none of the preferred directors is in the pool.
+	Spread bool `json:"spread,omitempty"`
+}
+
+// Sharding divides every VIP without a director policy across the pool, as
+// Spread does, so that each director only advertises its shard of the VIPs
+// and the pool scales beyond the capacity of one director. Replicas is the
+// number of directors advertising each VIP, 1 when unset.
+type Sharding struct {
+	Replicas int `json:"replicas,omitempty"`
+}
+
+// Advertises reports whether node advertises vip while the directors in pool
+// are up. An empty pool, as when the pool isn't known, advertises everywhere.
+func (c *ClusterConfig) Advertises(vip ServiceIP, node string, pool []string) bool {
+	if c == nil || len(pool) == 0 {
+		return true
+	}
+	policy, ok := c.Directors[vip]
+	if !ok {
+		if c.Sharding == nil {
+			return true
+		}
+		return containsString(spreadDirectors(vip, pool, c.Sharding.replicas()), node)
+	}
+
+	up := make(map[string]bool, len(pool))
+	for _, director := range pool {
+		up[director] = true
+	}
+	for _, director := range policy.Preferred {
+		if up[director] {
+			return director == node
+		}
+	}
+	if policy.Spread {
+		return containsString(spreadDirectors(vip, pool, 1), node)
+	}
+	return true
+}
+
+func (s *Sharding) replicas() int {
+	if s.Replicas < 1 {
+		return 1
+	}
+	return s.Replicas
+}
+
+// spreadDirectors picks the n directors of pool with the highest hashes of
+// them and vip, as rendezvous hashing does, so that a director joining or
+// leaving the pool only moves the VIPs it takes or had
+func spreadDirectors(vip ServiceIP, pool []string, n int) []string {
+	type scored struct {
+		director string
+		sum      uint64
+	}
+	scores := make([]scored, 0, len(pool))
+	for _, director := range pool {
+		h := fnv.New64a()
+		h.Write([]byte(vip))
+		h.Write([]byte{0})
+		h.Write([]byte(director))
+		scores = append(scores, scored{director, h.Sum64()})
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].sum != scores[j].sum {
+			return scores[i].sum > scores[j].sum
+		}
+		return scores[i].director < scores[j].director
+	})
+
+	if n > len(scores) {
+		n = len(scores)
+	}
+	picked := make([]string, 0, n)
+	for _, s := range scores[:n] {
+		picked = append(picked, s.director)
+	}
+	return picked
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ClusterConfig) validateDirectors() error {
+	for vip, policy := range c.Directors {
+		seen := map[string]bool{}
+		for _, director := range policy.Preferred {
+			if director == "" {
+				return fmt.Errorf("directors of %s must not list an empty node name", vip)
+			}
+			if seen[director] {
+				return fmt.Errorf("directors of %s list %s more than once", vip, director)
+			}
+			seen[director] = true
+		}
+		if len(policy.Preferred) == 0 && !policy.Spread {
+			return fmt.Errorf("directors of %s must list preferred nodes or spread", vip)
+		}
+	}
+	if c.Sharding != nil && c.Sharding.Replicas < 0 {
+		return fmt.Errorf("sharding replicas must not be negative")
+	}
+	return nil
+}
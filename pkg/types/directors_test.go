@@ -0,0 +1,122 @@
+package types
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAdvertises(t *testing.T) {
+	c := &ClusterConfig{
+		Directors: map[ServiceIP]DirectorPolicy{
+			"10.54.213.1": {Preferred: []string{"director-a", "director-b"}},
+			"10.54.213.2": {Preferred: []string{"director-c"}},
+			"10.54.213.3": {Preferred: []string{"director-c"}, Spread: true},
+		},
+	}
+	pool := []string{"director-a", "director-b"}
+
+	for _, tc := range []struct {
+		vip      ServiceIP
+		pool     []string
+		expected []string
+	}{
+		// the first preferred director that is up
+		{"10.54.213.1", pool, []string{"director-a"}},
+		{"10.54.213.1", []string{"director-b"}, []string{"director-b"}},
+		// none of the preferred directors is up, so every director advertises
+		{"10.54.213.2", pool, pool},
+		// no policy
+		{"10.54.213.4", pool, pool},
+		// no pool known
+		{"10.54.213.1", nil, pool},
+	} {
+		advertisers := []string{}
+		for _, node := range pool {
+			if c.Advertises(tc.vip, node, tc.pool) {
+				advertisers = append(advertisers, node)
+			}
+		}
+		if fmt.Sprint(advertisers) != fmt.Sprint(tc.expected) {
+			t.Errorf("%s with pool %v: expected %v to advertise. saw %v", tc.vip, tc.pool, tc.expected, advertisers)
+		}
+	}
+
+	// spread picks exactly one director of the pool
+	advertisers := 0
+	for _, node := range pool {
+		if c.Advertises("10.54.213.3", node, pool) {
+			advertisers++
+		}
+	}
+	if advertisers != 1 {
+		t.Fatalf("expected one director to advertise a spread VIP. saw %d", advertisers)
+	}
+}
+
+func TestSpreadDirector(t *testing.T) {
+	pool := []string{"director-a", "director-b", "director-c", "director-d"}
+	picked := map[string]int{}
+	moved := 0
+	for i := 0; i < 400; i++ {
+		vip := ServiceIP(fmt.Sprintf("10.54.%d.%d", i/250, i%250))
+		director := spreadDirectors(vip, pool, 1)[0]
+		picked[director]++
+
+		// removing a director only moves the VIPs it had
+		if after := spreadDirectors(vip, pool[1:], 1)[0]; after != director {
+			if director != "director-a" {
+				t.Fatalf("%s moved from %s to %s when director-a left", vip, director, after)
+			}
+			moved++
+		}
+	}
+	if len(picked) != len(pool) {
+		t.Fatalf("expected every director to be picked. saw %v", picked)
+	}
+	if moved != picked["director-a"] {
+		t.Fatalf("expected the %d VIPs of director-a to move. saw %d", picked["director-a"], moved)
+	}
+}
+
+func TestSharding(t *testing.T) {
+	pool := []string{"director-a", "director-b", "director-c"}
+	c := &ClusterConfig{
+		Directors: map[ServiceIP]DirectorPolicy{
+			"10.54.213.1": {Preferred: []string{"director-a"}},
+		},
+		Sharding: &Sharding{Replicas: 2},
+	}
+
+	shards := map[string]int{}
+	for i := 2; i < 200; i++ {
+		vip := ServiceIP(fmt.Sprintf("10.54.213.%d", i))
+		advertisers := 0
+		for _, node := range pool {
+			if c.Advertises(vip, node, pool) {
+				advertisers++
+				shards[node]++
+			}
+		}
+		if advertisers != 2 {
+			t.Fatalf("expected %s to be advertised by 2 directors. saw %d", vip, advertisers)
+		}
+	}
+	if len(shards) != len(pool) {
+		t.Fatalf("expected every director to have a shard. saw %v", shards)
+	}
+
+	// a director policy takes precedence over sharding
+	for _, node := range pool {
+		if c.Advertises("10.54.213.1", node, pool) != (node == "director-a") {
+			t.Fatalf("expected only director-a to advertise 10.54.213.1")
+		}
+	}
+
+	// more replicas than directors advertises from every director
+	c.Sharding.Replicas = 5
+	for _, node := range pool {
+		if !c.Advertises("10.54.213.2", node, pool) {
+			t.Fatalf("expected %s to advertise 10.54.213.2", node)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package types
+
+import (
+	v1 "k8s.io/api/core/v1"
+)
+
+// DrainAnnotation, set to "true" on a node, has directors drain it as they
+// would a cordoned node, without keeping pods from being scheduled to it
+const DrainAnnotation = "ravel.comcast.com/drain"
+
+// IsDraining returns true for a node that is cordoned, by the unschedulable
+// flag or taint, or that carries the DrainAnnotation
+func IsDraining(n *v1.Node) bool {
+	return n.Spec.Unschedulable || IsUnschedulable(n) || n.Annotations[DrainAnnotation] == "true"
+}
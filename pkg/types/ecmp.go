@@ -0,0 +1,139 @@
+package types
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultECMPFwmarkBase is the first firewall mark handed out to ECMP services.
+	// It sits above the 0x4000/0x8000 bits used by kube-proxy and the masq chain
+	// so that the marks never collide with existing packet marking.
+	DefaultECMPFwmarkBase = 0x100000
+
+	// ECMPFwmarkRange is the number of firewall marks available to ECMP services.
+	ECMPFwmarkRange = 0x1000
+)
+
+// ECMPFwmark associates a VIP, port and protocol with the firewall mark that
+// every director in an ECMP set uses for it.
+type ECMPFwmark struct {
+	VIP      ServiceIP
+	Port     string
+	Protocol string
+	Mark     int
+}
+
+// Key returns the identity of the marked service, i.e. 10.1.2.3:80:tcp
+func (f ECMPFwmark) Key() string {
+	return ECMPFwmarkKey(f.VIP, f.Port, f.Protocol)
+}
+
+// ECMPFwmarkKey formats the identity used to look up an ECMPFwmark
+func ECMPFwmarkKey(vip ServiceIP, port, protocol string) string {
+	return fmt.Sprintf("%s:%s:%s", vip, port, protocol)
+}
+
+// ECMPScheduler returns the scheduler to use when several directors receive
+// traffic for the same VIP from a router doing ECMP. Only consistent-hash
+// schedulers pick the same realserver on every director, so anything other
+// than sh is replaced with mh.
+func ECMPScheduler(opts IPVSOptions) string {
+	scheduler := opts.Scheduler()
+	switch scheduler {
+	case "mh", "sh":
+		return scheduler
+	}
+	if opts.RawScheduler != "" {
+		log.Warningf("ecmp: scheduler %s is not consistent across directors. using mh", scheduler)
+	}
+	return "mh"
+}
+
+// ECMPFwmarkMask is the mask the ECMP and steering marks are set with, the
+// whole packet mark. IPVS fwmark services match the whole mark, so a packet
+// that kube-proxy had already marked with 0x4000 or 0x8000 would otherwise
+// miss the service.
+const ECMPFwmarkMask = 0xffffffff
+
+// ValidateECMPFwmarkBase makes sure the ECMP marks starting at base fit a mask
+// of their own, clear of kube-proxy's marks and of the steering marks
+func ValidateECMPFwmarkBase(base int) error {
+	if base <= 0xffff {
+		return fmt.Errorf("ecmp fwmark base %#x must be above 0xffff, clear of kube-proxy's marks", base)
+	}
+	if base%ECMPFwmarkRange != 0 {
+		return fmt.Errorf("ecmp fwmark base %#x must be a multiple of %#x", base, ECMPFwmarkRange)
+	}
+	if base == SteeringFwmarkBase {
+		return fmt.Errorf("ecmp fwmark base %#x is the base of the steering marks", base)
+	}
+	return nil
+}
+
+// ECMPFwmarks computes the firewall mark for every IPv4 VIP, port and protocol in the
+// config. Marks are derived from a hash of the service identity so that every director
+// arrives at the same value independently. Collisions are resolved by probing upwards
+// in sorted key order, which is also deterministic across directors. Adding or removing
+// a service leaves the others' marks alone unless it collides with them: a service that
+// takes the slot another sorting after it probed into moves that one, and those after
+// it in turn, up to the next free mark.
+func ECMPFwmarks(config *ClusterConfig, base int) ([]ECMPFwmark, error) {
+	if base <= 0 {
+		base = DefaultECMPFwmarkBase
+	}
+
+	marks := []ECMPFwmark{}
+	for vip, ports := range config.Config {
+		for port, service := range ports {
+			if service.Translated() || service.TProxied() {
+				continue
+			}
+			if service.TCPEnabled {
+				marks = append(marks, ECMPFwmark{VIP: vip, Port: port, Protocol: "tcp"})
+			}
+			if service.UDPEnabled {
+				marks = append(marks, ECMPFwmark{VIP: vip, Port: port, Protocol: "udp"})
+			}
+		}
+	}
+	if len(marks) > ECMPFwmarkRange {
+		return nil, fmt.Errorf("ecmp: %d services exceeds the fwmark range of %d", len(marks), ECMPFwmarkRange)
+	}
+
+	sort.Slice(marks, func(i, j int) bool {
+		return marks[i].Key() < marks[j].Key()
+	})
+
+	keys := make([]string, len(marks))
+	for n := range marks {
+		keys[n] = marks[n].Key()
+	}
+	for n, mark := range hashFwmarks(keys, base, ECMPFwmarkRange) {
+		marks[n].Mark = mark
+	}
+
+	return marks, nil
+}
+
+// hashFwmarks assigns a mark in [base, base+size) to each of the sorted keys
+// from a hash of the key, probing upwards from collisions. There must be no
+// more keys than size.
+func hashFwmarks(keys []string, base, size int) []int {
+	marks := make([]int, len(keys))
+	used := map[int]bool{}
+	for n, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		offset := int(h.Sum32() % uint32(size))
+		for used[offset] {
+			offset = (offset + 1) % size
+		}
+		used[offset] = true
+		marks[n] = base + offset
+	}
+	return marks
+}
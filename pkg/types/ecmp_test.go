@@ -0,0 +1,128 @@
+package types
+
+import (
+	"fmt"
+	"hash/fnv"
+	"testing"
+)
+
+func TestECMPScheduler(t *testing.T) {
+	cases := map[string]string{
+		"":    "mh",
+		"wrr": "mh",
+		"rr":  "mh",
+		"mh":  "mh",
+		"sh":  "sh",
+	}
+	for raw, want := range cases {
+		got := ECMPScheduler(IPVSOptions{RawScheduler: raw})
+		if got != want {
+			t.Errorf("scheduler %q: expected %s, got %s", raw, want, got)
+		}
+	}
+}
+
+func TestECMPFwmarksStable(t *testing.T) {
+	config := &ClusterConfig{
+		Config: map[ServiceIP]PortMap{
+			"10.54.213.165": {
+				"80": &ServiceDef{Namespace: "syseng", Service: "mod-super8", PortName: "http", TCPEnabled: true},
+				"81": &ServiceDef{Namespace: "statsd-demo", Service: "ui", PortName: "http", TCPEnabled: true, UDPEnabled: true},
+			},
+		},
+	}
+
+	first, err := ECMPFwmarks(config, DefaultECMPFwmarkBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 3 {
+		t.Fatalf("expected 3 fwmarks, got %d", len(first))
+	}
+
+	seen := map[int]bool{}
+	byKey := map[string]int{}
+	for _, m := range first {
+		if seen[m.Mark] {
+			t.Errorf("duplicate fwmark %d", m.Mark)
+		}
+		seen[m.Mark] = true
+		if m.Mark < DefaultECMPFwmarkBase || m.Mark >= DefaultECMPFwmarkBase+ECMPFwmarkRange {
+			t.Errorf("fwmark %#x out of range", m.Mark)
+		}
+		byKey[m.Key()] = m.Mark
+	}
+
+	// adding a service must not renumber the existing ones
+	config.Config["10.54.213.166"] = PortMap{
+		"443": &ServiceDef{Namespace: "syseng", Service: "web", PortName: "https", TCPEnabled: true},
+	}
+	second, err := ECMPFwmarks(config, DefaultECMPFwmarkBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range second {
+		if mark, ok := byKey[m.Key()]; ok && mark != m.Mark {
+			t.Errorf("fwmark for %s changed from %d to %d", m.Key(), mark, m.Mark)
+		}
+	}
+}
+
+func TestHashFwmarksCollisions(t *testing.T) {
+	// find two keys that hash to the same slot of a small range
+	const size = 8
+	slots := map[uint32]string{}
+	var first, second string
+	for n := 0; second == ""; n++ {
+		key := fmt.Sprintf("10.54.213.%d:80:tcp", n)
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		slot := h.Sum32() % size
+		if other, ok := slots[slot]; ok {
+			first, second = other, key
+			if second < first {
+				first, second = second, first
+			}
+		}
+		slots[slot] = key
+	}
+
+	alone := hashFwmarks([]string{second}, 0x100, size)
+	both := hashFwmarks([]string{first, second}, 0x100, size)
+	if both[0] == both[1] {
+		t.Fatalf("expected colliding keys to get distinct marks. have %v", both)
+	}
+	if both[0] != alone[0] {
+		t.Fatalf("expected the first key in sorted order to take the hashed slot %#x. have %#x", alone[0], both[0])
+	}
+	// the key sorting after probes upwards, so adding the first moves it
+	if both[1] != 0x100+(alone[0]-0x100+1)%size {
+		t.Fatalf("expected the second key to move to the next slot. have %#x", both[1])
+	}
+
+	// a full range still hands out every mark once
+	keys := []string{}
+	for n := 0; n < size; n++ {
+		keys = append(keys, fmt.Sprintf("10.54.213.%d:80:tcp", n))
+	}
+	seen := map[int]bool{}
+	for _, mark := range hashFwmarks(keys, 0x100, size) {
+		if seen[mark] || mark < 0x100 || mark >= 0x100+size {
+			t.Fatalf("expected every mark in range once. have %#x twice or out of range", mark)
+		}
+		seen[mark] = true
+	}
+}
+
+func TestValidateECMPFwmarkBase(t *testing.T) {
+	for _, base := range []int{DefaultECMPFwmarkBase, 0x10000, 0x7000000} {
+		if err := ValidateECMPFwmarkBase(base); err != nil {
+			t.Fatalf("expected %#x to be valid. %v", base, err)
+		}
+	}
+	for _, base := range []int{0, 0x4000, 0x100800, SteeringFwmarkBase} {
+		if err := ValidateECMPFwmarkBase(base); err == nil {
+			t.Fatalf("expected %#x to be invalid", base)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package types
+
+import "fmt"
+
+// validateFlowExport makes sure that ports exporting flows keep the
+// connection tracking entries the flows are sampled from
+func (c *ClusterConfig) validateFlowExport() error {
+	for _, config := range []map[ServiceIP]PortMap{c.Config, c.Config6} {
+		for vip, ports := range config {
+			for port, def := range ports {
+				if def != nil && def.FlowExport && def.NoTrack {
+					return fmt.Errorf("%s:%s can't both export flows and bypass connection tracking", vip, port)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package types
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// The severities of lint findings, from the most severe
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+	LintInfo    = "info"
+)
+
+// LintSeverities ranks the severities of lint findings, higher being more severe
+var LintSeverities = map[string]int{LintInfo: 0, LintWarning: 1, LintError: 2}
+
+// LintFinding is a suspicious pattern in a cluster config. VIP and Port are
+// empty for findings about the config as a whole.
+type LintFinding struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	VIP      string `json:"vip,omitempty"`
+	Port     string `json:"port,omitempty"`
+	Message  string `json:"message"`
+}
+
+// LintOptions is what the linter knows beyond the config. Checks that need
+// what is missing are skipped.
+type LintOptions struct {
+	// BGPPrefixes are the prefixes the directors announce, that every VIP must
+	// fall in
+	BGPPrefixes []*net.IPNet
+	// Endpoints are the endpoints of the services, by namespace/name
+	Endpoints map[string]*v1.Endpoints
+}
+
+// Lint looks for patterns in config, as parsed and before it is expanded, that
+// are valid but likely mistakes, along with any validation error. Findings are
+// sorted by VIP, port and check.
+func Lint(config *ClusterConfig, opts LintOptions) []LintFinding {
+	findings := []LintFinding{}
+	add := func(severity, check string, vip ServiceIP, port, format string, args ...interface{}) {
+		findings = append(findings, LintFinding{Severity: severity, Check: check, VIP: string(vip), Port: port, Message: fmt.Sprintf(format, args...)})
+	}
+
+	expanded := config.DeepCopy()
+	if expanded.DualStack {
+		expanded.expandDualStack()
+	}
+	if err := expanded.Validate(); err != nil {
+		add(LintError, "invalid", "", "", "%v", err)
+	}
+
+	// a mapping to an address that isn't IPv6 is skipped
+	for vip, v6 := range config.IPV6 {
+		if ip := net.ParseIP(v6); ip == nil || ip.To4() != nil {
+			add(LintWarning, "ipv6-address", vip, "", "%q in the ipv6 map is not an IPv6 address, and is skipped", v6)
+		}
+	}
+
+	// an explicit v6 port replaces the one a dual-stack v4 port would add
+	for vip, ports := range config.Config {
+		v6, ok := config.IPV6[vip]
+		if !ok || !config.DualStack {
+			continue
+		}
+		for port, def := range ports {
+			if def == nil || !def.IPV6Enabled {
+				continue
+			}
+			if _, ok := config.Config6[ServiceIP(v6)][port]; ok {
+				add(LintWarning, "shadowed-port", vip, port, "ipv6Enabled is shadowed by the port of %s in config6, which is served in its place", v6)
+			}
+		}
+	}
+
+	// a steering rule whose sources an earlier rule covers never applies
+	for vip, ports := range config.Config {
+		for port, def := range ports {
+			if def == nil {
+				continue
+			}
+			for n, s := range def.Steering {
+				for m := 0; m < n; m++ {
+					if coversSources(def.Steering[m].Sources, s.Sources) {
+						add(LintWarning, "shadowed-steering", vip, port, "steering rule %d never applies, as rule %d matches every source it does", n, m)
+						break
+					}
+				}
+			}
+		}
+	}
+
+	lintMTU(expanded, add)
+
+	if len(opts.BGPPrefixes) > 0 {
+		for _, c := range []map[ServiceIP]PortMap{config.Config, config.Config6} {
+			for vip := range c {
+				if !inPrefixes(string(vip), opts.BGPPrefixes) {
+					add(LintError, "bgp-prefix", vip, "", "the VIP is outside every announced bgp prefix, so it is unreachable when advertised with bgp")
+				}
+			}
+		}
+	}
+
+	if opts.Endpoints != nil {
+		for _, c := range []map[ServiceIP]PortMap{expanded.Config, expanded.Config6} {
+			for vip, ports := range c {
+				for port, def := range ports {
+					if def == nil || def.Translated() || def.TProxied() {
+						continue
+					}
+					key := def.Namespace + "/" + def.Service
+					switch backends := endpointNodes(opts.Endpoints[key], def.PortName); backends {
+					case 0:
+						add(LintWarning, "no-backend", vip, port, "service %s has no ready endpoints for port %q", key, def.PortName)
+					case 1:
+						add(LintWarning, "single-backend", vip, port, "service %s is served by a single node, so the VIP port is down whenever that node is", key)
+					}
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(findings, func(n, m int) bool {
+		a, b := findings[n], findings[m]
+		if a.VIP != b.VIP {
+			return a.VIP < b.VIP
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return a.Check < b.Check
+	})
+	return findings
+}
+
+// lintMTU checks that MTUs are numbers within what interfaces take, that they
+// are set for VIPs of the config, and that both families of a dual-stack VIP
+// have the same one
+func lintMTU(config *ClusterConfig, add func(severity, check string, vip ServiceIP, port, format string, args ...interface{})) {
+	for _, c := range []struct {
+		mtus     map[ServiceIP]string
+		config   map[ServiceIP]PortMap
+		min      int
+		mtuField string
+	}{
+		{config.MTUConfig, config.Config, 576, "mtuConfig"},
+		{config.MTUConfig6, config.Config6, 1280, "mtuConfig6"},
+	} {
+		for vip, value := range c.mtus {
+			mtu, err := strconv.Atoi(value)
+			if err != nil {
+				add(LintError, "mtu-invalid", vip, "", "%s %q is not a number", c.mtuField, value)
+				continue
+			}
+			if mtu < c.min || mtu > 9216 {
+				add(LintWarning, "mtu-invalid", vip, "", "%s %d is outside %d-9216", c.mtuField, mtu, c.min)
+			}
+			if _, ok := c.config[vip]; !ok {
+				add(LintWarning, "mtu-unknown-vip", vip, "", "%s is set for a VIP that isn't configured", c.mtuField)
+			}
+		}
+	}
+	for vip, v6 := range config.IPV6 {
+		mtu4, ok4 := config.MTUConfig[vip]
+		mtu6, ok6 := config.MTUConfig6[ServiceIP(v6)]
+		if (ok4 || ok6) && mtu4 != mtu6 {
+			add(LintWarning, "mtu-mismatch", vip, "", "the MTU of the VIP, %q, differs from that of its ipv6 pair %s, %q", mtu4, v6, mtu6)
+		}
+	}
+}
+
+// coversSources returns true when every CIDR of sources is within a CIDR of covering
+func coversSources(covering, sources []string) bool {
+	nets := []*net.IPNet{}
+	for _, source := range covering {
+		if _, n, err := net.ParseCIDR(source); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	for _, source := range sources {
+		_, n, err := net.ParseCIDR(source)
+		if err != nil {
+			return false
+		}
+		ones, _ := n.Mask.Size()
+		covered := false
+		for _, c := range nets {
+			if cones, _ := c.Mask.Size(); cones <= ones && c.Contains(n.IP) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return len(sources) > 0
+}
+
+// inPrefixes returns true when vip is within one of prefixes
+func inPrefixes(vip string, prefixes []*net.IPNet) bool {
+	ip := net.ParseIP(vip)
+	for _, p := range prefixes {
+		if ip != nil && p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointNodes returns the number of nodes with a ready endpoint of the port
+// named portName, counting endpoints without a node as nodes of their own
+func endpointNodes(endpoints *v1.Endpoints, portName string) int {
+	if endpoints == nil {
+		return 0
+	}
+	nodes := map[string]bool{}
+	for _, subset := range endpoints.Subsets {
+		served := false
+		for _, p := range subset.Ports {
+			if p.Name == portName {
+				served = true
+			}
+		}
+		if !served {
+			continue
+		}
+		for _, address := range subset.Addresses {
+			if address.NodeName != nil {
+				nodes[*address.NodeName] = true
+			} else {
+				nodes[address.IP] = true
+			}
+		}
+	}
+	return len(nodes)
+}
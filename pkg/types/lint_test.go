@@ -0,0 +1,73 @@
+package types
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLint(t *testing.T) {
+	config, err := ParseClusterConfig([]byte(`{
+        "config": {
+            "10.54.213.147": {
+                "80": {"namespace": "syseng", "service": "web", "portName": "http", "tcpEnabled": true, "ipv6Enabled": true,
+                       "steering": [{"sources": ["10.0.0.0/8"], "nodeLabels": {"pool": "a"}},
+                                    {"sources": ["10.1.0.0/16"], "nodeLabels": {"pool": "b"}}]},
+                "443": {"namespace": "syseng", "service": "api", "portName": "https", "tcpEnabled": true}
+            },
+            "192.0.2.10": {
+                "80": {"namespace": "syseng", "service": "web", "portName": "http", "tcpEnabled": true}
+            }
+        },
+        "config6": {
+            "2001:db8::7": {
+                "80": {"namespace": "syseng", "service": "web", "portName": "http", "tcpEnabled": true}
+            }
+        },
+        "dualStack": true,
+        "ipv6": {"10.54.213.147": "2001:db8::7"},
+        "mtuConfig": {"10.54.213.147": "9000", "10.54.213.200": "1500"},
+        "mtuConfig6": {"2001:db8::7": "1500"}
+    }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := func(name string) *string { return &name }
+	_, prefix, _ := net.ParseCIDR("10.54.213.0/24")
+	_, prefix6, _ := net.ParseCIDR("2001:db8::/64")
+	findings := Lint(config, LintOptions{
+		BGPPrefixes: []*net.IPNet{prefix, prefix6},
+		Endpoints: map[string]*v1.Endpoints{
+			"syseng/web": {
+				ObjectMeta: metav1.ObjectMeta{Namespace: "syseng", Name: "web"},
+				Subsets: []v1.EndpointSubset{{
+					Addresses: []v1.EndpointAddress{{IP: "100.64.0.1", NodeName: node("a")}, {IP: "100.64.0.2", NodeName: node("a")}},
+					Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+				}},
+			},
+		},
+	})
+
+	checks := []string{}
+	for _, f := range findings {
+		checks = append(checks, f.VIP+":"+f.Port+" "+f.Severity+" "+f.Check)
+	}
+	expected := []string{
+		"10.54.213.147: warning mtu-mismatch",
+		"10.54.213.147:443 warning no-backend",
+		"10.54.213.147:80 warning shadowed-port",
+		"10.54.213.147:80 warning shadowed-steering",
+		"10.54.213.147:80 warning single-backend",
+		"10.54.213.200: warning mtu-unknown-vip",
+		"192.0.2.10: error bgp-prefix",
+		"192.0.2.10:80 warning single-backend",
+		"2001:db8::7:80 warning single-backend",
+	}
+	if !reflect.DeepEqual(checks, expected) {
+		t.Fatalf("expected findings\n%v\nhave\n%v", expected, checks)
+	}
+}
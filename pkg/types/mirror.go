@@ -0,0 +1,93 @@
+package types
+
+import (
+	"fmt"
+	"net"
+)
+
+// Mirror copies a sample of the connections to a VIP port to a shadow
+// backend, i.e. to test a new version of a service with production traffic.
+// The directors duplicate the packets of the sampled connections, as they
+// arrive, to Gateway. The original packets are load balanced as usual, and
+// the replies of the shadow backend are its own to discard.
+type Mirror struct {
+	// Gateway is the address the copies are sent to, on a network the
+	// directors are attached to. It must accept traffic to the VIP, as a
+	// realserver does, to serve the copies.
+	Gateway string `json:"gateway"`
+
+	// Percent is the share of new connections that are mirrored, 100 when
+	// unset. Sampling follows connections through connection tracking, so a
+	// sampled port can't bypass it with noTrack.
+	Percent int `json:"percent,omitempty"`
+}
+
+// Sampled reports whether only some of the connections are mirrored
+func (m *Mirror) Sampled() bool {
+	return m.Percent > 0 && m.Percent < 100
+}
+
+// Mirrored reports whether traffic to the port is mirrored
+func (s *ServiceDef) Mirrored() bool {
+	return s != nil && s.Mirror != nil
+}
+
+// HasMirror reports whether any VIP port of the config, of the v6 VIPs when v6
+// is set, is mirrored
+func (c *ClusterConfig) HasMirror(v6 bool) bool {
+	if c == nil {
+		return false
+	}
+	config := c.Config
+	if v6 {
+		config = c.Config6
+	}
+	for _, ports := range config {
+		for _, def := range ports {
+			if def.Mirrored() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func copyMirror(in *Mirror) *Mirror {
+	if in == nil {
+		return nil
+	}
+	m := *in
+	return &m
+}
+
+// validateMirrors makes sure every mirror has a gateway of its VIP's family
+// and a percent of connections to sample
+func (c *ClusterConfig) validateMirrors() error {
+	for _, config := range []map[ServiceIP]PortMap{c.Config, c.Config6} {
+		for vip, ports := range config {
+			for port, def := range ports {
+				if !def.Mirrored() {
+					continue
+				}
+				m := def.Mirror
+				gateway := net.ParseIP(m.Gateway)
+				if gateway == nil {
+					return fmt.Errorf("mirror gateway %q for %s:%s is not an ip address", m.Gateway, vip, port)
+				}
+				if ip := net.ParseIP(string(vip)); ip != nil && (ip.To4() == nil) != (gateway.To4() == nil) {
+					return fmt.Errorf("mirror gateway %s for %s:%s is not of the VIP's family", m.Gateway, vip, port)
+				}
+				if m.Percent < 0 || m.Percent > 100 {
+					return fmt.Errorf("mirror percent %d for %s:%s must be between 0 and 100", m.Percent, vip, port)
+				}
+				if m.Sampled() && def.NoTrack {
+					return fmt.Errorf("%s:%s can't both sample mirrored connections and bypass connection tracking", vip, port)
+				}
+				if def.TProxied() {
+					return fmt.Errorf("%s:%s can't be both transparently proxied and mirrored", vip, port)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// NamedPort reports whether a VIP port of the config names a port of its
+// kubernetes service instead of numbering it. The watcher replaces named ports
+// with the number the service gives them, so that renumbering the port in the
+// app doesn't need an edit of the cluster config.
+func NamedPort(port string) bool {
+	_, err := strconv.Atoi(port)
+	return err != nil
+}
+
+// validatePorts makes sure every VIP port is a port number or a name a
+// kubernetes service port could have
+func (c *ClusterConfig) validatePorts() error {
+	for _, config := range []map[ServiceIP]PortMap{c.Config, c.Config6} {
+		for vip, ports := range config {
+			for port := range ports {
+				if !NamedPort(port) {
+					if p, _ := strconv.Atoi(port); p < 1 || p > 65535 {
+						return fmt.Errorf("port %s of %s must be between 1 and 65535", port, vip)
+					}
+					continue
+				}
+				if errs := validation.IsDNS1123Label(port); len(errs) > 0 {
+					return fmt.Errorf("port %q of %s is neither a number nor a service port name. %s", port, vip, errs[0])
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -74,7 +74,11 @@ func NodeEqual(a, b *v1.Node) bool {
 // 	return n
 // }
 
+// IPV4 returns the v4 address of the node, preferring an internal address
 func IPV4(n *v1.Node) string {
+	if ip := internalIP(n, false); ip != "" {
+		return ip
+	}
 	for _, addr := range n.Status.Addresses {
 		i := net.ParseIP(addr.Address)
 		if i.To4() != nil {
@@ -84,10 +88,27 @@ func IPV4(n *v1.Node) string {
 	return ""
 }
 
+// IPV6 returns the v6 address of the node. The address label is preferred; nodes
+// without it, such as those in clusters with no IPv4 at all, use their first v6
+// internal address.
 func IPV6(n *v1.Node) string {
 	if v6Addr, ok := n.Labels[v6AddrLabelKey]; ok {
 		return strings.Replace(v6Addr, "-", ":", -1)
 	}
+	return internalIP(n, true)
+}
+
+// internalIP returns the first internal address of the node in the v4 or v6
+// family, or an empty string when it has none
+func internalIP(n *v1.Node, v6 bool) string {
+	for _, addr := range n.Status.Addresses {
+		if addr.Type != v1.NodeInternalIP {
+			continue
+		}
+		if i := net.ParseIP(addr.Address); i != nil && (i.To4() == nil) == v6 {
+			return i.String()
+		}
+	}
 	return ""
 }
 
@@ -104,6 +125,15 @@ func IsEligibleBackend(n *v1.Node, labels map[string]string, ip string, ignoreCo
 		return false, fmt.Sprintf("node %s does not have an IP address", n.Name)
 	}
 
+	// a backend must have an address in the family of the service, so that
+	// dual-stack services send each family to addresses of that family
+	if v6 && IPV6(n) == "" {
+		return false, fmt.Sprintf("node %s does not have an IPv6 address", n.Name)
+	}
+	if !v6 && IPV4(n) == "" {
+		return false, fmt.Sprintf("node %s does not have an IPv4 address", n.Name)
+	}
+
 	if IsUnschedulable(n) && !ignoreCordon {
 		return false, fmt.Sprintf("node %s has unschedulable taint set.", n.Name)
 	}
@@ -119,6 +149,9 @@ func IsEligibleBackend(n *v1.Node, labels map[string]string, ip string, ignoreCo
 		if !v6 && IPV4(n) == ip {
 			return false, fmt.Sprintf("node %s matches ip address %s",IPV4(n), ip)
 		}
+		if v6 && IPV6(n) == ip {
+			return false, fmt.Sprintf("node %s matches ip address %s", IPV6(n), ip)
+		}
 	}
 
 	return true, fmt.Sprintf("node %s is eligible", n.Name)
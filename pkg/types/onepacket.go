@@ -0,0 +1,29 @@
+package types
+
+import (
+	"fmt"
+)
+
+// UDPArgs returns the ipvsadm arguments that only apply to the UDP virtual
+// service of a port. ipvsadm -Sn prints them after those of PersistenceArgs.
+func (i *IPVSOptions) UDPArgs() string {
+	if i.OnePacket {
+		return " -o"
+	}
+	return ""
+}
+
+// validateOnePacket makes sure one packet scheduling is only set on ports that
+// serve UDP
+func (c *ClusterConfig) validateOnePacket() error {
+	for _, config := range []map[ServiceIP]PortMap{c.Config, c.Config6} {
+		for vip, ports := range config {
+			for port, def := range ports {
+				if def != nil && def.IPVSOptions.OnePacket && !def.UDPEnabled {
+					return fmt.Errorf("one packet scheduling for %s:%s needs udpEnabled", vip, port)
+				}
+			}
+		}
+	}
+	return nil
+}
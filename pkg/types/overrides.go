@@ -0,0 +1,161 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Overrides are changes made to the cluster config of a single node by an
+// operator, through the control API, rather than by editing the configmap.
+// Withdrawn VIPs are taken off the node entirely, maintenance replaces what
+// the configmap sets for a VIP, and drained nodes are treated as if they
+// carried the DrainAnnotation. Overrides live in memory and are lost
+// when the process restarts.
+type Overrides struct {
+	sync.Mutex
+
+	withdrawn   map[ServiceIP]bool
+	maintenance map[ServiceIP]Maintenance
+	drained     map[string]bool
+}
+
+// OverrideState is a copy of the overrides in effect
+type OverrideState struct {
+	Withdrawn   []string                  `json:"withdrawn"`
+	Maintenance map[ServiceIP]Maintenance `json:"maintenance"`
+	Drained     []string                  `json:"drained"`
+}
+
+// NewOverrides creates an empty set of overrides
+func NewOverrides() *Overrides {
+	return &Overrides{
+		withdrawn:   map[ServiceIP]bool{},
+		maintenance: map[ServiceIP]Maintenance{},
+		drained:     map[string]bool{},
+	}
+}
+
+// Withdraw takes vip off the node until it is advertised again
+func (o *Overrides) Withdraw(vip ServiceIP) {
+	o.Lock()
+	defer o.Unlock()
+	o.withdrawn[vip] = true
+}
+
+// Advertise undoes the withdrawal of vip, returning false when it wasn't withdrawn
+func (o *Overrides) Advertise(vip ServiceIP) bool {
+	o.Lock()
+	defer o.Unlock()
+	withdrawn := o.withdrawn[vip]
+	delete(o.withdrawn, vip)
+	return withdrawn
+}
+
+// SetMaintenance puts vip in maintenance as m, or, when m is nil, removes the
+// override so that the configmap decides again
+func (o *Overrides) SetMaintenance(vip ServiceIP, m *Maintenance) error {
+	o.Lock()
+	defer o.Unlock()
+	if m == nil {
+		delete(o.maintenance, vip)
+		return nil
+	}
+	switch m.Action {
+	case "", MaintenanceReject, MaintenanceDrop:
+	default:
+		return fmt.Errorf("maintenance action %q for %s must be %s or %s", m.Action, vip, MaintenanceReject, MaintenanceDrop)
+	}
+	o.maintenance[vip] = *m
+	return nil
+}
+
+// Drain drains the node named node, as the DrainAnnotation does, until it is
+// undrained
+func (o *Overrides) Drain(node string) {
+	o.Lock()
+	defer o.Unlock()
+	o.drained[node] = true
+}
+
+// Undrain undoes Drain, returning false when the node wasn't drained
+func (o *Overrides) Undrain(node string) bool {
+	o.Lock()
+	defer o.Unlock()
+	drained := o.drained[node]
+	delete(o.drained, node)
+	return drained
+}
+
+// State returns a copy of the overrides in effect
+func (o *Overrides) State() OverrideState {
+	o.Lock()
+	defer o.Unlock()
+	s := OverrideState{Withdrawn: []string{}, Maintenance: map[ServiceIP]Maintenance{}, Drained: []string{}}
+	for vip := range o.withdrawn {
+		s.Withdrawn = append(s.Withdrawn, string(vip))
+	}
+	sort.Strings(s.Withdrawn)
+	for vip, m := range o.maintenance {
+		s.Maintenance[vip] = m
+	}
+	for node := range o.drained {
+		s.Drained = append(s.Drained, node)
+	}
+	sort.Strings(s.Drained)
+	return s
+}
+
+// Apply returns config with the overrides made. config is returned as it is
+// when there are none, and copied otherwise. A nil Overrides has none.
+func (o *Overrides) Apply(config *ClusterConfig) *ClusterConfig {
+	if o == nil || config == nil {
+		return config
+	}
+	o.Lock()
+	defer o.Unlock()
+	if len(o.withdrawn) == 0 && len(o.maintenance) == 0 {
+		return config
+	}
+
+	out := config.DeepCopy()
+	for vip := range o.withdrawn {
+		delete(out.Config, vip)
+		delete(out.Config6, vip)
+	}
+	if len(o.maintenance) > 0 && out.Maintenance == nil {
+		out.Maintenance = map[ServiceIP]Maintenance{}
+	}
+	for vip, m := range o.maintenance {
+		out.Maintenance[vip] = m
+	}
+	return out
+}
+
+// ApplyNodes returns nodes with the drained ones annotated with the
+// DrainAnnotation. The nodes that are annotated are copied first.
+func (o *Overrides) ApplyNodes(nodes []*v1.Node) []*v1.Node {
+	if o == nil || nodes == nil {
+		return nodes
+	}
+	o.Lock()
+	defer o.Unlock()
+	if len(o.drained) == 0 {
+		return nodes
+	}
+
+	out := make([]*v1.Node, 0, len(nodes))
+	for _, n := range nodes {
+		if o.drained[n.Name] && n.Annotations[DrainAnnotation] != "true" {
+			n = n.DeepCopy()
+			if n.Annotations == nil {
+				n.Annotations = map[string]string{}
+			}
+			n.Annotations[DrainAnnotation] = "true"
+		}
+		out = append(out, n)
+	}
+	return out
+}
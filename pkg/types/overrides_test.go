@@ -0,0 +1,70 @@
+package types
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestOverrides(t *testing.T) {
+	config := &ClusterConfig{
+		Generation: 3,
+		Config: map[ServiceIP]PortMap{
+			"10.54.213.165": {"80": &ServiceDef{Service: "web", TCPEnabled: true}},
+			"10.54.213.166": {"80": &ServiceDef{Service: "api", TCPEnabled: true}},
+		},
+	}
+
+	var none *Overrides
+	if none.Apply(config) != config {
+		t.Fatal("expected a nil Overrides to leave the config as it is")
+	}
+	o := NewOverrides()
+	if o.Apply(config) != config {
+		t.Fatal("expected no overrides to leave the config as it is")
+	}
+
+	o.Withdraw("10.54.213.165")
+	if err := o.SetMaintenance("10.54.213.166", &Maintenance{Action: MaintenanceReject}); err != nil {
+		t.Fatal(err)
+	}
+	out := o.Apply(config)
+	if _, ok := out.Config["10.54.213.165"]; ok {
+		t.Fatal("expected the withdrawn VIP to be removed")
+	}
+	if m, ok := out.InMaintenance("10.54.213.166"); !ok || m.Action != MaintenanceReject {
+		t.Fatalf("expected the VIP to be in maintenance. have %+v", out.Maintenance)
+	}
+	if out.Generation != 3 || len(config.Config) != 2 || config.Maintenance != nil {
+		t.Fatal("expected the config to be copied, keeping its generation")
+	}
+
+	if !o.Advertise("10.54.213.165") || o.Advertise("10.54.213.165") {
+		t.Fatal("expected only a withdrawn VIP to be advertised again")
+	}
+	o.SetMaintenance("10.54.213.166", nil)
+	if o.Apply(config) != config {
+		t.Fatal("expected the overrides to be cleared")
+	}
+}
+
+func TestOverridesDrain(t *testing.T) {
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-b"}},
+	}
+	o := NewOverrides()
+	o.Drain("node-b")
+
+	out := o.ApplyNodes(nodes)
+	if IsDraining(out[0]) || !IsDraining(out[1]) {
+		t.Fatal("expected only the drained node to be draining")
+	}
+	if IsDraining(nodes[1]) {
+		t.Fatal("expected the drained node to be copied rather than annotated in place")
+	}
+	if !o.Undrain("node-b") || IsDraining(o.ApplyNodes(nodes)[1]) {
+		t.Fatal("expected the node to be undrained")
+	}
+}
@@ -0,0 +1,56 @@
+package types
+
+import (
+	"fmt"
+	"net"
+)
+
+// PersistenceArgs returns the ipvsadm arguments that make a virtual service
+// persistent, in the order ipvsadm -Sn prints them, or an empty string when
+// persistence is disabled. v6 selects the prefix length of IPv6 clients.
+func (i *IPVSOptions) PersistenceArgs(v6 bool) string {
+	if i.Persistence <= 0 {
+		return ""
+	}
+	args := fmt.Sprintf(" -p %d", i.Persistence)
+	if v6 {
+		// ipvsadm takes and prints the v6 granularity as a prefix length
+		if i.PersistencePrefix6 > 0 && i.PersistencePrefix6 < 128 {
+			args += fmt.Sprintf(" -M %d", i.PersistencePrefix6)
+		}
+		return args
+	}
+	// and the v4 one as a netmask
+	if i.PersistencePrefix > 0 && i.PersistencePrefix < 32 {
+		args += " -M " + net.IP(net.CIDRMask(i.PersistencePrefix, 32)).String()
+	}
+	return args
+}
+
+// validatePersistence makes sure persistence timeouts are positive and that
+// client prefixes are only set, within their family's range, on persistent ports
+func (c *ClusterConfig) validatePersistence() error {
+	for _, config := range []map[ServiceIP]PortMap{c.Config, c.Config6} {
+		for vip, ports := range config {
+			for port, def := range ports {
+				if def == nil {
+					continue
+				}
+				o := def.IPVSOptions
+				if o.Persistence < 0 {
+					return fmt.Errorf("persistence for %s:%s must not be negative", vip, port)
+				}
+				if o.PersistencePrefix < 0 || o.PersistencePrefix > 32 {
+					return fmt.Errorf("persistence prefix %d for %s:%s must be between 1 and 32", o.PersistencePrefix, vip, port)
+				}
+				if o.PersistencePrefix6 < 0 || o.PersistencePrefix6 > 128 {
+					return fmt.Errorf("persistence prefix6 %d for %s:%s must be between 1 and 128", o.PersistencePrefix6, vip, port)
+				}
+				if o.Persistence == 0 && (o.PersistencePrefix != 0 || o.PersistencePrefix6 != 0) {
+					return fmt.Errorf("persistence prefixes for %s:%s need a persistence timeout", vip, port)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package types
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// PortRewrite changes the port that realservers DNAT a VIP port's traffic to,
+// which is otherwise the port the endpoints give PortName. The pods of each
+// backend set, picked by label, can be sent to a port of their own, i.e. to
+// move VIP:443 from a pod's 443 to its 8443 one deployment at a time.
+type PortRewrite struct {
+	// TargetPortName names the port of the endpoints to send the traffic to,
+	// and TargetPort is the port number to send it to instead. At most one
+	// is set. When neither is, pods matching none of Backends keep PortName.
+	TargetPortName string `json:"targetPortName,omitempty"`
+	TargetPort     int    `json:"targetPort,omitempty"`
+
+	// Backends rewrite the port of the pods matching their selector, in
+	// order of the first that matches
+	Backends []BackendPortRewrite `json:"backends,omitempty"`
+}
+
+// BackendPortRewrite is the port the pods matching Selector are sent to
+type BackendPortRewrite struct {
+	Selector       map[string]string `json:"selector"`
+	TargetPortName string            `json:"targetPortName,omitempty"`
+	TargetPort     int               `json:"targetPort,omitempty"`
+}
+
+// Target returns the name or number of the port that a pod with podLabels is
+// sent to. Both are empty when the pod keeps the port of the VIP port's
+// PortName.
+func (r *PortRewrite) Target(podLabels map[string]string) (string, int) {
+	if r == nil {
+		return "", 0
+	}
+	for _, b := range r.Backends {
+		if labels.SelectorFromSet(b.Selector).Matches(labels.Set(podLabels)) {
+			return b.TargetPortName, b.TargetPort
+		}
+	}
+	return r.TargetPortName, r.TargetPort
+}
+
+// TargetPortNames returns every port name the rewrite sends pods to
+func (r *PortRewrite) TargetPortNames() []string {
+	if r == nil {
+		return nil
+	}
+	out := []string{}
+	if r.TargetPortName != "" {
+		out = append(out, r.TargetPortName)
+	}
+	for _, b := range r.Backends {
+		if b.TargetPortName != "" {
+			out = append(out, b.TargetPortName)
+		}
+	}
+	return out
+}
+
+func copyPortRewrite(in *PortRewrite) *PortRewrite {
+	if in == nil {
+		return nil
+	}
+	r := *in
+	if in.Backends != nil {
+		r.Backends = make([]BackendPortRewrite, len(in.Backends))
+		for n, b := range in.Backends {
+			selector := make(map[string]string, len(b.Selector))
+			for k, v := range b.Selector {
+				selector[k] = v
+			}
+			b.Selector = selector
+			r.Backends[n] = b
+		}
+	}
+	return &r
+}
+
+// validatePortRewrites makes sure every rewrite names a single target, and
+// that backend sets are picked by a selector. Rewrites only apply to the v4
+// VIP ports, which realservers NAT.
+func (c *ClusterConfig) validatePortRewrites() error {
+	for vip, ports := range c.Config {
+		for port, def := range ports {
+			if def == nil || def.PortRewrite == nil {
+				continue
+			}
+			r := def.PortRewrite
+			if err := validatePortTarget(r.TargetPortName, r.TargetPort); err != nil {
+				return fmt.Errorf("port rewrite of %s:%s %v", vip, port, err)
+			}
+			for n, b := range r.Backends {
+				if len(b.Selector) == 0 {
+					return fmt.Errorf("port rewrite backend %d of %s:%s has no selector", n, vip, port)
+				}
+				if b.TargetPortName == "" && b.TargetPort == 0 {
+					return fmt.Errorf("port rewrite backend %d of %s:%s has no target port", n, vip, port)
+				}
+				if err := validatePortTarget(b.TargetPortName, b.TargetPort); err != nil {
+					return fmt.Errorf("port rewrite backend %d of %s:%s %v", n, vip, port, err)
+				}
+			}
+			if def.Translated() || def.TProxied() {
+				return fmt.Errorf("%s:%s doesn't reach the realservers, so its port can't be rewritten", vip, port)
+			}
+		}
+	}
+	for vip, ports := range c.Config6 {
+		for port, def := range ports {
+			if def != nil && def.PortRewrite != nil {
+				return fmt.Errorf("port rewrite of %s:%s is not available for v6 VIPs", vip, port)
+			}
+		}
+	}
+	return nil
+}
+
+func validatePortTarget(name string, port int) error {
+	if name != "" && port != 0 {
+		return fmt.Errorf("sets both targetPortName and targetPort")
+	}
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("targetPort %d must be between 1 and 65535", port)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package types
+
+const (
+	// RoleLabel is set to RoleDirectorActive on the node of the active director
+	// by directors that label their nodes, so that monitoring, disruption
+	// budgets and scheduling constraints can find it
+	RoleLabel          = "ravel.comcast.com/role"
+	RoleDirectorActive = "director-active"
+
+	// ActiveSinceAnnotation is the time the director on a node labeled with
+	// RoleLabel became active, in RFC 3339
+	ActiveSinceAnnotation = "ravel.comcast.com/director-active-since"
+)
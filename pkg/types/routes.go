@@ -0,0 +1,70 @@
+package types
+
+import (
+	"fmt"
+	"net"
+)
+
+// ReturnRoute sends the replies of a VIP out of one interface of a
+// multi-homed node, rather than the one the main routing table picks. A
+// policy routing rule looks up the packets sourced from the VIP in Table,
+// whose default route leaves through Interface, via Gateway when it is set.
+// VIPs of a family that share a table must share its route.
+type ReturnRoute struct {
+	Interface string `json:"interface"`
+	Gateway   string `json:"gateway,omitempty"`
+	Table     int    `json:"table"`
+}
+
+// the routing tables the kernel reserves: unspec, default, main and local
+var reservedTables = map[int]bool{0: true, 253: true, 254: true, 255: true}
+
+// ReturnRoutes returns the return routes of the v4 VIPs of the config, or of
+// the v6 VIPs when v6 is set
+func (c *ClusterConfig) ReturnRoutes(v6 bool) map[ServiceIP]ReturnRoute {
+	out := map[ServiceIP]ReturnRoute{}
+	if c == nil {
+		return out
+	}
+	for vip, r := range c.Routes {
+		if ip := net.ParseIP(string(vip)); ip != nil && (ip.To4() == nil) == v6 {
+			out[vip] = r
+		}
+	}
+	return out
+}
+
+// validateRoutes makes sure every return route names an interface, a table
+// the kernel doesn't reserve and a gateway of the family of its VIP, and that
+// the VIPs sharing a table agree on its route
+func (c *ClusterConfig) validateRoutes() error {
+	type familyTable struct {
+		v6    bool
+		table int
+	}
+	tables := map[familyTable]ReturnRoute{}
+	for vip, r := range c.Routes {
+		ip := net.ParseIP(string(vip))
+		if ip == nil {
+			return fmt.Errorf("route vip %q is not an ip address", vip)
+		}
+		v6 := ip.To4() == nil
+		if r.Interface == "" {
+			return fmt.Errorf("route of %s has no interface", vip)
+		}
+		if r.Table < 1 || reservedTables[r.Table] {
+			return fmt.Errorf("route table %d of %s must be positive and not one of the reserved tables 253, 254 and 255", r.Table, vip)
+		}
+		if r.Gateway != "" {
+			if gw := net.ParseIP(r.Gateway); gw == nil || (gw.To4() == nil) != v6 {
+				return fmt.Errorf("route gateway %q of %s is not an address of the family of the VIP", r.Gateway, vip)
+			}
+		}
+		key := familyTable{v6, r.Table}
+		if other, ok := tables[key]; ok && other != r {
+			return fmt.Errorf("route of %s shares table %d with a VIP that routes through %s %s", vip, r.Table, other.Interface, other.Gateway)
+		}
+		tables[key] = r
+	}
+	return nil
+}
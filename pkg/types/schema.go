@@ -0,0 +1,486 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// cluster config schema versions. A config without an apiVersion is v1.
+const (
+	APIVersionV1 = "v1"
+	APIVersionV2 = "v2"
+)
+
+// ClusterConfigV2 is the v2 schema of the cluster config. The settings of the
+// whole cluster are those of v1, but services are a list of typed entries
+// instead of maps of string ports to ServiceDefs, and each names its own
+// scheduler, persistence and flags. Invalid values are refused instead of
+// falling back to defaults as v1 does.
+type ClusterConfigV2 struct {
+	APIVersion string `json:"apiVersion"`
+
+	VIPPool    []string             `json:"vipPool,omitempty"`
+	MTUConfig  map[ServiceIP]string `json:"mtuConfig,omitempty"`
+	MTUConfig6 map[ServiceIP]string `json:"mtuConfig6,omitempty"`
+	NodeLabels map[string]string    `json:"labels,omitempty"`
+	IPV6       map[ServiceIP]string `json:"ipv6,omitempty"`
+	DualStack  bool                 `json:"dualStack,omitempty"`
+
+	// Services are the VIP ports of both families. A service is IPv6 when
+	// its VIP is.
+	Services []ServiceV2 `json:"services"`
+
+	Announce    map[ServiceIP]string         `json:"announce,omitempty"`
+	Maintenance map[ServiceIP]Maintenance    `json:"maintenance,omitempty"`
+	Defense     map[ServiceIP]Defense        `json:"defense,omitempty"`
+	IPVSDefense *IPVSDefense                 `json:"ipvsDefense,omitempty"`
+	Directors   map[ServiceIP]DirectorPolicy `json:"directors,omitempty"`
+	Sharding    *Sharding                    `json:"sharding,omitempty"`
+	Templates   []ServiceTemplate            `json:"templates,omitempty"`
+	Routes      map[ServiceIP]ReturnRoute    `json:"routes,omitempty"`
+	VRFs        map[string]VRF               `json:"vrfs,omitempty"`
+}
+
+// ServiceV2 is a VIP port and the kubernetes service behind it
+type ServiceV2 struct {
+	VIP  ServiceIP `json:"vip"`
+	Port int       `json:"port,omitempty"`
+	// ServicePort is the name of the port of the kubernetes service whose
+	// number is the VIP port, in place of Port
+	ServicePort string `json:"servicePort,omitempty"`
+
+	Namespace string `json:"namespace"`
+	Service   string `json:"service"`
+	PortName  string `json:"portName"`
+
+	// Protocols are tcp, udp or both
+	Protocols []string `json:"protocols"`
+
+	IPV4 bool `json:"ipv4,omitempty"`
+	// IPV6 also serves the port of a v4 VIP on the v6 VIP the ipv6 map of the
+	// cluster config pairs with it, when the config is dualStack
+	IPV6          bool `json:"ipv6,omitempty"`
+	ProxyProtocol bool `json:"proxyProtocol,omitempty"`
+
+	// Scheduler is the IPVS scheduler and its flags. An empty name, or none,
+	// is wrr.
+	Scheduler *SchedulerV2 `json:"scheduler,omitempty"`
+	// ForwardingMethod is direct, the default, tunnel or masquerade
+	ForwardingMethod string         `json:"forwardingMethod,omitempty"`
+	Persistence      *PersistenceV2 `json:"persistence,omitempty"`
+	Limits           *LimitsV2      `json:"limits,omitempty"`
+	OnePacket        bool           `json:"onePacket,omitempty"`
+
+	NoTrack        bool            `json:"noTrack,omitempty"`
+	Translate      string          `json:"translate,omitempty"`
+	Steering       []Steering      `json:"steering,omitempty"`
+	ACL            *ACL            `json:"acl,omitempty"`
+	TProxyPort     int             `json:"tproxyPort,omitempty"`
+	AdaptiveWeight *AdaptiveWeight `json:"adaptiveWeight,omitempty"`
+	Hairpin        bool            `json:"hairpin,omitempty"`
+	Mirror         *Mirror         `json:"mirror,omitempty"`
+	FlowExport     bool            `json:"flowExport,omitempty"`
+	PortRewrite    *PortRewrite    `json:"portRewrite,omitempty"`
+	BackendPorts   []BackendPort   `json:"backendPorts,omitempty"`
+}
+
+// SchedulerV2 is an IPVS scheduler, i.e. mh, and its flags, i.e. mh-port
+type SchedulerV2 struct {
+	Name  string   `json:"name,omitempty"`
+	Flags []string `json:"flags,omitempty"`
+}
+
+// PersistenceV2 sends a client, or its whole prefix, to the same realserver
+// for Timeout seconds after its last connection
+type PersistenceV2 struct {
+	Timeout int `json:"timeout"`
+	Prefix  int `json:"prefix,omitempty"`
+	Prefix6 int `json:"prefix6,omitempty"`
+}
+
+// LimitsV2 are the connection thresholds of the service, divided across its
+// realservers by weight, see IPVSOptions
+type LimitsV2 struct {
+	Upper int `json:"upper"`
+	Lower int `json:"lower"`
+}
+
+var (
+	schedulersV2 = map[string]bool{"rr": true, "wrr": true, "lc": true, "wlc": true, "dh": true, "sh": true, "mh": true}
+	flagsV2      = map[string]bool{"flag-1": true, "flag-2": true, "flag-3": true, "sh-fallback": true, "sh-port": true, "mh-fallback": true, "mh-port": true}
+
+	forwardingV2 = map[string]string{"": "", "direct": "g", "tunnel": "i", "masquerade": "m"}
+	forwardingV1 = map[string]string{"g": "direct", "i": "tunnel", "m": "masquerade"}
+)
+
+// ParseClusterConfig decodes a cluster config of any schema version into a
+// ClusterConfig. It doesn't validate or expand the config, as NewClusterConfig
+// does.
+func ParseClusterConfig(data []byte) (*ClusterConfig, error) {
+	version := struct {
+		APIVersion string `json:"apiVersion"`
+	}{}
+	if err := json.Unmarshal(data, &version); err != nil {
+		return nil, fmt.Errorf("json unmarshal error. %v", err)
+	}
+
+	switch version.APIVersion {
+	case "", APIVersionV1:
+		clusterConfig := &ClusterConfig{}
+		if err := json.Unmarshal(data, clusterConfig); err != nil {
+			return nil, fmt.Errorf("json unmarshal error. %v", err)
+		}
+		return clusterConfig, nil
+	case APIVersionV2:
+		// v2 is typed, so a misspelled field is an error rather than a default
+		v2 := &ClusterConfigV2{}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(v2); err != nil {
+			return nil, fmt.Errorf("json unmarshal error. %v", err)
+		}
+		return v2.ClusterConfig()
+	default:
+		return nil, fmt.Errorf("apiVersion %q must be %s or %s", version.APIVersion, APIVersionV1, APIVersionV2)
+	}
+}
+
+// ClusterConfig converts the v2 config into the ClusterConfig the rest of
+// ravel works with, refusing the values v1 would have replaced by defaults
+func (c *ClusterConfigV2) ClusterConfig() (*ClusterConfig, error) {
+	out := &ClusterConfig{
+		VIPPool:     c.VIPPool,
+		MTUConfig:   c.MTUConfig,
+		MTUConfig6:  c.MTUConfig6,
+		NodeLabels:  c.NodeLabels,
+		IPV6:        c.IPV6,
+		DualStack:   c.DualStack,
+		Config:      map[ServiceIP]PortMap{},
+		Config6:     map[ServiceIP]PortMap{},
+		Announce:    c.Announce,
+		Maintenance: c.Maintenance,
+		Defense:     c.Defense,
+		IPVSDefense: c.IPVSDefense,
+		Directors:   c.Directors,
+		Sharding:    c.Sharding,
+		Templates:   c.Templates,
+		Routes:      c.Routes,
+		VRFs:        c.VRFs,
+	}
+
+	for n, s := range c.Services {
+		def, err := s.serviceDef()
+		if err != nil {
+			return nil, fmt.Errorf("service %d: %v", n, err)
+		}
+		config := out.Config
+		if net.ParseIP(string(s.VIP)).To4() == nil {
+			config = out.Config6
+		}
+		port := s.port()
+		if _, ok := config[s.VIP][port]; ok {
+			return nil, fmt.Errorf("service %d: %s:%s is defined more than once", n, s.VIP, port)
+		}
+		if config[s.VIP] == nil {
+			config[s.VIP] = PortMap{}
+		}
+		config[s.VIP][port] = def
+	}
+	return out, nil
+}
+
+// port is the key of the service in its VIP's port map
+func (s *ServiceV2) port() string {
+	if s.ServicePort != "" {
+		return s.ServicePort
+	}
+	return strconv.Itoa(s.Port)
+}
+
+func (s *ServiceV2) serviceDef() (*ServiceDef, error) {
+	if net.ParseIP(string(s.VIP)) == nil {
+		return nil, fmt.Errorf("vip %q is not an ip address", s.VIP)
+	}
+	if s.ServicePort != "" {
+		if s.Port != 0 {
+			return nil, fmt.Errorf("%s sets both port and servicePort", s.VIP)
+		}
+		if !NamedPort(s.ServicePort) {
+			return nil, fmt.Errorf("servicePort %q of %s must be a name. numbers go in port", s.ServicePort, s.VIP)
+		}
+	} else if s.Port < 1 || s.Port > 65535 {
+		return nil, fmt.Errorf("port %d of %s must be between 1 and 65535", s.Port, s.VIP)
+	}
+
+	def := &ServiceDef{
+		Namespace:            s.Namespace,
+		Service:              s.Service,
+		PortName:             s.PortName,
+		IPV4Enabled:          s.IPV4,
+		IPV6Enabled:          s.IPV6,
+		ProxyProtocolEnabled: s.ProxyProtocol,
+		NoTrack:              s.NoTrack,
+		Translate:            s.Translate,
+		Steering:             s.Steering,
+		ACL:                  s.ACL,
+		TProxyPort:           s.TProxyPort,
+		AdaptiveWeight:       s.AdaptiveWeight,
+		Hairpin:              s.Hairpin,
+		Mirror:               s.Mirror,
+		FlowExport:           s.FlowExport,
+		PortRewrite:          s.PortRewrite,
+		BackendPorts:         s.BackendPorts,
+	}
+	for _, protocol := range s.Protocols {
+		switch protocol {
+		case "tcp":
+			def.TCPEnabled = true
+		case "udp":
+			def.UDPEnabled = true
+		default:
+			return nil, fmt.Errorf("protocol %q of %s:%s must be tcp or udp", protocol, s.VIP, s.port())
+		}
+	}
+
+	o := &def.IPVSOptions
+	if sc := s.Scheduler; sc != nil {
+		if sc.Name != "" && !schedulersV2[sc.Name] {
+			return nil, fmt.Errorf("scheduler %q of %s:%s is not supported", sc.Name, s.VIP, s.port())
+		}
+		o.RawScheduler = sc.Name
+		for _, flag := range sc.Flags {
+			if !flagsV2[flag] {
+				return nil, fmt.Errorf("scheduler flag %q of %s:%s is not supported", flag, s.VIP, s.port())
+			}
+		}
+		o.Flags = strings.Join(sc.Flags, ",")
+	}
+
+	method, ok := forwardingV2[s.ForwardingMethod]
+	if !ok {
+		return nil, fmt.Errorf("forwarding method %q of %s:%s must be direct, tunnel or masquerade", s.ForwardingMethod, s.VIP, s.port())
+	}
+	o.RawForwardingMethod = method
+
+	if p := s.Persistence; p != nil {
+		if p.Timeout <= 0 {
+			return nil, fmt.Errorf("persistence timeout of %s:%s must be positive", s.VIP, s.port())
+		}
+		o.Persistence, o.PersistencePrefix, o.PersistencePrefix6 = p.Timeout, p.Prefix, p.Prefix6
+	}
+	if l := s.Limits; l != nil {
+		if l.Lower < 0 || l.Upper <= l.Lower {
+			return nil, fmt.Errorf("limits of %s:%s must have a lower limit below the upper one", s.VIP, s.port())
+		}
+		o.RawUThreshold, o.RawLThreshold = l.Upper, l.Lower
+	}
+	o.OnePacket = s.OnePacket
+	return def, nil
+}
+
+// Migrate converts config, of any schema version, to v2. Values v1 replaced by
+// defaults are migrated as their defaults, and returned as warnings. The
+// result is validated, and checked to configure every service as config does.
+func Migrate(config *ClusterConfig) (*ClusterConfigV2, []string, error) {
+	out := &ClusterConfigV2{
+		APIVersion:  APIVersionV2,
+		VIPPool:     config.VIPPool,
+		MTUConfig:   config.MTUConfig,
+		MTUConfig6:  config.MTUConfig6,
+		NodeLabels:  config.NodeLabels,
+		IPV6:        config.IPV6,
+		DualStack:   config.DualStack,
+		Services:    []ServiceV2{},
+		Announce:    config.Announce,
+		Maintenance: config.Maintenance,
+		Defense:     config.Defense,
+		IPVSDefense: config.IPVSDefense,
+		Directors:   config.Directors,
+		Sharding:    config.Sharding,
+		Templates:   config.Templates,
+		Routes:      config.Routes,
+		VRFs:        config.VRFs,
+	}
+	warnings := []string{}
+
+	for _, c := range []map[ServiceIP]PortMap{config.Config, config.Config6} {
+		vips := []string{}
+		for vip := range c {
+			vips = append(vips, string(vip))
+		}
+		sort.Strings(vips)
+		for _, vip := range vips {
+			ports := []int{}
+			named := []string{}
+			for port := range c[ServiceIP(vip)] {
+				if NamedPort(port) {
+					named = append(named, port)
+					continue
+				}
+				p, _ := strconv.Atoi(port)
+				ports = append(ports, p)
+			}
+			sort.Ints(ports)
+			sort.Strings(named)
+			for _, port := range ports {
+				def := c[ServiceIP(vip)][strconv.Itoa(port)]
+				if def == nil {
+					continue
+				}
+				s, w := migrateService(ServiceIP(vip), port, def)
+				out.Services = append(out.Services, s)
+				warnings = append(warnings, w...)
+			}
+			for _, port := range named {
+				def := c[ServiceIP(vip)][port]
+				if def == nil {
+					continue
+				}
+				s, w := migrateService(ServiceIP(vip), 0, def)
+				s.ServicePort = port
+				out.Services = append(out.Services, s)
+				warnings = append(warnings, w...)
+			}
+		}
+	}
+
+	migrated, err := out.ClusterConfig()
+	if err != nil {
+		return nil, warnings, fmt.Errorf("the migrated config is invalid. %v", err)
+	}
+	if err := migrated.Validate(); err != nil {
+		return nil, warnings, fmt.Errorf("the migrated config is invalid. %v", err)
+	}
+	if err := equivalent(config, migrated); err != nil {
+		return nil, warnings, fmt.Errorf("the migrated config differs. %v", err)
+	}
+	return out, warnings, nil
+}
+
+// migrateService converts a v1 service to v2, warning about the values v1
+// replaced by defaults
+func migrateService(vip ServiceIP, port int, def *ServiceDef) (ServiceV2, []string) {
+	warnings := []string{}
+	o := def.IPVSOptions
+	s := ServiceV2{
+		VIP:            vip,
+		Port:           port,
+		Namespace:      def.Namespace,
+		Service:        def.Service,
+		PortName:       def.PortName,
+		Protocols:      []string{},
+		IPV4:           def.IPV4Enabled,
+		IPV6:           def.IPV6Enabled,
+		ProxyProtocol:  def.ProxyProtocolEnabled,
+		OnePacket:      o.OnePacket,
+		NoTrack:        def.NoTrack,
+		Translate:      def.Translate,
+		Steering:       def.Steering,
+		ACL:            def.ACL,
+		TProxyPort:     def.TProxyPort,
+		AdaptiveWeight: def.AdaptiveWeight,
+		Hairpin:        def.Hairpin,
+		Mirror:         def.Mirror,
+		FlowExport:     def.FlowExport,
+		PortRewrite:    def.PortRewrite,
+		BackendPorts:   def.BackendPorts,
+	}
+	if def.TCPEnabled {
+		s.Protocols = append(s.Protocols, "tcp")
+	}
+	if def.UDPEnabled {
+		s.Protocols = append(s.Protocols, "udp")
+	}
+
+	if o.RawScheduler != "" || splitFlags(o.Flags) != nil {
+		s.Scheduler = &SchedulerV2{Flags: splitFlags(o.Flags)}
+		if o.RawScheduler != "" {
+			s.Scheduler.Name = o.Scheduler()
+			if s.Scheduler.Name != strings.TrimSpace(strings.ToLower(o.RawScheduler)) {
+				warnings = append(warnings, fmt.Sprintf("%s:%d: scheduler %q is not supported, migrated as %s", vip, port, o.RawScheduler, s.Scheduler.Name))
+			}
+		}
+	}
+
+	if o.RawForwardingMethod != "" {
+		s.ForwardingMethod = forwardingV1[o.ForwardingMethod()]
+		if o.RawForwardingMethod != o.ForwardingMethod() {
+			warnings = append(warnings, fmt.Sprintf("%s:%d: forwarding method %q is not supported, migrated as %s", vip, port, o.RawForwardingMethod, s.ForwardingMethod))
+		}
+	}
+
+	if o.Persistence > 0 {
+		s.Persistence = &PersistenceV2{Timeout: o.Persistence, Prefix: o.PersistencePrefix, Prefix6: o.PersistencePrefix6}
+	}
+	if o.UThreshold() > 0 {
+		s.Limits = &LimitsV2{Upper: o.UThreshold(), Lower: o.LThreshold()}
+	} else if o.RawUThreshold != 0 || o.RawLThreshold != 0 {
+		warnings = append(warnings, fmt.Sprintf("%s:%d: thresholds %d/%d are ignored, and were dropped", vip, port, o.RawUThreshold, o.RawLThreshold))
+	}
+	return s, warnings
+}
+
+// splitFlags returns the comma separated flags, or nil when there are none
+func splitFlags(flags string) []string {
+	var out []string
+	for _, flag := range strings.Split(flags, ",") {
+		if flag = strings.TrimSpace(flag); flag != "" {
+			out = append(out, flag)
+		}
+	}
+	return out
+}
+
+// equivalent returns an error naming the first service that a and b configure
+// differently, comparing the options of each as ravel applies them rather than
+// as they were written
+func equivalent(a, b *ClusterConfig) error {
+	for family, pair := range map[string][2]map[ServiceIP]PortMap{
+		"config":  {a.Config, b.Config},
+		"config6": {a.Config6, b.Config6},
+	} {
+		if err := equivalentPorts(pair[0], pair[1]); err != nil {
+			return fmt.Errorf("%s: %v", family, err)
+		}
+		if err := equivalentPorts(pair[1], pair[0]); err != nil {
+			return fmt.Errorf("%s: %v", family, err)
+		}
+	}
+	return nil
+}
+
+func equivalentPorts(a, b map[ServiceIP]PortMap) error {
+	for vip, ports := range a {
+		for port, def := range ports {
+			if def == nil {
+				continue
+			}
+			other := b[vip][port]
+			if other == nil {
+				return fmt.Errorf("%s:%s is missing", vip, port)
+			}
+			if !reflect.DeepEqual(effective(def), effective(other)) {
+				return fmt.Errorf("%s:%s is configured differently", vip, port)
+			}
+		}
+	}
+	return nil
+}
+
+// effective returns def with its ipvs options replaced by the values ravel
+// applies for them
+func effective(def *ServiceDef) ServiceDef {
+	d := *def
+	o := &d.IPVSOptions
+	o.RawScheduler = o.Scheduler()
+	o.RawForwardingMethod = o.ForwardingMethod()
+	o.RawUThreshold, o.RawLThreshold = o.UThreshold(), o.LThreshold()
+	o.Flags = strings.Join(splitFlags(o.Flags), ",")
+	return d
+}
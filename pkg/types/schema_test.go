@@ -0,0 +1,88 @@
+package types
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const v1Config = `{
+	"vipPool": ["10.54.213.165", "2001:db8::165"],
+	"labels": {"role": "ravel"},
+	"config": {
+		"10.54.213.165": {
+			"80": {"namespace": "web", "service": "frontend", "portName": "http", "tcpEnabled": true,
+				"ipvsOptions": {"scheduler": "MH", "flags": "flag-1, flag-2", "forwardingMethod": "g", "persistence": 300, "persistencePrefix": 24}},
+			"53": {"namespace": "dns", "service": "coredns", "portName": "dns", "tcpEnabled": true, "udpEnabled": true,
+				"ipvsOptions": {"scheduler": "lblc", "uThreshold": 10, "lThreshold": 20, "onePacket": true}}
+		}
+	},
+	"config6": {
+		"2001:db8::165": {
+			"443": {"namespace": "web", "service": "frontend", "portName": "https", "tcpEnabled": true}
+		}
+	}
+}`
+
+func TestMigrate(t *testing.T) {
+	config, err := ParseClusterConfig([]byte(v1Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated, warnings, err := Migrate(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 2 {
+		t.Fatalf("expected warnings about the scheduler and thresholds of port 53. have %v", warnings)
+	}
+	if len(migrated.Services) != 3 || migrated.Services[0].Port != 53 || migrated.Services[2].VIP != "2001:db8::165" {
+		t.Fatalf("expected the services ordered by vip and port. have %+v", migrated.Services)
+	}
+	web := migrated.Services[1]
+	if web.Scheduler.Name != "mh" || strings.Join(web.Scheduler.Flags, ",") != "flag-1,flag-2" || web.ForwardingMethod != "direct" || web.Persistence.Prefix != 24 {
+		t.Fatalf("expected the typed options of port 80. have %+v", web)
+	}
+
+	// the migrated document parses back into the same services
+	b, err := json.Marshal(migrated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseClusterConfig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := equivalent(config, parsed); err != nil {
+		t.Fatal(err)
+	}
+	if def := parsed.Config6["2001:db8::165"]["443"]; def == nil || def.PortName != "https" {
+		t.Fatalf("expected the v6 service in config6. have %+v", parsed.Config6)
+	}
+}
+
+func TestParseClusterConfigV2(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		config string
+		valid  bool
+	}{
+		{"v2", `{"apiVersion": "v2", "services": [{"vip": "10.54.213.165", "port": 80, "protocols": ["tcp"], "scheduler": {"name": "sh", "flags": ["sh-port"]}}]}`, true},
+		{"unknown version", `{"apiVersion": "v3", "services": []}`, false},
+		{"unknown field", `{"apiVersion": "v2", "services": [{"vip": "10.54.213.165", "port": 80, "schedular": {"name": "sh"}}]}`, false},
+		{"unknown scheduler", `{"apiVersion": "v2", "services": [{"vip": "10.54.213.165", "port": 80, "scheduler": {"name": "lblc"}}]}`, false},
+		{"unknown flag", `{"apiVersion": "v2", "services": [{"vip": "10.54.213.165", "port": 80, "scheduler": {"name": "mh", "flags": ["mh-prot"]}}]}`, false},
+		{"port out of range", `{"apiVersion": "v2", "services": [{"vip": "10.54.213.165", "port": 70000}]}`, false},
+		{"duplicate port", `{"apiVersion": "v2", "services": [{"vip": "10.54.213.165", "port": 80}, {"vip": "10.54.213.165", "port": 80}]}`, false},
+		{"inverted limits", `{"apiVersion": "v2", "services": [{"vip": "10.54.213.165", "port": 80, "limits": {"upper": 10, "lower": 20}}]}`, false},
+	} {
+		config, err := ParseClusterConfig([]byte(c.config))
+		if (err == nil) != c.valid {
+			t.Errorf("%s: expected valid=%v. have %v", c.name, c.valid, err)
+			continue
+		}
+		if c.valid && (config.Config == nil || config.Config6 == nil) {
+			t.Errorf("%s: expected both families to be set, as the watcher requires", c.name)
+		}
+	}
+}
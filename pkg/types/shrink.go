@@ -0,0 +1,46 @@
+package types
+
+import (
+	v1 "k8s.io/api/core/v1"
+)
+
+// AllowShrinkAnnotation, set to "true" on the ravel configmap, lets changes
+// through the shrink guard. Remove it once the intended change has been applied.
+const AllowShrinkAnnotation = "ravel.comcast.com/allow-shrink"
+
+// AllowShrink returns true when the configmap carries the AllowShrinkAnnotation
+func AllowShrink(cm *v1.ConfigMap) bool {
+	return cm != nil && cm.Annotations[AllowShrinkAnnotation] == "true"
+}
+
+// Shrinks returns true when removing removed of total items takes away more
+// than maxPercent of them
+func Shrinks(total, removed, maxPercent int) bool {
+	return total > 0 && removed*100 > total*maxPercent
+}
+
+// RemovedPorts returns the number of VIP ports in before, over IPv4 and IPv6,
+// and how many of them are missing from after
+func RemovedPorts(before, after *ClusterConfig) (total, removed int) {
+	if before == nil {
+		return 0, 0
+	}
+	var afterConfig, afterConfig6 map[ServiceIP]PortMap
+	if after != nil {
+		afterConfig, afterConfig6 = after.Config, after.Config6
+	}
+	for _, c := range []struct{ before, after map[ServiceIP]PortMap }{
+		{before.Config, afterConfig},
+		{before.Config6, afterConfig6},
+	} {
+		for vip, ports := range c.before {
+			for port := range ports {
+				total++
+				if _, ok := c.after[vip][port]; !ok {
+					removed++
+				}
+			}
+		}
+	}
+	return total, removed
+}
@@ -0,0 +1,158 @@
+package types
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+const (
+	// SteeringFwmarkBase is the first firewall mark handed out to steered
+	// clients. It sits above the ECMP range so the two never collide.
+	SteeringFwmarkBase = 0x200000
+
+	// SteeringFwmarkRange is the number of firewall marks available to steering rules
+	SteeringFwmarkRange = 0x1000
+)
+
+// Steering sends the clients of a VIP port that come from Sources to a subset
+// of the backends, or to the backends of a different service. The nodes must
+// carry NodeLabels in addition to the labels of the cluster config, and when
+// Service is set its endpoints decide the node weights instead of those of
+// the port's own service. Namespace and PortName default to the port's.
+type Steering struct {
+	Sources    []string          `json:"sources"`
+	NodeLabels map[string]string `json:"nodeLabels,omitempty"`
+	Namespace  string            `json:"namespace,omitempty"`
+	Service    string            `json:"service,omitempty"`
+	PortName   string            `json:"portName,omitempty"`
+}
+
+// Target returns the service definition that serves the steered clients of def
+func (s Steering) Target(def *ServiceDef) *ServiceDef {
+	out := *def
+	out.Steering = nil
+	if s.Service == "" {
+		return &out
+	}
+	out.Service = s.Service
+	if s.Namespace != "" {
+		out.Namespace = s.Namespace
+	}
+	if s.PortName != "" {
+		out.PortName = s.PortName
+	}
+	return &out
+}
+
+// SteeringFwmark associates the steering rule at Index of a VIP, port and
+// protocol with the firewall mark its clients' traffic carries
+type SteeringFwmark struct {
+	VIP      ServiceIP
+	Port     string
+	Protocol string
+	Index    int
+	Rule     Steering
+	Mark     int
+}
+
+// Key returns the identity of the steering rule, i.e. 10.1.2.3:80:tcp:0
+func (f SteeringFwmark) Key() string {
+	return fmt.Sprintf("%s:%d", ECMPFwmarkKey(f.VIP, f.Port, f.Protocol), f.Index)
+}
+
+// SteeringFwmarks computes the firewall mark for every steering rule of the
+// IPv4 VIP ports in the config. Marks are derived from a hash of the rule's
+// identity, as with ECMPFwmarks, so that every director arrives at the same
+// value, and adding a rule only moves the others it collides with. The result is sorted
+// by VIP, port, protocol and then the order of the rules, which is the order
+// clients are matched in.
+func SteeringFwmarks(config *ClusterConfig) ([]SteeringFwmark, error) {
+	marks := []SteeringFwmark{}
+	if config == nil {
+		return marks, nil
+	}
+	for vip, ports := range config.Config {
+		for port, service := range ports {
+			if service == nil || service.Translated() {
+				continue
+			}
+			for n, rule := range service.Steering {
+				if service.TCPEnabled {
+					marks = append(marks, SteeringFwmark{VIP: vip, Port: port, Protocol: "tcp", Index: n, Rule: rule})
+				}
+				if service.UDPEnabled {
+					marks = append(marks, SteeringFwmark{VIP: vip, Port: port, Protocol: "udp", Index: n, Rule: rule})
+				}
+			}
+		}
+	}
+	if len(marks) > SteeringFwmarkRange {
+		return nil, fmt.Errorf("steering: %d rules exceeds the fwmark range of %d", len(marks), SteeringFwmarkRange)
+	}
+
+	sort.Slice(marks, func(i, j int) bool {
+		a, b := marks[i], marks[j]
+		if a.VIP != b.VIP || a.Port != b.Port || a.Protocol != b.Protocol {
+			return ECMPFwmarkKey(a.VIP, a.Port, a.Protocol) < ECMPFwmarkKey(b.VIP, b.Port, b.Protocol)
+		}
+		return a.Index < b.Index
+	})
+
+	keys := make([]string, len(marks))
+	for n := range marks {
+		keys[n] = marks[n].Key()
+	}
+	for n, mark := range hashFwmarks(keys, SteeringFwmarkBase, SteeringFwmarkRange) {
+		marks[n].Mark = mark
+	}
+	return marks, nil
+}
+
+// HasSteering reports whether any VIP port of the config steers clients
+func (c *ClusterConfig) HasSteering() bool {
+	if c == nil {
+		return false
+	}
+	for _, ports := range c.Config {
+		for _, def := range ports {
+			if def != nil && len(def.Steering) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateSteering makes sure every steering rule matches v4 clients and
+// belongs to a port that is load balanced in its own family
+func (c *ClusterConfig) validateSteering() error {
+	for vip, ports := range c.Config6 {
+		for port, def := range ports {
+			if def != nil && len(def.Steering) > 0 {
+				return fmt.Errorf("steering for %s:%s is only available for IPv4 VIPs", vip, port)
+			}
+		}
+	}
+	for vip, ports := range c.Config {
+		for port, def := range ports {
+			if def == nil || len(def.Steering) == 0 {
+				continue
+			}
+			if def.Translated() {
+				return fmt.Errorf("%s:%s can't be both steered and translated", vip, port)
+			}
+			for _, rule := range def.Steering {
+				if len(rule.Sources) == 0 {
+					return fmt.Errorf("steering rule for %s:%s has no sources", vip, port)
+				}
+				for _, source := range rule.Sources {
+					if ip, _, err := net.ParseCIDR(source); err != nil || ip.To4() == nil {
+						return fmt.Errorf("steering source %q for %s:%s is not an IPv4 CIDR", source, vip, port)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package types
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"path"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ServiceTemplate configures every kubernetes service it matches at once, in
+// place of a config entry per service port. The watcher gives each matching
+// service a VIP of Pool and serves each port the service declares on it, with
+// the options of Def.
+type ServiceTemplate struct {
+	// Namespace and Service are glob patterns, as path.Match takes them, for
+	// the namespaces and names of the services to match. An empty pattern
+	// matches every one.
+	Namespace string `json:"namespace,omitempty"`
+	Service   string `json:"service,omitempty"`
+
+	// Selector further restricts the template to the services with these
+	// labels, i.e. {"expose": "true"}
+	Selector map[string]string `json:"selector,omitempty"`
+
+	// Pool are the VIPs the matching services are spread across. A service
+	// takes the first VIP, in an order of its own, whose ports it doesn't
+	// collide with, so that it keeps its VIP as services come and go. The v6
+	// VIPs of the pool serve services in their own right, as ipv6Enabled
+	// only pairs VIPs for the ports the config lists.
+	Pool []ServiceIP `json:"pool"`
+
+	// Ports are the names of the service ports to serve. Every port the
+	// service declares is served when empty.
+	Ports []string `json:"ports,omitempty"`
+
+	// Def are the options of the VIP ports the template creates. Its
+	// namespace, service, port name and protocols come from the service.
+	Def *ServiceDef `json:"def,omitempty"`
+}
+
+// Matches reports whether the template configures the service with the
+// namespace, name and labels given
+func (t *ServiceTemplate) Matches(namespace, service string, serviceLabels map[string]string) bool {
+	if t.Namespace != "" {
+		if ok, _ := path.Match(t.Namespace, namespace); !ok {
+			return false
+		}
+	}
+	if t.Service != "" {
+		if ok, _ := path.Match(t.Service, service); !ok {
+			return false
+		}
+	}
+	return labels.SelectorFromSet(t.Selector).Matches(labels.Set(serviceLabels))
+}
+
+// ServesPort reports whether the template serves the service port named name
+func (t *ServiceTemplate) ServesPort(name string) bool {
+	return len(t.Ports) == 0 || containsString(t.Ports, name)
+}
+
+// ServiceDef returns the definition of a VIP port the template creates for
+// the port portName of the service
+func (t *ServiceTemplate) ServiceDef(namespace, service, portName string) *ServiceDef {
+	def := &ServiceDef{}
+	if t.Def != nil {
+		def = copyServiceDef(t.Def)
+	}
+	def.Namespace = namespace
+	def.Service = service
+	def.PortName = portName
+	return def
+}
+
+// PoolOrder returns the VIPs of the pool in the order the service tries them,
+// ranked by their hashes with the service as rendezvous hashing does, so that
+// a VIP joining or leaving the pool only moves the services it takes or had
+func (t *ServiceTemplate) PoolOrder(service string) []ServiceIP {
+	type scored struct {
+		vip ServiceIP
+		sum uint64
+	}
+	scores := make([]scored, 0, len(t.Pool))
+	for _, vip := range t.Pool {
+		h := fnv.New64a()
+		h.Write([]byte(service))
+		h.Write([]byte{0})
+		h.Write([]byte(vip))
+		scores = append(scores, scored{vip, h.Sum64()})
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].sum != scores[j].sum {
+			return scores[i].sum > scores[j].sum
+		}
+		return scores[i].vip < scores[j].vip
+	})
+
+	out := make([]ServiceIP, 0, len(scores))
+	for _, s := range scores {
+		out = append(out, s.vip)
+	}
+	return out
+}
+
+func copyTemplates(in []ServiceTemplate) []ServiceTemplate {
+	if in == nil {
+		return nil
+	}
+	out := make([]ServiceTemplate, len(in))
+	for n, t := range in {
+		if t.Selector != nil {
+			selector := make(map[string]string, len(t.Selector))
+			for k, v := range t.Selector {
+				selector[k] = v
+			}
+			t.Selector = selector
+		}
+		t.Pool = append([]ServiceIP(nil), t.Pool...)
+		t.Ports = append([]string(nil), t.Ports...)
+		if t.Def != nil {
+			t.Def = copyServiceDef(t.Def)
+		}
+		out[n] = t
+	}
+	return out
+}
+
+// validateTemplates makes sure every template has a pool of VIPs and patterns
+// that path.Match can use
+func (c *ClusterConfig) validateTemplates() error {
+	for n, t := range c.Templates {
+		for _, pattern := range []string{t.Namespace, t.Service} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("template %d: pattern %q is invalid. %v", n, pattern, err)
+			}
+		}
+		if len(t.Pool) == 0 {
+			return fmt.Errorf("template %d has no pool of VIPs", n)
+		}
+		for _, vip := range t.Pool {
+			if net.ParseIP(string(vip)) == nil {
+				return fmt.Errorf("template %d: pool vip %q is not an ip address", n, vip)
+			}
+		}
+		if t.Def != nil && (t.Def.Namespace != "" || t.Def.Service != "" || t.Def.PortName != "") {
+			return fmt.Errorf("template %d sets the namespace, service or port name of its def, which come from the services it matches", n)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package types
+
+import "fmt"
+
+// TProxied reports whether traffic to the port is delivered to a local
+// transparent proxy rather than load balanced by IPVS
+func (s *ServiceDef) TProxied() bool {
+	return s != nil && s.TProxyPort != 0
+}
+
+// HasTProxy reports whether any VIP port of the config, of the v6 VIPs when v6
+// is set, is delivered to a transparent proxy
+func (c *ClusterConfig) HasTProxy(v6 bool) bool {
+	if c == nil {
+		return false
+	}
+	config := c.Config
+	if v6 {
+		config = c.Config6
+	}
+	for _, ports := range config {
+		for _, def := range ports {
+			if def.TProxied() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateTProxy makes sure transparently proxied ports name a valid proxy port
+// and aren't also handed elsewhere by translation or steering
+func (c *ClusterConfig) validateTProxy() error {
+	for _, config := range []map[ServiceIP]PortMap{c.Config, c.Config6} {
+		for vip, ports := range config {
+			for port, def := range ports {
+				if !def.TProxied() {
+					continue
+				}
+				if def.TProxyPort < 1 || def.TProxyPort > 65535 {
+					return fmt.Errorf("tproxy port %d for %s:%s must be between 1 and 65535", def.TProxyPort, vip, port)
+				}
+				if def.Translated() {
+					return fmt.Errorf("%s:%s can't be both transparently proxied and translated", vip, port)
+				}
+				if len(def.Steering) > 0 {
+					return fmt.Errorf("%s:%s can't be both transparently proxied and steered", vip, port)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+)
+
+// TranslateSIIT translates traffic to a VIP port statelessly into the other
+// address family, so that it is served by the paired VIP of that family. It
+// lets a v6 VIP front backends that only have v4 addresses, or the reverse.
+const TranslateSIIT = "siit"
+
+// Translation is a VIP port whose traffic is translated into the family of
+// Target, the VIP paired with it in the ipv6 map of the cluster config. The
+// service of Target on the same port handles the translated traffic.
+type Translation struct {
+	VIP    ServiceIP
+	Target ServiceIP
+	Port   string
+	Def    *ServiceDef
+}
+
+// Translations returns every translated VIP port in the config, sorted by VIP
+// and port so that an unchanged config renders identically. Ports whose VIP
+// has no pair are left out; Validate rejects them.
+func (c *ClusterConfig) Translations() []Translation {
+	out := []Translation{}
+	if c == nil {
+		return out
+	}
+	for vip, ports := range c.Config {
+		target, ok := c.IPV6[vip]
+		for port, def := range ports {
+			if ok && def.Translated() {
+				out = append(out, Translation{VIP: vip, Target: ServiceIP(target), Port: port, Def: def})
+			}
+		}
+	}
+	for vip, ports := range c.Config6 {
+		target, ok := c.pairedV4(vip)
+		for port, def := range ports {
+			if ok && def.Translated() {
+				out = append(out, Translation{VIP: vip, Target: target, Port: port, Def: def})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].VIP != out[j].VIP {
+			return out[i].VIP < out[j].VIP
+		}
+		return out[i].Port < out[j].Port
+	})
+	return out
+}
+
+// Translated reports whether traffic to the port is translated into the other
+// family rather than load balanced in its own
+func (s *ServiceDef) Translated() bool {
+	return s != nil && s.Translate != ""
+}
+
+// pairedV4 returns the v4 VIP that the ipv6 map pairs with vip6
+func (c *ClusterConfig) pairedV4(vip6 ServiceIP) (ServiceIP, bool) {
+	for vip, v6 := range c.IPV6 {
+		if ServiceIP(v6) == vip6 {
+			return vip, true
+		}
+	}
+	return "", false
+}
+
+// validateTranslations makes sure every translated port has a paired VIP that
+// serves the same port without translating it back
+func (c *ClusterConfig) validateTranslations() error {
+	check := func(vip ServiceIP, port string, def *ServiceDef, target ServiceIP, paired bool, targets map[ServiceIP]PortMap) error {
+		if def.Translate != TranslateSIIT {
+			return fmt.Errorf("translate %q for %s:%s must be %s", def.Translate, vip, port, TranslateSIIT)
+		}
+		if !paired {
+			return fmt.Errorf("%s:%s is translated but %s has no pair in the ipv6 map", vip, port, vip)
+		}
+		targetDef, ok := targets[target][port]
+		if !ok || targetDef == nil {
+			return fmt.Errorf("%s:%s is translated to %s, which does not serve port %s", vip, port, target, port)
+		}
+		if targetDef.Translated() {
+			return fmt.Errorf("%s:%s and %s:%s are translated into each other", vip, port, target, port)
+		}
+		return nil
+	}
+
+	for vip, ports := range c.Config {
+		target, ok := c.IPV6[vip]
+		for port, def := range ports {
+			if !def.Translated() {
+				continue
+			}
+			if def.IPV6Enabled {
+				return fmt.Errorf("%s:%s can't be both ipv6Enabled and translated", vip, port)
+			}
+			if err := check(vip, port, def, ServiceIP(target), ok, c.Config6); err != nil {
+				return err
+			}
+		}
+	}
+	for vip, ports := range c.Config6 {
+		target, ok := c.pairedV4(vip)
+		for port, def := range ports {
+			if !def.Translated() {
+				continue
+			}
+			if err := check(vip, port, def, target, ok, c.Config); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
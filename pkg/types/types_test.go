@@ -2,6 +2,7 @@ package types
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 
 	"k8s.io/api/core/v1"
@@ -26,3 +27,878 @@ func TestConfigDataConvert(t *testing.T) {
 
 	fmt.Printf("clusterConfig: %v", clusterConfig)
 }
+
+func TestClusterConfigDeepCopy(t *testing.T) {
+	c := &ClusterConfig{
+		Generation: 3,
+		VIPPool:    []string{"10.54.213.165"},
+		Config: map[ServiceIP]PortMap{
+			"10.54.213.165": {
+				"80": &ServiceDef{Namespace: "syseng", Service: "mod-super8", PortName: "http"},
+			},
+		},
+	}
+	out := c.DeepCopy()
+	if out.Generation != 3 {
+		t.Fatalf("expected generation 3. saw %d", out.Generation)
+	}
+
+	c.VIPPool[0] = "10.1.1.1"
+	c.Config["10.54.213.165"]["80"].Service = "changed"
+	delete(c.Config, "10.54.213.165")
+
+	if out.VIPPool[0] != "10.54.213.165" {
+		t.Fatal("expected the vip pool to be copied")
+	}
+	def, ok := out.Config["10.54.213.165"]["80"]
+	if !ok || def.Service != "mod-super8" {
+		t.Fatal("expected service definitions to be copied")
+	}
+}
+
+func TestMaintenanceValidate(t *testing.T) {
+	c := &ClusterConfig{
+		Maintenance: map[ServiceIP]Maintenance{
+			"10.54.213.165": {},
+			"10.54.213.166": {Action: MaintenanceDrop, Withdraw: true},
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := c.InMaintenance("10.54.213.166"); !ok || !m.Withdraw {
+		t.Fatalf("expected 10.54.213.166 to be withdrawn. have %+v", m)
+	}
+	if _, ok := c.InMaintenance("10.54.213.167"); ok {
+		t.Fatal("expected 10.54.213.167 to be in service")
+	}
+
+	out := c.DeepCopy()
+	delete(c.Maintenance, "10.54.213.165")
+	if _, ok := out.InMaintenance("10.54.213.165"); !ok {
+		t.Fatal("expected maintenance to be copied")
+	}
+
+	c.Maintenance["10.54.213.165"] = Maintenance{Action: "blackhole"}
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected an error for an unknown action")
+	}
+}
+
+func TestShrinkGuard(t *testing.T) {
+	before := &ClusterConfig{
+		Config: map[ServiceIP]PortMap{
+			"10.54.213.165": {"80": nil, "443": nil},
+			"10.54.213.166": {"80": nil},
+		},
+		Config6: map[ServiceIP]PortMap{
+			"2001:db8::1": {"80": nil},
+		},
+	}
+	after := &ClusterConfig{
+		Config: map[ServiceIP]PortMap{
+			"10.54.213.165": {"80": nil},
+		},
+		Config6: map[ServiceIP]PortMap{
+			"2001:db8::1": {"80": nil},
+		},
+	}
+
+	total, removed := RemovedPorts(before, after)
+	if total != 4 || removed != 2 {
+		t.Fatalf("expected 2 of 4 ports removed. have %d of %d", removed, total)
+	}
+	if Shrinks(total, removed, 50) {
+		t.Fatal("expected removing half the ports to be allowed at 50%")
+	}
+	if !Shrinks(total, removed, 25) {
+		t.Fatal("expected removing half the ports to be refused at 25%")
+	}
+
+	total, removed = RemovedPorts(before, &ClusterConfig{})
+	if total != 4 || removed != 4 {
+		t.Fatalf("expected an empty config to remove every port. have %d of %d", removed, total)
+	}
+	if Shrinks(0, 0, 0) {
+		t.Fatal("expected an empty config to never shrink")
+	}
+
+	cm := &v1.ConfigMap{}
+	if AllowShrink(cm) || AllowShrink(nil) {
+		t.Fatal("expected shrinking to be refused without the annotation")
+	}
+	cm.Annotations = map[string]string{AllowShrinkAnnotation: "true"}
+	if !AllowShrink(cm) {
+		t.Fatal("expected the annotation to allow shrinking")
+	}
+}
+
+func TestNodeIPV6(t *testing.T) {
+	v6Only := &v1.Node{Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+		{Type: v1.NodeHostName, Address: "node-a"},
+		{Type: v1.NodeInternalIP, Address: "2001:db8:0:0::a"},
+	}}}
+	if ip := IPV6(v6Only); ip != "2001:db8::a" {
+		t.Fatalf("expected the v6 internal address of a node without the label. have %q", ip)
+	}
+	if ip := IPV4(v6Only); ip != "" {
+		t.Fatalf("expected no v4 address. have %q", ip)
+	}
+
+	labeled := v6Only.DeepCopy()
+	labeled.Labels = map[string]string{v6AddrLabelKey: "2001-db8--b"}
+	if ip := IPV6(labeled); ip != "2001:db8::b" {
+		t.Fatalf("expected the label to be preferred. have %q", ip)
+	}
+
+	v6Only.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	if eligible, _ := IsEligibleBackendV6(v6Only, nil, "2001:db8::a", false, true); eligible {
+		t.Fatal("expected a v6 only master node to be skipped")
+	}
+	if eligible, reason := IsEligibleBackendV6(v6Only, nil, "2001:db8::c", false, true); !eligible {
+		t.Fatalf("expected a v6 only node to be eligible. %s", reason)
+	}
+}
+
+func TestDualStackServiceExpansion(t *testing.T) {
+	data := map[string]string{"green": `{
+                "dualStack": true,
+                "ipv6": {"10.54.213.147": "2001:db8::7"},
+                "config": {
+                    "10.54.213.147":{
+                        "80":{"namespace": "syseng", "service": "web", "portName": "http", "ipv6Enabled": true},
+                        "81":{"namespace": "syseng", "service": "ui", "portName": "http"},
+                        "82":{"namespace": "syseng", "service": "api", "portName": "http", "ipv6Enabled": true}
+                    },
+                    "10.54.213.148":{
+                        "80":{"namespace": "syseng", "service": "other", "portName": "http", "ipv6Enabled": true}
+                    }
+                },
+                "config6": {
+                    "2001:db8::7":{
+                        "82":{"namespace": "syseng", "service": "api-v6", "portName": "http"}
+                    }
+                }
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ports := clusterConfig.Config6["2001:db8::7"]
+	if len(clusterConfig.Config6) != 1 || len(ports) != 2 {
+		t.Fatalf("expected only the ipv6Enabled ports of the mapped VIP in config6. have %v", clusterConfig.Config6)
+	}
+	if def := ports["80"]; def == nil || def.Service != "web" {
+		t.Fatalf("expected port 80 to serve the v4 service. have %+v", def)
+	}
+	if ports["80"] == clusterConfig.Config["10.54.213.147"]["80"] {
+		t.Fatal("expected the v6 service definition to be a copy")
+	}
+	if def := ports["82"]; def.Service != "api-v6" {
+		t.Fatalf("expected an explicit config6 port to be kept. have %+v", def)
+	}
+
+	// a v4 address in the ipv6 map is skipped rather than rejecting the config
+	data["green"] = `{"dualStack": true, "ipv6": {"10.54.213.147": "10.54.213.148"},
+                "config": {"10.54.213.147": {"80": {"namespace": "syseng", "service": "web", "portName": "http", "ipv6Enabled": true}}}}`
+	clusterConfig, err = NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusterConfig.Config6) != 0 {
+		t.Fatalf("expected the v4 mapping to be skipped. have %v", clusterConfig.Config6)
+	}
+
+	// without dualStack, ipv6Enabled ports aren't served on the paired v6 VIP
+	data["green"] = `{"ipv6": {"10.54.213.147": "2001:db8::7"},
+                "config": {"10.54.213.147": {"80": {"namespace": "syseng", "service": "web", "portName": "http", "ipv6Enabled": true}}}}`
+	clusterConfig, err = NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusterConfig.Config6) != 0 {
+		t.Fatalf("expected no dual-stack expansion without dualStack. have %v", clusterConfig.Config6)
+	}
+}
+
+func TestNodeAddressFamilies(t *testing.T) {
+	node := &v1.Node{Status: v1.NodeStatus{
+		Addresses: []v1.NodeAddress{
+			{Type: v1.NodeExternalIP, Address: "192.0.2.10"},
+			{Type: v1.NodeInternalIP, Address: "2001:db8::a"},
+			{Type: v1.NodeInternalIP, Address: "10.0.0.10"},
+		},
+		Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+	}}
+	if ip := IPV4(node); ip != "10.0.0.10" {
+		t.Fatalf("expected the v4 internal address to be preferred. have %q", ip)
+	}
+	if ip := IPV6(node); ip != "2001:db8::a" {
+		t.Fatalf("expected the v6 internal address. have %q", ip)
+	}
+
+	v4Only := &v1.Node{Status: v1.NodeStatus{
+		Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.11"}},
+		Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+	}}
+	if eligible, _ := IsEligibleBackendV6(v4Only, nil, "", false, false); eligible {
+		t.Fatal("expected a node without a v6 address to be ineligible for v6 services")
+	}
+	if eligible, reason := IsEligibleBackendV4(v4Only, nil, "", false, false); !eligible {
+		t.Fatalf("expected a v4 node to be eligible for v4 services. %s", reason)
+	}
+}
+
+func TestTranslations(t *testing.T) {
+	data := map[string]string{"green": `{
+                "ipv6": {"10.54.213.147": "2001:db8::7", "10.54.213.148": "2001:db8::8"},
+                "config": {
+                    "10.54.213.147":{
+                        "80":{"namespace": "syseng", "service": "web", "portName": "http", "tcpEnabled": true}
+                    },
+                    "10.54.213.148":{
+                        "53":{"namespace": "syseng", "service": "dns", "portName": "dns", "udpEnabled": true, "translate": "siit"}
+                    }
+                },
+                "config6": {
+                    "2001:db8::7":{
+                        "80":{"namespace": "syseng", "service": "web", "portName": "http", "tcpEnabled": true, "translate": "siit"}
+                    },
+                    "2001:db8::8":{
+                        "53":{"namespace": "syseng", "service": "dns", "portName": "dns", "udpEnabled": true}
+                    }
+                }
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	translations := clusterConfig.Translations()
+	if len(translations) != 2 {
+		t.Fatalf("expected two translated ports. have %+v", translations)
+	}
+	if tr := translations[0]; tr.VIP != "10.54.213.148" || tr.Target != "2001:db8::8" || tr.Port != "53" {
+		t.Fatalf("expected the v4 port to translate to its v6 pair. have %+v", tr)
+	}
+	if tr := translations[1]; tr.VIP != "2001:db8::7" || tr.Target != "10.54.213.147" || tr.Port != "80" {
+		t.Fatalf("expected the v6 port to translate to its v4 pair. have %+v", tr)
+	}
+
+	invalid := map[string]string{
+		"unknown mode": `{"ipv6": {"10.54.213.147": "2001:db8::7"},
+                "config": {"10.54.213.147": {"80": {"service": "web", "translate": "nat64"}}},
+                "config6": {"2001:db8::7": {"80": {"service": "web"}}}}`,
+		"no pair": `{"config": {"10.54.213.147": {"80": {"service": "web", "translate": "siit"}}}}`,
+		"pair without the port": `{"ipv6": {"10.54.213.147": "2001:db8::7"},
+                "config": {"10.54.213.147": {"80": {"service": "web", "translate": "siit"}}},
+                "config6": {"2001:db8::7": {"443": {"service": "web"}}}}`,
+		"both directions": `{"ipv6": {"10.54.213.147": "2001:db8::7"},
+                "config": {"10.54.213.147": {"80": {"service": "web", "translate": "siit"}}},
+                "config6": {"2001:db8::7": {"80": {"service": "web", "translate": "siit"}}}}`,
+		"dual-stack": `{"dualStack": true, "ipv6": {"10.54.213.147": "2001:db8::7"},
+                "config": {"10.54.213.147": {"80": {"service": "web", "translate": "siit", "ipv6Enabled": true}}}}`,
+	}
+	for name, config := range invalid {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: map[string]string{"green": config}}, "green"); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestSteering(t *testing.T) {
+	data := map[string]string{"green": `{
+                "config": {
+                    "10.54.213.147":{
+                        "80":{"namespace": "syseng", "service": "web", "portName": "http", "tcpEnabled": true, "steering": [
+                            {"sources": ["10.0.0.0/8"], "nodeLabels": {"region": "east"}},
+                            {"sources": ["192.168.0.0/16", "172.16.0.0/12"], "service": "web-canary"}
+                        ]},
+                        "443":{"namespace": "syseng", "service": "web", "portName": "https", "tcpEnabled": true}
+                    }
+                }
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clusterConfig.HasSteering() {
+		t.Fatal("expected the config to steer clients")
+	}
+	marks, err := SteeringFwmarks(clusterConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 2 || marks[0].Index != 0 || marks[1].Index != 1 {
+		t.Fatalf("expected a mark per rule in rule order. have %+v", marks)
+	}
+	for _, m := range marks {
+		if m.Mark < SteeringFwmarkBase || m.Mark >= SteeringFwmarkBase+SteeringFwmarkRange {
+			t.Fatalf("mark %#x of %s is outside the steering range", m.Mark, m.Key())
+		}
+	}
+	if marks[0].Mark == marks[1].Mark {
+		t.Fatalf("expected distinct marks. have %+v", marks)
+	}
+
+	again, _ := SteeringFwmarks(clusterConfig)
+	if again[0].Mark != marks[0].Mark || again[1].Mark != marks[1].Mark {
+		t.Fatal("expected marks to be stable")
+	}
+
+	def := clusterConfig.Config["10.54.213.147"]["80"]
+	if target := def.Steering[1].Target(def); target.Service != "web-canary" || target.Namespace != "syseng" || target.Steering != nil {
+		t.Fatalf("unexpected steering target %+v", target)
+	}
+	if target := def.Steering[0].Target(def); target.Service != "web" {
+		t.Fatalf("expected a rule without a service to keep the port's. have %+v", target)
+	}
+
+	invalid := map[string]string{
+		"no sources": `{"config": {"10.54.213.147": {"80": {"service": "web", "steering": [{"service": "web-canary"}]}}}}`,
+		"bad source": `{"config": {"10.54.213.147": {"80": {"service": "web", "steering": [{"sources": ["10.0.0.1"]}]}}}}`,
+		"v6 source":  `{"config": {"10.54.213.147": {"80": {"service": "web", "steering": [{"sources": ["2001:db8::/32"]}]}}}}`,
+		"v6 vip":     `{"config6": {"2001:db8::7": {"80": {"service": "web", "steering": [{"sources": ["10.0.0.0/8"]}]}}}}`,
+	}
+	for name, config := range invalid {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: map[string]string{"green": config}}, "green"); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestACLValidate(t *testing.T) {
+	data := map[string]string{"green": `{
+                "dualStack": true,
+                "ipv6": {"10.54.213.147": "2001:db8::7"},
+                "config": {
+                    "10.54.213.147":{
+                        "80":{"service": "web", "tcpEnabled": true, "ipv6Enabled": true, "acl": {"allow": ["10.0.0.0/8", "2001:db8:1::/48"], "deny": ["10.1.0.0/16"]}}
+                    }
+                }
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clusterConfig.HasACL(false) || !clusterConfig.HasACL(true) {
+		t.Fatal("expected the dual-stack port to keep its acl in both families")
+	}
+	copied := clusterConfig.DeepCopy()
+	copied.Config["10.54.213.147"]["80"].ACL.Allow[0] = "192.168.0.0/16"
+	if clusterConfig.Config["10.54.213.147"]["80"].ACL.Allow[0] != "10.0.0.0/8" {
+		t.Fatal("expected the copy not to share the acl")
+	}
+
+	invalid := map[string]string{
+		"not a cidr": `{"config": {"10.54.213.147": {"80": {"service": "web", "acl": {"deny": ["10.0.0.1"]}}}}}`,
+		"translated": `{"ipv6": {"10.54.213.147": "2001:db8::7"},
+                "config": {"10.54.213.147": {"80": {"service": "web", "translate": "siit", "acl": {"allow": ["10.0.0.0/8"]}}}},
+                "config6": {"2001:db8::7": {"80": {"service": "web"}}}}`,
+	}
+	for name, config := range invalid {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: map[string]string{"green": config}}, "green"); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestDefense(t *testing.T) {
+	data := map[string]string{"green": `{
+                "config": {
+                    "10.54.213.147":{
+                        "443":{"service": "web", "tcpEnabled": true}
+                    }
+                },
+                "defense": {"10.54.213.147": {"synProxy": true, "mss": 1400}},
+                "ipvsDefense": {"dropEntry": 1, "secureTcp": 3}
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, ok := clusterConfig.SYNProxy("10.54.213.147")
+	if !ok {
+		t.Fatal("expected the syn proxy to be enabled for the VIP")
+	}
+	if mss, wscale := d.Options(); mss != 1400 || wscale != DefaultSYNProxyWScale {
+		t.Fatalf("unexpected syn proxy options %d %d", mss, wscale)
+	}
+
+	expected := map[string]string{
+		"net/ipv4/tcp_syncookies":              "1",
+		"net/netfilter/nf_conntrack_tcp_loose": "0",
+		"net/ipv4/vs/drop_entry":               "1",
+		"net/ipv4/vs/secure_tcp":               "3",
+	}
+	if sysctls := clusterConfig.DefenseSysctls(); !reflect.DeepEqual(sysctls, expected) {
+		t.Fatalf("unexpected defense sysctls %v", sysctls)
+	}
+
+	copied := clusterConfig.DeepCopy()
+	*copied.IPVSDefense.DropEntry = 2
+	if *clusterConfig.IPVSDefense.DropEntry != 1 {
+		t.Fatal("expected the copy not to share the ipvs defense")
+	}
+
+	invalid := map[string]string{
+		"v6 vip":     `{"config": {}, "defense": {"2001:db8::7": {"synProxy": true}}}`,
+		"mss":        `{"config": {}, "defense": {"10.54.213.147": {"synProxy": true, "mss": 100}}}`,
+		"wscale":     `{"config": {}, "defense": {"10.54.213.147": {"synProxy": true, "wscale": 15}}}`,
+		"notrack":    `{"config": {"10.54.213.147": {"443": {"service": "web", "noTrack": true}}}, "defense": {"10.54.213.147": {"synProxy": true}}}`,
+		"strategy":   `{"config": {}, "ipvsDefense": {"dropPacket": 4}}`,
+		"amemthresh": `{"config": {}, "ipvsDefense": {"amemthresh": 0}}`,
+	}
+	for name, config := range invalid {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: map[string]string{"green": config}}, "green"); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestTProxy(t *testing.T) {
+	data := map[string]string{"green": `{
+                "config": {
+                    "10.54.213.147":{
+                        "80":{"service": "web", "tcpEnabled": true, "tproxyPort": 15001},
+                        "443":{"service": "web", "tcpEnabled": true}
+                    }
+                }
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clusterConfig.HasTProxy(false) || clusterConfig.HasTProxy(true) {
+		t.Fatal("expected only the v4 VIP to be transparently proxied")
+	}
+	marks, err := ECMPFwmarks(clusterConfig, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 1 || marks[0].Port != "443" {
+		t.Fatalf("expected only the load balanced port to get an ecmp mark. have %+v", marks)
+	}
+
+	invalid := map[string]string{
+		"port":  `{"config": {"10.54.213.147": {"80": {"service": "web", "tproxyPort": 70000}}}}`,
+		"steer": `{"config": {"10.54.213.147": {"80": {"service": "web", "tproxyPort": 15001, "steering": [{"sources": ["10.0.0.0/8"]}]}}}}`,
+		"translated": `{"ipv6": {"10.54.213.147": "2001:db8::7"},
+                "config": {"10.54.213.147": {"80": {"service": "web", "translate": "siit", "tproxyPort": 15001}}},
+                "config6": {"2001:db8::7": {"80": {"service": "web"}}}}`,
+	}
+	for name, config := range invalid {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: map[string]string{"green": config}}, "green"); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestReturnRoutes(t *testing.T) {
+	data := map[string]string{"green": `{
+                "config": {
+                    "10.54.213.147":{"80":{"service": "web", "tcpEnabled": true}},
+                    "10.54.213.148":{"80":{"service": "api", "tcpEnabled": true}}
+                },
+                "config6": {
+                    "2001:db8::7":{"80":{"service": "web", "tcpEnabled": true}}
+                },
+                "routes": {
+                    "10.54.213.147": {"interface": "eth1", "gateway": "10.54.100.1", "table": 200},
+                    "10.54.213.148": {"interface": "eth1", "gateway": "10.54.100.1", "table": 200},
+                    "2001:db8::7": {"interface": "eth1", "table": 200}
+                }
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes := clusterConfig.ReturnRoutes(false); len(routes) != 2 || routes["10.54.213.148"].Gateway != "10.54.100.1" {
+		t.Fatalf("expected the routes of both v4 VIPs. have %+v", routes)
+	}
+	if routes := clusterConfig.ReturnRoutes(true); len(routes) != 1 || routes["2001:db8::7"].Interface != "eth1" {
+		t.Fatalf("expected the route of the v6 VIP. have %+v", routes)
+	}
+
+	invalid := map[string]string{
+		"interface": `{"routes": {"10.54.213.147": {"table": 200}}}`,
+		"reserved":  `{"routes": {"10.54.213.147": {"interface": "eth1", "table": 254}}}`,
+		"family":    `{"routes": {"10.54.213.147": {"interface": "eth1", "gateway": "2001:db8::1", "table": 200}}}`,
+		"shared": `{"routes": {"10.54.213.147": {"interface": "eth1", "table": 200},
+                "10.54.213.148": {"interface": "eth2", "table": 200}}}`,
+	}
+	for name, config := range invalid {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: map[string]string{"green": config}}, "green"); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestVRFs(t *testing.T) {
+	data := map[string]string{"green": `{
+                "config": {
+                    "10.54.213.147":{"80":{"service": "web", "tcpEnabled": true}},
+                    "10.54.213.148":{"80":{"service": "api", "tcpEnabled": true}}
+                },
+                "vrfs": {
+                    "tenant-a": {"table": 100, "vips": ["10.54.213.147"]}
+                },
+                "routes": {
+                    "10.54.213.147": {"interface": "eth1", "gateway": "10.54.100.1", "table": 100}
+                }
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, ok := clusterConfig.VRFOf("10.54.213.147"); !ok || name != "tenant-a" {
+		t.Fatalf("expected 10.54.213.147 in vrf tenant-a. have %q", name)
+	}
+	if _, ok := clusterConfig.VRFOf("10.54.213.148"); ok {
+		t.Fatal("expected 10.54.213.148 in no vrf")
+	}
+	copied := clusterConfig.DeepCopy()
+	copied.VRFs["tenant-a"].VIPs[0] = "10.54.213.149"
+	if clusterConfig.VRFs["tenant-a"].VIPs[0] != "10.54.213.147" {
+		t.Fatal("expected DeepCopy to copy the vips of the vrfs")
+	}
+
+	invalid := map[string]string{
+		"name":     `{"vrfs": {"tenant-with-a-long-name": {"table": 100}}}`,
+		"reserved": `{"vrfs": {"tenant-a": {"table": 255}}}`,
+		"tables":   `{"vrfs": {"tenant-a": {"table": 100}, "tenant-b": {"table": 100}}}`,
+		"vips": `{"vrfs": {"tenant-a": {"table": 100, "vips": ["10.54.213.147"]},
+                "tenant-b": {"table": 101, "vips": ["10.54.213.147"]}}}`,
+		"route table": `{"vrfs": {"tenant-a": {"table": 100, "vips": ["10.54.213.147"]}},
+                "routes": {"10.54.213.147": {"interface": "eth1", "table": 200}}}`,
+		"route into vrf": `{"vrfs": {"tenant-a": {"table": 100}},
+                "routes": {"10.54.213.148": {"interface": "eth1", "table": 100}}}`,
+	}
+	for name, config := range invalid {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: map[string]string{"green": config}}, "green"); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	data := map[string]string{"green": `{
+                "config": {
+                    "10.54.213.147":{
+                        "80":{"service": "web", "tcpEnabled": true, "mirror": {"gateway": "10.54.100.9", "percent": 10}},
+                        "443":{"service": "web", "tcpEnabled": true}
+                    }
+                }
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clusterConfig.HasMirror(false) || clusterConfig.HasMirror(true) {
+		t.Fatal("expected only the v4 VIP to be mirrored")
+	}
+	if !clusterConfig.Config["10.54.213.147"]["80"].Mirror.Sampled() {
+		t.Fatal("expected port 80 to be sampled")
+	}
+
+	invalid := map[string]string{
+		"gateway": `{"config": {"10.54.213.147": {"80": {"service": "web", "mirror": {"gateway": "shadow"}}}}}`,
+		"family":  `{"config": {"10.54.213.147": {"80": {"service": "web", "mirror": {"gateway": "2001:db8::9"}}}}}`,
+		"percent": `{"config": {"10.54.213.147": {"80": {"service": "web", "mirror": {"gateway": "10.54.100.9", "percent": 101}}}}}`,
+		"notrack": `{"config": {"10.54.213.147": {"80": {"service": "web", "noTrack": true, "mirror": {"gateway": "10.54.100.9", "percent": 50}}}}}`,
+		"tproxy":  `{"config": {"10.54.213.147": {"80": {"service": "web", "tproxyPort": 15001, "mirror": {"gateway": "10.54.100.9"}}}}}`,
+	}
+	for name, config := range invalid {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: map[string]string{"green": config}}, "green"); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestPortRewrite(t *testing.T) {
+	data := map[string]string{"green": `{
+                "config": {
+                    "10.54.213.147":{
+                        "443":{"service": "web", "portName": "https", "tcpEnabled": true, "ipv6Enabled": true,
+                               "portRewrite": {"backends": [{"selector": {"track": "canary"}, "targetPort": 8443}]}}
+                    }
+                },
+                "dualStack": true,
+                "ipv6": {"10.54.213.147": "2001:db8::7"}
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := clusterConfig.Config["10.54.213.147"]["443"].PortRewrite
+	if name, port := r.Target(map[string]string{"track": "canary"}); name != "" || port != 8443 {
+		t.Fatalf("expected canary pods to be sent to 8443. have %q %d", name, port)
+	}
+	if name, port := r.Target(map[string]string{"track": "stable"}); name != "" || port != 0 {
+		t.Fatalf("expected other pods to keep their port. have %q %d", name, port)
+	}
+	if clusterConfig.Config6["2001:db8::7"]["443"].PortRewrite != nil {
+		t.Fatal("expected the v6 VIP port not to be rewritten")
+	}
+
+	invalid := map[string]string{
+		"both":     `{"config": {"10.54.213.147": {"443": {"service": "web", "portRewrite": {"targetPort": 8443, "targetPortName": "https-alt"}}}}}`,
+		"range":    `{"config": {"10.54.213.147": {"443": {"service": "web", "portRewrite": {"targetPort": 70000}}}}}`,
+		"selector": `{"config": {"10.54.213.147": {"443": {"service": "web", "portRewrite": {"backends": [{"targetPort": 8443}]}}}}}`,
+		"target":   `{"config": {"10.54.213.147": {"443": {"service": "web", "portRewrite": {"backends": [{"selector": {"track": "canary"}}]}}}}}`,
+		"v6":       `{"config6": {"2001:db8::7": {"443": {"service": "web", "portRewrite": {"targetPort": 8443}}}}}`,
+	}
+	for name, config := range invalid {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: map[string]string{"green": config}}, "green"); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestBackendPorts(t *testing.T) {
+	data := map[string]string{"green": `{
+                "config": {
+                    "10.54.213.147":{
+                        "80":{"service": "web", "tcpEnabled": true, "ipv6Enabled": true, "ipvsOptions": {"forwardingMethod": "m"},
+                              "backendPorts": [
+                                  {"nodeSelector": {"pool": "new", "zone": "a"}, "targetPort": 30081},
+                                  {"nodeSelector": {"pool": "new"}, "targetPort": 30080}
+                              ]}
+                    }
+                },
+                "dualStack": true,
+                "ipv6": {"10.54.213.147": "2001:db8::7"}
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := clusterConfig.Config["10.54.213.147"]["80"]
+	for _, c := range []struct {
+		labels map[string]string
+		port   string
+	}{
+		{map[string]string{"pool": "new", "zone": "a"}, "30081"},
+		{map[string]string{"pool": "new", "zone": "b"}, "30080"},
+		{map[string]string{"pool": "old"}, "80"},
+		{nil, "80"},
+	} {
+		if port := def.RealPort("80", c.labels); port != c.port {
+			t.Errorf("expected nodes labeled %v to be sent to %s. have %s", c.labels, c.port, port)
+		}
+	}
+	if port := clusterConfig.Config6["2001:db8::7"]["80"].RealPort("80", map[string]string{"pool": "new"}); port != "30080" {
+		t.Fatalf("expected the v6 VIP port to keep its backend ports. have %s", port)
+	}
+
+	invalid := map[string]string{
+		"method":   `{"config": {"10.54.213.147": {"80": {"service": "web", "backendPorts": [{"nodeSelector": {"pool": "new"}, "targetPort": 30080}]}}}}`,
+		"selector": `{"config": {"10.54.213.147": {"80": {"service": "web", "ipvsOptions": {"forwardingMethod": "m"}, "backendPorts": [{"targetPort": 30080}]}}}}`,
+		"range":    `{"config": {"10.54.213.147": {"80": {"service": "web", "ipvsOptions": {"forwardingMethod": "m"}, "backendPorts": [{"nodeSelector": {"pool": "new"}}]}}}}`,
+		"shadowed": `{"config": {"10.54.213.147": {"80": {"service": "web", "ipvsOptions": {"forwardingMethod": "m"}, "backendPorts": [{"nodeSelector": {"pool": "new"}, "targetPort": 30080}, {"nodeSelector": {"pool": "new", "zone": "a"}, "targetPort": 30081}]}}}}`,
+		"tproxy":   `{"config": {"10.54.213.147": {"80": {"service": "web", "tproxyPort": 15001, "ipvsOptions": {"forwardingMethod": "m"}, "backendPorts": [{"nodeSelector": {"pool": "new"}, "targetPort": 30080}]}}}}`,
+	}
+	for name, config := range invalid {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: map[string]string{"green": config}}, "green"); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestNamedPort(t *testing.T) {
+	data := map[string]string{"green": `{
+                "config": {
+                    "10.54.213.147":{
+                        "https":{"service": "web", "portName": "https", "tcpEnabled": true},
+                        "80":{"service": "web", "portName": "http", "tcpEnabled": true}
+                    }
+                }
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !NamedPort("https") || NamedPort("80") {
+		t.Fatal("expected only https to be a named port")
+	}
+
+	// a named port migrates to servicePort and back
+	migrated, _, err := Migrate(clusterConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrated.Services) != 2 || migrated.Services[1].ServicePort != "https" || migrated.Services[1].Port != 0 {
+		t.Fatalf("expected the named port after the numbered one. have %+v", migrated.Services)
+	}
+	parsed, err := migrated.ClusterConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def := parsed.Config["10.54.213.147"]["https"]; def == nil || def.PortName != "https" {
+		t.Fatalf("expected the named port to parse back. have %+v", parsed.Config)
+	}
+
+	invalid := map[string]string{
+		"name":  `{"config": {"10.54.213.147": {"Https_Alt": {"service": "web"}}}}`,
+		"range": `{"config": {"10.54.213.147": {"70000": {"service": "web"}}}}`,
+		"both":  `{"apiVersion": "v2", "services": [{"vip": "10.54.213.147", "port": 443, "servicePort": "https", "service": "web", "protocols": ["tcp"]}]}`,
+	}
+	for name, config := range invalid {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: map[string]string{"green": config}}, "green"); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	data := map[string]string{"green": `{
+                "config": {},
+                "templates": [
+                    {"namespace": "team-*", "selector": {"expose": "true"}, "pool": ["10.54.213.150", "10.54.213.151"],
+                     "def": {"ipvsOptions": {"scheduler": "mh"}}}
+                ]
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &clusterConfig.Templates[0]
+	if !tmpl.Matches("team-a", "web", map[string]string{"expose": "true", "app": "web"}) {
+		t.Fatal("expected the labeled service of a team namespace to match")
+	}
+	if tmpl.Matches("kube-system", "web", map[string]string{"expose": "true"}) || tmpl.Matches("team-a", "web", nil) {
+		t.Fatal("expected services of other namespaces or without the label not to match")
+	}
+	def := tmpl.ServiceDef("team-a", "web", "http")
+	if def.Namespace != "team-a" || def.PortName != "http" || def.IPVSOptions.RawScheduler != "mh" {
+		t.Fatalf("unexpected definition %+v", def)
+	}
+	if order := tmpl.PoolOrder("team-a/web"); len(order) != 2 || order[0] == order[1] {
+		t.Fatalf("expected every VIP of the pool in the order. have %v", order)
+	}
+
+	invalid := map[string]string{
+		"pool":    `{"config": {}, "templates": [{"namespace": "team-*"}]}`,
+		"pattern": `{"config": {}, "templates": [{"namespace": "team-[", "pool": ["10.54.213.150"]}]}`,
+		"def":     `{"config": {}, "templates": [{"pool": ["10.54.213.150"], "def": {"service": "web"}}]}`,
+	}
+	for name, config := range invalid {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: map[string]string{"green": config}}, "green"); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestAdaptiveWeight(t *testing.T) {
+	data := map[string]string{"green": `{
+                "config": {
+                    "10.54.213.147":{
+                        "80":{"service": "web", "tcpEnabled": true, "adaptiveWeight": {"signal": "latency", "minPercent": 25}},
+                        "443":{"service": "web", "tcpEnabled": true}
+                    }
+                }
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := clusterConfig.Config["10.54.213.147"]["80"].AdaptiveWeight
+	if a == nil || a.SignalName() != AdaptiveLatency {
+		t.Fatalf("expected port 80 to be weighted by latency. have %+v", a)
+	}
+	if min, max := a.Bounds(); min != 0.25 || max != 1 {
+		t.Fatalf("unexpected bounds %v %v", min, max)
+	}
+	if clusterConfig.Config["10.54.213.147"]["443"].AdaptiveWeight != nil {
+		t.Fatal("expected port 443 not to be adaptively weighted")
+	}
+
+	copied := clusterConfig.DeepCopy()
+	copied.Config["10.54.213.147"]["80"].AdaptiveWeight.MinPercent = 50
+	if a.MinPercent != 25 {
+		t.Fatal("expected the copy not to share the adaptive weight")
+	}
+
+	invalid := map[string]string{
+		"signal": `{"config": {"10.54.213.147": {"80": {"service": "web", "adaptiveWeight": {"signal": "cpu"}}}}}`,
+		"probe":  `{"config": {"10.54.213.147": {"80": {"service": "web", "adaptiveWeight": {"probePort": 70000}}}}}`,
+		"bounds": `{"config": {"10.54.213.147": {"80": {"service": "web", "adaptiveWeight": {"minPercent": 80, "maxPercent": 50}}}}}`,
+		"max":    `{"config": {"10.54.213.147": {"80": {"service": "web", "adaptiveWeight": {"maxPercent": 5000}}}}}`,
+	}
+	for name, config := range invalid {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: map[string]string{"green": config}}, "green"); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	data := map[string]string{"green": `{
+                "config": {
+                    "10.54.213.147":{
+                        "443":{"service": "auth", "tcpEnabled": true, "ipvsOptions": {"persistence": 600, "persistencePrefix": 24, "persistencePrefix6": 64}},
+                        "80":{"service": "web", "tcpEnabled": true, "ipvsOptions": {"persistence": 300}},
+                        "8080":{"service": "web", "tcpEnabled": true}
+                    }
+                }
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports := clusterConfig.Config["10.54.213.147"]
+	for _, c := range []struct {
+		port     string
+		v6       bool
+		expected string
+	}{
+		{"443", false, " -p 600 -M 255.255.255.0"},
+		{"443", true, " -p 600 -M 64"},
+		{"80", false, " -p 300"},
+		{"80", true, " -p 300"},
+		{"8080", false, ""},
+	} {
+		if args := ports[c.port].IPVSOptions.PersistenceArgs(c.v6); args != c.expected {
+			t.Errorf("%s v6=%v: expected %q. have %q", c.port, c.v6, c.expected, args)
+		}
+	}
+
+	invalid := map[string]string{
+		"timeout":  `{"config": {"10.54.213.147": {"80": {"service": "web", "ipvsOptions": {"persistence": -1}}}}}`,
+		"prefix":   `{"config": {"10.54.213.147": {"80": {"service": "web", "ipvsOptions": {"persistence": 300, "persistencePrefix": 33}}}}}`,
+		"prefix6":  `{"config": {"10.54.213.147": {"80": {"service": "web", "ipvsOptions": {"persistence": 300, "persistencePrefix6": 129}}}}}`,
+		"unneeded": `{"config": {"10.54.213.147": {"80": {"service": "web", "ipvsOptions": {"persistencePrefix": 24}}}}}`,
+	}
+	for name, config := range invalid {
+		if _, err := NewClusterConfig(&v1.ConfigMap{Data: map[string]string{"green": config}}, "green"); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestOnePacket(t *testing.T) {
+	data := map[string]string{"green": `{
+                "config": {
+                    "10.54.213.147":{
+                        "53":{"service": "dns", "tcpEnabled": true, "udpEnabled": true, "ipvsOptions": {"onePacket": true}},
+                        "514":{"service": "syslog", "udpEnabled": true}
+                    }
+                }
+        }`}
+	clusterConfig, err := NewClusterConfig(&v1.ConfigMap{Data: data}, "green")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports := clusterConfig.Config["10.54.213.147"]
+	if args := ports["53"].IPVSOptions.UDPArgs(); args != " -o" {
+		t.Fatalf("expected one packet scheduling for dns. have %q", args)
+	}
+	if args := ports["514"].IPVSOptions.UDPArgs(); args != "" {
+		t.Fatalf("expected no one packet scheduling for syslog. have %q", args)
+	}
+
+	tcpOnly := `{"config": {"10.54.213.147": {"80": {"service": "web", "tcpEnabled": true, "ipvsOptions": {"onePacket": true}}}}}`
+	if _, err := NewClusterConfig(&v1.ConfigMap{Data: map[string]string{"green": tcpOnly}}, "green"); err == nil {
+		t.Fatal("expected one packet scheduling on a tcp only port to be rejected")
+	}
+}
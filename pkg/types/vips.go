@@ -0,0 +1,13 @@
+package types
+
+const (
+	// VIPsAnnotation is set by directors that publish VIPs on the kubernetes
+	// services the cluster config assigns VIPs to, to the comma separated
+	// VIPs. It records what ravel published, so that it is only ever replaced
+	// or removed by ravel.
+	VIPsAnnotation = "ravel.comcast.com/vips"
+
+	// ExternalDNSTargetAnnotation is the annotation external-dns publishes the
+	// records of a service's hostnames to
+	ExternalDNSTargetAnnotation = "external-dns.alpha.kubernetes.io/target"
+)
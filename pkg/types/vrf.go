@@ -0,0 +1,94 @@
+package types
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// VRF places the VIPs it lists in a Linux VRF, a device with a routing table
+// of its own that the interfaces of a tenant's network are enslaved to, so
+// that the routes of the tenant's VIPs are kept apart from those of the node
+// and of the other tenants. The VIPs are advertised in the rib of the gobgpd
+// VRF of the same name, whose sessions peer with the routers of the tenant,
+// rather than in the global rib.
+//
+// IPVS keys its services by address whichever VRF it is in, so a VIP is in
+// one VRF of a node at most. Tenants whose VIP ranges overlap are given config
+// keys of their own, served by separate directors.
+type VRF struct {
+	// Table is the routing table of the VRF device. A return route of a VIP
+	// of the VRF, see ReturnRoute, must use it.
+	Table int         `json:"table"`
+	VIPs  []ServiceIP `json:"vips"`
+}
+
+// the longest name of a device, which a VRF is
+const maxDeviceName = 15
+
+// VRFOf returns the name of the VRF the VIP is placed in
+func (c *ClusterConfig) VRFOf(vip ServiceIP) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	for name, vrf := range c.VRFs {
+		for _, v := range vrf.VIPs {
+			if v == vip {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+func copyVRFs(in map[string]VRF) map[string]VRF {
+	if in == nil {
+		return nil
+	}
+	out := make(map[string]VRF, len(in))
+	for name, vrf := range in {
+		vrf.VIPs = append([]ServiceIP(nil), vrf.VIPs...)
+		out[name] = vrf
+	}
+	return out
+}
+
+// validateVRFs makes sure every VRF has a name a device can take and a table
+// of its own that the kernel doesn't reserve, that a VIP is in one VRF at
+// most, and that return routes only use the table of a VRF for its VIPs
+func (c *ClusterConfig) validateVRFs() error {
+	tables := map[int]string{}
+	vips := map[ServiceIP]string{}
+	for name, vrf := range c.VRFs {
+		if name == "" || len(name) > maxDeviceName || strings.ContainsAny(name, "/: \t") {
+			return fmt.Errorf("vrf name %q must be a device name of 1 to %d characters", name, maxDeviceName)
+		}
+		if vrf.Table < 1 || reservedTables[vrf.Table] {
+			return fmt.Errorf("vrf %s: table %d must be positive and not one of the reserved tables 253, 254 and 255", name, vrf.Table)
+		}
+		if other, ok := tables[vrf.Table]; ok {
+			return fmt.Errorf("vrf %s: table %d is the table of vrf %s", name, vrf.Table, other)
+		}
+		tables[vrf.Table] = name
+		for _, vip := range vrf.VIPs {
+			if net.ParseIP(string(vip)) == nil {
+				return fmt.Errorf("vrf %s: vip %q is not an ip address", name, vip)
+			}
+			if other, ok := vips[vip]; ok {
+				return fmt.Errorf("vrf %s: vip %s is placed in vrf %s already", name, vip, other)
+			}
+			vips[vip] = name
+		}
+	}
+
+	for vip, r := range c.Routes {
+		name, inVRF := vips[vip]
+		if inVRF && r.Table != c.VRFs[name].Table {
+			return fmt.Errorf("route of %s must use table %d of its vrf %s", vip, c.VRFs[name].Table, name)
+		}
+		if other, ok := tables[r.Table]; ok && !inVRF {
+			return fmt.Errorf("route of %s uses table %d of vrf %s, which %s isn't in", vip, r.Table, other, vip)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"time"
+)
+
+// Breaker keeps an apply that fails persistently, such as an iptables restore
+// the kernel refuses, from being retried on every tick. It opens after
+// Threshold consecutive failures, and while it is open the apply is only
+// retried once Backoff has passed, the wait doubling with every failed retry up
+// to Backoff.Max. A success closes it.
+//
+// A Threshold of zero or less never opens. A Breaker is used by the one loop
+// that applies, and isn't safe for concurrent use.
+type Breaker struct {
+	Threshold int
+	Backoff   Backoff
+
+	failures int
+	retryAt  time.Time
+	lastErr  error
+}
+
+// Allow is whether the apply may be tried at now: always while the breaker is
+// closed, and once its backoff has passed while it is open
+func (b *Breaker) Allow(now time.Time) bool {
+	return !b.Open() || !now.Before(b.retryAt)
+}
+
+// Failure records a failed apply at now, and returns true when it opened the
+// breaker
+func (b *Breaker) Failure(now time.Time, err error) bool {
+	b.failures++
+	b.lastErr = err
+	if b.Threshold <= 0 || b.failures < b.Threshold {
+		return false
+	}
+	b.retryAt = now.Add(b.Backoff.Next(b.failures - b.Threshold + 1))
+	return b.failures == b.Threshold
+}
+
+// Success records an apply that succeeded, and returns true when it closed the
+// breaker
+func (b *Breaker) Success() bool {
+	wasOpen := b.Open()
+	b.failures = 0
+	b.lastErr = nil
+	b.retryAt = time.Time{}
+	return wasOpen
+}
+
+// Open is whether the apply has failed Threshold times in a row
+func (b *Breaker) Open() bool {
+	return b.Threshold > 0 && b.failures >= b.Threshold
+}
+
+// Failures is the number of consecutive failed applies
+func (b *Breaker) Failures() int {
+	return b.failures
+}
+
+// RetryAt is when an open breaker allows the apply next
+func (b *Breaker) RetryAt() time.Time {
+	return b.retryAt
+}
+
+// Err is the error of the last failed apply, nil after a success
+func (b *Breaker) Err() error {
+	return b.lastErr
+}
@@ -0,0 +1,56 @@
+package util
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := &Breaker{Threshold: 3, Backoff: Backoff{Initial: 10 * time.Second, Max: 30 * time.Second}}
+	now := time.Now()
+	err := fmt.Errorf("iptables-restore: line 12 failed")
+
+	// failures below the threshold are retried every tick
+	for n := 1; n < 3; n++ {
+		if b.Failure(now, err) {
+			t.Fatalf("expected the breaker to stay closed after %d failures", n)
+		}
+		if !b.Allow(now) {
+			t.Fatalf("expected a retry at once after %d failures", n)
+		}
+	}
+	if !b.Failure(now, err) || !b.Open() {
+		t.Fatal("expected the third failure to open the breaker")
+	}
+	if b.Allow(now.Add(9*time.Second)) || !b.Allow(now.Add(10*time.Second)) {
+		t.Fatalf("expected a retry only after the backoff. retry at %v", b.RetryAt().Sub(now))
+	}
+
+	// every failed retry doubles the wait up to the max, and doesn't open again
+	for _, want := range []time.Duration{20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		if b.Failure(now, err) {
+			t.Fatal("expected a failed retry not to report the breaker opened again")
+		}
+		if wait := b.RetryAt().Sub(now); wait != want {
+			t.Fatalf("expected a wait of %v after %d failures. saw %v", want, b.Failures(), wait)
+		}
+	}
+	if b.Err() != err {
+		t.Fatalf("expected the last error to be kept. saw %v", b.Err())
+	}
+
+	if !b.Success() || b.Open() || b.Failures() != 0 || b.Err() != nil || !b.Allow(now) {
+		t.Fatal("expected a success to close the breaker")
+	}
+	if b.Success() {
+		t.Fatal("expected a success of a closed breaker not to report it closed")
+	}
+
+	disabled := &Breaker{}
+	for n := 0; n < 10; n++ {
+		if disabled.Failure(now, err) || !disabled.Allow(now) {
+			t.Fatal("expected a breaker without a threshold never to open")
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// RegisterDebugHandlers adds the net/http/pprof profiles under /debug/pprof/ and a
+// summary of the go runtime under /debug/runtime to mux. The handlers are
+// registered explicitly rather than by importing net/http/pprof for its side
+// effects, so that profiling is only served when asked for.
+func RegisterDebugHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/runtime", func(w http.ResponseWriter, _ *http.Request) {
+		b, err := json.MarshalIndent(readRuntimeStats(), "", " ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
+
+// runtimeStats is the go runtime state served on /debug/runtime. the same values
+// are exported continuously by the go_* prometheus metrics; this is for a quick
+// look at a single node.
+type runtimeStats struct {
+	Goroutines int `json:"goroutines"`
+	Threads    int `json:"threads"`
+
+	HeapAlloc   uint64 `json:"heapAllocBytes"`
+	HeapInuse   uint64 `json:"heapInuseBytes"`
+	HeapObjects uint64 `json:"heapObjects"`
+	HeapSys     uint64 `json:"heapSysBytes"`
+	Sys         uint64 `json:"sysBytes"`
+	TotalAlloc  uint64 `json:"totalAllocBytes"`
+
+	NumGC         uint32        `json:"numGC"`
+	LastGC        time.Time     `json:"lastGC"`
+	LastGCPause   time.Duration `json:"lastGCPauseNs"`
+	TotalGCPause  time.Duration `json:"totalGCPauseNs"`
+	NextGC        uint64        `json:"nextGCBytes"`
+	GCCPUFraction float64       `json:"gcCPUFraction"`
+}
+
+func readRuntimeStats() runtimeStats {
+	m := runtime.MemStats{}
+	runtime.ReadMemStats(&m)
+	threads, _ := runtime.ThreadCreateProfile(nil)
+
+	s := runtimeStats{
+		Goroutines:    runtime.NumGoroutine(),
+		Threads:       threads,
+		HeapAlloc:     m.HeapAlloc,
+		HeapInuse:     m.HeapInuse,
+		HeapObjects:   m.HeapObjects,
+		HeapSys:       m.HeapSys,
+		Sys:           m.Sys,
+		TotalAlloc:    m.TotalAlloc,
+		NumGC:         m.NumGC,
+		TotalGCPause:  time.Duration(m.PauseTotalNs),
+		NextGC:        m.NextGC,
+		GCCPUFraction: m.GCCPUFraction,
+	}
+	if m.NumGC > 0 {
+		s.LastGC = time.Unix(0, int64(m.LastGC))
+		s.LastGCPause = time.Duration(m.PauseNs[(m.NumGC+255)%256])
+	}
+	return s
+}
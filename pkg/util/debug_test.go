@@ -0,0 +1,32 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegisterDebugHandlers(t *testing.T) {
+	mux := http.NewServeMux()
+	RegisterDebugHandlers(mux)
+
+	res := httptest.NewRecorder()
+	mux.ServeHTTP(res, httptest.NewRequest("GET", "/debug/runtime", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected /debug/runtime to be served. saw %d", res.Code)
+	}
+	s := runtimeStats{}
+	if err := json.Unmarshal(res.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Goroutines == 0 || s.HeapAlloc == 0 {
+		t.Fatalf("expected goroutines and heap to be reported. saw %+v", s)
+	}
+
+	res = httptest.NewRecorder()
+	mux.ServeHTTP(res, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected the pprof index to be served. saw %d", res.Code)
+	}
+}
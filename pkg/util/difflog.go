@@ -0,0 +1,337 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DiffLogDebug is the DiffLog target that writes diffs to the logger at debug level
+const DiffLogDebug = "debug"
+
+// DiffLog records the unified diff between the rules in place and the rules an
+// apply is about to write, so that every change to iptables and ipvs can be
+// traced afterwards. Diffs go either to the logger at debug level or to a file
+// that is rotated once it grows past maxSize, keeping maxFiles old files
+// alongside it as path.1, path.2 and so on. A nil DiffLog records nothing.
+type DiffLog struct {
+	sync.Mutex
+
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	file *os.File
+	size int64
+
+	logger logrus.FieldLogger
+}
+
+// NewDiffLog creates a DiffLog writing to target, which is DiffLogDebug or the
+// path of a file. An empty target disables the log and returns nil.
+func NewDiffLog(target string, maxSize int64, maxFiles int, logger logrus.FieldLogger) (*DiffLog, error) {
+	if target == "" {
+		return nil, nil
+	}
+	l := &DiffLog{logger: logger}
+	if target == DiffLogDebug {
+		return l, nil
+	}
+
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("difflog: max size must be positive")
+	}
+	if maxFiles < 0 {
+		return nil, fmt.Errorf("difflog: max files must not be negative")
+	}
+	l.path = target
+	l.maxSize = maxSize
+	l.maxFiles = maxFiles
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Log records the difference between existing and desired under the name what.
+// Nothing is recorded when they are the same.
+func (l *DiffLog) Log(what string, existing, desired []string) {
+	if l == nil {
+		return
+	}
+	if l.path == "" {
+		if !logrus.IsLevelEnabled(logrus.DebugLevel) {
+			return
+		}
+		if diff := UnifiedDiff(what+" existing", what+" desired", existing, desired); diff != "" {
+			l.logger.Debugf("difflog: %s changes\n%s", what, diff)
+		}
+		return
+	}
+
+	diff := UnifiedDiff(what+" existing", what+" desired", existing, desired)
+	if diff == "" {
+		return
+	}
+	entry := fmt.Sprintf("# %s %s\n%s", time.Now().UTC().Format(time.RFC3339), what, diff)
+
+	l.Lock()
+	defer l.Unlock()
+	if l.size > 0 && l.size+int64(len(entry)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			l.logger.Errorf("difflog: unable to rotate %s. %v", l.path, err)
+		}
+	}
+	if l.file == nil {
+		return
+	}
+	n, err := l.file.WriteString(entry)
+	l.size += int64(n)
+	if err != nil {
+		l.logger.Errorf("difflog: unable to write to %s. %v", l.path, err)
+	}
+}
+
+// Close closes the file being written, if any
+func (l *DiffLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *DiffLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("difflog: unable to open %s. %v", l.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("difflog: unable to stat %s. %v", l.path, err)
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// rotate moves every kept file one number up, dropping the oldest, and starts
+// a new file at path
+func (l *DiffLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	if l.maxFiles == 0 {
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return l.open()
+	}
+	if err := os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := l.maxFiles - 1; n >= 1; n-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", l.path, n), fmt.Sprintf("%s.%d", l.path, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return l.open()
+}
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// maxDiffEdits bounds the work done to find the shortest diff. Inputs that
+// differ by more are shown as entirely removed and added.
+const maxDiffEdits = 1000
+
+// diffOp is a line of a diff: kept (' '), removed ('-') or added ('+')
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// UnifiedDiff returns the unified diff that turns a into b, with the file names
+// from and to in its header, or an empty string when they are the same
+func UnifiedDiff(from, to string, a, b []string) string {
+	ops := diffLines(a, b)
+
+	// the lines of a and b before each op, for the hunk headers
+	aLine := make([]int, len(ops)+1)
+	bLine := make([]int, len(ops)+1)
+	changes := []int{}
+	for n, op := range ops {
+		aLine[n+1], bLine[n+1] = aLine[n], bLine[n]
+		if op.kind != '+' {
+			aLine[n+1]++
+		}
+		if op.kind != '-' {
+			bLine[n+1]++
+		}
+		if op.kind != ' ' {
+			changes = append(changes, n)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", from, to)
+	for c := 0; c < len(changes); {
+		// changes closer together than twice the context share a hunk
+		last := c
+		for last+1 < len(changes) && changes[last+1]-changes[last] <= 2*diffContext {
+			last++
+		}
+		start := changes[c] - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := changes[last] + diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(aLine[start], aLine[end]-aLine[start]), hunkRange(bLine[start], bLine[end]-bLine[start]))
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			out.WriteByte('\n')
+		}
+		c = last + 1
+	}
+	return out.String()
+}
+
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", before+1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+// diffLines returns the shortest edit script from a to b
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b)-prefix-suffix)
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ops = append(ops, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// myers is the O(ND) diff of Myers' "An O(ND) Difference Algorithm and Its
+// Variations". trace[d] holds the furthest x reached on each diagonal k in
+// -d..d after d edits, at index k+d.
+func myers(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	limit := n + m
+	if limit > maxDiffEdits {
+		limit = maxDiffEdits
+	}
+
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	trace := [][]int{}
+	for d := 0; d <= limit; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		if v[offset+n-m] >= n && (n-m+d)%2 == 0 && n-m >= -d && n-m <= d {
+			return backtrack(a, b, trace)
+		}
+	}
+
+	// too different to be worth the search
+	ops := make([]diffOp, 0, n+m)
+	for _, line := range a {
+		ops = append(ops, diffOp{'-', line})
+	}
+	for _, line := range b {
+		ops = append(ops, diffOp{'+', line})
+	}
+	return ops
+}
+
+func backtrack(a, b []string, trace [][]int) []diffOp {
+	ops := []diffOp{}
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		at := func(k int) int { return prev[k+d-1] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			ops = append(ops, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 {
+		ops = append(ops, diffOp{' ', a[x-1]})
+		x--
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := []string{"*nat", ":RAVEL - [0:0]", "-A RAVEL -d 10.0.0.1/32 -j RAVEL-SVC-A", "-A RAVEL -d 10.0.0.2/32 -j RAVEL-SVC-B", "COMMIT"}
+	b := []string{"*nat", ":RAVEL - [0:0]", "-A RAVEL -d 10.0.0.1/32 -j RAVEL-SVC-A", "-A RAVEL -d 10.0.0.3/32 -j RAVEL-SVC-C", "COMMIT"}
+
+	want := `--- nat existing
++++ nat desired
+@@ -1,5 +1,5 @@
+ *nat
+ :RAVEL - [0:0]
+ -A RAVEL -d 10.0.0.1/32 -j RAVEL-SVC-A
+--A RAVEL -d 10.0.0.2/32 -j RAVEL-SVC-B
++-A RAVEL -d 10.0.0.3/32 -j RAVEL-SVC-C
+ COMMIT
+`
+	if diff := UnifiedDiff("nat existing", "nat desired", a, b); diff != want {
+		t.Fatalf("unexpected diff\n%s", diff)
+	}
+	if diff := UnifiedDiff("nat existing", "nat desired", a, a); diff != "" {
+		t.Fatalf("expected no diff between identical rules. saw\n%s", diff)
+	}
+}
+
+func TestUnifiedDiffHunks(t *testing.T) {
+	a := []string{}
+	for i := 0; i < 20; i++ {
+		a = append(a, strings.Repeat("x", i+1))
+	}
+	b := append([]string{"first"}, a[1:]...)
+	b = append(b[:18], "last")
+
+	diff := UnifiedDiff("a", "b", a, b)
+	if strings.Count(diff, "@@ -") != 2 {
+		t.Fatalf("expected changes far apart to be in separate hunks\n%s", diff)
+	}
+	if !strings.Contains(diff, "@@ -1,4 +1,4 @@\n-x\n+first\n") || !strings.Contains(diff, "@@ -16,5 +16,4 @@\n") {
+		t.Fatalf("unexpected hunks\n%s", diff)
+	}
+}
+
+func TestDiffLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "difflog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.diff")
+
+	l, err := NewDiffLog(path, 200, 2, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 6; i++ {
+		l.Log("ipvs-ipv4", []string{"-A -t 10.0.0.1:80 -s wrr"}, []string{"-A -t 10.0.0.1:80 -s wrr", "-a -t 10.0.0.1:80 -r 10.1.0.1:80 -m -w 1"})
+	}
+	l.Log("ipvs-ipv4", []string{"unchanged"}, []string{"unchanged"})
+
+	for _, name := range []string{"rules.diff", "rules.diff.1", "rules.diff.2"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) == 0 || len(b) > 200 || !strings.Contains(string(b), "+-a -t 10.0.0.1:80 -r 10.1.0.1:80 -m -w 1\n") {
+			t.Fatalf("expected %s to hold diffs within the size limit. saw\n%s", name, b)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected no more than two old files to be kept. %v", err)
+	}
+}
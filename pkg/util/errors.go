@@ -0,0 +1,72 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The classes of the errors a reconcile fails with, which decide how the
+// failure is handled. An error is given a class with WithClass or Errorf where
+// it happens, and keeps it through wrappers that use %w. Test for a class with
+// errors.Is, or name it with ErrorClass.
+var (
+	// ErrTransient is a failure that clears on its own, such as the xtables
+	// lock held by another program. It is retried without counting as a failure.
+	ErrTransient = errors.New("transient")
+
+	// ErrKernelApply is the kernel refusing, or not taking, a change. It is
+	// retried, and fails the worker once it keeps failing.
+	ErrKernelApply = errors.New("kernel apply")
+
+	// ErrConfigInvalid is a config that can't be applied as it is. Retrying it
+	// can't help, so it alerts at once and waits for the config to change.
+	ErrConfigInvalid = errors.New("config invalid")
+)
+
+// the names of the classes, for metric labels
+const (
+	ClassTransient     = "transient"
+	ClassKernelApply   = "kernel_apply"
+	ClassConfigInvalid = "config_invalid"
+	ClassUnknown       = "unknown"
+)
+
+// classError is an error of a class. Its message is that of the error alone,
+// so classifying an error doesn't change what is logged.
+type classError struct {
+	class error
+	err   error
+}
+
+func (e *classError) Error() string        { return e.err.Error() }
+func (e *classError) Unwrap() error        { return e.err }
+func (e *classError) Is(target error) bool { return target == e.class }
+
+// WithClass returns err with class, or nil when err is nil
+func WithClass(class, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classError{class: class, err: err}
+}
+
+// Errorf formats an error of class as fmt.Errorf does
+func Errorf(class error, format string, args ...interface{}) error {
+	return &classError{class: class, err: fmt.Errorf(format, args...)}
+}
+
+// ErrorClass names the class of err. An invalid config is named first, since
+// no retry fixes it, and a transient failure ahead of the kernel apply that it
+// failed.
+func ErrorClass(err error) string {
+	switch {
+	case errors.Is(err, ErrConfigInvalid):
+		return ClassConfigInvalid
+	case errors.Is(err, ErrTransient):
+		return ClassTransient
+	case errors.Is(err, ErrKernelApply):
+		return ClassKernelApply
+	default:
+		return ClassUnknown
+	}
+}
@@ -0,0 +1,33 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorClass(t *testing.T) {
+	lock := Errorf(ErrTransient, "another app is holding the xtables lock")
+	for _, c := range []struct {
+		name  string
+		err   error
+		class string
+	}{
+		{"unclassified", fmt.Errorf("boom"), ClassUnknown},
+		{"kernel", WithClass(ErrKernelApply, fmt.Errorf("ipvsadm exited 2")), ClassKernelApply},
+		{"wrapped", fmt.Errorf("director: unable to apply. %w", lock), ClassTransient},
+		{"transient kernel apply", WithClass(ErrKernelApply, lock), ClassTransient},
+		{"invalid", WithClass(ErrTransient, Errorf(ErrConfigInvalid, "shrink refused")), ClassConfigInvalid},
+	} {
+		if class := ErrorClass(c.err); class != c.class {
+			t.Errorf("%s: expected class %s. saw %s", c.name, c.class, class)
+		}
+	}
+
+	if WithClass(ErrKernelApply, nil) != nil {
+		t.Fatal("expected no error for a nil error")
+	}
+	if err := WithClass(ErrKernelApply, errors.New("ipvsadm exited 2")); err.Error() != "ipvsadm exited 2" {
+		t.Fatalf("expected the message to be unchanged. saw %q", err.Error())
+	}
+}
@@ -0,0 +1,161 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FreezeWindow is a recurring period during which configuration changes are
+// held back. It starts at every minute matching a cron expression and lasts
+// for Duration. Times are matched in UTC.
+type FreezeWindow struct {
+	Spec     string
+	Duration time.Duration
+
+	minute, hour, dom, month, dow []bool
+	domStar, dowStar              bool
+}
+
+// FreezeSchedule is a set of freeze windows. The zero value is never frozen.
+type FreezeSchedule []*FreezeWindow
+
+// ParseFreezeSchedule parses freeze windows separated by semicolons. Each window
+// is a five field cron expression - minute, hour, day of month, month and day of
+// week - followed by a duration, so '0 18 * * 5 4h' freezes from 18:00 to 22:00
+// every Friday. Fields accept *, numbers, ranges, lists and steps.
+func ParseFreezeSchedule(s string) (FreezeSchedule, error) {
+	schedule := FreezeSchedule{}
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		w, err := ParseFreezeWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, w)
+	}
+	return schedule, nil
+}
+
+// ParseFreezeWindow parses a single freeze window
+func ParseFreezeWindow(spec string) (*FreezeWindow, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("freeze window %q must have five cron fields and a duration", spec)
+	}
+	d, err := time.ParseDuration(fields[5])
+	if err != nil {
+		return nil, fmt.Errorf("freeze window %q has an invalid duration. %v", spec, err)
+	}
+	if d <= 0 {
+		return nil, fmt.Errorf("freeze window %q must have a positive duration", spec)
+	}
+
+	w := &FreezeWindow{Spec: spec, Duration: d}
+	for _, f := range []struct {
+		field    string
+		min, max int
+		out      *[]bool
+	}{
+		{fields[0], 0, 59, &w.minute},
+		{fields[1], 0, 23, &w.hour},
+		{fields[2], 1, 31, &w.dom},
+		{fields[3], 1, 12, &w.month},
+		{fields[4], 0, 7, &w.dow},
+	} {
+		set, err := parseCronField(f.field, f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("freeze window %q has an invalid field %q. %v", spec, f.field, err)
+		}
+		*f.out = set
+	}
+	// sunday is both 0 and 7
+	w.dow[0] = w.dow[0] || w.dow[7]
+	w.domStar = fields[2] == "*"
+	w.dowStar = fields[4] == "*"
+	return w, nil
+}
+
+// parseCronField returns the values matched by a cron field, indexed by value
+func parseCronField(field string, min, max int) ([]bool, error) {
+	set := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", bounds[0])
+			}
+			lo, hi = n, n
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", bounds[1])
+				}
+			} else if step > 1 {
+				// 5/15 means every 15 starting at 5
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%d-%d is outside of %d-%d", lo, hi, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// starts returns true when the window starts in the minute of t
+func (w *FreezeWindow) starts(t time.Time) bool {
+	if !w.minute[t.Minute()] || !w.hour[t.Hour()] || !w.month[int(t.Month())] {
+		return false
+	}
+	// as in cron, when both days are restricted either one may match
+	dom, dow := w.dom[t.Day()], w.dow[int(t.Weekday())]
+	switch {
+	case w.domStar && w.dowStar:
+		return true
+	case w.domStar:
+		return dow
+	case w.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+// Active returns true when t falls within the window
+func (w *FreezeWindow) Active(t time.Time) bool {
+	t = t.UTC()
+	for start := t.Truncate(time.Minute); t.Sub(start) < w.Duration; start = start.Add(-time.Minute) {
+		if w.starts(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// Active returns the window that t falls within, or nil when no window is active
+func (s FreezeSchedule) Active(t time.Time) *FreezeWindow {
+	for _, w := range s {
+		if w.Active(t) {
+			return w
+		}
+	}
+	return nil
+}
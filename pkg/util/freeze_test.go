@@ -0,0 +1,58 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFreezeSchedule(t *testing.T) {
+	schedule, err := ParseFreezeSchedule("0 18 * * 5 4h; 30 2 1,15 * * 30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedule) != 2 {
+		t.Fatalf("expected 2 windows. have %d", len(schedule))
+	}
+
+	for _, tc := range []struct {
+		at     string
+		frozen bool
+	}{
+		{"2021-06-04T17:59:00Z", false}, // friday
+		{"2021-06-04T18:00:00Z", true},
+		{"2021-06-04T21:59:59Z", true},
+		{"2021-06-04T22:00:00Z", false},
+		{"2021-06-05T18:30:00Z", false}, // saturday
+		{"2021-06-15T02:45:00Z", true},
+		{"2021-06-15T03:00:00Z", false},
+		{"2021-06-16T02:45:00Z", false},
+	} {
+		at, err := time.Parse(time.RFC3339, tc.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frozen := schedule.Active(at) != nil; frozen != tc.frozen {
+			t.Errorf("expected frozen=%v at %s", tc.frozen, tc.at)
+		}
+	}
+
+	// a window that crosses midnight is still active the next day
+	w, err := ParseFreezeWindow("0 22 * * 0 6h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.Active(time.Date(2021, 6, 7, 3, 0, 0, 0, time.UTC)) {
+		t.Error("expected the sunday window to be active on monday morning")
+	}
+
+	for _, spec := range []string{"0 18 * * 5", "0 24 * * * 1h", "*/0 * * * * 1h", "0 18 * * 5 -1h", "5-1 * * * * 1h"} {
+		if _, err := ParseFreezeSchedule(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+
+	empty, err := ParseFreezeSchedule("")
+	if err != nil || empty.Active(time.Now()) != nil {
+		t.Fatalf("expected an empty schedule to never freeze. %v", err)
+	}
+}
@@ -7,11 +7,47 @@ import (
 	"net/http"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// unhealthy is the reasons, by component, that /health reports the node unhealthy
+var unhealthy = struct {
+	sync.Mutex
+	reasons map[string]string
+}{reasons: map[string]string{}}
+
+// MarkUnhealthy makes /health respond 503 with reason until MarkHealthy is
+// called for component
+func MarkUnhealthy(component, reason string) {
+	unhealthy.Lock()
+	defer unhealthy.Unlock()
+	unhealthy.reasons[component] = reason
+}
+
+// MarkHealthy clears the reason component was marked unhealthy for, if any
+func MarkHealthy(component string) {
+	unhealthy.Lock()
+	defer unhealthy.Unlock()
+	delete(unhealthy.reasons, component)
+}
+
+// UnhealthyReasons returns a copy of the reasons, by component, the node is marked unhealthy
+func UnhealthyReasons() map[string]string {
+	unhealthy.Lock()
+	defer unhealthy.Unlock()
+	if len(unhealthy.reasons) == 0 {
+		return nil
+	}
+	reasons := make(map[string]string, len(unhealthy.reasons))
+	for component, reason := range unhealthy.reasons {
+		reasons[component] = reason
+	}
+	return reasons
+}
+
 // listens on a port and returns a set of information about the health of the system
 func ListenForHealth(primaryInterface string, port int, logger logrus.FieldLogger) {
 	logger.Infof("initializing /health handler on port %d", port)
@@ -22,7 +58,11 @@ func ListenForHealth(primaryInterface string, port int, logger logrus.FieldLogge
 			logger.Info("request completed in %v", time.Since(start))
 		}()
 		data := health(primaryInterface, logger)
+		data.Unhealthy = UnhealthyReasons()
 		b, _ := json.MarshalIndent(data, " ", " ")
+		if len(data.Unhealthy) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
 		w.Write(b)
 	})
 
@@ -39,6 +79,9 @@ type healthData struct {
 	IPVS      []string            `json:"ipvs,omitempty"`
 
 	Errors []string `json:"errors,omitempty"`
+
+	// Unhealthy is why, by component, the node is marked unhealthy
+	Unhealthy map[string]string `json:"unhealthy,omitempty"`
 }
 
 func health(primaryInterface string, logger logrus.FieldLogger) *healthData {
@@ -0,0 +1,24 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarkUnhealthy(t *testing.T) {
+	if reasons := UnhealthyReasons(); reasons != nil {
+		t.Fatalf("expected a healthy node. saw %v", reasons)
+	}
+
+	MarkUnhealthy("director", "reconcile panicked")
+	MarkUnhealthy("realserver", "reconcile panicked")
+	MarkHealthy("realserver")
+	if reasons := UnhealthyReasons(); !reflect.DeepEqual(reasons, map[string]string{"director": "reconcile panicked"}) {
+		t.Fatalf("expected only the director to be unhealthy. saw %v", reasons)
+	}
+
+	MarkHealthy("director")
+	if reasons := UnhealthyReasons(); reasons != nil {
+		t.Fatalf("expected a healthy node once every component recovered. saw %v", reasons)
+	}
+}
@@ -54,6 +54,8 @@ type Table string
 const (
 	TableNAT    Table = "nat"
 	TableFilter Table = "filter"
+	TableMangle Table = "mangle"
+	TableRaw    Table = "raw"
 )
 
 type Chain string
@@ -70,10 +72,12 @@ const (
 )
 
 const (
-	cmdIptablesSave    string = "iptables-save"
-	cmdIptablesRestore string = "iptables-restore"
-	cmdIptables        string = "iptables"
-	cmdIp6tables       string = "ip6tables"
+	cmdIptablesSave     string = "iptables-save"
+	cmdIptablesRestore  string = "iptables-restore"
+	cmdIptables         string = "iptables"
+	cmdIp6tablesSave    string = "ip6tables-save"
+	cmdIp6tablesRestore string = "ip6tables-restore"
+	cmdIp6tables        string = "ip6tables"
 )
 
 // Option flag for Restore
@@ -96,6 +100,16 @@ const MinCheckVersion = "1.4.11"
 const MinWaitVersion = "1.4.20"
 const MinWait2Version = "1.4.22"
 
+// MinRestoreWaitVersion is the first version whose iptables-restore takes the
+// xtables lock, and so supports -w
+const MinRestoreWaitVersion = "1.6.2"
+
+// lock contention backoff of SetLockWait, doubling from the first to the most
+const (
+	lockBackoff    = 100 * time.Millisecond
+	lockBackoffMax = 2 * time.Second
+)
+
 // Runner implements Interface in terms of exec("iptables").
 type Runner struct {
 	mu       sync.Mutex
@@ -105,6 +119,16 @@ type Runner struct {
 	hasCheck bool
 	waitFlag []string
 
+	// restoreWait is set when iptables-restore supports -w. lockWait, when
+	// set, replaces the default wait for the xtables lock, see SetLockWait
+	restoreWait    bool
+	lockWait       time.Duration
+	lockRetries    int
+	lockContention func()
+
+	// scope, when set, is the context commands run under, see SetScope
+	scope *Scope
+
 	reloadFuncs []func()
 	signal      chan *godbus.Signal
 }
@@ -115,6 +139,11 @@ func NewDefault() *Runner {
 	return New(utilexec.New(), utildbus.New(), ProtocolIpv4)
 }
 
+// NewDefault6 is NewDefault for ip6tables
+func NewDefault6() *Runner {
+	return New(utilexec.New(), utildbus.New(), ProtocolIpv6)
+}
+
 // New returns a new Interface which will exec iptables.
 func New(exec utilexec.Interface, dbus utildbus.Interface, protocol Protocol) *Runner {
 	vstring, err := getIptablesVersionString(exec)
@@ -128,11 +157,84 @@ func New(exec utilexec.Interface, dbus utildbus.Interface, protocol Protocol) *R
 		protocol: protocol,
 		hasCheck: getIptablesHasCheckCommand(vstring),
 		waitFlag: getIptablesWaitFlag(vstring),
+
+		restoreWait: versionAtLeast(vstring, MinRestoreWaitVersion),
 	}
 	runner.ConnectToFirewallD()
 	return runner
 }
 
+// SetScope runs commands under the context of scope, so that a caller that
+// binds it can cancel them. Each command still times out on its own.
+func (runner *Runner) SetScope(scope *Scope) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	runner.scope = scope
+}
+
+// parent is the context commands run under
+func (runner *Runner) parent() context.Context {
+	if runner.scope != nil {
+		return runner.scope.Context()
+	}
+	return context.Background()
+}
+
+// SetLockWait makes commands wait up to wait for the xtables lock that other
+// programs, i.e. kube-proxy, hold while they write, rather than the default of
+// 2 seconds, and makes restores wait for it too when iptables-restore supports
+// that. A command that still fails on the lock is retried up to retries times
+// with a backoff, and contention, when not nil, is called each time.
+func (runner *Runner) SetLockWait(wait time.Duration, retries int, contention func()) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	runner.lockWait = wait
+	runner.lockRetries = retries
+	runner.lockContention = contention
+	if wait > 0 && runner.waitFlag != nil {
+		runner.waitFlag = []string{"-w", waitSeconds(wait)}
+	}
+}
+
+// waitSeconds renders d as the whole seconds -w takes, rounding up
+func waitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%d", (d+time.Second-1)/time.Second)
+}
+
+// withLockRetry runs f until it succeeds, fails on something other than the
+// xtables lock, or has been retried as often as SetLockWait allows
+func (runner *Runner) withLockRetry(f func() ([]byte, error)) ([]byte, error) {
+	backoff := lockBackoff
+	for try := 0; ; try++ {
+		b, err := f()
+		if err == nil || !isLockContention(b, err) {
+			return b, err
+		}
+		if runner.lockContention != nil {
+			runner.lockContention()
+		}
+		if try >= runner.lockRetries {
+			return b, err
+		}
+		log.Warnf("runner: xtables lock is held by another program. retrying in %v", backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > lockBackoffMax {
+			backoff = lockBackoffMax
+		}
+	}
+}
+
+// isLockContention returns true when a command failed because another program
+// held the xtables lock
+func isLockContention(out []byte, err error) bool {
+	for _, s := range []string{string(out), err.Error()} {
+		if strings.Contains(s, "xtables lock") || strings.Contains(s, "Resource temporarily unavailable") {
+			return true
+		}
+	}
+	return false
+}
+
 // Destroy is part of Interface.
 func (runner *Runner) Destroy() {
 	if runner.signal != nil {
@@ -281,10 +383,10 @@ func (runner *Runner) Save(table Table) ([]byte, error) {
 	args := []string{"-t", string(table)}
 	glog.V(4).Infof("running iptables-save %v", args)
 
-	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second*30)
+	ctx, ctxCancel := context.WithTimeout(runner.parent(), time.Second*30)
 	defer ctxCancel()
 
-	return runner.exec.CommandContext(ctx, cmdIptablesSave, args...).CombinedOutput()
+	return runner.exec.CommandContext(ctx, runner.saveCommand(), args...).CombinedOutput()
 }
 
 func (runner *Runner) SaveAll() ([]byte, error) {
@@ -295,10 +397,10 @@ func (runner *Runner) SaveAll() ([]byte, error) {
 	// run and return
 	glog.V(4).Infof("running iptables-save")
 
-	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second*30)
+	ctx, ctxCancel := context.WithTimeout(runner.parent(), time.Second*30)
 	defer ctxCancel()
 
-	return runner.exec.CommandContext(ctx, cmdIptablesSave, []string{}...).CombinedOutput()
+	return runner.exec.CommandContext(ctx, runner.saveCommand(), []string{}...).CombinedOutput()
 }
 
 func (runner *Runner) Restore(table Table, data []byte, flush FlushFlag, counters RestoreCountersFlag) error {
@@ -326,16 +428,26 @@ func (runner *Runner) restoreInternal(args []string, data []byte, flush FlushFla
 	if counters {
 		args = append(args, "--counters")
 	}
-
-	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second*30)
-	defer ctxCancel()
+	if runner.lockWait > 0 && runner.restoreWait {
+		args = append(args, "-w", waitSeconds(runner.lockWait))
+	}
 
 	// run the command and return the output or an error including the output and error
-	cmd := runner.exec.CommandContext(ctx, cmdIptablesRestore, args...)
-	cmd.SetStdin(bytes.NewBuffer(data))
-	b, err := cmd.CombinedOutput()
+	b, err := runner.withLockRetry(func() ([]byte, error) {
+		ctx, ctxCancel := context.WithTimeout(runner.parent(), time.Second*30)
+		defer ctxCancel()
+
+		cmd := runner.exec.CommandContext(ctx, runner.restoreCommand(), args...)
+		cmd.SetStdin(bytes.NewBuffer(data))
+		return cmd.CombinedOutput()
+	})
 	if err != nil {
-		return fmt.Errorf("%v (%s)", err, b)
+		// contention outlasting the retries clears once the other program is done
+		class := ErrKernelApply
+		if isLockContention(b, err) {
+			class = ErrTransient
+		}
+		return Errorf(class, "%v (%s)", err, b)
 	}
 	return nil
 }
@@ -348,17 +460,35 @@ func (runner *Runner) iptablesCommand() string {
 	}
 }
 
+// saveCommand returns the save binary of the runner's protocol
+func (runner *Runner) saveCommand() string {
+	if runner.IsIpv6() {
+		return cmdIp6tablesSave
+	}
+	return cmdIptablesSave
+}
+
+// restoreCommand returns the restore binary of the runner's protocol
+func (runner *Runner) restoreCommand() string {
+	if runner.IsIpv6() {
+		return cmdIp6tablesRestore
+	}
+	return cmdIptablesRestore
+}
+
 func (runner *Runner) run(op operation, args []string) ([]byte, error) {
 	iptablesCmd := runner.iptablesCommand()
 
-	fullArgs := append(runner.waitFlag, string(op))
+	fullArgs := append(append([]string{}, runner.waitFlag...), string(op))
 	fullArgs = append(fullArgs, args...)
 	log.Debugln("runner: running iptables commands:", string(op), args)
 
-	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second*30)
-	defer ctxCancel()
+	return runner.withLockRetry(func() ([]byte, error) {
+		ctx, ctxCancel := context.WithTimeout(runner.parent(), time.Second*30)
+		defer ctxCancel()
 
-	return runner.exec.CommandContext(ctx, iptablesCmd, fullArgs...).CombinedOutput()
+		return runner.exec.CommandContext(ctx, iptablesCmd, fullArgs...).CombinedOutput()
+	})
 }
 
 // Returns (bool, nil) if it was able to check the existence of the rule, or
@@ -377,10 +507,10 @@ func (runner *Runner) checkRule(table Table, chain Chain, args ...string) (bool,
 func (runner *Runner) checkRuleWithoutCheck(table Table, chain Chain, args ...string) (bool, error) {
 	glog.V(1).Infof("running iptables-save -t %s", string(table))
 
-	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second*45)
+	ctx, ctxCancel := context.WithTimeout(runner.parent(), time.Second*45)
 	defer ctxCancel()
 
-	out, err := runner.exec.CommandContext(ctx, cmdIptablesSave, "-t", string(table)).CombinedOutput()
+	out, err := runner.exec.CommandContext(ctx, runner.saveCommand(), "-t", string(table)).CombinedOutput()
 	if err != nil {
 		return false, fmt.Errorf("error checking rule: %v", err)
 	}
@@ -500,6 +630,19 @@ func getIptablesWaitFlag(vstring string) []string {
 	}
 }
 
+// versionAtLeast returns true when vstring is a version no older than min
+func versionAtLeast(vstring, min string) bool {
+	version, err := semver.NewVersion(vstring)
+	if err != nil {
+		return false
+	}
+	minVersion, err := semver.NewVersion(min)
+	if err != nil {
+		return false
+	}
+	return !version.LessThan(*minVersion)
+}
+
 // getIptablesVersionString runs "iptables --version" to get the version string
 // in the form "X.X.X"
 func getIptablesVersionString(exec utilexec.Interface) (string, error) {
@@ -0,0 +1,56 @@
+package util
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockRetry(t *testing.T) {
+	contended := 0
+	runner := &Runner{}
+	runner.SetLockWait(5*time.Second, 2, func() { contended++ })
+
+	held := errors.New("exit status 4")
+	out := []byte("Another app is currently holding the xtables lock. Perhaps you want to use the -w option?")
+
+	// the lock is released before the retries run out
+	calls := 0
+	if _, err := runner.withLockRetry(func() ([]byte, error) {
+		calls++
+		if calls < 2 {
+			return out, held
+		}
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || contended != 1 {
+		t.Fatalf("expected a single retry. have %d calls and %d waits", calls, contended)
+	}
+
+	// the lock stays held
+	calls, contended = 0, 0
+	if _, err := runner.withLockRetry(func() ([]byte, error) {
+		calls++
+		return out, held
+	}); err != held {
+		t.Fatalf("expected the lock error once the retries run out. have %v", err)
+	}
+	if calls != 3 || contended != 3 {
+		t.Fatalf("expected 2 retries. have %d calls and %d waits", calls, contended)
+	}
+
+	// other errors aren't retried
+	calls = 0
+	if _, err := runner.withLockRetry(func() ([]byte, error) {
+		calls++
+		return []byte("iptables-restore: line 3 failed"), errors.New("exit status 1")
+	}); err == nil || calls != 1 {
+		t.Fatalf("expected other errors to be returned at once. have %v after %d calls", err, calls)
+	}
+
+	if s := waitSeconds(1500 * time.Millisecond); s != "2" {
+		t.Fatalf("expected the wait to round up to whole seconds. have %s", s)
+	}
+}
@@ -0,0 +1,197 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RunGroup tracks a set of named goroutines that share a lifetime, so that a
+// worker can wait for all of them on shutdown and find out which failed. A
+// goroutine that panics is recovered and its panic kept as its error.
+type RunGroup struct {
+	sync.Mutex
+	wg      sync.WaitGroup
+	running map[string]int
+	err     error
+}
+
+// NewRunGroup creates an empty RunGroup
+func NewRunGroup() *RunGroup {
+	return &RunGroup{running: map[string]int{}}
+}
+
+// Go runs fn in a goroutine called name. The first error returned by any
+// goroutine in the group is kept and returned by Err.
+func (g *RunGroup) Go(name string, fn func() error) {
+	g.start(name)
+	go func() {
+		defer g.done(name)
+		g.fail(g.run(name, fn))
+	}()
+}
+
+// Backoff is how long a supervised goroutine waits before it is restarted. The
+// wait starts at Initial and doubles with every consecutive failure up to Max.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// Next returns the wait before the restart that follows failures consecutive failures
+func (b Backoff) Next(failures int) time.Duration {
+	wait := b.Initial
+	for n := 1; n < failures && wait < b.Max; n++ {
+		wait *= 2
+	}
+	if wait > b.Max {
+		wait = b.Max
+	}
+	return wait
+}
+
+// GoSupervised runs fn in a goroutine called name, like Go, but restarts it
+// after backoff when it fails, until ctx is done. onFailure, when set, is
+// called with every failure and the number of consecutive failures before the
+// restart. A run that lasted at least backoff.Max resets the count. fn
+// returning nil ends the goroutine for good.
+func (g *RunGroup) GoSupervised(ctx context.Context, name string, backoff Backoff, fn func() error, onFailure func(err error, failures int)) {
+	g.start(name)
+	go func() {
+		defer g.done(name)
+		failures := 0
+		for {
+			started := time.Now()
+			err := g.run(name, fn)
+			if err == nil {
+				return
+			}
+			g.fail(err)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if time.Since(started) >= backoff.Max {
+				failures = 0
+			}
+			failures++
+			if onFailure != nil {
+				onFailure(err, failures)
+			}
+
+			t := time.NewTimer(backoff.Next(failures))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (g *RunGroup) start(name string) {
+	g.Lock()
+	g.running[name]++
+	g.Unlock()
+	g.wg.Add(1)
+}
+
+func (g *RunGroup) done(name string) {
+	g.Lock()
+	g.running[name]--
+	if g.running[name] == 0 {
+		delete(g.running, name)
+	}
+	g.Unlock()
+	g.wg.Done()
+}
+
+// run calls fn, turning a panic into an error
+func (g *RunGroup) run(name string, fn func() error) error {
+	if err := Recover(name, fn); err != nil {
+		if _, ok := err.(*PanicError); ok {
+			return err
+		}
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// PanicError is a panic recovered by Recover
+type PanicError struct {
+	Name  string
+	Value interface{}
+	Stack []byte
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("%s panicked: %v\n%s", p.Name, p.Value, p.Stack)
+}
+
+// Recover calls fn and returns its error. If fn panics, the panic is recovered
+// and returned as a *PanicError instead, so that the caller decides what
+// becomes of a half finished operation rather than the whole process dying.
+func Recover(name string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Name: name, Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return fn()
+}
+
+// fail keeps err if it is the group's first
+func (g *RunGroup) fail(err error) {
+	if err == nil {
+		return
+	}
+	g.Lock()
+	if g.err == nil {
+		g.err = err
+	}
+	g.Unlock()
+}
+
+// Err returns the first error returned by a goroutine in the group, or nil
+func (g *RunGroup) Err() error {
+	g.Lock()
+	defer g.Unlock()
+	return g.err
+}
+
+// Running returns the names of the goroutines that have not returned, sorted.
+// A name started more than once is listed once per goroutine.
+func (g *RunGroup) Running() []string {
+	g.Lock()
+	defer g.Unlock()
+	names := []string{}
+	for name, n := range g.running {
+		for i := 0; i < n; i++ {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Wait blocks until every goroutine in the group has returned or timeout has
+// passed. It returns the goroutines still running, which are leaked when the
+// caller gives up on them.
+func (g *RunGroup) Wait(timeout time.Duration) []string {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return g.Running()
+	}
+}
@@ -0,0 +1,114 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunGroup(t *testing.T) {
+	g := NewRunGroup()
+	stop := make(chan struct{})
+	for _, name := range []string{"periodic", "watches", "watches"} {
+		g.Go(name, func() error {
+			<-stop
+			return nil
+		})
+	}
+	g.Go("failed", func() error { return fmt.Errorf("unable to start") })
+	g.Go("panicked", func() error { panic("nil map") })
+
+	// the goroutines that block have not returned yet
+	if running := g.Wait(50 * time.Millisecond); !reflect.DeepEqual(running, []string{"periodic", "watches", "watches"}) {
+		t.Fatalf("expected periodic and two watches to be running. saw %v", running)
+	}
+	if err := g.Err(); err == nil || !strings.HasPrefix(err.Error(), "failed: unable to start") && !strings.HasPrefix(err.Error(), "panicked panicked: nil map") {
+		t.Fatalf("expected the first failure to be kept. saw %v", err)
+	}
+
+	close(stop)
+	if running := g.Wait(time.Second); len(running) != 0 {
+		t.Fatalf("expected every goroutine to have returned. saw %v", running)
+	}
+}
+
+func TestBackoffNext(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 5 * time.Second}
+	for failures, want := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if wait := b.Next(failures); wait != want {
+			t.Fatalf("expected a wait of %v after %d failures. saw %v", want, failures, wait)
+		}
+	}
+}
+
+func TestGoSupervised(t *testing.T) {
+	g := NewRunGroup()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runs := 0
+	failures := []int{}
+	done := make(chan struct{})
+	g.GoSupervised(ctx, "periodic", Backoff{Initial: time.Millisecond, Max: time.Second}, func() error {
+		runs++
+		switch runs {
+		case 1:
+			return fmt.Errorf("apply failed")
+		case 2:
+			panic("nil map")
+		}
+		close(done)
+		<-ctx.Done()
+		return nil
+	}, func(err error, n int) {
+		failures = append(failures, n)
+	})
+
+	<-done
+	if !reflect.DeepEqual(failures, []int{1, 2}) {
+		t.Fatalf("expected two consecutive failures before the third run. saw %v", failures)
+	}
+	if err := g.Err(); err == nil || err.Error() != "periodic: apply failed" {
+		t.Fatalf("expected the first failure to be kept. saw %v", err)
+	}
+
+	cancel()
+	if running := g.Wait(time.Second); len(running) != 0 {
+		t.Fatalf("expected the supervised goroutine to exit with its context. saw %v", running)
+	}
+}
+
+func TestGoSupervisedStopsDuringBackoff(t *testing.T) {
+	g := NewRunGroup()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	g.GoSupervised(ctx, "watches", Backoff{Initial: time.Hour, Max: time.Hour}, func() error {
+		return fmt.Errorf("watch closed")
+	}, func(error, int) { cancel() })
+
+	if running := g.Wait(time.Second); len(running) != 0 {
+		t.Fatalf("expected the supervised goroutine to give up its backoff when canceled. saw %v", running)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	if err := Recover("apply", func() error { return fmt.Errorf("restore failed") }); err == nil || err.Error() != "restore failed" {
+		t.Fatalf("expected the error to be returned as is. saw %v", err)
+	}
+
+	err := Recover("apply", func() error {
+		var rules map[string][]string
+		rules["RAVEL"] = nil
+		return nil
+	})
+	p, ok := err.(*PanicError)
+	if !ok {
+		t.Fatalf("expected a recovered panic. saw %v", err)
+	}
+	if p.Name != "apply" || !strings.HasPrefix(p.Error(), "apply panicked: assignment to entry in nil map") || len(p.Stack) == 0 {
+		t.Fatalf("expected the panic to be kept with its stack. saw %v", p)
+	}
+}
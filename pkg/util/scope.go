@@ -0,0 +1,46 @@
+package util
+
+import (
+	"context"
+	"sync"
+)
+
+// Scope is the context the commands of an executor run under. It is the
+// context it was created with, or a narrower one while a caller, such as a
+// stage of a reconcile, has bound its own, so that the deadline and
+// cancellation of the caller reach the commands it runs. Executors that share
+// a Scope are bound together.
+type Scope struct {
+	mu    sync.Mutex
+	base  context.Context
+	bound context.Context
+}
+
+// NewScope creates a Scope of base
+func NewScope(base context.Context) *Scope {
+	return &Scope{base: base}
+}
+
+// Bind runs commands under ctx until release is called, which restores the
+// context bound before
+func (s *Scope) Bind(ctx context.Context) (release func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.bound
+	s.bound = ctx
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.bound = prev
+	}
+}
+
+// Context returns the context to run a command under
+func (s *Scope) Context() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bound != nil {
+		return s.bound
+	}
+	return s.base
+}
@@ -0,0 +1,29 @@
+package util
+
+import (
+	"context"
+	"testing"
+)
+
+func TestScope(t *testing.T) {
+	base := context.Background()
+	s := NewScope(base)
+	if s.Context() != base {
+		t.Fatal("expected commands to run under the base context when nothing is bound")
+	}
+
+	stage, cancel := context.WithCancel(base)
+	release := s.Bind(stage)
+	if s.Context() != stage {
+		t.Fatal("expected commands to run under the bound context")
+	}
+	cancel()
+	if s.Context().Err() != context.Canceled {
+		t.Fatal("expected the cancellation of the bound context to reach the commands")
+	}
+
+	release()
+	if s.Context() != base {
+		t.Fatal("expected the release to restore the base context")
+	}
+}
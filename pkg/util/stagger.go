@@ -0,0 +1,81 @@
+package util
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// StaggeredTicker delivers ticks at a fixed interval, like time.Ticker, but at a
+// phase derived from a key such as the node name. Nodes that start at the same
+// moment therefore tick at different times, and a given node always ticks at the
+// same point in the interval across restarts.
+//
+// A StaggeredTicker with an interval of zero or less never ticks.
+type StaggeredTicker struct {
+	C <-chan time.Time
+
+	c    chan time.Time
+	stop chan struct{}
+}
+
+// NewStaggeredTicker creates a ticker with the given interval whose phase is
+// determined by key
+func NewStaggeredTicker(interval time.Duration, key string) *StaggeredTicker {
+	c := make(chan time.Time, 1)
+	t := &StaggeredTicker{
+		C:    c,
+		c:    c,
+		stop: make(chan struct{}),
+	}
+	if interval > 0 {
+		go t.run(interval, StaggerOffset(interval, key))
+	}
+	return t
+}
+
+// StaggerOffset returns the phase within interval at which key should run
+func StaggerOffset(interval time.Duration, key string) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+// nextStaggeredTick returns the first time after now that falls on offset within interval
+func nextStaggeredTick(now time.Time, interval, offset time.Duration) time.Time {
+	phase := time.Duration(now.UnixNano() % int64(interval))
+	wait := offset - phase
+	if wait <= 0 {
+		wait += interval
+	}
+	return now.Add(wait)
+}
+
+func (t *StaggeredTicker) run(interval, offset time.Duration) {
+	timer := time.NewTimer(time.Until(nextStaggeredTick(time.Now(), interval, offset)))
+	defer timer.Stop()
+	for {
+		select {
+		case now := <-timer.C:
+			// drop the tick if the reader is behind, as time.Ticker does
+			select {
+			case t.c <- now:
+			default:
+			}
+			timer.Reset(time.Until(nextStaggeredTick(time.Now(), interval, offset)))
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Stop turns off the ticker. A tick that was already buffered may still be read.
+func (t *StaggeredTicker) Stop() {
+	select {
+	case <-t.stop:
+	default:
+		close(t.stop)
+	}
+}
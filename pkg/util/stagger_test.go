@@ -0,0 +1,49 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStaggerOffset(t *testing.T) {
+	interval := time.Minute
+	a := StaggerOffset(interval, "10.131.153.76")
+	if a != StaggerOffset(interval, "10.131.153.76") {
+		t.Fatal("expected the offset for a key to be stable")
+	}
+	if a < 0 || a >= interval {
+		t.Fatalf("expected the offset to be within the interval. saw %v", a)
+	}
+	if a == StaggerOffset(interval, "10.131.153.77") {
+		t.Fatal("expected different nodes to have different offsets")
+	}
+	if StaggerOffset(0, "10.131.153.76") != 0 {
+		t.Fatal("expected a zero offset for a disabled interval")
+	}
+}
+
+func TestNextStaggeredTick(t *testing.T) {
+	interval := time.Minute
+	offset := 10 * time.Second
+	now := time.Unix(600, 0) // on an interval boundary
+
+	next := nextStaggeredTick(now, interval, offset)
+	if next.Sub(now) != offset {
+		t.Fatalf("expected the next tick %v after now. saw %v", offset, next.Sub(now))
+	}
+
+	// exactly on the offset, the next tick is a full interval away
+	if d := nextStaggeredTick(next, interval, offset).Sub(next); d != interval {
+		t.Fatalf("expected the following tick %v later. saw %v", interval, d)
+	}
+}
+
+func TestStaggeredTickerDisabled(t *testing.T) {
+	ticker := NewStaggeredTicker(0, "10.131.153.76")
+	defer ticker.Stop()
+	select {
+	case <-ticker.C:
+		t.Fatal("expected a disabled ticker never to tick")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
@@ -0,0 +1,130 @@
+package watcher
+
+import (
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// APIOptions reduce the load the watcher puts on the api server, which matters
+// on clusters with thousands of nodes
+type APIOptions struct {
+	// NodeSelector is a label selector limiting the nodes that are watched, i.e.
+	// to the nodes that run realservers. Empty watches every node.
+	NodeSelector string
+
+	// Protobuf asks the api server for protobuf rather than JSON, which is
+	// cheaper for both to encode and decode. The server falls back to JSON for
+	// anything it can't send as protobuf.
+	Protobuf bool
+}
+
+// configure sets the content types of the options on a client config
+func (o APIOptions) configure(config *rest.Config) {
+	if o.Protobuf {
+		config.ContentType = "application/vnd.kubernetes.protobuf"
+		config.AcceptContentTypes = "application/vnd.kubernetes.protobuf,application/json"
+	}
+}
+
+// nodeListOptions limits the list and watch of nodes to the selected ones
+func (o APIOptions) nodeListOptions(options *metav1.ListOptions) {
+	options.LabelSelector = o.NodeSelector
+}
+
+// lastAppliedAnnotation is set by kubectl apply to the whole object it applied
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// The trim functions drop the fields of objects that Ravel doesn't use before
+// they are stored, as every snapshot of the watcher deep copies them. The
+// managed fields and the last applied configuration are often larger than the
+// rest of an object.
+
+// trimMeta drops the managed fields and last applied configuration of meta
+func trimMeta(meta *metav1.ObjectMeta) {
+	meta.ManagedFields = nil
+	if _, ok := meta.Annotations[lastAppliedAnnotation]; ok {
+		annotations := make(map[string]string, len(meta.Annotations)-1)
+		for k, v := range meta.Annotations {
+			if k != lastAppliedAnnotation {
+				annotations[k] = v
+			}
+		}
+		meta.Annotations = annotations
+	}
+}
+
+// trimService returns a copy of service without the fields Ravel doesn't use
+func trimService(service *v1.Service) *v1.Service {
+	s := service.DeepCopy()
+	trimMeta(&s.ObjectMeta)
+	return s
+}
+
+// trimEndpoints returns a copy of endpoints without the fields Ravel doesn't use
+func trimEndpoints(endpoints *v1.Endpoints) *v1.Endpoints {
+	ep := endpoints.DeepCopy()
+	trimMeta(&ep.ObjectMeta)
+	return ep
+}
+
+// trimEndpointSlice returns a copy of slice without the fields Ravel doesn't use
+func trimEndpointSlice(slice *discoveryv1.EndpointSlice) *discoveryv1.EndpointSlice {
+	s := slice.DeepCopy()
+	trimMeta(&s.ObjectMeta)
+	return s
+}
+
+// trimNode returns a copy of node without the fields Ravel doesn't use. The
+// images of a node, which are most of its status, are dropped.
+func trimNode(node *v1.Node) *v1.Node {
+	n := node.DeepCopy()
+	trimMeta(&n.ObjectMeta)
+	n.Status.Images = nil
+	n.Status.VolumesInUse = nil
+	n.Status.VolumesAttached = nil
+	return n
+}
+
+// trimPod returns the parts of pod that Ravel uses: where it runs, its
+// addresses and whether it is ready
+func trimPod(pod *v1.Pod) *v1.Pod {
+	p := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              pod.Name,
+			Namespace:         pod.Namespace,
+			UID:               pod.UID,
+			ResourceVersion:   pod.ResourceVersion,
+			DeletionTimestamp: pod.DeletionTimestamp,
+		},
+		Spec: v1.PodSpec{NodeName: pod.Spec.NodeName},
+		Status: v1.PodStatus{
+			Phase:  pod.Status.Phase,
+			PodIP:  pod.Status.PodIP,
+			PodIPs: append([]v1.PodIP(nil), pod.Status.PodIPs...),
+		},
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodReady {
+			p.Status.Conditions = []v1.PodCondition{{Type: c.Type, Status: c.Status}}
+		}
+	}
+	if pod.Labels != nil {
+		p.Labels = make(map[string]string, len(pod.Labels))
+		for k, v := range pod.Labels {
+			p.Labels[k] = v
+		}
+	}
+	return p
+}
+
+// podReady reports whether the ready condition of pod is true
+func podReady(pod *v1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,223 @@
+package watcher
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// cachedState is the part of the watcher state that rules are generated from
+type cachedState struct {
+	ConfigMap     *v1.ConfigMap
+	ClusterConfig *types.ClusterConfig
+	Nodes         []*v1.Node
+
+	AllServices   map[string]*v1.Service
+	AllEndpoints  map[string]*v1.Endpoints
+	AllPods       map[string]*v1.Pod
+	AllPodsByNode map[string][]*v1.Pod
+
+	AllEndpointSlices map[string]*discoveryv1.EndpointSlice
+}
+
+// configCache is the format of the config cache file. Checksum is the hex
+// encoded sha256 of State, and Signature, when the cache is signed, the hex
+// encoded HMAC-SHA256 of ConfigKey, Written and State, see cacheSignature.
+type configCache struct {
+	ConfigKey string          `json:"configKey"`
+	Written   time.Time       `json:"written"`
+	Checksum  string          `json:"checksum"`
+	Signature string          `json:"signature,omitempty"`
+	State     json.RawMessage `json:"state"`
+}
+
+// cacheSignature returns the signature of c with key
+func cacheSignature(c *configCache, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(c.ConfigKey))
+	mac.Write([]byte{0})
+	mac.Write([]byte(c.Written.UTC().Format(time.RFC3339Nano)))
+	mac.Write([]byte{0})
+	mac.Write(c.State)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SetCache keeps a local cache of the last known config at path, so that a worker
+// restarted while the api server is unreachable can keep its rules in place. A
+// cache already at path is loaded, and Snapshot and Current return it until the
+// watcher has synced. A missing cache is not an error; a corrupt one is ignored
+// and the error returned. With key, the cache is signed with HMAC-SHA256, so
+// that only a cache the worker wrote itself is loaded, and one that is
+// unsigned or signed with another key is ignored likewise.
+func (w *Watcher) SetCache(path string, key []byte) error {
+	w.Lock()
+	w.cachePath = path
+	w.cacheKey = key
+	w.Unlock()
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		w.logger.Infof("watcher: no config cache at %s", path)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("watcher: unable to read config cache. %v", err)
+	}
+
+	c := configCache{}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return fmt.Errorf("watcher: config cache at %s is corrupt. %v", path, err)
+	}
+	if c.ConfigKey != w.ConfigKey {
+		return fmt.Errorf("watcher: config cache at %s is for config key %s, not %s", path, c.ConfigKey, w.ConfigKey)
+	}
+	if sum := sha256.Sum256(c.State); hex.EncodeToString(sum[:]) != c.Checksum {
+		return fmt.Errorf("watcher: config cache at %s does not match its checksum", path)
+	}
+	if len(key) > 0 {
+		if c.Signature == "" {
+			return fmt.Errorf("watcher: config cache at %s is not signed", path)
+		}
+		if !hmac.Equal([]byte(cacheSignature(&c, key)), []byte(c.Signature)) {
+			return fmt.Errorf("watcher: config cache at %s is not signed with the config cache key", path)
+		}
+	}
+	state := cachedState{}
+	if err := json.Unmarshal(c.State, &state); err != nil {
+		return fmt.Errorf("watcher: config cache at %s is corrupt. %v", path, err)
+	}
+	if state.ClusterConfig == nil {
+		return fmt.Errorf("watcher: config cache at %s has no cluster config", path)
+	}
+
+	w.Lock()
+	w.cache = &Watcher{
+		ConfigMapNamespace: w.ConfigMapNamespace,
+		ConfigMapName:      w.ConfigMapName,
+		ConfigKey:          w.ConfigKey,
+
+		ConfigMap:     state.ConfigMap,
+		ClusterConfig: state.ClusterConfig,
+		Nodes:         state.Nodes,
+		AllServices:   state.AllServices,
+		AllEndpoints:  state.AllEndpoints,
+		AllPods:       state.AllPods,
+		AllPodsByNode: state.AllPodsByNode,
+
+		AllEndpointSlices: state.AllEndpointSlices,
+
+		AutoSvc:  w.AutoSvc,
+		AutoPort: w.AutoPort,
+
+		ctx:     w.ctx,
+		logger:  w.logger,
+		metrics: w.metrics,
+		health:  w.health,
+	}
+	w.Unlock()
+
+	w.logger.Infof("watcher: loaded cluster config generation %d with %d nodes from the config cache written at %v", state.ClusterConfig.Generation, len(state.Nodes), c.Written)
+	w.metrics.ConfigCacheInUse(true)
+	return nil
+}
+
+// WriteCache saves the state of s, a snapshot that was reconciled successfully,
+// to the config cache. The file is replaced atomically, so a crash mid-write
+// leaves the previous cache in place. It does nothing when no cache is set.
+func (w *Watcher) WriteCache(s *Watcher) error {
+	w.RLock()
+	path, key := w.cachePath, w.cacheKey
+	w.RUnlock()
+	if path == "" || s.ClusterConfig == nil {
+		return nil
+	}
+
+	state, err := json.Marshal(cachedState{
+		ConfigMap:     s.ConfigMap,
+		ClusterConfig: s.ClusterConfig,
+		Nodes:         s.Nodes,
+		AllServices:   s.AllServices,
+		AllEndpoints:  s.AllEndpoints,
+		AllPods:       s.AllPods,
+		AllPodsByNode: s.AllPodsByNode,
+
+		AllEndpointSlices: s.AllEndpointSlices,
+	})
+	if err != nil {
+		return fmt.Errorf("watcher: unable to encode config cache. %v", err)
+	}
+	sum := sha256.Sum256(state)
+	c := configCache{
+		ConfigKey: w.ConfigKey,
+		Written:   time.Now(),
+		Checksum:  hex.EncodeToString(sum[:]),
+		State:     state,
+	}
+	if len(key) > 0 {
+		c.Signature = cacheSignature(&c, key)
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("watcher: unable to encode config cache. %v", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("watcher: unable to write config cache. %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("watcher: unable to write config cache. %v", err)
+	}
+	return nil
+}
+
+// cached returns the state loaded from the config cache while the watcher has
+// not synced with the api server, or nil. Once the watcher has synced and
+// published a config and nodes of its own, the cache is dropped for good. A
+// watcher that isn't watching has nothing to sync, and only needs its own state.
+func (w *Watcher) cached() *Watcher {
+	w.RLock()
+	c := w.cache
+	live := w.ClusterConfig != nil && w.Nodes != nil
+	w.RUnlock()
+	if c == nil {
+		return nil
+	}
+	if !live || (w.health != nil && !w.health.Synced()) {
+		return c
+	}
+
+	w.Lock()
+	dropped := w.cache == c
+	if dropped {
+		w.cache = nil
+	}
+	w.Unlock()
+	if !dropped {
+		return nil
+	}
+	w.logger.Info("watcher: synced with the api server. no longer using the config cache")
+	w.metrics.ConfigCacheInUse(false)
+	return nil
+}
+
+// Current returns the cluster config and nodes that rules are generated from,
+// which are those of the config cache until the watcher has synced
+func (w *Watcher) Current() (*types.ClusterConfig, []*v1.Node) {
+	src := w
+	if c := w.cached(); c != nil {
+		src = c
+	}
+	src.RLock()
+	defer src.RUnlock()
+	return src.ClusterConfig, src.Nodes
+}
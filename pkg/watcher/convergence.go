@@ -0,0 +1,38 @@
+package watcher
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// noteChange records a change to the endpoints of identity, so that the next
+// config published carries the time of the earliest change it folds in, see
+// types.ClusterConfig.EventTime. Nothing is recorded before the first config is
+// published, or for endpoints relisted without change, since the initial sync
+// and a relist would otherwise be measured from the last time each endpoints
+// changed. The caller holds the lock.
+func (w *Watcher) noteChange(identity string, endpoints *v1.Endpoints) {
+	if w.ClusterConfig == nil {
+		return
+	}
+	if current, ok := w.AllEndpoints[identity]; ok && current.ResourceVersion == endpoints.ResourceVersion {
+		return
+	}
+	at := changeTime(endpoints, time.Now())
+	if w.changedAt.IsZero() || at.Before(w.changedAt) {
+		w.changedAt = at
+	}
+}
+
+// changeTime returns when the change to endpoints was triggered, which the
+// endpoints controller records as the time of the pod or service change behind
+// it, or now when it isn't recorded. Times after now, which only a clock skewed
+// from that of the controller produces, are taken as now.
+func changeTime(endpoints *v1.Endpoints, now time.Time) time.Time {
+	at, err := time.Parse(time.RFC3339Nano, endpoints.Annotations[v1.EndpointsLastChangeTriggerTime])
+	if err != nil || at.After(now) {
+		return now
+	}
+	return at
+}
@@ -0,0 +1,169 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// vipPatch is what publishing the VIPs of a service changes
+type vipPatch struct {
+	// meta is the merge patch of the service's annotations, and status that
+	// of its load balancer status, nil when they are already up to date
+	meta   []byte
+	status []byte
+}
+
+// PublishVIPs writes the VIPs that the cluster config assigns to each
+// kubernetes service into its types.ExternalDNSTargetAnnotation, and into the
+// load balancer status of services of type LoadBalancer, every interval until
+// ctx is done, so that external-dns publishes records for them. They are
+// removed once the service has no VIPs. A target or status that ravel didn't
+// write is left alone, and so is every service ravel never published VIPs on.
+func (w *Watcher) PublishVIPs(ctx context.Context, interval time.Duration) {
+	w.logger.Infof("watcher: publishing the VIPs of services for external-dns every %v", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// a config from the cache may be stale, and is left until the
+		// watcher has synced
+		config, _ := w.Current()
+		if config == nil || w.cached() != nil {
+			continue
+		}
+		patches, err := vipPatches(config, w.Services())
+		if err != nil {
+			w.logger.Errorf("watcher: unable to build the VIP patches of services. %v", err)
+			continue
+		}
+		for key, patch := range patches {
+			w.patchService(ctx, key, patch)
+		}
+	}
+}
+
+// patchService applies patch to the service named by key, namespace/name
+func (w *Watcher) patchService(ctx context.Context, key string, patch vipPatch) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return
+	}
+	services := w.clientset.CoreV1().Services(parts[0])
+	patchCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if patch.meta != nil {
+		if _, err := services.Patch(patchCtx, parts[1], k8stypes.MergePatchType, patch.meta, metav1.PatchOptions{}); err != nil {
+			w.logger.Warnf("watcher: unable to publish the VIPs of service %s. %v", key, err)
+			return
+		}
+	}
+	if patch.status != nil {
+		if _, err := services.Patch(patchCtx, parts[1], k8stypes.MergePatchType, patch.status, metav1.PatchOptions{}, "status"); err != nil {
+			w.logger.Warnf("watcher: unable to publish the VIPs of service %s in its load balancer status. %v", key, err)
+			return
+		}
+	}
+	w.logger.Infof("watcher: published the VIPs of service %s", key)
+}
+
+// serviceVIPs returns the sorted VIPs config assigns to each service, by
+// namespace/name
+func serviceVIPs(config *types.ClusterConfig) map[string][]string {
+	seen := map[string]map[string]bool{}
+	for _, c := range []map[types.ServiceIP]types.PortMap{config.Config, config.Config6} {
+		for vip, ports := range c {
+			for _, def := range ports {
+				if def == nil || def.Service == "" {
+					continue
+				}
+				key := def.Namespace + "/" + def.Service
+				if seen[key] == nil {
+					seen[key] = map[string]bool{}
+				}
+				seen[key][string(vip)] = true
+			}
+		}
+	}
+	out := map[string][]string{}
+	for key, vips := range seen {
+		for vip := range vips {
+			out[key] = append(out[key], vip)
+		}
+		sort.Strings(out[key])
+	}
+	return out
+}
+
+// vipPatches returns the patches that bring services up to date with the VIPs
+// config assigns them, by namespace/name
+func vipPatches(config *types.ClusterConfig, services map[string]*v1.Service) (map[string]vipPatch, error) {
+	assigned := serviceVIPs(config)
+	patches := map[string]vipPatch{}
+	for key, svc := range services {
+		if svc == nil {
+			continue
+		}
+		want := strings.Join(assigned[key], ",")
+		had := svc.Annotations[types.VIPsAnnotation]
+
+		annotations := map[string]interface{}{}
+		if want != had {
+			annotations[types.VIPsAnnotation] = nullIfEmpty(want)
+		}
+		if target := svc.Annotations[types.ExternalDNSTargetAnnotation]; (target == "" || target == had) && target != want {
+			annotations[types.ExternalDNSTargetAnnotation] = nullIfEmpty(want)
+		}
+
+		var patch vipPatch
+		if len(annotations) > 0 {
+			meta, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": annotations}})
+			if err != nil {
+				return nil, err
+			}
+			patch.meta = meta
+		}
+		if svc.Spec.Type == v1.ServiceTypeLoadBalancer {
+			current := []string{}
+			for _, ingress := range svc.Status.LoadBalancer.Ingress {
+				current = append(current, ingress.IP)
+			}
+			if have := strings.Join(current, ","); (have == "" || have == had) && have != want {
+				ingress := []v1.LoadBalancerIngress{}
+				for _, vip := range assigned[key] {
+					ingress = append(ingress, v1.LoadBalancerIngress{IP: vip})
+				}
+				status, err := json.Marshal(map[string]interface{}{"status": map[string]interface{}{"loadBalancer": map[string]interface{}{"ingress": ingress}}})
+				if err != nil {
+					return nil, err
+				}
+				patch.status = status
+			}
+		}
+		if patch.meta != nil || patch.status != nil {
+			patches[key] = patch
+		}
+	}
+	return patches, nil
+}
+
+// nullIfEmpty returns nil, which deletes a key in a merge patch, for an empty s
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,107 @@
+package watcher
+
+import (
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/watch"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SetTerminatingEndpoints makes the watcher follow the endpointslices of the
+// cluster as well as its endpoints. Endpoints only list ready pods, so a VIP
+// port whose pods are all shutting down would be removed, and its established
+// connections with it. With endpointslices, pods that are terminating but still
+// serving keep their VIP ports configured. Their nodes are given no weight, as
+// they have no ready endpoints, so that they keep their established connections
+// but get no new ones. Pod readiness gates are honored either way, as a pod is
+// not ready until its gates are.
+//
+// The watches are re-established to include endpointslices, which needs list
+// and watch permissions on discovery.k8s.io endpointslices.
+func (w *Watcher) SetTerminatingEndpoints() {
+	w.Lock()
+	w.watchEndpointSlices = true
+	w.Unlock()
+	w.Disconnect()
+}
+
+// endpointSliceEvents returns the events of the endpointslice watch, or nil,
+// which never delivers, when the watcher doesn't follow endpointslices
+func (w *Watcher) endpointSliceEvents() <-chan watch.Event {
+	if w.endpointSlices == nil {
+		return nil
+	}
+	return w.endpointSlices.ResultChan()
+}
+
+// processEndpointSlice handles an event coming from a watch for endpointslices
+func (w *Watcher) processEndpointSlice(eventType watch.EventType, slice *discoveryv1.EndpointSlice) {
+	w.Lock()
+	defer w.Unlock()
+
+	if eventType == "ERROR" {
+		log.Errorln("watcher: got an ERROR event type from the endpointslice watcher:", slice)
+		return
+	}
+
+	if w.AllEndpointSlices == nil {
+		w.AllEndpointSlices = map[string]*discoveryv1.EndpointSlice{}
+	}
+	identity := slice.ObjectMeta.Namespace + "/" + slice.ObjectMeta.Name
+	switch eventType {
+	case "ADDED", "MODIFIED":
+		w.AllEndpointSlices[identity] = slice
+	case "DELETED":
+		delete(w.AllEndpointSlices, identity)
+	default:
+		log.Warningln("Got an unknown endpointslice eventType of:", eventType)
+	}
+}
+
+// TerminatingEndpointsForService returns the endpoints of the service that are
+// shutting down gracefully but still serving. An empty portName matches every
+// port of the service.
+func (w *Watcher) TerminatingEndpointsForService(serviceName string, namespace string, portName string) []discoveryv1.Endpoint {
+	w.RLock()
+	defer w.RUnlock()
+	return w.terminatingEndpoints(serviceName, namespace, portName)
+}
+
+// terminatingEndpoints is TerminatingEndpointsForService for callers that
+// already hold the lock
+func (w *Watcher) terminatingEndpoints(serviceName string, namespace string, portName string) []discoveryv1.Endpoint {
+	var out []discoveryv1.Endpoint
+	for _, slice := range w.AllEndpointSlices {
+		if slice.Namespace != namespace || slice.Labels[discoveryv1.LabelServiceName] != serviceName {
+			continue
+		}
+		if portName != "" && !slicePortNamed(slice, portName) {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			if isTerminatingServing(ep.Conditions) {
+				out = append(out, ep)
+			}
+		}
+	}
+	return out
+}
+
+// slicePortNamed returns true when slice has a port named portName
+func slicePortNamed(slice *discoveryv1.EndpointSlice, portName string) bool {
+	for _, p := range slice.Ports {
+		if p.Name != nil && *p.Name == portName {
+			return true
+		}
+	}
+	return false
+}
+
+// isTerminatingServing returns true for an endpoint that is shutting down but
+// still serving. An unknown serving condition is taken as serving, as
+// kube-proxy does.
+func isTerminatingServing(c discoveryv1.EndpointConditions) bool {
+	terminating := c.Terminating != nil && *c.Terminating
+	serving := c.Serving == nil || *c.Serving
+	return terminating && serving
+}
@@ -0,0 +1,46 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+)
+
+// eventComponent is the source of the events ravel records
+const eventComponent = "ravel"
+
+// NodeEvent records an event of eventType, Normal or Warning, on node. Events
+// of nodes live in the default namespace, as those of the kubelet do.
+func (w *Watcher) NodeEvent(node, eventType, reason, message string) error {
+	if w == nil || w.clientset == nil {
+		return fmt.Errorf("watcher: no kubernetes client to record events with")
+	}
+	ctx, cancel := context.WithTimeout(w.ctx, 10*time.Second)
+	defer cancel()
+
+	now := metav1.Now()
+	_, err := w.clientset.CoreV1().Events(v1.NamespaceDefault).Create(ctx, &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: node + ".",
+			Namespace:    v1.NamespaceDefault,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind: "Node",
+			Name: node,
+			// the kubelet refers to its node by name
+			UID: k8stypes.UID(node),
+		},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         v1.EventSource{Component: eventComponent, Host: node},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}, metav1.CreateOptions{})
+	return err
+}
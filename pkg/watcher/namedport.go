@@ -0,0 +1,63 @@
+package watcher
+
+import (
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// GetServicePortNumber returns the number of the port named portName in the
+// spec of the service, or 0 if the service has no such port
+func (w *Watcher) GetServicePortNumber(namespace, serviceName, portName string) int32 {
+	w.RLock()
+	defer w.RUnlock()
+
+	s, ok := w.AllServices[fmt.Sprintf("%s/%s", namespace, serviceName)]
+	if !ok {
+		return 0
+	}
+	for _, p := range s.Spec.Ports {
+		if p.Name == portName {
+			return p.Port
+		}
+	}
+	return 0
+}
+
+// resolveNamedPorts replaces the named VIP ports of config with the number
+// their service gives the port of that name, returning how many were removed.
+// A port that the service doesn't have, or whose service doesn't exist yet, is
+// removed like a service without endpoints. A VIP port number set in the
+// config wins over a named port that resolves to it.
+func (w *Watcher) resolveNamedPorts(config map[types.ServiceIP]types.PortMap) int {
+	var removed int
+	for vip, ports := range config {
+		for port, def := range ports {
+			if !types.NamedPort(port) {
+				continue
+			}
+			delete(ports, port)
+			if def == nil {
+				continue
+			}
+
+			number := w.GetServicePortNumber(def.Namespace, def.Service, port)
+			if number == 0 {
+				log.Debugln("watcher: service", def.Namespace+"/"+def.Service, "has no port named", port, "for", vip)
+				removed++
+				continue
+			}
+			resolved := strconv.Itoa(int(number))
+			if _, ok := ports[resolved]; ok {
+				log.Warningln("watcher: port", port, "of", def.Namespace+"/"+def.Service, "resolves to", string(vip)+":"+resolved, "which the config already sets. ignoring the named port")
+				removed++
+				continue
+			}
+			ports[resolved] = def
+		}
+	}
+	return removed
+}
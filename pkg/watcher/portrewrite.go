@@ -0,0 +1,109 @@
+package watcher
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// GetTargetPortsOnNode returns the port that traffic to each pod of the
+// service on the node is DNATed to, keyed by pod IP. A pod keeps the port that
+// its endpoint subset gives portName, unless rewrite sends the pods with its
+// labels elsewhere. A target port name that the subset doesn't have leaves the
+// pod on portName, so that a port renamed in the app doesn't take it out of
+// service.
+func (w *Watcher) GetTargetPortsOnNode(nodeName, serviceName, namespace, portName string, rewrite *types.PortRewrite) map[string]int32 {
+	w.RLock()
+	defer w.RUnlock()
+
+	pods := map[string]*v1.Pod{}
+	for _, p := range w.AllPodsByNode[nodeName] {
+		if p.Status.PodIP != "" {
+			pods[p.Status.PodIP] = p
+		}
+	}
+
+	out := map[string]int32{}
+	for _, ep := range w.AllEndpoints {
+		if !strings.EqualFold(ep.Name, serviceName) || !strings.EqualFold(ep.Namespace, namespace) {
+			continue
+		}
+		for _, subset := range ep.Subsets {
+			ports := subsetPorts(subset)
+			port, ok := ports[portName]
+			if !ok {
+				continue
+			}
+			for _, addr := range subset.Addresses {
+				pod, ok := pods[addr.IP]
+				if !ok {
+					continue
+				}
+				out[addr.IP] = port
+				name, number := rewrite.Target(pod.Labels)
+				if number != 0 {
+					out[addr.IP] = int32(number)
+				} else if target, ok := ports[name]; ok && name != "" {
+					out[addr.IP] = target
+				}
+			}
+		}
+	}
+	return out
+}
+
+// unknownTargetPorts returns the target port names of rewrite that no
+// endpoint subset of the service has
+func (w *Watcher) unknownTargetPorts(namespace, serviceName string, rewrite *types.PortRewrite) []string {
+	names := rewrite.TargetPortNames()
+	if len(names) == 0 {
+		return nil
+	}
+
+	w.RLock()
+	defer w.RUnlock()
+	known := map[string]bool{}
+	if ep, ok := w.AllEndpoints[fmt.Sprintf("%s/%s", namespace, serviceName)]; ok {
+		for _, subset := range ep.Subsets {
+			for name := range subsetPorts(subset) {
+				known[name] = true
+			}
+		}
+	}
+	unknown := []string{}
+	for _, name := range names {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	return unknown
+}
+
+// validatePortRewrites logs the VIP ports of config whose rewrites name ports
+// the endpoints of their service don't have. Their pods keep the port of the
+// VIP port's PortName.
+func (w *Watcher) validatePortRewrites(config map[types.ServiceIP]types.PortMap) {
+	for vip, ports := range config {
+		for port, def := range ports {
+			if def == nil || def.PortRewrite == nil {
+				continue
+			}
+			if unknown := w.unknownTargetPorts(def.Namespace, def.Service, def.PortRewrite); len(unknown) > 0 {
+				log.Warningln("watcher: port rewrite of", string(vip)+":"+port, "names ports", strings.Join(unknown, ","), "that the endpoints of", def.Namespace+"/"+def.Service, "don't have. pods keep port", def.PortName)
+			}
+		}
+	}
+}
+
+func subsetPorts(subset v1.EndpointSubset) map[string]int32 {
+	ports := make(map[string]int32, len(subset.Ports))
+	for _, p := range subset.Ports {
+		ports[p.Name] = p.Port
+	}
+	return ports
+}
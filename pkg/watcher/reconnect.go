@@ -0,0 +1,156 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// relistTimeout is how long the lists of a relist have to complete
+const relistTimeout = 2 * time.Minute
+
+// SetReconnect sets the backoff between attempts to re-establish the watches,
+// which doubles with each consecutive failure, and the number of consecutive
+// failures after which the watcher relists every resource. 0 never relists.
+func (w *Watcher) SetReconnect(backoff util.Backoff, relistAfter int) {
+	w.Lock()
+	defer w.Unlock()
+	w.reconnectBackoff = backoff
+	w.relistAfter = relistAfter
+}
+
+// StaleFor returns how long the watcher's view of the cluster may have been
+// out of date, which is since its watches were last restarted or it was
+// created, until they have synced again. A watcher that is synced returns 0.
+func (w *Watcher) StaleFor() time.Duration {
+	if w.health == nil {
+		return 0
+	}
+	synced := w.health.Synced()
+
+	w.Lock()
+	defer w.Unlock()
+	if synced {
+		w.unsyncedSince = time.Time{}
+		return 0
+	}
+	if w.unsyncedSince.IsZero() {
+		return 0
+	}
+	return time.Since(w.unsyncedSince)
+}
+
+// watchFailed records a failed watch, returning the wait before the watches
+// are re-established and whether every resource should be relisted first
+func (w *Watcher) watchFailed() (time.Duration, bool) {
+	w.Lock()
+	defer w.Unlock()
+	if w.unsyncedSince.IsZero() {
+		w.unsyncedSince = time.Now()
+	}
+	w.watchFailures++
+	relist := w.relistAfter > 0 && w.watchFailures%w.relistAfter == 0
+	return w.reconnectBackoff.Next(w.watchFailures), relist
+}
+
+// watchBackoff returns the wait before the next attempt to re-establish the
+// watches, or 0 when they are up
+func (w *Watcher) watchBackoff() time.Duration {
+	w.RLock()
+	defer w.RUnlock()
+	if w.watchFailures == 0 {
+		return 0
+	}
+	return w.reconnectBackoff.Next(w.watchFailures)
+}
+
+// relist replaces the services, endpoints, nodes and pods of the watcher with
+// a fresh list of them. The informers of re-established watches list again
+// too, but only add and update objects from it, so an object deleted while
+// the watches were down would be kept until the process restarted. The
+// objects are replaced at once, and only when every list succeeded, so the
+// watcher never publishes from a partial view.
+func (w *Watcher) relist() error {
+	ctx, cancel := context.WithTimeout(w.ctx, relistTimeout)
+	defer cancel()
+	core := w.clientset.CoreV1()
+
+	services, err := core.Services(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("watcher: unable to relist services. %v", err)
+	}
+	endpoints, err := core.Endpoints(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("watcher: unable to relist endpoints. %v", err)
+	}
+	nodeOptions := metav1.ListOptions{}
+	w.api.nodeListOptions(&nodeOptions)
+	nodes, err := core.Nodes().List(ctx, nodeOptions)
+	if err != nil {
+		return fmt.Errorf("watcher: unable to relist nodes. %v", err)
+	}
+	pods, err := core.Pods(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("watcher: unable to relist pods. %v", err)
+	}
+
+	w.RLock()
+	watchSlices := w.watchEndpointSlices
+	w.RUnlock()
+	var slices *discoveryv1.EndpointSliceList
+	if watchSlices {
+		slices, err = w.clientset.DiscoveryV1().EndpointSlices(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("watcher: unable to relist endpointslices. %v", err)
+		}
+	}
+
+	allServices := map[string]*v1.Service{}
+	for i := range services.Items {
+		s := trimService(&services.Items[i])
+		allServices[s.Namespace+"/"+s.Name] = s
+	}
+	allEndpoints := map[string]*v1.Endpoints{}
+	for i := range endpoints.Items {
+		ep := &endpoints.Items[i]
+		// skipped by the watch too, as they are updated constantly
+		if ep.Namespace == "kube-system" && (ep.Name == "kube-controller-manager" || ep.Name == "kube-scheduler") {
+			continue
+		}
+		allEndpoints[ep.Namespace+"/"+ep.Name] = trimEndpoints(ep)
+	}
+	allNodes := make([]*v1.Node, 0, len(nodes.Items))
+	for i := range nodes.Items {
+		allNodes = append(allNodes, trimNode(&nodes.Items[i]))
+	}
+	allPods, allPodsByNode := map[string]*v1.Pod{}, map[string][]*v1.Pod{}
+	for i := range pods.Items {
+		p := trimPod(&pods.Items[i])
+		allPods[p.Namespace+"/"+p.Name] = p
+		allPodsByNode[p.Spec.NodeName] = append(allPodsByNode[p.Spec.NodeName], p)
+	}
+
+	w.Lock()
+	w.AllServices = allServices
+	w.AllEndpoints = allEndpoints
+	w.Nodes = allNodes
+	w.AllPods = allPods
+	w.AllPodsByNode = allPodsByNode
+	if slices != nil {
+		w.AllEndpointSlices = map[string]*discoveryv1.EndpointSlice{}
+		for i := range slices.Items {
+			s := trimEndpointSlice(&slices.Items[i])
+			w.AllEndpointSlices[s.Namespace+"/"+s.Name] = s
+		}
+	}
+	w.Unlock()
+
+	w.logger.Infof("watcher: relisted %d services, %d endpoints, %d nodes and %d pods", len(allServices), len(allEndpoints), len(allNodes), len(allPods))
+	return nil
+}
@@ -0,0 +1,130 @@
+package watcher
+
+import (
+	"net"
+	"sort"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// expandTemplates adds the VIP ports that the templates of config create for
+// the services they match, returning how many were added. Services that the
+// config lists already are left to their entries, and a service matched by
+// several templates takes the first. Services are placed in the order of
+// their namespace and name, each on the first VIP of its template's pool
+// where none of its ports are taken.
+func (w *Watcher) expandTemplates(config *types.ClusterConfig) int {
+	if len(config.Templates) == 0 {
+		return 0
+	}
+
+	services := w.Services()
+	keys := make([]string, 0, len(services))
+	for key := range services {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	placed := map[string]bool{}
+	for _, c := range []map[types.ServiceIP]types.PortMap{config.Config, config.Config6} {
+		for _, ports := range c {
+			for _, def := range ports {
+				if def != nil {
+					placed[def.Namespace+"/"+def.Service] = true
+				}
+			}
+		}
+	}
+
+	var added int
+	for n := range config.Templates {
+		t := &config.Templates[n]
+		for _, key := range keys {
+			s := services[key]
+			if placed[key] || !t.Matches(s.Namespace, s.Name, s.Labels) {
+				continue
+			}
+			defs := templatePorts(t, s)
+			if len(defs) == 0 {
+				continue
+			}
+			vip, ok := templateVIP(config, t, key, defs)
+			if !ok {
+				log.Warningln("watcher: template", n, "has no VIP left with ports free for", key)
+				continue
+			}
+
+			portMaps := &config.Config
+			if net.ParseIP(string(vip)).To4() == nil {
+				portMaps = &config.Config6
+			}
+			if *portMaps == nil {
+				*portMaps = map[types.ServiceIP]types.PortMap{}
+			}
+			if (*portMaps)[vip] == nil {
+				(*portMaps)[vip] = types.PortMap{}
+			}
+			for port, def := range defs {
+				(*portMaps)[vip][port] = def
+				added++
+			}
+			placed[key] = true
+		}
+	}
+	return added
+}
+
+// templatePorts returns the definitions of the VIP ports the template creates
+// for the service, keyed by port. A port the service declares for both tcp and
+// udp is a single VIP port with both enabled.
+func templatePorts(t *types.ServiceTemplate, s *v1.Service) types.PortMap {
+	defs := types.PortMap{}
+	for _, p := range s.Spec.Ports {
+		if !t.ServesPort(p.Name) {
+			continue
+		}
+		port := strconv.Itoa(int(p.Port))
+		def, ok := defs[port]
+		if !ok {
+			def = t.ServiceDef(s.Namespace, s.Name, p.Name)
+			def.TCPEnabled, def.UDPEnabled = false, false
+		}
+		switch p.Protocol {
+		case v1.ProtocolTCP, "":
+			def.TCPEnabled = true
+		case v1.ProtocolUDP:
+			def.UDPEnabled = true
+		default:
+			// ravel doesn't balance sctp
+			continue
+		}
+		defs[port] = def
+	}
+	return defs
+}
+
+// templateVIP picks the first VIP of the template's pool, in the service's
+// order, that serves none of the ports of defs yet
+func templateVIP(config *types.ClusterConfig, t *types.ServiceTemplate, service string, defs types.PortMap) (types.ServiceIP, bool) {
+	for _, vip := range t.PoolOrder(service) {
+		ports := config.Config[vip]
+		if net.ParseIP(string(vip)).To4() == nil {
+			ports = config.Config6[vip]
+		}
+		free := true
+		for port := range defs {
+			if _, ok := ports[port]; ok {
+				free = false
+				break
+			}
+		}
+		if free {
+			return vip, true
+		}
+	}
+	return "", false
+}
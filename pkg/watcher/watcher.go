@@ -8,20 +8,26 @@ import (
 	"fmt"
 	"net/http"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	watchtools "k8s.io/client-go/tools/watch"
 
+	"github.com/Comcast/Ravel/pkg/stats"
 	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -49,14 +55,23 @@ type Watcher struct {
 	AllPodsByNode map[string][]*v1.Pod // map of node name to pods on the node
 	ConfigMap     *v1.ConfigMap
 
+	// AllEndpointSlices is only followed with SetTerminatingEndpoints
+	AllEndpointSlices map[string]*discoveryv1.EndpointSlice
+
 	// client watches.
 	clientset  *kubernetes.Clientset
+	api        APIOptions
 	nodeWatch  watch.Interface
 	services   watch.Interface
 	endpoints  watch.Interface
 	configmaps watch.Interface
 	podChan    watch.Interface
 
+	// endpointSlices is nil unless watchEndpointSlices is set, see
+	// SetTerminatingEndpoints
+	endpointSlices      watch.Interface
+	watchEndpointSlices bool
+
 	// this is the 'official' configuration
 	ClusterConfig *types.ClusterConfig
 	Nodes         []*v1.Node
@@ -65,25 +80,60 @@ type Watcher struct {
 	AutoSvc  string
 	AutoPort int
 
-	// How long to wait to re-init watchers after a watcher error.
-	// Starts at 1 second, then increments by 1 second every time
-	// there's another error without an intervening successful event.
-	watchBackoffDuration time.Duration
+	// How long to wait to re-init watchers after a watcher error, which
+	// doubles with every error without an intervening successful event.
+	// watchFailures counts those errors and is only touched by the watches
+	// goroutine. Every relistAfter of them, every resource is relisted.
+	reconnectBackoff util.Backoff
+	relistAfter      int
+	watchFailures    int
+
+	// unsyncedSince is when the watches were last restarted, or the watcher
+	// created, without having synced since. see StaleFor
+	unsyncedSince time.Time
 
 	publishChan chan *types.ClusterConfig
 
+	// generation is the Generation of the last published config and configSHA
+	// the hash of its content. only touched by publish
+	generation uint64
+	configSHA  [sha1.Size]byte
+
+	// changedAt is when the earliest change to endpoints that is not yet in a
+	// published config was triggered, see noteChange
+	changedAt time.Time
+
+	// disconnectChan forces the watches to be torn down and re-established,
+	// as if the connection to the api server was lost
+	disconnectChan chan struct{}
+
+	// shrinkGuard, when above zero, is the largest percentage of VIP ports that
+	// a published config may remove
+	shrinkGuard   int
+	shrinkMetrics shrinkMetrics
+
+	// cachePath is where the state behind a successful reconcile is saved, and
+	// cache the state loaded from there at startup. cache is dropped once the
+	// watcher has synced with the api server. cacheKey, when set, signs the
+	// cache.
+	cachePath string
+	cacheKey  []byte
+	cache     *Watcher
+
 	ctx     context.Context
 	logger  log.FieldLogger
 	metrics WatcherMetrics
+	health  *stats.WatchHealth
 }
 
 // NewWatcher creates a new Watcher struct, which is used to watch services, endpoints, and more
-func NewWatcher(ctx context.Context, kubeConfigFile, cmNamespace, cmName, configKey, lbKind string, autoSvc string, autoPort int, logger log.FieldLogger) (*Watcher, error) {
+func NewWatcher(ctx context.Context, kubeConfigFile, cmNamespace, cmName, configKey, lbKind string, autoSvc string, autoPort int, api APIOptions, logger log.FieldLogger) (*Watcher, error) {
 
 	config, err := clientcmd.BuildConfigFromFlags("", kubeConfigFile)
 	if err != nil {
 		return nil, fmt.Errorf("error getting configuration from kubeconfig at %s. %v", kubeConfigFile, err)
 	}
+	api.configure(config)
 	log.Debugln("Created kube client for watcher")
 
 	// create the clientset
@@ -96,6 +146,7 @@ func NewWatcher(ctx context.Context, kubeConfigFile, cmNamespace, cmName, config
 		ctx: ctx,
 
 		clientset: clientset,
+		api:       api,
 
 		ConfigMapNamespace: cmNamespace,
 		ConfigMapName:      cmName,
@@ -109,10 +160,16 @@ func NewWatcher(ctx context.Context, kubeConfigFile, cmNamespace, cmName, config
 		AutoSvc:  autoSvc,
 		AutoPort: autoPort,
 
-		publishChan: make(chan *types.ClusterConfig),
+		publishChan:    make(chan *types.ClusterConfig),
+		disconnectChan: make(chan struct{}, 1),
+
+		reconnectBackoff: util.Backoff{Initial: time.Second, Max: 30 * time.Second},
+		relistAfter:      5,
+		unsyncedSince:    time.Now(),
 
 		logger:  logger.WithFields(log.Fields{"module": "watcher"}),
 		metrics: NewWatcherMetrics(lbKind, configKey),
+		health:  stats.NewWatchHealth(lbKind, configKey, prometheus.DefaultRegisterer),
 	}
 	if err := w.initWatch(); err != nil {
 		log.Errorln("Failed to init watcher with error:", err)
@@ -290,6 +347,9 @@ func (w *Watcher) stopWatch() {
 	w.endpoints.Stop()
 	w.configmaps.Stop()
 	w.podChan.Stop()
+	if w.endpointSlices != nil {
+		w.endpointSlices.Stop()
+	}
 }
 
 func (w *Watcher) initWatch() error {
@@ -298,7 +358,8 @@ func (w *Watcher) initWatch() error {
 
 	// TODO - optimize by limiting fields that are watched
 	serviceListWatcher := cache.NewListWatchFromClient(w.clientset.CoreV1().RESTClient(), "services", v1.NamespaceAll, fields.Everything())
-	_, _, servicesChan, _ := watchtools.NewIndexerInformerWatcher(serviceListWatcher, &v1.Service{})
+	_, servicesInformer, servicesChan, _ := watchtools.NewIndexerInformerWatcher(serviceListWatcher, &v1.Service{})
+	w.health.SetSynced("services", servicesInformer.HasSynced)
 	w.services = servicesChan
 
 	// services, err := w.clientset.CoreV1().Services("").Watch(w.ctx, metav1.ListOptions{})
@@ -308,9 +369,21 @@ func (w *Watcher) initWatch() error {
 	// }
 
 	endpointListWatcher := cache.NewListWatchFromClient(w.clientset.CoreV1().RESTClient(), "endpoints", v1.NamespaceAll, fields.Everything())
-	_, _, endpointChan, _ := watchtools.NewIndexerInformerWatcher(endpointListWatcher, &v1.Endpoints{})
+	_, endpointInformer, endpointChan, _ := watchtools.NewIndexerInformerWatcher(endpointListWatcher, &v1.Endpoints{})
+	w.health.SetSynced("endpoints", endpointInformer.HasSynced)
 	w.endpoints = endpointChan
 
+	w.RLock()
+	watchSlices := w.watchEndpointSlices
+	w.RUnlock()
+	w.endpointSlices = nil
+	if watchSlices {
+		sliceListWatcher := cache.NewListWatchFromClient(w.clientset.DiscoveryV1().RESTClient(), "endpointslices", v1.NamespaceAll, fields.Everything())
+		_, sliceInformer, sliceChan, _ := watchtools.NewIndexerInformerWatcher(sliceListWatcher, &discoveryv1.EndpointSlice{})
+		w.health.SetSynced("endpointslices", sliceInformer.HasSynced)
+		w.endpointSlices = sliceChan
+	}
+
 	// endpoints, err := w.clientset.CoreV1().Endpoints("").Watch(w.ctx, metav1.ListOptions{})
 	// w.metrics.WatchErr("endpoints", err)
 	// if err != nil {
@@ -319,7 +392,8 @@ func (w *Watcher) initWatch() error {
 	// }
 
 	configmapListWatcher := cache.NewListWatchFromClient(w.clientset.CoreV1().RESTClient(), "configmaps", "platform-load-balancer", fields.Everything())
-	_, _, configmapChan, _ := watchtools.NewIndexerInformerWatcher(configmapListWatcher, &v1.ConfigMap{})
+	_, configmapInformer, configmapChan, _ := watchtools.NewIndexerInformerWatcher(configmapListWatcher, &v1.ConfigMap{})
+	w.health.SetSynced("configmaps", configmapInformer.HasSynced)
 	w.configmaps = configmapChan
 
 	// configmaps, err := w.clientset.CoreV1().ConfigMaps(w.configMapNamespace).Watch(w.ctx, metav1.ListOptions{})
@@ -330,8 +404,9 @@ func (w *Watcher) initWatch() error {
 	// 	return fmt.Errorf("error starting watch on configmap. %v", err)
 	// }
 
-	nodesListWatcher := cache.NewListWatchFromClient(w.clientset.CoreV1().RESTClient(), "nodes", v1.NamespaceAll, fields.Everything())
-	_, _, nodeChan, _ := watchtools.NewIndexerInformerWatcher(nodesListWatcher, &v1.Node{})
+	nodesListWatcher := cache.NewFilteredListWatchFromClient(w.clientset.CoreV1().RESTClient(), "nodes", v1.NamespaceAll, w.api.nodeListOptions)
+	_, nodeInformer, nodeChan, _ := watchtools.NewIndexerInformerWatcher(nodesListWatcher, &v1.Node{})
+	w.health.SetSynced("nodes", nodeInformer.HasSynced)
 	w.nodeWatch = nodeChan
 
 	// nodes, err := w.clientset.CoreV1().Nodes().Watch(w.ctx, metav1.ListOptions{})
@@ -344,7 +419,8 @@ func (w *Watcher) initWatch() error {
 	// }
 
 	podsListWatcher := cache.NewListWatchFromClient(w.clientset.CoreV1().RESTClient(), "pods", v1.NamespaceAll, fields.Everything())
-	_, _, podChan, _ := watchtools.NewIndexerInformerWatcher(podsListWatcher, &v1.Pod{})
+	_, podInformer, podChan, _ := watchtools.NewIndexerInformerWatcher(podsListWatcher, &v1.Pod{})
+	w.health.SetSynced("pods", podInformer.HasSynced)
 	w.podChan = podChan
 
 	// w.services = services
@@ -372,7 +448,9 @@ func (w *Watcher) ingestPodWatchEvents() {
 			log.Errorln("watcher: the pod update channel got an update, but the object was not a *v1.Pod so it was skipped")
 			continue
 		}
+		p = trimPod(p)
 		podLookupKey := p.Namespace + "/" + p.Name
+		w.health.Event("pods")
 
 		// depending on the update type, change the contents of the pods map
 		// log.Debugln("watcher: ingestPodWatchEvents: waiting for mutex lock...")
@@ -444,32 +522,128 @@ func (w *Watcher) Services() map[string]*v1.Service {
 	return out
 }
 
-// resetWatch attempts to bootstrap initWatch indefinitely.
-func (w *Watcher) resetWatch() error {
+// Snapshot returns a detached copy of the watcher's state that is safe to read
+// while the watcher keeps ingesting events. The cluster config and nodes are deep
+// copied. Services, endpoints and pods are replaced rather than modified when
+// events arrive, so only their maps are copied. The snapshot has no watches of
+// its own and must not be started. Until the watcher has synced with the api
+// server, the snapshot is taken from the config cache if one was loaded.
+func (w *Watcher) Snapshot() *Watcher {
+	if c := w.cached(); c != nil {
+		return c.Snapshot()
+	}
+
+	w.RLock()
+	defer w.RUnlock()
+
+	s := &Watcher{
+		ConfigMapNamespace: w.ConfigMapNamespace,
+		ConfigMapName:      w.ConfigMapName,
+		ConfigKey:          w.ConfigKey,
+
+		AllServices:   make(map[string]*v1.Service, len(w.AllServices)),
+		AllEndpoints:  make(map[string]*v1.Endpoints, len(w.AllEndpoints)),
+		AllPods:       make(map[string]*v1.Pod, len(w.AllPods)),
+		AllPodsByNode: make(map[string][]*v1.Pod, len(w.AllPodsByNode)),
+		ConfigMap:     w.ConfigMap,
 
-	// increment backoff duration by 1 second, up to 30 seconds max
-	// if errors occur without an intervening successful event arrival.
-	// Most of the time, w.watchBackoffDuration will be zero, so this
-	// expression sets it to 1 * time.Second. w.watchBackoffDuration gets
-	// reset to 0 every time an event arrives successfully.
-	w.watchBackoffDuration = (w.watchBackoffDuration + time.Second) % (30 * time.Second)
+		AllEndpointSlices: make(map[string]*discoveryv1.EndpointSlice, len(w.AllEndpointSlices)),
+
+		ClusterConfig: w.ClusterConfig.DeepCopy(),
+
+		AutoSvc:  w.AutoSvc,
+		AutoPort: w.AutoPort,
+
+		ctx:     w.ctx,
+		logger:  w.logger,
+		metrics: w.metrics,
+		health:  w.health,
+	}
+	for k, v := range w.AllServices {
+		s.AllServices[k] = v
+	}
+	for k, v := range w.AllEndpoints {
+		s.AllEndpoints[k] = v
+	}
+	for k, v := range w.AllEndpointSlices {
+		s.AllEndpointSlices[k] = v
+	}
+	for k, v := range w.AllPods {
+		s.AllPods[k] = v
+	}
+	for k, v := range w.AllPodsByNode {
+		s.AllPodsByNode[k] = append([]*v1.Pod{}, v...)
+	}
+	if w.Nodes != nil {
+		s.Nodes = make([]*v1.Node, 0, len(w.Nodes))
+		for _, n := range w.Nodes {
+			s.Nodes = append(s.Nodes, n.DeepCopy())
+		}
+	}
+	return s
+}
+
+// resetWatch attempts to bootstrap initWatch indefinitely. resource is the
+// watch that triggered the reset and is recorded in the reconnect count.
+func (w *Watcher) resetWatch(resource string) error {
+	w.health.Reconnect(resource)
+
+	// the backoff doubles if errors occur without an intervening successful
+	// event arrival, and is reset every time an event arrives successfully
+	backoff, relist := w.watchFailed()
 
 	w.stopWatch()
+	w.health.Unsynced()
 
 	// Sleep, because the channels that events arrive on are closed,
 	// so no event arrive anyway. Linux kernel keeps on doing the IPVS
 	// rules or iptables rules that are in place, this is not an interruption
 	// in load balanced VIP:port service.
-	time.Sleep(w.watchBackoffDuration)
+	select {
+	case <-time.After(backoff):
+	case <-w.ctx.Done():
+	}
+
+	if relist {
+		err := w.relist()
+		w.metrics.WatchErr("relist", err)
+		if err != nil {
+			w.logger.Errorf("watcher: %v", err)
+		} else if nodes, err := w.buildNodeConfig(); err == nil {
+			w.publishNodes(nodes)
+		}
+	}
 
 	err := w.initWatch()
 	if err != nil {
 		return err
 	}
 
+	// the pod events are read by their own goroutine, which exited when the
+	// previous pod watch was stopped
+	go w.ingestPodWatchEvents()
 	return nil
 }
 
+// Disconnect tears down and re-establishes the kubernetes watches, as if the
+// api server connection had dropped. It does not block.
+func (w *Watcher) Disconnect() {
+	select {
+	case w.disconnectChan <- struct{}{}:
+	default:
+	}
+}
+
+// LastEvent returns the time the last event of any watched resource arrived, or
+// the time the watcher was created if none has. A watcher that isn't watching
+// returns the zero time.
+func (w *Watcher) LastEvent() time.Time {
+	if w.health == nil {
+		return time.Time{}
+	}
+	return w.health.Latest()
+}
+
 // runs forever (basically) and watches kubernetes for changes.
 func (w *Watcher) watches() {
 	log.Debugln("watcher: starting up watches")
@@ -486,6 +660,13 @@ func (w *Watcher) watches() {
 			w.stopWatch()
 			return
 
+		case <-w.disconnectChan:
+			w.logger.Warnln("watcher: disconnect requested - restarting watch")
+			if err := w.resetWatch("disconnect"); err != nil {
+				w.logger.Errorf("watcher: resetWatch() failed: %v", err)
+			}
+			continue
+
 		case evt, ok := <-w.services.ResultChan():
 			// log.Debugln("watcher: services chan got an event:", evt)
 			if !ok || evt.Object == nil {
@@ -495,19 +676,20 @@ func (w *Watcher) watches() {
 				if evt.Object == nil {
 					log.Debugln("watcher: servicesChan event object was nil - restarting watch")
 				}
-				err := w.resetWatch()
+				err := w.resetWatch("services")
 				if err != nil {
 					w.logger.Errorf("watcher: resetWatch() failed: %v", err)
 				}
 				continue
 			}
-			w.watchBackoffDuration = 0
+			w.watchFailures = 0
 			svcUpdates++
 			w.metrics.WatchData("services")
+			w.health.Event("services")
 			svc := evt.Object.(*v1.Service)
 			// log.Debugln("watcher: services chan got an event:", svc.Name, evt.Type)
 
-			w.processService(evt.Type, svc.DeepCopy())
+			w.processService(evt.Type, trimService(svc))
 
 		case evt, ok := <-w.endpoints.ResultChan():
 			if !ok || evt.Object == nil {
@@ -517,7 +699,7 @@ func (w *Watcher) watches() {
 				if evt.Object == nil {
 					log.Debugln("watcher: endpointsChan event object was nil - restarting watch")
 				}
-				err := w.resetWatch()
+				err := w.resetWatch("endpoints")
 				if err != nil {
 					w.logger.Errorf("watcher: resetWatch() failed: %v", err)
 				}
@@ -538,11 +720,28 @@ func (w *Watcher) watches() {
 			}
 			// log.Debugln("watcher: endpoints chan got an event:", evt)
 
-			w.watchBackoffDuration = 0
+			w.watchFailures = 0
 			epUpdates++
 			w.metrics.WatchData("endpoints")
+			w.health.Event("endpoints")
 			// w.logger.Debugf("got new endpoints from result chan")
-			w.processEndpoint(evt.Type, ep.DeepCopy())
+			w.processEndpoint(evt.Type, trimEndpoints(ep))
+
+		case evt, ok := <-w.endpointSliceEvents():
+			if !ok || evt.Object == nil {
+				log.Debugln("watcher: endpointSlicesChan closed or sent a nil object - restarting watch")
+				err := w.resetWatch("endpointslices")
+				if err != nil {
+					w.logger.Errorf("watcher: resetWatch() failed: %v", err)
+				}
+				continue
+			}
+			w.watchFailures = 0
+			epUpdates++
+			w.metrics.WatchData("endpointslices")
+			w.health.Event("endpointslices")
+			slice := evt.Object.(*discoveryv1.EndpointSlice)
+			w.processEndpointSlice(evt.Type, trimEndpointSlice(slice))
 
 		case evt, ok := <-w.configmaps.ResultChan():
 			if !ok || evt.Object == nil {
@@ -552,15 +751,16 @@ func (w *Watcher) watches() {
 				if evt.Object == nil {
 					log.Debugln("watcher: configmapsChan event object was nil - restarting watch")
 				}
-				err := w.resetWatch()
+				err := w.resetWatch("configmaps")
 				if err != nil {
 					w.logger.Errorf("watcher: resetWatch() failed: %v", err)
 				}
 				continue
 			}
-			w.watchBackoffDuration = 0
+			w.watchFailures = 0
 			cmUpdates++
 			w.metrics.WatchData("configmaps")
+			w.health.Event("configmaps")
 			// w.logger.Debugf("got new configmap from result chan")
 
 			cm := evt.Object.(*v1.ConfigMap)
@@ -575,20 +775,21 @@ func (w *Watcher) watches() {
 				if evt.Object == nil {
 					log.Debugln("watcher: nodeChan event object was nil - restarting watch")
 				}
-				err := w.resetWatch()
+				err := w.resetWatch("nodes")
 				if err != nil {
 					w.logger.Errorf("watcher: resetWatch() failed: %v", err)
 				}
 				continue
 			}
-			w.watchBackoffDuration = 0
+			w.watchFailures = 0
 			nodeUpdates++
 			w.metrics.WatchData("nodes")
+			w.health.Event("nodes")
 			// w.logger.Debugf("got nodes update from result chan")
 			n := evt.Object.(*v1.Node)
 			log.Debugln("watcher: nodeWatch chan got an event:", n.Name, evt.Type)
 
-			w.processNode(evt.Type, n.DeepCopy())
+			w.processNode(evt.Type, trimNode(n))
 
 			// Compute a new set of nodes and node endpoints. Compare that set of info to the
 			// set of info that was last transmitted.  If it changed, publish it.
@@ -607,7 +808,7 @@ func (w *Watcher) watches() {
 
 		case <-metricsUpdateTicker.C:
 
-			w.metrics.WatchBackoffDuration(w.watchBackoffDuration)
+			w.metrics.WatchBackoffDuration(w.watchBackoff())
 
 			w.logger.WithFields(log.Fields{
 				"total":     totalUpdates,
@@ -741,6 +942,28 @@ func (w *Watcher) buildNodeConfig() ([]*v1.Node, error) {
 	return nodeList, nil
 }
 
+// PodNodes returns the sorted names of the nodes running a ready pod in
+// namespace that matches selector, i.e. the directors that are up
+func (w *Watcher) PodNodes(namespace string, selector labels.Selector) []string {
+	w.RLock()
+	defer w.RUnlock()
+
+	seen := map[string]bool{}
+	nodes := []string{}
+	for _, p := range w.AllPods {
+		if p.Namespace != namespace || p.DeletionTimestamp != nil || p.Spec.NodeName == "" || seen[p.Spec.NodeName] {
+			continue
+		}
+		if !podReady(p) || !selector.Matches(labels.Set(p.Labels)) {
+			continue
+		}
+		seen[p.Spec.NodeName] = true
+		nodes = append(nodes, p.Spec.NodeName)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
 // GetPodIPsOnNode fetches all the PodIPs for the specified service on the specified node.
 func (w *Watcher) GetPodIPsOnNode(nodeName string, serviceName string, namespace string, portName string) []string {
 
@@ -958,15 +1181,83 @@ func (w *Watcher) watchPublish() {
 // }
 
 func (w *Watcher) publish(cc *types.ClusterConfig) {
-	log.Debugln("watcher: publishing new cluster config with", len(cc.Config), "IPv4 addresses and", len(cc.Config6), "IPv6 addresses")
-	w.ClusterConfig = cc
+	if w.refuseShrink(cc) {
+		return
+	}
 
-	// generate a new full config record
-	b, _ := json.Marshal(w.ClusterConfig)
+	// generate a new full config record. map keys are marshalled in order,
+	// so equal configs always hash the same
+	b, _ := json.Marshal(cc)
 	sha := sha1.Sum(b)
+	if sha != w.configSHA || w.generation == 0 {
+		w.generation++
+		w.configSHA = sha
+	}
+	cc.Generation = w.generation
+
+	log.Debugln("watcher: publishing new cluster config generation", cc.Generation, "with", len(cc.Config), "IPv4 addresses and", len(cc.Config6), "IPv6 addresses")
+	w.Lock()
+	cc.EventTime, w.changedAt = w.changedAt, time.Time{}
+	w.ClusterConfig = cc
+	w.Unlock()
+
+	w.metrics.ClusterConfigGeneration(cc.Generation)
 	w.metrics.ClusterConfigInfo(base64.StdEncoding.EncodeToString(sha[:]), string(b))
 }
 
+// shrinkMetrics records whether the shrink guard is refusing a change
+type shrinkMetrics interface {
+	ShrinkRefused(what string, refused bool)
+}
+
+// SetShrinkGuard refuses to publish configs that remove more than maxPercent of
+// the VIP ports in the current config, which is what an empty or truncated
+// configmap or a mass loss of endpoints looks like. The current config stays in
+// place until the change shrinks less or the configmap carries
+// types.AllowShrinkAnnotation. A maxPercent of zero disables the guard.
+func (w *Watcher) SetShrinkGuard(maxPercent int, metrics shrinkMetrics) {
+	w.Lock()
+	defer w.Unlock()
+	w.shrinkGuard = maxPercent
+	w.shrinkMetrics = metrics
+}
+
+// refuseShrink returns true when the shrink guard refuses to publish cc
+func (w *Watcher) refuseShrink(cc *types.ClusterConfig) bool {
+	w.RLock()
+	guard, metrics := w.shrinkGuard, w.shrinkMetrics
+	current, configMap := w.ClusterConfig, w.ConfigMap
+	w.RUnlock()
+	if guard <= 0 {
+		return false
+	}
+
+	total, removed := types.RemovedPorts(current, cc)
+	refused := types.Shrinks(total, removed, guard)
+	if refused && types.AllowShrink(configMap) {
+		w.logger.Warnf("watcher: publishing a config that removes %d of %d VIP ports because the configmap is annotated with %s", removed, total, types.AllowShrinkAnnotation)
+		refused = false
+	}
+	if refused {
+		w.logger.Errorf("watcher: refusing to publish a config that removes %d of %d VIP ports, more than the %d%% allowed. annotate the configmap with %s=true to apply it", removed, total, guard, types.AllowShrinkAnnotation)
+	}
+	if metrics != nil {
+		metrics.ShrinkRefused("config", refused)
+	}
+	return refused
+}
+
+// ConfigGeneration returns the Generation of the current cluster config, or 0 if
+// none has been published
+func (w *Watcher) ConfigGeneration() uint64 {
+	w.RLock()
+	defer w.RUnlock()
+	if w.ClusterConfig == nil {
+		return 0
+	}
+	return w.ClusterConfig.Generation
+}
+
 func (w *Watcher) publishNodes(nodes []*v1.Node) {
 	// startTime := time.Now()
 	// log.Debugln("watcher: publishNodes running")
@@ -995,6 +1286,15 @@ func (w *Watcher) buildClusterConfig() (*types.ClusterConfig, error) {
 	}
 	log.Debugln("watcher: buildClusterConfig newConfig has", len(newConfig.Config), "ipv4 configurations after extractConfigKey")
 
+	// add the VIP ports of the services that the templates match. the options
+	// of the templates are only checked once they are applied to a port
+	if added := w.expandTemplates(newConfig); added > 0 {
+		if err := newConfig.Validate(); err != nil {
+			return nil, fmt.Errorf("watcher: the config expanded from its templates is invalid. %w", err)
+		}
+		log.Debugln("watcher: buildClusterConfig added", added, "ports from templates")
+	}
+
 	// Update the config to eliminate any services that do not exist
 	err = w.filterConfig(newConfig)
 	if err != nil {
@@ -1093,6 +1393,42 @@ func (w *Watcher) HasConfigChanged(currentConfig *types.ClusterConfig, newConfig
 				log.Infoln("watcher:", currentKey, currentPortMapKey, "UDPEnabled has changed")
 				return true
 			}
+			if newConfig.Config[currentKey][currentPortMapKey].Translate != currentPortMapValue.Translate {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "Translate has changed")
+				return true
+			}
+			if !reflect.DeepEqual(newConfig.Config[currentKey][currentPortMapKey].Steering, currentPortMapValue.Steering) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "Steering has changed")
+				return true
+			}
+			if !reflect.DeepEqual(newConfig.Config[currentKey][currentPortMapKey].ACL, currentPortMapValue.ACL) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "ACL has changed")
+				return true
+			}
+			if newConfig.Config[currentKey][currentPortMapKey].TProxyPort != currentPortMapValue.TProxyPort {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "TProxyPort has changed")
+				return true
+			}
+			if !reflect.DeepEqual(newConfig.Config[currentKey][currentPortMapKey].AdaptiveWeight, currentPortMapValue.AdaptiveWeight) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "AdaptiveWeight has changed")
+				return true
+			}
+			if newConfig.Config[currentKey][currentPortMapKey].Hairpin != currentPortMapValue.Hairpin {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "Hairpin has changed")
+				return true
+			}
+			if !reflect.DeepEqual(newConfig.Config[currentKey][currentPortMapKey].Mirror, currentPortMapValue.Mirror) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "Mirror has changed")
+				return true
+			}
+			if !reflect.DeepEqual(newConfig.Config[currentKey][currentPortMapKey].PortRewrite, currentPortMapValue.PortRewrite) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "PortRewrite has changed")
+				return true
+			}
+			if !reflect.DeepEqual(newConfig.Config[currentKey][currentPortMapKey].BackendPorts, currentPortMapValue.BackendPorts) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "BackendPorts have changed")
+				return true
+			}
 			// this is disabled because flags can't be applied after a rule is created
 			// if newConfig.Config[currentKey][currentPortMapKey].IPVSOptions.Flags != currentPortMapValue.IPVSOptions.Flags {
 			// 	log.Infoln("watcher:", currentKey, currentPortMapKey, "IPVS Flags have changed:", newConfig.Config[currentKey][currentPortMapKey].IPVSOptions.Flags, "vs", currentPortMapValue.IPVSOptions.Flags)
@@ -1102,6 +1438,14 @@ func (w *Watcher) HasConfigChanged(currentConfig *types.ClusterConfig, newConfig
 				log.Infoln("watcher:", currentKey, currentPortMapKey, "RawForwardingMethod has changed")
 				return true
 			}
+			if newConfig.Config[currentKey][currentPortMapKey].IPVSOptions.PersistenceArgs(false) != currentPortMapValue.IPVSOptions.PersistenceArgs(false) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "IPVS persistence has changed")
+				return true
+			}
+			if newConfig.Config[currentKey][currentPortMapKey].IPVSOptions.OnePacket != currentPortMapValue.IPVSOptions.OnePacket {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "IPVS one packet scheduling has changed")
+				return true
+			}
 			if newConfig.Config[currentKey][currentPortMapKey].IPVSOptions.RawScheduler != currentPortMapValue.IPVSOptions.RawScheduler {
 				log.Infoln("watcher:", currentKey, currentPortMapKey, "RawScheduler has changed")
 				return true
@@ -1175,6 +1519,30 @@ func (w *Watcher) HasConfigChanged(currentConfig *types.ClusterConfig, newConfig
 				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 UDPEnabled has changed")
 				return true
 			}
+			if newConfig.Config6[currentKey][currentPortMapKey].Translate != currentPortMapValue.Translate {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 Translate has changed")
+				return true
+			}
+			if !reflect.DeepEqual(newConfig.Config6[currentKey][currentPortMapKey].Steering, currentPortMapValue.Steering) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 Steering has changed")
+				return true
+			}
+			if !reflect.DeepEqual(newConfig.Config6[currentKey][currentPortMapKey].ACL, currentPortMapValue.ACL) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 ACL has changed")
+				return true
+			}
+			if newConfig.Config6[currentKey][currentPortMapKey].TProxyPort != currentPortMapValue.TProxyPort {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 TProxyPort has changed")
+				return true
+			}
+			if !reflect.DeepEqual(newConfig.Config6[currentKey][currentPortMapKey].AdaptiveWeight, currentPortMapValue.AdaptiveWeight) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 AdaptiveWeight has changed")
+				return true
+			}
+			if !reflect.DeepEqual(newConfig.Config6[currentKey][currentPortMapKey].BackendPorts, currentPortMapValue.BackendPorts) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 BackendPorts have changed")
+				return true
+			}
 			// this is disabled because flags can't be applied once a rule is created
 			// if newConfig.Config6[currentKey][currentPortMapKey].IPVSOptions.Flags != currentPortMapValue.IPVSOptions.Flags {
 			// 	log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 IPVS Flags have changed")
@@ -1184,6 +1552,14 @@ func (w *Watcher) HasConfigChanged(currentConfig *types.ClusterConfig, newConfig
 				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 RawForwardingMethod has changed")
 				return true
 			}
+			if newConfig.Config6[currentKey][currentPortMapKey].IPVSOptions.PersistenceArgs(true) != currentPortMapValue.IPVSOptions.PersistenceArgs(true) {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 IPVS persistence has changed")
+				return true
+			}
+			if newConfig.Config6[currentKey][currentPortMapKey].IPVSOptions.OnePacket != currentPortMapValue.IPVSOptions.OnePacket {
+				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 IPVS one packet scheduling has changed")
+				return true
+			}
 			if newConfig.Config6[currentKey][currentPortMapKey].IPVSOptions.RawScheduler != currentPortMapValue.IPVSOptions.RawScheduler {
 				log.Infoln("watcher:", currentKey, currentPortMapKey, "config6 RawScheduler has changed")
 				return true
@@ -1228,6 +1604,38 @@ func (w *Watcher) HasConfigChanged(currentConfig *types.ClusterConfig, newConfig
 		}
 	}
 
+	// Check the defenses for changes
+	if !reflect.DeepEqual(currentConfig.Defense, newConfig.Defense) {
+		log.Infoln("watcher: defense configuration has changed")
+		return true
+	}
+	if !reflect.DeepEqual(currentConfig.IPVSDefense, newConfig.IPVSDefense) {
+		log.Infoln("watcher: ipvs defense configuration has changed")
+		return true
+	}
+
+	// Check the director policies for changes
+	if !reflect.DeepEqual(currentConfig.Directors, newConfig.Directors) {
+		log.Infoln("watcher: director policies have changed")
+		return true
+	}
+	if !reflect.DeepEqual(currentConfig.Sharding, newConfig.Sharding) {
+		log.Infoln("watcher: sharding configuration has changed")
+		return true
+	}
+
+	// Check the return routes for changes
+	if !reflect.DeepEqual(currentConfig.Routes, newConfig.Routes) {
+		log.Infoln("watcher: return routes have changed")
+		return true
+	}
+
+	// Check the VRFs for changes
+	if !reflect.DeepEqual(currentConfig.VRFs, newConfig.VRFs) {
+		log.Infoln("watcher: vrfs have changed")
+		return true
+	}
+
 	if currentConfig.MTUConfig == nil || newConfig.MTUConfig == nil {
 		log.Warningln("watcher: MTUConfig was empty on new or current config")
 		return false
@@ -1419,10 +1827,12 @@ func (w *Watcher) processEndpoint(eventType watch.EventType, endpoints *v1.Endpo
 	switch eventType {
 	case "ADDED", "MODIFIED":
 		log.Debugln("watcher: there are now", len(endpoints.Subsets), "subsets for endpoint", identity)
+		w.noteChange(identity, endpoints)
 		w.AllEndpoints[identity] = endpoints
 	case "DELETED":
 		log.Debugln("watcher: endpoints and all subsets deleted:", endpoints.Name)
 		// w.logger.Debugf("processEndpoint - DELETED")
+		w.noteChange(identity, endpoints)
 		delete(w.AllEndpoints, identity)
 
 	default:
@@ -1535,7 +1945,9 @@ func (w *Watcher) ServiceHasValidEndpoints(ns, svc string) bool {
 		}
 	}
 
-	return false
+	// a service whose pods are all shutting down keeps its VIP ports until
+	// they stop serving, so that established connections drain
+	return len(w.terminatingEndpoints(svc, ns, "")) != 0
 }
 
 func (w *Watcher) userServiceInEndpoints(ns, svc, portName string) bool {
@@ -1556,7 +1968,7 @@ func (w *Watcher) userServiceInEndpoints(ns, svc, portName string) bool {
 			}
 		}
 	}
-	return false
+	return len(w.terminatingEndpoints(svc, ns, portName)) != 0
 }
 
 func (w *Watcher) ServiceExistsInConfig(config *types.ClusterConfig, serviceName string, namespace string, portName string) bool {
@@ -1607,18 +2019,42 @@ func (w *Watcher) filterConfig(inCC *types.ClusterConfig) error {
 		return fmt.Errorf("watcher: filterConfig can't run because the passed in cluster config was nil")
 	}
 
-	// track how many ports are removed for filtering reasons
-	// var filteredPorts []string
-	var filteredCount int
-
 	// var notFilteredPorts []string
 	if inCC.Config == nil {
 		return fmt.Errorf("watcher: filterConfig can't run because the passed in cluster config was nil")
 	}
 
+	// named ports take the number their service gives them before the
+	// services are checked
+	filteredCount := w.resolveNamedPorts(inCC.Config) + w.resolveNamedPorts(inCC.Config6)
+
+	// walk the input configmap and check for matches. v6 only clusters have
+	// nothing but Config6, so both families are filtered the same way
+	filteredCount += w.filterPortMaps(inCC.Config) + w.filterPortMaps(inCC.Config6)
+	w.validatePortRewrites(inCC.Config)
+
+	// display how many ports were filtered and what they were
+	// log.Debugln("watcher: filterConfig filtered", filteredCount, "services out of the cluster config:", strings.Join(filteredPorts, ", "))
+	log.Debugln("watcher: filterConfig filtered", filteredCount, "services out of the cluster config")
+	if inCC.Config == nil {
+		log.Debugln("watcher: filterConfig inCC.Config == nil")
+		return fmt.Errorf("watcher: inCC.Config nil after filtering services")
+	}
+
+	// debug output how many services _are_ configured
+	// log.Debugln("watcher: after filtering there were", len(notFilteredPorts), "services in the cluster config:", strings.Join(notFilteredPorts, ","))
+
+	return nil
+}
+
+// filterPortMaps removes the ports of config whose services have no endpoints
+// or cluster ip yet, returning how many were removed
+func (w *Watcher) filterPortMaps(config map[types.ServiceIP]types.PortMap) int {
+	var filteredCount int
+
 	// walk the input configmap and check for matches.
 	// if no match is found, continue. if a match is found, add the entire portMap back into the config
-	for lbVIP, portMap := range inCC.Config {
+	for lbVIP, portMap := range config {
 		for port, lbTarget := range portMap {
 
 			// if the lbTarget is nil, then there is nothing to filter
@@ -1633,7 +2069,7 @@ func (w *Watcher) filterConfig(inCC *types.ClusterConfig) error {
 
 				// remove this item from the config because there are no endpoints for it yet
 				w.Lock()
-				delete(inCC.Config[lbVIP], port)
+				delete(config[lbVIP], port)
 				w.Unlock()
 
 				filteredCount++
@@ -1645,7 +2081,7 @@ func (w *Watcher) filterConfig(inCC *types.ClusterConfig) error {
 
 				// remove this item from the config because there isn't a clusterIP set for it yet
 				w.Lock()
-				delete(inCC.Config[lbVIP], port)
+				delete(config[lbVIP], port)
 				w.Unlock()
 
 				filteredCount++
@@ -1659,7 +2095,7 @@ func (w *Watcher) filterConfig(inCC *types.ClusterConfig) error {
 
 				// delete service if it does not have valid endpoints
 				w.Lock()
-				delete(inCC.Config[lbVIP], port)
+				delete(config[lbVIP], port)
 				w.Unlock()
 
 				filteredCount++
@@ -1670,18 +2106,7 @@ func (w *Watcher) filterConfig(inCC *types.ClusterConfig) error {
 		}
 	}
 
-	// display how many ports were filtered and what they were
-	// log.Debugln("watcher: filterConfig filtered", filteredCount, "services out of the cluster config:", strings.Join(filteredPorts, ", "))
-	log.Debugln("watcher: filterConfig filtered", filteredCount, "services out of the cluster config")
-	if inCC.Config == nil {
-		log.Debugln("watcher: filterConfig inCC.Config == nil")
-		return fmt.Errorf("watcher: inCC.Config nil after filtering services")
-	}
-
-	// debug output how many services _are_ configured
-	// log.Debugln("watcher: after filtering there were", len(notFilteredPorts), "services in the cluster config:", strings.Join(notFilteredPorts, ","))
-
-	return nil
+	return filteredCount
 }
 
 // func (n *Node) HasServiceRunning(namespace, service, portName string) bool {
@@ -1712,6 +2137,26 @@ func (w *Watcher) NodeHasServiceRunning(nodeName string, namespace string, servi
 	// return len(endpointAddresses) > 0
 }
 
+// PodCIDRsForNode returns the ranges the pods of the node are given addresses
+// from, or nothing when the node is unknown or has none assigned
+func (w *Watcher) PodCIDRsForNode(nodeName string) []string {
+	w.RLock()
+	defer w.RUnlock()
+	for _, n := range w.Nodes {
+		if n.Name != nodeName {
+			continue
+		}
+		if len(n.Spec.PodCIDRs) > 0 {
+			return append([]string{}, n.Spec.PodCIDRs...)
+		}
+		if n.Spec.PodCIDR != "" {
+			return []string{n.Spec.PodCIDR}
+		}
+		return nil
+	}
+	return nil
+}
+
 // func (n *Node) HasServiceRunning(namespace, service, portName string) bool {
 // 	for _, endpoint := range n.Endpoints {
 // 		if endpoint.Namespace == namespace && endpoint.Service == service {
@@ -33,6 +33,15 @@ type WatcherMetrics interface {
 
 	// contains the full applied configutration and a hash of it
 	ClusterConfigInfo(sha string, info string)
+
+	// the generation of the most recently published cluster config
+	// gauge rdei_lb_watch_cluster_config_generation
+	ClusterConfigGeneration(generation uint64)
+
+	// whether rules are generated from the config cache, before the watcher
+	// has synced with the api server
+	// gauge rdei_lb_watch_config_cache_in_use
+	ConfigCacheInUse(inUse bool)
 }
 
 type Metrics struct {
@@ -48,6 +57,8 @@ type Metrics struct {
 	dataCount       *prometheus.CounterVec
 	configCount     *prometheus.CounterVec
 	configInfo      *prometheus.GaugeVec
+	configGen       *prometheus.GaugeVec
+	cacheInUse      *prometheus.GaugeVec
 }
 
 func (m *Metrics) WatchBackoffDuration(d time.Duration) {
@@ -73,6 +84,16 @@ func (m *Metrics) WatchData(endpoint string) {
 func (m *Metrics) WatchClusterConfig(event string) {
 	m.configCount.With(prometheus.Labels{"lb": m.kind, "seczone": m.secZone, "event": event}).Add(1)
 }
+func (m *Metrics) ClusterConfigGeneration(generation uint64) {
+	m.configGen.With(prometheus.Labels{"lb": m.kind, "seczone": m.secZone}).Set(float64(generation))
+}
+func (m *Metrics) ConfigCacheInUse(inUse bool) {
+	v := 0.0
+	if inUse {
+		v = 1
+	}
+	m.cacheInUse.With(prometheus.Labels{"lb": m.kind, "seczone": m.secZone}).Set(v)
+}
 func (m *Metrics) ClusterConfigInfo(sha string, info string) {
 	// because this has potential to be a high-cardinality metric,
 	// clearing the metrics every few minutes. Note that this may result
@@ -145,7 +166,21 @@ func NewWatcherMetrics(kind, secZone string) WatcherMetrics {
 		Help: "returns the current value of the watch backoff duration. a non-1s duration indicates that the backoff is present and the load balancer is unable to communicate with the api server",
 	}, defaultLabels)
 
+	// gauge watch_cluster_config_generation
+	configGen := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: stats.Prefix + "watch_cluster_config_generation",
+		Help: "is the generation of the most recently published cluster config. it increases only when the config content changes",
+	}, defaultLabels)
+
+	// gauge watch_config_cache_in_use
+	cacheInUse := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: stats.Prefix + "watch_config_cache_in_use",
+		Help: "is 1 while rules are generated from the config cache because the watcher has not synced with the api server since startup",
+	}, defaultLabels)
+
 	prometheus.MustRegister(configInfo)
+	prometheus.MustRegister(cacheInUse)
+	prometheus.MustRegister(configGen)
 	prometheus.MustRegister(reconfigCount)
 	prometheus.MustRegister(dataCount)
 	prometheus.MustRegister(watchLatency)
@@ -161,6 +196,8 @@ func NewWatcherMetrics(kind, secZone string) WatcherMetrics {
 
 		backoffDuration: backoffDuration,
 		configInfo:      configInfo,
+		configGen:       configGen,
+		cacheInUse:      cacheInUse,
 		configCount:     reconfigCount,
 		dataCount:       dataCount,
 		initLatency:     watchLatency,
@@ -3,11 +3,23 @@ package watcher
 import (
 	"encoding/json"
 	"io/ioutil"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Comcast/Ravel/pkg/stats"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
 	log "github.com/sirupsen/logrus"
 )
 
+var testHealth = stats.NewWatchHealth("test", "zone", prometheus.NewRegistry())
+
 func loadTestWatcherJSON(filePath string) (*Watcher, error) {
 	var w Watcher
 	b, err := ioutil.ReadFile(filePath)
@@ -91,3 +103,449 @@ func TestUserServiceInEndpoints(t *testing.T) {
 		t.Fatal("no endpoints found for service, but there should be")
 	}
 }
+
+func TestSnapshotIsDetached(t *testing.T) {
+	w, err := loadTestWatcherJSON("watcher.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := w.Snapshot()
+
+	// changes to the watcher after the snapshot must not be visible in it
+	for vip := range w.ClusterConfig.Config {
+		delete(w.ClusterConfig.Config, vip)
+	}
+	if len(w.Nodes) > 0 {
+		w.Nodes[0].Name = "changed"
+		if s.Nodes[0].Name == "changed" {
+			t.Fatal("expected snapshot nodes to be copies")
+		}
+	}
+	if len(s.ClusterConfig.Config) == 0 {
+		t.Fatal("expected snapshot config to be unaffected by changes to the watcher")
+	}
+
+	for k := range w.AllEndpoints {
+		delete(w.AllEndpoints, k)
+	}
+	if eps := s.GetEndpointAddressesForService("vsg-ml-inference-consumer", "nginx", "http"); len(eps) != 1 {
+		t.Fatal("wrong number of endpoint addresses in snapshot")
+	}
+}
+
+type fakeWatcherMetrics struct {
+	cacheInUse bool
+}
+
+func (m *fakeWatcherMetrics) WatchBackoffDuration(d time.Duration)      {}
+func (m *fakeWatcherMetrics) WatchErr(endpoint string, err error)       {}
+func (m *fakeWatcherMetrics) WatchInit(d time.Duration)                 {}
+func (m *fakeWatcherMetrics) WatchData(endpoint string)                 {}
+func (m *fakeWatcherMetrics) WatchClusterConfig(event string)           {}
+func (m *fakeWatcherMetrics) ClusterConfigInfo(sha string, info string) {}
+func (m *fakeWatcherMetrics) ClusterConfigGeneration(generation uint64) {}
+func (m *fakeWatcherMetrics) ConfigCacheInUse(inUse bool)               { m.cacheInUse = inUse }
+
+func TestConfigCache(t *testing.T) {
+	w, err := loadTestWatcherJSON("watcher.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.logger = log.New()
+	path := filepath.Join(t.TempDir(), "config-cache.json")
+	if err := w.SetCache(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteCache(w.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted watcher that hasn't heard from the api server
+	metrics := &fakeWatcherMetrics{}
+	restarted := &Watcher{ConfigKey: w.ConfigKey, logger: log.New(), metrics: metrics, health: testHealth}
+	if err := restarted.SetCache(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !metrics.cacheInUse {
+		t.Fatal("expected the config cache to be in use")
+	}
+	config, nodes := restarted.Current()
+	if config == nil || len(config.Config) != len(w.ClusterConfig.Config) || len(nodes) != len(w.Nodes) {
+		t.Fatal("expected the cached config and nodes before the watcher has synced")
+	}
+	s := restarted.Snapshot()
+	if addrs := s.GetEndpointAddressesForService("vsg-ml-inference-consumer", "nginx", "http"); len(addrs) != 1 {
+		t.Fatalf("expected the endpoints of the cached snapshot. have %v", addrs)
+	}
+
+	// once synced, the watcher's own state is used
+	restarted.ClusterConfig = w.ClusterConfig.DeepCopy()
+	restarted.Nodes = w.Nodes[:0]
+	restarted.health.SetSynced("nodes", func() bool { return true })
+	defer testHealth.Unsynced()
+	if _, nodes := restarted.Current(); len(nodes) != 0 || metrics.cacheInUse {
+		t.Fatal("expected the config cache to be dropped once the watcher has synced")
+	}
+
+	// a watcher that isn't watching uses its own state as soon as it has one
+	unwatched := &Watcher{ConfigKey: w.ConfigKey, logger: log.New(), metrics: metrics}
+	if err := unwatched.SetCache(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	unwatched.ClusterConfig = w.ClusterConfig.DeepCopy()
+	unwatched.Nodes = w.Nodes[:0]
+	if _, nodes := unwatched.Current(); len(nodes) != 0 {
+		t.Fatal("expected the state of a watcher without watch health over the config cache")
+	}
+
+	// a corrupt cache is refused
+	b, _ := ioutil.ReadFile(path)
+	b[len(b)/2] ^= 1
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Watcher{ConfigKey: w.ConfigKey, logger: log.New(), metrics: metrics}).SetCache(path, nil); err == nil {
+		t.Fatal("expected an error loading a corrupt config cache")
+	}
+
+	// a signed cache is only loaded with its key, and an unsigned one not
+	// at all once there is a key
+	key := []byte("0123456789abcdef0123456789abcdef")
+	unsigned := filepath.Join(t.TempDir(), "config-cache.json")
+	signed := filepath.Join(t.TempDir(), "config-cache.json")
+	for path, key := range map[string][]byte{unsigned: nil, signed: key} {
+		if err := w.SetCache(path, key); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteCache(w.Snapshot()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, c := range map[string]struct {
+		path string
+		key  []byte
+		ok   bool
+	}{
+		"signed":    {signed, key, true},
+		"other key": {signed, []byte("another key"), false},
+		"unsigned":  {unsigned, key, false},
+	} {
+		err := (&Watcher{ConfigKey: w.ConfigKey, logger: log.New(), metrics: metrics}).SetCache(c.path, c.key)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: expected loaded=%v. have %v", name, c.ok, err)
+		}
+	}
+}
+
+func TestTerminatingEndpoints(t *testing.T) {
+	yes, no := true, false
+	http := "http"
+	w := &Watcher{AllEndpoints: map[string]*v1.Endpoints{
+		"nginx/drain": {
+			ObjectMeta: metav1.ObjectMeta{Namespace: "nginx", Name: "drain"},
+			Subsets:    []v1.EndpointSubset{{Ports: []v1.EndpointPort{{Name: "http", Port: 8080}}}},
+		},
+	}}
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nginx", Name: "drain-x7k2p", Labels: map[string]string{discoveryv1.LabelServiceName: "drain"}},
+		Ports:      []discoveryv1.EndpointPort{{Name: &http}},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.131.153.76"}, Conditions: discoveryv1.EndpointConditions{Ready: &no, Serving: &yes, Terminating: &yes}},
+			{Addresses: []string{"10.131.153.77"}, Conditions: discoveryv1.EndpointConditions{Ready: &no, Serving: &no, Terminating: &yes}},
+			{Addresses: []string{"10.131.153.78"}, Conditions: discoveryv1.EndpointConditions{Ready: &no, Serving: &no, Terminating: &no}},
+		},
+	}
+
+	if w.ServiceHasValidEndpoints("nginx", "drain") {
+		t.Fatal("expected a service with no ready endpoints to be invalid without endpointslices")
+	}
+
+	w.processEndpointSlice("ADDED", slice)
+	if eps := w.TerminatingEndpointsForService("drain", "nginx", "http"); len(eps) != 1 || eps[0].Addresses[0] != "10.131.153.76" {
+		t.Fatalf("expected only the serving terminating endpoint. have %v", eps)
+	}
+	if eps := w.TerminatingEndpointsForService("drain", "nginx", "https"); len(eps) != 0 {
+		t.Fatalf("expected no endpoints for another port. have %v", eps)
+	}
+	if !w.ServiceHasValidEndpoints("nginx", "drain") || !w.userServiceInEndpoints("nginx", "drain", "http") {
+		t.Fatal("expected a service with serving terminating endpoints to keep its VIP ports")
+	}
+
+	w.processEndpointSlice("DELETED", slice)
+	if w.ServiceHasValidEndpoints("nginx", "drain") {
+		t.Fatal("expected the service to be invalid once its endpointslice is gone")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	w := &Watcher{logger: log.New(), health: testHealth}
+	w.SetReconnect(util.Backoff{Initial: time.Second, Max: 4 * time.Second}, 3)
+	w.health.Unsynced()
+
+	waits, relists := []time.Duration{}, 0
+	for i := 0; i < 6; i++ {
+		wait, relist := w.watchFailed()
+		waits = append(waits, wait)
+		if relist {
+			relists++
+		}
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second, 4 * time.Second, 4 * time.Second}
+	for i := range want {
+		if waits[i] != want[i] {
+			t.Fatalf("expected the backoff to double up to its max. have %v", waits)
+		}
+	}
+	if relists != 2 {
+		t.Fatalf("expected a relist every 3 failures. have %d", relists)
+	}
+	if w.watchBackoff() != 4*time.Second {
+		t.Fatalf("expected the current backoff to be reported. have %v", w.watchBackoff())
+	}
+
+	// stale until the informers of the restarted watches have synced
+	if w.StaleFor() <= 0 {
+		t.Fatal("expected the watcher to be stale while its watches are failing")
+	}
+	w.health.SetSynced("nodes", func() bool { return true })
+	if age := w.StaleFor(); age != 0 {
+		t.Fatalf("expected a synced watcher not to be stale. have %v", age)
+	}
+	w.health.Unsynced()
+	if age := w.StaleFor(); age != 0 {
+		t.Fatalf("expected staleness to start with the next failure, not before. have %v", age)
+	}
+}
+
+func TestTrim(t *testing.T) {
+	meta := metav1.ObjectMeta{
+		Name:          "10.131.153.76",
+		Labels:        map[string]string{"role": "realserver"},
+		Annotations:   map[string]string{lastAppliedAnnotation: "{}", "ravel/drain": "true"},
+		ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubelet"}},
+	}
+	node := &v1.Node{ObjectMeta: meta, Status: v1.NodeStatus{
+		Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.131.153.76"}},
+		Images:    []v1.ContainerImage{{Names: []string{"nginx"}}},
+	}}
+	n := trimNode(node)
+	if n.Status.Images != nil || n.ManagedFields != nil || len(n.Annotations) != 1 || n.Annotations["ravel/drain"] != "true" {
+		t.Fatalf("expected the images, managed fields and last applied configuration to be dropped. have %+v", n)
+	}
+	if len(n.Status.Addresses) != 1 || n.Labels["role"] != "realserver" {
+		t.Fatalf("expected the addresses and labels to be kept. have %+v", n)
+	}
+	if node.Status.Images == nil || len(node.Annotations) != 2 {
+		t.Fatal("expected the informer's node to be left as it was")
+	}
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nginx", Name: "nginx-x7k2p", Labels: map[string]string{"app": "nginx"}, ManagedFields: meta.ManagedFields},
+		Spec:       v1.PodSpec{NodeName: "10.131.153.76", Containers: []v1.Container{{Name: "nginx"}}},
+		Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: "100.127.0.5"},
+	}
+	p := trimPod(pod)
+	if p.Spec.Containers != nil || p.ManagedFields != nil {
+		t.Fatalf("expected only the pod's placement and addresses. have %+v", p)
+	}
+	if p.Namespace != "nginx" || p.Name != "nginx-x7k2p" || p.Spec.NodeName != "10.131.153.76" || p.Status.PodIP != "100.127.0.5" || p.Labels["app"] != "nginx" {
+		t.Fatalf("expected the pod's placement and addresses to be kept. have %+v", p)
+	}
+}
+
+func TestResolveNamedPorts(t *testing.T) {
+	w := &Watcher{
+		AllServices: map[string]*v1.Service{
+			"web/frontend": {Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+				{Name: "http", Port: 8080},
+				{Name: "https", Port: 443},
+			}}},
+		},
+	}
+	def := func(portName string) *types.ServiceDef {
+		return &types.ServiceDef{Namespace: "web", Service: "frontend", PortName: portName}
+	}
+	config := map[types.ServiceIP]types.PortMap{
+		"10.54.213.165": {
+			"http":    def("http"),
+			"https":   def("https"),
+			"grpc":    def("grpc"),
+			"443":     def("https-alt"),
+			"missing": {Namespace: "web", Service: "backend", PortName: "http"},
+		},
+	}
+
+	if removed := w.resolveNamedPorts(config); removed != 3 {
+		t.Fatalf("expected the unknown ports and the collision to be removed. have %d", removed)
+	}
+	ports := config["10.54.213.165"]
+	if len(ports) != 2 || ports["8080"] == nil || ports["8080"].PortName != "http" {
+		t.Fatalf("expected http to resolve to 8080. have %+v", ports)
+	}
+	if ports["443"].PortName != "https-alt" {
+		t.Fatalf("expected the numbered port to win over the named one. have %+v", ports["443"])
+	}
+
+	// renumbering the port in the service moves the VIP port with it
+	w.AllServices["web/frontend"].Spec.Ports[0].Port = 9090
+	config = map[types.ServiceIP]types.PortMap{"10.54.213.165": {"http": def("http")}}
+	w.resolveNamedPorts(config)
+	if config["10.54.213.165"]["9090"] == nil {
+		t.Fatalf("expected http to follow the service to 9090. have %+v", config)
+	}
+}
+
+func TestExpandTemplates(t *testing.T) {
+	service := func(namespace, name string, expose string, ports ...v1.ServicePort) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: map[string]string{"expose": expose}},
+			Spec:       v1.ServiceSpec{Ports: ports},
+		}
+	}
+	http := v1.ServicePort{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}
+	w := &Watcher{
+		AllServices: map[string]*v1.Service{
+			"team-a/web":    service("team-a", "web", "true", http, v1.ServicePort{Name: "metrics", Port: 9100}),
+			"team-a/api":    service("team-a", "api", "true", http),
+			"team-a/dns":    service("team-a", "dns", "true", v1.ServicePort{Name: "dns", Port: 53, Protocol: v1.ProtocolTCP}, v1.ServicePort{Name: "dns-udp", Port: 53, Protocol: v1.ProtocolUDP}),
+			"team-a/hidden": service("team-a", "hidden", "false", http),
+			"team-b/web":    service("team-b", "web", "true", http),
+			"team-a/listed": service("team-a", "listed", "true", http),
+		},
+	}
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.165": {"80": &types.ServiceDef{Namespace: "team-a", Service: "listed", PortName: "http", TCPEnabled: true}},
+		},
+		Templates: []types.ServiceTemplate{{
+			Namespace: "team-a",
+			Selector:  map[string]string{"expose": "true"},
+			Pool:      []types.ServiceIP{"10.54.213.150", "10.54.213.151"},
+			Ports:     []string{"http", "dns", "dns-udp"},
+		}},
+	}
+
+	// web and api both want port 80, so they take a VIP each, and dns is a
+	// single port with both protocols
+	if added := w.expandTemplates(config); added != 3 {
+		t.Fatalf("expected the http ports of web and api and the dns port. have %d in %+v", added, config.Config)
+	}
+	services := map[string]types.ServiceIP{}
+	for vip, ports := range config.Config {
+		for port, def := range ports {
+			if port == "9100" {
+				t.Fatal("expected the metrics port not to be served")
+			}
+			if def.Namespace == "team-b" || def.Service == "hidden" {
+				t.Fatalf("expected %s/%s not to match", def.Namespace, def.Service)
+			}
+			services[def.Service] = vip
+			if def.Service == "dns" && (!def.TCPEnabled || !def.UDPEnabled) {
+				t.Fatalf("expected dns to serve tcp and udp. have %+v", def)
+			}
+		}
+	}
+	if services["web"] == services["api"] || services["listed"] != "10.54.213.165" {
+		t.Fatalf("expected web and api on VIPs of their own and listed on its entry. have %v", services)
+	}
+
+	// without its entry, listed competes for port 80 too, and the last of
+	// the services in order finds no VIP left
+	config.Config = map[types.ServiceIP]types.PortMap{}
+	if added := w.expandTemplates(config); added != 3 {
+		t.Fatalf("expected api and dns to keep their ports and listed to take the last port 80. have %d", added)
+	}
+	for _, ports := range config.Config {
+		if def := ports["80"]; def != nil && def.Service == "web" {
+			t.Fatal("expected web to find no VIP left")
+		}
+	}
+}
+
+func TestNoteChange(t *testing.T) {
+	triggered := time.Now().Add(-3 * time.Second).UTC().Truncate(time.Millisecond)
+	ep := func(version string, at time.Time) *v1.Endpoints {
+		return &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "syseng",
+			Name:            "web",
+			ResourceVersion: version,
+			Annotations:     map[string]string{v1.EndpointsLastChangeTriggerTime: at.Format(time.RFC3339Nano)},
+		}}
+	}
+	w := &Watcher{AllEndpoints: map[string]*v1.Endpoints{}}
+
+	// the initial sync is not a change
+	w.processEndpoint("ADDED", ep("1", triggered.Add(-time.Hour)))
+	if !w.changedAt.IsZero() {
+		t.Fatalf("expected no change before a config is published. saw %v", w.changedAt)
+	}
+
+	w.ClusterConfig = &types.ClusterConfig{}
+	w.processEndpoint("ADDED", ep("1", triggered.Add(-time.Hour)))
+	if !w.changedAt.IsZero() {
+		t.Fatalf("expected a relist without change to be ignored. saw %v", w.changedAt)
+	}
+	w.processEndpoint("MODIFIED", ep("2", triggered))
+	w.processEndpoint("MODIFIED", ep("3", triggered.Add(time.Second)))
+	if !w.changedAt.Equal(triggered) {
+		t.Fatalf("expected the earliest change at %v. saw %v", triggered, w.changedAt)
+	}
+
+	// a trigger time from the future is taken as the time it was seen
+	now := time.Now()
+	if at := changeTime(ep("4", now.Add(time.Hour)), now); !at.Equal(now) {
+		t.Fatalf("expected a change from the future to be taken as now. saw %v", at)
+	}
+}
+
+func TestVIPPatches(t *testing.T) {
+	web := &types.ServiceDef{Namespace: "syseng", Service: "web", TCPEnabled: true}
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.147": {"80": web, "443": web},
+			"10.54.213.148": {"80": web},
+		},
+		Config6: map[types.ServiceIP]types.PortMap{
+			"2001:db8::7": {"80": web},
+		},
+	}
+	svc := func(annotations map[string]string, lb bool, ingress ...string) *v1.Service {
+		s := &v1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}}
+		if lb {
+			s.Spec.Type = v1.ServiceTypeLoadBalancer
+		}
+		for _, ip := range ingress {
+			s.Status.LoadBalancer.Ingress = append(s.Status.LoadBalancer.Ingress, v1.LoadBalancerIngress{IP: ip})
+		}
+		return s
+	}
+	vips := "10.54.213.147,10.54.213.148,2001:db8::7"
+
+	for name, c := range map[string]struct {
+		key    string
+		svc    *v1.Service
+		meta   string
+		status string
+	}{
+		"publish": {"syseng/web", svc(nil, true),
+			`{"metadata":{"annotations":{"external-dns.alpha.kubernetes.io/target":"` + vips + `","ravel.comcast.com/vips":"` + vips + `"}}}`,
+			`{"status":{"loadBalancer":{"ingress":[{"ip":"10.54.213.147"},{"ip":"10.54.213.148"},{"ip":"2001:db8::7"}]}}}`},
+		"published": {"syseng/web", svc(map[string]string{types.VIPsAnnotation: vips, types.ExternalDNSTargetAnnotation: vips}, true, "10.54.213.147", "10.54.213.148", "2001:db8::7"), "", ""},
+		"user target": {"syseng/web", svc(map[string]string{types.ExternalDNSTargetAnnotation: "web.example.com"}, false),
+			`{"metadata":{"annotations":{"ravel.comcast.com/vips":"` + vips + `"}}}`, ""},
+		"other controller": {"syseng/web", svc(map[string]string{types.VIPsAnnotation: vips, types.ExternalDNSTargetAnnotation: vips}, true, "192.0.2.1"), "", ""},
+		"release": {"syseng/api", svc(map[string]string{types.VIPsAnnotation: "10.54.213.149", types.ExternalDNSTargetAnnotation: "10.54.213.149"}, true, "10.54.213.149"),
+			`{"metadata":{"annotations":{"external-dns.alpha.kubernetes.io/target":null,"ravel.comcast.com/vips":null}}}`,
+			`{"status":{"loadBalancer":{"ingress":[]}}}`},
+		"unrelated": {"syseng/db", svc(nil, true), "", ""},
+	} {
+		patches, err := vipPatches(config, map[string]*v1.Service{c.key: c.svc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch := patches[c.key]
+		if string(patch.meta) != c.meta || string(patch.status) != c.status {
+			t.Errorf("%s: expected %s %s. saw %s %s", name, c.meta, c.status, patch.meta, patch.status)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package watchplane
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/mtls"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/util"
+)
+
+// Client asks a Server for the bundles of a node. A connection that breaks,
+// as when the server restarts, is made again on the next call.
+type Client struct {
+	addr   string
+	tls    *mtls.Files
+	client *rpc.Client
+}
+
+// NewClient creates a Client of the server on addr. It connects on the first
+// call.
+func NewClient(addr string) *Client {
+	return &Client{addr: addr}
+}
+
+// SetTLS connects to a server that serves the bundles with mutual TLS,
+// presenting the certificate of files
+func (c *Client) SetTLS(files *mtls.Files) {
+	c.tls = files
+}
+
+// Next returns the bundle of node once it is newer than the bundle of epoch
+// and revision, see Server.Next
+func (c *Client) Next(ctx context.Context, node, epoch string, revision uint64, wait time.Duration) (*Bundle, error) {
+	if c.client == nil {
+		conn, err := mtls.Dial(ctx, c.addr, c.tls, 10*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("watchplane: unable to connect to %s. %v", c.addr, err)
+		}
+		c.client = jsonrpc.NewClient(conn)
+	}
+
+	// a server that went away without closing the connection never replies,
+	// so the call is given up on a while after the server would have
+	if wait <= 0 {
+		wait = DefaultWait
+	}
+	callCtx, cancel := context.WithTimeout(ctx, wait+30*time.Second)
+	defer cancel()
+
+	bundle := &Bundle{}
+	args := NextArgs{Node: node, Epoch: epoch, Revision: revision, Wait: wait}
+	call := c.client.Go(serviceName+".Next", args, bundle, make(chan *rpc.Call, 1))
+	select {
+	case <-callCtx.Done():
+		c.Close()
+		return nil, fmt.Errorf("watchplane: no bundle from %s. %v", c.addr, callCtx.Err())
+	case <-call.Done:
+	}
+	if call.Error != nil {
+		if _, ok := call.Error.(rpc.ServerError); !ok {
+			c.Close()
+		}
+		return nil, call.Error
+	}
+	return bundle, nil
+}
+
+// Close closes the connection to the server
+func (c *Client) Close() error {
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
+
+// Agent applies the bundles of its node: the VIPs of the cluster config on
+// the loopback and the iptables rules of the pods on the node, as a
+// realserver would from watches of its own. v6 VIPs are added, but the
+// haproxy bridges of a realserver to their v4 pods are not run.
+type Agent struct {
+	node      string
+	client    *Client
+	ipDevices system.AddressManager
+	ipt       iptables.RuleApplier
+
+	// cache is where the last bundle applied is written, so that a
+	// restarted agent applies it at once and resumes from its revision
+	cache string
+
+	// verifier, when set, refuses the bundles not signed by the watch plane
+	verifier *Verifier
+
+	// backoff is the wait after a failure to reach the server or to apply
+	backoff util.Backoff
+	wait    time.Duration
+
+	epoch    string
+	revision uint64
+
+	logger log.FieldLogger
+}
+
+// NewAgent creates an Agent for node, which receives its bundles with client
+func NewAgent(node string, client *Client, ipDevices system.AddressManager, ipt iptables.RuleApplier, logger log.FieldLogger) *Agent {
+	return &Agent{
+		node:      node,
+		client:    client,
+		ipDevices: ipDevices,
+		ipt:       ipt,
+		backoff:   util.Backoff{Initial: time.Second, Max: time.Minute},
+		wait:      DefaultWait,
+		logger:    logger.WithFields(log.Fields{"module": "watchplane", "node": node}),
+	}
+}
+
+// SetCache keeps the last bundle applied at path
+func (a *Agent) SetCache(path string) {
+	a.cache = path
+}
+
+// SetVerifier only applies the bundles verifier accepts
+func (a *Agent) SetVerifier(verifier *Verifier) {
+	a.verifier = verifier
+}
+
+// Run applies the cached bundle, if any, then every bundle the server sends
+// until ctx is done
+func (a *Agent) Run(ctx context.Context) error {
+	defer a.client.Close()
+	if b, err := a.readCache(); err != nil {
+		a.logger.Warnf("watchplane: unable to read the cached bundle. %v", err)
+	} else if b != nil {
+		if err := a.Apply(b); err != nil {
+			a.logger.Errorf("watchplane: unable to apply the cached bundle of revision %d. %v", b.Revision, err)
+		}
+	}
+
+	var failures int
+	for ctx.Err() == nil {
+		b, err := a.client.Next(ctx, a.node, a.epoch, a.revision, a.wait)
+		if err == nil && !b.Unchanged {
+			err = a.Apply(b)
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		failures++
+		wait := a.backoff.Next(failures)
+		a.logger.Errorf("watchplane: %v. retrying in %v", err, wait)
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+	return nil
+}
+
+// Apply applies the bundle to the node, and records its revision as the one
+// to resume from. With a verifier, a bundle that isn't signed for the node,
+// or is older than the bundle applied last, is refused: either a bundle of
+// the same epoch and a lower revision, or of an epoch that began before, as
+// the epoch is signed along with the bundle.
+func (a *Agent) Apply(b *Bundle) error {
+	if b.Config == nil {
+		return fmt.Errorf("bundle of revision %d has no cluster config", b.Revision)
+	}
+	if a.verifier != nil {
+		if b.Node != a.node {
+			return fmt.Errorf("bundle of revision %d is for node %s", b.Revision, b.Node)
+		}
+		if b.Epoch == a.epoch && b.Revision < a.revision {
+			return fmt.Errorf("bundle of revision %d is older than the bundle of revision %d applied", b.Revision, a.revision)
+		}
+		if a.epoch != "" && b.Epoch != a.epoch && !epochAfter(b.Epoch, a.epoch) {
+			return fmt.Errorf("bundle of epoch %s is from a watch plane started before that of the epoch %s applied", b.Epoch, a.epoch)
+		}
+		if err := a.verifier.Verify(b); err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	if err := a.setAddresses(b.Config, false); err != nil {
+		return err
+	}
+	if err := a.setAddresses(b.Config, true); err != nil {
+		return err
+	}
+
+	existing, err := a.ipt.Save()
+	if err != nil {
+		return err
+	}
+	merged, _, err := a.ipt.Merge(b.Rules, existing)
+	if err != nil {
+		return err
+	}
+	if err := a.ipt.Restore(merged); err != nil {
+		return err
+	}
+	if err := a.ipt.SetMaintenance(b.Config); err != nil {
+		return err
+	}
+	if err := a.ipt.SetACL(b.Config); err != nil {
+		return err
+	}
+
+	a.epoch, a.revision = b.Epoch, b.Revision
+	a.logger.Infof("watchplane: applied the bundle of revision %d in %v", b.Revision, time.Since(start))
+	if err := a.writeCache(b); err != nil {
+		a.logger.Warnf("watchplane: unable to cache the bundle. %v", err)
+	}
+	return nil
+}
+
+// setAddresses puts the VIPs of one family of config on the node, removing
+// those no longer configured, as a realserver does
+func (a *Agent) setAddresses(config *types.ClusterConfig, isIP6 bool) error {
+	vips, mtus := config.Config, config.MTUConfig
+	if isIP6 {
+		vips, mtus = config.Config6, config.MTUConfig6
+	}
+	configured4, configured6, err := a.ipDevices.Get()
+	if err != nil {
+		return err
+	}
+
+	desired := []string{}
+	devToAddr := map[string]string{}
+	for ip := range vips {
+		device := a.ipDevices.Device(string(ip), isIP6)
+		desired = append(desired, device)
+		devToAddr[device] = string(ip)
+	}
+
+	var removals, additions []string
+	if isIP6 {
+		removals, additions = a.ipDevices.Compare6(configured6, desired)
+	} else {
+		removals, additions = a.ipDevices.Compare4(configured4, desired)
+	}
+	for _, device := range removals {
+		if err := a.ipDevices.Del(device); err != nil {
+			return err
+		}
+	}
+	for _, device := range additions {
+		add := a.ipDevices.Add
+		if isIP6 {
+			add = a.ipDevices.Add6
+		}
+		if err := add(devToAddr[device]); err != nil {
+			return err
+		}
+	}
+
+	if err := a.ipDevices.SetMTU(mtus, isIP6); err != nil {
+		return err
+	}
+	return a.ipDevices.SetReturnRoutes(config.ReturnRoutes(isIP6), isIP6)
+}
+
+func (a *Agent) readCache() (*Bundle, error) {
+	if a.cache == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(a.cache)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	bundle := &Bundle{}
+	if err := json.Unmarshal(b, bundle); err != nil {
+		return nil, err
+	}
+	if bundle.Node != a.node {
+		return nil, fmt.Errorf("the cached bundle is of node %s", bundle.Node)
+	}
+	return bundle, nil
+}
+
+// writeCache replaces the cache with the bundle, through a rename so that a
+// crash never leaves half a bundle
+func (a *Agent) writeCache(bundle *Bundle) error {
+	if a.cache == "" {
+		return nil
+	}
+	b, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(a.cache), filepath.Base(a.cache)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), a.cache)
+}
@@ -0,0 +1,159 @@
+package watchplane
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+)
+
+// Signer signs the bundles a Server compiles with an ed25519 key, so that
+// agents only apply bundles of the watch plane itself. Neither a proxy
+// between them nor whoever can write the bundle cache of a node can make a
+// bundle the agent would apply.
+type Signer struct {
+	key ed25519.PrivateKey
+}
+
+// NewSigner creates a Signer of key
+func NewSigner(key ed25519.PrivateKey) *Signer {
+	return &Signer{key: key}
+}
+
+// LoadSigner reads the PKCS #8 PEM encoded ed25519 private key at path, as
+// openssl genpkey -algorithm ed25519 writes
+func LoadSigner(path string) (*Signer, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("watchplane: unable to parse the signing key at %s. %v", path, err)
+	}
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("watchplane: the signing key at %s is a %T, not an ed25519 key", path, key)
+	}
+	return NewSigner(k), nil
+}
+
+// Sign signs the bundle
+func (s *Signer) Sign(b *Bundle) error {
+	sum, err := b.sum()
+	if err != nil {
+		return err
+	}
+	b.Signature = ed25519.Sign(s.key, sum[:])
+	return nil
+}
+
+// signDigest signs the bundle whose content has the digest d, which the
+// server has already
+func (s *Signer) signDigest(b *Bundle, d [sha256.Size]byte) {
+	sum := b.sumOf(d)
+	b.Signature = ed25519.Sign(s.key, sum[:])
+}
+
+// Verifier verifies the bundles an agent applies against the public keys of
+// the watch plane. More than one key is accepted so that the key of the watch
+// plane can be rotated without the agents refusing its bundles meanwhile.
+type Verifier struct {
+	keys []ed25519.PublicKey
+}
+
+// NewVerifier creates a Verifier of keys
+func NewVerifier(keys ...ed25519.PublicKey) *Verifier {
+	return &Verifier{keys: keys}
+}
+
+// LoadVerifier reads the PKIX PEM encoded ed25519 public keys at paths, as
+// openssl pkey -pubout writes
+func LoadVerifier(paths ...string) (*Verifier, error) {
+	keys := make([]ed25519.PublicKey, 0, len(paths))
+	for _, path := range paths {
+		der, err := readPEM(path, "PUBLIC KEY")
+		if err != nil {
+			return nil, err
+		}
+		key, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("watchplane: unable to parse the verification key at %s. %v", path, err)
+		}
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("watchplane: the verification key at %s is a %T, not an ed25519 key", path, key)
+		}
+		keys = append(keys, k)
+	}
+	return NewVerifier(keys...), nil
+}
+
+// Verify returns an error unless the bundle is signed by one of the keys
+func (v *Verifier) Verify(b *Bundle) error {
+	if len(b.Signature) == 0 {
+		return fmt.Errorf("bundle of revision %d is not signed", b.Revision)
+	}
+	sum, err := b.sum()
+	if err != nil {
+		return err
+	}
+	for _, key := range v.keys {
+		if ed25519.Verify(key, sum[:], b.Signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("bundle of revision %d is not signed by a trusted key", b.Revision)
+}
+
+// sum is what the signature of a bundle signs: its node, epoch, revision and
+// time of compilation, which keep a bundle from being sent to another node or
+// passed off as newer, and the digest of its content
+func (b *Bundle) sum() ([sha256.Size]byte, error) {
+	configJSON, err := json.Marshal(b.Config)
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("watchplane: unable to encode the cluster config. %v", err)
+	}
+	d, err := digest(configJSON, b.Rules)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return b.sumOf(d), nil
+}
+
+// sumOf is sum with the digest of the content at hand
+func (b *Bundle) sumOf(d [sha256.Size]byte) [sha256.Size]byte {
+	h := sha256.New()
+	for _, s := range []string{b.Node, b.Epoch} {
+		binary.Write(h, binary.BigEndian, uint32(len(s)))
+		h.Write([]byte(s))
+	}
+	binary.Write(h, binary.BigEndian, b.Revision)
+	binary.Write(h, binary.BigEndian, b.Compiled.UnixNano())
+	h.Write(d[:])
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// readPEM returns the contents of the first block of kind in the file at path
+func readPEM(path, kind string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("watchplane: unable to read the key at %s. %v", path, err)
+	}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("watchplane: no %s in %s", kind, path)
+		}
+		if block.Type == kind {
+			return block.Bytes, nil
+		}
+	}
+}
@@ -0,0 +1,380 @@
+// Package watchplane splits the realserver into a watch plane and a compute
+// plane, for clusters too large for every node to watch every endpoint. One
+// Server runs the kubernetes watches, compiles the bundle of each node - the
+// cluster config and the iptables rules of the pods on the node - and serves
+// the bundles to an Agent on every node, which only applies its own.
+//
+// The protocol is net/rpc with the JSON codec over tcp, as the control api
+// is, under the service name WatchPlane. An agent long-polls Next with the
+// epoch and revision of the last bundle it applied, and the call returns once
+// the node's bundle is newer than that. Every bundle is a complete snapshot,
+// so an agent that reconnects resumes where it left off, and is only sent its
+// bundle again when it changed or the server restarted. A server with a
+// Signer signs its bundles, and an agent with a Verifier applies no others.
+//
+// TODO: bundles were asked to be streamed over gRPC and are long-polled over
+// net/rpc until that change of transport is reviewed. A gRPC server stream
+// would resume from the same epoch and revision cursor Next takes.
+package watchplane
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/rpc"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/mtls"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+const serviceName = "WatchPlane"
+
+// how long Next waits for a newer bundle by default, and at most
+const (
+	DefaultWait = 30 * time.Second
+	maxWait     = 5 * time.Minute
+)
+
+// Bundle is everything the agent of a node applies: a snapshot of the cluster
+// config and of the rules generated for the node from it. Epoch is the start
+// time of the server, so it changes, and grows, when the server restarts, and
+// Revision grows with every change to a bundle of the epoch.
+type Bundle struct {
+	Node     string                       `json:"node"`
+	Epoch    string                       `json:"epoch"`
+	Revision uint64                       `json:"revision"`
+	Compiled time.Time                    `json:"compiled"`
+	Config   *types.ClusterConfig         `json:"config,omitempty"`
+	Rules    map[string]*iptables.RuleSet `json:"rules,omitempty"`
+
+	// Signature is the signature of the bundle by the Signer of the server,
+	// if it has one
+	Signature []byte `json:"signature,omitempty"`
+
+	// Unchanged is set on the reply to a Next that waited without the
+	// bundle changing. It carries no config or rules.
+	Unchanged bool `json:"unchanged,omitempty"`
+}
+
+// NextArgs asks for the bundle of Node once it is newer than the bundle of
+// Epoch and Revision, waiting for Wait at most
+type NextArgs struct {
+	Node     string
+	Epoch    string
+	Revision uint64
+	Wait     time.Duration
+}
+
+// Source is what bundles are compiled from: the cluster config, the nodes,
+// and the rules of each node for the config
+type Source interface {
+	Config() *types.ClusterConfig
+	Nodes() []string
+	Rules(node string, config *types.ClusterConfig) (map[string]*iptables.RuleSet, error)
+}
+
+type watcherSource struct {
+	w   *watcher.Watcher
+	ipt iptables.RuleApplier
+}
+
+// WatcherSource compiles bundles from the watcher, with the rules ipt
+// generates for the realservers
+func WatcherSource(w *watcher.Watcher, ipt iptables.RuleApplier) Source {
+	return &watcherSource{w: w, ipt: ipt}
+}
+
+func (s *watcherSource) Config() *types.ClusterConfig {
+	config, _ := s.w.Current()
+	return config
+}
+
+func (s *watcherSource) Nodes() []string {
+	_, nodes := s.w.Current()
+	names := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	return names
+}
+
+func (s *watcherSource) Rules(node string, config *types.ClusterConfig) (map[string]*iptables.RuleSet, error) {
+	return s.ipt.GenerateRulesForNodeClassic(s.w, node, config, false)
+}
+
+// Server compiles the bundles of the nodes and serves them to their agents
+type Server struct {
+	sync.Mutex
+
+	epoch    string
+	revision uint64
+	bundles  map[string]*Bundle
+	digests  map[string][sha256.Size]byte
+
+	// changed is closed, and replaced, whenever a bundle changes
+	changed chan struct{}
+
+	source Source
+	signer *Signer
+	tls    *mtls.Files
+	policy mtls.Policy
+	logger log.FieldLogger
+}
+
+// NewServer creates a Server of the bundles compiled from source
+func NewServer(source Source, logger log.FieldLogger) *Server {
+	return &Server{
+		epoch:   newEpoch(time.Now()),
+		bundles: map[string]*Bundle{},
+		digests: map[string][sha256.Size]byte{},
+		changed: make(chan struct{}),
+		source:  source,
+		logger:  logger.WithFields(log.Fields{"module": "watchplane"}),
+	}
+}
+
+// SetSigner signs the bundles compiled from now on with signer
+func (s *Server) SetSigner(signer *Signer) {
+	s.Lock()
+	defer s.Unlock()
+	s.signer = signer
+}
+
+// SetTLS serves the bundles with mutual TLS, authorizing every call by
+// policy, see pkg/mtls
+func (s *Server) SetTLS(files *mtls.Files, policy mtls.Policy) {
+	s.tls = files
+	s.policy = policy
+}
+
+// Epoch returns the epoch of the bundles the server compiles
+func (s *Server) Epoch() string {
+	return s.epoch
+}
+
+// newEpoch returns the epoch of a server started at t, its start time in
+// nanoseconds base 36 encoded
+func newEpoch(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 36)
+}
+
+// epochAfter returns true when epoch a began after epoch b. An epoch that
+// isn't a start time is after none.
+func epochAfter(a, b string) bool {
+	ta, err := strconv.ParseInt(a, 36, 64)
+	if err != nil {
+		return false
+	}
+	tb, err := strconv.ParseInt(b, 36, 64)
+	return err != nil || ta > tb
+}
+
+// Compile compiles the bundle of every node, giving those that changed a new
+// revision and waking the agents waiting on them. The bundles of nodes that
+// are gone are dropped. A node whose bundle can't be compiled keeps its last.
+func (s *Server) Compile() error {
+	config := s.source.Config()
+	if config == nil {
+		return fmt.Errorf("watchplane: no cluster config to compile yet")
+	}
+	// every bundle shares the config, which is copied and summed once
+	config = config.DeepCopy()
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("watchplane: unable to encode the cluster config. %v", err)
+	}
+	nodes := s.source.Nodes()
+	sort.Strings(nodes)
+
+	type compiled struct {
+		node   string
+		rules  map[string]*iptables.RuleSet
+		digest [sha256.Size]byte
+	}
+	out := make([]compiled, 0, len(nodes))
+	var firstErr error
+	for _, node := range nodes {
+		rules, err := s.source.Rules(node, config)
+		if err == nil {
+			var d [sha256.Size]byte
+			if d, err = digest(configJSON, rules); err == nil {
+				out = append(out, compiled{node, rules, d})
+				continue
+			}
+		}
+		s.logger.Errorf("watchplane: unable to compile the bundle of %s. %v", node, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	var changed bool
+	for _, c := range out {
+		if d, ok := s.digests[c.node]; ok && d == c.digest {
+			continue
+		}
+		s.revision++
+		b := &Bundle{
+			Node:     c.node,
+			Epoch:    s.epoch,
+			Revision: s.revision,
+			Compiled: time.Now(),
+			Config:   config,
+			Rules:    c.rules,
+		}
+		if s.signer != nil {
+			s.signer.signDigest(b, c.digest)
+		}
+		s.bundles[c.node] = b
+		s.digests[c.node] = c.digest
+		changed = true
+	}
+	present := map[string]bool{}
+	for _, node := range nodes {
+		present[node] = true
+	}
+	for node := range s.bundles {
+		if !present[node] {
+			delete(s.bundles, node)
+			delete(s.digests, node)
+		}
+	}
+	if changed {
+		close(s.changed)
+		s.changed = make(chan struct{})
+	}
+	return firstErr
+}
+
+// digest sums the encoded config and the rules of a bundle. The rules of each
+// chain are summed in sorted order, as they are generated from maps, so that
+// a bundle only changes with its content.
+func digest(configJSON []byte, rules map[string]*iptables.RuleSet) ([sha256.Size]byte, error) {
+	sorted := make(map[string][]string, len(rules))
+	for chain, set := range rules {
+		if set == nil {
+			continue
+		}
+		r := append([]string{set.ChainRule}, set.Rules...)
+		sort.Strings(r[1:])
+		sorted[chain] = r
+	}
+	b, err := json.Marshal(sorted)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	h := sha256.New()
+	h.Write(configJSON)
+	h.Write(b)
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// Run compiles the bundles every interval until ctx is done
+func (s *Server) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := s.Compile(); err != nil {
+			s.logger.Errorf("watchplane: compile failed. %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Next returns the bundle of node once it is newer than the bundle of epoch
+// and revision. After wait without one, it returns a bundle that is only
+// marked Unchanged.
+func (s *Server) Next(ctx context.Context, node, epoch string, revision uint64, wait time.Duration) *Bundle {
+	if wait <= 0 {
+		wait = DefaultWait
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		s.Lock()
+		b, ok := s.bundles[node]
+		changed := s.changed
+		s.Unlock()
+		if ok && (epoch != b.Epoch || revision < b.Revision) {
+			return b
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return &Bundle{Node: node, Epoch: epoch, Revision: revision, Unchanged: true}
+		case <-ctx.Done():
+			return &Bundle{Node: node, Epoch: epoch, Revision: revision, Unchanged: true}
+		}
+	}
+}
+
+// service is the rpc service of a Server
+type service struct {
+	s   *Server
+	ctx context.Context
+}
+
+// Next answers Server.Next
+func (v *service) Next(args NextArgs, reply *Bundle) error {
+	if args.Node == "" {
+		return fmt.Errorf("watchplane: a node must be named")
+	}
+	*reply = *v.s.Next(v.ctx, args.Node, args.Epoch, args.Revision, args.Wait)
+	return nil
+}
+
+// Serve answers the agents on addr until ctx is done
+func Serve(ctx context.Context, addr string, s *Server) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName(serviceName, &service{s: s, ctx: ctx}); err != nil {
+		return fmt.Errorf("watchplane: unable to register the service. %v", err)
+	}
+	listener, err := mtls.Listen(addr, s.tls)
+	if err != nil {
+		return fmt.Errorf("watchplane: unable to listen on %s. %v", addr, err)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	s.logger.Infof("watchplane: serving bundles on %s", addr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("watchplane: stopped serving %s. %v", addr, err)
+		}
+		go func() {
+			codec, err := mtls.ServerCodec(conn, s.policy, s.logger)
+			if err != nil {
+				s.logger.Warnf("watchplane: %v", err)
+				conn.Close()
+				return
+			}
+			server.ServeCodec(codec)
+		}()
+	}
+}
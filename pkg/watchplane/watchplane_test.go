@@ -0,0 +1,264 @@
+package watchplane
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/iptables"
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+)
+
+// fakeSource gives each node the rules it is mapped to
+type fakeSource struct {
+	config *types.ClusterConfig
+	nodes  []string
+	rules  map[string][]string
+}
+
+func (f *fakeSource) Config() *types.ClusterConfig { return f.config }
+func (f *fakeSource) Nodes() []string              { return f.nodes }
+func (f *fakeSource) Rules(node string, config *types.ClusterConfig) (map[string]*iptables.RuleSet, error) {
+	return map[string]*iptables.RuleSet{"RAVEL": {ChainRule: ":RAVEL - [0:0]", Rules: f.rules[node]}}, nil
+}
+
+func TestServerNext(t *testing.T) {
+	source := &fakeSource{
+		config: &types.ClusterConfig{Config: map[types.ServiceIP]types.PortMap{}},
+		nodes:  []string{"node-a", "node-b"},
+		rules: map[string][]string{
+			"node-a": {"-A RAVEL -d 10.54.213.147/32 -j RAVEL-SVC-A", "-A RAVEL -d 10.54.213.148/32 -j RAVEL-SVC-B"},
+			"node-b": {"-A RAVEL -d 10.54.213.147/32 -j RAVEL-SVC-C"},
+		},
+	}
+	s := NewServer(source, logrus.New())
+	if err := s.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	b := s.Next(ctx, "node-a", "", 0, time.Millisecond)
+	if b.Unchanged || b.Epoch != s.Epoch() || b.Config == nil || len(b.Rules["RAVEL"].Rules) != 2 {
+		t.Fatalf("expected the bundle of node-a. have %+v", b)
+	}
+	revision := b.Revision
+
+	// the same rules in another order are the same bundle
+	source.rules["node-a"] = []string{source.rules["node-a"][1], source.rules["node-a"][0]}
+	s.Compile()
+	if b := s.Next(ctx, "node-a", s.Epoch(), revision, time.Millisecond); !b.Unchanged || b.Revision != revision {
+		t.Fatalf("expected no newer bundle than %d. have %+v", revision, b)
+	}
+
+	// an agent waiting for node-b is woken by its change alone
+	next := make(chan *Bundle)
+	nodeB := s.Next(ctx, "node-b", "", 0, time.Millisecond)
+	go func() { next <- s.Next(ctx, "node-b", s.Epoch(), nodeB.Revision, time.Minute) }()
+	source.rules["node-b"] = nil
+	time.Sleep(10 * time.Millisecond)
+	s.Compile()
+	select {
+	case b := <-next:
+		if b.Unchanged || b.Revision <= nodeB.Revision || len(b.Rules["RAVEL"].Rules) != 0 {
+			t.Fatalf("expected the new bundle of node-b. have %+v", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the change to wake the waiting agent")
+	}
+
+	// a bundle of another epoch, from before a restart of the server, is
+	// replaced at once
+	if b := s.Next(ctx, "node-a", "restarted", revision, time.Millisecond); b.Unchanged || b.Epoch != s.Epoch() {
+		t.Fatalf("expected the bundle of the current epoch. have %+v", b)
+	}
+
+	// the bundles of nodes that are gone are dropped
+	source.nodes = []string{"node-b"}
+	s.Compile()
+	if b := s.Next(ctx, "node-a", "", 0, time.Millisecond); !b.Unchanged {
+		t.Fatalf("expected no bundle for node-a. have %+v", b)
+	}
+}
+
+func TestAgentApply(t *testing.T) {
+	config := &types.ClusterConfig{
+		Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.147": {"80": {Namespace: "default", Service: "web", PortName: "http", TCPEnabled: true}},
+		},
+		Config6: map[types.ServiceIP]types.PortMap{
+			"2001:db8::7": {"80": {Namespace: "default", Service: "web", PortName: "http", TCPEnabled: true}},
+		},
+	}
+	ipt := iptables.NewFakeRuleApplier("RAVEL", true, logrus.New())
+	rules, err := ipt.GenerateRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := system.NewFakeIP()
+	ip.Add("10.54.213.100")
+	cache := filepath.Join(t.TempDir(), "bundle.json")
+	a := NewAgent("node-a", NewClient("127.0.0.1:0"), ip, ipt, logrus.New())
+	a.SetCache(cache)
+	if err := a.Apply(&Bundle{Node: "node-a", Epoch: "e", Revision: 7, Config: config, Rules: rules}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ip.Devices["10_54_213_147"] != "10.54.213.147" || ip.Devices["2001db87"] != "2001:db8::7" {
+		t.Fatalf("expected the vips of the bundle on the node. have %v", ip.Devices)
+	}
+	if _, ok := ip.Devices["10_54_213_100"]; ok {
+		t.Fatalf("expected the vip no longer configured to be removed. have %v", ip.Devices)
+	}
+	if _, ok := ipt.Table["RAVEL"]; !ok || ipt.Restores != 1 {
+		t.Fatalf("expected the rules of the bundle restored. have %v", ipt.Table)
+	}
+
+	// a restarted agent resumes from the cached bundle
+	restarted := NewAgent("node-a", NewClient("127.0.0.1:0"), system.NewFakeIP(), ipt, logrus.New())
+	restarted.SetCache(cache)
+	b, err := restarted.readCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b == nil || b.Epoch != "e" || b.Revision != 7 || len(b.Config.Config) != 1 {
+		t.Fatalf("expected the cached bundle of revision 7. have %+v", b)
+	}
+	if err := restarted.Apply(b); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.epoch != "e" || restarted.revision != 7 {
+		t.Fatalf("expected to resume from revision 7. have %s %d", restarted.epoch, restarted.revision)
+	}
+}
+
+func TestSignedBundles(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPath := filepath.Join(dir, "watchplane.pub")
+	if err := ioutil.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	der, err = x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privatePath := filepath.Join(dir, "watchplane.key")
+	if err := ioutil.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := LoadSigner(privatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := LoadVerifier(publicPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := &fakeSource{
+		config: &types.ClusterConfig{Config: map[types.ServiceIP]types.PortMap{
+			"10.54.213.147": {"80": {Namespace: "default", Service: "web", PortName: "http", TCPEnabled: true}},
+		}},
+		nodes: []string{"node-a"},
+		rules: map[string][]string{"node-a": {"-A RAVEL -d 10.54.213.147/32 -j RAVEL-SVC-A", "-A RAVEL -d 10.54.213.147/32 -j RAVEL-SVC-B"}},
+	}
+	s := NewServer(source, logrus.New())
+	s.SetSigner(signer)
+	s.Compile()
+
+	// the bundle is verified as an agent receives it
+	b, err := json.Marshal(s.Next(context.Background(), "node-a", "", 0, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode := func() *Bundle {
+		bundle := &Bundle{}
+		if err := json.Unmarshal(b, bundle); err != nil {
+			t.Fatal(err)
+		}
+		return bundle
+	}
+	if err := verifier.Verify(decode()); err != nil {
+		t.Fatalf("expected the bundle to verify. %v", err)
+	}
+
+	tampered := map[string]func(*Bundle){
+		"rules":    func(b *Bundle) { b.Rules["RAVEL"].Rules[0] = "-A RAVEL -j DNAT --to 192.0.2.1" },
+		"config":   func(b *Bundle) { b.Config.Config["10.54.213.147"]["80"].Service = "evil" },
+		"node":     func(b *Bundle) { b.Node = "node-b" },
+		"revision": func(b *Bundle) { b.Revision++ },
+		"unsigned": func(b *Bundle) { b.Signature = nil },
+	}
+	for name, tamper := range tampered {
+		bundle := decode()
+		tamper(bundle)
+		if err := verifier.Verify(bundle); err == nil {
+			t.Errorf("%s: expected the tampered bundle to be refused", name)
+		}
+	}
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	if err := NewVerifier(other).Verify(decode()); err == nil {
+		t.Fatal("expected a bundle signed with another key to be refused")
+	}
+	if err := NewVerifier(other, public).Verify(decode()); err != nil {
+		t.Fatalf("expected any of the keys to verify the bundle. %v", err)
+	}
+
+	// an agent with the verifier applies the signed bundle, and neither a
+	// tampered nor an older one
+	ipt := iptables.NewFakeRuleApplier("RAVEL", true, logrus.New())
+	a := NewAgent("node-a", NewClient("127.0.0.1:0"), system.NewFakeIP(), ipt, logrus.New())
+	a.SetVerifier(verifier)
+	bundle := decode()
+	bundle.Rules["RAVEL"].Rules = append(bundle.Rules["RAVEL"].Rules, "-A RAVEL -j ACCEPT")
+	if err := a.Apply(bundle); err == nil || ipt.Restores != 0 {
+		t.Fatal("expected the agent to refuse the tampered bundle")
+	}
+	if err := a.Apply(decode()); err != nil {
+		t.Fatal(err)
+	}
+	a.revision++
+	if err := a.Apply(decode()); err == nil || ipt.Restores != 1 {
+		t.Fatal("expected the agent to refuse a bundle older than the last applied")
+	}
+
+	// a bundle of a watch plane started earlier is refused, even signed and
+	// of a higher revision, while one started later is applied
+	start, _ := strconv.ParseInt(s.Epoch(), 36, 64)
+	for _, c := range []struct {
+		epoch   string
+		applied bool
+	}{
+		{newEpoch(time.Unix(0, start).Add(-time.Hour)), false},
+		{"not-a-start-time", false},
+		{newEpoch(time.Unix(0, start).Add(time.Hour)), true},
+	} {
+		bundle := decode()
+		bundle.Epoch, bundle.Revision = c.epoch, a.revision+1
+		if err := signer.Sign(bundle); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Apply(bundle); (err == nil) != c.applied {
+			t.Errorf("epoch %s: expected applied=%v. have %v", c.epoch, c.applied, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package xdp
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/system"
+	"github.com/Comcast/Ravel/pkg/types"
+	"github.com/Comcast/Ravel/pkg/watcher"
+)
+
+// Executor serves the virtual services of an IPVS manager from a Plane. The
+// manager keeps generating ipvsadm rules, and the Plane turns them into map
+// entries. VIPs in maintenance are left out of the maps, since the maintenance
+// chain in the filter table never sees the traffic the program forwards. For
+// the same reason the acl, syn proxy, tproxy and fwmark chains have no effect
+// on services served from XDP.
+type Executor struct {
+	*system.IPVS
+
+	plane *Plane
+}
+
+var _ system.IPVSExecutor = &Executor{}
+
+// NewExecutor makes plane the ipvsadm of ipvs and returns an executor for both
+func NewExecutor(ipvs *system.IPVS, plane *Plane) *Executor {
+	ipvs.SetCommandRunner(plane)
+	return &Executor{IPVS: ipvs, plane: plane}
+}
+
+func (e *Executor) SetIPVS(w *watcher.Watcher, config *types.ClusterConfig, logger log.FieldLogger, ipType string) error {
+	if err := e.exclude(config); err != nil {
+		return err
+	}
+	return e.IPVS.SetIPVS(w, config, logger, ipType)
+}
+
+func (e *Executor) CheckConfigParity(w *watcher.Watcher, config *types.ClusterConfig, addresses []string) (bool, error) {
+	if err := e.exclude(config); err != nil {
+		return false, err
+	}
+	return e.IPVS.CheckConfigParity(w, config, addresses)
+}
+
+// exclude keeps the VIPs config has in maintenance out of the maps
+func (e *Executor) exclude(config *types.ClusterConfig) error {
+	vips := []string{}
+	if config != nil {
+		for vip := range config.Maintenance {
+			vips = append(vips, string(vip))
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return e.plane.Exclude(ctx, vips)
+}
@@ -0,0 +1,83 @@
+package xdp
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// maglevBackend is a real in a consistent hashing ring, and the share of the
+// ring it gets relative to the other reals
+type maglevBackend struct {
+	real   uint32
+	key    string
+	weight int
+}
+
+// maglevRing fills a ring of size entries, which must be prime, with the reals
+// of backends using maglev hashing. Each real takes slots in proportion to its
+// weight, and adding or removing a real moves little of the rest. Reals with
+// no weight get no slots, and a ring without any is left empty, all zero.
+func maglevRing(backends []maglevBackend, size int) []uint32 {
+	ring := make([]uint32, size)
+
+	live := []maglevBackend{}
+	maxWeight := 0
+	for _, b := range backends {
+		if b.weight > 0 {
+			live = append(live, b)
+			if b.weight > maxWeight {
+				maxWeight = b.weight
+			}
+		}
+	}
+	if len(live) == 0 || size == 0 {
+		return ring
+	}
+	// every director must arrive at the same ring for the same reals
+	sort.Slice(live, func(i, j int) bool { return live[i].key < live[j].key })
+
+	offsets := make([]uint64, len(live))
+	skips := make([]uint64, len(live))
+	next := make([]uint64, len(live))
+	credit := make([]int, len(live))
+	for n, b := range live {
+		offsets[n] = hash64(b.key, 0) % uint64(size)
+		skips[n] = hash64(b.key, 1)%uint64(size-1) + 1
+	}
+
+	filled := make([]bool, size)
+	placed := 0
+	for placed < size {
+		for n := range live {
+			// weighted maglev: a real takes its turn once it has accumulated
+			// enough credit, so heavier reals place more often
+			credit[n] += live[n].weight
+			if credit[n] < maxWeight {
+				continue
+			}
+			credit[n] -= maxWeight
+
+			slot := (offsets[n] + next[n]*skips[n]) % uint64(size)
+			for filled[slot] {
+				next[n]++
+				slot = (offsets[n] + next[n]*skips[n]) % uint64(size)
+			}
+			next[n]++
+			filled[slot] = true
+			ring[slot] = live[n].real
+			placed++
+			if placed == size {
+				break
+			}
+		}
+	}
+	return ring
+}
+
+// hash64 hashes key with a seed, so that offset and skip are independent
+func hash64(key string, seed byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte{seed})
+	h.Write([]byte(key))
+	return h.Sum64()
+}
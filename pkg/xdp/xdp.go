@@ -0,0 +1,674 @@
+// Package xdp is an experimental data plane that forwards the director's
+// virtual services from an XDP program on the ingress interface, ahead of the
+// kernel's network stack, instead of through IPVS.
+//
+// The program itself is built outside of ravel and loaded from an object
+// file. ravel pins it and its maps below the pin path and fills the maps:
+//
+//	vips      hash   key:   addr [16]byte (v4 in the first 4 bytes), port be16,
+//	                        proto u8 (6 tcp, 17 udp), pad u8
+//	                 value: flags u32 (bit 0 set for v6), vip_num u32
+//	reals     array  key:   index u32, 0 is never used
+//	                 value: addr [16]byte, flags u8 (bit 0 set for v6), pad [3]u8
+//	ch_rings  array  key:   vip_num * ring size + slot u32
+//	                 value: index of a real u32, 0 when the VIP has no reals
+//
+// Integers other than ports are in host byte order. The program hashes a
+// packet's flow into the ring of its VIP and forwards it to the real found
+// there the way IPVS does with -g, keeping the VIP as destination.
+package xdp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+// defaults of Config
+const (
+	DefaultPinPath  = "/sys/fs/bpf/ravel"
+	DefaultRingSize = 65537
+	DefaultMaxVIPs  = 512
+	DefaultMaxReals = 4096
+)
+
+// attach modes of the program
+const (
+	ModeDriver  = "drv"
+	ModeGeneric = "generic"
+)
+
+// names of the pinned program and maps
+const (
+	pinnedProgram = "prog"
+	mapVIPs       = "vips"
+	mapReals      = "reals"
+	mapRings      = "ch_rings"
+)
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+	flagV6   = 1
+)
+
+// Config describes the XDP program and where to attach it
+type Config struct {
+	// Interface is the device that receives VIP traffic
+	Interface string
+	// Object is the compiled XDP program
+	Object string
+	// Mode is drv, for the driver's native support, or generic
+	Mode string
+	// PinPath is the bpffs directory the program and its maps are pinned in
+	PinPath string
+	// RingSize is the number of slots in the ring of each VIP. It must be
+	// prime, and match the program.
+	RingSize int
+	// MaxVIPs and MaxReals are the sizes the program gives its maps
+	MaxVIPs  int
+	MaxReals int
+}
+
+// Validate fills in defaults and checks that the config can be loaded
+func (c *Config) Validate() error {
+	if c.PinPath == "" {
+		c.PinPath = DefaultPinPath
+	}
+	if c.Mode == "" {
+		c.Mode = ModeDriver
+	}
+	if c.RingSize == 0 {
+		c.RingSize = DefaultRingSize
+	}
+	if c.MaxVIPs == 0 {
+		c.MaxVIPs = DefaultMaxVIPs
+	}
+	if c.MaxReals == 0 {
+		c.MaxReals = DefaultMaxReals
+	}
+
+	if c.Object == "" {
+		return fmt.Errorf("xdp: an object file is required")
+	}
+	if c.Interface == "" {
+		return fmt.Errorf("xdp: an interface is required")
+	}
+	if c.Mode != ModeDriver && c.Mode != ModeGeneric {
+		return fmt.Errorf("xdp: mode %q must be %s or %s", c.Mode, ModeDriver, ModeGeneric)
+	}
+	if !isPrime(c.RingSize) {
+		return fmt.Errorf("xdp: ring size %d must be prime", c.RingSize)
+	}
+	if c.MaxVIPs < 1 || c.MaxReals < 2 {
+		return fmt.Errorf("xdp: max vips must be at least 1 and max reals at least 2")
+	}
+	if uint64(c.MaxVIPs)*uint64(c.RingSize) > 1<<32-1 {
+		return fmt.Errorf("xdp: %d vips with rings of %d don't fit the ring map", c.MaxVIPs, c.RingSize)
+	}
+	return nil
+}
+
+// Plane programs the maps of an XDP program from ipvsadm rules. It stands in
+// for ipvsadm as the CommandRunner of system.IPVS, so that the director keeps
+// generating and reconciling rules as it does for IPVS.
+type Plane struct {
+	sync.Mutex
+
+	config Config
+	runner system.CommandRunner
+	logger log.FieldLogger
+
+	// rules are the ipvsadm rules in the maps, keyed by service and real
+	rules map[string]string
+	// excluded VIPs are left out of the maps
+	excluded map[string]bool
+
+	vipNums  map[string]uint32
+	realNums map[string]uint32
+
+	// what was last written to each map, so only changes are written
+	vips  map[string]vipEntry
+	reals map[uint32]string
+	rings map[uint32][]uint32
+}
+
+// vipEntry is an encoded entry of the vips map
+type vipEntry struct {
+	key   string
+	value string
+}
+
+// New creates a Plane for config. Nothing is loaded until Attach is called.
+func New(config Config, logger log.FieldLogger) (*Plane, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	p := &Plane{
+		config: config,
+		runner: system.NewCommandRunner(),
+		logger: logger.WithFields(log.Fields{"dataplane": "xdp", "interface": config.Interface}),
+	}
+	p.reset()
+	return p, nil
+}
+
+// SetCommandRunner replaces the runner used to execute bpftool
+func (p *Plane) SetCommandRunner(r system.CommandRunner) {
+	p.Lock()
+	defer p.Unlock()
+	p.runner = r
+}
+
+func (p *Plane) reset() {
+	p.rules = map[string]string{}
+	p.excluded = map[string]bool{}
+	p.vipNums = map[string]uint32{}
+	p.realNums = map[string]uint32{}
+	p.vips = map[string]vipEntry{}
+	p.reals = map[uint32]string{}
+	p.rings = map[uint32][]uint32{}
+}
+
+// Check returns an error that says what is missing unless bpftool can be run,
+// so that a node without it fails at startup with a clear error
+func (p *Plane) Check(ctx context.Context) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if out, err := p.runner.Run(ctx, nil, "bpftool", "version"); err != nil {
+		return fmt.Errorf("xdp: bpftool is unusable. it must be installed to use the xdp data plane. %v: %s", err, out)
+	}
+	return nil
+}
+
+// Attach loads the program with fresh maps and attaches it to the interface,
+// replacing any program already there. The maps start out empty.
+func (p *Plane) Attach(ctx context.Context) error {
+	p.Lock()
+	defer p.Unlock()
+
+	// maps left pinned by an earlier run would be reused by the loader
+	if _, err := p.runner.Run(ctx, nil, "rm", "-rf", p.config.PinPath); err != nil {
+		return fmt.Errorf("xdp: unable to remove %s. %v", p.config.PinPath, err)
+	}
+	if out, err := p.runner.Run(ctx, nil, "bpftool", "prog", "load", p.config.Object, p.pinned(pinnedProgram),
+		"type", "xdp", "pinmaps", p.config.PinPath); err != nil {
+		return fmt.Errorf("xdp: unable to load %s. %v: %s", p.config.Object, err, out)
+	}
+	if out, err := p.runner.Run(ctx, nil, "bpftool", "net", "attach", p.attachType(), "pinned", p.pinned(pinnedProgram),
+		"dev", p.config.Interface, "overwrite"); err != nil {
+		return fmt.Errorf("xdp: unable to attach to %s. %v: %s", p.config.Interface, err, out)
+	}
+	p.reset()
+	p.logger.Infof("xdp: attached %s in %s mode", p.config.Object, p.config.Mode)
+	return nil
+}
+
+// Detach removes the program from the interface and unpins it with its maps
+func (p *Plane) Detach(ctx context.Context) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if out, err := p.runner.Run(ctx, nil, "bpftool", "net", "detach", p.attachType(), "dev", p.config.Interface); err != nil {
+		return fmt.Errorf("xdp: unable to detach from %s. %v: %s", p.config.Interface, err, out)
+	}
+	if _, err := p.runner.Run(ctx, nil, "rm", "-rf", p.config.PinPath); err != nil {
+		return fmt.Errorf("xdp: unable to remove %s. %v", p.config.PinPath, err)
+	}
+	p.reset()
+	return nil
+}
+
+// Run answers the ipvsadm commands that system.IPVS issues. -Sn lists the
+// rules in the maps, -R applies rules to them and -C empties them. Rules
+// only take effect once the maps have been written, so a failed write
+// leaves -Sn showing what is actually being served.
+func (p *Plane) Run(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	if name != "ipvsadm" || len(args) == 0 {
+		return nil, fmt.Errorf("xdp: unsupported command %s %s", name, strings.Join(args, " "))
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	switch args[0] {
+	case "-Sn":
+		return []byte(strings.Join(p.sortedRules(p.rules), "\n")), nil
+	case "-R":
+		rules := applyRules(p.rules, strings.Split(string(stdin), "\n"))
+		if err := p.sync(ctx, rules); err != nil {
+			return nil, err
+		}
+		p.rules = rules
+		return []byte{}, nil
+	case "-C":
+		rules := map[string]string{}
+		if err := p.sync(ctx, rules); err != nil {
+			return nil, err
+		}
+		p.rules = rules
+		return []byte{}, nil
+	}
+	return nil, fmt.Errorf("xdp: unsupported command %s %s", name, strings.Join(args, " "))
+}
+
+// Exclude leaves the services of vips out of the maps, rewriting them if the
+// set of excluded VIPs changed
+func (p *Plane) Exclude(ctx context.Context, vips []string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	excluded := map[string]bool{}
+	for _, vip := range vips {
+		// services are matched by their parsed address
+		if ip := net.ParseIP(vip); ip != nil {
+			vip = ip.String()
+		}
+		excluded[vip] = true
+	}
+	if len(excluded) == len(p.excluded) {
+		same := true
+		for vip := range excluded {
+			if !p.excluded[vip] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return nil
+		}
+	}
+
+	previous := p.excluded
+	p.excluded = excluded
+	if err := p.sync(ctx, p.rules); err != nil {
+		p.excluded = previous
+		return err
+	}
+	return nil
+}
+
+// Rules returns the ipvsadm rules in the maps
+func (p *Plane) Rules() []string {
+	p.Lock()
+	defer p.Unlock()
+	return p.sortedRules(p.rules)
+}
+
+func (p *Plane) sortedRules(rules map[string]string) []string {
+	out := make([]string, 0, len(rules))
+	for _, r := range rules {
+		out = append(out, r)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// service is a virtual service parsed from an ipvsadm rule
+type service struct {
+	ip    net.IP
+	port  uint16
+	proto uint8
+}
+
+func (s service) v6() bool {
+	return s.ip.To4() == nil
+}
+
+// sync writes the maps so that they serve rules. Services are numbered, and
+// reals indexed, stably across calls, so that unchanged rings aren't
+// rewritten. Entries are written in an order that never exposes a VIP
+// before its ring is complete.
+func (p *Plane) sync(ctx context.Context, rules map[string]string) error {
+	services := map[string]service{}
+	backends := map[string][]maglevBackend{}
+	realIPs := map[string]net.IP{}
+
+	for _, r := range p.sortedRules(rules) {
+		fields := strings.Fields(r)
+		if len(fields) < 3 {
+			continue
+		}
+		name := fields[1] + " " + fields[2]
+		if fields[1] == "-f" {
+			p.logger.Warnf("xdp: fwmark service %s is not supported and is left out", name)
+			continue
+		}
+		svc, err := parseService(fields[1], fields[2])
+		if err != nil {
+			return err
+		}
+		if p.excluded[svc.ip.String()] {
+			continue
+		}
+
+		switch fields[0] {
+		case "-A":
+			services[name] = svc
+		case "-a":
+			real, weight, err := parseReal(fields)
+			if err != nil {
+				return err
+			}
+			realIPs[real.String()] = real
+			backends[name] = append(backends[name], maglevBackend{key: real.String(), weight: weight})
+		}
+	}
+
+	vipNums, err := allocate(p.vipNums, sortedKeys(services), 0, p.config.MaxVIPs)
+	if err != nil {
+		return fmt.Errorf("xdp: more than %d vips. %v", p.config.MaxVIPs, err)
+	}
+	realNums, err := allocate(p.realNums, sortedKeys(realIPs), 1, p.config.MaxReals)
+	if err != nil {
+		return fmt.Errorf("xdp: more than %d reals. %v", p.config.MaxReals-1, err)
+	}
+
+	batch := []string{}
+	vips := map[string]vipEntry{}
+	for name, svc := range services {
+		vips[name] = vipEntry{key: encodeVIPKey(svc), value: encodeVIPValue(svc, vipNums[name])}
+	}
+
+	// VIPs that go away stop being served before their number is reused
+	for _, name := range sortedKeys(p.vips) {
+		if _, ok := vips[name]; !ok || vips[name].key != p.vips[name].key {
+			batch = append(batch, fmt.Sprintf("map delete pinned %s key %s", p.pinned(mapVIPs), p.vips[name].key))
+		}
+	}
+
+	// reals are in place before any ring refers to them. Indexes that are no
+	// longer used are left as they are, as no ring refers to them either.
+	reals := map[uint32]string{}
+	for _, addr := range sortedKeys(realNums) {
+		num := realNums[addr]
+		reals[num] = encodeReal(realIPs[addr])
+		if p.reals[num] != reals[num] {
+			batch = append(batch, fmt.Sprintf("map update pinned %s key %s value %s", p.pinned(mapReals), encodeU32(num), reals[num]))
+		}
+	}
+
+	rings := map[uint32][]uint32{}
+	for num, ring := range p.rings {
+		rings[num] = ring
+	}
+	for _, name := range sortedKeys(services) {
+		num := vipNums[name]
+		members := backends[name]
+		for n := range members {
+			members[n].real = realNums[members[n].key]
+		}
+		ring := maglevRing(members, p.config.RingSize)
+		previous := p.rings[num]
+		for slot, real := range ring {
+			if previous != nil && previous[slot] == real {
+				continue
+			}
+			key := uint32(int(num)*p.config.RingSize + slot)
+			batch = append(batch, fmt.Sprintf("map update pinned %s key %s value %s", p.pinned(mapRings), encodeU32(key), encodeU32(real)))
+		}
+		rings[num] = ring
+	}
+
+	for _, name := range sortedKeys(vips) {
+		if old, ok := p.vips[name]; !ok || old != vips[name] {
+			batch = append(batch, fmt.Sprintf("map update pinned %s key %s value %s", p.pinned(mapVIPs), vips[name].key, vips[name].value))
+		}
+	}
+
+	if len(batch) > 0 {
+		input := strings.Join(batch, "\n") + "\n"
+		if out, err := p.runner.Run(ctx, []byte(input), "bpftool", "batch", "file", "-"); err != nil {
+			return fmt.Errorf("xdp: unable to write %d map entries. %v: %s", len(batch), err, out)
+		}
+		p.logger.Debugf("xdp: wrote %d map entries for %d vips and %d reals", len(batch), len(services), len(realNums))
+	}
+
+	p.vipNums = vipNums
+	p.realNums = realNums
+	p.vips = vips
+	p.reals = reals
+	p.rings = rings
+	return nil
+}
+
+func (p *Plane) pinned(name string) string {
+	return filepath.Join(p.config.PinPath, name)
+}
+
+func (p *Plane) attachType() string {
+	if p.config.Mode == ModeGeneric {
+		return "xdpgeneric"
+	}
+	return "xdpdrv"
+}
+
+// applyRules applies ipvsadm add (-A, -a), edit (-E, -e) and delete (-D, -d)
+// rules to existing, returning the resulting rules
+func applyRules(existing map[string]string, rules []string) map[string]string {
+	out := map[string]string{}
+	for k, r := range existing {
+		out[k] = r
+	}
+	for _, r := range rules {
+		r = strings.TrimSpace(r)
+		fields := strings.Fields(r)
+		if len(fields) < 3 {
+			continue
+		}
+		switch fields[0] {
+		case "-A", "-a":
+			out[ruleKey(fields)] = r
+		case "-E":
+			fields[0] = "-A"
+			out[ruleKey(fields)] = strings.Join(fields, " ")
+		case "-e":
+			fields[0] = "-a"
+			out[ruleKey(fields)] = strings.Join(fields, " ")
+		case "-D":
+			svc := fields[1] + " " + fields[2]
+			for k := range out {
+				if k == svc || strings.HasPrefix(k, svc+" ") {
+					delete(out, k)
+				}
+			}
+		case "-d":
+			fields[0] = "-a"
+			delete(out, ruleKey(fields))
+		}
+	}
+	return out
+}
+
+// ruleKey identifies a rule by its service and real, ignoring weights and flags
+func ruleKey(fields []string) string {
+	key := fields[1] + " " + fields[2]
+	for n := 3; n < len(fields)-1; n++ {
+		if fields[n] == "-r" {
+			return key + " -r " + fields[n+1]
+		}
+	}
+	return key
+}
+
+// parseService parses the protocol flag and address of an ipvsadm service
+func parseService(flag, address string) (service, error) {
+	svc := service{}
+	switch flag {
+	case "-t":
+		svc.proto = protoTCP
+	case "-u":
+		svc.proto = protoUDP
+	default:
+		return svc, fmt.Errorf("xdp: unsupported service type %s", flag)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return svc, fmt.Errorf("xdp: unable to parse service %s. %v", address, err)
+	}
+	if svc.ip = net.ParseIP(host); svc.ip == nil {
+		return svc, fmt.Errorf("xdp: unable to parse service address %s", host)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return svc, fmt.Errorf("xdp: unable to parse service port %s. %v", port, err)
+	}
+	svc.port = uint16(n)
+	return svc, nil
+}
+
+// parseReal returns the address and weight of the real of an ipvsadm -a rule.
+// The real's port is ignored, since forwarding keeps the VIP's.
+func parseReal(fields []string) (net.IP, int, error) {
+	var ip net.IP
+	weight := 1
+	for n := 3; n < len(fields)-1; n++ {
+		switch fields[n] {
+		case "-r":
+			host, _, err := net.SplitHostPort(fields[n+1])
+			if err != nil {
+				host = strings.Trim(fields[n+1], "[]")
+			}
+			if ip = net.ParseIP(host); ip == nil {
+				return nil, 0, fmt.Errorf("xdp: unable to parse real %s", fields[n+1])
+			}
+		case "-w":
+			w, err := strconv.Atoi(fields[n+1])
+			if err != nil {
+				return nil, 0, fmt.Errorf("xdp: unable to parse weight %s. %v", fields[n+1], err)
+			}
+			weight = w
+		}
+	}
+	if ip == nil {
+		return nil, 0, fmt.Errorf("xdp: rule has no real: %s", strings.Join(fields, " "))
+	}
+	return ip, weight, nil
+}
+
+// allocate numbers every key of want between first and limit, keeping the
+// numbers keys had in previous and giving new keys the lowest ones free
+func allocate(previous map[string]uint32, keys []string, first, limit int) (map[string]uint32, error) {
+	out := map[string]uint32{}
+	used := map[uint32]bool{}
+	for _, k := range keys {
+		if num, ok := previous[k]; ok {
+			out[k] = num
+			used[num] = true
+		}
+	}
+	next := uint32(first)
+	for _, k := range keys {
+		if _, ok := out[k]; ok {
+			continue
+		}
+		for used[next] {
+			next++
+		}
+		if int(next) >= limit {
+			return nil, fmt.Errorf("no room for %s", k)
+		}
+		out[k] = next
+		used[next] = true
+	}
+	return out, nil
+}
+
+// sortedKeys returns the keys of a map with string keys, sorted
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch m := m.(type) {
+	case map[string]service:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]net.IP:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]uint32:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]vipEntry:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func encodeVIPKey(svc service) string {
+	b := make([]byte, 20)
+	copy(b, addrBytes(svc.ip))
+	binary.BigEndian.PutUint16(b[16:], svc.port)
+	b[18] = svc.proto
+	return hexBytes(b)
+}
+
+func encodeVIPValue(svc service, num uint32) string {
+	b := make([]byte, 8)
+	if svc.v6() {
+		binary.LittleEndian.PutUint32(b, flagV6)
+	}
+	binary.LittleEndian.PutUint32(b[4:], num)
+	return hexBytes(b)
+}
+
+func encodeReal(ip net.IP) string {
+	b := make([]byte, 20)
+	copy(b, addrBytes(ip))
+	if ip.To4() == nil {
+		b[16] = flagV6
+	}
+	return hexBytes(b)
+}
+
+func encodeU32(n uint32) string {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, n)
+	return hexBytes(b)
+}
+
+// addrBytes returns a v4 address as its 4 bytes, and a v6 address as its 16
+func addrBytes(ip net.IP) []byte {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+// hexBytes renders b the way bpftool takes keys and values, i.e. `hex 0a 00 00 01`
+func hexBytes(b []byte) string {
+	out := make([]string, 0, len(b)+1)
+	out = append(out, "hex")
+	for _, c := range b {
+		out = append(out, fmt.Sprintf("%02x", c))
+	}
+	return strings.Join(out, " ")
+}
+
+func isPrime(n int) bool {
+	if n < 2 {
+		return false
+	}
+	for d := 2; d*d <= n; d++ {
+		if n%d == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+package xdp
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Comcast/Ravel/pkg/system"
+)
+
+func TestMaglevRing(t *testing.T) {
+	const size = 65537
+	backends := []maglevBackend{
+		{real: 1, key: "10.0.0.1", weight: 1},
+		{real: 2, key: "10.0.0.2", weight: 1},
+		{real: 3, key: "10.0.0.3", weight: 2},
+		{real: 4, key: "10.0.0.4", weight: 0},
+	}
+	ring := maglevRing(backends, size)
+
+	counts := map[uint32]int{}
+	for _, real := range ring {
+		counts[real]++
+	}
+	if counts[0] != 0 || counts[4] != 0 {
+		t.Fatalf("expected every slot to hold a weighted real, got %v", counts)
+	}
+	// weight 2 should hold about half of the ring, the others a quarter each
+	if counts[3] < size*45/100 || counts[3] > size*55/100 || counts[1] < size*20/100 || counts[2] < size*20/100 {
+		t.Fatalf("ring isn't divided by weight: %v", counts)
+	}
+
+	// the order reals are given in doesn't matter
+	reversed := []maglevBackend{backends[3], backends[2], backends[1], backends[0]}
+	for n, real := range maglevRing(reversed, size) {
+		if ring[n] != real {
+			t.Fatalf("slot %d differs when reals are reordered", n)
+		}
+	}
+
+	// removing a real mostly moves only its own slots
+	without := maglevRing(backends[1:], size)
+	moved := 0
+	for n := range ring {
+		if ring[n] != 1 && ring[n] != without[n] {
+			moved++
+		}
+	}
+	if moved > size/10 {
+		t.Fatalf("removing a real moved %d other slots", moved)
+	}
+
+	for _, real := range maglevRing(nil, 7) {
+		if real != 0 {
+			t.Fatalf("expected an empty ring without reals")
+		}
+	}
+}
+
+func TestPlane(t *testing.T) {
+	plane, err := New(Config{Interface: "eth0", Object: "ravel.o", RingSize: 7, MaxVIPs: 2}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := system.NewRecordingCommandRunner()
+	plane.SetCommandRunner(runner)
+	ctx := context.Background()
+
+	if err := plane.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if lines := runner.CommandLines(); len(lines) != 1 || lines[0] != "bpftool version" {
+		t.Fatalf("expected bpftool to be checked. have %v", lines)
+	}
+	runner.Commands = nil
+
+	if err := plane.Attach(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"rm -rf /sys/fs/bpf/ravel",
+		"bpftool prog load ravel.o /sys/fs/bpf/ravel/prog type xdp pinmaps /sys/fs/bpf/ravel",
+		"bpftool net attach xdpdrv pinned /sys/fs/bpf/ravel/prog dev eth0 overwrite",
+	}
+	if strings.Join(runner.CommandLines(), "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected attach commands\n%s", strings.Join(runner.CommandLines(), "\n"))
+	}
+
+	rules := strings.Join([]string{
+		"-A -t 10.1.2.3:80 -s wrr",
+		"-a -t 10.1.2.3:80 -r 10.0.0.1:80 -g -w 1",
+		"-A -f 5 -s wrr",
+	}, "\n")
+	runner.Commands = nil
+	if _, err := plane.Run(ctx, []byte(rules), "ipvsadm", "-R"); err != nil {
+		t.Fatal(err)
+	}
+	if len(runner.Commands) != 1 || runner.Commands[0].String() != "bpftool batch file -" {
+		t.Fatalf("expected a single batch, got %v", runner.CommandLines())
+	}
+	batch := strings.Split(strings.TrimSpace(runner.Commands[0].Stdin), "\n")
+	// the real, seven ring slots and finally the vip
+	if len(batch) != 9 {
+		t.Fatalf("expected 9 map updates, got %d\n%s", len(batch), strings.Join(batch, "\n"))
+	}
+	if batch[0] != "map update pinned /sys/fs/bpf/ravel/reals key hex 01 00 00 00 value hex 0a 00 00 01 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00" {
+		t.Fatalf("unexpected real entry %s", batch[0])
+	}
+	if batch[1] != "map update pinned /sys/fs/bpf/ravel/ch_rings key hex 00 00 00 00 value hex 01 00 00 00" {
+		t.Fatalf("unexpected ring entry %s", batch[1])
+	}
+	if batch[8] != "map update pinned /sys/fs/bpf/ravel/vips key hex 0a 01 02 03 00 00 00 00 00 00 00 00 00 00 00 00 00 50 06 00 value hex 00 00 00 00 00 00 00 00" {
+		t.Fatalf("unexpected vip entry %s", batch[8])
+	}
+
+	out, err := plane.Run(ctx, nil, "ipvsadm", "-Sn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "-a -t 10.1.2.3:80 -r 10.0.0.1:80 -g -w 1") {
+		t.Fatalf("expected the rules to be listed, got\n%s", out)
+	}
+
+	// an unchanged weight writes nothing
+	runner.Commands = nil
+	if _, err := plane.Run(ctx, []byte("-e -t 10.1.2.3:80 -r 10.0.0.1:80 -g -w 1"), "ipvsadm", "-R"); err != nil {
+		t.Fatal(err)
+	}
+	if len(runner.Commands) != 0 {
+		t.Fatalf("expected no writes, got %v", runner.CommandLines())
+	}
+
+	// maintenance takes the vip out of the maps
+	if err := plane.Exclude(ctx, []string{"10.1.2.3"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(runner.Commands) != 1 || !strings.HasPrefix(runner.Commands[0].Stdin, "map delete pinned /sys/fs/bpf/ravel/vips key hex 0a 01 02 03") {
+		t.Fatalf("expected the vip to be deleted, got %v", runner.Commands)
+	}
+
+	// a failed write leaves the rules as they were
+	runner.Respond("bpftool batch file -", "", context.DeadlineExceeded)
+	if _, err := plane.Run(ctx, []byte("-A -t 10.1.2.4:80 -s wrr"), "ipvsadm", "-R"); err == nil {
+		t.Fatal("expected the failed write to be returned")
+	}
+	if len(plane.Rules()) != 3 {
+		t.Fatalf("expected the rules to be kept, got %v", plane.Rules())
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, c := range []Config{
+		{Interface: "eth0"},
+		{Object: "ravel.o"},
+		{Interface: "eth0", Object: "ravel.o", Mode: "offload"},
+		{Interface: "eth0", Object: "ravel.o", RingSize: 65536},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Fatalf("expected %+v to be invalid", c)
+		}
+	}
+	c := Config{Interface: "eth0", Object: "ravel.o"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.RingSize != DefaultRingSize || c.PinPath != DefaultPinPath || c.Mode != ModeDriver {
+		t.Fatalf("expected defaults, got %+v", c)
+	}
+}